@@ -22,12 +22,16 @@ var debug bool
 var test bool
 var addr string
 var op string
+var privileged bool
+var tenant string
 
 func init() {
 	flag.BoolVar(&debug, "d", false, "debug mode")
 	flag.BoolVar(&test, "t", false, "test mode (WARNING: disables authentication)")
 	flag.StringVar(&addr, "b", "0.0.0.0:4430", "binding address:port pair")
 	flag.StringVar(&op, "o", "", "operation ((open:<volume>)|close|derive:<data>)")
+	flag.BoolVar(&privileged, "p", false, "privileged helper mode (requires privsep_socket, privsep_user)")
+	flag.StringVar(&tenant, "n", "", "tenant name (see tenants)")
 
 	log.SetOutput(os.Stdout)
 }
@@ -47,11 +51,7 @@ func main() {
 	conf.TestMode = test
 	conf.BindAddress = addr
 
-	if op == "" {
-		if os.Geteuid() == 0 {
-			log.Fatal("Please do not run this application with administrative privileges")
-		}
-
+	if op == "" && !privileged {
 		if conf.TestMode {
 			log.Println("*** WARNING *** authentication disabled (test mode switch enabled)")
 		}
@@ -79,6 +79,29 @@ func main() {
 		}
 	}
 
+	if err := conf.SetEnv(os.Environ()); err != nil {
+		log.Fatal(err)
+	}
+
+	// containers commonly lack unprivileged users and sudo
+	if op == "" && !privileged && !conf.Container && os.Geteuid() == 0 {
+		log.Fatal("Please do not run this application with administrative privileges")
+	}
+
+	if tenant != "" {
+		if err := conf.SetTenant(tenant); err != nil {
+			log.Fatal(err)
+		}
+
+		log.SetPrefix(tenant + ": ")
+	} else if op == "" && !privileged && len(conf.Tenants) > 0 {
+		log.Fatal(interlock.ServeTenants(*configPath))
+	}
+
+	if privileged {
+		log.Fatal(interlock.ServePrivileged())
+	}
+
 	err := conf.SetMountPoint()
 
 	if err != nil {
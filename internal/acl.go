@@ -0,0 +1,466 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/syslog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Per-directory access control lists, stored on the encrypted volume, map
+// principals to directory permissions. The most specific directory with an
+// ACL applies to each path, paths without any applicable ACL are unrestricted.
+//
+// Principals are expressed as "user:<name>", "role:<name>" or "*" (any),
+// the authenticated volume session is user and role "admin", guest sessions
+// are identified by their username and role.
+//
+// Permissions are a combination of "r" (read), "w" (write) and "d" (delete).
+//
+// Every authenticated API method must be listed in aclRequests, unlisted ones
+// are denied. Request paths are checked both as given and with symbolic links
+// resolved, so that a link cannot grant access to a restricted directory.
+
+const aclFile = ".interlock-acl.json"
+
+const (
+	aclRead   = "r"
+	aclWrite  = "w"
+	aclDelete = "d"
+)
+
+// maximum request body read for path extraction
+const aclMaxBody = 64 * 1024 * 1024
+
+// permissions required by each API method on its path attributes, methods
+// without path attributes are listed with no requirement
+var aclRequests = map[string]map[string]string{
+	"/api/auth/logout":                {},
+	"/api/auth/poweroff":              {},
+	"/api/auth/nonce":                 {},
+	"/api/luks/change":                {},
+	"/api/luks/add":                   {},
+	"/api/luks/remove":                {},
+	"/api/config/time":                {},
+	"/api/config/readonly":            {},
+	"/api/config/network/scan":        {},
+	"/api/config/network/list":        {},
+	"/api/config/network/join":        {},
+	"/api/config/network/forget":      {},
+	"/api/acl/list":                   {},
+	"/api/acl/set":                    {},
+	"/api/honeytoken/list":            {},
+	"/api/honeytoken/add":             {"path": aclWrite},
+	"/api/honeytoken/remove":          {"path": aclWrite},
+	"/api/guest/create":               {"path": aclRead},
+	"/api/guest/list":                 {},
+	"/api/guest/revoke":               {},
+	"/api/escrow/provision":           {},
+	"/api/deposit/list":               {},
+	"/api/deposit/ingest":             {},
+	"/api/file/list":                  {"path": aclRead},
+	"/api/file/download":              {"path": aclRead},
+	"/api/file/downloads":             {},
+	"/api/file/preview":               {"path": aclRead},
+	"/api/file/upload":                {"path": aclWrite},
+	"/api/file/camera":                {"path": aclWrite},
+	"/api/file/delete":                {"path": aclDelete},
+	"/api/file/move":                  {"src": aclDelete, "dst": aclWrite},
+	"/api/file/copy":                  {"src": aclRead, "dst": aclWrite},
+	"/api/file/new":                   {"path": aclWrite},
+	"/api/file/mkdir":                 {"path": aclWrite},
+	"/api/file/extract":               {"src": aclRead, "dst": aclWrite},
+	"/api/file/compress":              {"src": aclRead, "dst": aclWrite},
+	"/api/file/encrypt":               {"src": aclRead + aclWrite, "key": aclRead, "sig_key": aclRead},
+	"/api/file/decrypt":               {"src": aclRead + aclWrite, "key": aclRead, "sig_key": aclRead},
+	"/api/file/rewrap":                {"src": aclRead, "dst": aclWrite, "key": aclRead, "recipient": aclRead},
+	"/api/file/migrate":               {"path": aclRead + aclWrite},
+	"/api/file/sign":                  {"src": aclRead + aclWrite, "key": aclRead},
+	"/api/file/verify":                {"src": aclRead, "sig": aclRead, "key": aclRead},
+	"/api/file/lock":                  {"path": aclWrite},
+	"/api/file/unlock":                {"path": aclWrite},
+	"/api/file/sync":                  {"path": aclRead + aclWrite},
+	"/api/file/export":                {"src": aclRead, "dst": aclWrite, "key": aclRead, "sig_key": aclRead},
+	"/api/file/import":                {"src": aclRead, "dst": aclWrite, "key": aclRead, "sig_key": aclRead},
+	"/api/file/pdf":                   {"src": aclRead, "dst": aclWrite},
+	"/api/file/sanitize":              {"src": aclRead + aclWrite},
+	"/api/clipboard/cut":              {"path": aclDelete},
+	"/api/clipboard/copy":             {"path": aclRead},
+	"/api/clipboard/paste":            {"dst": aclWrite},
+	"/api/clipboard/list":             {},
+	"/api/clipboard/clear":            {},
+	"/api/crypto/ciphers":             {},
+	"/api/crypto/keys":                {},
+	"/api/crypto/gen_key":             {},
+	"/api/crypto/upload_key":          {},
+	"/api/crypto/key_info":            {"path": aclRead},
+	"/api/crypto/revocation":          {"path": aclRead},
+	"/api/crypto/revoke_key":          {"path": aclWrite},
+	"/api/crypto/hierarchy":           {},
+	"/api/transcript/list":            {},
+	"/api/transcript/export":          {"dst": aclWrite, "key": aclRead},
+	"/api/journal/list":               {},
+	"/api/journal/resolve":            {},
+	"/api/status/version":             {},
+	"/api/status/running":             {},
+	"/api/status/history":             {},
+	"/api/status/sensors":             {},
+	"/api/status/measurements":        {},
+	"/api/status/measurements/accept": {},
+}
+
+type principal struct {
+	User string
+	Role string
+}
+
+var adminPrincipal = principal{User: "admin", Role: "admin"}
+
+type aclStore struct {
+	sync.Mutex
+	// directory -> principal -> permissions
+	entries map[string]map[string]string
+}
+
+var acls aclStore
+
+func aclPath() string {
+	return filepath.Join(conf.MountPoint, aclFile)
+}
+
+// requestPaths returns the path attributes of a request, restoring the
+// consumed request body.
+func requestPaths(w http.ResponseWriter, r *http.Request) (paths map[string][]string, err error) {
+	paths = make(map[string][]string)
+
+	switch r.RequestURI {
+	case "/api/file/upload":
+		fileName, err := url.QueryUnescape(r.Header.Get("X-Uploadfilename"))
+
+		if err != nil {
+			return nil, err
+		}
+
+		paths["path"] = []string{fileName}
+
+		return paths, nil
+	case "/api/file/camera":
+		paths["path"] = []string{conf.CameraPath}
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, aclMaxBody))
+
+	if err != nil {
+		return
+	}
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	var req map[string]interface{}
+
+	if err = json.Unmarshal(body, &req); err != nil {
+		return
+	}
+
+	for _, attr := range []string{"path", "src", "dst", "sig", "key", "sig_key", "recipient"} {
+		var values []interface{}
+
+		switch v := req[attr].(type) {
+		case nil:
+			continue
+		case []interface{}:
+			values = v
+		default:
+			values = []interface{}{v}
+		}
+
+		for _, v := range values {
+			s, ok := v.(string)
+
+			if !ok {
+				return nil, fmt.Errorf("invalid %s attribute", attr)
+			}
+
+			// unset optional paths (e.g. password based keys)
+			if s == "" && attr != "path" {
+				continue
+			}
+
+			paths[attr] = append(paths[attr], s)
+		}
+	}
+
+	return
+}
+
+// load reads the ACL store from the encrypted volume when not cached.
+func (a *aclStore) load() (err error) {
+	if a.entries != nil {
+		return
+	}
+
+	a.entries = make(map[string]map[string]string)
+	buf, err := volumeJail().ReadFile(aclPath())
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return
+	}
+
+	return json.Unmarshal(buf, &a.entries)
+}
+
+func (a *aclStore) save() (err error) {
+	buf, err := json.MarshalIndent(a.entries, "", "\t")
+
+	if err != nil {
+		return
+	}
+
+	tmp := aclPath() + ".tmp"
+
+	if err = volumeJail().WriteFile(tmp, buf, 0600); err != nil {
+		return
+	}
+
+	return volumeJail().Rename(tmp, aclPath())
+}
+
+// Set assigns principal permissions on a directory, empty permissions remove
+// the entry.
+func (a *aclStore) Set(dir string, name string, perms string) (err error) {
+	if name != "*" && !strings.HasPrefix(name, "user:") && !strings.HasPrefix(name, "role:") {
+		return errors.New("invalid principal")
+	}
+
+	for _, p := range perms {
+		if !strings.ContainsRune(aclRead+aclWrite+aclDelete, p) {
+			return fmt.Errorf("invalid permission %c", p)
+		}
+	}
+
+	dir = path.Clean("/" + dir)
+
+	a.Lock()
+	defer a.Unlock()
+
+	if err = a.load(); err != nil {
+		return
+	}
+
+	if perms == "" {
+		delete(a.entries[dir], name)
+
+		if len(a.entries[dir]) == 0 {
+			delete(a.entries, dir)
+		}
+	} else {
+		if a.entries[dir] == nil {
+			a.entries[dir] = make(map[string]string)
+		}
+
+		a.entries[dir][name] = perms
+	}
+
+	if err = a.save(); err != nil {
+		return
+	}
+
+	status.Log(syslog.LOG_NOTICE, "ACL for %s set to %s:%q", dir, name, perms)
+
+	return
+}
+
+// permissions returns the permissions granted to the principal on the
+// argument path, restricted is false if no ACL applies.
+func (a *aclStore) permissions(p string, who principal) (perms string, restricted bool) {
+	for dir := path.Clean("/" + p); ; dir = path.Dir(dir) {
+		if entry, ok := a.entries[dir]; ok {
+			for _, name := range []string{"user:" + who.User, "role:" + who.Role, "*"} {
+				if perms, ok = entry[name]; ok {
+					break
+				}
+			}
+
+			return perms, true
+		}
+
+		if dir == "/" {
+			return "", false
+		}
+	}
+}
+
+// Check verifies the principal permissions for all request paths, methods
+// not listed in aclRequests are denied.
+func (a *aclStore) Check(w http.ResponseWriter, r *http.Request, who principal) (err error) {
+	required, ok := aclRequests[r.RequestURI]
+
+	if !ok {
+		return errors.New("access denied")
+	}
+
+	if len(required) == 0 {
+		return
+	}
+
+	paths, err := requestPaths(w, r)
+
+	if err != nil {
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	if err = a.load(); err != nil {
+		return
+	}
+
+	for attr, list := range paths {
+		for _, p := range list {
+			resolved, err := resolvePath(p)
+
+			if err != nil {
+				return err
+			}
+
+			for _, c := range []string{path.Clean("/" + p), resolved} {
+				if c == "/"+aclFile || c == "/"+honeytokenFile {
+					return errors.New("access denied")
+				}
+
+				perms, restricted := a.permissions(c, who)
+
+				if !restricted {
+					continue
+				}
+
+				for _, perm := range required[attr] {
+					if !strings.ContainsRune(perms, perm) {
+						return fmt.Errorf("access denied to %s", p)
+					}
+				}
+			}
+		}
+	}
+
+	return
+}
+
+// resolvePath returns the volume relative path of p with symbolic links
+// resolved.
+func resolvePath(p string) (resolved string, err error) {
+	osPath, err := absolutePath(p)
+
+	if err != nil {
+		return
+	}
+
+	if osPath, err = volumeJail().Resolve(osPath); err != nil {
+		return
+	}
+
+	return path.Clean("/" + relativePath(osPath)), nil
+}
+
+func (a *aclStore) Reset() {
+	a.Lock()
+	defer a.Unlock()
+
+	a.entries = nil
+}
+
+type aclEntry struct {
+	Path        string `json:"path"`
+	Principal   string `json:"principal"`
+	Permissions string `json:"perms"`
+}
+
+func (a *aclStore) List() (list []aclEntry, err error) {
+	a.Lock()
+	defer a.Unlock()
+
+	if err = a.load(); err != nil {
+		return
+	}
+
+	list = []aclEntry{}
+
+	for dir, entry := range a.entries {
+		for name, perms := range entry {
+			list = append(list, aclEntry{dir, name, perms})
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Path == list[j].Path {
+			return list[i].Principal < list[j].Principal
+		}
+
+		return list[i].Path < list[j].Path
+	})
+
+	return
+}
+
+func aclList() (res jsonObject) {
+	list, err := acls.List()
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	return jsonObject{
+		"status":   "OK",
+		"response": list,
+	}
+}
+
+func aclSet(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = acls.Set(req["path"].(string), req["principal"].(string), req["perms"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	return jsonObject{
+		"status":   "OK",
+		"response": nil,
+	}
+}
+
+// denyRequest replies to requests rejected before dispatching.
+func denyRequest(w http.ResponseWriter, r *http.Request, err error) {
+	if r.RequestURI == "/api/file/upload" {
+		http.Error(w, err.Error(), http.StatusForbidden)
+	} else {
+		sendResponse(w, localize(errorResponse(err, ""), r))
+	}
+}
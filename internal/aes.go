@@ -257,7 +257,7 @@ func decryptOFB(key []byte, salt []byte, iv []byte, input *os.File, output *os.F
 		return
 	}
 
-	if !hmac.Equal(inputMac, mac.Sum(nil)) {
+	if !secretEqualBytes(inputMac, mac.Sum(nil)) {
 		return errors.New("invalid HMAC")
 	}
 
@@ -0,0 +1,390 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Interoperable symmetric file encryption, files can be opened without
+// INTERLOCK using standard command line tools. Two formats are produced, the
+// format of decrypted files is detected from their header so that either
+// cipher opens both.
+//
+// AES-256-OPENSSL, equivalent to `openssl enc -aes-256-cbc -pbkdf2` (OpenSSL
+// >= 1.1.1), key and iv are derived from password using PBKDF2 with SHA256 and
+// 10000 rounds (unless configured otherwise, see aesCompatOptions), the
+// ciphertext is PKCS#7 padded and not authenticated:
+//
+// "Salted__" || salt (8 bytes) || ciphertext
+//
+//	openssl enc -d -aes-256-cbc -pbkdf2 -md sha256 -iter 10000 -in <file>
+//
+// AES-256-GPG, equivalent to `gpg --symmetric --cipher-algo AES256`, an
+// OpenPGP message (RFC 4880) with iterated and salted S2K (SHA256) and
+// integrity protected data packet:
+//
+//	gpg --decrypt <file>
+
+const (
+	aesCompatOpenSSL = "openssl"
+	aesCompatGPG     = "gpg"
+)
+
+const openSSLMagic = "Salted__"
+const openSSLSaltSize = 8
+const openSSLIterations = 10000
+
+type aesCompat struct {
+	info     cipherInfo
+	format   string
+	options  aesCompatOptions
+	password string
+
+	cipherInterface
+}
+
+// aesCompatOptions are the "cipher_options" of the interoperable ciphers,
+// iterations are the PBKDF2 rounds (openssl, which must then be decrypted with
+// `-iter`) or the S2K count (gpg), compression (zlib level 1-9) applies to gpg
+// only.
+type aesCompatOptions struct {
+	Iterations  int `json:"iterations"`
+	Compression int `json:"compression"`
+}
+
+func init() {
+	conf.SetAvailableCipher((&aesCompat{format: aesCompatOpenSSL}).Init())
+	conf.SetAvailableCipher((&aesCompat{format: aesCompatGPG}).Init())
+}
+
+func (a *aesCompat) Init() cipherInterface {
+	switch a.format {
+	case aesCompatOpenSSL:
+		a.info = cipherInfo{
+			Name:        "AES-256-OPENSSL",
+			Description: "AES CBC w/ 256 bit key derived using PBKDF2 (openssl enc compatible)",
+			Extension:   "enc",
+		}
+	case aesCompatGPG:
+		a.info = cipherInfo{
+			Name:        "AES-256-GPG",
+			Description: "OpenPGP symmetric AES w/ 256 bit key (gpg --symmetric compatible)",
+			Extension:   "gpg",
+		}
+	}
+
+	a.info.KeyFormat = "password"
+	a.info.Enc = true
+	a.info.Dec = true
+
+	return a
+}
+
+func (a *aesCompat) New() cipherInterface {
+	return (&aesCompat{format: a.format, options: a.options}).Init()
+}
+
+func (a *aesCompat) Configure(options json.RawMessage) (err error) {
+	opts := aesCompatOptions{}
+
+	if err = parseCipherOptions(options, &opts); err != nil {
+		return
+	}
+
+	switch a.format {
+	case aesCompatOpenSSL:
+		if opts.Iterations == 0 {
+			opts.Iterations = openSSLIterations
+		}
+
+		if opts.Iterations < 1000 {
+			return fmt.Errorf("invalid iterations %d", opts.Iterations)
+		}
+
+		if opts.Compression != 0 {
+			return errors.New("compression not supported")
+		}
+	case aesCompatGPG:
+		// S2K counts are encoded with limited precision
+		if opts.Iterations != 0 && (opts.Iterations < 1024 || opts.Iterations > 65011712) {
+			return fmt.Errorf("invalid iterations %d", opts.Iterations)
+		}
+
+		if opts.Compression < 0 || opts.Compression > 9 {
+			return fmt.Errorf("invalid compression level %d", opts.Compression)
+		}
+	}
+
+	a.options = opts
+
+	return
+}
+
+func (a *aesCompat) Activate(activate bool) (err error) {
+	// no activation required
+	return
+}
+
+func (a *aesCompat) GetInfo() cipherInfo {
+	return a.info
+}
+
+func (a *aesCompat) SetPassword(password string) (err error) {
+	if len(password) < 8 {
+		return errors.New("password < 8 characters")
+	}
+
+	a.password = password
+
+	return
+}
+
+func (a *aesCompat) Encrypt(input *os.File, output *os.File, sign bool) (err error) {
+	if sign {
+		return errors.New("symmetric cipher does not support signing")
+	}
+
+	if a.format == aesCompatGPG {
+		return encryptGPG(a.password, a.options, input, output)
+	}
+
+	return encryptOpenSSL(a.password, a.options.Iterations, input, output)
+}
+
+// Decrypt detects the file format from its header.
+func (a *aesCompat) Decrypt(input *os.File, output *os.File, verify bool) (err error) {
+	if verify {
+		return errors.New("symmetric cipher does not support signature verification")
+	}
+
+	reader := bufio.NewReader(input)
+	magic, err := reader.Peek(len(openSSLMagic))
+
+	if err == nil && string(magic) == openSSLMagic {
+		return decryptOpenSSL(a.password, a.options.Iterations, reader, output)
+	}
+
+	return decryptGPG(a.password, reader, output)
+}
+
+func openSSLKey(password string, salt []byte, iterations int) (key []byte, iv []byte) {
+	if iterations == 0 {
+		iterations = openSSLIterations
+	}
+
+	k := pbkdf2.Key([]byte(password), salt, iterations, 32+aes.BlockSize, sha256.New)
+	return k[0:32], k[32:]
+}
+
+func encryptOpenSSL(password string, iterations int, input io.Reader, output io.Writer) (err error) {
+	salt := make([]byte, openSSLSaltSize)
+
+	if _, err = io.ReadFull(rand.Reader, salt); err != nil {
+		return
+	}
+
+	key, iv := openSSLKey(password, salt, iterations)
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return
+	}
+
+	if _, err = output.Write(append([]byte(openSSLMagic), salt...)); err != nil {
+		return
+	}
+
+	mode := cipher.NewCBCEncrypter(block, iv)
+	buf := make([]byte, 32*1024)
+
+	for {
+		n, e := io.ReadFull(input, buf)
+
+		if e != nil && e != io.EOF && e != io.ErrUnexpectedEOF {
+			return e
+		}
+
+		last := e != nil
+		chunk := buf[:n]
+
+		if last {
+			// PKCS#7 padding
+			padding := aes.BlockSize - n%aes.BlockSize
+			chunk = append(chunk, bytes.Repeat([]byte{byte(padding)}, padding)...)
+		}
+
+		mode.CryptBlocks(chunk, chunk)
+
+		if _, err = output.Write(chunk); err != nil {
+			return
+		}
+
+		if last {
+			return
+		}
+	}
+}
+
+func decryptOpenSSL(password string, iterations int, input io.Reader, output io.Writer) (err error) {
+	header := make([]byte, len(openSSLMagic)+openSSLSaltSize)
+
+	if _, err = io.ReadFull(input, header); err != nil {
+		return
+	}
+
+	key, iv := openSSLKey(password, header[len(openSSLMagic):], iterations)
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return
+	}
+
+	mode := cipher.NewCBCDecrypter(block, iv)
+	buf := make([]byte, 32*1024)
+	var pending []byte
+
+	for {
+		n, e := io.ReadFull(input, buf)
+
+		if e != nil && e != io.EOF && e != io.ErrUnexpectedEOF {
+			return e
+		}
+
+		if n%aes.BlockSize != 0 {
+			return errors.New("invalid ciphertext length")
+		}
+
+		chunk := buf[:n]
+		mode.CryptBlocks(chunk, chunk)
+
+		// the last block is held back until padding removal
+		if _, err = output.Write(pending); err != nil {
+			return
+		}
+
+		pending = append(pending[:0], chunk...)
+
+		if e != nil {
+			break
+		}
+	}
+
+	if len(pending) == 0 {
+		return errors.New("invalid ciphertext length")
+	}
+
+	padding := int(pending[len(pending)-1])
+
+	if padding == 0 || padding > aes.BlockSize || padding > len(pending) ||
+		!bytes.Equal(pending[len(pending)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return errors.New("invalid password or padding")
+	}
+
+	_, err = output.Write(pending[:len(pending)-padding])
+
+	return
+}
+
+func encryptGPG(password string, options aesCompatOptions, input io.Reader, output io.Writer) (err error) {
+	config := &packet.Config{
+		DefaultCipher: packet.CipherAES256,
+		DefaultHash:   crypto.SHA256,
+		S2KCount:      options.Iterations,
+	}
+
+	if options.Compression > 0 {
+		config.DefaultCompressionAlgo = packet.CompressionZLIB
+		config.CompressionConfig = &packet.CompressionConfig{Level: options.Compression}
+	}
+
+	hints := &openpgp.FileHints{IsBinary: true}
+	plaintext, err := openpgp.SymmetricallyEncrypt(output, []byte(password), hints, config)
+
+	if err != nil {
+		return
+	}
+
+	if _, err = io.Copy(plaintext, input); err != nil {
+		return
+	}
+
+	return plaintext.Close()
+}
+
+func decryptGPG(password string, input io.Reader, output io.Writer) (err error) {
+	tried := false
+
+	prompt := func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+		if !symmetric || tried {
+			return nil, errors.New("invalid password")
+		}
+
+		tried = true
+
+		return []byte(password), nil
+	}
+
+	md, err := openpgp.ReadMessage(input, nil, prompt, nil)
+
+	if err != nil {
+		return
+	}
+
+	// integrity protection is verified on EOF
+	_, err = io.Copy(output, md.UnverifiedBody)
+
+	return
+}
+
+func (a *aesCompat) GenKey(i string, e string) (p string, s string, err error) {
+	err = errors.New("symmetric cipher does not support key generation")
+	return
+}
+
+func (a *aesCompat) GetKeyInfo(k key) (i string, err error) {
+	err = errors.New("symmetric cipher does not support key")
+	return
+}
+
+func (a *aesCompat) SetKey(k key) error {
+	return errors.New("symmetric cipher does not support key")
+}
+
+func (a *aesCompat) Sign(i *os.File, o *os.File) error {
+	return errors.New("symmetric cipher does not support signing")
+}
+
+func (a *aesCompat) Verify(i *os.File, s *os.File) error {
+	return errors.New("symmetric cipher does not support signature verification")
+}
+
+func (a *aesCompat) GenOTP(timestamp int64) (otp string, exp int64, err error) {
+	err = errors.New("cipher does not support OTP generation")
+	return
+}
+
+func (a *aesCompat) HandleRequest(r *http.Request) (res jsonObject) {
+	res = notFound()
+	return
+}
@@ -0,0 +1,120 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// produced with:
+//
+//	openssl enc -aes-256-cbc -pbkdf2 -md sha256 -iter 10000 -pass pass:interlocktest
+//	gpg --symmetric --cipher-algo AES256 --passphrase interlocktest
+var aesCompatVectors = []string{
+	"U2FsdGVkX1/La86AEpbiz0bZVZYSkwliIhbnNxK6MJvDD6q8djm+OOgvu2AjgptNtESk1yDrg44EH7c2US//9g==",
+	"jA0ECQMC87ymnCYAmtf/0l0B/R8hvf3+C0j3mWWKdmlEx+p+qxl4mna0GCaz2sLcGQv68mQv8BGJwLVTBy28hZjU9HTjwQczmBJfmV4r9HoY3FSSoEveHTbx86tM1wgTNNkjxZrBHhU0kWJB0Xo=",
+}
+
+func TestAesCompat(t *testing.T) {
+	password := "interlocktest"
+	cleartext := "01234567890ABCDEFGHILMNOPQRSTUVZ!@#"
+
+	for _, format := range []string{aesCompatOpenSSL, aesCompatGPG} {
+		input, _ := ioutil.TempFile("", "aes_compat_test_input-")
+		input.Write([]byte(cleartext))
+		input.Seek(0, 0)
+		defer os.Remove(input.Name())
+
+		ciphertext, _ := ioutil.TempFile("", "aes_compat_test_ciphertext-")
+		defer os.Remove(ciphertext.Name())
+
+		decrypted, _ := ioutil.TempFile("", "aes_compat_test_decrypted-")
+		defer os.Remove(decrypted.Name())
+
+		a := (&aesCompat{format: format}).Init()
+		a.SetPassword(password)
+
+		if err := a.Encrypt(input, ciphertext, false); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+
+		ciphertext.Seek(0, 0)
+
+		if err := a.Decrypt(ciphertext, decrypted, false); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+
+		compare, _ := ioutil.ReadFile(decrypted.Name())
+
+		if !bytes.Equal([]byte(cleartext), compare) {
+			t.Errorf("%s: cleartext and ciphertext differ", format)
+		}
+
+		// the OpenSSL format has no MAC, a wrong password passes the
+		// padding check about once in 256 attempts (see below)
+		if format == aesCompatOpenSSL {
+			continue
+		}
+
+		invalid := (&aesCompat{format: format}).Init()
+		invalid.SetPassword("invalidpassword")
+		ciphertext.Seek(0, 0)
+
+		if err := invalid.Decrypt(ciphertext, decrypted, false); err == nil {
+			t.Errorf("%s: invalid password accepted", format)
+		}
+	}
+
+	// files produced by standard tools, either cipher detects the format
+	for _, vector := range aesCompatVectors {
+		buf, _ := base64.StdEncoding.DecodeString(vector)
+
+		ciphertext, _ := ioutil.TempFile("", "aes_compat_test_vector-")
+		ciphertext.Write(buf)
+		defer os.Remove(ciphertext.Name())
+
+		decrypted, _ := ioutil.TempFile("", "aes_compat_test_decrypted-")
+		defer os.Remove(decrypted.Name())
+
+		a := (&aesCompat{format: aesCompatOpenSSL}).Init()
+		a.SetPassword(password)
+		ciphertext.Seek(0, 0)
+
+		if err := a.Decrypt(ciphertext, decrypted, false); err != nil {
+			t.Fatal(err)
+		}
+
+		compare, _ := ioutil.ReadFile(decrypted.Name())
+
+		if !bytes.Equal([]byte(cleartext), compare) {
+			t.Errorf("unexpected cleartext: %q", compare)
+		}
+	}
+
+	// the OpenSSL vector decrypted with a wrong password is known to fail
+	// the padding check
+	buf, _ := base64.StdEncoding.DecodeString(aesCompatVectors[0])
+
+	ciphertext, _ := ioutil.TempFile("", "aes_compat_test_vector-")
+	ciphertext.Write(buf)
+	ciphertext.Seek(0, 0)
+	defer os.Remove(ciphertext.Name())
+
+	decrypted, _ := ioutil.TempFile("", "aes_compat_test_decrypted-")
+	defer os.Remove(decrypted.Name())
+
+	invalid := (&aesCompat{format: aesCompatOpenSSL}).Init()
+	invalid.SetPassword("invalidpassword")
+
+	if err := invalid.Decrypt(ciphertext, decrypted, false); err == nil {
+		t.Error("openssl: invalid password accepted")
+	}
+}
@@ -7,14 +7,20 @@
 package interlock
 
 import (
+	"bytes"
 	"embed"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/fs"
 	"log"
+	"log/syslog"
 	"net/http"
 	"net/url"
+	"os"
 	"regexp"
+	"strconv"
+	"strings"
 )
 
 //go:embed static/*
@@ -22,9 +28,13 @@ var static embed.FS
 
 var URIPattern = regexp.MustCompile("/api/([A-Za-z0-9]+)/([a-z0-9_]+)")
 
+// the default HTTP multiplexer is not used to avoid exposure of handlers
+// registered by imported packages (e.g. net/http/pprof)
+var mux = http.NewServeMux()
+
 func applyHeaders(h http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Security-Policy", "default-src https:; script-src https: 'self' 'unsafe-eval' 'unsafe-inline'; style-src https: 'self' 'unsafe-inline'; img-src https: 'self'; connect-src https: 'self';")
+		w.Header().Set("Content-Security-Policy", contentSecurityPolicy())
 		w.Header().Set("Cache-Control", "no-cache, no-store, max-age=0, must-revalidate")
 		w.Header().Set("Pragma", "no-cache")
 		w.Header().Set("Expires", "Fri, 07 Jan 1981 00:00:00 GMT")
@@ -33,18 +43,46 @@ func applyHeaders(h http.Handler) http.HandlerFunc {
 	}
 }
 
+func staticRoot() (fs.FS, error) {
+	if conf.StaticPath != "" {
+		return os.DirFS(conf.StaticPath), nil
+	}
+
+	return fs.Sub(static, "static")
+}
+
 func registerHandlers() (err error) {
-	root, err := fs.Sub(static, "static")
+	root, err := staticRoot()
 
 	if err != nil {
 		return
 	}
 
-	static := http.FileServer(http.FS(root))
+	static, err := integrityHandler(root, staticHandler(root))
+
+	if err != nil {
+		return
+	}
+
+	if err = initCatalogs(); err != nil {
+		return
+	}
+
+	if err = validateUI(); err != nil {
+		return
+	}
+
+	if err = validateMount(); err != nil {
+		return
+	}
+
 	staticHandler := applyHeaders(static)
 
-	http.Handle("/", http.StripPrefix("/", staticHandler))
-	http.HandleFunc("/api/", apiHandler)
+	mux.Handle("/", http.StripPrefix("/", recoverHandler(staticHandler)))
+	mux.HandleFunc("/api/", recoverHandler(corsHandler(apiHandler)))
+	mux.HandleFunc("/healthz", recoverHandler(healthHandler))
+	mux.HandleFunc("/readyz", recoverHandler(readyHandler))
+	mux.HandleFunc("/lite", recoverHandler(liteHandler))
 
 	return
 }
@@ -56,7 +94,46 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 
+	release, err := throttle.Acquire(r, throttleOwner(r))
+
+	if err != nil {
+		busyResponse(w, r, http.StatusTooManyRequests, err)
+		return
+	}
+	defer release()
+
+	n := requestMemoryEstimate(r)
+
+	if err := memory.Reserve(n); err != nil {
+		busyResponse(w, r, http.StatusServiceUnavailable, err)
+		return
+	}
+	defer memory.Release(n)
+
+	if err := validateSchema(r); err != nil {
+		invalidRequest(w, r, err)
+		return
+	}
+
 	switch r.RequestURI {
+	case "/api/csp-report":
+		// violation reports are sent by the browser without XSRF token
+		cspReport(w, r)
+	case "/api/deposit/upload":
+		// deposits are accepted without authentication
+		depositUpload(w, r)
+	case "/api/escrow/recover":
+		// recovery contacts have no credentials for the volume
+		sendResponse(w, localize(escrowRecover(w, r), r))
+	case "/api/auth/header":
+		// detached headers are required before authentication
+		sendResponse(w, localize(headerUpload(w, r), r))
+	case "/api/status/banner":
+		// the login banner is displayed before authentication
+		sendResponse(w, localize(bannerStatus(), r))
+	case "/api/status/ui":
+		// branding is applied to the login page
+		sendResponse(w, localize(uiStatus(), r))
 	case "/api/auth/login":
 		// On a successful login the "INTERLOCK-Token" is returned as cookie via the
 		// "Set-Cookie" header in HTTP response.
@@ -64,12 +141,20 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 		// The XSRF protection token "X-SRFToken" is returned in the response payload.
 		// This token must be included by the client as HTTP header in every request to
 		// the backend.
-		sendResponse(w, login(w, r))
+		sendResponse(w, localize(login(w, r), r))
+	case "/api/auth/guest":
+		sendResponse(w, localize(guestLogin(w, r), r))
+	case "/api/auth/piv_challenge":
+		sendResponse(w, localize(pivChallenge(), r))
+	case "/api/auth/piv":
+		sendResponse(w, localize(pivLogin(w, r), r))
+	case "/api/auth/keypad":
+		sendResponse(w, localize(keypadLogin(w, r), r))
 	case "/api/auth/refresh":
 		if validSessionID, _, _ := session.Validate(r); validSessionID {
-			// The session is validated using a single session cookie, we re-send the
-			// XSRF token if authenticated user lands again on login page (e.g. different
-			// tab).
+			// The session is validated using a single session cookie, a new
+			// XSRF token is issued if authenticated user lands again on login page
+			// (e.g. different tab), invalidating the previous one.
 			sendResponse(w, refresh(w))
 		} else {
 			sendResponse(w, jsonObject{"status": "INVALID_SESSION", "response": nil})
@@ -77,8 +162,26 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 	default:
 		validSessionID, validXSRFToken, err := session.Validate(r)
 
+		if err == errSessionMoved {
+			status.Log(syslog.LOG_WARNING, "session used from %s, invalidating", r.RemoteAddr)
+			reportError("session invalidation", closeSession())
+			sendResponse(w, jsonObject{"status": "SESSION_MOVED", "response": nil})
+			break
+		}
+
 		if !(validSessionID && validXSRFToken) {
-			u, _ := url.Parse(r.RequestURI)
+			if g := guests.Validate(r, true); g != nil {
+				handleGuestRequest(w, r, g)
+				break
+			}
+
+			u, e := url.Parse(r.RequestURI)
+
+			if e != nil {
+				reportError("request parsing", e)
+				sendResponse(w, jsonObject{"status": "INVALID", "response": nil})
+				break
+			}
 
 			switch u.Path {
 			case "/api/file/upload":
@@ -87,9 +190,25 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 				// download is an exception as it is already
 				// protected from XSRF with its own unique
 				// handshake
-				if validSessionID {
-					p, _ := url.ParseQuery(u.RawQuery)
-					fileDownloadByID(w, p["id"][0])
+				if validSessionID || guests.Validate(r, false) != nil {
+					p, e := url.ParseQuery(u.RawQuery)
+
+					if e != nil || p.Get("id") == "" {
+						reportError("download request parsing", fmt.Errorf("invalid query %q: %v", u.RawQuery, e))
+						http.Error(w, "invalid download request", http.StatusBadRequest)
+						break
+					}
+
+					jobs.Do(jobOwner(r), "downloading", func() { fileDownloadByID(w, r, p.Get("id")) })
+					break
+				}
+
+				sendResponse(w, jsonObject{"status": "INVALID_SESSION", "response": nil})
+			case "/api/file/preview":
+				// signed preview URLs are embedded in the UI (e.g. <img>
+				// tags) without XSRF token
+				if validSessionID || guests.Validate(r, false) != nil {
+					jobs.Do(jobOwner(r), "previewing", func() { filePreviewByURL(w, r, u.Query()) })
 					break
 				}
 				fallthrough
@@ -97,6 +216,26 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 				sendResponse(w, jsonObject{"status": "INVALID_SESSION", "response": nil})
 			}
 		} else if validSessionID && validXSRFToken {
+			if err = acls.Check(w, r, adminPrincipal); err != nil {
+				denyRequest(w, r, err)
+				break
+			}
+
+			if tripHoneytokens(w, r, adminPrincipal) {
+				break
+			}
+
+			if oneTimeRequests[r.RequestURI] && !session.ConsumeNonce(r.RequestURI, r.Header.Get(XSRFNonceHeader)) {
+				sendResponse(w, localize(errorResponse(errors.New("missing or invalid one-time XSRF token"), "INVALID"), r))
+				break
+			}
+
+			if XSRFToken, err := session.RenewXSRFToken(); err != nil {
+				reportError("XSRF token renewal", err)
+			} else if XSRFToken != "" {
+				w.Header().Set(XSRFHeader, XSRFToken)
+			}
+
 			handleRequest(w, r)
 		} else {
 			sendResponse(w, jsonObject{"status": "INVALID_SESSION", "response": nil})
@@ -104,8 +243,86 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// writeRequests lists the API methods modifying the encrypted volume.
+var writeRequests = map[string]bool{
+	"/api/luks/change":           true,
+	"/api/luks/add":              true,
+	"/api/luks/remove":           true,
+	"/api/escrow/provision":      true,
+	"/api/file/upload":           true,
+	"/api/file/camera":           true,
+	"/api/deposit/ingest":        true,
+	"/api/file/delete":           true,
+	"/api/file/move":             true,
+	"/api/file/copy":             true,
+	"/api/file/new":              true,
+	"/api/file/mkdir":            true,
+	"/api/file/extract":          true,
+	"/api/file/compress":         true,
+	"/api/file/encrypt":          true,
+	"/api/file/decrypt":          true,
+	"/api/file/sign":             true,
+	"/api/file/rewrap":           true,
+	"/api/file/migrate":          true,
+	"/api/transcript/export":     true,
+	"/api/journal/resolve":       true,
+	"/api/file/sync":             true,
+	"/api/file/export":           true,
+	"/api/file/import":           true,
+	"/api/file/pdf":              true,
+	"/api/file/sanitize":         true,
+	"/api/clipboard/paste":       true,
+	"/api/acl/set":               true,
+	"/api/honeytoken/add":        true,
+	"/api/honeytoken/remove":     true,
+	"/api/crypto/gen_key":        true,
+	"/api/crypto/upload_key":     true,
+	"/api/crypto/revocation":     true,
+	"/api/crypto/revoke_key":     true,
+	"/api/config/network/join":   true,
+	"/api/config/network/forget": true,
+}
+
+// writeAllowed returns an error if write operations are currently disabled.
+func writeAllowed(uri string) error {
+	if !writeRequests[uri] {
+		return nil
+	}
+
+	if power.Failing() {
+		return errPowerFailure
+	}
+
+	if readOnly.Enabled() {
+		return errReadOnly
+	}
+
+	return nil
+}
+
 func handleRequest(w http.ResponseWriter, r *http.Request) {
 	var res jsonObject
+	var rotate bool
+
+	if err := writeAllowed(r.RequestURI); err != nil {
+		if r.RequestURI == "/api/file/upload" {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		} else {
+			sendResponse(w, localize(errorResponse(err, ""), r))
+		}
+
+		return
+	}
+
+	if err := clockAllowed(r.RequestURI); err != nil {
+		sendResponse(w, localize(errorResponse(err, ""), r))
+		return
+	}
+
+	migration.Touch()
+
+	body := transcriptBody(r)
+	defer func() { transcript.Record(r, body, res) }()
 
 	switch r.RequestURI {
 	case "/api/auth/logout":
@@ -115,16 +332,58 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 		defer poweroff()
 	case "/api/luks/change":
 		res = passwordRequest(r, _change)
+		rotate = true
 	case "/api/luks/add":
 		res = passwordRequest(r, _add)
+		rotate = true
 	case "/api/luks/remove":
 		res = passwordRequest(r, _remove)
+		rotate = true
 	case "/api/config/time":
 		res = timeRequest(r)
+	case "/api/config/readonly":
+		res = readOnlyRequest(r)
+	case "/api/config/network/scan":
+		res = wifiScan()
+	case "/api/config/network/list":
+		res = wifiList()
+	case "/api/config/network/join":
+		res = wifiJoin(r)
+	case "/api/config/network/forget":
+		res = wifiForget(r)
+	case "/api/acl/list":
+		res = aclList()
+	case "/api/auth/nonce":
+		res = nonceRequest(r)
+	case "/api/acl/set":
+		res = aclSet(r)
+		rotate = true
+	case "/api/honeytoken/list":
+		res = honeytokenList()
+	case "/api/honeytoken/add":
+		res = honeytokenAdd(r)
+	case "/api/honeytoken/remove":
+		res = honeytokenRemove(r)
+	case "/api/guest/create":
+		res = guestCreate(r)
+		rotate = true
+	case "/api/guest/list":
+		res = guestList()
+	case "/api/guest/revoke":
+		res = guestRevoke(r)
+		rotate = true
 	case "/api/file/list":
-		res = fileList(r)
+		jobs.Do(jobOwner(r), "listing", func() { res = fileList(w, r) })
 	case "/api/file/upload":
 		fileUpload(w, r)
+	case "/api/file/camera":
+		res = fileCamera(r)
+	case "/api/escrow/provision":
+		res = escrowProvision(r)
+	case "/api/deposit/list":
+		res = depositList()
+	case "/api/deposit/ingest":
+		res = depositIngest()
 	case "/api/file/download":
 		res = fileDownload(r)
 	case "/api/file/delete":
@@ -145,10 +404,42 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 		res = fileEncrypt(r)
 	case "/api/file/decrypt":
 		res = fileDecrypt(r)
+	case "/api/file/rewrap":
+		res = fileRewrap(r)
+	case "/api/file/migrate":
+		res = fileMigrate(r)
+	case "/api/file/downloads":
+		res = fileDownloads(r)
+	case "/api/file/preview":
+		res = filePreview(r)
 	case "/api/file/sign":
 		res = fileSign(r)
 	case "/api/file/verify":
 		res = fileVerify(r)
+	case "/api/file/lock":
+		res = fileLockRequest(r)
+	case "/api/file/unlock":
+		res = fileUnlockRequest(r)
+	case "/api/file/sync":
+		res = fileSync(r)
+	case "/api/file/export":
+		res = fileExport(r)
+	case "/api/file/import":
+		res = fileImport(r)
+	case "/api/file/pdf":
+		res = filePDF(r)
+	case "/api/file/sanitize":
+		res = fileSanitize(r)
+	case "/api/clipboard/cut":
+		res = clipboardCut(r)
+	case "/api/clipboard/copy":
+		res = clipboardCopy(r)
+	case "/api/clipboard/paste":
+		res = clipboardPaste(r)
+	case "/api/clipboard/list":
+		res = clipboardList()
+	case "/api/clipboard/clear":
+		res = clipboardClear()
 	case "/api/crypto/ciphers":
 		res = ciphers()
 	case "/api/crypto/keys":
@@ -159,10 +450,32 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 		res = uploadKey(r)
 	case "/api/crypto/key_info":
 		res = keyInfo(r)
+	case "/api/crypto/revocation":
+		res = keyRevocation(r)
+	case "/api/crypto/revoke_key":
+		res = revokeKey(r)
+	case "/api/crypto/hierarchy":
+		res = keyHierarchy()
 	case "/api/status/version":
 		res = versionStatus()
 	case "/api/status/running":
 		res = runningStatus()
+	case "/api/transcript/list":
+		res = transcriptList()
+	case "/api/transcript/export":
+		res = transcriptExport(r)
+	case "/api/journal/list":
+		res = journalList()
+	case "/api/journal/resolve":
+		res = journalResolve(r)
+	case "/api/status/history":
+		res = historyRequest(r)
+	case "/api/status/sensors":
+		res = sensorsStatus()
+	case "/api/status/measurements":
+		res = measurementsReport()
+	case "/api/status/measurements/accept":
+		res = acceptMeasurements()
 	default:
 		m := URIPattern.FindStringSubmatch(r.RequestURI)
 
@@ -179,8 +492,25 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if rotate {
+		// privilege-sensitive operations invalidate the current XSRF
+		// token, the new one is returned in the response header
+		XSRFToken, err := session.RotateXSRFToken()
+
+		if err != nil {
+			// never keep using a token which should have been
+			// invalidated, the session is closed instead
+			reportError("XSRF token rotation", err)
+			session.Clear()
+			http.Error(w, "XSRF token rotation failed", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set(XSRFHeader, XSRFToken)
+	}
+
 	if res != nil {
-		sendResponse(w, res)
+		sendResponse(w, localize(res, r))
 	}
 }
 
@@ -195,10 +525,8 @@ func passwordRequest(r *http.Request, mode int) (res jsonObject) {
 
 	switch mode {
 	case _change, _add:
-		err = validateRequest(req, []string{"volume:s", "password:s", "newpassword:s"})
 		newPassword = req["newpassword"].(string)
 	case _remove:
-		err = validateRequest(req, []string{"volume:s", "password:s"})
 	default:
 		err = errors.New("unsupported operation")
 	}
@@ -207,7 +535,7 @@ func passwordRequest(r *http.Request, mode int) (res jsonObject) {
 		return errorResponse(err, "")
 	}
 
-	err = keyOp(req["volume"].(string), req["password"].(string), newPassword, mode)
+	err = keyOp(r.Context(), req["volume"].(string), req["password"].(string), newPassword, mode)
 
 	if err != nil {
 		return errorResponse(err, "")
@@ -231,11 +559,38 @@ func notFound() (res jsonObject) {
 }
 
 func sendResponse(w http.ResponseWriter, res jsonObject) {
+	writeResponse(w, http.StatusOK, res)
+}
+
+// writeResponse encodes the response object before writing it, the client
+// therefore always receives valid JSON with a matching Content-Length, values
+// which cannot be encoded result in an internal error response.
+func writeResponse(w http.ResponseWriter, code int, res jsonObject) {
+	buf := new(bytes.Buffer)
+
+	if err := json.NewEncoder(buf).Encode(res); err != nil {
+		reportError("response encoding", err)
+
+		code = http.StatusInternalServerError
+		buf.Reset()
+
+		_ = json.NewEncoder(buf).Encode(jsonObject{
+			"status":   "KO",
+			"response": []string{"response encoding error"},
+		})
+	}
+
 	if conf.Debug {
-		log.Print(res.String())
+		log.Print(strings.TrimSpace(buf.String()))
 	}
 
-	fmt.Fprint(w, res.String())
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(code)
+
+	if _, err := buf.WriteTo(w); err != nil {
+		reportError("response write", err)
+	}
 }
 
 func errorResponse(err error, statusCode string) (res jsonObject) {
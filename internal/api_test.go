@@ -0,0 +1,2207 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"log/syslog"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+const testVolume = "encryptedfs"
+const testPassword = "interlocktest"
+const testCleartext = "01234567890ABCDEFGHILMNOPQRSTUVZ!@#"
+
+var registerOnce sync.Once
+
+type apiClient struct {
+	t         *testing.T
+	srv       *httptest.Server
+	client    *http.Client
+	XSRFToken string
+}
+
+func newTestServer(t *testing.T) (c *apiClient) {
+	mountPoint, err := ioutil.TempDir("", "interlock_test-")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(mountPoint) })
+
+	log.SetOutput(ioutil.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stdout) })
+
+	conf.SetDefaults()
+	conf.Debug = true
+	conf.TLS = "off"
+	conf.MountPoint = mountPoint
+	conf.HSM = "mock:cipher"
+	conf.WatchdogInterval = 0
+	conf.SetVolume(newMockVolume(testVolume, testPassword))
+	conf.SetAvailableHSM("mock", new(mockHSM))
+
+	if err = conf.EnableCiphers(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = conf.EnableHSM(); err != nil {
+		t.Fatal(err)
+	}
+
+	registerOnce.Do(func() {
+		err = registerHandlers()
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jar, _ := cookiejar.New(nil)
+
+	c = &apiClient{
+		t:      t,
+		srv:    httptest.NewServer(mux),
+		client: &http.Client{Jar: jar},
+	}
+
+	t.Cleanup(c.srv.Close)
+
+	return
+}
+
+func (c *apiClient) request(method string, uri string, header map[string]string, body []byte) (res *http.Response) {
+	req, err := http.NewRequest(method, c.srv.URL+uri, bytes.NewReader(body))
+
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	if c.XSRFToken != "" {
+		req.Header.Set(XSRFHeader, c.XSRFToken)
+	}
+
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+
+	res, err = c.client.Do(req)
+
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	// XSRF token rotation
+	if XSRFToken := res.Header.Get(XSRFHeader); XSRFToken != "" {
+		c.XSRFToken = XSRFToken
+	}
+
+	return
+}
+
+// nonce returns a one-time XSRF token for the argument method, or an empty
+// string if not available to the client (e.g. guests).
+func (c *apiClient) nonce(method string) string {
+	r := c.request("POST", "/api/auth/nonce", nil, []byte(jsonObject{"method": method}.String()))
+	defer r.Body.Close()
+
+	var res jsonObject
+
+	if err := json.NewDecoder(r.Body).Decode(&res); err != nil || res["status"] != "OK" {
+		return ""
+	}
+
+	return res["response"].(string)
+}
+
+func (c *apiClient) call(method string, req jsonObject) (res jsonObject) {
+	var body []byte
+	var header map[string]string
+
+	if req != nil {
+		body = []byte(req.String())
+	}
+
+	if oneTimeRequests["/api/"+method] {
+		if nonce := c.nonce(method); nonce != "" {
+			header = map[string]string{XSRFNonceHeader: nonce}
+		}
+	}
+
+	r := c.request("POST", "/api/"+method, header, body)
+	defer r.Body.Close()
+
+	if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+		c.t.Fatalf("%s: %v", method, err)
+	}
+
+	return
+}
+
+func (c *apiClient) mustCall(method string, req jsonObject) (res jsonObject) {
+	res = c.call(method, req)
+
+	if res["status"] != "OK" {
+		c.t.Fatalf("%s: %v", method, res)
+	}
+
+	return
+}
+
+// wait for completion of background operations
+func (c *apiClient) wait(path string) {
+	for i := 0; i < 600; i++ {
+		_, err := os.Stat(filepath.Join(conf.MountPoint, path))
+
+		if err == nil && len(status.Notifications()) == 0 {
+			return
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	c.t.Fatalf("timeout waiting for %s", path)
+}
+
+func (c *apiClient) upload(path string, data string) {
+	header := map[string]string{
+		"X-Uploadfilename": path,
+		"X-Forceoverwrite": "true",
+	}
+
+	res := c.request("POST", "/api/file/upload", header, []byte(data))
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(res.Body)
+		c.t.Fatalf("upload of %s failed: %s", path, msg)
+	}
+}
+
+func (c *apiClient) download(path string) string {
+	res := c.mustCall("file/download", jsonObject{"path": path})
+
+	// the download handshake does not involve the XSRF token
+	XSRFToken := c.XSRFToken
+	c.XSRFToken = ""
+
+	r := c.request("GET", "/api/file/download?id="+res["response"].(string), nil, nil)
+	defer r.Body.Close()
+
+	c.XSRFToken = XSRFToken
+
+	buf, err := ioutil.ReadAll(r.Body)
+
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	return string(buf)
+}
+
+func (c *apiClient) login() {
+	res := c.mustCall("auth/login", jsonObject{
+		"volume":   testVolume,
+		"password": testPassword,
+		"dispose":  false,
+	})
+
+	c.XSRFToken = res["response"].(map[string]interface{})["XSRFToken"].(string)
+}
+
+func logged(msg string) (found bool) {
+	for _, e := range status.Logs() {
+		if e.Message == msg {
+			found = true
+		}
+	}
+
+	return
+}
+
+func TestAPI(t *testing.T) {
+	c := newTestServer(t)
+
+	// authentication
+
+	res := c.call("file/list", jsonObject{"path": "/", "sha256": false})
+
+	if res["status"] != "INVALID_SESSION" {
+		t.Fatalf("unauthenticated request accepted: %v", res)
+	}
+
+	res = c.call("auth/login", jsonObject{"volume": testVolume, "password": "invalid", "dispose": false})
+
+	if res["status"] != "INVALID_SESSION" {
+		t.Fatalf("invalid password accepted: %v", res)
+	}
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	// upload/download
+
+	c.upload("/test.txt", testCleartext)
+
+	res = c.mustCall("file/list", jsonObject{"path": "/", "sha256": true})
+	inodes := res["response"].(map[string]interface{})["inodes"].([]interface{})
+	listed := false
+
+	for _, i := range inodes {
+		inode := i.(map[string]interface{})
+
+		if inode["name"] == "test.txt" && inode["sha256"] != "" {
+			listed = true
+		}
+	}
+
+	if !listed {
+		t.Fatalf("unexpected file list: %v", inodes)
+	}
+
+	if data := c.download("/test.txt"); data != testCleartext {
+		t.Fatalf("downloaded data mismatch: %s", data)
+	}
+
+	// symmetric ciphers
+
+	for _, cipher := range []string{"AES-256-OFB", "AES-256-MOCK"} {
+		ext := "." + conf.enabledCiphers[cipher].GetInfo().Extension
+		src := "/" + cipher + ".txt"
+
+		c.upload(src, testCleartext)
+
+		c.mustCall("file/encrypt", jsonObject{"src": src, "cipher": cipher, "wipe_src": true, "sign": false, "password": testPassword, "key": "", "sig_key": ""})
+		c.wait(src + ext)
+
+		c.mustCall("file/decrypt", jsonObject{"src": src + ext, "cipher": cipher, "verify": false, "password": testPassword, "key": "", "sig_key": ""})
+		c.wait(src)
+
+		if data := c.download(src); data != testCleartext {
+			t.Fatalf("%s decrypted data mismatch: %s", cipher, data)
+		}
+	}
+
+	// asymmetric ciphers
+
+	c.mustCall("crypto/gen_key", jsonObject{"identifier": "test", "key_format": "armor", "cipher": "OpenPGP", "email": "testonly@example.com"})
+	c.wait("/keys/pgp/private/test.armor")
+
+	res = c.mustCall("crypto/keys", jsonObject{"public": true, "private": true})
+
+	if n := len(res["response"].([]interface{})); n != 2 {
+		t.Fatalf("unexpected number of keys: %d", n)
+	}
+
+	pubKey := "/keys/pgp/public/test.armor"
+	secKey := "/keys/pgp/private/test.armor"
+
+	c.upload("/pgp.txt", testCleartext)
+
+	c.mustCall("file/encrypt", jsonObject{"src": "/pgp.txt", "cipher": "OpenPGP", "wipe_src": true, "sign": true, "password": "", "key": pubKey, "sig_key": secKey})
+	c.wait("/pgp.txt.pgp")
+
+	c.mustCall("file/decrypt", jsonObject{"src": "/pgp.txt.pgp", "cipher": "OpenPGP", "verify": false, "password": "", "key": secKey, "sig_key": pubKey})
+	c.wait("/pgp.txt")
+
+	if data := c.download("/pgp.txt"); data != testCleartext {
+		t.Fatalf("OpenPGP decrypted data mismatch: %s", data)
+	}
+
+	c.mustCall("file/sign", jsonObject{"src": "/pgp.txt", "cipher": "OpenPGP", "password": "", "key": secKey})
+	c.wait("/pgp.txt.pgp-signature")
+
+	c.mustCall("file/verify", jsonObject{"src": "/pgp.txt", "sig": "/pgp.txt.pgp-signature", "cipher": "OpenPGP", "key": pubKey})
+	c.wait("/pgp.txt.pgp-signature")
+
+	if !logged("successful verification of /pgp.txt") {
+		t.Fatal("OpenPGP signature verification failed")
+	}
+
+	res = c.mustCall("crypto/key_info", jsonObject{"path": secKey})
+	info := res["response"].(string)
+
+	if !strings.Contains(info, "Usage (3 records)") || !strings.Contains(info, " sign /pgp.txt ") || !strings.Contains(info, " decrypt /pgp.txt.pgp ") {
+		t.Fatalf("unexpected key usage: %s", info)
+	}
+
+	// OTP ciphers
+
+	seed := base32.StdEncoding.EncodeToString([]byte("this is a TOTP test k"))
+
+	c.mustCall("crypto/upload_key", jsonObject{
+		"key":  jsonObject{"identifier": "test", "key_format": "base32", "cipher": "TOTP", "private": true},
+		"data": seed,
+	})
+
+	res = c.mustCall("crypto/key_info", jsonObject{"path": "/keys/totp/private/test.base32"})
+
+	if !bytes.Contains([]byte(res["response"].(string)), []byte("Code")) {
+		t.Fatalf("unexpected TOTP key info: %v", res)
+	}
+
+	// forbidden operations
+
+	res = c.call("file/download", jsonObject{"path": secKey})
+
+	if res["status"] != "KO" {
+		t.Fatalf("private key download allowed: %v", res)
+	}
+
+	res = c.call("file/list", jsonObject{"path": "/../", "sha256": false})
+
+	if res["status"] != "KO" {
+		t.Fatalf("path traversal allowed: %v", res)
+	}
+}
+
+func TestFileListStream(t *testing.T) {
+	c := newTestServer(t)
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	dir := filepath.Join(conf.MountPoint, "large")
+	os.Mkdir(dir, 0700)
+
+	for i := 0; i < 2*listBatchSize+10; i++ {
+		ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("%05d", i)), []byte{}, 0600)
+	}
+
+	res := c.mustCall("file/list", jsonObject{"path": "/large", "sha256": false})
+
+	if inodes := res["response"].(map[string]interface{})["inodes"].([]interface{}); len(inodes) != 2*listBatchSize+10 {
+		t.Errorf("unexpected number of inodes: %d", len(inodes))
+	}
+
+	r := c.request("POST", "/api/file/list", map[string]string{"Accept": ndjsonType}, []byte(`{"path": "/large", "sha256": false}`))
+	defer r.Body.Close()
+
+	if r.Header.Get("Content-Type") != ndjsonType {
+		t.Errorf("unexpected content type: %s", r.Header.Get("Content-Type"))
+	}
+
+	scanner := bufio.NewScanner(r.Body)
+	names := make(map[string]bool)
+
+	for n := 0; scanner.Scan(); n++ {
+		var line jsonObject
+
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatal(err)
+		}
+
+		if n == 0 {
+			if line["status"] != "OK" {
+				t.Fatalf("unexpected status line: %v", line)
+			}
+
+			continue
+		}
+
+		names[line["name"].(string)] = true
+	}
+
+	if len(names) != 2*listBatchSize+10 || !names["00000"] {
+		t.Errorf("unexpected NDJSON listing: %d inodes", len(names))
+	}
+
+	if res = c.call("file/list", jsonObject{"path": "/missing", "sha256": false}); res["status"] != "KO" {
+		t.Errorf("unexpected response for missing directory: %v", res)
+	}
+}
+
+func TestKeyRevocation(t *testing.T) {
+	c := newTestServer(t)
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	pubKey := "/keys/pgp/public/revoke.armor"
+	secKey := "/keys/pgp/private/revoke.armor"
+
+	c.mustCall("crypto/gen_key", jsonObject{"identifier": "revoke", "key_format": "armor", "cipher": "OpenPGP", "email": "testonly@example.com"})
+	c.wait(secKey)
+
+	var rev string
+
+	for i := 0; i < 50 && rev == ""; i++ {
+		if res := c.call("crypto/revocation", jsonObject{"path": secKey}); res["status"] == "OK" {
+			rev = res["response"].(string)
+		} else {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	block, err := armor.Decode(strings.NewReader(rev))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := packet.Read(block.Body)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sig, ok := p.(*packet.Signature)
+
+	if !ok || sig.SigType != packet.SigTypeKeyRevocation {
+		t.Fatalf("unexpected revocation certificate packet: %v", p)
+	}
+
+	pub, err := os.Open(filepath.Join(conf.MountPoint, pubKey))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	entities, err := openpgp.ReadArmoredKeyRing(pub)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = entities[0].PrimaryKey.VerifyRevocationSignature(sig); err != nil {
+		t.Fatalf("invalid revocation certificate: %v", err)
+	}
+
+	if res := c.call("crypto/revocation", jsonObject{"path": secKey}); res["status"] != "KO" {
+		t.Fatalf("revocation certificate retrieved twice: %v", res)
+	}
+
+	c.upload("/revoke.txt", testCleartext)
+	c.mustCall("crypto/revoke_key", jsonObject{"path": pubKey})
+
+	res := c.mustCall("crypto/keys", jsonObject{"public": true, "private": true})
+
+	for _, k := range res["response"].([]interface{}) {
+		if k.(map[string]interface{})["revoked"].(float64) == 0 {
+			t.Fatalf("key not marked revoked: %v", k)
+		}
+	}
+
+	if res = c.call("file/sign", jsonObject{"src": "/revoke.txt", "cipher": "OpenPGP", "password": "", "key": secKey}); res["status"] != "KO" {
+		t.Fatalf("signing allowed with revoked key: %v", res)
+	}
+
+	if res = c.call("file/encrypt", jsonObject{"src": "/revoke.txt", "cipher": "OpenPGP", "wipe_src": false, "sign": false, "password": "", "key": pubKey, "sig_key": ""}); res["status"] != "KO" {
+		t.Fatalf("encryption allowed with revoked key: %v", res)
+	}
+
+	if res = c.call("crypto/revoke_key", jsonObject{"path": secKey}); res["status"] != "KO" {
+		t.Fatalf("key revoked twice: %v", res)
+	}
+}
+
+func TestDedup(t *testing.T) {
+	c := newTestServer(t)
+	conf.Dedup = true
+	defer func() { conf.Dedup = false }()
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	c.upload("/a.txt", testCleartext)
+	c.upload("/b.txt", testCleartext)
+
+	a, _ := os.Stat(filepath.Join(conf.MountPoint, "a.txt"))
+	b, _ := os.Stat(filepath.Join(conf.MountPoint, "b.txt"))
+
+	if !os.SameFile(a, b) {
+		t.Error("duplicate upload not linked")
+	}
+
+	if saved := dedup.Saved(); saved != int64(len(testCleartext)) {
+		t.Errorf("unexpected saved space: %d", saved)
+	}
+
+	if data := c.download("/b.txt"); data != testCleartext {
+		t.Errorf("downloaded data mismatch: %s", data)
+	}
+
+	// uploads with metadata must not alter the existing file
+	header := map[string]string{
+		"X-Uploadfilename": "/c.txt",
+		"X-Uploadmode":     "0640",
+		"X-Uploadmtime":    "1000000000",
+	}
+
+	if r := c.request("POST", "/api/file/upload", header, []byte(testCleartext)); r.StatusCode != http.StatusOK {
+		t.Fatalf("upload failed: %d", r.StatusCode)
+	}
+
+	a, _ = os.Stat(filepath.Join(conf.MountPoint, "a.txt"))
+	d, _ := os.Stat(filepath.Join(conf.MountPoint, "c.txt"))
+
+	if os.SameFile(a, d) || d.Mode().Perm() != 0640 || d.ModTime().Unix() != 1000000000 {
+		t.Errorf("unexpected deduplicated upload metadata: %v %v", d.Mode(), d.ModTime())
+	}
+
+	if a.Mode().Perm() == 0640 || a.ModTime().Unix() == 1000000000 {
+		t.Error("existing file metadata altered by duplicate upload")
+	}
+}
+
+func TestDownloadLength(t *testing.T) {
+	c := newTestServer(t)
+	defer conf.SetDefaults()
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	conf.CompressPaths = []string{"/archive"}
+
+	for _, p := range []string{"/length.txt", "/archive/length.txt"} {
+		c.upload(p, testCleartext)
+
+		res := c.mustCall("file/download", jsonObject{"path": p})
+
+		XSRFToken := c.XSRFToken
+		c.XSRFToken = ""
+
+		r := c.request("GET", "/api/file/download?id="+res["response"].(string), nil, nil)
+		buf, _ := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+
+		c.XSRFToken = XSRFToken
+
+		// chunked transfer encoding prevents sendfile(2)
+		if r.ContentLength != int64(len(testCleartext)) || len(r.TransferEncoding) != 0 {
+			t.Errorf("%s: unexpected length %d (%v)", p, r.ContentLength, r.TransferEncoding)
+		}
+
+		if string(buf) != testCleartext {
+			t.Errorf("%s: downloaded data mismatch: %s", p, buf)
+		}
+	}
+}
+
+func TestSync(t *testing.T) {
+	c := newTestServer(t)
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	c.upload("/sync.txt", "AAAABBBBCC")
+
+	res := c.mustCall("file/sync", jsonObject{"path": "/sync.txt", "op": "signature", "block_size": 4})
+	blocks := res["response"].(map[string]interface{})["blocks"].([]interface{})
+
+	if len(blocks) != 3 {
+		t.Fatalf("unexpected block signatures: %v", blocks)
+	}
+
+	updated := "AAAAXXXXCC"
+	sum := sha256.Sum256([]byte(updated))
+
+	c.mustCall("file/sync", jsonObject{
+		"path":       "/sync.txt",
+		"op":         "patch",
+		"block_size": 4,
+		"delta": []jsonObject{
+			{"block": 0},
+			{"data": base64.StdEncoding.EncodeToString([]byte("XXXX"))},
+			{"block": 2},
+		},
+		"sha256": hex.EncodeToString(sum[:]),
+	})
+
+	if data := c.download("/sync.txt"); data != updated {
+		t.Errorf("synchronized data mismatch: %s", data)
+	}
+
+	res = c.call("file/sync", jsonObject{"path": "/sync.txt", "op": "patch", "delta": []jsonObject{{"block": 0}}, "sha256": ""})
+
+	if res["status"] != "KO" {
+		t.Errorf("invalid checksum accepted: %v", res)
+	}
+}
+
+func TestBundle(t *testing.T) {
+	c := newTestServer(t)
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	c.upload("/export/a.txt", testCleartext)
+	c.upload("/export/dir/b.txt", testCleartext)
+
+	c.mustCall("file/export", jsonObject{"src": "/export", "dst": "/export", "cipher": "AES-256-OFB", "password": testPassword, "key": "", "sig_key": ""})
+	c.wait("/export.bundle.aes256ofb")
+
+	c.mustCall("file/import", jsonObject{"src": "/export.bundle.aes256ofb", "dst": "/import", "cipher": "AES-256-OFB", "password": testPassword, "key": "", "sig_key": ""})
+	c.wait("/import/export/dir/b.txt")
+
+	if data := c.download("/import/export/dir/b.txt"); data != testCleartext {
+		t.Errorf("imported data mismatch: %s", data)
+	}
+
+	res := c.call("file/import", jsonObject{"src": "/export.bundle.aes256ofb", "dst": "/invalid", "cipher": "AES-256-OFB", "password": "invalidpassword", "key": "", "sig_key": ""})
+	c.wait("/invalid")
+
+	if res["status"] != "OK" || !logged("invalid HMAC") {
+		t.Errorf("invalid password accepted: %v", res)
+	}
+}
+
+func TestReplica(t *testing.T) {
+	c := newTestServer(t)
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	conf.ReplicaPaths = []string{"backup"}
+	defer func() { conf.ReplicaPaths = nil }()
+
+	peer := httptest.NewTLSServer(replicaHandler())
+	defer peer.Close()
+
+	put := func(path string, data string, backup bool) int {
+		uri := fmt.Sprintf("%s/replica/file?path=%s&mtime=1000&backup=%v", peer.URL, path, backup)
+		req, _ := http.NewRequest(http.MethodPut, uri, bytes.NewBufferString(data))
+		res, err := peer.Client().Do(req)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		return res.StatusCode
+	}
+
+	if code := put("/outside.txt", "data", false); code != http.StatusForbidden {
+		t.Errorf("replication outside configured paths allowed: %d", code)
+	}
+
+	put("/backup/replica.txt", "first", false)
+	put("/backup/replica.txt", "second", true)
+
+	if data := c.download("/backup/replica.txt"); data != "second" {
+		t.Errorf("replicated data mismatch: %s", data)
+	}
+
+	info, err := os.Stat(filepath.Join(conf.MountPoint, "backup", "replica.txt"))
+
+	if err != nil || info.ModTime().Unix() != 1000 {
+		t.Errorf("replicated mtime not preserved: %v", err)
+	}
+
+	entries, err := replicaManifest(filepath.Join(conf.MountPoint, "backup"))
+
+	if err != nil || len(entries) != 2 {
+		t.Errorf("conflicting copy not preserved: %v %v", entries, err)
+	}
+}
+
+func TestLock(t *testing.T) {
+	c := newTestServer(t)
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	c.upload("/locked.txt", "data")
+
+	res := c.mustCall("file/lock", jsonObject{"path": "/locked.txt", "owner": "alice"})
+	token := res["response"].(map[string]interface{})["token"].(string)
+
+	if res = c.call("file/lock", jsonObject{"path": "/locked.txt", "owner": "bob"}); res["status"] != "KO" {
+		t.Errorf("concurrent lock acquired: %v", res)
+	}
+
+	if res = c.call("file/delete", jsonObject{"path": []string{"/locked.txt"}}); res["status"] != "KO" {
+		t.Errorf("locked file deleted: %v", res)
+	}
+
+	header := map[string]string{
+		"X-Uploadfilename": "/locked.txt",
+		"X-Forceoverwrite": "true",
+	}
+
+	r := c.request("POST", "/api/file/upload", header, []byte("other"))
+	r.Body.Close()
+
+	if r.StatusCode == http.StatusOK {
+		t.Error("locked file overwritten without token")
+	}
+
+	header["X-Locktoken"] = token
+	r = c.request("POST", "/api/file/upload", header, []byte("update"))
+	r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		t.Error("locked file not writable with token")
+	}
+
+	res = c.mustCall("file/list", jsonObject{"path": "/", "sha256": false})
+
+	for _, i := range res["response"].(map[string]interface{})["inodes"].([]interface{}) {
+		inode := i.(map[string]interface{})
+
+		if inode["name"] == "locked.txt" && inode["lock"].(map[string]interface{})["owner"] != "alice" {
+			t.Errorf("lock holder not reported: %v", inode)
+		}
+	}
+
+	c.mustCall("file/unlock", jsonObject{"path": "/locked.txt", "token": token})
+	c.mustCall("file/delete", jsonObject{"path": []string{"/locked.txt"}})
+}
+
+func TestMetadata(t *testing.T) {
+	c := newTestServer(t)
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	header := map[string]string{
+		"X-Uploadfilename": "/meta/a.txt",
+		"X-Uploadmode":     "0640",
+		"X-Uploadmtime":    "1000",
+	}
+
+	r := c.request("POST", "/api/file/upload", header, []byte(testCleartext))
+	r.Body.Close()
+
+	osPath := filepath.Join(conf.MountPoint, "meta", "a.txt")
+	xattrs := syscall.Setxattr(osPath, "user.interlock", []byte("test"), 0) == nil
+
+	res := c.mustCall("file/list", jsonObject{"path": "/meta", "sha256": false, "metadata": true})
+	inode := res["response"].(map[string]interface{})["inodes"].([]interface{})[0].(map[string]interface{})
+	metadata := inode["metadata"].(map[string]interface{})
+
+	if metadata["mode"] != float64(0640) || metadata["mtime"] != float64(1000) {
+		t.Errorf("upload metadata not preserved: %v", metadata)
+	}
+
+	c.mustCall("file/export", jsonObject{"src": "/meta", "dst": "/meta", "cipher": "AES-256-OFB", "password": testPassword, "key": "", "sig_key": ""})
+	c.wait("/meta.bundle.aes256ofb")
+
+	c.mustCall("file/import", jsonObject{"src": "/meta.bundle.aes256ofb", "dst": "/restore", "cipher": "AES-256-OFB", "password": testPassword, "key": "", "sig_key": ""})
+	c.wait("/restore/meta/a.txt")
+
+	m, err := getMetadata(filepath.Join(conf.MountPoint, "restore", "meta", "a.txt"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Mode != 0640 || m.Mtime != 1000 {
+		t.Errorf("bundle metadata not preserved: %+v", m)
+	}
+
+	if xattrs && string(m.Xattrs["user.interlock"]) != "test" {
+		t.Errorf("bundle extended attributes not preserved: %+v", m)
+	}
+}
+
+func TestSymlink(t *testing.T) {
+	c := newTestServer(t)
+
+	c.login()
+	defer c.call("auth/logout", nil)
+	defer func() { conf.Symlinks = symlinkReject }()
+
+	c.upload("/target.txt", testCleartext)
+
+	if err := os.Symlink("/etc", filepath.Join(conf.MountPoint, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink("target.txt", filepath.Join(conf.MountPoint, "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	if res := c.call("file/download", jsonObject{"path": "/link.txt"}); res["status"] != "KO" {
+		t.Errorf("symbolic link accepted with reject policy: %v", res)
+	}
+
+	conf.Symlinks = symlinkPreserve
+
+	if res := c.call("file/download", jsonObject{"path": "/escape/passwd"}); res["status"] != "KO" {
+		t.Errorf("symbolic link escaping the volume accepted: %v", res)
+	}
+
+	if data := c.download("/link.txt"); data != testCleartext {
+		t.Errorf("symbolic link data mismatch: %s", data)
+	}
+
+	buf := new(bytes.Buffer)
+	w := zip.NewWriter(buf)
+	h := &zip.FileHeader{Name: "evil"}
+	h.SetMode(os.ModeSymlink | 0777)
+	f, _ := w.CreateHeader(h)
+	f.Write([]byte("../../../etc"))
+	w.Close()
+
+	r, _ := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+
+	if err := unzip(r, filepath.Join(conf.MountPoint, "extract")); err == nil {
+		t.Error("symbolic link escaping the volume extracted")
+	}
+}
+
+func TestFilenamePolicy(t *testing.T) {
+	c := newTestServer(t)
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	c.upload(url.QueryEscape("/cafe\u0301.txt"), testCleartext)
+
+	if _, err := os.Stat(filepath.Join(conf.MountPoint, "caf\u00e9.txt")); err != nil {
+		t.Errorf("uploaded file name not normalized: %v", err)
+	}
+
+	if res := c.call("file/mkdir", jsonObject{"path": []string{"/dir/bell\a"}}); res["status"] != "KO" {
+		t.Errorf("control characters accepted: %v", res)
+	}
+
+	if res := c.call("file/new", jsonObject{"path": "/aux.txt", "contents": ""}); res["status"] != "KO" {
+		t.Errorf("reserved name accepted: %v", res)
+	}
+}
+
+func TestLocalize(t *testing.T) {
+	c := newTestServer(t)
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	c.upload("/localized.txt", testCleartext)
+
+	body := []byte(jsonObject{"path": "/localized.txt", "contents": ""}.String())
+	header := map[string]string{"Accept-Language": "fr-CH, it-IT;q=0.9, en;q=0.8"}
+
+	r := c.request("POST", "/api/file/new", header, body)
+	defer r.Body.Close()
+
+	var res jsonObject
+
+	if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg := res["response"].([]interface{})[0]; msg != "il percorso /localized.txt esiste, sovrascrittura non eseguita" {
+		t.Errorf("unexpected translation: %v", msg)
+	}
+
+	if res = c.call("file/new", jsonObject{"path": "/localized.txt", "contents": ""}); res["response"].([]interface{})[0] != "path /localized.txt exists, not overwriting" {
+		t.Errorf("unexpected default language: %v", res)
+	}
+}
+
+func TestSendResponse(t *testing.T) {
+	vectors := []struct {
+		res    jsonObject
+		code   int
+		status string
+	}{
+		{jsonObject{"status": "OK", "response": "<\u2028>"}, http.StatusOK, "OK"},
+		{jsonObject{"status": "OK", "response": make(chan int)}, http.StatusInternalServerError, "KO"},
+		{jsonObject{"status": "OK", "response": []interface{}{math.Inf(1)}}, http.StatusInternalServerError, "KO"},
+	}
+
+	for _, v := range vectors {
+		w := httptest.NewRecorder()
+		sendResponse(w, v.res)
+
+		var res jsonObject
+
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("invalid JSON response %q: %v", w.Body.String(), err)
+		}
+
+		if w.Code != v.code || res["status"] != v.status {
+			t.Errorf("unexpected response: %d %v", w.Code, res)
+		}
+
+		if l := w.Header().Get("Content-Length"); l != strconv.Itoa(w.Body.Len()) {
+			t.Errorf("invalid Content-Length %s (%d)", l, w.Body.Len())
+		}
+	}
+}
+
+func TestClipboard(t *testing.T) {
+	c := newTestServer(t)
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	c.upload("/clip/a.txt", testCleartext)
+	c.upload("/clip/b.txt", testCleartext)
+	c.mustCall("file/mkdir", jsonObject{"path": []string{"/copied", "/moved"}})
+
+	c.mustCall("clipboard/copy", jsonObject{"path": []string{"/clip/a.txt", "/clip/b.txt"}})
+	c.mustCall("clipboard/paste", jsonObject{"dst": "/copied"})
+	c.wait("/copied/b.txt")
+
+	res := c.mustCall("clipboard/list", nil)
+
+	if paths := res["response"].(map[string]interface{})["path"].([]interface{}); len(paths) != 2 {
+		t.Errorf("copied entries not retained: %v", paths)
+	}
+
+	c.mustCall("clipboard/cut", jsonObject{"path": []string{"/clip/a.txt"}})
+	c.mustCall("clipboard/paste", jsonObject{"dst": "/moved"})
+	c.wait("/moved/a.txt")
+
+	if _, err := os.Stat(filepath.Join(conf.MountPoint, "clip", "a.txt")); err == nil {
+		t.Error("cut entry not moved")
+	}
+
+	if res = c.call("clipboard/paste", jsonObject{"dst": "/moved"}); res["status"] != "KO" {
+		t.Errorf("cut entries pasted twice: %v", res)
+	}
+}
+
+func TestPower(t *testing.T) {
+	c := newTestServer(t)
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	supply := t.TempDir()
+	conf.PowerSupply = supply
+
+	defer func() {
+		conf.PowerSupply = ""
+		power.check()
+	}()
+
+	ioutil.WriteFile(filepath.Join(supply, "status"), []byte("Discharging\n"), 0600)
+	ioutil.WriteFile(filepath.Join(supply, "capacity"), []byte("15\n"), 0600)
+
+	if power.check() || !power.Status()["warning"].(bool) {
+		t.Errorf("unexpected power status: %v", power.Status())
+	}
+
+	c.mustCall("file/mkdir", jsonObject{"path": []string{"/powered"}})
+
+	ioutil.WriteFile(filepath.Join(supply, "capacity"), []byte("3\n"), 0600)
+
+	if !power.check() {
+		t.Errorf("shutdown not triggered: %v", power.Status())
+	}
+
+	if res := c.call("file/mkdir", jsonObject{"path": []string{"/unpowered"}}); res["status"] != "KO" {
+		t.Errorf("write allowed during power failure: %v", res)
+	}
+
+	c.mustCall("file/list", jsonObject{"path": "/", "sha256": false})
+}
+
+func TestDeadman(t *testing.T) {
+	c := newTestServer(t)
+
+	dir := t.TempDir()
+	target := filepath.Join(dir, "header")
+	ioutil.WriteFile(target, []byte("secret"), 0600)
+
+	conf.DeadmanPeriod = 60
+	conf.DeadmanAction = deadmanDestroy
+	conf.DeadmanState = filepath.Join(dir, "state")
+	conf.DeadmanPaths = []string{target}
+
+	defer func() {
+		conf.DeadmanPeriod = 0
+		conf.DeadmanAction = deadmanNotify
+		conf.DeadmanState = ""
+		conf.DeadmanPaths = nil
+	}()
+
+	if err := deadman.load(); err != nil {
+		t.Fatal(err)
+	}
+
+	if deadman.check(0) {
+		t.Fatal("switch triggered before deadline")
+	}
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	res := c.mustCall("status/running", nil)
+	s := res["response"].(map[string]interface{})["deadman"].(map[string]interface{})
+
+	if s["remaining"].(float64) <= 0 || s["action"] != deadmanDestroy {
+		t.Errorf("unexpected deadman status: %v", s)
+	}
+
+	if deadman.check(30 * time.Second) {
+		t.Fatal("switch triggered before deadline")
+	}
+
+	if !deadman.check(31 * time.Second) {
+		t.Fatal("switch not triggered after deadline")
+	}
+
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Errorf("path not destroyed: %v", err)
+	}
+
+	if deadman.check(120 * time.Second) {
+		t.Error("switch triggered twice")
+	}
+
+	c.mustCall("auth/logout", nil)
+	c.login()
+
+	if s := deadman.Status(); s["triggered"].(int64) != 0 || s["uptime"].(int64) != 0 || deadman.LastLogin == 0 {
+		t.Errorf("login did not reset the switch: %v", s)
+	}
+
+	// logins with an invalid clock restart the countdown without
+	// recording their time
+	clock.invalid = true
+	defer func() { clock.invalid = false }()
+
+	deadman.check(50 * time.Second)
+	deadman.Reset()
+
+	if deadman.LastLogin != 0 || deadman.Remaining() != 60*time.Second {
+		t.Errorf("unexpected state after login with invalid clock: %v", deadman.Status())
+	}
+
+	if err := deadman.load(); err != nil || deadman.Remaining() != 60*time.Second {
+		t.Errorf("state not persisted (%v)", err)
+	}
+}
+
+func TestMeasurements(t *testing.T) {
+	c := newTestServer(t)
+
+	dir := t.TempDir()
+	asset := filepath.Join(dir, "index.html")
+	ioutil.WriteFile(asset, []byte("<html></html>"), 0600)
+
+	conf.Measurements = filepath.Join(t.TempDir(), "measurements")
+	conf.StaticPath = dir
+
+	defer func() {
+		conf.Measurements = ""
+		conf.StaticPath = ""
+		indicator.SetTamper(false)
+	}()
+
+	if err := measurements.check(); err != nil {
+		t.Fatal(err)
+	}
+
+	if changes := measurements.Changes(); len(changes) != 0 {
+		t.Fatalf("unexpected changes on first run: %v", changes)
+	}
+
+	ioutil.WriteFile(asset, []byte("<html>tampered</html>"), 0600)
+
+	if err := measurements.check(); err != nil {
+		t.Fatal(err)
+	}
+
+	if indicator.State() != indicatorTamper {
+		t.Errorf("tamper not signaled: %s", indicator.State())
+	}
+
+	res := c.mustCall("auth/login", jsonObject{"volume": testVolume, "password": testPassword, "dispose": false})
+	defer c.call("auth/logout", nil)
+
+	c.XSRFToken = res["response"].(map[string]interface{})["XSRFToken"].(string)
+	tamper := res["response"].(map[string]interface{})["tamper"].([]interface{})
+
+	if len(tamper) != 1 || tamper[0] != "static asset changed: index.html" {
+		t.Errorf("unexpected tamper report: %v", tamper)
+	}
+
+	c.mustCall("status/measurements/accept", nil)
+
+	if err := measurements.check(); err != nil {
+		t.Fatal(err)
+	}
+
+	res = c.mustCall("status/measurements", nil)
+
+	if changes := res["response"].(map[string]interface{})["changes"].([]interface{}); len(changes) != 0 {
+		t.Errorf("changes not accepted: %v", changes)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	c := newTestServer(t)
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	c.upload("/before", "data")
+
+	res := c.mustCall("config/readonly", jsonObject{"readonly": true})
+
+	if !res["response"].(map[string]interface{})["readonly"].(bool) {
+		t.Fatalf("read-only mode not enabled: %v", res)
+	}
+
+	if !conf.volume.(*mockVolume).readOnly {
+		t.Error("volume not remounted read-only")
+	}
+
+	if res := c.call("file/mkdir", jsonObject{"path": []string{"/after"}}); res["status"] != "KO" {
+		t.Errorf("write allowed in read-only mode: %v", res)
+	}
+
+	if data := c.download("/before"); data != "data" {
+		t.Errorf("unexpected download: %s", data)
+	}
+
+	c.mustCall("config/readonly", jsonObject{"readonly": false})
+	c.mustCall("file/mkdir", jsonObject{"path": []string{"/after"}})
+
+	conf.ReadOnly = true
+	defer func() { conf.ReadOnly = false }()
+
+	c.mustCall("auth/logout", nil)
+	c.login()
+
+	if !readOnly.Enabled() {
+		t.Error("read-only mode not applied at login")
+	}
+}
+
+func TestGuest(t *testing.T) {
+	c := newTestServer(t)
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	c.mustCall("file/mkdir", jsonObject{"path": []string{"/shared"}})
+	c.upload("/shared/report", "report")
+	c.upload("/private", "private")
+
+	res := c.mustCall("guest/create", jsonObject{"path": "/shared", "ops": []string{"list", "download"}, "duration": 60})
+	credentials := res["response"].(map[string]interface{})
+
+	jar, _ := cookiejar.New(nil)
+	g := &apiClient{t: t, srv: c.srv, client: &http.Client{Jar: jar}}
+
+	if res := g.call("auth/guest", jsonObject{"username": credentials["username"], "password": "invalid"}); res["status"] != "INVALID_SESSION" {
+		t.Errorf("invalid guest credentials accepted: %v", res)
+	}
+
+	res = g.mustCall("auth/guest", jsonObject{"username": credentials["username"], "password": credentials["password"]})
+	g.XSRFToken = res["response"].(map[string]interface{})["XSRFToken"].(string)
+
+	g.mustCall("file/list", jsonObject{"path": "/shared", "sha256": false})
+
+	if data := g.download("/shared/report"); data != "report" {
+		t.Errorf("unexpected guest download: %s", data)
+	}
+
+	for _, req := range []jsonObject{
+		{"path": "/", "sha256": false},
+		{"path": "/shared/../", "sha256": false},
+	} {
+		if res := g.call("file/list", req); res["status"] != "KO" {
+			t.Errorf("guest access outside directory: %v", res)
+		}
+	}
+
+	if res := g.call("file/download", jsonObject{"path": "/private"}); res["status"] != "KO" {
+		t.Errorf("guest access outside directory: %v", res)
+	}
+
+	if res := g.call("file/mkdir", jsonObject{"path": []string{"/shared/new"}}); res["status"] != "KO" {
+		t.Errorf("guest operation not restricted: %v", res)
+	}
+
+	if res := g.call("luks/add", jsonObject{"volume": testVolume, "password": testPassword, "newpassword": "guest"}); res["status"] != "KO" {
+		t.Errorf("guest operation not restricted: %v", res)
+	}
+
+	conf.Symlinks = symlinkPreserve
+	defer func() { conf.Symlinks = symlinkReject }()
+
+	os.Symlink("../private", filepath.Join(conf.MountPoint, "shared", "link"))
+
+	if res := g.call("file/download", jsonObject{"path": "/shared/link"}); res["status"] != "KO" {
+		t.Errorf("guest access outside directory through symbolic link: %v", res)
+	}
+
+	list := c.mustCall("guest/list", nil)["response"].([]interface{})
+
+	if len(list) != 1 || !list[0].(map[string]interface{})["active"].(bool) {
+		t.Errorf("unexpected guest list: %v", list)
+	}
+
+	c.mustCall("guest/revoke", jsonObject{"username": credentials["username"]})
+
+	res = c.mustCall("guest/create", jsonObject{"path": "/shared", "ops": []string{"mkdir", "delete"}, "duration": 60})
+	credentials = res["response"].(map[string]interface{})
+
+	w := &apiClient{t: t, srv: c.srv, client: &http.Client{Jar: jar}}
+	res = w.mustCall("auth/guest", jsonObject{"username": credentials["username"], "password": credentials["password"]})
+	w.XSRFToken = res["response"].(map[string]interface{})["XSRFToken"].(string)
+
+	w.mustCall("file/mkdir", jsonObject{"path": []string{"/shared/new"}})
+	w.mustCall("file/delete", jsonObject{"path": []string{"/shared/new"}})
+
+	for _, p := range []string{"/shared", "/shared/", "/shared/."} {
+		if res := w.call("file/delete", jsonObject{"path": []string{p}}); res["status"] != "KO" {
+			t.Errorf("guest directory %s deleted: %v", p, res)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(conf.MountPoint, "shared", "report")); err != nil {
+		t.Error("guest directory removed")
+	}
+
+	if res := g.call("file/list", jsonObject{"path": "/shared", "sha256": false}); res["status"] != "INVALID_SESSION" {
+		t.Errorf("revoked guest session still valid: %v", res)
+	}
+}
+
+func TestPIV(t *testing.T) {
+	c := newTestServer(t)
+
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "PIV test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, _ := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	ca, _ := x509.ParseCertificate(caDER)
+
+	caFile := filepath.Join(t.TempDir(), "piv-ca.pem")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0600)
+
+	conf.PIVCA = caFile
+	conf.PIVRoles = map[string]string{"alice": "staff"}
+	defer func() { conf.PIVCA = ""; conf.PIVRoles = nil }()
+
+	issue := func(name string) (*ecdsa.PrivateKey, string) {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		der, _ := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+
+		return key, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	}
+
+	jar, _ := cookiejar.New(nil)
+	p := &apiClient{t: t, srv: c.srv, client: &http.Client{Jar: jar}}
+
+	pivLogin := func(key *ecdsa.PrivateKey, cert string) jsonObject {
+		nonce := p.mustCall("auth/piv_challenge", nil)["response"].(map[string]interface{})["nonce"].(string)
+		digest := sha256.Sum256([]byte(nonce))
+		sig, _ := ecdsa.SignASN1(rand.Reader, key, digest[:])
+
+		return p.call("auth/piv", jsonObject{
+			"certificate": cert,
+			"nonce":       nonce,
+			"signature":   base64.StdEncoding.EncodeToString(sig),
+		})
+	}
+
+	alice, aliceCert := issue("alice")
+
+	if res := pivLogin(alice, aliceCert); res["status"] != "INVALID_SESSION" {
+		t.Errorf("PIV login without unlocked volume: %v", res)
+	}
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	c.mustCall("file/mkdir", jsonObject{"path": []string{"/hr"}})
+	c.upload("/hr/payroll", "payroll")
+	c.upload("/handbook", "handbook")
+	c.mustCall("acl/set", jsonObject{"path": "/hr", "principal": "role:admin", "perms": "rwd"})
+
+	mallory, malloryCert := issue("mallory")
+
+	if res := pivLogin(mallory, malloryCert); res["status"] != "INVALID_SESSION" {
+		t.Errorf("unmapped certificate accepted: %v", res)
+	}
+
+	if res := pivLogin(mallory, aliceCert); res["status"] != "INVALID_SESSION" {
+		t.Errorf("invalid signature accepted: %v", res)
+	}
+
+	res := pivLogin(alice, aliceCert)
+
+	if res["status"] != "OK" {
+		t.Fatalf("PIV login failed: %v", res)
+	}
+
+	response := res["response"].(map[string]interface{})
+	p.XSRFToken = response["XSRFToken"].(string)
+
+	if response["user"] != "alice" || response["role"] != "staff" {
+		t.Errorf("unexpected PIV session: %v", response)
+	}
+
+	if data := p.download("/handbook"); data != "handbook" {
+		t.Errorf("unexpected PIV download: %s", data)
+	}
+
+	if res := p.call("file/download", jsonObject{"path": "/hr/payroll"}); res["status"] != "KO" {
+		t.Errorf("ACL not enforced on PIV session: %v", res)
+	}
+
+	if res := p.call("guest/create", jsonObject{"path": "/", "ops": []string{"list"}, "duration": 60}); res["status"] != "KO" {
+		t.Errorf("PIV session not restricted: %v", res)
+	}
+}
+
+func TestBanner(t *testing.T) {
+	c := newTestServer(t)
+	conf.Banner = "authorized use only"
+	defer func() { conf.Banner = "" }()
+
+	res := c.mustCall("status/banner", nil)
+
+	if banner := res["response"].(map[string]interface{}); banner["banner"] != conf.Banner || banner["acknowledge"] != true {
+		t.Errorf("unexpected banner: %v", res)
+	}
+
+	req := jsonObject{
+		"volume":   testVolume,
+		"password": testPassword,
+		"dispose":  false,
+	}
+
+	if res = c.call("auth/login", req); res["status"] != "KO" || session.Active() {
+		t.Fatalf("login without banner acknowledgment: %v", res)
+	}
+
+	req["banner"] = true
+	res = c.mustCall("auth/login", req)
+	c.XSRFToken = res["response"].(map[string]interface{})["XSRFToken"].(string)
+	defer c.call("auth/logout", nil)
+
+	acknowledged := false
+
+	for _, e := range status.Logs() {
+		if strings.HasPrefix(e.Message, "login banner acknowledged from ") {
+			acknowledged = true
+		}
+	}
+
+	if !acknowledged {
+		t.Error("banner acknowledgment not logged")
+	}
+}
+
+func TestSessionBinding(t *testing.T) {
+	c := newTestServer(t)
+	conf.SessionBinding = bindingSubnet
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	u, _ := url.Parse(c.srv.URL + "/api/")
+	cookies := c.client.Jar.Cookies(u)
+
+	request := func(remote string) (res jsonObject) {
+		r := httptest.NewRequest("POST", "/api/file/list", strings.NewReader(`{"path":"/","sha256":false}`))
+		r.RemoteAddr = remote
+		r.Header.Set(XSRFHeader, c.XSRFToken)
+
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+
+		return
+	}
+
+	if res := request("127.0.0.42:1234"); res["status"] != "OK" {
+		t.Errorf("request from same subnet refused: %v", res)
+	}
+
+	if res := request("192.0.2.1:1234"); res["status"] != "SESSION_MOVED" {
+		t.Errorf("request from different client accepted: %v", res)
+	}
+
+	if session.Active() {
+		t.Error("session not invalidated")
+	}
+
+	if res := c.call("file/list", jsonObject{"path": "/", "sha256": false}); res["status"] != "INVALID_SESSION" {
+		t.Errorf("invalidated session accepted: %v", res)
+	}
+}
+
+func TestXSRF(t *testing.T) {
+	c := newTestServer(t)
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	c.mustCall("file/mkdir", jsonObject{"path": []string{"/xsrf"}})
+
+	// one-time tokens
+	r := c.request("POST", "/api/file/delete", nil, []byte(jsonObject{"path": []string{"/xsrf"}}.String()))
+	r.Body.Close()
+
+	if _, err := os.Stat(filepath.Join(conf.MountPoint, "xsrf")); err != nil {
+		t.Fatal("delete without one-time token executed")
+	}
+
+	if res := c.call("auth/nonce", jsonObject{"method": "file/list"}); res["status"] != "KO" {
+		t.Errorf("one-time token issued for non destructive method: %v", res)
+	}
+
+	nonce := c.nonce("file/delete")
+	header := map[string]string{XSRFNonceHeader: nonce}
+
+	r = c.request("POST", "/api/file/mkdir", header, []byte(jsonObject{"path": []string{"/xsrf2"}}.String()))
+	r.Body.Close()
+
+	r = c.request("POST", "/api/file/delete", header, []byte(jsonObject{"path": []string{"/xsrf"}}.String()))
+	r.Body.Close()
+
+	if _, err := os.Stat(filepath.Join(conf.MountPoint, "xsrf")); !os.IsNotExist(err) {
+		t.Fatal("delete with one-time token not executed")
+	}
+
+	r = c.request("POST", "/api/file/delete", header, []byte(jsonObject{"path": []string{"/xsrf2"}}.String()))
+	r.Body.Close()
+
+	if _, err := os.Stat(filepath.Join(conf.MountPoint, "xsrf2")); err != nil {
+		t.Error("one-time token reused")
+	}
+
+	// rotation on refresh
+	XSRFToken := c.XSRFToken
+	r = c.request("GET", "/api/auth/refresh", nil, nil)
+
+	var res jsonObject
+
+	if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+
+	r.Body.Close()
+	c.XSRFToken = res["response"].(map[string]interface{})["XSRFToken"].(string)
+
+	if c.XSRFToken == XSRFToken {
+		t.Fatal("XSRF token not rotated on refresh")
+	}
+
+	previous := c.XSRFToken
+	c.XSRFToken = XSRFToken
+
+	if res = c.call("file/list", jsonObject{"path": "/", "sha256": false}); res["status"] != "INVALID_SESSION" {
+		t.Errorf("rotated XSRF token accepted: %v", res)
+	}
+
+	c.XSRFToken = previous
+
+	// renewal past half the maximum age, with grace period
+	session.Lock()
+	session.xsrfIssued = time.Now().Add(-time.Duration(conf.XSRFMaxAge) * time.Second * 3 / 4)
+	session.Unlock()
+
+	c.mustCall("file/list", jsonObject{"path": "/", "sha256": false})
+
+	if c.XSRFToken == previous {
+		t.Fatal("XSRF token not renewed")
+	}
+
+	renewed := c.XSRFToken
+	c.XSRFToken = previous
+	c.mustCall("file/list", jsonObject{"path": "/", "sha256": false})
+	c.XSRFToken = renewed
+
+	// expiration
+	session.Lock()
+	session.xsrfIssued = time.Now().Add(-time.Duration(conf.XSRFMaxAge+1) * time.Second)
+	session.Unlock()
+
+	if res = c.call("file/list", jsonObject{"path": "/", "sha256": false}); res["status"] != "INVALID_SESSION" {
+		t.Errorf("expired XSRF token accepted: %v", res)
+	}
+
+	r = c.request("GET", "/api/auth/refresh", nil, nil)
+	json.NewDecoder(r.Body).Decode(&res)
+	r.Body.Close()
+	c.XSRFToken = res["response"].(map[string]interface{})["XSRFToken"].(string)
+}
+
+func TestACL(t *testing.T) {
+	c := newTestServer(t)
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	c.mustCall("file/mkdir", jsonObject{"path": []string{"/hr", "/hr/public", "/finance"}})
+	c.upload("/hr/payroll", "payroll")
+	c.upload("/hr/public/handbook", "handbook")
+
+	c.mustCall("acl/set", jsonObject{"path": "/hr", "principal": "role:admin", "perms": "rwd"})
+	c.mustCall("acl/set", jsonObject{"path": "/hr/public", "principal": "*", "perms": "r"})
+
+	if res := c.call("acl/set", jsonObject{"path": "/hr", "principal": "nobody", "perms": "r"}); res["status"] != "KO" {
+		t.Errorf("invalid principal accepted: %v", res)
+	}
+
+	res := c.mustCall("guest/create", jsonObject{"path": "/", "ops": []string{"list", "download", "upload"}, "role": "staff", "duration": 60})
+	credentials := res["response"].(map[string]interface{})
+
+	jar, _ := cookiejar.New(nil)
+	g := &apiClient{t: t, srv: c.srv, client: &http.Client{Jar: jar}}
+
+	res = g.mustCall("auth/guest", jsonObject{"username": credentials["username"], "password": credentials["password"]})
+	g.XSRFToken = res["response"].(map[string]interface{})["XSRFToken"].(string)
+
+	if data := g.download("/hr/public/handbook"); data != "handbook" {
+		t.Errorf("unexpected guest download: %s", data)
+	}
+
+	if res := g.call("file/download", jsonObject{"path": "/hr/payroll"}); res["status"] != "KO" {
+		t.Errorf("ACL not enforced: %v", res)
+	}
+
+	header := map[string]string{"X-Uploadfilename": "/hr/public/upload"}
+
+	if r := g.request("POST", "/api/file/upload", header, []byte("data")); r.StatusCode != http.StatusForbidden {
+		t.Errorf("ACL not enforced on upload: %d", r.StatusCode)
+	}
+
+	g.upload("/finance/report", "report")
+
+	c.mustCall("acl/set", jsonObject{"path": "/hr/public", "principal": "role:staff", "perms": "rw"})
+	g.upload("/hr/public/upload", "data")
+
+	conf.Symlinks = symlinkPreserve
+	defer func() { conf.Symlinks = symlinkReject }()
+
+	os.Symlink("../hr", filepath.Join(conf.MountPoint, "finance", "alias"))
+
+	if res := g.call("file/download", jsonObject{"path": "/finance/alias/payroll"}); res["status"] != "KO" {
+		t.Errorf("ACL bypassed through symbolic link: %v", res)
+	}
+
+	if err := acls.Check(nil, httptest.NewRequest("POST", "/api/file/unlisted", nil), adminPrincipal); err == nil {
+		t.Error("method without ACL requirements allowed")
+	}
+
+	for uri := range schemas {
+		switch uri {
+		case "/api/auth/login", "/api/auth/guest", "/api/auth/piv", "/api/auth/keypad", "/api/escrow/recover":
+			continue
+		}
+
+		if _, ok := aclRequests[uri]; !ok {
+			t.Errorf("%s missing ACL requirements", uri)
+		}
+	}
+
+	if res := c.call("file/download", jsonObject{"path": "/" + aclFile}); res["status"] != "KO" {
+		t.Errorf("ACL store accessible: %v", res)
+	}
+
+	list := c.mustCall("acl/list", nil)["response"].([]interface{})
+
+	if len(list) != 3 {
+		t.Errorf("unexpected ACL list: %v", list)
+	}
+
+	c.mustCall("acl/set", jsonObject{"path": "/hr", "principal": "role:admin", "perms": ""})
+
+	if res := c.call("file/list", jsonObject{"path": "/hr", "sha256": false}); res["status"] != "OK" {
+		t.Errorf("removed ACL still enforced: %v", res)
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	c := newTestServer(t)
+
+	events := make(chan event, 10)
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		if r.Header.Get(webhookSignatureHeader) != signWebhook("secret", body) {
+			t.Errorf("invalid webhook signature")
+		}
+
+		var e event
+		json.Unmarshal(body, &e)
+		events <- e
+	}))
+	defer srv.Close()
+
+	client := eventClient
+	eventClient = srv.Client()
+
+	conf.Webhooks = []webhook{{URL: srv.URL, Secret: "secret", Events: []string{eventLogin, eventLoginFailed, eventUpload}}}
+
+	defer func() {
+		eventClient = client
+		conf.Webhooks = nil
+	}()
+
+	if err := checkWebhooks(); err != nil {
+		t.Fatal(err)
+	}
+
+	next := func() event {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("webhook not delivered")
+		}
+
+		return event{}
+	}
+
+	c.call("auth/login", jsonObject{"volume": testVolume, "password": "invalid", "dispose": false})
+
+	if e := next(); e.Name != eventLoginFailed || e.Details["volume"] != testVolume {
+		t.Errorf("unexpected event: %v", e)
+	}
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	if e := next(); e.Name != eventLogin {
+		t.Errorf("unexpected event: %v", e)
+	}
+
+	c.upload("/hooked", "data")
+
+	if e := next(); e.Name != eventUpload || e.Details["path"] != "/hooked" {
+		t.Errorf("unexpected event: %v", e)
+	}
+
+	conf.Webhooks[0].URL = "http://insecure"
+
+	if err := checkWebhooks(); err == nil {
+		t.Error("plain HTTP webhook accepted")
+	}
+}
+
+func TestPush(t *testing.T) {
+	c := newTestServer(t)
+
+	requests := make(chan *http.Request, 10)
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+	}))
+	defer srv.Close()
+
+	client := eventClient
+	eventClient = srv.Client()
+
+	defer func() {
+		eventClient = client
+		conf.PushService = ""
+		conf.PushToken = ""
+	}()
+
+	next := func() *http.Request {
+		select {
+		case r := <-requests:
+			return r
+		case <-time.After(5 * time.Second):
+			t.Fatal("push notification not delivered")
+		}
+
+		return nil
+	}
+
+	conf.PushService = pushNtfy
+	conf.PushURL = srv.URL + "/interlock"
+
+	if err := checkPush(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.call("auth/login", jsonObject{"volume": testVolume, "password": "invalid", "dispose": false})
+
+	if r := next(); r.URL.Path != "/interlock" || r.Header.Get("Title") != "INTERLOCK: failed login" || r.Header.Get("Priority") != "4" {
+		t.Errorf("unexpected ntfy request: %v %v", r.URL, r.Header)
+	}
+
+	// not included in default push events
+	c.login()
+	c.mustCall("auth/logout", nil)
+
+	conf.PushService = pushGotify
+	conf.PushURL = srv.URL
+
+	if err := checkPush(); err == nil {
+		t.Error("missing Gotify token accepted")
+	}
+
+	conf.PushToken = "token"
+
+	c.call("auth/login", jsonObject{"volume": testVolume, "password": "invalid", "dispose": false})
+
+	if r := next(); r.URL.Path != "/message" || r.Header.Get("X-Gotify-Key") != "token" {
+		t.Errorf("unexpected Gotify request: %v %v", r.URL, r.Header)
+	}
+}
+
+func TestSIEM(t *testing.T) {
+	c := newTestServer(t)
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unreachable := l.Addr().String()
+	l.Close()
+
+	retry := siemRetry
+	siemRetry = 0
+
+	conf.SIEMAddress = unreachable
+	conf.SIEMFormat = siemCEF
+	conf.SIEMTLS = false
+
+	defer func() {
+		siemRetry = retry
+		conf.SIEMAddress = ""
+
+		if siem.conn != nil {
+			siem.conn.Close()
+			siem.conn = nil
+		}
+	}()
+
+	siem.deliver(siem.format(statusEntry{Epoch: 1, Code: syslog.LOG_ALERT, Message: "first|entry"}))
+
+	spool, err := ioutil.ReadFile(filepath.Join(conf.MountPoint, siemSpool))
+
+	if err != nil || !strings.HasPrefix(string(spool), `CEF:0|F-Secure|INTERLOCK|`) || !strings.Contains(string(spool), `|1|first\|entry|9|rt=1000 `) {
+		t.Fatalf("entry not spooled: %s %v", spool, err)
+	}
+
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	conf.SIEMAddress = l.Addr().String()
+	conf.SIEMFormat = siemJSON
+
+	siem.deliver(siem.format(statusEntry{Epoch: 2, Code: syslog.LOG_INFO, Message: "second"}))
+
+	conn, err := l.Accept()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+
+	for _, expected := range []string{"first|entry", `"msg":"second"`} {
+		if !scanner.Scan() || !strings.Contains(scanner.Text(), expected) {
+			t.Errorf("unexpected SIEM entry: %s", scanner.Text())
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(conf.MountPoint, siemSpool)); !os.IsNotExist(err) {
+		t.Errorf("spool not removed: %v", err)
+	}
+}
+
+func TestFaults(t *testing.T) {
+	c := newTestServer(t)
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	faults.Lock()
+	previous := faults.sites["download request parsing"]
+	faults.Unlock()
+
+	XSRFToken := c.XSRFToken
+	c.XSRFToken = ""
+
+	if r := c.request("GET", "/api/file/download?invalid", nil, nil); r.StatusCode != http.StatusBadRequest {
+		t.Errorf("unexpected status for invalid download: %d", r.StatusCode)
+	}
+
+	c.XSRFToken = XSRFToken
+
+	res := c.mustCall("status/running", nil)
+	errors := res["response"].(map[string]interface{})["errors"].(map[string]interface{})
+
+	if errors["sites"].(map[string]interface{})["download request parsing"] != float64(previous+1) {
+		t.Errorf("internal error not reported: %v", errors)
+	}
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	c := newTestServer(t)
+
+	if res := c.request("GET", "/healthz", nil, nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("health endpoint served outside container mode (%d)", res.StatusCode)
+	}
+
+	conf.Container = true
+	defer func() {
+		conf.Container = false
+		conf.VolumePath = ""
+	}()
+
+	for _, uri := range []string{"/healthz", "/readyz"} {
+		if res := c.request("GET", uri, nil, nil); res.StatusCode != http.StatusOK {
+			t.Errorf("unexpected %s status %d", uri, res.StatusCode)
+		}
+	}
+
+	conf.VolumePath = filepath.Join(conf.MountPoint, "missing")
+
+	if res := c.request("GET", "/readyz", nil, nil); res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("ready with missing volume_path (%d)", res.StatusCode)
+	}
+}
+
+func TestUIStatus(t *testing.T) {
+	c := newTestServer(t)
+
+	res := c.mustCall("status/ui", nil)
+
+	if ui := res["response"].(map[string]interface{}); ui["title"] != defaultUITitle || len(ui["features"].([]interface{})) != len(uiFeatures) {
+		t.Errorf("unexpected default branding: %v", res)
+	}
+
+	conf.UITitle = "ACME Vault"
+	conf.UILogo = "images/acme.png"
+	conf.UIFeatures = []string{"upload"}
+
+	res = c.mustCall("status/ui", nil)
+	ui := res["response"].(map[string]interface{})
+
+	if ui["title"] != conf.UITitle || ui["logo"] != "/images/acme.png" || len(ui["features"].([]interface{})) != 1 {
+		t.Errorf("unexpected branding: %v", res)
+	}
+
+	for _, logo := range []string{"/etc/passwd", "../logo.png", "images/../../logo.png"} {
+		conf.UILogo = logo
+
+		if err := validateUI(); err == nil {
+			t.Errorf("invalid logo %s accepted", logo)
+		}
+	}
+
+	conf.UILogo = ""
+	conf.UIFeatures = []string{"shell"}
+
+	if err := validateUI(); err == nil {
+		t.Error("invalid feature accepted")
+	}
+
+	conf.SetDefaults()
+}
+
+func TestKeyOpDelay(t *testing.T) {
+	c := newTestServer(t)
+	c.login()
+	defer c.call("auth/logout", nil)
+	defer func() { keyOps = keyOpLimiter{} }()
+
+	if res := c.call("luks/change", jsonObject{"volume": testVolume, "password": "invalid", "newpassword": "other"}); res["status"] != "KO" {
+		t.Fatalf("invalid password accepted: %v", res)
+	}
+
+	res := c.call("luks/change", jsonObject{"volume": testVolume, "password": testPassword, "newpassword": testPassword})
+
+	if res["status"] != "KO" || !strings.Contains(fmt.Sprint(res["response"]), "retry in") {
+		t.Errorf("key operation not delayed after failure: %v", res)
+	}
+
+	keyOps.Lock()
+	keyOps.next = time.Now()
+	keyOps.Unlock()
+
+	c.mustCall("luks/change", jsonObject{"volume": testVolume, "password": testPassword, "newpassword": testPassword})
+
+	if keyOps.failures != 0 {
+		t.Errorf("failures not reset after success (%d)", keyOps.failures)
+	}
+
+	if !secretEqual("token", "token") || secretEqual("token", "other") || secretEqual("", "token") {
+		t.Error("unexpected secret comparison")
+	}
+}
+
+func TestFailedLogins(t *testing.T) {
+	c := newTestServer(t)
+	failedLogins = loginAttempts{}
+
+	for i := 0; i < 2; i++ {
+		if res := c.call("auth/login", jsonObject{"volume": testVolume, "password": "invalid", "dispose": false}); res["status"] != "INVALID_SESSION" {
+			t.Fatalf("invalid login accepted: %v", res)
+		}
+	}
+
+	res := c.mustCall("auth/login", jsonObject{"volume": testVolume, "password": testPassword, "dispose": false})
+	c.XSRFToken = res["response"].(map[string]interface{})["XSRFToken"].(string)
+
+	attempts, _ := res["response"].(map[string]interface{})["failed_logins"].([]interface{})
+
+	if len(attempts) != 2 {
+		t.Fatalf("unexpected failed logins: %v", res["response"])
+	}
+
+	if a := attempts[0].(map[string]interface{}); a["volume"] != testVolume || a["remote"] == "" || a["epoch"].(float64) == 0 {
+		t.Errorf("unexpected failed login: %v", a)
+	}
+
+	if !logged("2 failed login attempt(s) since the last login, latest from " + attempts[1].(map[string]interface{})["remote"].(string)) {
+		t.Error("failed logins not logged")
+	}
+
+	c.call("auth/logout", nil)
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	if len(failedLogins.Last()) != 0 {
+		t.Error("failed logins reported twice")
+	}
+}
+
+func TestHoneytoken(t *testing.T) {
+	c := newTestServer(t)
+
+	var tripped []event
+
+	sinks := eventSinks
+	eventSinks = append(eventSinks, func(e event) {
+		if e.Name == eventHoneytoken {
+			tripped = append(tripped, e)
+		}
+	})
+
+	defer func() {
+		eventSinks = sinks
+		conf.HoneytokenLock = false
+	}()
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	c.upload("/passwords.txt", "bait")
+	c.mustCall("honeytoken/add", jsonObject{"path": "/passwords.txt"})
+	c.mustCall("honeytoken/add", jsonObject{"path": "/wallet.dat"})
+
+	if res := c.call("honeytoken/add", jsonObject{"path": "/wallet.dat"}); res["status"] != "KO" {
+		t.Errorf("duplicate honeytoken accepted: %v", res)
+	}
+
+	if r := c.request("POST", "/api/honeytoken/add", nil, []byte(`{}`)); r.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid honeytoken request accepted: %d", r.StatusCode)
+	}
+
+	c.mustCall("config/readonly", jsonObject{"readonly": true})
+
+	if res := c.call("honeytoken/remove", jsonObject{"path": "/wallet.dat"}); res["status"] != "KO" {
+		t.Errorf("honeytoken removed in read-only mode: %v", res)
+	}
+
+	c.mustCall("config/readonly", jsonObject{"readonly": false})
+
+	if list := c.mustCall("honeytoken/list", nil)["response"].([]interface{}); len(list) != 2 {
+		t.Errorf("unexpected honeytoken list: %v", list)
+	}
+
+	if data := c.download("/wallet.dat"); len(data) != honeytokenSize {
+		t.Errorf("unexpected decoy size %d", len(data))
+	}
+
+	if len(tripped) != 1 || tripped[0].Details["path"] != "/wallet.dat" || tripped[0].Details["action"] != "download" {
+		t.Fatalf("honeytoken not tripped: %v", tripped)
+	}
+
+	if !logged(fmt.Sprintf("honeytoken /wallet.dat accessed by admin (/api/file/download) from %s", tripped[0].Details["remote"])) {
+		t.Error("honeytoken access not logged")
+	}
+
+	if res := c.call("file/download", jsonObject{"path": "/" + honeytokenFile}); res["status"] != "KO" {
+		t.Errorf("honeytoken store accessible: %v", res)
+	}
+
+	c.mustCall("honeytoken/remove", jsonObject{"path": "/wallet.dat"})
+	c.download("/wallet.dat")
+
+	if len(tripped) != 1 {
+		t.Errorf("removed honeytoken tripped: %v", tripped)
+	}
+
+	c.mustCall("file/mkdir", jsonObject{"path": []string{"/vault/inner", "/other"}})
+	c.upload("/vault/inner/seed", "seed")
+	c.upload("/vault/notes", "notes")
+	c.mustCall("honeytoken/add", jsonObject{"path": "/vault/inner/seed"})
+
+	conf.Symlinks = symlinkPreserve
+	defer func() { conf.Symlinks = symlinkReject }()
+
+	os.Symlink("vault/inner/seed", filepath.Join(conf.MountPoint, "alias"))
+	os.Link(filepath.Join(conf.MountPoint, "vault", "inner", "seed"), filepath.Join(conf.MountPoint, "hardlink"))
+
+	tripped = nil
+
+	c.mustCall("file/copy", jsonObject{"src": []string{"/vault/notes"}, "dst": "/other"})
+	c.wait("/other/notes")
+
+	if len(tripped) != 0 {
+		t.Errorf("honeytoken tripped by unrelated file: %v", tripped)
+	}
+
+	for _, req := range []struct {
+		method string
+		args   jsonObject
+	}{
+		{"file/download", jsonObject{"path": "/alias"}},
+		{"file/download", jsonObject{"path": "/hardlink"}},
+		{"file/copy", jsonObject{"src": []string{"/vault"}, "dst": "/copy"}},
+		{"file/compress", jsonObject{"src": []string{"/vault"}, "dst": "/vault.zip"}},
+		{"file/sign", jsonObject{"src": "/vault/inner/seed", "cipher": "OpenPGP", "password": "", "key": "/invalid"}},
+		{"clipboard/copy", jsonObject{"path": []string{"/vault/inner"}}},
+		{"clipboard/paste", jsonObject{"dst": "/other"}},
+	} {
+		before := len(tripped)
+		c.call(req.method, req.args)
+
+		if req.method == "clipboard/copy" {
+			continue
+		}
+
+		if len(tripped) != before+1 || tripped[before].Details["path"] != "/vault/inner/seed" {
+			t.Errorf("honeytoken not tripped by %s %v: %v", req.method, req.args, tripped)
+		}
+	}
+
+	c.wait("/other/inner/seed")
+	c.wait("/vault.zip")
+
+	c.mustCall("file/move", jsonObject{"src": []string{"/vault"}, "dst": "/moved"})
+
+	if list := c.mustCall("honeytoken/list", nil)["response"].([]interface{}); len(list) != 2 || list[0].(map[string]interface{})["path"] != "/moved/inner/seed" {
+		t.Errorf("honeytoken not moved: %v", list)
+	}
+
+	c.mustCall("file/delete", jsonObject{"path": []string{"/moved"}})
+
+	if list := c.mustCall("honeytoken/list", nil)["response"].([]interface{}); len(list) != 1 || list[0].(map[string]interface{})["path"] != "/passwords.txt" {
+		t.Errorf("deleted honeytoken not removed: %v", list)
+	}
+
+	conf.HoneytokenLock = true
+
+	if res := c.call("file/download", jsonObject{"path": "/passwords.txt"}); res["status"] != "INVALID_SESSION" {
+		t.Errorf("session not closed: %v", res)
+	}
+
+	if res := c.call("file/list", jsonObject{"path": "/", "sha256": false}); res["status"] != "INVALID_SESSION" {
+		t.Errorf("volume not locked: %v", res)
+	}
+}
+
+func TestKeyHierarchy(t *testing.T) {
+	c := newTestServer(t)
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	c.mustCall("crypto/gen_key", jsonObject{"identifier": "hierarchy", "key_format": "armor", "cipher": "OpenPGP", "email": "testonly@example.com"})
+	c.wait("/keys/pgp/private/hierarchy.armor")
+
+	res := c.mustCall("crypto/hierarchy", nil)["response"].(map[string]interface{})
+
+	if res["volume"] != testVolume {
+		t.Errorf("unexpected volume: %v", res["volume"])
+	}
+
+	nodes := make(map[string]map[string]interface{})
+
+	for _, n := range res["keys"].([]interface{}) {
+		node := n.(map[string]interface{})
+		nodes[node["name"].(string)] = node
+	}
+
+	if k := nodes[volumeKeyName]; k == nil || k["protected_by"].([]interface{})[0] != keyProtectionPassphrase {
+		t.Errorf("unexpected volume key: %v", k)
+	}
+
+	k := nodes["OpenPGP keys"]
+
+	if k == nil || k["parent"] != volumeKeyName || k["count"].(float64) != 1 || k["encrypted"] != nil {
+		t.Fatalf("unexpected OpenPGP keys: %v", k)
+	}
+
+	if p := k["protected_by"].([]interface{}); len(p) != 1 || p[0] != keyProtectionPlaintext {
+		t.Errorf("unexpected OpenPGP keys protection: %v", p)
+	}
+
+	if k := nodes["AES-256-OFB keys"]; k == nil || k["parent"] != nil || k["storage"] == "" {
+		t.Errorf("unexpected AES-256-OFB keys: %v", k)
+	}
+}
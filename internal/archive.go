@@ -8,22 +8,32 @@ package interlock
 
 import (
 	"archive/zip"
-	"errors"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
 	"io"
+	"io/ioutil"
 	"log/syslog"
 	"os"
 	"path"
-	"path/filepath"
 	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
 )
 
-func zipWriter(src []string, dst io.Writer) (written int64, err error) {
+// zipWriter archives the source paths, entries are AES encrypted when a
+// password is specified.
+func zipWriter(src []string, dst io.Writer, password string) (written int64, err error) {
 	writer := zip.NewWriter(dst)
 	defer writer.Close()
 
 	walkFn := func(osPath string, info os.FileInfo, e error) (err error) {
 		var w int64
-		var f io.Writer
+		var content io.Reader
 
 		if info == nil {
 			return
@@ -38,6 +48,22 @@ func zipWriter(src []string, dst io.Writer) (written int64, err error) {
 		n := status.Notify(syslog.LOG_NOTICE, "adding %s to archive", path.Base(osPath))
 		defer status.Remove(n)
 
+		var target string
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			var linked os.FileInfo
+
+			target, linked, err = archiveLink(osPath)
+
+			if err != nil {
+				return
+			}
+
+			if linked != nil {
+				info = linked
+			}
+		}
+
 		fileHeader, err := zip.FileInfoHeader(info)
 
 		if err != nil {
@@ -47,26 +73,36 @@ func zipWriter(src []string, dst io.Writer) (written int64, err error) {
 		relPath := strings.TrimPrefix(relativePath(osPath), "/")
 		fileHeader.Name = relPath
 
-		f, err = writer.CreateHeader(fileHeader)
+		// preserved symbolic links store their target as content
+		if info.Mode()&os.ModeSymlink != 0 {
+			content = strings.NewReader(target)
+		} else {
+			input, err := openStored(osPath)
 
-		if err != nil {
-			return
+			if err != nil {
+				return err
+			}
+			defer input.Close()
+
+			content = input
 		}
 
-		input, err := os.Open(osPath)
+		if password != "" {
+			w, err = zipAESEntry(writer, fileHeader, content, password)
+			written += w
 
-		if err != nil {
 			return
 		}
-		defer input.Close()
 
-		w, err = io.Copy(f, input)
-		written += w
+		f, err := writer.CreateHeader(fileHeader)
 
 		if err != nil {
 			return
 		}
 
+		w, err = io.Copy(f, content)
+		written += w
+
 		return
 	}
 
@@ -74,7 +110,7 @@ func zipWriter(src []string, dst io.Writer) (written int64, err error) {
 		n := status.Notify(syslog.LOG_NOTICE, "compressing %s", path.Base(s))
 		defer status.Remove(n)
 
-		err = filepath.Walk(s, walkFn)
+		err = volumeJail().Walk(s, walkFn)
 
 		if err != nil {
 			break
@@ -84,17 +120,22 @@ func zipWriter(src []string, dst io.Writer) (written int64, err error) {
 	return
 }
 
-func zipPath(src []string, dst string) (err error) {
-	output, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_TRUNC, 0600)
+func zipPath(owner string, src []string, dst string, password string) (err error) {
+	output, err := createAtomic("compress", "", dst, true)
 
 	if err != nil {
 		return
 	}
 
-	go func() {
-		defer output.Close()
+	jobs.Go(owner, "compressing archive", func() {
+
+		_, err = zipWriter(src, output.File, password)
 
-		_, err = zipWriter(src, output)
+		if err == nil {
+			err = output.Commit()
+		} else {
+			output.Abort()
+		}
 
 		if err != nil {
 			status.Error(err)
@@ -102,88 +143,282 @@ func zipPath(src []string, dst string) (err error) {
 		}
 
 		status.Log(syslog.LOG_NOTICE, "completed compression to %s", relativePath(dst))
-	}()
+	})
 
 	return
 }
 
-func unzipFile(src string, dst string) (err error) {
+func unzipFile(owner string, src string, dst string) (err error) {
 	reader, err := zip.OpenReader(src)
 
 	if err != nil {
 		return
 	}
 
-	err = os.MkdirAll(dst, 0700)
+	// a pre-existing destination directory is not rolled back
+	var artifacts []string
+
+	if _, err = volumeJail().Stat(dst); os.IsNotExist(err) {
+		artifacts = append(artifacts, dst)
+	}
+
+	id := journal.Begin("extract", src, dst, artifacts...)
+	err = volumeJail().MkdirAll(dst, 0700)
 
 	if err != nil {
+		journal.End(id)
 		defer reader.Close()
 		return
 	}
 
-	go func() {
+	jobs.Go(owner, "extracting archive", func() {
+		defer journal.End(id)
 		defer reader.Close()
 
 		n := status.Notify(syslog.LOG_NOTICE, "extracting %s", relativePath(src))
 		defer status.Remove(n)
 
-		for _, f := range reader.Reader.File {
-			if strings.Contains(f.Name, traversalPattern) {
-				status.Error(errors.New("path traversal detected"))
-				return
-			}
+		err := unzip(&reader.Reader, dst)
 
-			dstPath := filepath.Join(dst, f.Name)
+		if err != nil {
+			status.Error(err)
+			return
+		}
 
-			if f.FileInfo().IsDir() {
-				err = os.MkdirAll(dstPath, f.Mode())
+		status.Log(syslog.LOG_NOTICE, "completed extraction of %s", relativePath(src))
+	})
 
-				if err != nil {
-					status.Error(err)
-					return
-				}
-			} else {
-				err = os.MkdirAll(path.Dir(dstPath), 0700)
+	return
+}
 
-				if err != nil {
-					status.Error(err)
-					return
-				}
+func unzip(reader *zip.Reader, dst string) (err error) {
+	j := &jail{root: dst}
 
-				n := status.Notify(syslog.LOG_NOTICE, "extracting %s from archive", f.Name)
-				defer status.Remove(n)
+	for _, f := range reader.File {
+		var dstPath string
 
-				output, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_TRUNC, f.Mode())
+		dstPath, err = j.Path(f.Name)
 
-				if err != nil {
-					status.Error(err)
-					return
-				}
-				defer output.Close()
+		if err != nil {
+			return
+		}
 
-				input, err := f.Open()
+		if f.FileInfo().IsDir() {
+			err = j.MkdirAll(dstPath, f.Mode())
+		} else if f.Mode()&os.ModeSymlink != 0 {
+			err = unzipLink(f, dstPath)
+		} else {
+			err = unzipEntry(j, f, dstPath)
+		}
 
-				if err != nil {
-					status.Error(err)
-					return
-				}
-				defer input.Close()
+		if err != nil {
+			return
+		}
+	}
 
-				_, err = io.Copy(output, input)
+	return
+}
 
-				if err != nil {
-					status.Error(err)
-					return
-				}
+func unzipEntry(j *jail, f *zip.File, dstPath string) (err error) {
+	err = j.MkdirAll(path.Dir(dstPath), 0700)
+
+	if err != nil {
+		return
+	}
+
+	n := status.Notify(syslog.LOG_NOTICE, "extracting %s from archive", f.Name)
+	defer status.Remove(n)
+
+	output, err := j.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_TRUNC, f.Mode())
+
+	if err != nil {
+		return
+	}
+	defer output.Close()
+
+	input, err := f.Open()
+
+	if err != nil {
+		return
+	}
+	defer input.Close()
+
+	_, err = io.Copy(output, input)
 
-				output.Close()
-				//lint:ignore SA1019 incorrectly matches zip:*FileHeader.ModTime()
-				os.Chtimes(dstPath, f.ModTime(), f.ModTime())
+	if err != nil {
+		return
+	}
+
+	output.Close()
+	//lint:ignore SA1019 incorrectly matches zip:*FileHeader.ModTime()
+	j.Chtimes(dstPath, f.ModTime(), f.ModTime())
+
+	return
+}
+
+func unzipLink(f *zip.File, dstPath string) (err error) {
+	input, err := f.Open()
+
+	if err != nil {
+		return
+	}
+	defer input.Close()
+
+	target, err := ioutil.ReadAll(io.LimitReader(input, maxLinkTarget))
+
+	if err != nil {
+		return
+	}
+
+	return extractLink(dstPath, string(target))
+}
+
+// WinZip AES (AE-2) encryption, entries are deflated and then encrypted with
+// AES-256 in little-endian counter mode, the encrypted data is authenticated
+// with HMAC-SHA1. Keys are derived from the password using PBKDF2 with SHA1
+// and 1000 rounds:
+//
+// salt (16 bytes) || password verifier (2 bytes) || ciphertext || hmac (10 bytes)
+
+const zipAESMethod = 99
+const zipAESExtraID = 0x9901
+const zipAESSaltSize = 16
+const zipAESMacSize = 10
+const zipAESRounds = 1000
+
+// zipAESKeys returns the encryption key, authentication key and password
+// verifier.
+func zipAESKeys(password string, salt []byte) (encKey []byte, macKey []byte, verifier []byte) {
+	k := pbkdf2.Key([]byte(password), salt, zipAESRounds, 2*32+2, sha1.New)
+	return k[0:32], k[32:64], k[64:]
+}
+
+// zipAESStream implements the WinZip AES counter mode, the counter is a
+// little-endian block number starting at 1.
+type zipAESStream struct {
+	block   cipher.Block
+	counter [aes.BlockSize]byte
+	stream  [aes.BlockSize]byte
+	pos     int
+}
+
+func newZipAESStream(key []byte) (s *zipAESStream, err error) {
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return
+	}
+
+	return &zipAESStream{block: block, pos: aes.BlockSize}, nil
+}
+
+func (s *zipAESStream) XORKeyStream(dst []byte, src []byte) {
+	for i := range src {
+		if s.pos == aes.BlockSize {
+			for j := range s.counter {
+				s.counter[j]++
+
+				if s.counter[j] != 0 {
+					break
+				}
 			}
+
+			s.block.Encrypt(s.stream[:], s.counter[:])
+			s.pos = 0
 		}
 
-		status.Log(syslog.LOG_NOTICE, "completed extraction of %s", relativePath(src))
+		dst[i] = src[i] ^ s.stream[s.pos]
+		s.pos++
+	}
+}
+
+// zipAESEntry adds an encrypted entry, the encrypted data is staged in a
+// temporary file as its size is required before writing.
+func zipAESEntry(writer *zip.Writer, header *zip.FileHeader, input io.Reader, password string) (written int64, err error) {
+	tmp, err := ioutil.TempFile("", "zip-")
+
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
 	}()
 
+	salt := make([]byte, zipAESSaltSize)
+
+	if _, err = io.ReadFull(rand.Reader, salt); err != nil {
+		return
+	}
+
+	encKey, macKey, verifier := zipAESKeys(password, salt)
+	stream, err := newZipAESStream(encKey)
+
+	if err != nil {
+		return
+	}
+
+	if _, err = tmp.Write(append(salt, verifier...)); err != nil {
+		return
+	}
+
+	mac := hmac.New(sha1.New, macKey)
+	encrypted := &cipher.StreamWriter{S: stream, W: io.MultiWriter(tmp, mac)}
+	compressor, err := flate.NewWriter(encrypted, flate.DefaultCompression)
+
+	if err != nil {
+		return
+	}
+
+	if written, err = io.Copy(compressor, input); err != nil {
+		return
+	}
+
+	if err = compressor.Close(); err != nil {
+		return
+	}
+
+	if _, err = tmp.Write(mac.Sum(nil)[:zipAESMacSize]); err != nil {
+		return
+	}
+
+	size, err := tmp.Seek(0, io.SeekCurrent)
+
+	if err != nil {
+		return
+	}
+
+	// AE-2 vendor version, "AE" vendor id, AES-256 strength, actual method
+	extra := make([]byte, 11)
+	binary.LittleEndian.PutUint16(extra[0:], zipAESExtraID)
+	binary.LittleEndian.PutUint16(extra[2:], 7)
+	binary.LittleEndian.PutUint16(extra[4:], 2)
+	copy(extra[6:], "AE")
+	extra[8] = 3
+	binary.LittleEndian.PutUint16(extra[9:], zip.Deflate)
+
+	header.Method = zipAESMethod
+	header.Flags |= 0x1
+	header.CRC32 = 0
+	header.CompressedSize64 = uint64(size)
+	header.UncompressedSize64 = uint64(written)
+	header.Extra = append(header.Extra, extra...)
+
+	// raw entries do not derive the MS-DOS time from Modified
+	header.SetModTime(header.Modified)
+
+	w, err := writer.CreateRaw(header)
+
+	if err != nil {
+		return
+	}
+
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+
+	_, err = io.Copy(w, tmp)
+
 	return
 }
@@ -0,0 +1,201 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var archiveTestFiles = []struct {
+	name    string
+	content string
+}{
+	{"archive/a.txt", "01234567890ABCDEFGHILMNOPQRSTUVZ!@#"},
+	{"archive/sub/b.txt", "INTERLOCK archive test"},
+	{"archive/empty.txt", ""},
+}
+
+func archiveTestTree(t *testing.T) (src string) {
+	dir, err := ioutil.TempDir("", "archive_test-")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf.MountPoint = dir
+
+	for _, f := range archiveTestFiles {
+		p := filepath.Join(dir, f.name)
+		os.MkdirAll(filepath.Dir(p), 0700)
+
+		if err = ioutil.WriteFile(p, []byte(f.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return filepath.Join(dir, "archive")
+}
+
+func TestZipAES(t *testing.T) {
+	password := "interlocktest"
+	src := archiveTestTree(t)
+	defer os.RemoveAll(conf.MountPoint)
+
+	buf := new(bytes.Buffer)
+
+	if _, err := zipWriter([]string{src}, buf, password); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.File) != len(archiveTestFiles) {
+		t.Fatalf("unexpected number of entries: %d", len(r.File))
+	}
+
+	for _, f := range r.File {
+		if f.Method != zipAESMethod || f.Flags&0x1 == 0 {
+			t.Fatalf("%s: entry not encrypted", f.Name)
+		}
+
+		raw, err := f.OpenRaw()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, _ := ioutil.ReadAll(raw)
+		salt := data[:zipAESSaltSize]
+		body := data[zipAESSaltSize+2 : len(data)-zipAESMacSize]
+
+		encKey, macKey, verifier := zipAESKeys(password, salt)
+
+		if !bytes.Equal(verifier, data[zipAESSaltSize:zipAESSaltSize+2]) {
+			t.Fatalf("%s: password verifier mismatch", f.Name)
+		}
+
+		mac := hmac.New(sha1.New, macKey)
+		mac.Write(body)
+
+		if !hmac.Equal(mac.Sum(nil)[:zipAESMacSize], data[len(data)-zipAESMacSize:]) {
+			t.Fatalf("%s: authentication failure", f.Name)
+		}
+
+		stream, _ := newZipAESStream(encKey)
+		stream.XORKeyStream(body, body)
+
+		cleartext, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(body)))
+
+		if err != nil {
+			t.Fatalf("%s: %v", f.Name, err)
+		}
+
+		expected := ""
+
+		for _, tf := range archiveTestFiles {
+			if tf.name == f.Name {
+				expected = tf.content
+			}
+		}
+
+		if string(cleartext) != expected {
+			t.Errorf("%s: unexpected content %q", f.Name, cleartext)
+		}
+
+		if f.UncompressedSize64 != uint64(len(expected)) {
+			t.Errorf("%s: unexpected size %d", f.Name, f.UncompressedSize64)
+		}
+	}
+}
+
+func TestSevenZip(t *testing.T) {
+	password := "interlocktest"
+	src := archiveTestTree(t)
+	defer os.RemoveAll(conf.MountPoint)
+
+	output, _ := ioutil.TempFile("", "archive_test_7z-")
+	defer os.Remove(output.Name())
+
+	if _, err := sevenZipWriter([]string{src}, output, password); err != nil {
+		t.Fatal(err)
+	}
+
+	output.Close()
+	data, _ := ioutil.ReadFile(output.Name())
+
+	if !bytes.Equal(data[0:8], sevenZipSignature) {
+		t.Fatal("invalid signature")
+	}
+
+	if binary.LittleEndian.Uint32(data[8:12]) != crc32.ChecksumIEEE(data[12:32]) {
+		t.Fatal("start header CRC mismatch")
+	}
+
+	offset := binary.LittleEndian.Uint64(data[12:20])
+	size := binary.LittleEndian.Uint64(data[20:28])
+	header := data[32+offset : 32+offset+size]
+
+	if uint64(len(data)) != 32+offset+size {
+		t.Fatal("unexpected archive size")
+	}
+
+	if binary.LittleEndian.Uint32(data[28:32]) != crc32.ChecksumIEEE(header) {
+		t.Fatal("header CRC mismatch")
+	}
+
+	for _, f := range archiveTestFiles {
+		name := new(sevenZipBuffer)
+
+		for _, c := range f.name {
+			name.Write([]byte{byte(c), 0})
+		}
+
+		if !bytes.Contains(header, name.Bytes()) {
+			t.Errorf("%s: missing file name", f.name)
+		}
+	}
+
+	// coder id, properties size, cycles power, iv size, iv
+	i := bytes.Index(header, sevenZipAES)
+
+	if i < 0 {
+		t.Fatal("missing AES coder")
+	}
+
+	props := header[i+len(sevenZipAES)+1 : i+len(sevenZipAES)+1+18]
+	block, _ := aes.NewCipher(sevenZipKey(password, nil, uint(props[0]&0x3f)))
+
+	packed := append([]byte{}, data[32:32+offset]...)
+	cipher.NewCBCDecrypter(block, props[2:]).CryptBlocks(packed, packed)
+
+	// lexical walk order, empty files are not part of the packed stream
+	expected := archiveTestFiles[0].content + archiveTestFiles[1].content
+
+	if !bytes.HasPrefix(packed, []byte(expected)) {
+		t.Fatalf("unexpected cleartext: %q", packed)
+	}
+
+	if !bytes.Equal(packed[len(expected):], make([]byte, len(packed)-len(expected))) {
+		t.Fatal("unexpected padding")
+	}
+}
@@ -0,0 +1,115 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Atomic writes, mutating file operations write their output to a temporary
+// file in the destination directory, which is synchronized and renamed to the
+// final name only on success (followed by synchronization of the directory),
+// so that a crash never leaves a truncated file under its final name.
+//
+// Temporary files are recorded in the operation journal for removal after an
+// interrupted operation.
+
+const partialPrefix = ".interlock-partial-"
+
+type atomicFile struct {
+	*os.File
+
+	dst       string
+	exclusive bool
+	journal   string
+}
+
+// createAtomic creates a temporary file for the argument destination, when
+// exclusive the destination must not exist, both at creation and commit time.
+func createAtomic(op string, src string, dst string, exclusive bool) (f *atomicFile, err error) {
+	if exclusive {
+		if _, err = volumeJail().Lstat(dst); err == nil {
+			return nil, fmt.Errorf("path %s exists", relativePath(dst))
+		}
+	}
+
+	tmp, err := volumeJail().CreateTemp(filepath.Dir(dst), partialPrefix)
+
+	if err != nil {
+		return
+	}
+
+	f = &atomicFile{
+		File:      tmp,
+		dst:       dst,
+		exclusive: exclusive,
+		journal:   journal.Begin(op, src, dst, tmp.Name()),
+	}
+
+	return
+}
+
+// Commit synchronizes the temporary file and moves it to its destination.
+func (f *atomicFile) Commit() (err error) {
+	defer journal.End(f.journal)
+
+	tmp := f.Name()
+
+	defer func() {
+		if err != nil {
+			volumeJail().Remove(tmp)
+		}
+	}()
+
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return
+	}
+
+	if err = f.Close(); err != nil {
+		return
+	}
+
+	if f.exclusive {
+		// linking, unlike renaming, fails on an existing destination
+		if err = volumeJail().Link(tmp, f.dst); err != nil {
+			return
+		}
+
+		err = volumeJail().Remove(tmp)
+	} else {
+		err = volumeJail().Rename(tmp, f.dst)
+	}
+
+	if err != nil {
+		return
+	}
+
+	return syncDir(filepath.Dir(f.dst))
+}
+
+// Abort discards the temporary file.
+func (f *atomicFile) Abort() {
+	defer journal.End(f.journal)
+
+	f.Close()
+	volumeJail().Remove(f.Name())
+}
+
+// syncDir synchronizes a directory, persisting entries renamed in it.
+func syncDir(dir string) (err error) {
+	d, err := volumeJail().Open(dir)
+
+	if err != nil {
+		return
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
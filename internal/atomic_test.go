@@ -0,0 +1,92 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func partialFiles(t *testing.T, dir string) (n int) {
+	entries, err := ioutil.ReadDir(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), partialPrefix) {
+			n++
+		}
+	}
+
+	return
+}
+
+func TestAtomicFile(t *testing.T) {
+	c := newTestServer(t)
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	dst := filepath.Join(conf.MountPoint, "atomic.txt")
+
+	f, err := createAtomic("upload", "", dst, true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.Write([]byte("truncated"))
+
+	if _, err = ioutil.ReadFile(dst); err == nil {
+		t.Error("incomplete file visible under its final name")
+	}
+
+	f.Abort()
+
+	if _, err = ioutil.ReadFile(dst); err == nil || partialFiles(t, conf.MountPoint) != 0 {
+		t.Fatal("aborted file not discarded")
+	}
+
+	f, _ = createAtomic("upload", "", dst, true)
+	f.Write([]byte(testCleartext))
+
+	if err = f.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, _ := ioutil.ReadFile(dst); string(data) != testCleartext {
+		t.Errorf("committed data mismatch: %s", data)
+	}
+
+	if _, err = createAtomic("upload", "", dst, true); err == nil {
+		t.Error("exclusive creation over existing file")
+	}
+
+	// existing destination created while writing
+	f, _ = createAtomic("encrypt", "", filepath.Join(conf.MountPoint, "race.txt"), true)
+	ioutil.WriteFile(filepath.Join(conf.MountPoint, "race.txt"), []byte("existing"), 0600)
+
+	if err = f.Commit(); err == nil {
+		t.Error("exclusive commit over existing file")
+	}
+
+	if data, _ := ioutil.ReadFile(filepath.Join(conf.MountPoint, "race.txt")); string(data) != "existing" {
+		t.Error("existing file replaced")
+	}
+
+	if partialFiles(t, conf.MountPoint) != 0 {
+		t.Error("temporary files left behind")
+	}
+
+	if len(journal.active) != 0 {
+		t.Errorf("operations not removed from journal %v", journal.active)
+	}
+}
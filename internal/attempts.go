@@ -0,0 +1,90 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"log/syslog"
+	"sync"
+)
+
+// Failed login attempts, while the volume is locked unsuccessful logins are
+// recorded (time, volume, client address and TLS fingerprint) in memory and
+// reported on the next successful login, in the "failed_logins" attribute of
+// the login response and in the application log, so that users notice
+// password guessing against their device.
+//
+// The TLS fingerprint is the one used for session binding (negotiated
+// parameters and client certificate).
+
+const loginAttemptsMax = 100
+
+type loginAttempt struct {
+	Epoch  int64  `json:"epoch"`
+	Volume string `json:"volume"`
+	Remote string `json:"remote"`
+	TLS    string `json:"tls,omitempty"`
+}
+
+type loginAttempts struct {
+	sync.Mutex
+	pending []loginAttempt
+	dropped int
+	// attempts reported at the last login
+	last []loginAttempt
+}
+
+var failedLogins loginAttempts
+
+func init() {
+	eventSinks = append(eventSinks, failedLogins.record)
+}
+
+func (a *loginAttempts) record(e event) {
+	if e.Name != eventLoginFailed {
+		return
+	}
+
+	attempt := loginAttempt{Epoch: e.Epoch}
+	attempt.Volume, _ = e.Details["volume"].(string)
+	attempt.Remote, _ = e.Details["remote"].(string)
+	attempt.TLS, _ = e.Details["tls"].(string)
+
+	a.Lock()
+	defer a.Unlock()
+
+	if len(a.pending) >= loginAttemptsMax {
+		a.pending = a.pending[1:]
+		a.dropped++
+	}
+
+	a.pending = append(a.pending, attempt)
+}
+
+// Take reports the attempts recorded since the previous login, which are
+// then retained until the next one.
+func (a *loginAttempts) Take() {
+	a.Lock()
+	defer a.Unlock()
+
+	a.last = a.pending
+	a.pending = nil
+
+	if n := len(a.last) + a.dropped; n > 0 {
+		latest := a.last[len(a.last)-1]
+		status.Log(syslog.LOG_WARNING, "%d failed login attempt(s) since the last login, latest from %s", n, latest.Remote)
+	}
+
+	a.dropped = 0
+}
+
+// Last returns the attempts reported at the last login.
+func (a *loginAttempts) Last() []loginAttempt {
+	a.Lock()
+	defer a.Unlock()
+
+	return append([]loginAttempt{}, a.last...)
+}
@@ -7,19 +7,19 @@
 package interlock
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"errors"
 	"net/http"
-	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
 const cookieSize = 64
 const cookieAge = 8 * 60 * 60
 
-const sessionCookie = "INTERLOCK-Token"
 const XSRFHeader = "X-XSRFToken"
 
 func randomString(size int) (c string, err error) {
@@ -32,7 +32,46 @@ func randomString(size int) (c string, err error) {
 	return
 }
 
-func authenticate(volume string, password string, dispose bool) (err error) {
+func sessionCookie(value string, maxAge int) (cookie *http.Cookie) {
+	cookie = &http.Cookie{
+		Name:     conf.CookieName,
+		Value:    value,
+		Path:     "/api",
+		MaxAge:   maxAge,
+		Secure:   conf.TLS != "off" || conf.SecureProxy,
+		HttpOnly: true,
+	}
+
+	switch strings.ToLower(conf.SameSite) {
+	case "lax":
+		cookie.SameSite = http.SameSiteLaxMode
+	case "none":
+		// browsers reject SameSite=None cookies without Secure flag
+		cookie.SameSite = http.SameSiteNoneMode
+		cookie.Secure = true
+	case "off":
+		cookie.SameSite = http.SameSiteDefaultMode
+	default:
+		cookie.SameSite = http.SameSiteStrictMode
+	}
+
+	// cookie prefixes, see RFC6265bis section 4.1.3
+	switch {
+	case strings.HasPrefix(cookie.Name, "__Host-"):
+		cookie.Path = "/"
+		cookie.Secure = true
+	case strings.HasPrefix(cookie.Name, "__Secure-"):
+		cookie.Secure = true
+	}
+
+	return
+}
+
+func authenticate(ctx context.Context, volume string, password string, dispose bool) (err error) {
+	if err = checkAccessWindow(volume); err != nil {
+		return
+	}
+
 	if conf.TestMode {
 		conf.ActivateCiphers(true)
 		return
@@ -50,26 +89,38 @@ func authenticate(volume string, password string, dispose bool) (err error) {
 		return
 	}
 
-	err = unlock(volume, password)
+	err = unlock(ctx, volume, password)
 
 	if err != nil {
 		return
 	}
 
-	err = mount()
+	err = mount(ctx)
 
 	if err != nil {
 		return
 	}
 
-	err = os.MkdirAll(filepath.Join(conf.MountPoint, conf.KeyPath), 0700)
+	if err = protectHidden(); err != nil {
+		return
+	}
+
+	err = volumeJail().MkdirAll(filepath.Join(conf.MountPoint, conf.KeyPath), 0700)
 
 	if err != nil {
 		return
 	}
 
 	if dispose {
-		err = keyOp(volume, password, "", _remove)
+		err = keyOp(ctx, volume, password, "", _remove)
+
+		if err != nil {
+			return
+		}
+	}
+
+	if conf.ReadOnly {
+		err = readOnly.Set(true)
 
 		if err != nil {
 			return
@@ -82,131 +133,226 @@ func authenticate(volume string, password string, dispose bool) (err error) {
 }
 
 func refresh(w http.ResponseWriter) (res jsonObject) {
+	XSRFToken, err := session.RotateXSRFToken()
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
 	res = jsonObject{
 		"status": "OK",
 		"response": map[string]interface{}{
 			"volume":    session.Volume,
-			"XSRFToken": session.XSRFToken},
+			"XSRFToken": XSRFToken},
 	}
 
 	return
 }
 
-func login(w http.ResponseWriter, r *http.Request) (res jsonObject) {
+// nonceRequest issues a one-time XSRF token for a destructive API method.
+func nonceRequest(r *http.Request) (res jsonObject) {
 	req, err := parseRequest(r)
 
 	if err != nil {
 		return errorResponse(err, "")
 	}
 
-	err = validateRequest(req, []string{"volume:s", "password:s", "dispose:b"})
+	method := strings.TrimPrefix(req["method"].(string), "/api/")
+	nonce, err := session.Nonce("/api/" + method)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": nonce,
+	}
+
+	return
+}
+
+func login(w http.ResponseWriter, r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
 
 	if err != nil {
 		return errorResponse(err, "")
 	}
 
+	if err = acknowledgeBanner(req, r.RemoteAddr); err != nil {
+		return errorResponse(err, "")
+	}
+
 	if session.SessionID != "" {
 		return errorResponse(errors.New("existing session"), "INVALID_SESSION")
 	}
 
-	err = authenticate(req["volume"].(string), req["password"].(string), req["dispose"].(bool))
+	volume := req["volume"].(string)
+	password := req["password"].(string)
+	dispose := req["dispose"].(bool)
+
+	// optional FIDO2 unlock, the password is the authenticator PIN
+	if fido2, _ := req["fido2"].(bool); fido2 && !conf.TestMode {
+		if dispose {
+			return errorResponse(errors.New("FIDO2 keyslots cannot be disposed"), "")
+		}
+
+		password, err = fido2Passphrase(volume, password)
+
+		if err != nil {
+			emitEvent(eventLoginFailed, map[string]interface{}{
+				"volume": volume,
+				"remote": r.RemoteAddr,
+				"tls":    tlsFingerprint(r),
+			})
+
+			return errorResponse(err, "INVALID_SESSION")
+		}
+	}
+
+	return openSession(w, r, volume, password, dispose)
+}
+
+// openSession authenticates the volume and returns the login response.
+func openSession(w http.ResponseWriter, r *http.Request, volume string, password string, dispose bool) (res jsonObject) {
+	err := authenticate(r.Context(), volume, password, dispose)
 
 	if err != nil {
-		_ = umount()
-		_ = lock()
+		loginFailed(volume, r.RemoteAddr, tlsFingerprint(r))
 		return errorResponse(err, "INVALID_SESSION")
 	}
 
-	sessionID, err := randomString(cookieSize)
+	sessionID, XSRFToken, err := startSession(volume, r.RemoteAddr)
 
 	if err != nil {
 		return errorResponse(err, "")
 	}
 
-	secure := true
+	session.Bind(r)
 
-	if conf.TLS == "off" {
-		secure = false
-	}
+	http.SetCookie(w, sessionCookie(sessionID, cookieAge))
 
-	sessionCookie := &http.Cookie{
-		Name:     sessionCookie,
-		Value:    sessionID,
-		Path:     "/api",
-		MaxAge:   cookieAge,
-		Secure:   secure,
-		HttpOnly: true,
+	res = jsonObject{
+		"status": "OK",
+		"response": map[string]interface{}{
+			"volume":        session.Volume,
+			"XSRFToken":     XSRFToken,
+			"tamper":        measurements.Changes(),
+			"failed_logins": failedLogins.Last()},
 	}
 
-	http.SetCookie(w, sessionCookie)
+	return
+}
+
+// loginFailed releases the volume after an unsuccessful authentication, the
+// TLS fingerprint is empty for non-TLS login methods.
+func loginFailed(volume string, remote string, fingerprint string) {
+	reportError("login cleanup", umount())
+	reportError("login cleanup", lock())
+
+	emitEvent(eventLoginFailed, map[string]interface{}{
+		"volume": volume,
+		"remote": remote,
+		"tls":    fingerprint,
+	})
+}
 
-	XSRFToken, err := randomString(cookieSize)
+// startSession opens a session on an authenticated volume, sessions are
+// shared by all login methods (web and console).
+func startSession(volume string, remote string) (sessionID string, XSRFToken string, err error) {
+	sessionID, err = randomString(cookieSize)
 
 	if err != nil {
-		_ = umount()
-		_ = lock()
-		return errorResponse(err, "")
+		return
 	}
 
-	if !conf.Debug {
+	XSRFToken, err = randomString(cookieSize)
+
+	if err != nil {
+		reportError("login cleanup", umount())
+		reportError("login cleanup", lock())
+		return
+	}
+
+	if !conf.Debug && !readOnly.Enabled() {
 		// switch logging to encrypted partition
 		EnableFileLog()
 	}
 
-	session.Set(req["volume"].(string), sessionID, XSRFToken)
+	session.Set(volume, sessionID, XSRFToken)
+	reportError("systemd status", systemd.Status())
+	failedLogins.Take()
+	deadman.Reset()
+	reportError("status history", history.Open())
+	transcript.Start(volume, remote)
+	depositPending()
+	journal.Recover()
+
+	if conf.WiFi != "" {
+		go wifiRestore()
+	}
+
+	emitEvent(eventLogin, map[string]interface{}{
+		"volume": volume,
+		"remote": remote,
+	})
 
 	go func() {
 		time.Sleep(cookieAge * time.Second)
 		session.Clear()
+		reportError("systemd status", systemd.Status())
 	}()
 
-	res = jsonObject{
-		"status": "OK",
-		"response": map[string]interface{}{
-			"volume":    session.Volume,
-			"XSRFToken": session.XSRFToken},
-	}
-
 	return
 }
 
 func logout(w http.ResponseWriter) (res jsonObject) {
-	session.Clear()
+	http.SetCookie(w, sessionCookie("delete", -1))
 
-	if !conf.Debug {
-		// restore logging to syslog before unmounting encrypted partition
-		EnableSyslog()
-	}
+	err := closeSession()
 
-	sessionCookie := &http.Cookie{
-		Name:     sessionCookie,
-		Value:    "delete",
-		Path:     "/api",
-		MaxAge:   -1,
-		Secure:   true,
-		HttpOnly: true,
+	if err != nil {
+		return errorResponse(err, "")
 	}
 
-	http.SetCookie(w, sessionCookie)
-
 	res = jsonObject{
 		"status":   "OK",
 		"response": nil,
 	}
 
-	conf.ActivateCiphers(false)
+	return
+}
 
-	err := umount()
+// closeSession terminates the active session and locks the volume.
+func closeSession() (err error) {
+	migration.Stop()
+	session.Clear()
+	reportError("systemd status", systemd.Status())
+	transcript.End()
 
-	if err != nil {
-		return errorResponse(err, "")
+	if !conf.Debug {
+		// restore logging to syslog before unmounting encrypted partition
+		EnableSyslog()
 	}
 
-	err = lock()
+	conf.ActivateCiphers(false)
+	dedup.Reset()
+	locks.Reset()
+	clip.Reset()
+	guests.Reset()
+	acls.Reset()
+	honeytokens.Reset()
+	revocations.Reset()
+	history.Reset()
+	journal.Reset()
+	download.Reset()
+	previews.Reset()
+
+	err = umount()
 
 	if err != nil {
-		return errorResponse(err, "")
+		return
 	}
 
-	return
+	return lock()
 }
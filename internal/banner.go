@@ -0,0 +1,47 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"errors"
+	"log/syslog"
+)
+
+// Login banner, a legal notice displayed before login. When configured every
+// login method requires its explicit acknowledgment ("banner" attribute),
+// which is recorded in the audit log.
+
+var errBanner = errors.New("login banner not acknowledged")
+
+func bannerStatus() (res jsonObject) {
+	res = jsonObject{
+		"status": "OK",
+		"response": map[string]interface{}{
+			"banner":      conf.Banner,
+			"acknowledge": conf.Banner != "",
+		},
+	}
+
+	return
+}
+
+// acknowledgeBanner verifies and records the banner acknowledgment of a login
+// request.
+func acknowledgeBanner(req jsonObject, remote string) (err error) {
+	if conf.Banner == "" {
+		return
+	}
+
+	if ack, _ := req["banner"].(bool); !ack {
+		status.Log(syslog.LOG_WARNING, "login from %s without login banner acknowledgment", remote)
+		return errBanner
+	}
+
+	status.Log(syslog.LOG_NOTICE, "login banner acknowledged from %s", remote)
+
+	return
+}
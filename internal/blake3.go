@@ -0,0 +1,253 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// BLAKE3 (hash mode, 256-bit output), used for internal content hashing where
+// it is considerably faster than SHA-256 on the USB armory CPU, which lacks
+// SHA extensions.
+
+const (
+	blake3BlockLen = 64
+	blake3ChunkLen = 1024
+	blake3Size     = 32
+)
+
+const (
+	blake3ChunkStart = 1 << 0
+	blake3ChunkEnd   = 1 << 1
+	blake3Parent     = 1 << 2
+	blake3Root       = 1 << 3
+)
+
+var blake3IV = [8]uint32{
+	0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a,
+	0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19,
+}
+
+var blake3Permutation = [16]int{2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8}
+
+func blake3G(s *[16]uint32, a, b, c, d int, mx, my uint32) {
+	s[a] = s[a] + s[b] + mx
+	s[d] = bits.RotateLeft32(s[d]^s[a], -16)
+	s[c] = s[c] + s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -12)
+	s[a] = s[a] + s[b] + my
+	s[d] = bits.RotateLeft32(s[d]^s[a], -8)
+	s[c] = s[c] + s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -7)
+}
+
+func blake3Compress(cv *[8]uint32, block *[16]uint32, counter uint64, blockLen uint32, flags uint32) (s [16]uint32) {
+	m := *block
+
+	copy(s[0:8], cv[:])
+	copy(s[8:12], blake3IV[0:4])
+
+	s[12] = uint32(counter)
+	s[13] = uint32(counter >> 32)
+	s[14] = blockLen
+	s[15] = flags
+
+	for r := 0; r < 7; r++ {
+		blake3G(&s, 0, 4, 8, 12, m[0], m[1])
+		blake3G(&s, 1, 5, 9, 13, m[2], m[3])
+		blake3G(&s, 2, 6, 10, 14, m[4], m[5])
+		blake3G(&s, 3, 7, 11, 15, m[6], m[7])
+		blake3G(&s, 0, 5, 10, 15, m[8], m[9])
+		blake3G(&s, 1, 6, 11, 12, m[10], m[11])
+		blake3G(&s, 2, 7, 8, 13, m[12], m[13])
+		blake3G(&s, 3, 4, 9, 14, m[14], m[15])
+
+		var p [16]uint32
+
+		for i := range p {
+			p[i] = m[blake3Permutation[i]]
+		}
+
+		m = p
+	}
+
+	for i := 0; i < 8; i++ {
+		s[i] ^= s[i+8]
+		s[i+8] ^= cv[i]
+	}
+
+	return
+}
+
+func blake3Words(b []byte) (w [16]uint32) {
+	var block [blake3BlockLen]byte
+	copy(block[:], b)
+
+	for i := range w {
+		w[i] = binary.LittleEndian.Uint32(block[i*4:])
+	}
+
+	return
+}
+
+// blake3Output holds the inputs of a node compression, which are retained to
+// compute either its chaining value or the root output.
+type blake3Output struct {
+	cv       [8]uint32
+	block    [16]uint32
+	counter  uint64
+	blockLen uint32
+	flags    uint32
+}
+
+func (o *blake3Output) chainingValue() (cv [8]uint32) {
+	s := blake3Compress(&o.cv, &o.block, o.counter, o.blockLen, o.flags)
+	copy(cv[:], s[0:8])
+
+	return
+}
+
+func (o *blake3Output) root() (out []byte) {
+	s := blake3Compress(&o.cv, &o.block, 0, o.blockLen, o.flags|blake3Root)
+	out = make([]byte, blake3Size)
+
+	for i := 0; i < blake3Size/4; i++ {
+		binary.LittleEndian.PutUint32(out[i*4:], s[i])
+	}
+
+	return
+}
+
+func blake3ParentOutput(left [8]uint32, right [8]uint32) *blake3Output {
+	o := &blake3Output{
+		cv:       blake3IV,
+		blockLen: blake3BlockLen,
+		flags:    blake3Parent,
+	}
+
+	copy(o.block[0:8], left[:])
+	copy(o.block[8:16], right[:])
+
+	return o
+}
+
+type blake3Chunk struct {
+	cv         [8]uint32
+	counter    uint64
+	block      [blake3BlockLen]byte
+	blockLen   int
+	compressed int
+}
+
+func newBLAKE3Chunk(counter uint64) blake3Chunk {
+	return blake3Chunk{cv: blake3IV, counter: counter}
+}
+
+func (c *blake3Chunk) len() int {
+	return c.compressed*blake3BlockLen + c.blockLen
+}
+
+func (c *blake3Chunk) startFlag() uint32 {
+	if c.compressed == 0 {
+		return blake3ChunkStart
+	}
+
+	return 0
+}
+
+func (c *blake3Chunk) update(p []byte) {
+	for len(p) > 0 {
+		if c.blockLen == blake3BlockLen {
+			w := blake3Words(c.block[:])
+			s := blake3Compress(&c.cv, &w, c.counter, blake3BlockLen, c.startFlag())
+			copy(c.cv[:], s[0:8])
+
+			c.compressed++
+			c.blockLen = 0
+		}
+
+		n := copy(c.block[c.blockLen:], p)
+		c.blockLen += n
+		p = p[n:]
+	}
+}
+
+func (c *blake3Chunk) output() *blake3Output {
+	return &blake3Output{
+		cv:       c.cv,
+		block:    blake3Words(c.block[:c.blockLen]),
+		counter:  c.counter,
+		blockLen: uint32(c.blockLen),
+		flags:    c.startFlag() | blake3ChunkEnd,
+	}
+}
+
+type blake3Hash struct {
+	chunk blake3Chunk
+	stack [][8]uint32
+}
+
+func newBLAKE3() hash.Hash {
+	return &blake3Hash{chunk: newBLAKE3Chunk(0)}
+}
+
+func (h *blake3Hash) Write(p []byte) (n int, err error) {
+	n = len(p)
+
+	for len(p) > 0 {
+		if h.chunk.len() == blake3ChunkLen {
+			cv := h.chunk.output().chainingValue()
+			total := h.chunk.counter + 1
+
+			// merge completed subtrees, as many as trailing zero bits
+			for total&1 == 0 {
+				cv = blake3ParentOutput(h.stack[len(h.stack)-1], cv).chainingValue()
+				h.stack = h.stack[:len(h.stack)-1]
+				total >>= 1
+			}
+
+			h.stack = append(h.stack, cv)
+			h.chunk = newBLAKE3Chunk(h.chunk.counter + 1)
+		}
+
+		i := blake3ChunkLen - h.chunk.len()
+
+		if i > len(p) {
+			i = len(p)
+		}
+
+		h.chunk.update(p[:i])
+		p = p[i:]
+	}
+
+	return
+}
+
+func (h *blake3Hash) Sum(b []byte) []byte {
+	o := h.chunk.output()
+
+	for i := len(h.stack) - 1; i >= 0; i-- {
+		o = blake3ParentOutput(h.stack[i], o.chainingValue())
+	}
+
+	return append(b, o.root()...)
+}
+
+func (h *blake3Hash) Reset() {
+	h.chunk = newBLAKE3Chunk(0)
+	h.stack = nil
+}
+
+func (h *blake3Hash) Size() int {
+	return blake3Size
+}
+
+func (h *blake3Hash) BlockSize() int {
+	return blake3BlockLen
+}
@@ -0,0 +1,160 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// BLAKE3 test vectors, input bytes are i % 251
+var blake3Vectors = []struct {
+	len  int
+	hash string
+}{
+	{0, "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262"},
+	{1, "2d3adedff11b61f14c886e35afa036736dcd87a74d27b5c1510225d0f592e213"},
+	{1024, "42214739f095a406f3fc83deb889744ac00df831c10daa55189b5d121c855af7"},
+	{102400, "bc3e3d41a1146b069abffad3c0d44860cf664390afce4d9661f7902e7943e085"},
+}
+
+func TestBLAKE3(t *testing.T) {
+	for _, v := range blake3Vectors {
+		input := make([]byte, v.len)
+
+		for i := range input {
+			input[i] = byte(i % 251)
+		}
+
+		h := newBLAKE3()
+
+		// exercise buffering across chunk boundaries
+		h.Write(input[:v.len/3])
+		h.Write(input[v.len/3:])
+
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != v.hash {
+			t.Errorf("BLAKE3 mismatch for %d bytes: %s", v.len, sum)
+		}
+	}
+
+	h := newBLAKE3()
+	h.Write([]byte("abc"))
+
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != "6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85" {
+		t.Errorf("BLAKE3 mismatch: %s", sum)
+	}
+}
+
+func TestDedupIndex(t *testing.T) {
+	c := newTestServer(t)
+	conf.Dedup = true
+	defer func() { conf.Dedup = false }()
+
+	c.login()
+
+	c.upload("/a.txt", testCleartext)
+	c.call("auth/logout", nil)
+
+	var files map[string]dedupEntry
+	buf, err := ioutil.ReadFile(filepath.Join(conf.MountPoint, dedupIndexFile))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = json.Unmarshal(buf, &files); err != nil {
+		t.Fatal(err)
+	}
+
+	h := newBLAKE3()
+	h.Write([]byte(testCleartext))
+
+	if e, ok := files["/a.txt"]; !ok || e.Hash != hex.EncodeToString(h.Sum(nil)) {
+		t.Fatalf("unexpected index %v", files)
+	}
+
+	// a stale entry is rehashed, a matching one is trusted
+	files["/a.txt"] = dedupEntry{Size: 1, Hash: "stale"}
+	buf, _ = json.Marshal(files)
+	ioutil.WriteFile(filepath.Join(conf.MountPoint, dedupIndexFile), buf, 0600)
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	c.upload("/b.txt", testCleartext)
+
+	a, _ := os.Stat(filepath.Join(conf.MountPoint, "a.txt"))
+	b, _ := os.Stat(filepath.Join(conf.MountPoint, "b.txt"))
+
+	if !os.SameFile(a, b) {
+		t.Error("duplicate upload not linked")
+	}
+}
+
+func TestMeasurementsUpgrade(t *testing.T) {
+	newTestServer(t)
+
+	conf.Measurements = filepath.Join(t.TempDir(), "measurements")
+	conf.StaticPath = t.TempDir()
+
+	defer func() {
+		conf.Measurements = ""
+		conf.StaticPath = ""
+		indicator.SetTamper(false)
+	}()
+
+	// record sealed by an earlier release
+	legacy, err := measure("")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	legacy.Epoch = time.Now().Add(-time.Hour).Unix()
+
+	if err = saveMeasurements(legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = measurements.check(); err != nil {
+		t.Fatal(err)
+	}
+
+	if changes := measurements.Changes(); len(changes) != 0 {
+		t.Fatalf("unexpected changes on upgrade: %v", changes)
+	}
+
+	m, err := loadMeasurements()
+
+	if err != nil || m.Hash != measurementHash || !m.verify() {
+		t.Fatalf("measurements not upgraded: %v (%v)", m, err)
+	}
+
+	// tampered binary under the legacy algorithm
+	legacy.Binary = "tampered"
+
+	if err = saveMeasurements(legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = measurements.check(); err != nil {
+		t.Fatal(err)
+	}
+
+	if changes := measurements.Changes(); len(changes) != 1 || changes[0] != "interlock binary changed" {
+		t.Errorf("unexpected changes: %v", changes)
+	}
+
+	if err = measurements.Accept(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,445 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/syslog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Encrypted bundles are tar archives of a directory tree, encrypted (and
+// optionally signed) with any enabled cipher, providing a transfer format
+// between INTERLOCK instances.
+
+const bundleExt = ".bundle"
+
+func tarWriter(src string, dst io.Writer) (written int64, err error) {
+	writer := tar.NewWriter(dst)
+	defer writer.Close()
+
+	base := path.Dir(src)
+
+	err = volumeJail().Walk(src, func(osPath string, info os.FileInfo, e error) (err error) {
+		if e != nil {
+			return e
+		}
+
+		var target string
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			var linked os.FileInfo
+
+			target, linked, err = archiveLink(osPath)
+
+			if err != nil {
+				return
+			}
+
+			if linked != nil {
+				info = linked
+			}
+		}
+
+		if !info.IsDir() && !info.Mode().IsRegular() && target == "" {
+			return
+		}
+
+		if inKeyPath, private := detectKeyPath(osPath); inKeyPath && private {
+			return errors.New("cannot export private key(s)")
+		}
+
+		header, err := tar.FileInfoHeader(info, target)
+
+		if err != nil {
+			return
+		}
+
+		header.Name, err = filepath.Rel(base, osPath)
+
+		if err != nil {
+			return
+		}
+
+		if info.IsDir() {
+			header.Name += "/"
+		}
+
+		// links are archived without extended attributes
+		if target != "" {
+			return writer.WriteHeader(header)
+		}
+
+		input, err := volumeJail().Open(osPath)
+
+		if err != nil {
+			return
+		}
+		defer input.Close()
+
+		if err = tarMetadata(input, header); err != nil {
+			return
+		}
+
+		if err = writer.WriteHeader(header); err != nil {
+			return
+		}
+
+		if !info.Mode().IsRegular() {
+			return
+		}
+
+		w, err := io.Copy(writer, input)
+		written += w
+
+		return
+	})
+
+	return
+}
+
+func untar(src io.Reader, dst string) (err error) {
+	reader := tar.NewReader(src)
+	j := &jail{root: dst}
+
+	for {
+		var header *tar.Header
+		var dstPath string
+
+		header, err = reader.Next()
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return
+		}
+
+		dstPath, err = j.Path(header.Name)
+
+		if err != nil {
+			return
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = j.MkdirAll(dstPath, 0700)
+		case tar.TypeReg:
+			err = untarEntry(j, reader, header, dstPath)
+		case tar.TypeSymlink:
+			err = extractLink(dstPath, header.Linkname)
+		case tar.TypeLink:
+			err = extractHardlink(dst, dstPath, header.Linkname)
+		default:
+			err = fmt.Errorf("unsupported entry type for %s", header.Name)
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func untarEntry(j *jail, reader io.Reader, header *tar.Header, dstPath string) (err error) {
+	err = j.MkdirAll(path.Dir(dstPath), 0700)
+
+	if err != nil {
+		return
+	}
+
+	output, err := j.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_TRUNC, 0600)
+
+	if err != nil {
+		return
+	}
+	defer output.Close()
+
+	_, err = io.Copy(output, reader)
+
+	if err != nil {
+		return
+	}
+
+	return setMetadata(output, tarHeaderMetadata(header))
+}
+
+// setCipherKeys configures the cipher key (if applicable), signing or
+// verification key (if requested) and password (if not empty), recording their
+// usage on the argument file.
+func setCipherKeys(cipher cipherInterface, keyPath string, sigKeyPath string, password string, keyOp string, sigOp string, file string) (err error) {
+	info := cipher.GetInfo()
+
+	if info.KeyFormat != "password" {
+		if keyPath == "" {
+			return errors.New("key not specified")
+		}
+
+		if err = setCipherKey(cipher, keyPath, keyOp, file); err != nil {
+			return
+		}
+	}
+
+	if sigKeyPath != "" {
+		if !info.Sig {
+			return errors.New("signing requested but not supported by cipher")
+		}
+
+		if err = setCipherKey(cipher, sigKeyPath, sigOp, file); err != nil {
+			return
+		}
+	}
+
+	if password != "" || info.KeyFormat == "password" {
+		err = cipher.SetPassword(password)
+	}
+
+	return
+}
+
+func setCipherKey(cipher cipherInterface, keyPath string, op string, file string) (err error) {
+	osPath, err := absolutePath(keyPath)
+
+	if err != nil {
+		return
+	}
+
+	k, _, err := getKey(osPath)
+
+	if err != nil {
+		return
+	}
+
+	if err = checkRevoked(k, op); err != nil {
+		return
+	}
+
+	if err = cipher.SetKey(k); err != nil {
+		return
+	}
+
+	recordKeyUsage(k, op, file)
+
+	return
+}
+
+func fileExport(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	src, err := absolutePath(req["src"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	dst, err := absolutePath(req["dst"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	cipher, err := conf.GetCipher(req["cipher"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if !cipher.GetInfo().Enc {
+		return errorResponse(errors.New("encryption requested but not supported by cipher"), "")
+	}
+
+	sigKeyPath := req["sig_key"].(string)
+	sign := sigKeyPath != ""
+
+	err = setCipherKeys(cipher, req["key"].(string), sigKeyPath, req["password"].(string), keyUsageEncrypt, keyUsageSign, relativePath(src))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	stat, err := volumeJail().Stat(src)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if !stat.IsDir() {
+		return errorResponse(errors.New("bundle source must be a directory"), "")
+	}
+
+	if !strings.HasSuffix(dst, bundleExt+"."+cipher.GetInfo().Extension) {
+		dst += bundleExt + "." + cipher.GetInfo().Extension
+	}
+
+	output, err := volumeJail().OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_TRUNC, 0600)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	jobs.Go(jobOwner(r), "exporting bundle", func() {
+		defer output.Close()
+
+		n := status.Notify(syslog.LOG_INFO, "exporting %s", relativePath(src))
+		defer status.Remove(n)
+
+		err := exportBundle(cipher, src, output, sign)
+
+		if err != nil {
+			output.Close()
+			volumeJail().Remove(dst)
+			status.Error(err)
+			return
+		}
+
+		status.Log(syslog.LOG_NOTICE, "completed export of %s to %s", relativePath(src), relativePath(dst))
+	})
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": nil,
+	}
+
+	return
+}
+
+func exportBundle(cipher cipherInterface, src string, output *os.File, sign bool) (err error) {
+	archive, err := ioutil.TempFile("", "bundle-")
+
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		archive.Close()
+		os.Remove(archive.Name())
+	}()
+
+	if _, err = tarWriter(src, archive); err != nil {
+		return
+	}
+
+	if _, err = archive.Seek(0, 0); err != nil {
+		return
+	}
+
+	return cipher.Encrypt(archive, output, sign)
+}
+
+func fileImport(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	src, err := absolutePath(req["src"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	dst, err := absolutePath(req["dst"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if inKeyPath, _ := detectKeyPath(dst); inKeyPath {
+		return errorResponse(errors.New("importing within key storage is not allowed"), "")
+	}
+
+	cipher, err := conf.GetCipher(req["cipher"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if !cipher.GetInfo().Dec {
+		return errorResponse(errors.New("decryption requested but not supported by cipher"), "")
+	}
+
+	sigKeyPath := req["sig_key"].(string)
+	verify := sigKeyPath != ""
+
+	err = setCipherKeys(cipher, req["key"].(string), sigKeyPath, req["password"].(string), keyUsageDecrypt, keyUsageVerify, relativePath(src))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	input, err := volumeJail().Open(src)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if err = volumeJail().MkdirAll(dst, 0700); err != nil {
+		input.Close()
+		return errorResponse(err, "")
+	}
+
+	jobs.Go(jobOwner(r), "importing bundle", func() {
+		defer input.Close()
+
+		n := status.Notify(syslog.LOG_INFO, "importing %s", relativePath(src))
+		defer status.Remove(n)
+
+		err := importBundle(cipher, input, dst, verify)
+
+		if err != nil {
+			status.Error(err)
+			return
+		}
+
+		status.Log(syslog.LOG_NOTICE, "completed import of %s to %s", relativePath(src), relativePath(dst))
+	})
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": nil,
+	}
+
+	return
+}
+
+func importBundle(cipher cipherInterface, input *os.File, dst string, verify bool) (err error) {
+	archive, err := ioutil.TempFile("", "bundle-")
+
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		archive.Close()
+		os.Remove(archive.Name())
+	}()
+
+	// the archive is extracted only after successful decryption and
+	// signature verification
+	if err = cipher.Decrypt(input, archive, verify); err != nil {
+		return
+	}
+
+	if _, err = archive.Seek(0, 0); err != nil {
+		return
+	}
+
+	return untar(archive, dst)
+}
@@ -0,0 +1,447 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/syslog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Camera uploads, photos and videos are uploaded by mobile clients in chunks
+// which can be individually retried, completed uploads are stored in date
+// based folders under `camera_path` and optionally encrypted with
+// `camera_cipher` and `camera_key`.
+//
+// Partial uploads are kept on the encrypted volume, so that they can be
+// resumed across connection losses and restarts, and discarded when inactive
+// for more than cameraExpiry.
+
+const cameraDir = ".interlock-camera"
+
+const (
+	cameraMaxChunk = 16 * 1024 * 1024
+	cameraExpiry   = 24 * time.Hour
+)
+
+var cameraID = regexp.MustCompile("^[A-Za-z0-9_-]{8,64}$")
+
+type cameraUpload struct {
+	Name  string `json:"name"`
+	Size  int64  `json:"size"`
+	MTime int64  `json:"mtime"`
+	// destination, set on completion
+	Path string `json:"path"`
+}
+
+var cameraMutex sync.Mutex
+
+func cameraPath(id string, ext string) string {
+	return filepath.Join(conf.MountPoint, cameraDir, id+ext)
+}
+
+func (u *cameraUpload) save(id string) (err error) {
+	buf, err := json.Marshal(u)
+
+	if err != nil {
+		return
+	}
+
+	return volumeJail().WriteFile(cameraPath(id, ".json"), buf, 0600)
+}
+
+func loadCameraUpload(id string) (u *cameraUpload, err error) {
+	buf, err := volumeJail().ReadFile(cameraPath(id, ".json"))
+
+	if err != nil {
+		return
+	}
+
+	u = &cameraUpload{}
+	err = json.Unmarshal(buf, u)
+
+	return
+}
+
+// expireCameraUploads removes inactive partial uploads and records of
+// completed ones.
+func expireCameraUploads() {
+	entries, err := volumeJail().ReadDir(filepath.Join(conf.MountPoint, cameraDir))
+
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		info, err := e.Info()
+
+		if err == nil && time.Since(info.ModTime()) > cameraExpiry {
+			volumeJail().Remove(filepath.Join(conf.MountPoint, cameraDir, e.Name()))
+		}
+	}
+}
+
+// cameraDestination returns an unused path, in the date folder matching the
+// argument time, for the uploaded file name, the path must also be unused
+// with the argument suffix (encrypted file extension) appended.
+func cameraDestination(name string, suffix string, t time.Time) (osPath string, err error) {
+	dir := path.Join(conf.CameraPath, t.Format("2006"), t.Format("01"), t.Format("02"))
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	for i := 0; i < 1000; i++ {
+		p := path.Join(dir, name)
+
+		if i > 0 {
+			p = path.Join(dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+		}
+
+		if osPath, err = absolutePath(p); err != nil {
+			return
+		}
+
+		if _, err = volumeJail().Lstat(osPath); !os.IsNotExist(err) {
+			continue
+		}
+
+		if _, err = volumeJail().Lstat(osPath + suffix); os.IsNotExist(err) {
+			return osPath, nil
+		}
+	}
+
+	return "", fmt.Errorf("cannot find a destination for %s", name)
+}
+
+func cameraResponse(u *cameraUpload, received int64) jsonObject {
+	res := map[string]interface{}{
+		"received": received,
+		"complete": u.Path != "",
+	}
+
+	if u.Path != "" {
+		res["path"] = u.Path
+	}
+
+	return jsonObject{
+		"status":   "OK",
+		"response": res,
+	}
+}
+
+// startCameraUpload records a new upload from the request headers.
+func startCameraUpload(id string, r *http.Request) (u *cameraUpload, err error) {
+	name, err := url.QueryUnescape(r.Header.Get("X-Uploadfilename"))
+
+	if err != nil {
+		return
+	}
+
+	name = path.Base(name)
+
+	if name == "/" || name == "." {
+		return nil, errors.New("missing file name")
+	}
+
+	if name, err = checkFilename(name); err != nil {
+		return
+	}
+
+	size, err := strconv.ParseInt(r.Header.Get("X-Uploadsize"), 10, 64)
+
+	if err != nil || size < 0 {
+		return nil, errors.New("invalid upload size")
+	}
+
+	u = &cameraUpload{
+		Name: name,
+		Size: size,
+	}
+
+	if mtime := r.Header.Get("X-Uploadmtime"); mtime != "" {
+		if u.MTime, err = strconv.ParseInt(mtime, 10, 64); err != nil {
+			return
+		}
+	}
+
+	if err = volumeJail().MkdirAll(filepath.Join(conf.MountPoint, cameraDir), 0700); err != nil {
+		return
+	}
+
+	expireCameraUploads()
+
+	return u, u.save(id)
+}
+
+// fileCamera handles a single chunk of a camera upload, a request without
+// chunk offset returns the upload progress.
+func fileCamera(r *http.Request) (res jsonObject) {
+	var received int64
+
+	id := r.Header.Get("X-Uploadid")
+
+	if !cameraID.MatchString(id) {
+		return errorResponse(errors.New("invalid upload identifier"), "")
+	}
+
+	// the chunk is read before locking to avoid stalling other uploads
+	// on slow connections
+	chunk, err := ioutil.ReadAll(io.LimitReader(r.Body, cameraMaxChunk+1))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if len(chunk) > cameraMaxChunk {
+		return errorResponse(fmt.Errorf("chunk exceeds maximum size (%d bytes)", cameraMaxChunk), "")
+	}
+
+	cameraMutex.Lock()
+	defer cameraMutex.Unlock()
+
+	u, err := loadCameraUpload(id)
+
+	if os.IsNotExist(err) {
+		u, err = startCameraUpload(id, r)
+	}
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	// retries of the last chunk, after completion
+	if u.Path != "" {
+		return cameraResponse(u, u.Size)
+	}
+
+	partial, err := volumeJail().OpenFile(cameraPath(id, ".part"), os.O_RDWR|os.O_CREATE, 0600)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+	defer partial.Close()
+
+	stat, err := partial.Stat()
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	received = stat.Size()
+
+	offsetHeader := r.Header.Get("X-Chunkoffset")
+
+	if offsetHeader == "" {
+		return cameraResponse(u, received)
+	}
+
+	offset, err := strconv.ParseInt(offsetHeader, 10, 64)
+
+	if err != nil || offset < 0 {
+		return errorResponse(errors.New("invalid chunk offset"), "")
+	}
+
+	// retried chunks overwrite previously received data, gaps are not
+	// allowed
+	if offset > received {
+		return errorResponse(fmt.Errorf("chunk offset %d exceeds received size %d", offset, received), "")
+	}
+
+	if offset+int64(len(chunk)) > u.Size {
+		return errorResponse(errors.New("chunk exceeds upload size"), "")
+	}
+
+	if err = partial.Truncate(offset); err != nil {
+		return errorResponse(err, "")
+	}
+
+	if _, err = partial.WriteAt(chunk, offset); err != nil {
+		return errorResponse(err, "")
+	}
+
+	received = offset + int64(len(chunk))
+
+	if received < u.Size {
+		return cameraResponse(u, received)
+	}
+
+	if err = partial.Close(); err != nil {
+		return errorResponse(err, "")
+	}
+
+	if err = completeCameraUpload(id, u); err != nil {
+		return errorResponse(err, "")
+	}
+
+	return cameraResponse(u, received)
+}
+
+// completeCameraUpload moves a fully received upload to its destination, or
+// encrypts it there when `camera_cipher` is configured.
+func completeCameraUpload(id string, u *cameraUpload) (err error) {
+	var ext string
+
+	t := time.Now()
+
+	if u.MTime > 0 {
+		t = time.Unix(u.MTime, 0)
+	}
+
+	if conf.CameraCipher != "" {
+		cipher, err := conf.GetCipher(conf.CameraCipher)
+
+		if err != nil {
+			return err
+		}
+
+		ext = "." + cipher.GetInfo().Extension
+	}
+
+	osPath, err := cameraDestination(u.Name, ext, t)
+
+	if err != nil {
+		return
+	}
+
+	if err = volumeJail().MkdirAll(filepath.Dir(osPath), 0700); err != nil {
+		return
+	}
+
+	if conf.CameraCipher != "" {
+		return cameraEncrypt(id, u, osPath+ext, t)
+	}
+
+	if err = volumeJail().Rename(cameraPath(id, ".part"), osPath); err != nil {
+		return
+	}
+
+	if u.MTime > 0 {
+		reportError("camera upload time", volumeJail().Chtimes(osPath, t, t))
+	}
+
+	status.Log(syslog.LOG_INFO, "uploaded %s (%v bytes)", relativePath(osPath), u.Size)
+	uploadCompleted(osPath, u.Size)
+
+	u.Path = relativePath(osPath)
+
+	return u.save(id)
+}
+
+// cameraEncrypt encrypts, in the background, a completed upload to its
+// destination with the configured cipher and public key. The cleartext never
+// leaves the partial uploads directory and is removed, along with the upload
+// record, on any failure so that the upload can be restarted.
+func cameraEncrypt(id string, u *cameraUpload, dst string, t time.Time) (err error) {
+	src := cameraPath(id, ".part")
+
+	defer func() {
+		if err != nil {
+			volumeJail().Remove(src)
+			volumeJail().Remove(cameraPath(id, ".json"))
+		}
+	}()
+
+	cipher, err := conf.GetCipher(conf.CameraCipher)
+
+	if err != nil {
+		return
+	}
+
+	if !cipher.GetInfo().Enc || cipher.GetInfo().KeyFormat == "password" {
+		return errors.New("camera cipher must support key based encryption")
+	}
+
+	keyPath, err := absolutePath(conf.CameraKey)
+
+	if err != nil {
+		return
+	}
+
+	k, _, err := getKey(keyPath)
+
+	if err != nil {
+		return
+	}
+
+	if err = checkRevoked(k, keyUsageEncrypt); err != nil {
+		return
+	}
+
+	if err = cipher.SetKey(k); err != nil {
+		return
+	}
+
+	recordKeyUsage(k, keyUsageEncrypt, relativePath(dst))
+
+	input, err := volumeJail().Open(src)
+
+	if err != nil {
+		return
+	}
+
+	output, err := createAtomic("encrypt", src, dst, true)
+
+	if err != nil {
+		input.Close()
+		return
+	}
+
+	u.Path = relativePath(dst)
+
+	if err = u.save(id); err != nil {
+		input.Close()
+		output.Abort()
+		return
+	}
+
+	jobs.Go("camera", "encrypting", func() {
+		n := status.Notify(syslog.LOG_INFO, "encrypting %s", relativePath(dst))
+		defer status.Remove(n)
+
+		err := cipher.Encrypt(input, output.File, false)
+		input.Close()
+
+		if err == nil {
+			err = output.Commit()
+		} else {
+			output.Abort()
+		}
+
+		// the cleartext is discarded regardless of the outcome
+		volumeJail().Remove(src)
+
+		if err != nil {
+			cameraMutex.Lock()
+			volumeJail().Remove(cameraPath(id, ".json"))
+			cameraMutex.Unlock()
+
+			status.Error(fmt.Errorf("camera upload encryption: %v", err))
+			return
+		}
+
+		if u.MTime > 0 {
+			reportError("camera upload time", volumeJail().Chtimes(dst, t, t))
+		}
+
+		status.Log(syslog.LOG_NOTICE, "uploaded and encrypted %s (%v bytes)", relativePath(dst), u.Size)
+		uploadCompleted(dst, u.Size)
+	})
+
+	return
+}
@@ -0,0 +1,122 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func (c *apiClient) cameraChunk(id string, name string, size int, offset int, chunk string) (res jsonObject) {
+	header := map[string]string{
+		"X-Uploadid":       id,
+		"X-Uploadfilename": name,
+		"X-Uploadsize":     strconv.Itoa(size),
+		"X-Uploadmtime":    strconv.FormatInt(time.Date(2020, 1, 2, 12, 0, 0, 0, time.UTC).Unix(), 10),
+	}
+
+	if offset >= 0 {
+		header["X-Chunkoffset"] = strconv.Itoa(offset)
+	}
+
+	r := c.request("POST", "/api/file/camera", header, []byte(chunk))
+	defer r.Body.Close()
+
+	if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+		c.t.Fatal(err)
+	}
+
+	return
+}
+
+func TestCamera(t *testing.T) {
+	c := newTestServer(t)
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	data := "0123456789abcdef"
+	id := "camera-test-1"
+
+	if res := c.cameraChunk(id, "photo.jpg", len(data), 0, data[0:6]); res["status"] != "OK" {
+		t.Fatalf("unexpected response: %v", res)
+	}
+
+	// retried chunk
+	c.cameraChunk(id, "photo.jpg", len(data), 0, data[0:6])
+
+	if res := c.cameraChunk(id, "photo.jpg", len(data), 10, data[10:]); res["status"] != "KO" {
+		t.Errorf("chunk gap accepted: %v", res)
+	}
+
+	res := c.cameraChunk(id, "photo.jpg", len(data), -1, "")
+
+	if received := res["response"].(map[string]interface{})["received"]; received != float64(6) {
+		t.Errorf("unexpected upload progress: %v", res)
+	}
+
+	c.cameraChunk(id, "photo.jpg", len(data), 6, data[6:12])
+	res = c.cameraChunk(id, "photo.jpg", len(data), 12, data[12:])
+
+	response := res["response"].(map[string]interface{})
+
+	if response["complete"] != true || response["path"] != "/camera/2020/01/02/photo.jpg" {
+		t.Fatalf("unexpected completion response: %v", res)
+	}
+
+	if buf, err := ioutil.ReadFile(filepath.Join(conf.MountPoint, "camera/2020/01/02/photo.jpg")); err != nil || string(buf) != data {
+		t.Errorf("uploaded data mismatch: %q %v", buf, err)
+	}
+
+	// retried last chunk after completion
+	if res = c.cameraChunk(id, "photo.jpg", len(data), 12, data[12:]); res["response"].(map[string]interface{})["path"] != "/camera/2020/01/02/photo.jpg" {
+		t.Errorf("unexpected response to retried chunk: %v", res)
+	}
+
+	// name collisions and automatic encryption
+	c.mustCall("crypto/gen_key", jsonObject{"identifier": "camera", "key_format": "armor", "cipher": "OpenPGP", "email": "testonly@example.com"})
+	c.wait("/keys/pgp/private/camera.armor")
+
+	conf.CameraCipher = "OpenPGP"
+	conf.CameraKey = "/keys/pgp/public/camera.armor"
+
+	res = c.cameraChunk("camera-test-2", "photo.jpg", len(data), 0, data)
+
+	if path := res["response"].(map[string]interface{})["path"]; path != "/camera/2020/01/02/photo (1).jpg.pgp" {
+		t.Fatalf("unexpected path: %v", res)
+	}
+
+	c.wait("/camera/2020/01/02/photo (1).jpg.pgp")
+
+	for _, p := range []string{"camera/2020/01/02/photo (1).jpg", cameraDir + "/camera-test-2.part"} {
+		if _, err := os.Stat(filepath.Join(conf.MountPoint, p)); !os.IsNotExist(err) {
+			t.Errorf("cleartext %s not removed after encryption", p)
+		}
+	}
+
+	// encryption failures discard the cleartext and the upload record
+	conf.CameraKey = "/keys/pgp/public/missing.armor"
+
+	if res = c.cameraChunk("camera-test-3", "photo.jpg", len(data), 0, data); res["status"] != "KO" {
+		t.Errorf("upload with invalid camera key accepted: %v", res)
+	}
+
+	for _, p := range []string{cameraDir + "/camera-test-3.part", cameraDir + "/camera-test-3.json", "camera/2020/01/02/photo (2).jpg"} {
+		if _, err := os.Stat(filepath.Join(conf.MountPoint, p)); !os.IsNotExist(err) {
+			t.Errorf("%s retained after encryption failure", p)
+		}
+	}
+
+	if res = c.cameraChunk("invalid", "photo.jpg", len(data), 0, data); res["status"] != "KO" {
+		t.Errorf("invalid upload identifier accepted: %v", res)
+	}
+}
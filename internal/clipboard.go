@@ -0,0 +1,186 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"errors"
+	"fmt"
+	"log/syslog"
+	"net/http"
+	"sync"
+)
+
+// Server-side clipboard, paths are cut or copied in the session clipboard
+// and pasted to a destination directory as a single background operation.
+type clipboard struct {
+	sync.Mutex
+	mode  int
+	paths []string
+}
+
+var clip = clipboard{}
+
+func (c *clipboard) Set(mode int, paths []string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.mode = mode
+	c.paths = paths
+}
+
+func (c *clipboard) Get() (mode int, paths []string) {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.mode, append([]string{}, c.paths...)
+}
+
+func (c *clipboard) Reset() {
+	c.Set(_copy, nil)
+}
+
+func clipboardCut(r *http.Request) jsonObject {
+	return clipboardSet(r, _move)
+}
+
+func clipboardCopy(r *http.Request) jsonObject {
+	return clipboardSet(r, _copy)
+}
+
+func clipboardSet(r *http.Request, mode int) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	paths := []string{}
+
+	for _, p := range req["path"].([]interface{}) {
+		s, ok := p.(string)
+
+		if !ok {
+			return errorResponse(errors.New("invalid path"), "")
+		}
+
+		osPath, err := absolutePath(s)
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+
+		if _, err = volumeJail().Stat(osPath); err != nil {
+			return errorResponse(fmt.Errorf("path %s does not exist", relativePath(osPath)), "")
+		}
+
+		paths = append(paths, osPath)
+	}
+
+	clip.Set(mode, paths)
+
+	return clipboardList()
+}
+
+func clipboardList() (res jsonObject) {
+	mode, paths := clip.Get()
+	op := "copy"
+
+	if mode == _move {
+		op = "cut"
+	}
+
+	relPaths := []string{}
+
+	for _, p := range paths {
+		relPaths = append(relPaths, relativePath(p))
+	}
+
+	res = jsonObject{
+		"status": "OK",
+		"response": map[string]interface{}{
+			"op":   op,
+			"path": relPaths,
+		},
+	}
+
+	return
+}
+
+func clipboardClear() (res jsonObject) {
+	clip.Reset()
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": nil,
+	}
+
+	return
+}
+
+func clipboardPaste(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	dst, err := absolutePath(req["dst"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if stat, err := volumeJail().Stat(dst); err != nil || !stat.IsDir() {
+		return errorResponse(fmt.Errorf("destination %s is not a directory", relativePath(dst)), "")
+	}
+
+	mode, paths := clip.Get()
+
+	if len(paths) == 0 {
+		return errorResponse(errors.New("clipboard is empty"), "")
+	}
+
+	token := lockToken(r)
+
+	if err = locks.Check(dst, token); err != nil {
+		return errorResponse(err, "")
+	}
+
+	if mode == _move {
+		for _, src := range paths {
+			if err = locks.Check(src, token); err != nil {
+				return errorResponse(err, "")
+			}
+		}
+
+		// cut entries can only be pasted once
+		clip.Reset()
+	}
+
+	owner := jobOwner(r)
+
+	jobs.Go(owner, "pasting clipboard", func() {
+		n := status.Notify(syslog.LOG_NOTICE, "pasting %d item(s) to %s", len(paths), relativePath(dst))
+		defer status.Remove(n)
+
+		for _, src := range paths {
+			if err := fileOp(owner, src, dst, mode); err != nil {
+				status.Error(err)
+				return
+			}
+		}
+
+		status.Log(syslog.LOG_NOTICE, "pasted %d item(s) to %s", len(paths), relativePath(dst))
+	})
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": nil,
+	}
+
+	return
+}
@@ -0,0 +1,125 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"errors"
+	"log/syslog"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Time sanity checks, a device clock earlier than the build date is certainly
+// wrong (e.g. missing or discharged RTC battery) and would affect key
+// creation dates, signatures and one-time passwords. Crypto operations are
+// refused until the clock is set, unless overridden with `insecure_time`.
+//
+// When a hardware RTC is present it is read at startup and updated whenever
+// the device time is set.
+
+var rtcDevice = "/dev/rtc0"
+
+var buildDate = regexp.MustCompile(` on (\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2})`)
+
+var errClockInvalid = errors.New("device time is earlier than the build date, crypto operations are disabled until time is set")
+
+// cryptoRequests lists the API methods relying on a correct device time.
+var cryptoRequests = map[string]bool{
+	"/api/file/encrypt":      true,
+	"/api/file/decrypt":      true,
+	"/api/file/sign":         true,
+	"/api/file/verify":       true,
+	"/api/file/rewrap":       true,
+	"/api/file/migrate":      true,
+	"/api/crypto/gen_key":    true,
+	"/api/crypto/upload_key": true,
+	"/api/crypto/revocation": true,
+	"/api/crypto/revoke_key": true,
+}
+
+type clockStatus struct {
+	sync.Mutex
+	invalid      bool
+	notification int
+}
+
+var clock clockStatus
+
+// buildTime returns the build date embedded at compile time, zero if
+// unavailable.
+func buildTime() (t time.Time) {
+	m := buildDate.FindStringSubmatch(Build)
+
+	if len(m) != 2 {
+		return
+	}
+
+	t, _ = time.Parse("2006-01-02 15:04:05", m[1])
+
+	return
+}
+
+func rtcPresent() bool {
+	_, err := os.Stat(rtcDevice)
+	return err == nil
+}
+
+func startClock() {
+	if !conf.Container && rtcPresent() {
+		if err := rtcRead(); err != nil {
+			status.Error(err)
+		}
+	}
+
+	clock.check()
+}
+
+// check verifies the device time plausibility, notifying the user when it
+// needs to be set.
+func (c *clockStatus) check() {
+	c.Lock()
+	defer c.Unlock()
+
+	build := buildTime()
+	invalid := !build.IsZero() && time.Now().Before(build)
+
+	if invalid && !c.invalid {
+		c.notification = status.Notify(syslog.LOG_WARNING, "device time is earlier than the build date (%s), please set the correct time", build.Format("2006-01-02"))
+	}
+
+	if !invalid && c.invalid {
+		status.Remove(c.notification)
+	}
+
+	c.invalid = invalid
+}
+
+func (c *clockStatus) Invalid() bool {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.invalid
+}
+
+// clockAllowed returns an error if crypto operations are currently disabled.
+func clockAllowed(uri string) error {
+	if conf.InsecureTime {
+		return nil
+	}
+
+	if !cryptoRequests[uri] {
+		return nil
+	}
+
+	if clock.Invalid() {
+		return errClockInvalid
+	}
+
+	return nil
+}
@@ -0,0 +1,57 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestClock(t *testing.T) {
+	c := newTestServer(t)
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	build := Build
+
+	defer func() {
+		Build = build
+		conf.InsecureTime = false
+		clock.check()
+	}()
+
+	Build = "test@localhost on 2999-01-01 00:00:00"
+	clock.check()
+
+	if !strings.Contains(fmt.Sprintf("%v", status.Notifications()), "earlier than the build date (2999-01-01)") {
+		t.Error("missing invalid time notification")
+	}
+
+	req := jsonObject{"cipher": "OpenPGP", "path": "/", "src": "/missing", "password": "", "key": "", "sign": false, "sig_key": "", "wipe_src": false}
+	res := c.call("file/encrypt", req)
+
+	if res["status"] != "KO" || fmt.Sprintf("%v", res["response"]) != fmt.Sprintf("[%v]", errClockInvalid) {
+		t.Errorf("crypto operation allowed with invalid time: %v", res)
+	}
+
+	c.mustCall("file/list", jsonObject{"path": "/", "sha256": false})
+
+	conf.InsecureTime = true
+
+	if res = c.call("file/encrypt", req); fmt.Sprintf("%v", res["response"]) == fmt.Sprintf("[%v]", errClockInvalid) {
+		t.Errorf("invalid time not overridden: %v", res)
+	}
+
+	Build = ""
+	clock.check()
+
+	if clock.Invalid() || len(status.Notifications()) != 0 {
+		t.Errorf("unexpected notifications: %v", status.Notifications())
+	}
+}
@@ -10,47 +10,239 @@ package interlock
 
 import (
 	"bytes"
-	"errors"
+	"context"
+	"fmt"
 	"log"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
+	"unsafe"
 )
 
-func execCommand(cmd string, args []string, root bool, input string) (output string, err error) {
+// Subprocess timeouts, system commands are bound to a context which expires
+// after `command_timeout` seconds, or `luks_timeout` for volume operations,
+// so that a wedged helper cannot hang a session forever. Commands are first
+// sent SIGTERM, which sudo relays to its child, and killed if still running
+// after commandKillDelay.
+
+const commandKillDelay = 5 * time.Second
+
+// withTimeout returns a copy of ctx expiring after the argument number of
+// seconds, non-positive values disable the timeout.
+func withTimeout(ctx context.Context, seconds int) (context.Context, context.CancelFunc) {
+	if seconds <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, time.Duration(seconds)*time.Second)
+}
+
+// runContext runs a command, terminating it when ctx is done, the argument
+// name identifies the command in timeout errors. Resource limits are applied
+// when limit is true.
+func runContext(ctx context.Context, name string, c *exec.Cmd, limit bool) (err error) {
+	if err = c.Start(); err != nil {
+		return
+	}
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- c.Wait()
+	}()
+
+	if limit {
+		if err = limitCommand(c.Process.Pid); err != nil {
+			c.Process.Kill()
+			<-done
+			return
+		}
+	}
+
+	select {
+	case err = <-done:
+		return
+	case <-ctx.Done():
+	}
+
+	c.Process.Signal(syscall.SIGTERM)
+
+	select {
+	case <-done:
+	case <-time.After(commandKillDelay):
+		// output pipes might be held open by orphaned children, do not
+		// wait any further
+		c.Process.Kill()
+	}
+
+	return contextError(name, ctx)
+}
+
+// contextError returns the error of an operation interrupted by ctx.
+func contextError(name string, ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%s timed out", name)
+	}
+
+	return fmt.Errorf("%s canceled", name)
+}
+
+// System commands, only the absolute paths listed in commandAllowlist can be
+// executed, without shell, with a minimal environment and, when unprivileged,
+// with resource limits applied right after start. Commands flagged as root
+// are executed with sudo, whose environment reset and process limits apply,
+// or by the privileged helper when configured (see privsep.go).
+
+const sudo = "/usr/bin/sudo"
+
+type commandPolicy struct {
+	// executed with sudo
+	root bool
+}
+
+var commandAllowlist = map[string]commandPolicy{
+	"/bin/chown":       {root: true},
+	"/bin/date":        {root: true},
+	"/bin/mount":       {root: true},
+	"/bin/umount":      {root: true},
+	"/sbin/cryptsetup": {root: true},
+	"/sbin/hwclock":    {root: true},
+	"/sbin/ip":         {root: true},
+	"/sbin/lvm":        {},
+	"/sbin/modprobe":   {root: true},
+	"/sbin/poweroff":   {root: true},
+	dumpe2fs:           {root: true},
+	clevis:             {},
+	fido2Assert:        {},
+	fido2Token:         {},
+	pdfGhostscript:     {},
+	pdfOffice:          {},
+	pdfQPDF:            {},
+}
+
+// commandEnv returns the environment of system commands, TMPDIR is preserved,
+// when set, to keep temporary files on the encrypted volume.
+func commandEnv() (env []string) {
+	env = []string{
+		"PATH=/usr/sbin:/usr/bin:/sbin:/bin",
+		"HOME=" + os.Getenv("HOME"),
+		"LC_ALL=C",
+	}
+
+	if tmp := os.Getenv("TMPDIR"); tmp != "" {
+		env = append(env, "TMPDIR="+tmp)
+	}
+
+	return
+}
+
+// limitCommand applies resource limits to a started process, core dumps are
+// disabled as they might contain secrets.
+func limitCommand(pid int) (err error) {
+	limits := map[int]uint64{
+		syscall.RLIMIT_CORE:   0,
+		syscall.RLIMIT_NOFILE: 1024,
+	}
+
+	if conf.CommandMemory > 0 {
+		limits[syscall.RLIMIT_AS] = uint64(conf.CommandMemory) << 20
+	}
+
+	for resource, limit := range limits {
+		rlim := syscall.Rlimit{Cur: limit, Max: limit}
+		_, _, e := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(resource), uintptr(unsafe.Pointer(&rlim)), 0, 0, 0)
+
+		switch e {
+		case 0:
+		case syscall.ESRCH:
+			// already exited
+			return
+		default:
+			return fmt.Errorf("could not set resource limit %d, %v", resource, syscall.Errno(e))
+		}
+	}
+
+	return
+}
+
+func execCommand(cmd string, args []string, input string) (output string, err error) {
+	ctx, cancel := withTimeout(context.Background(), conf.CommandTimeout)
+	defer cancel()
+
+	return execCommandContext(ctx, cmd, args, input)
+}
+
+func execCommandContext(ctx context.Context, cmd string, args []string, input string) (output string, err error) {
 	var c *exec.Cmd
 
-	if root {
-		c = exec.Command("/usr/bin/sudo", append([]string{cmd}, args...)...)
-	} else {
+	policy, ok := commandAllowlist[cmd]
+
+	if !ok {
+		return "", fmt.Errorf("command %s not allowed", cmd)
+	}
+
+	if conf.Debug {
+		log.Printf("executing system command, sudo: %v, cmd: %s, args: %v\n", policy.root && conf.PrivsepSocket == "", cmd, args)
+	}
+
+	switch {
+	case policy.root && conf.PrivsepSocket != "":
+		return privsepCall(ctx, cmd, args, input)
+	case policy.root && os.Geteuid() == 0:
+		// container mode
+		if handled, err := nativeCommand(ctx, cmd, args, input); handled {
+			return "", err
+		}
+
+		c = exec.Command(cmd, args...)
+	case policy.root:
+		c = exec.Command(sudo, append([]string{cmd}, args...)...)
+	default:
 		c = exec.Command(cmd, args...)
 	}
 
-	var stdin bytes.Buffer
+	return runCommand(ctx, filepath.Base(cmd), c, input, !policy.root)
+}
+
+// nativeCommand performs privileged commands in-process when supported,
+// handled is false when the command must be executed.
+func nativeCommand(ctx context.Context, cmd string, args []string, input string) (handled bool, err error) {
+	switch cmd {
+	case "/sbin/cryptsetup":
+		return dmcryptCommand(ctx, args, input)
+	case "/bin/mount", "/bin/umount":
+		return mountCommand(cmd, args)
+	}
+
+	return
+}
+
+// runCommand runs a command with the system commands environment, returning
+// its output, errors include the command standard error.
+func runCommand(ctx context.Context, name string, c *exec.Cmd, input string, limit bool) (output string, err error) {
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
 
 	if input != "" {
-		_, err = stdin.WriteString(input)
-		c.Stdin = &stdin
-
-		if err != nil {
-			err = errors.New("error writing to stdin")
-			return
-		}
+		c.Stdin = strings.NewReader(input)
 	}
 
+	c.Env = commandEnv()
 	c.Stdout = &stdout
 	c.Stderr = &stderr
 
-	if conf.Debug {
-		log.Printf("executing system command, sudo: %v, cmd: %s, args: %v\n", root, cmd, args)
-	}
-
-	err = c.Run()
+	err = runContext(ctx, name, c, limit)
 
-	if err != nil {
-		err = errors.New(stderr.String())
+	if err != nil && ctx.Err() == nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%s: %s", name, msg)
+		} else {
+			err = fmt.Errorf("%s failed: %v", name, err)
+		}
 	}
 
 	return stdout.String(), err
@@ -58,28 +250,51 @@ func execCommand(cmd string, args []string, root bool, input string) (output str
 
 func setTime(epoch int64) (err error) {
 	args := []string{"-s", "@" + strconv.FormatInt(epoch, 10)}
-	_, err = execCommand("/bin/date", args, true, "")
+	_, err = execCommand("/bin/date", args, "")
+
+	if err != nil {
+		return
+	}
+
+	if rtcPresent() {
+		err = rtcWrite()
+	}
+
+	clock.check()
 
 	return
 }
 
-func cp(src string, dst string) (err error) {
-	args :=  []string{"-ra", src, dst}
-	_, err = execCommand("/bin/cp", args, false, "")
+// rtcRead sets the system time from the hardware clock.
+func rtcRead() (err error) {
+	args := []string{"--hctosys", "--utc", "-f", rtcDevice}
+	_, err = execCommand("/sbin/hwclock", args, "")
 
 	return
 }
 
-func mv(src string, dst string) (err error) {
-	args :=  []string{src, dst}
-	_, err = execCommand("/bin/mv", args, false, "")
+// rtcWrite sets the hardware clock from the system time.
+func rtcWrite() (err error) {
+	args := []string{"--systohc", "--utc", "-f", rtcDevice}
+	_, err = execCommand("/sbin/hwclock", args, "")
 
 	return
 }
 
 func poweroff() {
+	if conf.Container {
+		go func() {
+			// allow the response to be sent
+			time.Sleep(1 * time.Second)
+			log.Printf("container mode, exiting")
+			os.Exit(0)
+		}()
+
+		return
+	}
+
 	go func() {
-		_, _ = execCommand("/sbin/poweroff", []string{}, true, "")
+		_, _ = execCommand("/sbin/poweroff", []string{}, "")
 	}()
 }
 
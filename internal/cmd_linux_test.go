@@ -0,0 +1,133 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// +build linux
+
+package interlock
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommandTimeout(t *testing.T) {
+	conf.SetDefaults()
+	defer conf.SetDefaults()
+
+	commandAllowlist["/bin/echo"] = commandPolicy{}
+	commandAllowlist["/bin/sleep"] = commandPolicy{}
+
+	defer delete(commandAllowlist, "/bin/echo")
+	defer delete(commandAllowlist, "/bin/sleep")
+
+	output, err := execCommand("/bin/echo", []string{"interlock"}, "")
+
+	if err != nil || output != "interlock\n" {
+		t.Fatalf("unexpected output %q (%v)", output, err)
+	}
+
+	conf.CommandTimeout = 1
+	start := time.Now()
+
+	if _, err = execCommand("/bin/sleep", []string{"30"}, ""); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("wedged command not interrupted (%v)", err)
+	}
+
+	if time.Since(start) > 10*time.Second {
+		t.Error("timeout not enforced")
+	}
+
+	// clients going away
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	if _, err = execCommandContext(ctx, "/bin/sleep", []string{"30"}, ""); err == nil || !strings.Contains(err.Error(), "canceled") {
+		t.Errorf("canceled command not interrupted (%v)", err)
+	}
+}
+
+func TestCommandSandbox(t *testing.T) {
+	conf.SetDefaults()
+	defer conf.SetDefaults()
+
+	if _, err := execCommand("/bin/sh", []string{"-c", "true"}, ""); err == nil {
+		t.Fatal("command outside allowlist executed")
+	}
+
+	if _, err := execCommand("cp", []string{"/dev/null", "/dev/null"}, ""); err == nil {
+		t.Fatal("relative command executed")
+	}
+
+	commandAllowlist["/bin/sh"] = commandPolicy{}
+	defer delete(commandAllowlist, "/bin/sh")
+
+	os.Setenv("INTERLOCK_TEST_SECRET", "secret")
+	defer os.Unsetenv("INTERLOCK_TEST_SECRET")
+
+	// limits are applied right after start
+	output, err := execCommand("/bin/sh", []string{"-c", "sleep 0.5; echo \"$INTERLOCK_TEST_SECRET\" $(ulimit -c) $(ulimit -n)"}, "")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if output != " 0 1024\n" {
+		t.Errorf("unexpected command environment or limits %q", output)
+	}
+
+	if _, err = execCommand("/bin/sh", []string{"-c", "echo failure >&2; exit 1"}, ""); err == nil || err.Error() != "sh: failure" {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	tmp, set := os.LookupEnv("TMPDIR")
+	os.Unsetenv("TMPDIR")
+
+	if set {
+		defer os.Setenv("TMPDIR", tmp)
+	}
+
+	for _, v := range commandEnv() {
+		if strings.HasPrefix(v, "TMPDIR=") {
+			t.Errorf("unset TMPDIR passed to commands (%q)", v)
+		}
+	}
+}
+
+func TestMountCommand(t *testing.T) {
+	conf.SetDefaults()
+	defer conf.SetDefaults()
+
+	if args := mountArgs([]string{"remount", "ro"}, "/mnt"); strings.Join(args, " ") != "-o remount,ro,nodev,nosuid,noexec /mnt" {
+		t.Errorf("unexpected mount arguments %v", args)
+	}
+
+	if handled, _ := mountCommand("/bin/mount", []string{"-o", "exec", "/dev/mapper/interlockfs", "/mnt"}); handled {
+		t.Error("unsupported mount option handled")
+	}
+
+	if handled, _ := mountCommand("/bin/mount", []string{"-o", "nodev", "/mnt"}); handled {
+		t.Error("mount without device handled")
+	}
+
+	conf.MountOptions = []string{"nodev", "exec"}
+
+	if err := validateMount(); err == nil {
+		t.Error("invalid mount_options accepted")
+	}
+
+	conf.MountOptions = nil
+
+	if args := mountArgs(nil, "/dev/mapper/interlockfs", "/mnt"); len(args) != 2 {
+		t.Errorf("unexpected mount arguments %v", args)
+	}
+}
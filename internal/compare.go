@@ -0,0 +1,30 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+)
+
+// Secret comparisons, passwords, session and lock tokens, MACs and digests
+// are only compared with the following helpers. Their execution time does
+// not depend on the compared values, arguments are hashed first so that
+// their lengths are not disclosed either.
+
+// secretEqual reports whether two secrets are equal in constant time.
+func secretEqual(a string, b string) bool {
+	return secretEqualBytes([]byte(a), []byte(b))
+}
+
+// secretEqualBytes reports whether two secrets are equal in constant time.
+func secretEqualBytes(a []byte, b []byte) bool {
+	x := sha256.Sum256(a)
+	y := sha256.Sum256(b)
+
+	return subtle.ConstantTimeCompare(x[:], y[:]) == 1
+}
@@ -0,0 +1,448 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Compressed storage class, files uploaded within the `compress_paths`
+// directories are stored as independently compressed (zstd) and
+// authenticated encrypted (AES-256-GCM) chunks followed by an encrypted chunk
+// index, they are transparently reassembled on download. This trades CPU time
+// for storage space on small media.
+//
+// File format:
+//
+//   magic (5) | version (1) | file identifier (8)
+//   chunk:  length (4) | sealed zstd frame
+//   index:  length (4) | sealed [count (4) | size (8) | count * (offset (8) | length (4))]
+//   index offset (8)
+//
+// The nonce of each chunk combines the file identifier and the chunk number,
+// the index is sealed with the reserved number 0xffffffff, preventing chunk
+// reordering, substitution across files and truncation.
+//
+// Chunks are compressed with the in-tree zstd implementation (zstd.go),
+// files written by earlier releases (version 1) hold raw DEFLATE chunks and
+// remain readable.
+
+const compressMagic = "ILZC\x00"
+const compressDeflate = 1
+const compressZstd = 2
+const compressChunkSize = 256 * 1024
+const compressKeyFile = ".interlock-storage.key"
+const compressIndexChunk = 0xffffffff
+
+type compressedChunk struct {
+	offset int64
+	length uint32
+}
+
+// compressedPath returns whether a path belongs to a compressed storage
+// directory.
+func compressedPath(osPath string) bool {
+	for _, p := range conf.CompressPaths {
+		dir := filepath.Join(conf.MountPoint, filepath.Clean("/"+p))
+
+		if strings.HasPrefix(osPath, dir+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// storageKey returns the compressed storage key, which is generated on first
+// use and kept on the encrypted volume.
+func storageKey() (key []byte, err error) {
+	keyPath := filepath.Join(conf.MountPoint, compressKeyFile)
+	key, err = volumeJail().ReadFile(keyPath)
+
+	if err == nil && len(key) == 32 {
+		return
+	}
+
+	if !os.IsNotExist(err) {
+		return nil, errors.New("invalid storage key")
+	}
+
+	key = make([]byte, 32)
+
+	if _, err = rand.Read(key); err != nil {
+		return
+	}
+
+	err = volumeJail().WriteFile(keyPath, key, 0600)
+
+	return
+}
+
+func storageAEAD() (aead cipher.AEAD, err error) {
+	key, err := storageKey()
+
+	if err != nil {
+		return
+	}
+
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func compressNonce(id []byte, n uint32) (nonce []byte) {
+	nonce = make([]byte, 12)
+	copy(nonce, id)
+	binary.BigEndian.PutUint32(nonce[8:], n)
+
+	return
+}
+
+type compressedWriter struct {
+	output io.Writer
+	aead   cipher.AEAD
+	header []byte
+	buf    []byte
+	offset int64
+	size   int64
+	index  []compressedChunk
+}
+
+func newCompressedWriter(output io.Writer) (c *compressedWriter, err error) {
+	aead, err := storageAEAD()
+
+	if err != nil {
+		return
+	}
+
+	id := make([]byte, 8)
+
+	if _, err = rand.Read(id); err != nil {
+		return
+	}
+
+	c = &compressedWriter{
+		output: output,
+		aead:   aead,
+		header: append(append([]byte(compressMagic), compressZstd), id...),
+	}
+
+	_, err = output.Write(c.header)
+	c.offset = int64(len(c.header))
+
+	return
+}
+
+func (c *compressedWriter) seal(data []byte, n uint32) (err error) {
+	sealed := c.aead.Seal(nil, compressNonce(c.header[len(compressMagic)+1:], n), data, c.header)
+
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(sealed)))
+
+	if _, err = c.output.Write(append(length, sealed...)); err != nil {
+		return
+	}
+
+	c.offset += int64(len(length) + len(sealed))
+
+	return
+}
+
+func (c *compressedWriter) flush() (err error) {
+	if len(c.buf) == 0 {
+		return
+	}
+
+	if len(c.index) >= compressIndexChunk {
+		return errors.New("file too large")
+	}
+
+	compressed := zstdCompress(c.buf)
+
+	c.index = append(c.index, compressedChunk{c.offset, uint32(len(c.buf))})
+	c.size += int64(len(c.buf))
+	c.buf = c.buf[:0]
+
+	return c.seal(compressed, uint32(len(c.index)-1))
+}
+
+func (c *compressedWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		i := compressChunkSize - len(c.buf)
+
+		if i > len(p) {
+			i = len(p)
+		}
+
+		c.buf = append(c.buf, p[:i]...)
+		p = p[i:]
+		n += i
+
+		if len(c.buf) == compressChunkSize {
+			if err = c.flush(); err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// Close writes any pending chunk, the index and its offset, it does not close
+// the underlying writer.
+func (c *compressedWriter) Close() (err error) {
+	if err = c.flush(); err != nil {
+		return
+	}
+
+	index := make([]byte, 12, 12+len(c.index)*12)
+	binary.BigEndian.PutUint32(index[0:], uint32(len(c.index)))
+	binary.BigEndian.PutUint64(index[4:], uint64(c.size))
+
+	for _, chunk := range c.index {
+		entry := make([]byte, 12)
+		binary.BigEndian.PutUint64(entry[0:], uint64(chunk.offset))
+		binary.BigEndian.PutUint32(entry[8:], chunk.length)
+		index = append(index, entry...)
+	}
+
+	indexOffset := c.offset
+
+	if err = c.seal(index, compressIndexChunk); err != nil {
+		return
+	}
+
+	trailer := make([]byte, 8)
+	binary.BigEndian.PutUint64(trailer, uint64(indexOffset))
+
+	_, err = c.output.Write(trailer)
+
+	return
+}
+
+type compressedReader struct {
+	input  *os.File
+	aead   cipher.AEAD
+	header []byte
+	index  []compressedChunk
+	size   int64
+	next   int
+	buf    []byte
+}
+
+// readSealed reads and opens the sealed record at offset.
+func (c *compressedReader) readSealed(offset int64, n uint32) (data []byte, err error) {
+	length := make([]byte, 4)
+
+	if _, err = c.input.ReadAt(length, offset); err != nil {
+		return
+	}
+
+	sealed := make([]byte, binary.BigEndian.Uint32(length))
+
+	if int64(len(sealed)) > compressChunkSize*2 && n != compressIndexChunk {
+		return nil, errors.New("invalid chunk length")
+	}
+
+	if _, err = c.input.ReadAt(sealed, offset+4); err != nil {
+		return
+	}
+
+	return c.aead.Open(nil, compressNonce(c.header[len(compressMagic)+1:], n), sealed, c.header)
+}
+
+func newCompressedReader(input *os.File) (c *compressedReader, err error) {
+	stat, err := input.Stat()
+
+	if err != nil {
+		return
+	}
+
+	c = &compressedReader{
+		input:  input,
+		header: make([]byte, len(compressMagic)+1+8),
+	}
+
+	if stat.Size() < int64(len(c.header))+8 {
+		return nil, errors.New("invalid compressed file")
+	}
+
+	if _, err = input.ReadAt(c.header, 0); err != nil {
+		return
+	}
+
+	if !compressedFormat(c.header) {
+		return nil, errors.New("unsupported compressed file format")
+	}
+
+	if c.aead, err = storageAEAD(); err != nil {
+		return
+	}
+
+	trailer := make([]byte, 8)
+
+	if _, err = input.ReadAt(trailer, stat.Size()-8); err != nil {
+		return
+	}
+
+	offset := int64(binary.BigEndian.Uint64(trailer))
+
+	if offset < int64(len(c.header)) || offset > stat.Size()-8 {
+		return nil, errors.New("invalid compressed file index")
+	}
+
+	index, err := c.readSealed(offset, compressIndexChunk)
+
+	if err != nil {
+		return nil, errors.New("compressed file authentication failed")
+	}
+
+	if len(index) < 12 || int64(len(index)) != 12+int64(binary.BigEndian.Uint32(index[0:]))*12 {
+		return nil, errors.New("invalid compressed file index")
+	}
+
+	c.size = int64(binary.BigEndian.Uint64(index[4:]))
+
+	for i := 12; i < len(index); i += 12 {
+		c.index = append(c.index, compressedChunk{
+			offset: int64(binary.BigEndian.Uint64(index[i:])),
+			length: binary.BigEndian.Uint32(index[i+8:]),
+		})
+	}
+
+	return
+}
+
+func (c *compressedReader) Read(p []byte) (n int, err error) {
+	for len(c.buf) == 0 {
+		if c.next >= len(c.index) {
+			return 0, io.EOF
+		}
+
+		chunk := c.index[c.next]
+		compressed, err := c.readSealed(chunk.offset, uint32(c.next))
+
+		if err != nil {
+			return 0, errors.New("compressed file authentication failed")
+		}
+
+		switch c.header[len(compressMagic)] {
+		case compressDeflate:
+			c.buf, err = ioutil.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(compressed)), int64(chunk.length)+1))
+		default:
+			c.buf, err = zstdDecompress(compressed, int(chunk.length))
+		}
+
+		if err != nil {
+			return 0, err
+		}
+
+		if len(c.buf) != int(chunk.length) {
+			return 0, errors.New("invalid compressed chunk length")
+		}
+
+		c.next++
+	}
+
+	n = copy(p, c.buf)
+	c.buf = c.buf[n:]
+
+	return
+}
+
+func (c *compressedReader) Close() error {
+	return c.input.Close()
+}
+
+// compressedFormat returns whether a file header matches a supported
+// compressed storage format version.
+func compressedFormat(header []byte) bool {
+	if !bytes.HasPrefix(header, []byte(compressMagic)) || len(header) <= len(compressMagic) {
+		return false
+	}
+
+	switch header[len(compressMagic)] {
+	case compressDeflate, compressZstd:
+		return true
+	}
+
+	return false
+}
+
+// openStored opens a file for reading, compressed files are transparently
+// decompressed.
+func openStored(osPath string) (r io.ReadCloser, err error) {
+	input, err := volumeJail().Open(osPath)
+
+	if err != nil {
+		return
+	}
+
+	magic := make([]byte, len(compressMagic)+1)
+
+	if n, _ := input.ReadAt(magic, 0); n != len(magic) || !compressedFormat(magic) {
+		return input, nil
+	}
+
+	c, err := newCompressedReader(input)
+
+	if err != nil {
+		input.Close()
+		return
+	}
+
+	return c, nil
+}
+
+// compressStore stores the content of a reader in the compressed storage
+// format, the destination is only replaced once complete.
+func compressStore(osPath string, r io.Reader) (written int64, err error) {
+	tmp, err := createAtomic("upload", "", osPath, false)
+
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			tmp.Abort()
+		}
+	}()
+
+	w, err := newCompressedWriter(tmp.File)
+
+	if err != nil {
+		return
+	}
+
+	if written, err = io.Copy(w, r); err != nil {
+		return
+	}
+
+	if err = w.Close(); err != nil {
+		return
+	}
+
+	err = tmp.Commit()
+
+	return
+}
@@ -0,0 +1,106 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompressedStorage(t *testing.T) {
+	c := newTestServer(t)
+	defer conf.SetDefaults()
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	conf.CompressPaths = []string{"/archive"}
+
+	// spanning multiple chunks
+	data := strings.Repeat(testCleartext, 3*compressChunkSize/len(testCleartext))
+	c.upload("/archive/large.txt", data)
+	c.upload("/plain.txt", testCleartext)
+
+	osPath := filepath.Join(conf.MountPoint, "archive", "large.txt")
+	stored, err := ioutil.ReadFile(osPath)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.HasPrefix(stored, append([]byte(compressMagic), compressZstd)) || len(stored) >= len(data) || bytes.Contains(stored, []byte(testCleartext)) {
+		t.Fatalf("file not stored compressed and encrypted (%d bytes)", len(stored))
+	}
+
+	if d := c.download("/archive/large.txt"); d != data {
+		t.Fatal("downloaded data mismatch")
+	}
+
+	if d := c.download("/plain.txt"); d != testCleartext {
+		t.Fatalf("downloaded data mismatch: %s", d)
+	}
+
+	// empty and incompressible files
+	random := make([]byte, compressChunkSize+1)
+	rand.Read(random)
+
+	for _, content := range []string{"", string(random)} {
+		c.upload("/archive/other.bin", content)
+
+		if d := c.download("/archive/other.bin"); d != content {
+			t.Fatalf("downloaded data mismatch (%d bytes)", len(content))
+		}
+
+		os.Remove(filepath.Join(conf.MountPoint, "archive", "other.bin"))
+	}
+
+	// tampering
+	tampered := append([]byte{}, stored...)
+	tampered[len(compressMagic)+1+8+10] ^= 0xff
+
+	truncated := append([]byte{}, stored[:len(stored)-20]...)
+
+	for _, content := range [][]byte{tampered, truncated} {
+		ioutil.WriteFile(osPath, content, 0600)
+
+		r, err := openStored(osPath)
+
+		if err == nil {
+			_, err = ioutil.ReadAll(r)
+			r.Close()
+		}
+
+		if err == nil {
+			t.Error("tampered compressed file accepted")
+		}
+	}
+
+	// files stored by earlier releases as DEFLATE chunks (format version 1),
+	// created with a storage key of 0x42 bytes
+	legacy, err := ioutil.ReadFile(filepath.Join("testdata", "compress", "legacy-v1.ilzc"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ioutil.WriteFile(filepath.Join(conf.MountPoint, compressKeyFile), bytes.Repeat([]byte{0x42}, 32), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ioutil.WriteFile(filepath.Join(conf.MountPoint, "archive", "legacy.txt"), legacy, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if d := c.download("/archive/legacy.txt"); d != strings.Repeat("INTERLOCK compressed storage legacy format\n", 8000) {
+		t.Fatalf("legacy compressed file mismatch (%d bytes)", len(d))
+	}
+}
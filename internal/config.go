@@ -15,7 +15,6 @@ import (
 	"log/syslog"
 	"net/http"
 	"os"
-	"path/filepath"
 	"strings"
 	"time"
 )
@@ -30,19 +29,202 @@ type Config struct {
 	TLSCert     string   `json:"tls_cert"`
 	TLSKey      string   `json:"tls_key"`
 	TLSClientCA string   `json:"tls_client_ca"`
+	CookieName  string   `json:"cookie_name"`
+	SameSite    string   `json:"cookie_samesite"`
+	SecureProxy bool     `json:"cookie_secure"`
+	CSP         string   `json:"csp"`
+	CSPReport   bool     `json:"csp_report"`
+	StaticPath  string   `json:"static_path"`
 	HSM         string   `json:"hsm"`
 	KeyPath     string   `json:"key_path"`
 	VolumeGroup string   `json:"volume_group"`
 	Ciphers     []string `json:"ciphers"`
 
+	CipherOptions map[string]json.RawMessage `json:"cipher_options"`
+	ListenerTLS   map[string]listenerTLS     `json:"listener_tls"`
+
+	CORSOrigins     []string `json:"cors_origins"`
+	CORSCredentials bool     `json:"cors_credentials"`
+	CORSMaxAge      int      `json:"cors_max_age"`
+
+	WatchdogInterval   int  `json:"watchdog_interval"`
+	WatchdogGoroutines int  `json:"watchdog_goroutines"`
+	WatchdogFiles      int  `json:"watchdog_files"`
+	WatchdogMemory     int  `json:"watchdog_memory"`
+	WatchdogJobTimeout int  `json:"watchdog_job_timeout"`
+	WatchdogRelease    bool `json:"watchdog_release"`
+
+	DebugAddress string `json:"debug_address"`
+	Dedup        bool   `json:"dedup"`
+	Symlinks     string `json:"symlinks"`
+
+	ReplicaListen   string   `json:"replica_listen"`
+	ReplicaPeer     string   `json:"replica_peer"`
+	ReplicaPaths    []string `json:"replica_paths"`
+	ReplicaInterval int      `json:"replica_interval"`
+	ReplicaConflict string   `json:"replica_conflict"`
+	ReplicaCert     string   `json:"replica_cert"`
+	ReplicaKey      string   `json:"replica_key"`
+	ReplicaCA       string   `json:"replica_ca"`
+
+	FilenameNFC            bool     `json:"filename_nfc"`
+	FilenameMaxLength      int      `json:"filename_max_length"`
+	FilenameReserved       []string `json:"filename_reserved"`
+	FilenameCaseCollisions string   `json:"filename_case_collisions"`
+
+	LocalePath string `json:"locale_path"`
+
+	PowerSupply        string `json:"power_supply"`
+	PowerGPIO          string `json:"power_gpio"`
+	PowerGPIOActiveLow bool   `json:"power_gpio_active_low"`
+	PowerGPIOShutdown  bool   `json:"power_gpio_shutdown"`
+	PowerWarning       int    `json:"power_warning"`
+	PowerShutdown      int    `json:"power_shutdown"`
+	PowerInterval      int    `json:"power_interval"`
+
+	SensorsInterval int `json:"sensors_interval"`
+	SensorsMargin   int `json:"sensors_margin"`
+	SensorsLimit    int `json:"sensors_limit"`
+
+	LED         string            `json:"led"`
+	LEDPatterns map[string]string `json:"led_patterns"`
+
+	DeadmanPeriod   int      `json:"deadman_period"`
+	DeadmanAction   string   `json:"deadman_action"`
+	DeadmanState    string   `json:"deadman_state"`
+	DeadmanVolume   string   `json:"deadman_volume"`
+	DeadmanKeyslots []int    `json:"deadman_keyslots"`
+	DeadmanPaths    []string `json:"deadman_paths"`
+
+	Measurements string `json:"measurements"`
+	ReadOnly     bool   `json:"read_only"`
+
+	Webhooks []webhook `json:"webhooks"`
+	LowDisk  int       `json:"low_disk"`
+
+	PushService string   `json:"push_service"`
+	PushURL     string   `json:"push_url"`
+	PushToken   string   `json:"push_token"`
+	PushEvents  []string `json:"push_events"`
+
+	SIEMAddress string `json:"siem_address"`
+	SIEMFormat  string `json:"siem_format"`
+	SIEMTLS     bool   `json:"siem_tls"`
+	SIEMCA      string `json:"siem_ca"`
+
+	PDFResolution int `json:"pdf_resolution"`
+
+	Console     string `json:"console"`
+	FIDO2Device string `json:"fido2_device"`
+
+	PIVCA    string            `json:"piv_ca"`
+	PIVRoles map[string]string `json:"piv_roles"`
+
+	Keypad string `json:"keypad"`
+
+	AccessWindows  []string `json:"access_windows"`
+	SessionBinding string   `json:"session_binding"`
+	XSRFMaxAge     int      `json:"xsrf_max_age"`
+	Banner         string   `json:"banner"`
+
+	GRPCListen string `json:"grpc_listen"`
+	GRPCCert   string `json:"grpc_cert"`
+	GRPCKey    string `json:"grpc_key"`
+	GRPCCA     string `json:"grpc_ca"`
+
+	MDNS string `json:"mdns"`
+
+	USBNetwork string `json:"usb_network"`
+	USBAddress string `json:"usb_address"`
+	USBDHCP    bool   `json:"usb_dhcp"`
+
+	WiFi        string `json:"wifi"`
+	WiFiControl string `json:"wifi_control"`
+
+	NTPServers  []string `json:"ntp_servers"`
+	NTPInterval int      `json:"ntp_interval"`
+
+	InsecureTime bool `json:"insecure_time"`
+
+	HistorySize int `json:"history_size"`
+
+	LogMaxSize int `json:"log_max_size"`
+	LogKeep    int `json:"log_keep"`
+
+	CameraPath   string `json:"camera_path"`
+	CameraCipher string `json:"camera_cipher"`
+	CameraKey    string `json:"camera_key"`
+
+	DepositKey      string `json:"deposit_key"`
+	DepositSpool    string `json:"deposit_spool"`
+	DepositPath     string `json:"deposit_path"`
+	DepositMaxSize  int    `json:"deposit_max_size"`
+	DepositMaxSpool int    `json:"deposit_max_spool"`
+
+	TangVolume  string   `json:"tang_volume"`
+	TangServers []string `json:"tang_servers"`
+	TangTimeout int      `json:"tang_timeout"`
+
+	EscrowContacts  []string `json:"escrow_contacts"`
+	EscrowThreshold int      `json:"escrow_threshold"`
+	EscrowPath      string   `json:"escrow_path"`
+
+	HiddenHeader string `json:"hidden_header"`
+
+	HeaderMode string `json:"header_mode"`
+	HeaderPath string `json:"header_path"`
+
+	MigrateCiphers []string `json:"migrate_ciphers"`
+	MigrateIdle    int      `json:"migrate_idle"`
+
+	CompressPaths []string `json:"compress_paths"`
+
+	Workers      int `json:"workers"`
+	MemoryBudget int `json:"memory_budget"`
+
+	SessionRequests int `json:"session_requests"`
+	SessionQueue    int `json:"session_queue"`
+	ClientSessions  int `json:"client_sessions"`
+
+	DownloadTTL int `json:"download_ttl"`
+	PreviewTTL  int `json:"preview_ttl"`
+
+	CommandTimeout int `json:"command_timeout"`
+	LUKSTimeout    int `json:"luks_timeout"`
+	CipherTimeout  int `json:"cipher_timeout"`
+	CommandMemory  int `json:"command_memory"`
+
+	PrivsepSocket string `json:"privsep_socket"`
+	PrivsepUser   string `json:"privsep_user"`
+
+	Confinement      string   `json:"confinement"`
+	ConfinementPaths []string `json:"confinement_paths"`
+
+	Container  bool   `json:"container"`
+	VolumePath string `json:"volume_path"`
+
+	Tenants map[string]json.RawMessage `json:"tenants"`
+
+	UITitle    string   `json:"ui_title"`
+	UILogo     string   `json:"ui_logo"`
+	UIFeatures []string `json:"ui_features"`
+
+	MountOptions []string `json:"mount_options"`
+
+	HoneytokenLock bool `json:"honeytoken_lock"`
+
 	availableCiphers map[string]cipherInterface
 	enabledCiphers   map[string]cipherInterface
 	availableHSMs    map[string]HSMInterface
 	authHSM          HSMInterface
 	tlsHSM           HSMInterface
+	hsmCiphers       map[string]bool
+	volume           volumeInterface
 	MountPoint       string
 	TestMode         bool
-	logFile          *os.File
+	logFile          *rotatingFile
+	configPath       string
+	tenant           string
 }
 
 var conf Config
@@ -51,6 +233,18 @@ func GetConfig() *Config {
 	return &conf
 }
 
+// bindAddresses returns the list of addresses, comma separated in
+// bind_address, the HTTP server listens on.
+func (c *Config) bindAddresses() (addrs []string) {
+	for _, addr := range strings.Split(c.BindAddress, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return
+}
+
 func (c *Config) SetAvailableCipher(cipher cipherInterface) {
 	if c.availableCiphers == nil {
 		c.availableCiphers = make(map[string]cipherInterface)
@@ -67,6 +261,10 @@ func (c *Config) SetAvailableHSM(model string, HSM HSMInterface) {
 	c.availableHSMs[model] = HSM
 }
 
+func (c *Config) SetVolume(volume volumeInterface) {
+	c.volume = volume
+}
+
 func (c *Config) GetAvailableCipher(cipherName string) (cipher cipherInterface, err error) {
 	cipher, ok := c.availableCiphers[cipherName]
 
@@ -127,6 +325,26 @@ func (c *Config) EnableCiphers() (err error) {
 		}
 	}
 
+	for name := range c.CipherOptions {
+		if _, ok := c.enabledCiphers[name]; !ok {
+			return fmt.Errorf("options for disabled cipher %s", name)
+		}
+	}
+
+	for name, cipher := range c.enabledCiphers {
+		options := c.CipherOptions[name]
+
+		if configurable, ok := cipher.(cipherConfigurable); ok {
+			err = configurable.Configure(options)
+		} else if len(options) > 0 {
+			err = errors.New("cipher does not support options")
+		}
+
+		if err != nil {
+			return fmt.Errorf("invalid %s options: %v", name, err)
+		}
+	}
+
 	return
 }
 
@@ -146,6 +364,7 @@ func (c *Config) EnableHSM() (err error) {
 	if val, ok := c.availableHSMs[model]; ok {
 		options := strings.Split(HSMConf[1], ",")
 		HSM := val.New()
+		c.hsmCiphers = make(map[string]bool)
 
 		for i := 0; i < len(options); i++ {
 			switch options[i] {
@@ -157,6 +376,13 @@ func (c *Config) EnableHSM() (err error) {
 				cipher := HSM.Cipher()
 				c.SetAvailableCipher(cipher)
 				c.enabledCiphers[cipher.GetInfo().Name] = cipher
+				c.hsmCiphers[cipher.GetInfo().Name] = true
+			case "sig":
+				for _, cipher := range splitSigCiphers(HSM) {
+					c.SetAvailableCipher(cipher)
+					c.enabledCiphers[cipher.GetInfo().Name] = cipher
+					c.hsmCiphers[cipher.GetInfo().Name] = true
+				}
 			default:
 				log.Fatal("invalid hsm option")
 			}
@@ -192,6 +418,93 @@ func (c *Config) SetDefaults() {
 	c.TLS = "on"
 	c.TLSCert = "certs/cert.pem"
 	c.TLSKey = "certs/key.pem"
+	c.CookieName = "INTERLOCK-Token"
+	c.SameSite = "strict"
+	c.SecureProxy = false
+	c.CSP = defaultCSP
+	c.CSPReport = false
+	c.CORSOrigins = nil
+	c.CORSCredentials = false
+	c.CORSMaxAge = 600
+	c.WatchdogInterval = 60
+	c.WatchdogGoroutines = 1000
+	c.WatchdogFiles = 512
+	c.WatchdogMemory = 128
+	c.WatchdogJobTimeout = 3600
+	c.WatchdogRelease = false
+	c.Symlinks = "reject"
+	c.ReplicaInterval = 3600
+	c.ReplicaConflict = "keep"
+	c.FilenameNFC = true
+	c.PowerWarning = 20
+	c.PowerShutdown = 5
+	c.PowerInterval = 10
+	c.SensorsInterval = 60
+	c.SensorsMargin = 10
+	c.SensorsLimit = 85
+	c.DeadmanAction = "notify"
+	c.LowDisk = 10
+	c.PushEvents = []string{"login_failed", "wipe", "low_disk", "tamper", "honeytoken"}
+	c.SIEMFormat = "json"
+	c.SIEMTLS = true
+	c.PDFResolution = 150
+	c.SessionBinding = "off"
+	c.XSRFMaxAge = 3600
+	c.USBAddress = "10.0.0.1/24"
+	c.WiFiControl = "/var/run/wpa_supplicant"
+	c.NTPInterval = 3600
+	c.InsecureTime = false
+	c.HistorySize = 100
+	c.LogMaxSize = 1024
+	c.LogKeep = 5
+	c.CameraPath = "/camera"
+	c.CameraCipher = ""
+	c.CameraKey = ""
+	c.DepositKey = ""
+	c.DepositSpool = "/var/spool/interlock-deposit"
+	c.DepositPath = "/deposit"
+	c.DepositMaxSize = 100
+	c.DepositMaxSpool = 1000
+	c.TangVolume = ""
+	c.TangServers = nil
+	c.TangTimeout = 120
+	c.EscrowContacts = nil
+	c.EscrowThreshold = 2
+	c.EscrowPath = "/var/lib/interlock-escrow"
+	c.HiddenHeader = ""
+	c.HeaderMode = ""
+	c.HeaderPath = "/media/interlock-token"
+	c.MigrateCiphers = []string{"AES-256-OFB"}
+	c.MigrateIdle = 30
+	c.CompressPaths = nil
+	c.Workers = 2
+	c.MemoryBudget = 128
+	c.SessionRequests = 8
+	c.SessionQueue = 16
+	c.ClientSessions = 4
+	c.DownloadTTL = 60
+	c.PreviewTTL = 300
+	c.CommandTimeout = 3600
+	c.LUKSTimeout = 120
+	c.CipherTimeout = 3600
+	c.CommandMemory = 4096
+	c.PrivsepSocket = ""
+	c.PrivsepUser = ""
+	c.Confinement = "off"
+	c.ConfinementPaths = nil
+	c.Container = false
+	c.VolumePath = ""
+	c.Tenants = nil
+	c.UITitle = ""
+	c.UILogo = ""
+	c.UIFeatures = nil
+	c.MountOptions = []string{"nodev", "nosuid", "noexec"}
+	c.HoneytokenLock = false
+	c.FilenameMaxLength = 255
+	c.FilenameReserved = []string{"CON", "PRN", "AUX", "NUL",
+		"COM1", "COM2", "COM3", "COM4", "COM5", "COM6", "COM7", "COM8", "COM9",
+		"LPT1", "LPT2", "LPT3", "LPT4", "LPT5", "LPT6", "LPT7", "LPT8", "LPT9"}
+	c.FilenameCaseCollisions = "allow"
 	c.HSM = "off"
 	c.KeyPath = "keys"
 	c.Ciphers = []string{"OpenPGP", "AES-256-OFB", "TOTP"}
@@ -200,7 +513,7 @@ func (c *Config) SetDefaults() {
 }
 
 func (c *Config) SetMountPoint() error {
-	c.MountPoint = filepath.Join(os.Getenv("HOME"), mountPoint)
+	c.MountPoint = tenantMountPoint(os.Getenv("HOME"))
 
 	return os.MkdirAll(c.MountPoint, 0700)
 }
@@ -215,6 +528,7 @@ func (c *Config) Set(configPath string) (err error) {
 	}
 
 	err = json.Unmarshal(b, &c)
+	c.configPath = configPath
 
 	if debugFlag {
 		c.Debug = true
@@ -223,6 +537,19 @@ func (c *Config) Set(configPath string) (err error) {
 	return
 }
 
+// MarshalJSON redacts the push notification token from the configuration
+// dump.
+func (c *Config) MarshalJSON() ([]byte, error) {
+	type plain Config
+	p := plain(*c)
+
+	if p.PushToken != "" {
+		p.PushToken = "<redacted>"
+	}
+
+	return json.Marshal(p)
+}
+
 func (c *Config) Print() {
 	j, _ := json.MarshalIndent(c, "", "\t")
 
@@ -239,12 +566,6 @@ func timeRequest(r *http.Request) (res jsonObject) {
 
 	var epoch int64
 
-	err = validateRequest(req, []string{"epoch:n"})
-
-	if err != nil {
-		return errorResponse(err, "")
-	}
-
 	switch t := req["epoch"].(type) {
 	case json.Number:
 		epoch, err = t.Int64()
@@ -256,7 +577,8 @@ func timeRequest(r *http.Request) (res jsonObject) {
 		return errorResponse(err, "")
 	}
 
-	if conf.SetTime {
+	// NTP synchronized time prevails over the client one
+	if conf.SetTime && !ntp.Synced() {
 		err = setTime(epoch)
 
 		if err != nil {
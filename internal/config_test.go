@@ -0,0 +1,151 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestConfigPrint(t *testing.T) {
+	var buf bytes.Buffer
+
+	c := Config{}
+	c.SetDefaults()
+	c.PushToken = "push-secret-token"
+	c.Webhooks = []webhook{{URL: "https://example.com", Secret: "webhook-secret"}}
+
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	c.Print()
+
+	if out := buf.String(); strings.Contains(out, "push-secret-token") || strings.Contains(out, "webhook-secret") || !strings.Contains(out, `"push_token": "\u003credacted\u003e"`) {
+		t.Errorf("secrets not redacted:\n%s", out)
+	}
+
+	if c.PushToken != "push-secret-token" {
+		t.Error("configuration modified by redaction")
+	}
+}
+
+func TestCipherOptions(t *testing.T) {
+	ciphers := conf.Ciphers
+
+	defer func() {
+		conf.Ciphers = ciphers
+		conf.CipherOptions = nil
+		conf.EnableCiphers()
+	}()
+
+	conf.Ciphers = []string{"OpenPGP", "AES-256-OFB", "AES-256-OPENSSL", "TOTP"}
+	conf.CipherOptions = map[string]json.RawMessage{
+		"AES-256-OPENSSL": json.RawMessage(`{"iterations": 100000}`),
+		"TOTP":            json.RawMessage(`{"digits": 8, "period": 60}`),
+	}
+
+	if err := conf.EnableCiphers(); err != nil {
+		t.Fatal(err)
+	}
+
+	cipher, err := conf.GetAvailableCipher("AES-256-OPENSSL")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if iterations := cipher.(*aesCompat).options.Iterations; iterations != 100000 {
+		t.Errorf("options not applied to new instances: %d", iterations)
+	}
+
+	for name, options := range map[string]string{
+		"AES-256-OPENSSL": `{"iterations": 100000, "rounds": 1}`,
+		"AES-256-OFB":     `{"iterations": 100000}`,
+		"AES-256-GPG":     `{"iterations": 100000}`,
+		"TOTP":            `{"digits": 4}`,
+	} {
+		conf.CipherOptions = map[string]json.RawMessage{name: json.RawMessage(options)}
+
+		if err := conf.EnableCiphers(); err == nil {
+			t.Errorf("invalid %s options accepted: %s", name, options)
+		}
+	}
+}
+
+func TestSetEnv(t *testing.T) {
+	conf.SetDefaults()
+	defer conf.SetDefaults()
+
+	err := conf.SetEnv([]string{
+		"INTERLOCK_BIND_ADDRESS=127.0.0.1:4430",
+		"INTERLOCK_CONTAINER=true",
+		"INTERLOCK_WORKERS=4",
+		"INTERLOCK_CIPHERS=OpenPGP,TOTP",
+		`INTERLOCK_NTP_SERVERS=["pool.ntp.org"]`,
+		"INTERLOCK_TEST_MODE=true",
+		"HOME=/root",
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if conf.BindAddress != "127.0.0.1:4430" || !conf.Container || conf.Workers != 4 || conf.TestMode {
+		t.Errorf("environment not applied: %s %v %d %v", conf.BindAddress, conf.Container, conf.Workers, conf.TestMode)
+	}
+
+	if len(conf.Ciphers) != 2 || conf.Ciphers[1] != "TOTP" || len(conf.NTPServers) != 1 || conf.NTPServers[0] != "pool.ntp.org" {
+		t.Errorf("lists not applied: %v %v", conf.Ciphers, conf.NTPServers)
+	}
+
+	if err = conf.SetEnv([]string{"INTERLOCK_WORKERS=many"}); err == nil {
+		t.Error("invalid value accepted")
+	}
+}
+
+func TestTenants(t *testing.T) {
+	conf.SetDefaults()
+	defer func() {
+		conf.SetDefaults()
+		conf.tenant = ""
+	}()
+
+	conf.Tenants = map[string]json.RawMessage{
+		"alpha": json.RawMessage(`{"bind_address": "127.0.0.1:4430", "key_path": "keys-alpha"}`),
+		"beta":  json.RawMessage(`{"bind_address": "127.0.0.1:4431"}`),
+	}
+
+	if names, err := conf.tenantNames(); err != nil || len(names) != 2 || names[0] != "alpha" {
+		t.Errorf("unexpected tenants %v (%v)", names, err)
+	}
+
+	conf.Tenants["gamma"] = json.RawMessage(`{"bind_address": "127.0.0.1:4431"}`)
+
+	if _, err := conf.tenantNames(); err == nil {
+		t.Error("shared bind address accepted")
+	}
+
+	if err := conf.SetTenant("../alpha"); err == nil {
+		t.Error("invalid tenant accepted")
+	}
+
+	if err := conf.SetTenant("alpha"); err != nil {
+		t.Fatal(err)
+	}
+
+	if conf.KeyPath != "keys-alpha" || conf.CookieName != "INTERLOCK-Token-alpha" || conf.Tenants != nil {
+		t.Errorf("overrides not applied: %s %s", conf.KeyPath, conf.CookieName)
+	}
+
+	if volumeMapping() != "interlockfs-alpha" || tenantMountPoint("/home/interlock") != "/home/interlock/.interlock-mnt-alpha" {
+		t.Errorf("unexpected tenant paths %s %s", volumeMapping(), tenantMountPoint("/home/interlock"))
+	}
+}
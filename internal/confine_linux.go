@@ -0,0 +1,345 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// +build linux
+
+package interlock
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Self-confinement, with `confinement` set to "log" or "enforce" the server
+// installs, once initialized, a seccomp-bpf filter on the system calls it
+// never requires (module loading, tracing, namespaces, key management, ...).
+// Filtered calls are logged by the kernel (audit), in "log" mode they are
+// still allowed while in "enforce" mode they fail with EPERM.
+//
+// In "enforce" mode file system access is further restricted with Landlock,
+// when supported by the kernel, to the paths returned by confinementPaths.
+// Landlock has no logging facility, violations are reported as permission
+// errors by the failing operation.
+//
+// Confinement is inherited by executed commands and sets no_new_privs, which
+// prevents sudo from gaining privileges, therefore it requires the privileged
+// helper (`privsep_socket`).
+
+const (
+	confinementOff     = "off"
+	confinementLog     = "log"
+	confinementEnforce = "enforce"
+)
+
+const (
+	seccompSetModeFilter = 1
+	seccompFlagTSync     = 1
+	seccompFlagLog       = 2
+	seccompRetAllow      = 0x7fff0000
+	seccompRetLog        = 0x7ffc0000
+	seccompRetErrno      = 0x00050000
+)
+
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+	landlockRulePathBeneath  = 1
+)
+
+// Landlock file system access rights (ABI v1)
+const (
+	landlockExecute = 1 << iota
+	landlockWriteFile
+	landlockReadFile
+	landlockReadDir
+	landlockRemoveDir
+	landlockRemoveFile
+	landlockMakeChar
+	landlockMakeDir
+	landlockMakeReg
+	landlockMakeSock
+	landlockMakeFifo
+	landlockMakeBlock
+	landlockMakeSym
+
+	landlockHandled = 1<<iota - 1
+)
+
+const (
+	landlockRead  = landlockReadFile | landlockReadDir
+	landlockExec  = landlockRead | landlockExecute
+	landlockWrite = landlockHandled &^ (landlockMakeChar | landlockMakeBlock)
+	landlockFile  = landlockExecute | landlockWriteFile | landlockReadFile
+)
+
+// x32 system calls, on amd64, are flagged with this bit
+const syscallX32 = 0x40000000
+
+var auditArch = map[string]uint32{
+	"386":   0x40000003,
+	"amd64": 0xc000003e,
+	"arm":   0x40000028,
+	"arm64": 0xc00000b7,
+}
+
+var deniedSyscalls = []uintptr{
+	unix.SYS_ACCT,
+	unix.SYS_ADD_KEY,
+	unix.SYS_ADJTIMEX,
+	unix.SYS_BPF,
+	unix.SYS_CLOCK_ADJTIME,
+	unix.SYS_CLOCK_SETTIME,
+	unix.SYS_DELETE_MODULE,
+	unix.SYS_FANOTIFY_INIT,
+	unix.SYS_FINIT_MODULE,
+	unix.SYS_INIT_MODULE,
+	unix.SYS_KEXEC_LOAD,
+	unix.SYS_KEYCTL,
+	unix.SYS_LOOKUP_DCOOKIE,
+	unix.SYS_MOUNT,
+	unix.SYS_NAME_TO_HANDLE_AT,
+	unix.SYS_OPEN_BY_HANDLE_AT,
+	unix.SYS_PERF_EVENT_OPEN,
+	unix.SYS_PIVOT_ROOT,
+	unix.SYS_PROCESS_VM_READV,
+	unix.SYS_PROCESS_VM_WRITEV,
+	unix.SYS_PTRACE,
+	unix.SYS_QUOTACTL,
+	unix.SYS_REBOOT,
+	unix.SYS_REQUEST_KEY,
+	unix.SYS_SETDOMAINNAME,
+	unix.SYS_SETHOSTNAME,
+	unix.SYS_SETNS,
+	unix.SYS_SETTIMEOFDAY,
+	unix.SYS_SWAPOFF,
+	unix.SYS_SWAPON,
+	unix.SYS_SYSLOG,
+	unix.SYS_UMOUNT2,
+	unix.SYS_UNSHARE,
+	unix.SYS_USERFAULTFD,
+	unix.SYS_VHANGUP,
+}
+
+// seccompFilter returns a BPF program applying action to denied system calls
+// and to calls from foreign architectures.
+func seccompFilter(action uint32) (filter []unix.SockFilter, err error) {
+	arch, ok := auditArch[runtime.GOARCH]
+
+	if !ok {
+		return nil, fmt.Errorf("seccomp unsupported on %s", runtime.GOARCH)
+	}
+
+	ret := unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: action}
+
+	filter = []unix.SockFilter{
+		// seccomp_data.arch
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 4},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 1, K: arch},
+		ret,
+		// seccomp_data.nr
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 0},
+		{Code: unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K, Jf: 1, K: syscallX32},
+		ret,
+	}
+
+	for _, nr := range deniedSyscalls {
+		filter = append(filter, unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jf: 1, K: uint32(nr)}, ret)
+	}
+
+	filter = append(filter, unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: seccompRetAllow})
+
+	return
+}
+
+// installSeccomp applies the seccomp filter to all threads.
+func installSeccomp(action uint32) (err error) {
+	filter, err := seccompFilter(action)
+
+	if err != nil {
+		return
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	// no_new_privs is propagated to all threads by the synchronization
+	if err = unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return
+	}
+
+	prog := unix.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+
+	flags := seccompFlagTSync
+
+	if action != seccompRetLog {
+		flags |= seccompFlagLog
+	}
+
+	tid, _, e := syscall.RawSyscall(unix.SYS_SECCOMP, seccompSetModeFilter, uintptr(flags), uintptr(unsafe.Pointer(&prog)))
+
+	if e != 0 {
+		return fmt.Errorf("seccomp: %v", e)
+	}
+
+	if tid != 0 {
+		return fmt.Errorf("seccomp: thread %d could not be synchronized", tid)
+	}
+
+	return
+}
+
+// installLandlock restricts file system access, for all threads, to the
+// argument paths and access rights.
+func installLandlock(paths map[string]uint64) (err error) {
+	attr := struct{ handled uint64 }{landlockHandled}
+
+	ruleset, _, e := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+
+	if e != 0 {
+		return e
+	}
+	defer unix.Close(int(ruleset))
+
+	for path, access := range paths {
+		var stat unix.Stat_t
+
+		fd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+
+		if err == unix.ENOENT {
+			continue
+		}
+
+		if err != nil {
+			return fmt.Errorf("landlock: %s, %v", path, err)
+		}
+
+		if err = unix.Fstat(fd, &stat); err == nil && stat.Mode&unix.S_IFMT != unix.S_IFDIR {
+			access &= landlockFile
+		}
+
+		rule := struct {
+			access uint64
+			fd     int32
+		}{access, int32(fd)}
+
+		_, _, e = syscall.Syscall6(sysLandlockAddRule, ruleset, landlockRulePathBeneath, uintptr(unsafe.Pointer(&rule)), 0, 0, 0)
+		unix.Close(fd)
+
+		if e != 0 {
+			return fmt.Errorf("landlock: %s, %v", path, e)
+		}
+	}
+
+	// restrictions only apply to the calling thread
+	if _, _, e = syscall.AllThreadsSyscall(sysLandlockRestrictSelf, ruleset, 0, 0); e != 0 {
+		if e == syscall.ENOTSUP {
+			return errors.New("landlock: unsupported with cgo builds (CGO_ENABLED=0 required)")
+		}
+
+		return fmt.Errorf("landlock: %v", e)
+	}
+
+	return
+}
+
+// confinementPaths returns the paths, and their access rights, required by
+// the server and the commands it executes.
+func confinementPaths() (paths map[string]uint64) {
+	required := map[string]uint64{
+		"/bin":   landlockExec,
+		"/sbin":  landlockExec,
+		"/lib":   landlockExec,
+		"/lib64": landlockExec,
+		"/usr":   landlockExec,
+		"/etc":   landlockRead,
+		"/proc":  landlockRead,
+		"/dev":   landlockWrite,
+		"/sys":   landlockWrite,
+
+		os.Getenv("HOME"):                landlockWrite,
+		conf.MountPoint:                  landlockWrite,
+		conf.EscrowPath:                  landlockWrite,
+		filepath.Dir(deadmanStatePath()): landlockWrite,
+		conf.HeaderPath:                  landlockRead,
+		conf.StaticPath:                  landlockRead,
+		conf.LocalePath:                  landlockRead,
+	}
+
+	if conf.Measurements != "" {
+		required[filepath.Dir(conf.Measurements)] = landlockWrite
+	}
+
+	for _, p := range conf.ConfinementPaths {
+		required[p] = landlockWrite
+	}
+
+	paths = make(map[string]uint64)
+
+	for p, access := range required {
+		if p == "" {
+			continue
+		}
+
+		if abs, err := filepath.Abs(p); err == nil {
+			paths[abs] |= access
+		}
+	}
+
+	return
+}
+
+// confine applies the configured self-confinement, it must be invoked once
+// initialization is complete.
+func confine() (err error) {
+	var action uint32
+
+	switch conf.Confinement {
+	case confinementOff, "":
+		return
+	case confinementLog:
+		action = seccompRetLog
+	case confinementEnforce:
+		action = seccompRetErrno | uint32(syscall.EPERM)
+	default:
+		return fmt.Errorf("invalid confinement %q", conf.Confinement)
+	}
+
+	if conf.PrivsepSocket == "" {
+		return errors.New("confinement requires privsep_socket, as sudo cannot be used")
+	}
+
+	if err = installSeccomp(action); err != nil {
+		return
+	}
+
+	log.Printf("seccomp confinement enabled (%s)", conf.Confinement)
+
+	if conf.Confinement != confinementEnforce {
+		return
+	}
+
+	switch err = installLandlock(confinementPaths()); err {
+	case nil:
+		log.Printf("landlock confinement enabled")
+	case syscall.ENOSYS, syscall.EOPNOTSUPP:
+		log.Printf("landlock unavailable, file system confinement disabled")
+		err = nil
+	}
+
+	return
+}
@@ -0,0 +1,91 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// +build linux
+
+package interlock
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// confinedTest runs in a child process as confinement cannot be reverted.
+func confinedTest(t *testing.T) {
+	if err := installSeccomp(seccompRetErrno | uint32(syscall.EPERM)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := unix.Unshare(unix.CLONE_NEWUTS); err != unix.EPERM {
+		t.Errorf("denied system call allowed (%v)", err)
+	}
+
+	if _, err := ioutil.ReadFile("/proc/self/status"); err != nil {
+		t.Error(err)
+	}
+
+	dir := os.Getenv("INTERLOCK_TEST_CONFINED")
+
+	switch err := installLandlock(map[string]uint64{dir: landlockWrite}); {
+	case err == syscall.ENOSYS, err == syscall.EOPNOTSUPP:
+		t.Log("landlock unavailable")
+		return
+	case err != nil && strings.Contains(err.Error(), "cgo"):
+		t.Log(err)
+		return
+	case err != nil:
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "allowed"), nil, 0600); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := ioutil.ReadFile("/proc/self/status"); err == nil {
+		t.Error("access outside confinement paths allowed")
+	}
+}
+
+func TestConfinement(t *testing.T) {
+	if os.Getenv("INTERLOCK_TEST_CONFINED") != "" {
+		confinedTest(t)
+		return
+	}
+
+	conf.SetDefaults()
+	defer conf.SetDefaults()
+
+	conf.Confinement = confinementEnforce
+
+	if err := confine(); err == nil || !strings.Contains(err.Error(), "privsep_socket") {
+		t.Errorf("confinement without privileged helper accepted (%v)", err)
+	}
+
+	conf.Confinement = "strict"
+	conf.PrivsepSocket = "/run/interlock-privsep.sock"
+
+	if err := confine(); err == nil {
+		t.Error("invalid confinement accepted")
+	}
+
+	if filter, err := seccompFilter(seccompRetLog); err != nil || len(filter) != 2*len(deniedSyscalls)+7 {
+		t.Errorf("unexpected filter length %d (%v)", len(filter), err)
+	}
+
+	c := exec.Command(os.Args[0], "-test.run=^TestConfinement$", "-test.v")
+	c.Env = append(os.Environ(), "INTERLOCK_TEST_CONFINED="+t.TempDir())
+
+	if output, err := c.CombinedOutput(); err != nil {
+		t.Errorf("confined test failed: %v\n%s", err, output)
+	}
+}
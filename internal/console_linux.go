@@ -0,0 +1,186 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Serial console unlock, when the network is unavailable the volume can be
+// unlocked by entering its passphrase on a serial or USB CDC ACM console
+// (e.g. /dev/ttyGS0). Console logins open a regular session, subject to the
+// same single session policy as web logins, which lasts until the logout
+// command is entered or the session expires.
+
+const consoleRetry = 10 * time.Second
+
+func startConsole() (err error) {
+	if conf.Console == "" {
+		return
+	}
+
+	tty, err := os.OpenFile(conf.Console, os.O_RDWR|unix.O_NOCTTY, 0)
+
+	if err != nil {
+		return fmt.Errorf("cannot open console %s: %v", conf.Console, err)
+	}
+
+	log.Printf("starting console on %s", conf.Console)
+
+	go func() {
+		defer tty.Close()
+
+		reader := bufio.NewReader(tty)
+
+		for {
+			e := consoleLoop(tty, reader)
+
+			if e == io.EOF {
+				// no terminal attached
+				time.Sleep(consoleRetry)
+				continue
+			}
+
+			if e != nil {
+				log.Printf("console error: %v", e)
+				time.Sleep(consoleRetry)
+			}
+		}
+	}()
+
+	return
+}
+
+// networkAvailable returns true when any non-loopback interface is up and
+// configured.
+func networkAvailable() bool {
+	ifaces, err := net.Interfaces()
+
+	if err != nil {
+		return false
+	}
+
+	for _, i := range ifaces {
+		if i.Flags&net.FlagUp == 0 || i.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		if addrs, err := i.Addrs(); err == nil && len(addrs) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// consoleEcho toggles terminal echo, to be disabled on passphrase entry.
+func consoleEcho(tty *os.File, echo bool) (err error) {
+	termios, err := unix.IoctlGetTermios(int(tty.Fd()), unix.TCGETS)
+
+	if err != nil {
+		return
+	}
+
+	if echo {
+		termios.Lflag |= unix.ECHO
+	} else {
+		termios.Lflag &^= unix.ECHO
+	}
+
+	return unix.IoctlSetTermios(int(tty.Fd()), unix.TCSETS, termios)
+}
+
+func consoleLoop(tty *os.File, reader *bufio.Reader) (err error) {
+	prompt := func(p string) (line string, err error) {
+		if _, err = fmt.Fprint(tty, p); err != nil {
+			return
+		}
+
+		line, err = reader.ReadString('\n')
+
+		return strings.TrimRight(line, "\r\n"), err
+	}
+
+	if session.Active() {
+		var line string
+
+		if line, err = prompt("\r\nINTERLOCK session active, type 'logout' to lock the volume: "); err != nil {
+			return
+		}
+
+		if line == "logout" {
+			fmt.Fprint(tty, "\r\nlocking volume... ")
+			err = closeSession()
+
+			if err != nil {
+				fmt.Fprintf(tty, "%v\r\n", err)
+				return
+			}
+
+			fmt.Fprint(tty, "done\r\n")
+		}
+
+		return
+	}
+
+	if networkAvailable() {
+		// the web interface is expected to be used
+		_, err = prompt("\r\nINTERLOCK network available, use the web interface (press enter to retry) ")
+		return
+	}
+
+	volume, err := prompt("\r\nINTERLOCK volume: ")
+
+	if err != nil || volume == "" {
+		return
+	}
+
+	if err = consoleEcho(tty, false); err != nil {
+		return
+	}
+
+	password, err := prompt("passphrase: ")
+	consoleEcho(tty, true)
+
+	if err != nil {
+		return
+	}
+
+	fmt.Fprint(tty, "\r\nunlocking... ")
+
+	if session.Active() {
+		fmt.Fprint(tty, "existing session\r\n")
+		return
+	}
+
+	err = authenticate(context.Background(), volume, password, false)
+
+	if err != nil {
+		loginFailed(volume, "console", "")
+		fmt.Fprintf(tty, "%v\r\n", err)
+		return nil
+	}
+
+	if _, _, err = startSession(volume, "console"); err != nil {
+		fmt.Fprintf(tty, "%v\r\n", err)
+		return nil
+	}
+
+	fmt.Fprint(tty, "done\r\n")
+
+	return
+}
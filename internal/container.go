@@ -0,0 +1,121 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// Container mode, with `container` set the server can be executed within
+// OCI containers:
+//
+//   * running as root is allowed, privileged commands are executed directly
+//   * logs are written to standard output rather than syslog
+//   * poweroff terminates the server, leaving restarts to the runtime
+//   * the RTC is not accessed
+//   * unauthenticated /healthz (liveness) and /readyz (readiness) endpoints
+//     are served for orchestration probes
+//
+// Combined with `volume_path`, volumes are LUKS image files (<name>.img),
+// attached by cryptsetup to loop devices, instead of logical volumes so that
+// no block device needs to be provisioned for the container.
+//
+// Any configuration option can be set, overriding the configuration file, with
+// an INTERLOCK_<OPTION> environment variable (e.g. INTERLOCK_BIND_ADDRESS),
+// values are parsed as JSON, string and string list options also accept
+// plain (comma separated) values.
+
+const envPrefix = "INTERLOCK_"
+
+// SetEnv applies configuration options from the argument environment.
+func (c *Config) SetEnv(environ []string) (err error) {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	options := make(map[string]reflect.Value)
+
+	for i := 0; i < t.NumField(); i++ {
+		if tag := t.Field(i).Tag.Get("json"); tag != "" && tag != "-" {
+			options[envPrefix+strings.ToUpper(tag)] = v.Field(i)
+		}
+	}
+
+	for _, env := range environ {
+		kv := strings.SplitN(env, "=", 2)
+
+		if len(kv) != 2 {
+			continue
+		}
+
+		field, ok := options[kv[0]]
+
+		if !ok {
+			continue
+		}
+
+		if json.Unmarshal([]byte(kv[1]), field.Addr().Interface()) == nil {
+			continue
+		}
+
+		switch {
+		case field.Kind() == reflect.String:
+			field.SetString(kv[1])
+		case field.Type() == reflect.TypeOf([]string{}):
+			field.Set(reflect.ValueOf(strings.Split(kv[1], ",")))
+		default:
+			return fmt.Errorf("invalid %s value", kv[0])
+		}
+	}
+
+	return
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	if !conf.Container || r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// a deadlocked session manager would not answer
+	session.Active()
+
+	sendResponse(w, jsonObject{"status": "OK", "response": nil})
+}
+
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	var warnings []string
+
+	if !conf.Container || r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if s := watchdog.Status(); s != nil {
+		warnings, _ = s["warnings"].([]string)
+	}
+
+	if conf.VolumePath != "" {
+		if fi, err := os.Stat(conf.VolumePath); err != nil || !fi.IsDir() {
+			warnings = append(warnings, "volume_path unavailable")
+		}
+	}
+
+	if len(warnings) > 0 {
+		writeResponse(w, http.StatusServiceUnavailable, jsonObject{"status": "KO", "response": warnings})
+		return
+	}
+
+	sendResponse(w, jsonObject{"status": "OK", "response": nil})
+}
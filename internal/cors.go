@@ -0,0 +1,84 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Cross-Origin Resource Sharing, API requests are same-origin only unless
+// origins are listed in `cors_origins`, allowing separately hosted or packaged
+// clients to reach the API directly.
+
+// request headers accepted from cross-origin clients, all custom headers read
+// by API methods must be listed
+var corsHeaders = []string{
+	"Content-Type", "Accept", "Accept-Language", XSRFHeader, XSRFNonceHeader,
+	"X-Uploadfilename", "X-Forceoverwrite", "X-Uploadmode", "X-Uploadmtime",
+	"X-Uploadsize", "X-Uploadid", "X-Chunkoffset", "X-Locktoken", "X-Volume",
+}
+
+// response headers exposed to cross-origin clients
+var corsExposedHeaders = []string{XSRFHeader, "Content-Disposition"}
+
+// corsAllowed returns whether the argument origin is allowed, the "*"
+// wildcard is not honoured for credentialed requests.
+func corsAllowed(origin string) bool {
+	for _, o := range conf.CORSOrigins {
+		if o == origin || (o == "*" && !conf.CORSCredentials) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func corsHandler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+
+		if origin == "" || len(conf.CORSOrigins) == 0 {
+			h(w, r)
+			return
+		}
+
+		allowed := corsAllowed(origin)
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		w.Header().Add("Vary", "Origin")
+
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+
+			if conf.CORSCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+
+		if !preflight {
+			h(w, r)
+			return
+		}
+
+		if !allowed {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(corsHeaders, ", "))
+
+		if conf.CORSMaxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(conf.CORSMaxAge))
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
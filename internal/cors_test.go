@@ -0,0 +1,83 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	defer conf.SetDefaults()
+
+	var called bool
+
+	h := corsHandler(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+
+	request := func(method string, origin string) *httptest.ResponseRecorder {
+		called = false
+
+		r := httptest.NewRequest(method, "/api/status/version", nil)
+		r.Header.Set("Origin", origin)
+
+		if method == http.MethodOptions {
+			r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			r.Header.Set("Access-Control-Request-Headers", "x-uploadfilename")
+		}
+
+		w := httptest.NewRecorder()
+		h(w, r)
+
+		return w
+	}
+
+	// same-origin only by default
+	if w := request(http.MethodPost, "https://example.com"); !called || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("CORS headers set by default: %v", w.Header())
+	}
+
+	conf.CORSOrigins = []string{"https://example.com"}
+	conf.CORSCredentials = true
+
+	w := request(http.MethodOptions, "https://example.com")
+
+	if called || w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "https://example.com" ||
+		w.Header().Get("Access-Control-Allow-Credentials") != "true" || w.Header().Get("Access-Control-Max-Age") != "600" {
+		t.Errorf("unexpected preflight response: %d %v", w.Code, w.Header())
+	}
+
+	for _, header := range []string{"X-Uploadfilename", "X-Uploadid", "X-Chunkoffset", "X-Locktoken", "X-Volume"} {
+		if !strings.Contains(w.Header().Get("Access-Control-Allow-Headers"), header) {
+			t.Errorf("%s not allowed: %v", header, w.Header())
+		}
+	}
+
+	if w = request(http.MethodOptions, "https://attacker.com"); called || w.Code != http.StatusForbidden {
+		t.Errorf("preflight from disallowed origin accepted: %d", w.Code)
+	}
+
+	if w = request(http.MethodPost, "https://example.com"); !called || w.Header().Get("Access-Control-Expose-Headers") != XSRFHeader+", Content-Disposition" {
+		t.Errorf("unexpected response headers: %v", w.Header())
+	}
+
+	// wildcard is ignored for credentialed requests
+	conf.CORSOrigins = []string{"*"}
+
+	if w = request(http.MethodOptions, "https://example.com"); w.Code != http.StatusForbidden {
+		t.Errorf("wildcard origin accepted with credentials: %d", w.Code)
+	}
+
+	conf.CORSCredentials = false
+
+	if w = request(http.MethodOptions, "https://example.com"); w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("unexpected wildcard preflight response: %d %v", w.Code, w.Header())
+	}
+}
@@ -7,6 +7,7 @@
 package interlock
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/json"
@@ -19,6 +20,7 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/pbkdf2"
 )
@@ -31,6 +33,7 @@ type key struct {
 	Cipher     string `json:"cipher"`
 	Private    bool   `json:"private"`
 	Path       string `json:"path"`
+	Revoked    int64  `json:"revoked"`
 }
 
 type cipherInfo struct {
@@ -76,6 +79,37 @@ type cipherInterface interface {
 	HandleRequest(*http.Request) jsonObject
 }
 
+// cipherConfigurable is implemented by ciphers accepting options from the
+// "cipher_options" configuration section, nil options select the defaults.
+type cipherConfigurable interface {
+	Configure(options json.RawMessage) error
+}
+
+// cipherRewrapper is implemented by envelope ciphers able to re-encrypt the
+// data key of an encrypted file, with the secret key, to the public key
+// without decrypting the data.
+type cipherRewrapper interface {
+	Rewrap(src *os.File, dst *os.File) error
+}
+
+// cipherKeyEncryption is implemented by ciphers whose stored secret keys can
+// be protected by a password.
+type cipherKeyEncryption interface {
+	KeyEncrypted(k key) (bool, error)
+}
+
+// parseCipherOptions decodes cipher options rejecting unknown attributes.
+func parseCipherOptions(options json.RawMessage, v interface{}) (err error) {
+	if len(options) == 0 {
+		return
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(options))
+	dec.DisallowUnknownFields()
+
+	return dec.Decode(v)
+}
+
 type HSMInterface interface {
 	// return a fresh HSM instance
 	New() HSMInterface
@@ -114,13 +148,13 @@ func (k *key) Store(cipher cipherInterface, data string) (err error) {
 	k.Path = filepath.Join(conf.KeyPath, cipher.GetInfo().Extension, subdir, fileName)
 	keyPath := filepath.Join(conf.MountPoint, k.Path)
 
-	err = os.MkdirAll(path.Dir(keyPath), 0700)
+	err = volumeJail().MkdirAll(path.Dir(keyPath), 0700)
 
 	if err != nil {
 		return
 	}
 
-	output, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_TRUNC, 0600)
+	output, err := volumeJail().OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_TRUNC, 0600)
 
 	if err != nil {
 		return
@@ -145,30 +179,40 @@ func keyInfo(r *http.Request) (res jsonObject) {
 		return errorResponse(err, "")
 	}
 
-	err = validateRequest(req, []string{"path:s"})
+	path, err := absolutePath(req["path"].(string))
 
 	if err != nil {
 		return errorResponse(err, "")
 	}
 
-	path, err := absolutePath(req["path"].(string))
+	key, cipher, err := getKey(path)
 
 	if err != nil {
 		return errorResponse(err, "")
 	}
 
-	key, cipher, err := getKey(path)
+	info, err := cipher.GetKeyInfo(key)
 
 	if err != nil {
 		return errorResponse(err, "")
 	}
 
-	info, err := cipher.GetKeyInfo(key)
+	if cipher.GetInfo().OTP {
+		recordKeyUsage(key, keyUsageOTP, "")
+	}
+
+	usage, err := keyUsageInfo(key)
 
 	if err != nil {
 		return errorResponse(err, "")
 	}
 
+	if key.Revoked != 0 {
+		info += fmt.Sprintf("Revoked: %s\n", time.Unix(key.Revoked, 0).UTC().Format(time.RFC3339))
+	}
+
+	info += "\n" + usage
+
 	res = jsonObject{
 		"status":   "OK",
 		"response": info,
@@ -180,7 +224,7 @@ func keyInfo(r *http.Request) (res jsonObject) {
 func getKey(path string) (k key, cipher cipherInterface, err error) {
 	var private bool
 
-	fileInfo, err := os.Stat(path)
+	fileInfo, err := volumeJail().Stat(path)
 
 	if err != nil {
 		return
@@ -239,6 +283,7 @@ func getKey(path string) (k key, cipher cipherInterface, err error) {
 		Cipher:     cipher.GetInfo().Name,
 		Private:    private,
 		Path:       relativePath,
+		Revoked:    revocations.Revoked(keyPairID(cipherExt, identifier)),
 	}
 
 	return
@@ -291,7 +336,7 @@ func getKeys(cipher cipherInterface, private bool, filter string) (keys []key, e
 		return
 	}
 
-	err = filepath.Walk(basePath, walkFn)
+	err = volumeJail().Walk(basePath, walkFn)
 
 	return
 }
@@ -306,12 +351,6 @@ func keys(r *http.Request) (res jsonObject) {
 		return errorResponse(err, "")
 	}
 
-	err = validateRequest(req, []string{"public:b", "private:b"})
-
-	if err != nil {
-		return errorResponse(err, "")
-	}
-
 	if f, ok := req["filter"]; ok {
 		filter = f.(string)
 	}
@@ -357,12 +396,6 @@ func genKey(r *http.Request) (res jsonObject) {
 		return errorResponse(err, "")
 	}
 
-	err = validateRequest(req, []string{"identifier:s", "key_format:s", "cipher:s", "email:s"})
-
-	if err != nil {
-		return errorResponse(err, "")
-	}
-
 	identifier := req["identifier"].(string)
 	email := req["email"].(string)
 	cipherName := req["cipher"].(string)
@@ -373,7 +406,14 @@ func genKey(r *http.Request) (res jsonObject) {
 		return errorResponse(errors.New("could not identify compatible key cipher"), "")
 	}
 
-	go func() {
+	// ciphers with password protected key shares
+	if password, ok := req["password"].(string); ok && password != "" {
+		if err = cipher.SetPassword(password); err != nil {
+			return errorResponse(err, "")
+		}
+	}
+
+	jobs.Go(jobOwner(r), "generating key", func() {
 		n := status.Notify(syslog.LOG_INFO, "generating %s keypair %s", cipher.GetInfo().Name, identifier)
 		defer status.Remove(n)
 
@@ -412,8 +452,14 @@ func genKey(r *http.Request) (res jsonObject) {
 			return
 		}
 
+		err = storeRevocation(cipher, secKey, sec)
+
+		if err != nil {
+			status.Error(err)
+		}
+
 		status.Log(syslog.LOG_NOTICE, "generated %s keypair %s", cipher.GetInfo().Name, identifier)
-	}()
+	})
 
 	res = jsonObject{
 		"status":   "OK",
@@ -430,12 +476,6 @@ func uploadKey(r *http.Request) (res jsonObject) {
 		return errorResponse(err, "")
 	}
 
-	err = validateRequest(req, []string{"key:i", "data:s"})
-
-	if err != nil {
-		return errorResponse(err, "")
-	}
-
 	k := key{}
 
 	// we re-marsahal and unmarshal to avoid having to assign struct
@@ -490,3 +530,10 @@ func deriveKeyPBKDF2(salt []byte, password string, size int) (randSalt []byte, k
 
 	return
 }
+
+// zero overwrites key material once no longer required.
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,157 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"encoding/json"
+	"io"
+	"log/syslog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const defaultCSP = "default-src https:; script-src https: 'self' 'unsafe-eval' 'unsafe-inline'; style-src https: 'self' 'unsafe-inline'; img-src https: 'self'; connect-src https: 'self';"
+
+const cspReportURI = "/api/csp-report"
+
+// maximum accepted size for a single violation report
+const cspReportSize = 8 * 1024
+
+// maximum logged length for each violation report field
+const cspFieldSize = 256
+
+// Violation reports are accepted without authentication, the number of
+// logged reports is limited for each client address and overall in every
+// interval to prevent flooding of the application logs.
+const (
+	cspReportInterval  = time.Minute
+	cspReportsByClient = 10
+	cspReportsTotal    = 60
+)
+
+type cspLimiter struct {
+	sync.Mutex
+	start   time.Time
+	total   int
+	clients map[string]int
+	dropped int
+}
+
+var cspReports cspLimiter
+
+// Allow reports whether a violation report from the argument client address
+// can be logged in the current interval.
+func (l *cspLimiter) Allow(client string) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.clients == nil || time.Since(l.start) >= cspReportInterval {
+		if l.dropped > 0 {
+			status.Log(syslog.LOG_WARNING, "%d CSP violation reports dropped", l.dropped)
+		}
+
+		l.start = time.Now()
+		l.total = 0
+		l.clients = make(map[string]int)
+		l.dropped = 0
+	}
+
+	if l.total >= cspReportsTotal || l.clients[client] >= cspReportsByClient {
+		l.dropped++
+		return false
+	}
+
+	l.total++
+	l.clients[client]++
+
+	return true
+}
+
+// cspField strips control characters from report fields supplied by the
+// client, truncating them to cspFieldSize characters.
+func cspField(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == unicode.ReplacementChar {
+			return -1
+		}
+
+		return r
+	}, s)
+
+	if r := []rune(s); len(r) > cspFieldSize {
+		s = string(r[:cspFieldSize]) + "..."
+	}
+
+	return s
+}
+
+type cspViolation struct {
+	DocumentURI        string `json:"document-uri"`
+	BlockedURI         string `json:"blocked-uri"`
+	ViolatedDirective  string `json:"violated-directive"`
+	EffectiveDirective string `json:"effective-directive"`
+	SourceFile         string `json:"source-file"`
+	LineNumber         int    `json:"line-number"`
+}
+
+func contentSecurityPolicy() (csp string) {
+	csp = conf.CSP
+
+	if csp == "" {
+		csp = defaultCSP
+	}
+
+	if conf.CSPReport && !strings.Contains(csp, "report-uri") {
+		csp = strings.TrimSpace(csp)
+
+		if !strings.HasSuffix(csp, ";") {
+			csp += ";"
+		}
+
+		csp += " report-uri " + cspReportURI + ";"
+	}
+
+	return
+}
+
+func cspReport(w http.ResponseWriter, r *http.Request) {
+	var report struct {
+		Violation cspViolation `json:"csp-report"`
+	}
+
+	if !conf.CSPReport || r.Method != http.MethodPost {
+		sendResponse(w, notFound())
+		return
+	}
+
+	err := json.NewDecoder(io.LimitReader(r.Body, cspReportSize)).Decode(&report)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !cspReports.Allow(clientAddress(r)) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+
+	v := report.Violation
+
+	directive := v.EffectiveDirective
+
+	if directive == "" {
+		directive = v.ViolatedDirective
+	}
+
+	status.Log(syslog.LOG_WARNING, "CSP violation from %s: %s blocked by %s (%s:%d)", r.RemoteAddr, cspField(v.BlockedURI), cspField(directive), cspField(v.SourceFile), v.LineNumber)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,60 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCSPReport(t *testing.T) {
+	c := newTestServer(t)
+
+	conf.CSPReport = true
+	defer func() { conf.CSPReport = false }()
+
+	cspReports = cspLimiter{}
+
+	report := []byte(`{"csp-report": {"blocked-uri": "https://evil\n` + strings.Repeat("A", 1024) + `", "effective-directive": "script-src"}}`)
+
+	res := c.request("POST", "/api/csp-report", nil, report)
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("report not accepted (%d)", res.StatusCode)
+	}
+
+	found := false
+
+	for _, e := range status.Logs() {
+		if !strings.HasPrefix(e.Message, "CSP violation from ") {
+			continue
+		}
+
+		found = true
+
+		if !strings.Contains(e.Message, "https://evilAAA") || strings.Count(e.Message, "A") > cspFieldSize {
+			t.Errorf("report fields not sanitized: %q", e.Message)
+		}
+	}
+
+	if !found {
+		t.Error("report not logged")
+	}
+
+	for i := 1; i < cspReportsByClient; i++ {
+		res = c.request("POST", "/api/csp-report", nil, report)
+		res.Body.Close()
+	}
+
+	if res = c.request("POST", "/api/csp-report", nil, report); res.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("reports not throttled (%d)", res.StatusCode)
+	}
+
+	res.Body.Close()
+}
@@ -0,0 +1,341 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/syslog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Dead man's switch, when no successful login occurs within the configured
+// period the configured action is performed. The period is counted as
+// uptime accumulated, on the monotonic clock, since the last login rather
+// than as a wall-clock deadline: devices without RTC boot with an invalid
+// time and its later correction, or any other clock jump, must not trigger
+// irreversible actions. The state is kept on the unencrypted partition as it
+// must be available while the volume is locked.
+
+const (
+	deadmanNotify  = "notify"
+	deadmanWipe    = "wipe_keyslots"
+	deadmanDestroy = "destroy"
+)
+
+const deadmanState = ".interlock-deadman"
+
+// accumulated uptime persistence interval, limiting writes to the state file
+const deadmanSaveInterval = 10 * time.Minute
+
+type deadmanSwitch struct {
+	sync.Mutex
+	// last login time, not recorded while the device clock is invalid
+	LastLogin int64 `json:"last_login"`
+	// uptime accumulated since the last login
+	Uptime    time.Duration `json:"uptime"`
+	Triggered int64         `json:"triggered"`
+
+	saved time.Duration
+}
+
+var deadman deadmanSwitch
+
+func deadmanStatePath() string {
+	if conf.DeadmanState != "" {
+		return conf.DeadmanState
+	}
+
+	return filepath.Join(os.Getenv("HOME"), deadmanState)
+}
+
+func startDeadman() (err error) {
+	if conf.DeadmanPeriod <= 0 {
+		return
+	}
+
+	switch conf.DeadmanAction {
+	case deadmanNotify, deadmanWipe, deadmanDestroy:
+	default:
+		return fmt.Errorf("invalid deadman_action %s", conf.DeadmanAction)
+	}
+
+	err = deadman.load()
+
+	if err != nil {
+		return
+	}
+
+	status.Log(syslog.LOG_NOTICE, "dead man's switch armed, %s due after %v of uptime", conf.DeadmanAction, deadman.Remaining())
+
+	interval := time.Minute
+
+	if period := time.Duration(conf.DeadmanPeriod) * time.Second; period < interval {
+		interval = period
+	}
+
+	go func() {
+		defer recoverJob("dead man's switch")
+
+		// time.Now() carries a monotonic reading, unaffected by clock
+		// changes, which is used by Sub
+		last := time.Now()
+		deadman.check(0)
+
+		for {
+			time.Sleep(interval)
+
+			now := time.Now()
+			deadman.check(now.Sub(last))
+			last = now
+		}
+	}()
+
+	return
+}
+
+// load reads the state file, starting the countdown when absent.
+func (d *deadmanSwitch) load() (err error) {
+	d.Lock()
+	defer d.Unlock()
+
+	buf, err := ioutil.ReadFile(deadmanStatePath())
+
+	if os.IsNotExist(err) {
+		d.restart()
+		return d.save()
+	}
+
+	if err != nil {
+		return
+	}
+
+	if err = json.Unmarshal(buf, d); err != nil {
+		return
+	}
+
+	d.saved = d.Uptime
+
+	return
+}
+
+// restart resets the countdown, the login time is only recorded when the
+// device clock is plausible.
+func (d *deadmanSwitch) restart() {
+	d.LastLogin = 0
+
+	if !clock.Invalid() {
+		d.LastLogin = time.Now().Unix()
+	}
+
+	d.Uptime = 0
+	d.Triggered = 0
+	d.saved = 0
+}
+
+func (d *deadmanSwitch) save() (err error) {
+	d.saved = d.Uptime
+	buf, err := json.Marshal(d)
+
+	if err != nil {
+		return
+	}
+
+	path := deadmanStatePath()
+	tmp := path + ".tmp"
+
+	err = ioutil.WriteFile(tmp, buf, 0600)
+
+	if err != nil {
+		return
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// Reset restarts the countdown, invoked on every successful login.
+func (d *deadmanSwitch) Reset() {
+	if conf.DeadmanPeriod <= 0 {
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	d.restart()
+
+	if err := d.save(); err != nil {
+		status.Error(err)
+	}
+}
+
+// Remaining returns the uptime left before the action is performed.
+func (d *deadmanSwitch) Remaining() (remaining time.Duration) {
+	remaining = time.Duration(conf.DeadmanPeriod)*time.Second - d.Uptime
+
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	return
+}
+
+// check accumulates the argument uptime and performs the configured action
+// once the period is elapsed, returns true if the action has been triggered.
+func (d *deadmanSwitch) check(elapsed time.Duration) (triggered bool) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.Triggered != 0 {
+		return
+	}
+
+	d.Uptime += elapsed
+
+	if d.Remaining() > 0 {
+		if d.Uptime-d.saved >= deadmanSaveInterval {
+			reportError("dead man's switch state", d.save())
+		}
+
+		return
+	}
+
+	status.Log(syslog.LOG_ALERT, "dead man's switch triggered, no login within %v of uptime", d.Uptime.Round(time.Second))
+
+	if err := deadmanAction(); err != nil {
+		status.Error(err)
+	}
+
+	emitEvent(eventWipe, map[string]interface{}{
+		"action":     conf.DeadmanAction,
+		"last_login": d.LastLogin,
+	})
+
+	d.Triggered = time.Now().Unix()
+
+	if err := d.save(); err != nil {
+		status.Error(err)
+	}
+
+	return true
+}
+
+func (d *deadmanSwitch) Status() map[string]interface{} {
+	if conf.DeadmanPeriod <= 0 {
+		return nil
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	remaining := d.Remaining()
+
+	return map[string]interface{}{
+		"action":    conf.DeadmanAction,
+		"deadline":  time.Now().Add(remaining).Unix(),
+		"remaining": int64(remaining.Seconds()),
+		"uptime":    int64(d.Uptime.Seconds()),
+		"triggered": d.Triggered,
+	}
+}
+
+func deadmanAction() (err error) {
+	switch conf.DeadmanAction {
+	case deadmanNotify:
+		status.Notify(syslog.LOG_ALERT, "dead man's switch: no login within %d seconds", conf.DeadmanPeriod)
+	case deadmanWipe:
+		for _, slot := range conf.DeadmanKeyslots {
+			e := wipeKeyslot(conf.DeadmanVolume, slot)
+
+			if e != nil {
+				err = e
+				status.Error(e)
+			}
+		}
+	case deadmanDestroy:
+		for _, path := range conf.DeadmanPaths {
+			e := destroyPath(path)
+
+			if e != nil {
+				err = e
+				status.Error(e)
+			}
+		}
+	}
+
+	return
+}
+
+func wipeKeyslot(volume string, slot int) (err error) {
+	if volume == "" || strings.Contains(volume, traversalPattern) {
+		return errors.New("invalid deadman_volume")
+	}
+
+	device, cleanup, err := luksDevice(volume)
+
+	if err != nil {
+		return
+	}
+	defer cleanup()
+
+	args := append(append([]string{"-q", "luksKillSlot"}, device...), fmt.Sprintf("%d", slot))
+	cmd := "/sbin/cryptsetup"
+
+	status.Log(syslog.LOG_ALERT, "wiping LUKS keyslot %d on %s", slot, volume)
+
+	_, err = execCommand(cmd, args, "")
+
+	return
+}
+
+// destroyPath overwrites regular files before removing the path.
+func destroyPath(path string) (err error) {
+	if !filepath.IsAbs(path) || filepath.Clean(path) == "/" {
+		return fmt.Errorf("invalid deadman path %s", path)
+	}
+
+	status.Log(syslog.LOG_ALERT, "destroying %s", path)
+
+	err = filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		f, err := os.OpenFile(p, os.O_WRONLY, 0)
+
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		zero := make([]byte, 32*1024)
+
+		for n := info.Size(); n > 0; n -= int64(len(zero)) {
+			if n < int64(len(zero)) {
+				zero = zero[:n]
+			}
+
+			if _, err = f.Write(zero); err != nil {
+				return err
+			}
+		}
+
+		return f.Sync()
+	})
+
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+
+	return os.RemoveAll(path)
+}
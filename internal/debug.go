@@ -0,0 +1,69 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+func init() {
+	expvar.Publish("watchdog", expvar.Func(func() interface{} {
+		return watchdog.Status()
+	}))
+}
+
+// startDebugServer exposes profiling (net/http/pprof) and runtime variables
+// (expvar) on a dedicated listener, restricted to loopback addresses to
+// require local (or forwarded) access to the device.
+func startDebugServer() (err error) {
+	if conf.DebugAddress == "" {
+		return
+	}
+
+	host, _, err := net.SplitHostPort(conf.DebugAddress)
+
+	if err != nil {
+		return
+	}
+
+	ip := net.ParseIP(host)
+
+	if host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("debug address %s is not a loopback address", conf.DebugAddress)
+	}
+
+	debugMux := http.NewServeMux()
+
+	debugMux.HandleFunc("/debug/pprof/", pprof.Index)
+	debugMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	debugMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	debugMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	debugMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	debugMux.Handle("/debug/vars", expvar.Handler())
+
+	srv := &http.Server{
+		Addr:    conf.DebugAddress,
+		Handler: debugMux,
+	}
+
+	log.Printf("starting debug HTTP server on %s", conf.DebugAddress)
+
+	go func() {
+		err := srv.ListenAndServe()
+
+		if err != nil {
+			log.Printf("debug HTTP server error: %v", err)
+		}
+	}()
+
+	return
+}
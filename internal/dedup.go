@@ -0,0 +1,295 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"log/syslog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Content-addressed upload deduplication, uploaded files matching the
+// BLAKE3 hash of an existing file share its data: as a copy-on-write clone
+// on file systems supporting reflinks, otherwise as a hard link to it.
+//
+// Hard links share the inode, and therefore mode, timestamps and extended
+// attributes, they are not used for uploads specifying their own metadata.
+//
+// File hashes are kept in a persistent per-volume index, entries are reused
+// as long as the file size and modification time are unchanged, so that only
+// new or modified files are hashed when the index is built.
+type dedupIndex struct {
+	sync.Mutex
+	paths map[string]string
+	files map[string]dedupEntry
+	saved int64
+}
+
+type dedupEntry struct {
+	Size  int64  `json:"size"`
+	Mtime int64  `json:"mtime"`
+	Hash  string `json:"blake3"`
+}
+
+var dedup dedupIndex
+
+const dedupIndexFile = ".interlock-dedup.json"
+
+// fileHash returns the hash of a file, files outside of the encrypted volume
+// (e.g. the measured executable) are opened without jail.
+func fileHash(p string, newHash func() hash.Hash) (sum string, err error) {
+	open := os.Open
+
+	if j := volumeJail(); j.Contains(p) {
+		open = j.Open
+	}
+
+	f, err := open(p)
+
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	h := newHash()
+
+	if _, err = io.Copy(h, f); err != nil {
+		return
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func dedupIndexPath() string {
+	return filepath.Join(conf.MountPoint, dedupIndexFile)
+}
+
+// hash returns the BLAKE3 hash of a file, from the persistent index when its
+// size and modification time are unchanged.
+func (d *dedupIndex) hash(p string, info os.FileInfo) (sum string, err error) {
+	if e, ok := d.files[p]; ok && e.Size == info.Size() && e.Mtime == info.ModTime().UnixNano() {
+		return e.Hash, nil
+	}
+
+	if sum, err = fileHash(p, newBLAKE3); err != nil {
+		return
+	}
+
+	d.files[p] = dedupEntry{
+		Size:  info.Size(),
+		Mtime: info.ModTime().UnixNano(),
+		Hash:  sum,
+	}
+
+	return
+}
+
+// build indexes all regular files on the encrypted volume, excluding key
+// storage, it must be called with the index locked.
+func (d *dedupIndex) build() {
+	d.paths = make(map[string]string)
+	d.files = make(map[string]dedupEntry)
+
+	n := status.Notify(syslog.LOG_INFO, "indexing volume for deduplication")
+	defer status.Remove(n)
+
+	var files map[string]dedupEntry
+
+	if buf, err := volumeJail().ReadFile(dedupIndexPath()); err == nil && json.Unmarshal(buf, &files) == nil {
+		for rel, e := range files {
+			d.files[filepath.Join(conf.MountPoint, rel)] = e
+		}
+	}
+
+	indexed := make(map[string]dedupEntry)
+
+	volumeJail().Walk(conf.MountPoint, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info == nil {
+			return nil
+		}
+
+		if inKeyPath, _ := detectKeyPath(p); inKeyPath {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if !info.Mode().IsRegular() || info.Size() == 0 || strings.HasPrefix(info.Name(), partialPrefix) || p == dedupIndexPath() {
+			return nil
+		}
+
+		if hash, err := d.hash(p, info); err == nil {
+			d.paths[hash] = p
+			indexed[p] = d.files[p]
+		}
+
+		return nil
+	})
+
+	// drop entries of removed files
+	d.files = indexed
+
+	reportError("deduplication index", d.save())
+}
+
+// save writes the persistent index, paths are stored relative to the volume.
+func (d *dedupIndex) save() (err error) {
+	files := make(map[string]dedupEntry)
+
+	for p, e := range d.files {
+		files[relativePath(p)] = e
+	}
+
+	buf, err := json.Marshal(files)
+
+	if err != nil {
+		return
+	}
+
+	tmp := dedupIndexPath() + ".tmp"
+
+	if err = volumeJail().WriteFile(tmp, buf, 0600); err != nil {
+		return
+	}
+
+	return volumeJail().Rename(tmp, dedupIndexPath())
+}
+
+// lookup returns an existing file matching the argument hash, the match is
+// verified against the current file content.
+func (d *dedupIndex) lookup(hash string) (p string, ok bool) {
+	if d.paths == nil {
+		d.build()
+	}
+
+	if p, ok = d.paths[hash]; !ok {
+		return
+	}
+
+	info, err := volumeJail().Stat(p)
+
+	if err != nil {
+		delete(d.paths, hash)
+		delete(d.files, p)
+		return "", false
+	}
+
+	if h, err := d.hash(p, info); err != nil || h != hash {
+		delete(d.paths, hash)
+		return "", false
+	}
+
+	return
+}
+
+// Store saves the input to the argument path, through a temporary file,
+// sharing existing content when possible. Hard links are only used when
+// link is true.
+func (d *dedupIndex) Store(osPath string, input io.Reader, link bool) (written int64, err error) {
+	output, err := volumeJail().CreateTemp(path.Dir(osPath), partialPrefix)
+
+	if err != nil {
+		return
+	}
+
+	tmp := output.Name()
+
+	id := journal.Begin("upload", "", osPath, tmp)
+	defer journal.End(id)
+
+	defer func() {
+		if err != nil {
+			volumeJail().Remove(tmp)
+		}
+	}()
+
+	h := newBLAKE3()
+	written, err = io.Copy(io.MultiWriter(output, h), input)
+
+	if err == nil {
+		err = output.Sync()
+	}
+
+	output.Close()
+
+	if err != nil {
+		return
+	}
+
+	hash := hex.EncodeToString(h.Sum(nil))
+
+	d.Lock()
+	defer d.Unlock()
+
+	existing, ok := d.lookup(hash)
+
+	switch {
+	case written == 0 || !ok || existing == osPath:
+		if written > 0 {
+			d.paths[hash] = osPath
+		}
+	case cloneFile(existing, tmp) == nil:
+		d.saved += written
+		status.Log(syslog.LOG_INFO, "deduplicated %s as clone of %s (%v bytes saved, %v total)", relativePath(osPath), relativePath(existing), written, d.saved)
+	case link:
+		if err = volumeJail().Remove(tmp); err != nil {
+			return
+		}
+
+		if err = volumeJail().Link(existing, tmp); err != nil {
+			return
+		}
+
+		d.saved += written
+		status.Log(syslog.LOG_INFO, "deduplicated %s as %s (%v bytes saved, %v total)", relativePath(osPath), relativePath(existing), written, d.saved)
+	}
+
+	if err = volumeJail().Rename(tmp, osPath); err != nil {
+		return
+	}
+
+	reportError("upload synchronization", syncDir(path.Dir(osPath)))
+
+	if info, e := volumeJail().Stat(osPath); e == nil && written > 0 {
+		d.files[osPath] = dedupEntry{
+			Size:  info.Size(),
+			Mtime: info.ModTime().UnixNano(),
+			Hash:  hash,
+		}
+	}
+
+	return
+}
+
+func (d *dedupIndex) Saved() int64 {
+	d.Lock()
+	defer d.Unlock()
+
+	return d.saved
+}
+
+func (d *dedupIndex) Reset() {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.paths != nil {
+		reportError("deduplication index", d.save())
+	}
+
+	d.paths = nil
+	d.files = nil
+	d.saved = 0
+}
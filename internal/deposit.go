@@ -0,0 +1,336 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/syslog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// Deposit mode, a network dead drop: when `deposit_key` is configured files
+// can be uploaded without authentication, and without the volume being
+// unlocked, on /api/deposit/upload. Uploads are encrypted while streamed to
+// the OpenPGP public key, the original file name is only stored in the
+// encrypted literal data, and queued on the system partition until an
+// operator unlocks the volume and ingests them.
+//
+// The spool is limited to depositMaxFiles files, including uploads in
+// progress, and to `deposit_max_spool` MB, uploads in progress accounting
+// for the maximum deposit size.
+
+const depositExt = ".pgp"
+
+// maximum number of queued deposits
+const depositMaxFiles = 1000
+
+var errDepositFull = errors.New("deposit queue full")
+
+type depositQueue struct {
+	sync.Mutex
+	// uploads in progress
+	uploads int
+}
+
+var deposits depositQueue
+
+// Reserve creates the spool file of a new deposit when the spool limits
+// allow it, Release must be invoked once the upload is complete.
+func (q *depositQueue) Reserve() (tmp *os.File, err error) {
+	var size int64
+
+	q.Lock()
+	defer q.Unlock()
+
+	files, err := ioutil.ReadDir(conf.DepositSpool)
+
+	if err != nil {
+		return
+	}
+
+	// temporary files of uploads in progress, or interrupted ones, are
+	// counted as well
+	for _, f := range files {
+		size += f.Size()
+	}
+
+	maxSize := int64(conf.DepositMaxSize) * 1024 * 1024
+
+	if len(files) >= depositMaxFiles || size+int64(q.uploads+1)*maxSize > int64(conf.DepositMaxSpool)*1024*1024 {
+		return nil, errDepositFull
+	}
+
+	if tmp, err = ioutil.TempFile(conf.DepositSpool, ".deposit-"); err != nil {
+		return
+	}
+
+	q.uploads++
+
+	return
+}
+
+func (q *depositQueue) Release() {
+	q.Lock()
+	defer q.Unlock()
+
+	q.uploads--
+}
+
+type depositEntry struct {
+	ID    string `json:"id"`
+	Size  int64  `json:"size"`
+	Epoch int64  `json:"epoch"`
+}
+
+// depositEntries returns the queued deposits, oldest first.
+func depositEntries() (entries []depositEntry, err error) {
+	files, err := ioutil.ReadDir(conf.DepositSpool)
+
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return
+	}
+
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), depositExt) {
+			continue
+		}
+
+		entries = append(entries, depositEntry{
+			ID:    strings.TrimSuffix(f.Name(), depositExt),
+			Size:  f.Size(),
+			Epoch: f.ModTime().Unix(),
+		})
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+
+	return
+}
+
+// depositUpload encrypts and queues an unauthenticated upload.
+func depositUpload(w http.ResponseWriter, r *http.Request) {
+	if conf.DepositKey == "" || r.Method != http.MethodPost {
+		sendResponse(w, notFound())
+		return
+	}
+
+	res, err := deposit(w, r)
+
+	if err != nil {
+		// failures are not reflected in detail to anonymous clients
+		status.Log(syslog.LOG_ERR, "deposit from %s failed: %v", r.RemoteAddr, err)
+		sendResponse(w, jsonObject{"status": "KO", "response": []string{"deposit failed"}})
+		return
+	}
+
+	sendResponse(w, res)
+}
+
+func deposit(w http.ResponseWriter, r *http.Request) (res jsonObject, err error) {
+	entity, err := readPublicKey(conf.DepositKey)
+
+	if err != nil {
+		return
+	}
+
+	if err = os.MkdirAll(conf.DepositSpool, 0700); err != nil {
+		return
+	}
+
+	name, err := url.QueryUnescape(r.Header.Get("X-Uploadfilename"))
+
+	if err != nil {
+		return
+	}
+
+	rnd := make([]byte, 8)
+
+	if _, err = rand.Read(rnd); err != nil {
+		return
+	}
+
+	id := fmt.Sprintf("%d-%s", time.Now().UnixNano(), hex.EncodeToString(rnd))
+
+	tmp, err := deposits.Reserve()
+
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		deposits.Release()
+		tmp.Close()
+
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	hints := &openpgp.FileHints{
+		IsBinary: true,
+		FileName: path.Base("/" + name),
+		ModTime:  time.Now(),
+	}
+
+	pgpOut, err := openpgp.Encrypt(tmp, []*openpgp.Entity{entity}, nil, hints, nil)
+
+	if err != nil {
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, int64(conf.DepositMaxSize)*1024*1024)
+	written, err := io.Copy(pgpOut, body)
+
+	if err != nil {
+		return
+	}
+
+	if err = pgpOut.Close(); err != nil {
+		return
+	}
+
+	if err = tmp.Sync(); err != nil {
+		return
+	}
+
+	if err = os.Rename(tmp.Name(), filepath.Join(conf.DepositSpool, id+depositExt)); err != nil {
+		return
+	}
+
+	status.Log(syslog.LOG_NOTICE, "deposit %s received from %s (%v bytes)", id, r.RemoteAddr, written)
+
+	emitEvent(eventDeposit, map[string]interface{}{
+		"id":     id,
+		"size":   written,
+		"remote": r.RemoteAddr,
+	})
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": id,
+	}
+
+	return
+}
+
+func depositList() (res jsonObject) {
+	entries, err := depositEntries()
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": entries,
+	}
+
+	return
+}
+
+// depositIngest moves the queued deposits to `deposit_path` on the encrypted
+// volume.
+func depositIngest() (res jsonObject) {
+	entries, err := depositEntries()
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	dir, err := absolutePath(conf.DepositPath)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if err = volumeJail().MkdirAll(dir, 0700); err != nil {
+		return errorResponse(err, "")
+	}
+
+	ingested := []string{}
+
+	for _, e := range entries {
+		src := filepath.Join(conf.DepositSpool, e.ID+depositExt)
+		dst := filepath.Join(dir, e.ID+depositExt)
+
+		if err = depositMove(src, dst); err != nil {
+			return errorResponse(err, "")
+		}
+
+		ingested = append(ingested, relativePath(dst))
+	}
+
+	if len(ingested) > 0 {
+		status.Log(syslog.LOG_NOTICE, "ingested %d deposits", len(ingested))
+		checkDiskSpace()
+	}
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": ingested,
+	}
+
+	return
+}
+
+// depositPending notifies queued deposits at unlock.
+// depositMove copies a spooled deposit to the encrypted volume, the spool is
+// normally on a different file system, removing it once committed.
+func depositMove(src string, dst string) (err error) {
+	input, err := os.Open(src)
+
+	if err != nil {
+		return
+	}
+	defer input.Close()
+
+	output, err := createAtomic("ingest", src, dst, true)
+
+	if err != nil {
+		return
+	}
+
+	if _, err = io.Copy(output, input); err != nil {
+		output.Abort()
+		return
+	}
+
+	if err = output.Commit(); err != nil {
+		return
+	}
+
+	return os.Remove(src)
+}
+
+func depositPending() {
+	if conf.DepositKey == "" {
+		return
+	}
+
+	if entries, _ := depositEntries(); len(entries) > 0 {
+		status.Log(syslog.LOG_NOTICE, "%d deposits pending ingestion", len(entries))
+	}
+}
@@ -0,0 +1,121 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+func TestDeposit(t *testing.T) {
+	c := newTestServer(t)
+	dir := t.TempDir()
+
+	entity, err := openpgp.NewEntity("deposit", "", "testonly@example.com", nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile, err := os.Create(filepath.Join(dir, "deposit.asc"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, _ := armor.Encode(keyFile, openpgp.PublicKeyType, nil)
+	serialize(entity, w, nil)
+	w.Close()
+	keyFile.Close()
+
+	var res jsonObject
+
+	// disabled by default
+	r := c.request("POST", "/api/deposit/upload", nil, []byte(testCleartext))
+	json.NewDecoder(r.Body).Decode(&res)
+	r.Body.Close()
+
+	if res["status"] == "OK" {
+		t.Fatal("deposit accepted without deposit_key")
+	}
+
+	conf.DepositKey = keyFile.Name()
+	conf.DepositSpool = filepath.Join(dir, "spool")
+
+	header := map[string]string{"X-Uploadfilename": "secret%20report.txt"}
+	r = c.request("POST", "/api/deposit/upload", header, []byte(testCleartext))
+	defer r.Body.Close()
+
+	if err = json.NewDecoder(r.Body).Decode(&res); err != nil || res["status"] != "OK" {
+		t.Fatalf("unexpected deposit response: %v %v", res, err)
+	}
+
+	id := res["response"].(string)
+	spooled := filepath.Join(conf.DepositSpool, id+depositExt)
+	f, err := os.Open(spooled)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	md, err := openpgp.ReadMessage(f, openpgp.EntityList{entity}, nil, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if buf, err := ioutil.ReadAll(md.UnverifiedBody); err != nil || string(buf) != testCleartext || md.LiteralData.FileName != "secret report.txt" {
+		t.Errorf("deposit mismatch: %q %q %v", buf, md.LiteralData.FileName, err)
+	}
+
+	// spool size limit, accounting for the maximum deposit size
+	conf.DepositMaxSpool = conf.DepositMaxSize
+
+	r = c.request("POST", "/api/deposit/upload", nil, []byte(testCleartext))
+	res = jsonObject{}
+	json.NewDecoder(r.Body).Decode(&res)
+	r.Body.Close()
+
+	if res["status"] == "OK" {
+		t.Error("deposit accepted with full spool")
+	}
+
+	conf.DepositMaxSpool = 1000
+
+	if files, _ := ioutil.ReadDir(conf.DepositSpool); len(files) != 1 || deposits.uploads != 0 {
+		t.Errorf("rejected deposit not cleaned up: %d files, %d uploads", len(files), deposits.uploads)
+	}
+
+	// ingestion
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	if res = c.mustCall("deposit/list", nil); len(res["response"].([]interface{})) != 1 {
+		t.Errorf("unexpected deposit list: %v", res)
+	}
+
+	res = c.mustCall("deposit/ingest", nil)
+
+	if ingested := res["response"].([]interface{}); len(ingested) != 1 || ingested[0] != "/deposit/"+id+depositExt {
+		t.Fatalf("unexpected ingestion response: %v", res)
+	}
+
+	if _, err = os.Stat(filepath.Join(conf.MountPoint, "deposit", id+depositExt)); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = os.Stat(spooled); !os.IsNotExist(err) {
+		t.Error("ingested deposit not removed from spool")
+	}
+}
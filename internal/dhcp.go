@@ -0,0 +1,175 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// Minimal DHCP (RFC 2131) server for the USB network gadget, a single lease
+// is handed out to the host side of the point-to-point link.
+
+const dhcpLeaseTime = 24 * 3600
+
+// DHCP message types
+const (
+	dhcpDiscover = 1
+	dhcpOffer    = 2
+	dhcpRequest  = 3
+	dhcpACK      = 5
+	dhcpNAK      = 6
+)
+
+// DHCP options
+const (
+	dhcpOptSubnetMask  = 1
+	dhcpOptRequestedIP = 50
+	dhcpOptLeaseTime   = 51
+	dhcpOptMessageType = 53
+	dhcpOptServerID    = 54
+	dhcpOptEnd         = 255
+)
+
+var dhcpMagic = []byte{99, 130, 83, 99}
+
+type dhcpServer struct {
+	server net.IP
+	lease  net.IP
+	mask   net.IPMask
+}
+
+// newDHCPServer returns a server for the device address (CIDR notation),
+// leasing the following address in its subnet.
+func newDHCPServer(address string) (d *dhcpServer, err error) {
+	ip, network, err := net.ParseCIDR(address)
+
+	if err != nil {
+		return
+	}
+
+	if ip = ip.To4(); ip == nil {
+		return nil, errors.New("DHCP requires an IPv4 address")
+	}
+
+	lease := make(net.IP, 4)
+	binary.BigEndian.PutUint32(lease, binary.BigEndian.Uint32(ip)+1)
+
+	if !network.Contains(lease) || lease.Equal(broadcastAddress(network)) {
+		return nil, errors.New("no address available for DHCP lease")
+	}
+
+	return &dhcpServer{server: ip, lease: lease, mask: network.Mask}, nil
+}
+
+func broadcastAddress(n *net.IPNet) net.IP {
+	ip := make(net.IP, 4)
+
+	for i := range ip {
+		ip[i] = n.IP.To4()[i] | ^n.Mask[len(n.Mask)-4+i]
+	}
+
+	return ip
+}
+
+func dhcpOptions(buf []byte) (options map[byte][]byte, err error) {
+	options = make(map[byte][]byte)
+
+	for i := 0; i < len(buf); {
+		switch opt := buf[i]; opt {
+		case 0:
+			i++
+		case dhcpOptEnd:
+			return
+		default:
+			if i+1 >= len(buf) || i+2+int(buf[i+1]) > len(buf) {
+				return nil, errors.New("invalid DHCP option")
+			}
+
+			options[opt] = buf[i+2 : i+2+int(buf[i+1])]
+			i += 2 + int(buf[i+1])
+		}
+	}
+
+	return
+}
+
+// Reply returns the response to a client message, nil if the message is to
+// be ignored.
+func (d *dhcpServer) Reply(req []byte) (res []byte, err error) {
+	// fixed BOOTP header and magic cookie
+	if len(req) < 240 || req[0] != 1 || !bytes.Equal(req[236:240], dhcpMagic) {
+		return nil, errors.New("invalid DHCP message")
+	}
+
+	options, err := dhcpOptions(req[240:])
+
+	if err != nil {
+		return
+	}
+
+	msgType := options[dhcpOptMessageType]
+
+	if len(msgType) != 1 {
+		return nil, errors.New("missing DHCP message type")
+	}
+
+	var reply byte
+
+	switch msgType[0] {
+	case dhcpDiscover:
+		reply = dhcpOffer
+	case dhcpRequest:
+		if id, ok := options[dhcpOptServerID]; ok && !net.IP(id).Equal(d.server) {
+			// client selected another server
+			return
+		}
+
+		requested := net.IP(options[dhcpOptRequestedIP])
+
+		if requested == nil {
+			requested = net.IP(req[12:16])
+		}
+
+		if requested.Equal(d.lease) {
+			reply = dhcpACK
+		} else {
+			reply = dhcpNAK
+		}
+	default:
+		return
+	}
+
+	res = make([]byte, 240)
+	// BOOTREPLY, htype, hlen
+	copy(res, req[:3])
+	res[0] = 2
+	// xid, secs, flags
+	copy(res[4:12], req[4:12])
+	// giaddr, chaddr
+	copy(res[24:44], req[24:44])
+	copy(res[236:], dhcpMagic)
+
+	res = append(res, dhcpOptMessageType, 1, reply)
+	res = append(res, dhcpOptServerID, 4)
+	res = append(res, d.server...)
+
+	if reply != dhcpNAK {
+		// yiaddr, siaddr
+		copy(res[16:20], d.lease)
+		copy(res[20:24], d.server)
+
+		res = append(res, dhcpOptLeaseTime, 4)
+		res = binary.BigEndian.AppendUint32(res, dhcpLeaseTime)
+		res = append(res, dhcpOptSubnetMask, 4)
+		res = append(res, d.mask[len(d.mask)-4:]...)
+	}
+
+	return append(res, dhcpOptEnd), nil
+}
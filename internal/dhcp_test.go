@@ -0,0 +1,76 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func dhcpMessage(msgType byte, options ...byte) []byte {
+	msg := make([]byte, 240)
+	msg[0] = 1
+	msg[1] = 1
+	msg[2] = 6
+	copy(msg[4:8], []byte{0xde, 0xad, 0xbe, 0xef})
+	copy(msg[28:34], []byte{0x1a, 0x55, 0x89, 0xa2, 0x69, 0x41})
+	copy(msg[236:], dhcpMagic)
+
+	msg = append(msg, dhcpOptMessageType, 1, msgType)
+	msg = append(msg, options...)
+
+	return append(msg, dhcpOptEnd)
+}
+
+func TestDHCP(t *testing.T) {
+	if _, err := newDHCPServer("10.0.0.254/24"); err == nil {
+		t.Error("broadcast address leased")
+	}
+
+	d, err := newDHCPServer("10.0.0.1/24")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := d.Reply(dhcpMessage(dhcpDiscover))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options, err := dhcpOptions(res[240:])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res[0] != 2 || !bytes.Equal(res[4:8], []byte{0xde, 0xad, 0xbe, 0xef}) || !net.IP(res[16:20]).Equal(net.IPv4(10, 0, 0, 2)) {
+		t.Errorf("unexpected offer: %x", res[:44])
+	}
+
+	if options[dhcpOptMessageType][0] != dhcpOffer || !bytes.Equal(options[dhcpOptSubnetMask], []byte{255, 255, 255, 0}) {
+		t.Errorf("unexpected offer options: %v", options)
+	}
+
+	if res, _ = d.Reply(dhcpMessage(dhcpRequest, dhcpOptRequestedIP, 4, 10, 0, 0, 2, dhcpOptServerID, 4, 10, 0, 0, 1)); res[242] != dhcpACK {
+		t.Errorf("lease not acknowledged: %x", res[240:])
+	}
+
+	if res, _ = d.Reply(dhcpMessage(dhcpRequest, dhcpOptRequestedIP, 4, 10, 0, 0, 3)); res[242] != dhcpNAK {
+		t.Errorf("invalid lease acknowledged: %x", res[240:])
+	}
+
+	if res, _ = d.Reply(dhcpMessage(dhcpRequest, dhcpOptServerID, 4, 10, 0, 0, 9)); res != nil {
+		t.Error("response to request for another server")
+	}
+
+	if _, err = d.Reply(dhcpMessage(dhcpDiscover, dhcpOptRequestedIP, 4, 10)); err == nil {
+		t.Error("truncated option accepted")
+	}
+}
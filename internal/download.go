@@ -0,0 +1,190 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"errors"
+	"log/syslog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Download tokens, the identifiers returned by the file/download handshake
+// are single use, expire after `download_ttl` seconds and can only be
+// redeemed by the session which requested them. Issuance, redemption and
+// rejected attempts are logged, outstanding tokens can be listed and revoked
+// with the file/downloads API method.
+
+type downloadToken struct {
+	ID     string `json:"id"`
+	Path   string `json:"path"`
+	User   string `json:"user"`
+	Issued int64  `json:"issued"`
+	Expiry int64  `json:"expiry"`
+
+	osPath string
+	owner  string
+}
+
+type downloadCache struct {
+	sync.Mutex
+	cache map[string]*downloadToken
+}
+
+var download = downloadCache{
+	cache: make(map[string]*downloadToken),
+}
+
+// requestUser returns the user name of the session issuing the request.
+func requestUser(r *http.Request) string {
+	if g := guests.Validate(r, false); g != nil {
+		return g.Username
+	}
+
+	return "admin"
+}
+
+// prune removes expired tokens, it must be called with the cache locked.
+func (d *downloadCache) prune() {
+	now := time.Now().Unix()
+
+	for id, t := range d.cache {
+		if now > t.Expiry {
+			delete(d.cache, id)
+		}
+	}
+}
+
+func (d *downloadCache) Add(r *http.Request, id string, osPath string) {
+	now := time.Now()
+
+	t := &downloadToken{
+		ID:     id,
+		Path:   relativePath(osPath),
+		User:   requestUser(r),
+		Issued: now.Unix(),
+		Expiry: now.Add(time.Duration(conf.DownloadTTL) * time.Second).Unix(),
+		osPath: osPath,
+		owner:  jobOwner(r),
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	d.prune()
+	d.cache[id] = t
+
+	status.Log(syslog.LOG_INFO, "issued download token for %s to %s", t.Path, t.User)
+}
+
+// Remove redeems a token, which must have been issued to the requesting
+// session.
+func (d *downloadCache) Remove(r *http.Request, id string) (osPath string, err error) {
+	d.Lock()
+	defer d.Unlock()
+
+	t, ok := d.cache[id]
+
+	switch {
+	case !ok:
+		err = errors.New("download id not found")
+	case time.Now().Unix() > t.Expiry:
+		err = errors.New("download id expired")
+	case t.owner != jobOwner(r):
+		err = errors.New("download id issued to a different session")
+	}
+
+	if err != nil {
+		status.Log(syslog.LOG_WARNING, "rejected download from %s: %v", r.RemoteAddr, err)
+
+		// a token presented by another session is no longer trusted
+		if ok {
+			delete(d.cache, id)
+		}
+
+		return
+	}
+
+	delete(d.cache, id)
+	status.Log(syslog.LOG_INFO, "redeemed download token for %s by %s", t.Path, t.User)
+
+	return t.osPath, nil
+}
+
+func (d *downloadCache) List() (tokens []downloadToken) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.prune()
+	tokens = []downloadToken{}
+
+	for _, t := range d.cache {
+		tokens = append(tokens, *t)
+	}
+
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Issued < tokens[j].Issued
+	})
+
+	return
+}
+
+func (d *downloadCache) Revoke(id string) (err error) {
+	d.Lock()
+	defer d.Unlock()
+
+	t, ok := d.cache[id]
+
+	if !ok {
+		return errors.New("download id not found")
+	}
+
+	delete(d.cache, id)
+	status.Log(syslog.LOG_NOTICE, "revoked download token for %s issued to %s", t.Path, t.User)
+
+	return
+}
+
+func (d *downloadCache) Reset() {
+	d.Lock()
+	defer d.Unlock()
+
+	d.cache = make(map[string]*downloadToken)
+}
+
+func fileDownloads(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	switch req["action"].(string) {
+	case "list":
+		return jsonObject{
+			"status":   "OK",
+			"response": download.List(),
+		}
+	case "revoke":
+		if err = requireAttributes(req, "id"); err != nil {
+			return errorResponse(err, "")
+		}
+
+		if err = download.Revoke(req["id"].(string)); err != nil {
+			return errorResponse(err, "")
+		}
+	}
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": nil,
+	}
+
+	return
+}
@@ -0,0 +1,98 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"testing"
+)
+
+// redeem retrieves a download token, returning the response status code.
+func (c *apiClient) redeem(id string) (code int, data string) {
+	// the download handshake does not involve the XSRF token
+	XSRFToken := c.XSRFToken
+	c.XSRFToken = ""
+
+	r := c.request("GET", "/api/file/download?id="+id, nil, nil)
+	defer r.Body.Close()
+
+	c.XSRFToken = XSRFToken
+
+	buf, _ := ioutil.ReadAll(r.Body)
+
+	return r.StatusCode, string(buf)
+}
+
+func TestDownloadTokens(t *testing.T) {
+	c := newTestServer(t)
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	c.upload("/token.txt", testCleartext)
+
+	id := c.mustCall("file/download", jsonObject{"path": "/token.txt"})["response"].(string)
+
+	res := c.mustCall("file/downloads", jsonObject{"action": "list"})
+	tokens := res["response"].([]interface{})
+
+	if len(tokens) != 1 || tokens[0].(map[string]interface{})["path"] != "/token.txt" || tokens[0].(map[string]interface{})["user"] != "admin" {
+		t.Fatalf("unexpected tokens %v", tokens)
+	}
+
+	if code, data := c.redeem(id); code != http.StatusOK || data != testCleartext {
+		t.Fatalf("download failed: %d %s", code, data)
+	}
+
+	// single use
+	if code, _ := c.redeem(id); code == http.StatusOK {
+		t.Error("download token reused")
+	}
+
+	// revocation
+	id = c.mustCall("file/download", jsonObject{"path": "/token.txt"})["response"].(string)
+	c.mustCall("file/downloads", jsonObject{"action": "revoke", "id": id})
+
+	if code, _ := c.redeem(id); code == http.StatusOK {
+		t.Error("revoked download token accepted")
+	}
+
+	if res := c.call("file/downloads", jsonObject{"action": "revoke"}); res["status"] != "KO" {
+		t.Error("revocation without id accepted")
+	}
+
+	// expiry
+	conf.DownloadTTL = -1
+	id = c.mustCall("file/download", jsonObject{"path": "/token.txt"})["response"].(string)
+	conf.DownloadTTL = 60
+
+	if code, _ := c.redeem(id); code == http.StatusOK {
+		t.Error("expired download token accepted")
+	}
+
+	// session binding
+	res = c.mustCall("guest/create", jsonObject{"path": "/", "ops": []string{"download"}, "duration": 60})
+	credentials := res["response"].(map[string]interface{})
+
+	jar, _ := cookiejar.New(nil)
+	g := &apiClient{t: t, srv: c.srv, client: &http.Client{Jar: jar}}
+
+	res = g.mustCall("auth/guest", jsonObject{"username": credentials["username"], "password": credentials["password"]})
+	g.XSRFToken = res["response"].(map[string]interface{})["XSRFToken"].(string)
+
+	id = g.mustCall("file/download", jsonObject{"path": "/token.txt"})["response"].(string)
+
+	if code, _ := c.redeem(id); code == http.StatusOK {
+		t.Error("download token redeemed by a different session")
+	}
+
+	if tokens := c.mustCall("file/downloads", jsonObject{"action": "list"})["response"].([]interface{}); len(tokens) != 0 {
+		t.Errorf("unexpected tokens %v", tokens)
+	}
+}
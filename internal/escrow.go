@@ -0,0 +1,368 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/syslog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// Key escrow, a random passphrase is added to a volume keyslot and split,
+// with Shamir's Secret Sharing, among the `escrow_contacts` so that any
+// `escrow_threshold` of them can recover the volume. Each share is encrypted
+// to the contact OpenPGP public key and the escrow package is stored on the
+// system partition, in `escrow_path`, as it is needed while the volume is
+// locked.
+//
+// Recovery is performed by contacts submitting their decrypted shares, which
+// are kept in memory for at most escrowRecoveryExpiry, the volume is unlocked
+// once the threshold is reached.
+//
+// As recovery is performed without a volume session, contacts authenticate
+// each submission with an OpenPGP signature of the share, verified against
+// their public key stored in the escrow package. Each share is also checked
+// against its digest, recorded at split time, before being accepted so that
+// invalid shares cannot disrupt the ceremony.
+
+const escrowSecretSize = 32
+const escrowRecoveryExpiry = time.Hour
+
+type escrowShare struct {
+	Contact string `json:"contact"`
+	// armored OpenPGP message of the base64 encoded share
+	Share string `json:"share"`
+	// SHA256 digest of the share
+	Digest string `json:"digest"`
+	// armored contact public key, authenticating submissions
+	PublicKey string `json:"public_key"`
+}
+
+type escrowPackage struct {
+	Volume    string        `json:"volume"`
+	Threshold int           `json:"threshold"`
+	Digest    string        `json:"digest"`
+	Epoch     int64         `json:"epoch"`
+	Shares    []escrowShare `json:"shares"`
+}
+
+type escrowRecovery struct {
+	sync.Mutex
+	volume  string
+	shares  [][]byte
+	started time.Time
+}
+
+var recovery escrowRecovery
+
+func escrowFile(volume string) (string, error) {
+	if volume == "" || strings.ContainsAny(volume, "/\\") || strings.Contains(volume, traversalPattern) {
+		return "", errors.New("invalid volume name")
+	}
+
+	return filepath.Join(conf.EscrowPath, volume+".json"), nil
+}
+
+func loadEscrow(volume string) (p *escrowPackage, err error) {
+	path, err := escrowFile(volume)
+
+	if err != nil {
+		return
+	}
+
+	buf, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no escrow for volume %s", volume)
+	}
+
+	if err != nil {
+		return
+	}
+
+	p = &escrowPackage{}
+	err = json.Unmarshal(buf, p)
+
+	return
+}
+
+func (p *escrowPackage) save() (err error) {
+	path, err := escrowFile(p.Volume)
+
+	if err != nil {
+		return
+	}
+
+	if err = os.MkdirAll(conf.EscrowPath, 0700); err != nil {
+		return
+	}
+
+	buf, err := json.MarshalIndent(p, "", "\t")
+
+	if err != nil {
+		return
+	}
+
+	tmp := path + ".tmp"
+
+	if err = ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		return
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// encryptShare encrypts a share to the public key of a contact.
+func encryptShare(contact string, share []byte) (s escrowShare, err error) {
+	keyPath, err := absolutePath(contact)
+
+	if err != nil {
+		return
+	}
+
+	pub, err := volumeJail().ReadFile(keyPath)
+
+	if err != nil {
+		return
+	}
+
+	entity, err := decodePublicKey(bytes.NewReader(pub))
+
+	if err != nil {
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	w, err := armor.Encode(buf, "PGP MESSAGE", nil)
+
+	if err != nil {
+		return
+	}
+
+	pgpOut, err := openpgp.Encrypt(w, []*openpgp.Entity{entity}, nil, &openpgp.FileHints{IsBinary: true}, nil)
+
+	if err != nil {
+		return
+	}
+
+	if _, err = pgpOut.Write([]byte(base64.StdEncoding.EncodeToString(share))); err != nil {
+		return
+	}
+
+	if err = pgpOut.Close(); err != nil {
+		return
+	}
+
+	if err = w.Close(); err != nil {
+		return
+	}
+
+	s = escrowShare{
+		Contact:   contact,
+		Share:     buf.String(),
+		Digest:    escrowDigest(share),
+		PublicKey: string(pub),
+	}
+
+	return
+}
+
+// verifyShare authenticates a submitted share against the escrow package,
+// the share must match its digest and be signed by its contact.
+func (p *escrowPackage) verifyShare(encoded string, share []byte, signature string) (err error) {
+	i := int(share[0]) - 1
+
+	if i < 0 || i >= len(p.Shares) || !secretEqual(escrowDigest(share), p.Shares[i].Digest) {
+		return errors.New("invalid escrow share")
+	}
+
+	keyring, err := openpgp.ReadArmoredKeyRing(strings.NewReader(p.Shares[i].PublicKey))
+
+	if err != nil {
+		return
+	}
+
+	if _, err = openpgp.CheckArmoredDetachedSignature(keyring, strings.NewReader(encoded), strings.NewReader(signature)); err != nil {
+		return fmt.Errorf("invalid escrow share signature for contact %s", p.Shares[i].Contact)
+	}
+
+	return
+}
+
+func escrowPassphrase(secret []byte) string {
+	return base64.StdEncoding.EncodeToString(secret)
+}
+
+func escrowDigest(secret []byte) string {
+	sum := sha256.Sum256(secret)
+	return hex.EncodeToString(sum[:])
+}
+
+// escrowProvision adds the escrow keyslot to a volume and returns the escrow
+// package for distribution to the contacts.
+func escrowProvision(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	volume := req["volume"].(string)
+	password := req["password"].(string)
+
+	if len(conf.EscrowContacts) < conf.EscrowThreshold || conf.EscrowThreshold < 1 {
+		return errorResponse(errors.New("escrow contacts and threshold not configured"), "")
+	}
+
+	if p, _ := loadEscrow(volume); p != nil {
+		return errorResponse(fmt.Errorf("escrow already provisioned for volume %s", volume), "")
+	}
+
+	secret := make([]byte, escrowSecretSize)
+
+	if _, err = rand.Read(secret); err != nil {
+		return errorResponse(err, "")
+	}
+
+	shares, err := shamirSplit(secret, len(conf.EscrowContacts), conf.EscrowThreshold)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	p := &escrowPackage{
+		Volume:    volume,
+		Threshold: conf.EscrowThreshold,
+		Digest:    escrowDigest(secret),
+		Epoch:     time.Now().Unix(),
+	}
+
+	for i, contact := range conf.EscrowContacts {
+		s, err := encryptShare(contact, shares[i])
+
+		if err != nil {
+			return errorResponse(fmt.Errorf("escrow contact %s: %v", contact, err), "")
+		}
+
+		p.Shares = append(p.Shares, s)
+	}
+
+	passphrase := escrowPassphrase(secret)
+
+	if err = keyOp(r.Context(), volume, password, passphrase, _add); err != nil {
+		return errorResponse(err, "")
+	}
+
+	if err = p.save(); err != nil {
+		reportError("escrow cleanup", keyOp(context.Background(), volume, passphrase, "", _remove))
+		return errorResponse(err, "")
+	}
+
+	status.Log(syslog.LOG_NOTICE, "escrow provisioned for volume %s (%d of %d contacts)", volume, p.Threshold, len(p.Shares))
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": p,
+	}
+
+	return
+}
+
+// escrowRecover collects a recovery share and unlocks the volume once the
+// threshold is reached.
+func escrowRecover(w http.ResponseWriter, r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if err = acknowledgeBanner(req, r.RemoteAddr); err != nil {
+		return errorResponse(err, "")
+	}
+
+	if session.Active() {
+		return errorResponse(errors.New("existing session"), "INVALID_SESSION")
+	}
+
+	volume := req["volume"].(string)
+	p, err := loadEscrow(volume)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	encoded := strings.TrimSpace(req["share"].(string))
+	share, err := base64.StdEncoding.DecodeString(encoded)
+
+	if err != nil || len(share) != escrowSecretSize+1 || share[0] == 0 {
+		return errorResponse(errors.New("invalid escrow share"), "")
+	}
+
+	if err = p.verifyShare(encoded, share, req["signature"].(string)); err != nil {
+		status.Log(syslog.LOG_WARNING, "escrow recovery share for volume %s from %s rejected: %v", volume, r.RemoteAddr, err)
+		return errorResponse(err, "")
+	}
+
+	recovery.Lock()
+	defer recovery.Unlock()
+
+	if recovery.volume != volume || time.Since(recovery.started) > escrowRecoveryExpiry {
+		recovery.volume = volume
+		recovery.shares = nil
+		recovery.started = time.Now()
+	}
+
+	for _, s := range recovery.shares {
+		if s[0] == share[0] {
+			return errorResponse(errors.New("escrow share already submitted"), "")
+		}
+	}
+
+	recovery.shares = append(recovery.shares, share)
+	status.Log(syslog.LOG_WARNING, "escrow recovery share %d/%d for volume %s received from %s", len(recovery.shares), p.Threshold, volume, r.RemoteAddr)
+
+	if len(recovery.shares) < p.Threshold {
+		return jsonObject{
+			"status": "OK",
+			"response": map[string]interface{}{
+				"received":  len(recovery.shares),
+				"threshold": p.Threshold,
+			},
+		}
+	}
+
+	secret, err := shamirCombine(recovery.shares)
+
+	recovery.volume = ""
+	recovery.shares = nil
+
+	if err != nil || !secretEqual(escrowDigest(secret), p.Digest) {
+		return errorResponse(errors.New("escrow recovery failed, invalid shares"), "")
+	}
+
+	status.Log(syslog.LOG_WARNING, "volume %s recovered through escrow", volume)
+
+	return openSession(w, r, volume, escrowPassphrase(secret), false)
+}
@@ -0,0 +1,171 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+func TestShamir(t *testing.T) {
+	secret := []byte("INTERLOCK escrow secret")
+	shares, err := shamirSplit(secret, 5, 3)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subsets := [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}, {0, 1, 2, 3, 4}}
+
+	for _, subset := range subsets {
+		var s [][]byte
+
+		for _, i := range subset {
+			s = append(s, shares[i])
+		}
+
+		if recovered, err := shamirCombine(s); err != nil || !bytes.Equal(recovered, secret) {
+			t.Errorf("recovery with shares %v failed: %q %v", subset, recovered, err)
+		}
+	}
+
+	if recovered, _ := shamirCombine(shares[:2]); bytes.Equal(recovered, secret) {
+		t.Error("recovery below threshold")
+	}
+
+	if _, err = shamirCombine([][]byte{shares[0], shares[0], shares[1]}); err == nil {
+		t.Error("duplicate shares accepted")
+	}
+
+	if _, err = shamirSplit(secret, 2, 3); err == nil {
+		t.Error("threshold above number of shares accepted")
+	}
+}
+
+func TestEscrow(t *testing.T) {
+	c := newTestServer(t)
+	defer conf.SetDefaults()
+
+	c.login()
+
+	conf.EscrowPath = t.TempDir()
+	conf.EscrowThreshold = 2
+
+	var contacts []*openpgp.Entity
+
+	if err := os.MkdirAll(filepath.Join(conf.MountPoint, "escrow"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		entity, err := openpgp.NewEntity(fmt.Sprintf("contact%d", i), "", "testonly@example.com", nil)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keyPath := fmt.Sprintf("/escrow/contact%d.asc", i)
+		keyFile, err := os.Create(filepath.Join(conf.MountPoint, keyPath))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w, _ := armor.Encode(keyFile, openpgp.PublicKeyType, nil)
+		serialize(entity, w, nil)
+		w.Close()
+		keyFile.Close()
+
+		contacts = append(contacts, entity)
+		conf.EscrowContacts = append(conf.EscrowContacts, keyPath)
+	}
+
+	res := c.mustCall("escrow/provision", jsonObject{"volume": testVolume, "password": testPassword})
+	p := res["response"].(map[string]interface{})
+
+	if res = c.call("escrow/provision", jsonObject{"volume": testVolume, "password": testPassword}); res["status"] == "OK" {
+		t.Error("escrow provisioned twice")
+	}
+
+	var shares []string
+	var signatures []string
+
+	for i, s := range p["shares"].([]interface{}) {
+		block, err := armor.Decode(strings.NewReader(s.(map[string]interface{})["share"].(string)))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// each share is only readable by its contact
+		md, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{contacts[i]}, nil, nil)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		share, _ := ioutil.ReadAll(md.UnverifiedBody)
+		shares = append(shares, string(share))
+
+		// contacts authenticate their submission
+		var sig bytes.Buffer
+
+		if err = openpgp.ArmoredDetachSign(&sig, contacts[i], bytes.NewReader(share), nil); err != nil {
+			t.Fatal(err)
+		}
+
+		signatures = append(signatures, sig.String())
+	}
+
+	c.mustCall("auth/logout", nil)
+	c.XSRFToken = ""
+
+	// unsigned, mismatching and bogus shares are rejected without
+	// affecting the ceremony
+	if res = c.call("escrow/recover", jsonObject{"volume": testVolume, "share": shares[2]}); res["status"] != "INVALID" {
+		t.Errorf("unsigned share accepted: %v", res)
+	}
+
+	if res = c.call("escrow/recover", jsonObject{"volume": testVolume, "share": shares[2], "signature": signatures[1]}); res["status"] == "OK" {
+		t.Error("share signed by another contact accepted")
+	}
+
+	bogus := []byte(shares[1])
+	bogus[10] ^= 1
+
+	if res = c.call("escrow/recover", jsonObject{"volume": testVolume, "share": string(bogus), "signature": signatures[1]}); res["status"] == "OK" {
+		t.Error("bogus share accepted")
+	}
+
+	res = c.mustCall("escrow/recover", jsonObject{"volume": testVolume, "share": shares[2], "signature": signatures[2]})
+
+	if received := res["response"].(map[string]interface{})["received"]; received != float64(1) {
+		t.Errorf("unexpected recovery response: %v", res)
+	}
+
+	if res = c.call("escrow/recover", jsonObject{"volume": testVolume, "share": shares[2], "signature": signatures[2]}); res["status"] == "OK" {
+		t.Error("duplicate share accepted")
+	}
+
+	res = c.mustCall("escrow/recover", jsonObject{"volume": testVolume, "share": shares[0], "signature": signatures[0]})
+	c.XSRFToken = res["response"].(map[string]interface{})["XSRFToken"].(string)
+
+	if !logged("volume " + testVolume + " recovered through escrow") {
+		t.Error("recovery not logged")
+	}
+
+	c.mustCall("file/list", jsonObject{"path": "/", "sha256": false})
+	c.mustCall("auth/logout", nil)
+}
@@ -0,0 +1,94 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"log/syslog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Security relevant events, dispatched to the registered sinks (e.g.
+// webhooks) for consumption by external systems.
+
+const (
+	eventLogin        = "login"
+	eventLoginFailed  = "login_failed"
+	eventUpload       = "upload"
+	eventWipe         = "wipe"
+	eventLowDisk      = "low_disk"
+	eventTamper       = "tamper"
+	eventAccessDenied = "access_denied"
+	eventDeposit      = "deposit"
+	eventHoneytoken   = "honeytoken"
+)
+
+type event struct {
+	Name    string                 `json:"event"`
+	Epoch   int64                  `json:"epoch"`
+	Details map[string]interface{} `json:"details"`
+}
+
+// event sinks, registered at init time
+var eventSinks []func(e event)
+
+// HTTP client for event delivery to external services
+var eventClient = &http.Client{Timeout: 10 * time.Second}
+
+func emitEvent(name string, details map[string]interface{}) {
+	e := event{
+		Name:    name,
+		Epoch:   time.Now().Unix(),
+		Details: details,
+	}
+
+	for _, sink := range eventSinks {
+		sink(e)
+	}
+}
+
+var lowDisk struct {
+	sync.Mutex
+	active bool
+}
+
+// checkDiskSpace emits a low disk event when the encrypted volume free space
+// falls below the configured percentage.
+func checkDiskSpace() {
+	if conf.LowDisk <= 0 {
+		return
+	}
+
+	total, free, err := fsStatus(conf.MountPoint)
+
+	if err != nil || total == 0 {
+		return
+	}
+
+	percent := int(free * 100 / total)
+
+	lowDisk.Lock()
+	defer lowDisk.Unlock()
+
+	if percent >= conf.LowDisk {
+		lowDisk.active = false
+		return
+	}
+
+	if lowDisk.active {
+		return
+	}
+
+	lowDisk.active = true
+	status.Log(syslog.LOG_WARNING, "low disk space on encrypted volume (%d%% free)", percent)
+
+	emitEvent(eventLowDisk, map[string]interface{}{
+		"free":  free,
+		"total": total,
+	})
+}
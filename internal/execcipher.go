@@ -0,0 +1,313 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// External cipher, wraps a command implementing the following subprocess
+// protocol to integrate site specific algorithms (e.g. national standards)
+// without modifying INTERLOCK:
+//
+//	<command> [args] encrypt [--sign]    stdin: cleartext, stdout: ciphertext
+//	<command> [args] decrypt [--verify]  stdin: ciphertext, stdout: cleartext
+//	<command> [args] sign                stdin: data, stdout: signature
+//	<command> [args] verify              stdin: data, fd 4: signature
+//	<command> [args] keygen <id> <email> stdout: {"public": "...", "secret": "..."}
+//
+// The password, if any, is read from file descriptor 3 and key paths are
+// passed in the INTERLOCK_PUBLIC_KEY and INTERLOCK_SECRET_KEY environment
+// variables. A non-zero exit status indicates failure, standard error is
+// returned as error message.
+//
+// The command, and the operations it supports, are configured with the "exec"
+// cipher_options.
+
+const (
+	execEncrypt = "encrypt"
+	execDecrypt = "decrypt"
+	execSign    = "sign"
+	execVerify  = "verify"
+	execKeygen  = "keygen"
+)
+
+type execCipherOptions struct {
+	Command     string   `json:"command"`
+	Args        []string `json:"args"`
+	Description string   `json:"description"`
+	KeyFormat   string   `json:"key_format"`
+	Extension   string   `json:"extension"`
+	Operations  []string `json:"operations"`
+}
+
+type execCipher struct {
+	info     cipherInfo
+	options  execCipherOptions
+	password string
+	pubKey   string
+	secKey   string
+
+	cipherInterface
+}
+
+func init() {
+	conf.SetAvailableCipher(new(execCipher).Init())
+}
+
+func (e *execCipher) Init() cipherInterface {
+	e.info = cipherInfo{
+		Name:        "exec",
+		Description: "External cipher command",
+		KeyFormat:   "password",
+		Extension:   "exec",
+	}
+
+	if e.options.Description != "" {
+		e.info.Description = e.options.Description
+	}
+
+	if e.options.KeyFormat != "" {
+		e.info.KeyFormat = e.options.KeyFormat
+	}
+
+	if e.options.Extension != "" {
+		e.info.Extension = e.options.Extension
+	}
+
+	e.info.Enc = e.supports(execEncrypt)
+	e.info.Dec = e.supports(execDecrypt)
+	e.info.Sig = e.supports(execSign) && e.supports(execVerify)
+
+	return e
+}
+
+func (e *execCipher) New() cipherInterface {
+	return (&execCipher{options: e.options}).Init()
+}
+
+func (e *execCipher) Configure(options json.RawMessage) (err error) {
+	opts := execCipherOptions{}
+
+	if err = parseCipherOptions(options, &opts); err != nil {
+		return
+	}
+
+	if !filepath.IsAbs(opts.Command) {
+		return errors.New("command must be an absolute path")
+	}
+
+	if _, err = os.Stat(opts.Command); err != nil {
+		return
+	}
+
+	if strings.ContainsAny(opts.Extension, "/.") {
+		return fmt.Errorf("invalid extension %q", opts.Extension)
+	}
+
+	if len(opts.Operations) == 0 {
+		opts.Operations = []string{execEncrypt, execDecrypt, execSign, execVerify, execKeygen}
+	}
+
+	for _, op := range opts.Operations {
+		switch op {
+		case execEncrypt, execDecrypt, execSign, execVerify, execKeygen:
+		default:
+			return fmt.Errorf("invalid operation %s", op)
+		}
+	}
+
+	e.options = opts
+	e.Init()
+
+	return
+}
+
+func (e *execCipher) supports(op string) bool {
+	for _, o := range e.options.Operations {
+		if o == op {
+			return true
+		}
+	}
+
+	return false
+}
+
+// run executes an operation of the external command.
+func (e *execCipher) run(op string, args []string, stdin io.Reader, stdout io.Writer, signature *os.File) (err error) {
+	if e.options.Command == "" {
+		return errors.New("external cipher not configured")
+	}
+
+	if !e.supports(op) {
+		return fmt.Errorf("external cipher does not support %s", op)
+	}
+
+	// the password is passed over a pipe to keep it out of the process
+	// arguments and environment
+	r, w, err := os.Pipe()
+
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	defer w.Close()
+
+	go func() {
+		io.WriteString(w, e.password)
+		w.Close()
+	}()
+
+	var stderr bytes.Buffer
+
+	args = append(append(append([]string{}, e.options.Args...), op), args...)
+
+	c := exec.Command(e.options.Command, args...)
+	c.Stdin = stdin
+	c.Stdout = stdout
+	c.Stderr = &stderr
+	c.ExtraFiles = []*os.File{r}
+	c.Env = []string{
+		"PATH=/usr/sbin:/usr/bin:/sbin:/bin",
+		"INTERLOCK_PUBLIC_KEY=" + e.pubKey,
+		"INTERLOCK_SECRET_KEY=" + e.secKey,
+	}
+
+	if signature != nil {
+		c.ExtraFiles = append(c.ExtraFiles, signature)
+	}
+
+	if conf.Debug {
+		log.Printf("executing external cipher, cmd: %s, operation: %s\n", e.options.Command, op)
+	}
+
+	// operations run as background jobs, not bound to the issuing request
+	ctx, cancel := withTimeout(context.Background(), conf.CipherTimeout)
+	defer cancel()
+
+	if err = runContext(ctx, "external cipher "+op, c, true); err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return errors.New(msg)
+		}
+
+		return fmt.Errorf("external cipher %s failed: %v", op, err)
+	}
+
+	return
+}
+
+func (e *execCipher) Activate(activate bool) (err error) {
+	// no activation required
+	return
+}
+
+func (e *execCipher) GetInfo() cipherInfo {
+	return e.info
+}
+
+func (e *execCipher) GenKey(identifier string, email string) (pubKey string, secKey string, err error) {
+	var keys struct {
+		Public string `json:"public"`
+		Secret string `json:"secret"`
+	}
+
+	var stdout bytes.Buffer
+
+	if err = e.run(execKeygen, []string{identifier, email}, nil, &stdout, nil); err != nil {
+		return
+	}
+
+	if err = json.Unmarshal(stdout.Bytes(), &keys); err != nil {
+		return "", "", fmt.Errorf("invalid external cipher keygen output: %v", err)
+	}
+
+	return keys.Public, keys.Secret, nil
+}
+
+func (e *execCipher) GetKeyInfo(k key) (info string, err error) {
+	if err = e.SetKey(k); err != nil {
+		return
+	}
+
+	info = fmt.Sprintf("Identifier: %s, Format: %s, Cipher: %s\n", k.Identifier, k.KeyFormat, k.Cipher)
+
+	return
+}
+
+func (e *execCipher) SetPassword(password string) (err error) {
+	e.password = password
+	return
+}
+
+func (e *execCipher) SetKey(k key) (err error) {
+	keyPath := filepath.Join(conf.MountPoint, k.Path)
+
+	if _, err = volumeJail().Stat(keyPath); err != nil {
+		return
+	}
+
+	if k.Private {
+		e.secKey = keyPath
+	} else {
+		e.pubKey = keyPath
+	}
+
+	return
+}
+
+func (e *execCipher) Encrypt(input *os.File, output *os.File, sign bool) (err error) {
+	var args []string
+
+	if sign {
+		args = append(args, "--sign")
+	}
+
+	return e.run(execEncrypt, args, input, output, nil)
+}
+
+func (e *execCipher) Decrypt(input *os.File, output *os.File, verify bool) (err error) {
+	var args []string
+
+	if verify {
+		args = append(args, "--verify")
+	}
+
+	return e.run(execDecrypt, args, input, output, nil)
+}
+
+func (e *execCipher) Sign(input *os.File, output *os.File) error {
+	return e.run(execSign, nil, input, output, nil)
+}
+
+func (e *execCipher) Verify(input *os.File, signature *os.File) error {
+	return e.run(execVerify, nil, input, nil, signature)
+}
+
+func (e *execCipher) GenOTP(timestamp int64) (otp string, exp int64, err error) {
+	err = errors.New("cipher does not support OTP generation")
+	return
+}
+
+func (e *execCipher) HandleRequest(r *http.Request) (res jsonObject) {
+	res = notFound()
+	return
+}
@@ -0,0 +1,139 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// toy external cipher, the ciphertext is the base64 encoded cleartext
+// prefixed with the password, signatures are the sha256sum of the data
+const execTestCommand = `#!/bin/sh
+read -r password <&3
+
+case "$1" in
+encrypt)
+	echo "$password"
+	base64
+	;;
+decrypt)
+	read -r prefix
+	[ "$prefix" = "$password" ] || { echo "invalid password" >&2; exit 1; }
+	base64 -d
+	;;
+sign)
+	sha256sum | cut -d " " -f 1
+	;;
+verify)
+	[ "$(sha256sum | cut -d " " -f 1)" = "$(cat <&4)" ] || { echo "invalid signature" >&2; exit 1; }
+	;;
+keygen)
+	echo "{\"public\": \"pub $2\", \"secret\": \"sec $3\"}"
+	;;
+esac
+`
+
+func TestExecCipher(t *testing.T) {
+	dir := t.TempDir()
+	command := filepath.Join(dir, "cipher")
+
+	if err := ioutil.WriteFile(command, []byte(execTestCommand), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	e := &execCipher{}
+
+	if err := e.Configure(json.RawMessage(`{"command": "cipher"}`)); err == nil {
+		t.Error("relative command accepted")
+	}
+
+	if err := e.Configure(json.RawMessage(`{"command": "` + command + `", "operations": ["encrypt", "decrypt", "sign", "verify", "keygen"]}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if info := e.GetInfo(); !info.Enc || !info.Dec || !info.Sig {
+		t.Errorf("unexpected cipher info: %+v", info)
+	}
+
+	cipher := e.New()
+	cipher.SetPassword("interlocktest")
+
+	input := filepath.Join(dir, "input")
+	ioutil.WriteFile(input, []byte(testCleartext), 0600)
+
+	files := map[string]*os.File{}
+
+	for _, name := range []string{"input", "ciphertext", "decrypted", "signature"} {
+		f, err := os.OpenFile(filepath.Join(dir, name), os.O_RDWR|os.O_CREATE, 0600)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer f.Close()
+		files[name] = f
+	}
+
+	if err := cipher.Encrypt(files["input"], files["ciphertext"], false); err != nil {
+		t.Fatal(err)
+	}
+
+	files["ciphertext"].Seek(0, 0)
+
+	if err := cipher.Decrypt(files["ciphertext"], files["decrypted"], false); err != nil {
+		t.Fatal(err)
+	}
+
+	if decrypted, _ := ioutil.ReadFile(files["decrypted"].Name()); string(decrypted) != testCleartext {
+		t.Errorf("unexpected cleartext: %q", decrypted)
+	}
+
+	invalid := e.New()
+	invalid.SetPassword("invalidpassword")
+	files["ciphertext"].Seek(0, 0)
+
+	if err := invalid.Decrypt(files["ciphertext"], files["decrypted"], false); err == nil || err.Error() != "invalid password" {
+		t.Errorf("invalid password accepted: %v", err)
+	}
+
+	files["input"].Seek(0, 0)
+
+	if err := cipher.Sign(files["input"], files["signature"]); err != nil {
+		t.Fatal(err)
+	}
+
+	files["input"].Seek(0, 0)
+	files["signature"].Seek(0, 0)
+
+	if err := cipher.Verify(files["input"], files["signature"]); err != nil {
+		t.Error(err)
+	}
+
+	files["ciphertext"].Seek(0, 0)
+	files["signature"].Seek(0, 0)
+
+	if err := cipher.Verify(files["ciphertext"], files["signature"]); err == nil {
+		t.Error("invalid signature accepted")
+	}
+
+	pub, sec, err := cipher.GenKey("test", "test@example.com")
+
+	if err != nil || pub != "pub test" || sec != "sec test@example.com" {
+		t.Errorf("unexpected keys: %q %q %v", pub, sec, err)
+	}
+
+	e.Configure(json.RawMessage(`{"command": "` + command + `", "operations": ["encrypt"]}`))
+
+	if err := e.New().Sign(files["input"], files["signature"]); err == nil || !strings.Contains(err.Error(), "does not support") {
+		t.Errorf("unsupported operation executed: %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"log/syslog"
+	"sync"
+)
+
+// Internal errors, raised on code paths which cannot report them to the
+// client, are logged and counted per site to expose otherwise silent
+// failures in api/status/running.
+
+type faultCounter struct {
+	sync.Mutex
+	total int
+	sites map[string]int
+}
+
+var faults = faultCounter{
+	sites: make(map[string]int),
+}
+
+// reportError logs and counts an internal error, nil errors are ignored.
+func reportError(site string, err error) {
+	if err == nil {
+		return
+	}
+
+	faults.Lock()
+	faults.total++
+	faults.sites[site]++
+	faults.Unlock()
+
+	status.Log(syslog.LOG_ERR, "internal error (%s): %v", site, err)
+}
+
+func (f *faultCounter) Status() map[string]interface{} {
+	f.Lock()
+	defer f.Unlock()
+
+	sites := make(map[string]int)
+
+	for site, n := range f.sites {
+		sites[site] = n
+	}
+
+	return map[string]interface{}{
+		"total": f.total,
+		"sites": sites,
+	}
+}
@@ -0,0 +1,215 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/syslog"
+	"os"
+	"strings"
+)
+
+// FIDO2 volume unlock, compatible with LUKS2 keyslots enrolled with
+// `systemd-cryptenroll --fido2-device`. The keyslot passphrase is the base64
+// encoded output of the authenticator hmac-secret extension, evaluated on the
+// salt stored in the "systemd-fido2" LUKS2 token. The assertion is performed
+// with the libfido2 command line tools, on a security key attached to the
+// device, the login password is used as authenticator PIN.
+
+const fido2DefaultRP = "io.systemd.cryptsetup"
+const fido2TokenType = "systemd-fido2"
+
+const (
+	fido2Assert = "/usr/bin/fido2-assert"
+	fido2Token  = "/usr/bin/fido2-token"
+)
+
+type fido2Enrollment struct {
+	Type        string   `json:"type"`
+	Keyslots    []string `json:"keyslots"`
+	Credential  string   `json:"fido2-credential"`
+	Salt        string   `json:"fido2-salt"`
+	RP          string   `json:"fido2-rp"`
+	PINRequired bool     `json:"fido2-clientPin-required"`
+	UPRequired  *bool    `json:"fido2-up-required"`
+	UVRequired  bool     `json:"fido2-uv-required"`
+}
+
+// fido2Enrollments parses LUKS2 JSON metadata for systemd-fido2 tokens.
+func fido2Enrollments(metadata []byte) (enrollments []fido2Enrollment, err error) {
+	var luks2 struct {
+		Tokens map[string]json.RawMessage `json:"tokens"`
+	}
+
+	if err = json.Unmarshal(metadata, &luks2); err != nil {
+		return
+	}
+
+	for _, t := range luks2.Tokens {
+		var e fido2Enrollment
+
+		if err = json.Unmarshal(t, &e); err != nil {
+			return
+		}
+
+		if e.Type != fido2TokenType {
+			continue
+		}
+
+		if e.RP == "" {
+			e.RP = fido2DefaultRP
+		}
+
+		enrollments = append(enrollments, e)
+	}
+
+	if len(enrollments) == 0 {
+		err = errors.New("no FIDO2 enrollment found")
+	}
+
+	return
+}
+
+// fido2AssertInput returns the fido2-assert(1) input for hmac-secret
+// evaluation, along with its flags.
+func fido2AssertInput(e fido2Enrollment) (input string, flags []string, err error) {
+	clientDataHash := make([]byte, 32)
+
+	if _, err = rand.Read(clientDataHash); err != nil {
+		return
+	}
+
+	input = strings.Join([]string{
+		base64.StdEncoding.EncodeToString(clientDataHash),
+		e.RP,
+		e.Credential,
+		e.Salt,
+	}, "\n") + "\n"
+
+	flags = []string{"-G", "-h"}
+
+	// user presence defaults to required
+	if e.UPRequired == nil || *e.UPRequired {
+		flags = append(flags, "-t", "up=true")
+	} else {
+		flags = append(flags, "-t", "up=false")
+	}
+
+	if e.UVRequired {
+		flags = append(flags, "-t", "uv=true")
+	}
+
+	if e.PINRequired {
+		flags = append(flags, "-t", "pin=true")
+	}
+
+	return
+}
+
+// fido2Secret extracts the hmac-secret from fido2-assert(1) output, which is
+// its last line, returning it as keyslot passphrase.
+func fido2Secret(output string) (passphrase string, err error) {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	secret, err := base64.StdEncoding.DecodeString(lines[len(lines)-1])
+
+	if err != nil || len(secret) != 32 {
+		return "", errors.New("invalid FIDO2 hmac-secret")
+	}
+
+	return base64.StdEncoding.EncodeToString(secret), nil
+}
+
+// fido2Device returns the configured authenticator or the first one found.
+func fido2Device() (device string, err error) {
+	if conf.FIDO2Device != "" {
+		return conf.FIDO2Device, nil
+	}
+
+	output, err := execCommand(fido2Token, []string{"-L"}, "")
+
+	if err != nil {
+		return
+	}
+
+	// <path>: vendor=..., product=... (<manufacturer> <product>)
+	for _, line := range strings.Split(output, "\n") {
+		if i := strings.Index(line, ": "); i > 0 {
+			return line[:i], nil
+		}
+	}
+
+	return "", errors.New("no FIDO2 authenticator found")
+}
+
+// fido2Assertion runs fido2-assert(1), the assertion parameters are passed
+// with a file as, without a controlling terminal, the PIN is read from stdin.
+func fido2Assertion(device string, flags []string, input string, pin string) (output string, err error) {
+	f, err := ioutil.TempFile("", "fido2-")
+
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+
+	if _, err = f.WriteString(input); err != nil {
+		return
+	}
+
+	return execCommand(fido2Assert, append(flags, "-i", f.Name(), device), pin+"\n")
+}
+
+// fido2Passphrase derives the keyslot passphrase of a volume from the
+// attached authenticator.
+func fido2Passphrase(volume string, pin string) (passphrase string, err error) {
+	metadata, err := luksMetadata(volume)
+
+	if err != nil {
+		return
+	}
+
+	enrollments, err := fido2Enrollments([]byte(metadata))
+
+	if err != nil {
+		return
+	}
+
+	device, err := fido2Device()
+
+	if err != nil {
+		return
+	}
+
+	status.Log(syslog.LOG_NOTICE, "requesting FIDO2 assertion on %s, touch the security key", device)
+
+	for _, e := range enrollments {
+		input, flags, err := fido2AssertInput(e)
+
+		if err != nil {
+			return "", err
+		}
+
+		output, err := fido2Assertion(device, flags, input, pin)
+
+		if err != nil {
+			status.Log(syslog.LOG_NOTICE, "FIDO2 assertion failed for keyslot(s) %v", e.Keyslots)
+			continue
+		}
+
+		return fido2Secret(output)
+	}
+
+	return "", fmt.Errorf("FIDO2 authentication failed on %s", device)
+}
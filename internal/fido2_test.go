@@ -0,0 +1,85 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// LUKS2 metadata excerpt after `systemd-cryptenroll --fido2-device=auto`
+const fido2Metadata = `{
+  "keyslots": {},
+  "tokens": {
+    "0": {
+      "type": "systemd-fido2",
+      "keyslots": ["1"],
+      "fido2-credential": "dGVzdCBjcmVkZW50aWFs",
+      "fido2-salt": "c2FsdHNhbHRzYWx0c2FsdHNhbHRzYWx0c2FsdHNhbHQ=",
+      "fido2-rp": "io.systemd.cryptsetup",
+      "fido2-clientPin-required": true,
+      "fido2-up-required": true,
+      "fido2-uv-required": false
+    },
+    "1": {
+      "type": "systemd-tpm2",
+      "keyslots": ["2"]
+    }
+  }
+}`
+
+func TestFIDO2(t *testing.T) {
+	enrollments, err := fido2Enrollments([]byte(fido2Metadata))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(enrollments) != 1 || enrollments[0].Credential != "dGVzdCBjcmVkZW50aWFs" {
+		t.Fatalf("unexpected enrollments: %+v", enrollments)
+	}
+
+	input, flags, err := fido2AssertInput(enrollments[0])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(input, "\n")
+
+	if len(lines) != 5 || lines[1] != fido2DefaultRP || lines[3] != enrollments[0].Salt {
+		t.Errorf("unexpected assertion input: %q", input)
+	}
+
+	if !reflect.DeepEqual(flags, []string{"-G", "-h", "-t", "up=true", "-t", "pin=true"}) {
+		t.Errorf("unexpected assertion flags: %v", flags)
+	}
+
+	if _, err = fido2Enrollments([]byte(`{"tokens":{}}`)); err == nil {
+		t.Error("missing enrollment not detected")
+	}
+
+	// fido2-assert -G -h output: client data hash, rp id, authenticator
+	// data, signature, hmac-secret
+	output := "Y2RoCg==\nio.systemd.cryptsetup\nYXV0aGRhdGE=\nc2lnbmF0dXJl\n" +
+		"AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=\n"
+
+	passphrase, err := fido2Secret(output)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if passphrase != "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=" {
+		t.Errorf("unexpected passphrase: %s", passphrase)
+	}
+
+	if _, err = fido2Secret("c2lnbmF0dXJl\n"); err == nil {
+		t.Error("invalid hmac-secret accepted")
+	}
+}
@@ -8,10 +8,10 @@ package interlock
 
 import (
 	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"log/syslog"
 	"net/http"
@@ -19,10 +19,15 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
-	"sync"
+	"time"
 )
 
+const listBatchSize = 1000
+const ndjsonType = "application/x-ndjson"
+
 const (
 	_move = iota
 	_copy
@@ -32,70 +37,24 @@ const (
 )
 
 type inode struct {
-	Name    string `json:"name"`
-	Dir     bool   `json:"dir"`
-	Size    int64  `json:"size"`
-	Mtime   int64  `json:"mtime"`
-	KeyPath bool   `json:"key_path"`
-	Private bool   `json:"private"`
-	Key     *key   `json:"key"`
-	SHA256  string `json:"sha256"`
-}
-
-type downloadCache struct {
-	sync.Mutex
-	cache map[string]string
-}
-
-var download = downloadCache{
-	cache: make(map[string]string),
-}
-
-const traversalPattern = "../"
-
-func (d *downloadCache) Add(id string, path string) {
-	d.Lock()
-	defer d.Unlock()
-
-	// an abusive client can potentially add download entries at will,
-	// given the non persistent nature of the server, this is not
-	// considered to be an issue
-
-	d.cache[id] = path
-}
-
-func (d *downloadCache) Remove(id string) (path string, err error) {
-	d.Lock()
-	defer d.Unlock()
-	defer delete(d.cache, id)
-
-	if v, ok := d.cache[id]; ok {
-		path = v
-	} else {
-		err = errors.New("download id not found")
-	}
-
-	return
+	Name     string         `json:"name"`
+	Dir      bool           `json:"dir"`
+	Size     int64          `json:"size"`
+	Mtime    int64          `json:"mtime"`
+	KeyPath  bool           `json:"key_path"`
+	Private  bool           `json:"private"`
+	Key      *key           `json:"key"`
+	SHA256   string         `json:"sha256"`
+	Lock     *fileLock      `json:"lock"`
+	Metadata *inodeMetadata `json:"metadata"`
 }
 
-func absolutePath(subPath string) (path string, err error) {
-	if strings.Contains(subPath, traversalPattern) {
-		err = errors.New("path traversal detected")
-	}
-
-	path = filepath.Join(conf.MountPoint, subPath)
-
-	return
+func absolutePath(subPath string) (string, error) {
+	return volumeJail().Path(subPath)
 }
 
-func relativePath(p string) (subPath string) {
-	if !strings.HasPrefix(p, conf.MountPoint) {
-		subPath = path.Base(p)
-	} else {
-		subPath = p[len(conf.MountPoint):]
-	}
-
-	return
+func relativePath(p string) string {
+	return volumeJail().Rel(p)
 }
 
 func detectKeyPath(path string) (inKeyPath bool, private bool) {
@@ -129,13 +88,13 @@ func fileNewfile(r *http.Request) (res jsonObject) {
 		return errorResponse(err, "")
 	}
 
-	err = validateRequest(req, []string{"path:s", "contents:s"})
+	name, err := filenamePath(req["path"].(string))
 
 	if err != nil {
 		return errorResponse(err, "")
 	}
 
-	path, err := absolutePath(req["path"].(string))
+	path, err := absolutePath(name)
 
 	if err != nil {
 		return errorResponse(err, "")
@@ -147,14 +106,20 @@ func fileNewfile(r *http.Request) (res jsonObject) {
 		return errorResponse(errors.New("creating files within key storage is not allowed"), "")
 	}
 
-	_, err = os.Stat(path)
+	_, err = volumeJail().Stat(path)
 
 	if err == nil {
 		return errorResponse(fmt.Errorf("path %s exists, not overwriting", relativePath(path)), "")
 	}
 
+	err = locks.Check(path, lockToken(r))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
 	contents := req["contents"].(string)
-	err = ioutil.WriteFile(path, []byte(contents), 0644)
+	err = volumeJail().WriteFile(path, []byte(contents), 0644)
 
 	if err != nil {
 		return errorResponse(errors.New("cannot create file"), "")
@@ -189,32 +154,31 @@ func fileCompress(w http.ResponseWriter, r *http.Request) (res jsonObject) {
 		return errorResponse(err, "")
 	}
 
-	err = validateRequest(req, []string{"src:a", "dst:s"})
-
-	if err != nil {
-		return errorResponse(err, "")
-	}
-
 	dst, err := absolutePath(req["dst"].(string))
 
 	if err != nil {
 		return errorResponse(err, "")
 	}
 
-	switch filepath.Ext(dst) {
-	case ".zip", ".ZIP":
-		src := req["src"].([]interface{})
-		s := make([]string, len(src))
+	// optional archive password
+	password, _ := req["password"].(string)
 
-		for i := range src {
-			s[i], err = absolutePath(src[i].(string))
+	src := req["src"].([]interface{})
+	s := make([]string, len(src))
 
-			if err != nil {
-				return errorResponse(err, "")
-			}
+	for i := range src {
+		s[i], err = absolutePath(src[i].(string))
+
+		if err != nil {
+			return errorResponse(err, "")
 		}
+	}
 
-		err = zipPath(s, dst)
+	switch filepath.Ext(dst) {
+	case ".zip", ".ZIP":
+		err = zipPath(jobOwner(r), s, dst, password)
+	case ".7z", ".7Z":
+		err = sevenZipPath(jobOwner(r), s, dst, password)
 	default:
 		err = errors.New("unsupported archive format")
 	}
@@ -243,20 +207,25 @@ func fileMultiOp(r *http.Request, mode int) (res jsonObject) {
 
 	switch mode {
 	case _move, _copy, _extract:
-		err = validateRequest(req, []string{"src:a", "dst:s"})
 		srcAttr = "src"
+		dst, err = filenamePath(req["dst"].(string))
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+
+		dst, err = absolutePath(dst)
 
 		if err != nil {
 			return errorResponse(err, "")
 		}
 
-		dst, err = absolutePath(req["dst"].(string))
+		err = locks.Check(dst, lockToken(r))
 
 		if err != nil {
 			return errorResponse(err, "")
 		}
 	case _mkdir, _delete:
-		err = validateRequest(req, []string{"path:a"})
 		srcAttr = "path"
 	default:
 		err = errors.New("unsupported operation")
@@ -267,13 +236,31 @@ func fileMultiOp(r *http.Request, mode int) (res jsonObject) {
 	}
 
 	for _, file := range req[srcAttr].([]interface{}) {
-		path, err := absolutePath(file.(string))
+		name := file.(string)
+
+		if mode == _mkdir {
+			name, err = filenamePath(name)
+
+			if err != nil {
+				return errorResponse(err, "")
+			}
+		}
+
+		path, err := absolutePath(name)
 
 		if err != nil {
 			return errorResponse(err, "")
 		}
 
-		err = fileOp(path, dst, mode)
+		if mode == _move || mode == _delete {
+			err = locks.Check(path, lockToken(r))
+
+			if err != nil {
+				return errorResponse(err, "")
+			}
+		}
+
+		err = fileOp(jobOwner(r), path, dst, mode)
 
 		if err != nil {
 			return errorResponse(err, "")
@@ -288,7 +275,7 @@ func fileMultiOp(r *http.Request, mode int) (res jsonObject) {
 	return
 }
 
-func fileOp(src string, dst string, mode int) (err error) {
+func fileOp(owner string, src string, dst string, mode int) (err error) {
 	switch mode {
 	case _move, _copy, _extract:
 		inKeyPath, private := detectKeyPath(src)
@@ -302,46 +289,59 @@ func fileOp(src string, dst string, mode int) (err error) {
 		case _copy, _move:
 			var stat os.FileInfo
 
-			stat, err = os.Stat(dst)
+			stat, err = volumeJail().Stat(dst)
 
 			if err == nil && !stat.IsDir() {
 				err = fmt.Errorf("path %s exists", relativePath(dst))
 				break
 			}
 
+			target := dst
+
 			if err == nil && stat.IsDir() {
-				d := filepath.Join(dst, path.Base(src))
-				_, err = os.Stat(d)
+				target = filepath.Join(dst, path.Base(src))
+				_, err = volumeJail().Stat(target)
 
 				if err == nil {
-					err = fmt.Errorf("path %s exists", relativePath(d))
+					err = fmt.Errorf("path %s exists", relativePath(target))
 					break
 				}
+
+				if conf.FilenameCaseCollisions == "refuse" {
+					if existing, found := caseCollision(dst, path.Base(src)); found {
+						err = fmt.Errorf("path %s collides with existing %s", relativePath(target), existing)
+						break
+					}
+				}
 			}
 
 			if mode == _copy {
-				err = cp(src, dst)
-			} else {
-				err = mv(src, dst)
+				id := journal.Begin("copy", src, dst, target)
+				err = copyTree(src, target)
+				journal.End(id)
+			} else if err = volumeJail().Rename(src, target); err == nil {
+				reportError("honeytoken registry", honeytokens.Moved(src, target))
 			}
 		case _extract:
 			switch filepath.Ext(src) {
 			case ".zip", ".ZIP":
-				err = unzipFile(src, dst)
+				err = unzipFile(owner, src, dst)
 			default:
 				err = errors.New("unsupported archive format")
 			}
 		}
 	case _mkdir, _delete:
 		if mode == _mkdir {
-			err = os.MkdirAll(src, 0700)
+			err = volumeJail().MkdirAll(src, 0700)
 		} else { // _delete
-			err = os.RemoveAll(src)
+			err = volumeJail().RemoveAll(src)
 
 			if err != nil {
 				break
 			}
 
+			reportError("honeytoken registry", honeytokens.Deleted(src))
+
 			status.Log(syslog.LOG_NOTICE, "deleted %s", relativePath(src))
 		}
 	default:
@@ -351,14 +351,147 @@ func fileOp(src string, dst string, mode int) (err error) {
 	return
 }
 
-func fileList(r *http.Request) (res jsonObject) {
-	req, err := parseRequest(r)
+// copyTree copies src to dst within the encrypted volume, preserving
+// permissions and modification times, symbolic links are copied according to
+// the symbolic link policy.
+func copyTree(src string, dst string) (err error) {
+	j := volumeJail()
+
+	if (&jail{root: src}).Contains(dst) {
+		return fmt.Errorf("cannot copy %s into itself", relativePath(src))
+	}
+
+	return j.Walk(src, func(osPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dst, strings.TrimPrefix(osPath, src))
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, linked, err := archiveLink(osPath)
+
+			if err != nil {
+				return err
+			}
+
+			if linked == nil {
+				return extractLink(target, link)
+			}
+
+			info = linked
+		}
+
+		switch {
+		case info.IsDir():
+			return j.Mkdir(target, info.Mode().Perm()|0700)
+		case info.Mode().IsRegular():
+			return copyFileMode(j, osPath, target, info)
+		default:
+			return fmt.Errorf("cannot copy %s, unsupported file type", relativePath(osPath))
+		}
+	})
+}
+
+func copyFileMode(j *jail, src string, dst string, info os.FileInfo) (err error) {
+	input, err := j.Open(src)
 
 	if err != nil {
-		return errorResponse(err, "")
+		return
+	}
+	defer input.Close()
+
+	output, err := j.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+
+	if err != nil {
+		return
+	}
+
+	_, err = io.Copy(output, input)
+
+	if e := output.Close(); err == nil {
+		err = e
+	}
+
+	if err != nil {
+		return
+	}
+
+	return j.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// listInode returns the inode for a directory entry.
+func listInode(path string, file os.DirEntry, req jsonObject) (i inode, err error) {
+	info, err := file.Info()
+
+	if err != nil {
+		return
+	}
+
+	filePath := filepath.Join(path, file.Name())
+	inKeyPath, private := detectKeyPath(filePath)
+
+	i = inode{
+		Name:    file.Name(),
+		Dir:     file.IsDir(),
+		Size:    info.Size(),
+		Mtime:   info.ModTime().Unix(),
+		KeyPath: inKeyPath,
+		Private: private,
+		Lock:    locks.Holder(filePath),
+	}
+
+	if !file.IsDir() && inKeyPath {
+		key, _, err := getKey(filePath)
+
+		if err == nil {
+			i.Key = &key
+		} else {
+			status.Log(syslog.LOG_ERR, "error parsing %s, %s", file.Name(), err.Error())
+			i.Key = nil
+		}
+	}
+
+	if metadata, ok := req["metadata"].(bool); ok && metadata {
+		i.Metadata, err = getMetadata(filePath)
+
+		if err != nil {
+			status.Log(syslog.LOG_ERR, "error reading %s metadata, %s", file.Name(), err.Error())
+		}
+	}
+
+	if !file.IsDir() && req["sha256"].(bool) {
+		i.SHA256, _ = fileSHA256(filePath)
+	}
+
+	return i, nil
+}
+
+func fileSHA256(path string) (sum string, err error) {
+	f, err := volumeJail().Open(path)
+
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	h := sha256.New()
+
+	if _, err = io.Copy(h, f); err != nil {
+		return
 	}
 
-	err = validateRequest(req, []string{"path:s", "sha256:b"})
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// fileList streams the directory listing, reading entries in batches, to
+// bound memory usage on large directories. Clients accepting
+// application/x-ndjson receive the status object followed by one inode per
+// line, a single JSON response object is returned otherwise.
+//
+// Inodes are not sorted.
+func fileList(w http.ResponseWriter, r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
 
 	if err != nil {
 		return errorResponse(err, "")
@@ -370,11 +503,31 @@ func fileList(r *http.Request) (res jsonObject) {
 		return errorResponse(err, "")
 	}
 
-	fileInfo, err := ioutil.ReadDir(path)
+	dir, err := volumeJail().Open(path)
 
 	if err != nil {
 		return errorResponse(err, "")
 	}
+	defer dir.Close()
+
+	// the first batch is read before responding to report errors
+	entries, err := dir.ReadDir(listBatchSize)
+
+	if err != nil && err != io.EOF {
+		return errorResponse(err, "")
+	}
+
+	if order, _ := req["sort"].(string); order != "" && order != "none" {
+		var rest []os.DirEntry
+
+		// sorting requires reading the whole directory
+		if rest, err = dir.ReadDir(-1); err != nil {
+			return errorResponse(err, "")
+		}
+
+		entries = append(entries, rest...)
+		sortEntries(entries, order)
+	}
 
 	total, free, err := fsStatus(path)
 
@@ -382,62 +535,106 @@ func fileList(r *http.Request) (res jsonObject) {
 		return errorResponse(err, "")
 	}
 
-	inodes := []inode{}
+	ndjson := strings.Contains(r.Header.Get("Accept"), ndjsonType)
+	flusher, _ := w.(http.Flusher)
 
-	for _, file := range fileInfo {
-		if file.Name() == "lost+found" {
-			continue
-		}
+	if ndjson {
+		w.Header().Set("Content-Type", ndjsonType)
+		fmt.Fprintf(w, `{"status":"OK","response":{"total_space":%d,"free_space":%d}}`+"\n", total, free)
+	} else {
+		fmt.Fprintf(w, `{"status":"OK","response":{"total_space":%d,"free_space":%d,"inodes":[`, total, free)
+	}
 
-		filePath := filepath.Join(path, file.Name())
-		inKeyPath, private := detectKeyPath(filePath)
+	n := 0
+	names := make(map[string][]string)
 
-		inode := inode{
-			Name:    file.Name(),
-			Dir:     file.IsDir(),
-			Size:    file.Size(),
-			Mtime:   file.ModTime().Unix(),
-			KeyPath: inKeyPath,
-			Private: private,
-		}
+	for len(entries) > 0 {
+		for _, file := range entries {
+			if file.Name() == "lost+found" {
+				continue
+			}
+
+			key := caseKey(file.Name())
+			names[key] = append(names[key], file.Name())
 
-		if !file.IsDir() && inKeyPath {
-			key, _, err := getKey(filePath)
+			i, err := listInode(path, file, req)
 
-			if err == nil {
-				inode.Key = &key
-			} else {
-				status.Log(syslog.LOG_ERR, "error parsing %s, %s", file.Name(), err.Error())
-				inode.Key = nil
+			if err != nil {
+				// the response is already in progress
+				status.Log(syslog.LOG_ERR, "error listing %s, %s", file.Name(), err.Error())
+				continue
 			}
-		}
 
-		if !file.IsDir() && req["sha256"].(bool) {
-			f, err := os.Open(filePath)
+			buf, err := json.Marshal(i)
 
-			if err == nil {
-				defer f.Close()
+			if err != nil {
+				reportError("file listing", err)
+				continue
+			}
 
-				h := sha256.New()
+			switch {
+			case ndjson:
+				buf = append(buf, '\n')
+			case n > 0:
+				buf = append([]byte{','}, buf...)
+			}
 
-				if _, err := io.Copy(h, f); err == nil {
-					inode.SHA256 = fmt.Sprintf("%x", h.Sum(nil))
-				}
+			if _, err = w.Write(buf); err != nil {
+				return
 			}
+
+			n++
+		}
+
+		if flusher != nil {
+			flusher.Flush()
 		}
 
-		inodes = append(inodes, inode)
+		if entries, err = dir.ReadDir(listBatchSize); err != nil && err != io.EOF {
+			status.Log(syslog.LOG_ERR, "error listing %s, %s", path, err.Error())
+			break
+		}
 	}
 
-	res = jsonObject{
-		"status": "OK",
-		"response": map[string]interface{}{
-			"total_space": total,
-			"free_space":  free,
-			"inodes":      inodes,
-		},
+	collisions, _ := json.Marshal(caseCollisions(names))
+
+	if ndjson {
+		if len(collisions) > 2 {
+			fmt.Fprintf(w, `{"collisions":%s}`+"\n", collisions)
+		}
+	} else {
+		fmt.Fprintf(w, `],"collisions":%s}}`, collisions)
+	}
+
+	return
+}
+
+func sortEntries(entries []os.DirEntry, order string) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		if order == "natural" {
+			return naturalLess(entries[i].Name(), entries[j].Name())
+		}
+
+		return entries[i].Name() < entries[j].Name()
+	})
+}
+
+// caseCollisions returns the groups of names colliding on case-insensitive
+// file systems.
+func caseCollisions(names map[string][]string) (collisions [][]string) {
+	collisions = [][]string{}
+
+	for _, group := range names {
+		if len(group) > 1 {
+			sort.Strings(group)
+			collisions = append(collisions, group)
+		}
 	}
 
+	sort.Slice(collisions, func(i, j int) bool {
+		return collisions[i][0] < collisions[j][0]
+	})
+
 	return
 }
 
@@ -461,6 +658,12 @@ func fileUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	fileName, err = filenamePath(fileName)
+
+	if err != nil {
+		return
+	}
+
 	osPath, err := absolutePath(fileName)
 
 	if err != nil {
@@ -469,47 +672,160 @@ func fileUpload(w http.ResponseWriter, r *http.Request) {
 
 	osDir := path.Dir(osPath)
 
-	_, err = os.Stat(osPath)
+	_, err = volumeJail().Stat(osPath)
 
 	if err == nil && overwrite != "true" {
 		err = fmt.Errorf("path %s exists, not overwriting", osPath)
 		return
 	}
 
-	err = os.MkdirAll(osDir, 0700)
+	err = locks.Check(osPath, lockToken(r))
 
 	if err != nil {
 		return
 	}
 
-	osFile, err := os.Create(osPath)
-	_ = osFile.Chmod(0600)
+	err = volumeJail().MkdirAll(osDir, 0700)
+
+	if err != nil {
+		return
+	}
+
+	if compressedPath(osPath) {
+		var written int64
+		var osFile *os.File
+
+		n := status.Notify(syslog.LOG_NOTICE, "uploading %s", relativePath(osPath))
+		defer status.Remove(n)
+
+		written, err = compressStore(osPath, r.Body)
+
+		if err != nil {
+			return
+		}
+
+		osFile, err = volumeJail().Open(osPath)
+
+		if err != nil {
+			return
+		}
+		defer osFile.Close()
+
+		err = uploadMetadata(osFile, r)
+
+		if err != nil {
+			return
+		}
+
+		status.Log(syslog.LOG_INFO, "uploaded %s (%v bytes)", relativePath(osPath), written)
+		uploadCompleted(osPath, written)
+
+		return
+	}
+
+	if conf.Dedup {
+		var written int64
+		var osFile *os.File
+
+		n := status.Notify(syslog.LOG_NOTICE, "uploading %s", relativePath(osPath))
+		defer status.Remove(n)
+
+		// hard links would share metadata with the existing file
+		link := r.Header.Get("X-Uploadmode") == "" && r.Header.Get("X-Uploadmtime") == ""
+		written, err = dedup.Store(osPath, r.Body, link)
+
+		if err != nil {
+			return
+		}
+
+		osFile, err = volumeJail().Open(osPath)
+
+		if err != nil {
+			return
+		}
+		defer osFile.Close()
+
+		if err = uploadMetadata(osFile, r); err != nil {
+			return
+		}
+
+		status.Log(syslog.LOG_INFO, "uploaded %s (%v bytes)", relativePath(osPath), written)
+		uploadCompleted(osPath, written)
+
+		return
+	}
+
+	osFile, err := createAtomic("upload", "", osPath, false)
 
 	if err != nil {
 		return
 	}
-	defer osFile.Close()
 
 	n := status.Notify(syslog.LOG_NOTICE, "uploading %s", relativePath(osPath))
 	defer status.Remove(n)
 
 	written, err := io.Copy(osFile, r.Body)
 
+	if err == nil {
+		err = uploadMetadata(osFile.File, r)
+	}
+
 	if err != nil {
+		osFile.Abort()
+		return
+	}
+
+	if err = osFile.Commit(); err != nil {
 		return
 	}
 
 	status.Log(syslog.LOG_INFO, "uploaded %s (%v bytes)", relativePath(osPath), written)
+	uploadCompleted(osPath, written)
 }
 
-func fileDownload(r *http.Request) (res jsonObject) {
-	req, err := parseRequest(r)
+func uploadCompleted(osPath string, size int64) {
+	emitEvent(eventUpload, map[string]interface{}{
+		"path": relativePath(osPath),
+		"size": size,
+	})
 
-	if err != nil {
-		return errorResponse(err, "")
+	checkDiskSpace()
+}
+
+// uploadMetadata applies the optional file mode (octal) and modification time
+// (epoch) specified by the uploading client.
+func uploadMetadata(osFile *os.File, r *http.Request) (err error) {
+	if mode := r.Header.Get("X-Uploadmode"); mode != "" {
+		var perm uint64
+
+		perm, err = strconv.ParseUint(mode, 8, 32)
+
+		if err != nil {
+			return
+		}
+
+		if err = osFile.Chmod(os.FileMode(perm) & os.ModePerm); err != nil {
+			return
+		}
+	}
+
+	if mtime := r.Header.Get("X-Uploadmtime"); mtime != "" {
+		var t int64
+
+		t, err = strconv.ParseInt(mtime, 10, 64)
+
+		if err != nil {
+			return
+		}
+
+		err = volumeJail().Chtimes(osFile.Name(), time.Unix(t, 0), time.Unix(t, 0))
 	}
 
-	err = validateRequest(req, []string{"path:s"})
+	return
+}
+
+func fileDownload(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
 
 	if err != nil {
 		return errorResponse(err, "")
@@ -527,7 +843,7 @@ func fileDownload(r *http.Request) (res jsonObject) {
 		return errorResponse(errors.New("downloading private key(s) is not allowed"), "")
 	}
 
-	_, err = os.Stat(osPath)
+	_, err = volumeJail().Stat(osPath)
 
 	if err != nil {
 		return errorResponse(err, "")
@@ -539,7 +855,7 @@ func fileDownload(r *http.Request) (res jsonObject) {
 		return errorResponse(err, "")
 	}
 
-	download.Add(id, osPath)
+	download.Add(r, id, osPath)
 
 	res = jsonObject{
 		"status":   "OK",
@@ -549,7 +865,7 @@ func fileDownload(r *http.Request) (res jsonObject) {
 	return
 }
 
-func fileDownloadByID(w http.ResponseWriter, id string) {
+func fileDownloadByID(w http.ResponseWriter, r *http.Request, id string) {
 	var err error
 	var written int64
 
@@ -560,13 +876,13 @@ func fileDownloadByID(w http.ResponseWriter, id string) {
 		}
 	}()
 
-	osPath, err := download.Remove(id)
+	osPath, err := download.Remove(r, id)
 
 	if err != nil {
 		return
 	}
 
-	stat, err := os.Stat(osPath)
+	stat, err := volumeJail().Stat(osPath)
 
 	if err != nil {
 		return
@@ -584,19 +900,21 @@ func fileDownloadByID(w http.ResponseWriter, id string) {
 	w.Header().Set("Content-Disposition", "attachment; filename=\""+fileName+"\"")
 	w.Header().Set("Content-Type", "application/octet-stream")
 	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Last-Modified", stat.ModTime().UTC().Format(http.TimeFormat))
+	w.Header().Set("X-Filemode", fmt.Sprintf("%04o", stat.Mode().Perm()))
 
 	if stat.IsDir() {
-		written, err = zipWriter([]string{osPath}, w)
+		written, err = zipWriter([]string{osPath}, w, "")
 	} else {
-		var input *os.File
-		input, err = os.Open(osPath)
+		var input io.ReadCloser
+		input, err = openStored(osPath)
 
 		if err != nil {
 			return
 		}
 		defer input.Close()
 
-		written, err = io.Copy(w, input)
+		written, err = sendStored(w, input)
 	}
 
 	if err != nil {
@@ -606,14 +924,35 @@ func fileDownloadByID(w http.ResponseWriter, id string) {
 	status.Log(syslog.LOG_INFO, "downloaded %s (%v bytes)", fileName, written)
 }
 
-func fileEncrypt(r *http.Request) (res jsonObject) {
-	req, err := parseRequest(r)
+// sendStored writes a stored file to the response with its length, avoiding
+// chunked encoding so that plaintext files are transferred with sendfile(2)
+// by net/http on plain TCP connections, rather than copied in userspace.
+func sendStored(w http.ResponseWriter, input io.Reader) (written int64, err error) {
+	var size int64
 
-	if err != nil {
-		return errorResponse(err, "")
+	switch f := input.(type) {
+	case *os.File:
+		var stat os.FileInfo
+
+		if stat, err = f.Stat(); err != nil {
+			return
+		}
+
+		size = stat.Size()
+	case *compressedReader:
+		size = f.size
+	default:
+		return io.Copy(w, input)
 	}
 
-	err = validateRequest(req, []string{"src:s", "cipher:s", "wipe_src:b", "sign:b", "password:s", "key:s", "sig_key:s"})
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+
+	// the limited reader retains the *os.File for sendfile(2)
+	return io.CopyN(w, input, size)
+}
+
+func fileEncrypt(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
 
 	if err != nil {
 		return errorResponse(err, "")
@@ -647,33 +986,59 @@ func fileEncrypt(r *http.Request) (res jsonObject) {
 	}
 
 	if cipher.GetInfo().KeyFormat != "password" {
-		keyPath = filepath.Join(conf.MountPoint, keyPath)
+		keyPath, err = absolutePath(keyPath)
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+
 		key, _, err := getKey(keyPath)
 
 		if err != nil {
 			return errorResponse(err, "")
 		}
 
+		err = checkRevoked(key, keyUsageEncrypt)
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+
 		err = cipher.SetKey(key)
 
 		if err != nil {
 			return errorResponse(err, "")
 		}
+
+		recordKeyUsage(key, keyUsageEncrypt, relativePath(src))
 	}
 
 	if sign && cipher.GetInfo().Sig {
-		sigKeyPath = filepath.Join(conf.MountPoint, sigKeyPath)
+		sigKeyPath, err = absolutePath(sigKeyPath)
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+
 		key, _, err := getKey(sigKeyPath)
 
 		if err != nil {
 			return errorResponse(err, "")
 		}
 
+		err = checkRevoked(key, keyUsageSign)
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+
 		err = cipher.SetKey(key)
 
 		if err != nil {
 			return errorResponse(err, "")
 		}
+
+		recordKeyUsage(key, keyUsageSign, relativePath(src))
 	} else if sign && !cipher.GetInfo().Sig {
 		return errorResponse(errors.New("signing requested but not supported by cipher"), "")
 	}
@@ -686,7 +1051,7 @@ func fileEncrypt(r *http.Request) (res jsonObject) {
 		}
 	}
 
-	input, err := os.Open(src)
+	input, err := volumeJail().Open(src)
 
 	if err != nil {
 		input.Close()
@@ -694,22 +1059,26 @@ func fileEncrypt(r *http.Request) (res jsonObject) {
 	}
 
 	outputPath := src + "." + cipher.GetInfo().Extension
-	output, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_TRUNC, 0600)
+	output, err := createAtomic("encrypt", src, outputPath, true)
 
 	if err != nil {
 		input.Close()
-		output.Close()
 		return errorResponse(err, "")
 	}
 
-	go func() {
+	jobs.Go(jobOwner(r), "encrypting", func() {
 		defer input.Close()
-		defer output.Close()
 
 		n := status.Notify(syslog.LOG_INFO, "encrypting %s", relativePath(src))
 		defer status.Remove(n)
 
-		err = cipher.Encrypt(input, output, sign)
+		err = cipher.Encrypt(input, output.File, sign)
+
+		if err == nil {
+			err = output.Commit()
+		} else {
+			output.Abort()
+		}
 
 		if err != nil {
 			status.Error(err)
@@ -717,7 +1086,7 @@ func fileEncrypt(r *http.Request) (res jsonObject) {
 		}
 
 		if wipe {
-			err = os.Remove(src)
+			err = volumeJail().Remove(src)
 		}
 
 		if err != nil {
@@ -726,7 +1095,7 @@ func fileEncrypt(r *http.Request) (res jsonObject) {
 		}
 
 		status.Log(syslog.LOG_NOTICE, "completed encryption of %s", relativePath(src))
-	}()
+	})
 
 	res = jsonObject{
 		"status":   "OK",
@@ -745,12 +1114,6 @@ func fileDecrypt(r *http.Request) (res jsonObject) {
 		return errorResponse(err, "")
 	}
 
-	err = validateRequest(req, []string{"src:s", "password:s", "verify:b", "key:s", "sig_key:s", "cipher:s"})
-
-	if err != nil {
-		return errorResponse(err, "")
-	}
-
 	src, err := absolutePath(req["src"].(string))
 
 	if err != nil {
@@ -786,7 +1149,12 @@ func fileDecrypt(r *http.Request) (res jsonObject) {
 	}
 
 	if cipher.GetInfo().KeyFormat != "password" {
-		keyPath = filepath.Join(conf.MountPoint, keyPath)
+		keyPath, err = absolutePath(keyPath)
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+
 		key, _, err := getKey(keyPath)
 
 		if err != nil {
@@ -798,6 +1166,8 @@ func fileDecrypt(r *http.Request) (res jsonObject) {
 		if err != nil {
 			return errorResponse(err, "")
 		}
+
+		recordKeyUsage(key, keyUsageDecrypt, relativePath(src))
 	}
 
 	err = cipher.SetPassword(password)
@@ -807,7 +1177,12 @@ func fileDecrypt(r *http.Request) (res jsonObject) {
 	}
 
 	if verify && cipher.GetInfo().Sig {
-		sigKeyPath = filepath.Join(conf.MountPoint, sigKeyPath)
+		sigKeyPath, err = absolutePath(sigKeyPath)
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+
 		key, _, err := getKey(sigKeyPath)
 
 		if err != nil {
@@ -819,33 +1194,39 @@ func fileDecrypt(r *http.Request) (res jsonObject) {
 		if err != nil {
 			return errorResponse(err, "")
 		}
+
+		recordKeyUsage(key, keyUsageVerify, relativePath(src))
 	} else if verify && !cipher.GetInfo().Sig {
 		return errorResponse(errors.New("signature verification requested but not supported by cipher"), "")
 	}
 
-	input, err := os.Open(src)
+	input, err := volumeJail().Open(src)
 
 	if err != nil {
 		input.Close()
 		return errorResponse(err, "")
 	}
 
-	output, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_TRUNC, 0600)
+	output, err := createAtomic("decrypt", src, outputPath, true)
 
 	if err != nil {
 		input.Close()
-		output.Close()
 		return errorResponse(err, "")
 	}
 
-	go func() {
+	jobs.Go(jobOwner(r), "decrypting", func() {
 		defer input.Close()
-		defer output.Close()
 
 		n := status.Notify(syslog.LOG_INFO, "decrypting %s", relativePath(src))
 		defer status.Remove(n)
 
-		err = cipher.Decrypt(input, output, verify)
+		err = cipher.Decrypt(input, output.File, verify)
+
+		if err == nil {
+			err = output.Commit()
+		} else {
+			output.Abort()
+		}
 
 		if err != nil {
 			status.Error(err)
@@ -853,7 +1234,7 @@ func fileDecrypt(r *http.Request) (res jsonObject) {
 		}
 
 		status.Log(syslog.LOG_NOTICE, "completed decryption of %s", relativePath(src))
-	}()
+	})
 
 	res = jsonObject{
 		"status":   "OK",
@@ -870,12 +1251,6 @@ func fileSign(r *http.Request) (res jsonObject) {
 		return errorResponse(err, "")
 	}
 
-	err = validateRequest(req, []string{"src:s", "cipher:s", "password:s", "key:s"})
-
-	if err != nil {
-		return errorResponse(err, "")
-	}
-
 	src, err := absolutePath(req["src"].(string))
 
 	if err != nil {
@@ -896,19 +1271,32 @@ func fileSign(r *http.Request) (res jsonObject) {
 		return errorResponse(errors.New("signing requested but not supported by cipher"), "")
 	}
 
-	keyPath = filepath.Join(conf.MountPoint, keyPath)
+	keyPath, err = absolutePath(keyPath)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
 	key, _, err := getKey(keyPath)
 
 	if err != nil {
 		return errorResponse(err, "")
 	}
 
+	err = checkRevoked(key, keyUsageSign)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
 	err = cipher.SetKey(key)
 
 	if err != nil {
 		return errorResponse(err, "")
 	}
 
+	recordKeyUsage(key, keyUsageSign, relativePath(src))
+
 	if password != "" {
 		err = cipher.SetPassword(password)
 
@@ -917,7 +1305,7 @@ func fileSign(r *http.Request) (res jsonObject) {
 		}
 	}
 
-	input, err := os.Open(src)
+	input, err := volumeJail().Open(src)
 
 	if err != nil {
 		input.Close()
@@ -925,22 +1313,26 @@ func fileSign(r *http.Request) (res jsonObject) {
 	}
 
 	outputPath := src + "." + cipher.GetInfo().Extension + "-signature"
-	output, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_TRUNC, 0600)
+	output, err := createAtomic("sign", src, outputPath, true)
 
 	if err != nil {
 		input.Close()
-		output.Close()
 		return errorResponse(err, "")
 	}
 
-	go func() {
+	jobs.Go(jobOwner(r), "signing", func() {
 		defer input.Close()
-		defer output.Close()
 
 		n := status.Notify(syslog.LOG_INFO, "signing %s", relativePath(src))
 		defer status.Remove(n)
 
-		err = cipher.Sign(input, output)
+		err = cipher.Sign(input, output.File)
+
+		if err == nil {
+			err = output.Commit()
+		} else {
+			output.Abort()
+		}
 
 		if err != nil {
 			status.Error(err)
@@ -948,7 +1340,7 @@ func fileSign(r *http.Request) (res jsonObject) {
 		}
 
 		status.Log(syslog.LOG_NOTICE, "completed signing of %s", relativePath(src))
-	}()
+	})
 
 	res = jsonObject{
 		"status":   "OK",
@@ -965,12 +1357,6 @@ func fileVerify(r *http.Request) (res jsonObject) {
 		return errorResponse(err, "")
 	}
 
-	err = validateRequest(req, []string{"src:s", "sig:s", "key:s", "cipher:s"})
-
-	if err != nil {
-		return errorResponse(err, "")
-	}
-
 	src, err := absolutePath(req["src"].(string))
 
 	if err != nil {
@@ -997,7 +1383,12 @@ func fileVerify(r *http.Request) (res jsonObject) {
 	}
 
 	if cipher.GetInfo().KeyFormat != "password" {
-		sigKeyPath = filepath.Join(conf.MountPoint, sigKeyPath)
+		sigKeyPath, err = absolutePath(sigKeyPath)
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+
 		key, _, err := getKey(sigKeyPath)
 
 		if err != nil {
@@ -1009,15 +1400,17 @@ func fileVerify(r *http.Request) (res jsonObject) {
 		if err != nil {
 			return errorResponse(err, "")
 		}
+
+		recordKeyUsage(key, keyUsageVerify, relativePath(src))
 	}
 
-	input, err := os.Open(src)
+	input, err := volumeJail().Open(src)
 
 	if err != nil {
 		return errorResponse(err, "")
 	}
 
-	sig, err := os.Open(sigPath)
+	sig, err := volumeJail().Open(sigPath)
 
 	if err != nil {
 		input.Close()
@@ -1025,7 +1418,7 @@ func fileVerify(r *http.Request) (res jsonObject) {
 		return errorResponse(err, "")
 	}
 
-	go func() {
+	jobs.Go(jobOwner(r), "verifying", func() {
 		defer input.Close()
 		defer sig.Close()
 
@@ -1040,7 +1433,117 @@ func fileVerify(r *http.Request) (res jsonObject) {
 		}
 
 		status.Log(syslog.LOG_NOTICE, "successful verification of %s", relativePath(src))
-	}()
+	})
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": nil,
+	}
+
+	return
+}
+
+func fileRewrap(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	src, err := absolutePath(req["src"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	dst, err := absolutePath(req["dst"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	password := req["password"].(string)
+	cipherName := req["cipher"].(string)
+
+	cipher, err := conf.GetCipher(cipherName)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	rewrapper, ok := cipher.(cipherRewrapper)
+
+	if !ok {
+		return errorResponse(errors.New("rewrap not supported by cipher"), "")
+	}
+
+	keys := make(map[string]key)
+
+	for _, k := range []string{"key", "recipient"} {
+		keyPath, err := absolutePath(req[k].(string))
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+
+		keys[k], _, err = getKey(keyPath)
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+
+		if err = cipher.SetKey(keys[k]); err != nil {
+			return errorResponse(err, "")
+		}
+	}
+
+	if err = checkRevoked(keys["recipient"], keyUsageEncrypt); err != nil {
+		return errorResponse(err, "")
+	}
+
+	if password != "" {
+		if err = cipher.SetPassword(password); err != nil {
+			return errorResponse(err, "")
+		}
+	}
+
+	recordKeyUsage(keys["key"], keyUsageDecrypt, relativePath(src))
+	recordKeyUsage(keys["recipient"], keyUsageEncrypt, relativePath(dst))
+
+	input, err := volumeJail().Open(src)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	output, err := createAtomic("rewrap", src, dst, true)
+
+	if err != nil {
+		input.Close()
+		return errorResponse(err, "")
+	}
+
+	jobs.Go(jobOwner(r), "rewrapping", func() {
+		defer input.Close()
+
+		n := status.Notify(syslog.LOG_INFO, "rewrapping %s", relativePath(src))
+		defer status.Remove(n)
+
+		err = rewrapper.Rewrap(input, output.File)
+
+		if err == nil {
+			err = output.Commit()
+		} else {
+			output.Abort()
+		}
+
+		if err != nil {
+			status.Error(err)
+			return
+		}
+
+		status.Log(syslog.LOG_NOTICE, "completed rewrap of %s to %s", relativePath(src), relativePath(dst))
+	})
 
 	res = jsonObject{
 		"status":   "OK",
@@ -0,0 +1,316 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+//go:generate sh -c "python3 unicode_gen.py | gofmt > unicode_tables.go"
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Hangul syllables are composed and decomposed algorithmically (Unicode
+// Standard, Section 3.12).
+const (
+	hangulSBase  = 0xAC00
+	hangulLBase  = 0x1100
+	hangulVBase  = 0x1161
+	hangulTBase  = 0x11A7
+	hangulLCount = 19
+	hangulVCount = 21
+	hangulTCount = 28
+	hangulNCount = hangulVCount * hangulTCount
+	hangulSCount = hangulLCount * hangulNCount
+)
+
+func combiningClassOf(r rune) uint8 {
+	i := sort.Search(len(combiningClasses), func(i int) bool {
+		return combiningClasses[i].hi >= r
+	})
+
+	if i < len(combiningClasses) && combiningClasses[i].lo <= r {
+		return combiningClasses[i].ccc
+	}
+
+	return 0
+}
+
+func decompose(s string) (runes []rune) {
+	for _, r := range s {
+		if r >= hangulSBase && r < hangulSBase+hangulSCount {
+			i := r - hangulSBase
+			runes = append(runes, hangulLBase+i/hangulNCount, hangulVBase+(i%hangulNCount)/hangulTCount)
+
+			if t := i % hangulTCount; t != 0 {
+				runes = append(runes, hangulTBase+t)
+			}
+
+			continue
+		}
+
+		if d, ok := canonicalDecompositions[r]; ok {
+			runes = append(runes, []rune(d)...)
+		} else {
+			runes = append(runes, r)
+		}
+	}
+
+	// canonical ordering of combining marks sequences
+	for i := 0; i < len(runes); {
+		if combiningClassOf(runes[i]) == 0 {
+			i++
+			continue
+		}
+
+		j := i
+
+		for j < len(runes) && combiningClassOf(runes[j]) != 0 {
+			j++
+		}
+
+		marks := runes[i:j]
+
+		sort.SliceStable(marks, func(a, b int) bool {
+			return combiningClassOf(marks[a]) < combiningClassOf(marks[b])
+		})
+
+		i = j
+	}
+
+	return
+}
+
+func composePair(a rune, b rune) (r rune, ok bool) {
+	if a >= hangulLBase && a < hangulLBase+hangulLCount && b >= hangulVBase && b < hangulVBase+hangulVCount {
+		return hangulSBase + ((a-hangulLBase)*hangulVCount+(b-hangulVBase))*hangulTCount, true
+	}
+
+	if a >= hangulSBase && a < hangulSBase+hangulSCount && (a-hangulSBase)%hangulTCount == 0 && b > hangulTBase && b < hangulTBase+hangulTCount {
+		return a + (b - hangulTBase), true
+	}
+
+	r, ok = canonicalCompositions[[2]rune{a, b}]
+
+	return
+}
+
+// normalizeNFC returns the Unicode Normalization Form C of s.
+func normalizeNFC(s string) string {
+	ascii := true
+
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			ascii = false
+			break
+		}
+	}
+
+	if ascii {
+		return s
+	}
+
+	runes := decompose(s)
+
+	if len(runes) == 0 {
+		return s
+	}
+
+	starter := 0
+	lastClass := int(combiningClassOf(runes[0]))
+
+	if lastClass != 0 {
+		// leading combining marks are never composed
+		lastClass = 256
+	}
+
+	composed := runes[:1]
+
+	for _, r := range runes[1:] {
+		class := int(combiningClassOf(r))
+
+		if lastClass < class || lastClass == 0 {
+			if c, ok := composePair(composed[starter], r); ok {
+				composed[starter] = c
+				continue
+			}
+		}
+
+		if class == 0 {
+			starter = len(composed)
+		}
+
+		lastClass = class
+		composed = append(composed, r)
+	}
+
+	return string(composed)
+}
+
+// caseKey returns the case-insensitive form of a name, names sharing it
+// collide on case-insensitive file systems.
+func caseKey(name string) string {
+	return strings.ToLower(strings.ToUpper(normalizeNFC(name)))
+}
+
+// caseCollision returns the name of an existing entry of dir matching name
+// case-insensitively, an exact match is not a collision.
+func caseCollision(dir string, name string) (existing string, found bool) {
+	entries, err := volumeJail().ReadDir(dir)
+
+	if err != nil {
+		return
+	}
+
+	key := caseKey(name)
+
+	for _, e := range entries {
+		if e.Name() != name && caseKey(e.Name()) == key {
+			return e.Name(), true
+		}
+	}
+
+	return
+}
+
+// collationKey returns the primary collation elements of a name, letters
+// with diacritics sort along with their base letters and case is ignored.
+func collationKey(name string) (key []rune) {
+	for _, r := range decompose(name) {
+		if combiningClassOf(r) != 0 {
+			continue
+		}
+
+		key = append(key, unicode.ToLower(r))
+	}
+
+	return
+}
+
+func digitRun(s []rune, i int) (j int) {
+	for j = i; j < len(s) && s[j] >= '0' && s[j] <= '9'; j++ {
+	}
+
+	return
+}
+
+// naturalLess compares names in natural order, embedded numbers are compared
+// by value (e.g. "file2" precedes "file10").
+func naturalLess(a string, b string) bool {
+	x := collationKey(a)
+	y := collationKey(b)
+
+	i, j := 0, 0
+
+	for i < len(x) && j < len(y) {
+		ei := digitRun(x, i)
+		ej := digitRun(y, j)
+
+		if ei > i && ej > j {
+			nx := strings.TrimLeft(string(x[i:ei]), "0")
+			ny := strings.TrimLeft(string(y[j:ej]), "0")
+
+			if len(nx) != len(ny) {
+				return len(nx) < len(ny)
+			}
+
+			if nx != ny {
+				return nx < ny
+			}
+
+			i, j = ei, ej
+			continue
+		}
+
+		if x[i] != y[j] {
+			return x[i] < y[j]
+		}
+
+		i++
+		j++
+	}
+
+	if len(x)-i != len(y)-j {
+		return len(x)-i < len(y)-j
+	}
+
+	// names differing only by case, diacritics or leading zeros
+	return a < b
+}
+
+// checkFilename applies the filename policy to a single path element,
+// returning its normalized form.
+func checkFilename(name string) (normalized string, err error) {
+	if !utf8.ValidString(name) {
+		return "", fmt.Errorf("invalid file name %q, invalid UTF-8 encoding", name)
+	}
+
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return "", fmt.Errorf("invalid file name %q, control characters are not allowed", name)
+		}
+	}
+
+	normalized = name
+
+	if conf.FilenameNFC {
+		normalized = normalizeNFC(name)
+	}
+
+	if conf.FilenameMaxLength > 0 && len(normalized) > conf.FilenameMaxLength {
+		return "", fmt.Errorf("invalid file name %q, exceeds maximum length (%d bytes)", name, conf.FilenameMaxLength)
+	}
+
+	base := strings.SplitN(normalized, ".", 2)[0]
+
+	for _, reserved := range conf.FilenameReserved {
+		if strings.EqualFold(base, reserved) {
+			return "", fmt.Errorf("invalid file name %q, reserved name", name)
+		}
+	}
+
+	return
+}
+
+// filenamePath applies the filename policy to the elements of a volume path
+// which do not exist yet, existing elements are left untouched to preserve
+// access to previously stored files.
+func filenamePath(subPath string) (p string, err error) {
+	osPath := conf.MountPoint
+	elements := strings.Split(subPath, "/")
+
+	for i, name := range elements {
+		if name == "" || name == "." {
+			continue
+		}
+
+		osPath = filepath.Join(osPath, name)
+
+		if _, e := volumeJail().Lstat(osPath); e == nil {
+			continue
+		}
+
+		elements[i], err = checkFilename(name)
+
+		if err != nil {
+			return
+		}
+
+		if conf.FilenameCaseCollisions == "refuse" {
+			if existing, found := caseCollision(filepath.Dir(osPath), elements[i]); found {
+				return "", fmt.Errorf("invalid file name %q, collides with existing %q", name, existing)
+			}
+		}
+
+		osPath = filepath.Join(filepath.Dir(osPath), elements[i])
+	}
+
+	return strings.Join(elements, "/"), nil
+}
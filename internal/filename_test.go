@@ -0,0 +1,118 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeNFC(t *testing.T) {
+	vectors := map[string]string{
+		"interlock":          "interlock",
+		"e\u0301":            "\u00e9",
+		"\u00e9":             "\u00e9",
+		"\u1100\u1161\u11a8": "\uac01",
+		"e\u0302\u0323":      "\u1ec7",
+		"\u212b":             "\u00c5",
+		"A\u030a":            "\u00c5",
+		"\u0344":             "\u0308\u0301",
+		"a\u0301\u0301":      "\u00e1\u0301",
+		"\u0301a":            "\u0301a",
+		"\ufb01":             "\ufb01",
+		"\u1e9b\u0323":       "\u1e9b\u0323",
+	}
+
+	for input, expected := range vectors {
+		if output := normalizeNFC(input); output != expected {
+			t.Errorf("%+q: expected %+q, got %+q", input, expected, output)
+		}
+	}
+}
+
+func TestCheckFilename(t *testing.T) {
+	conf.SetDefaults()
+
+	if name, err := checkFilename("cafe\u0301.txt"); err != nil || name != "caf\u00e9.txt" {
+		t.Errorf("unexpected normalization %+q (%v)", name, err)
+	}
+
+	invalid := []string{
+		"tab\tname",
+		"bell\x07",
+		"\xff\xfe",
+		"nul.txt",
+		"COM1",
+		strings.Repeat("a", 256),
+	}
+
+	for _, name := range invalid {
+		if _, err := checkFilename(name); err == nil {
+			t.Errorf("%+q: invalid file name accepted", name)
+		}
+	}
+}
+
+func TestNaturalSort(t *testing.T) {
+	names := []string{"file10.txt", "File2.txt", "été", "file1.txt", "ete", "file01.txt", "Zeta", "alpha"}
+	expected := []string{"alpha", "ete", "été", "file01.txt", "file1.txt", "File2.txt", "file10.txt", "Zeta"}
+
+	sort.SliceStable(names, func(i, j int) bool {
+		return naturalLess(names[i], names[j])
+	})
+
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("unexpected order %q", names)
+	}
+}
+
+func TestCaseCollisions(t *testing.T) {
+	c := newTestServer(t)
+	defer conf.SetDefaults()
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	c.mustCall("file/mkdir", jsonObject{"path": []string{"/sorted"}})
+
+	for _, name := range []string{"b10.txt", "b9.txt", "Readme.txt", "README.txt"} {
+		c.upload("/sorted/"+name, testCleartext)
+	}
+
+	res := c.mustCall("file/list", jsonObject{"path": "/sorted", "sha256": false, "sort": "natural"})
+	response := res["response"].(map[string]interface{})
+
+	var names []string
+
+	for _, inode := range response["inodes"].([]interface{}) {
+		names = append(names, inode.(map[string]interface{})["name"].(string))
+	}
+
+	if !reflect.DeepEqual(names, []string{"b9.txt", "b10.txt", "README.txt", "Readme.txt"}) {
+		t.Errorf("unexpected listing order %q", names)
+	}
+
+	collisions := response["collisions"].([]interface{})
+
+	if len(collisions) != 1 || !reflect.DeepEqual(collisions[0], []interface{}{"README.txt", "Readme.txt"}) {
+		t.Errorf("unexpected collisions %v", collisions)
+	}
+
+	conf.FilenameCaseCollisions = "refuse"
+
+	if res := c.call("file/mkdir", jsonObject{"path": []string{"/sorted/readme.TXT"}}); res["status"] != "KO" {
+		t.Error("colliding directory name accepted")
+	}
+
+	if res := c.call("file/new", jsonObject{"path": "/sorted/B9.txt", "contents": ""}); res["status"] != "KO" {
+		t.Error("colliding file name accepted")
+	}
+
+	c.mustCall("file/new", jsonObject{"path": "/sorted/b11.txt", "contents": ""})
+}
@@ -0,0 +1,138 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build go1.18
+// +build go1.18
+
+package interlock
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Fuzzing entry points for the attack surface exposed to (authenticated)
+// clients, see the Makefile fuzz target.
+
+func FuzzParseRequest(f *testing.F) {
+	f.Add([]byte(`{"volume": "encryptedfs", "password": "interlocktest", "dispose": false}`))
+	f.Add([]byte(`{"path": "/", "sha256": true}`))
+	f.Add([]byte(`{"src": ["/a", "/b"], "dst": "/c"}`))
+	f.Add([]byte(`{"epoch": 1430051641}`))
+	f.Add([]byte(`{"key": {"identifier": "test"}, "data": ""}`))
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		r := httptest.NewRequest("POST", "/api/file/list", bytes.NewReader(body))
+		req, err := parseRequest(r)
+
+		if err != nil {
+			return
+		}
+
+		for _, s := range schemas {
+			_ = s.Validate(req)
+		}
+	})
+}
+
+func FuzzUnzip(f *testing.F) {
+	buf := new(bytes.Buffer)
+	w := zip.NewWriter(buf)
+
+	for _, name := range []string{"test.txt", "dir/", "dir/test.txt", "../test.txt"} {
+		e, _ := w.Create(name)
+		e.Write([]byte(name))
+	}
+
+	w.Close()
+	f.Add(buf.Bytes())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+
+		if err != nil {
+			return
+		}
+
+		for _, f := range reader.File {
+			if f.UncompressedSize64 > 1<<20 {
+				return
+			}
+		}
+
+		// the extraction directory parent must hold nothing else
+		dir := t.TempDir()
+		dst := filepath.Join(dir, "extract")
+		_ = unzip(reader, dst)
+
+		filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+			if p != dir && p != dst && !strings.HasPrefix(p, dst+string(filepath.Separator)) {
+				t.Fatalf("extraction outside destination: %s", p)
+			}
+
+			return nil
+		})
+	})
+}
+
+func FuzzAESDecrypt(f *testing.F) {
+	password := "interlocktest"
+	cleartext := []byte("01234567890ABCDEFGHILMNOPQRSTUVZ!@#")
+
+	input, _ := ioutil.TempFile("", "aes_fuzz_input-")
+	input.Write(cleartext)
+	input.Seek(0, 0)
+
+	ciphertext, _ := ioutil.TempFile("", "aes_fuzz_ciphertext-")
+
+	a := &aes256OFB{}
+	a.SetPassword(password)
+	a.Encrypt(input, ciphertext, false)
+
+	seed, _ := ioutil.ReadFile(ciphertext.Name())
+	f.Add(seed)
+	f.Add(seed[0:24])
+
+	input.Close()
+	os.Remove(input.Name())
+	ciphertext.Close()
+	os.Remove(ciphertext.Name())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		dir := t.TempDir()
+
+		src := filepath.Join(dir, "input")
+		dst := filepath.Join(dir, "output")
+
+		if err := ioutil.WriteFile(src, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		input, _ := os.Open(src)
+		defer input.Close()
+
+		output, _ := os.Create(dst)
+		defer output.Close()
+
+		a := &aes256OFB{}
+		a.SetPassword(password)
+
+		if err := a.Decrypt(input, output, false); err != nil {
+			return
+		}
+
+		// only untampered ciphertexts can pass HMAC verification
+		if decrypted, _ := ioutil.ReadFile(dst); !bytes.Equal(decrypted, cleartext) {
+			t.Fatal("decryption of tampered ciphertext succeeded")
+		}
+	})
+}
@@ -0,0 +1,489 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Golden file compatibility suite, files produced by each release are kept
+// under testdata/golden/<release> and must remain readable by later ones.
+//
+// Vectors for a new release are generated with:
+//
+//	go test -run '^TestGolden$' ./internal -golden=<release>
+
+var goldenRelease = flag.String("golden", "", "generate golden vectors for the argument release")
+
+const goldenDir = "testdata/golden"
+const goldenPassword = "interlockgolden"
+const goldenTimestamp = int64(1430051641)
+
+type goldenVector struct {
+	Name      string `json:"name"`
+	Cipher    string `json:"cipher"`
+	Op        string `json:"op"`
+	File      string `json:"file,omitempty"`
+	Sig       string `json:"sig,omitempty"`
+	Key       string `json:"key,omitempty"`
+	SigKey    string `json:"sig_key,omitempty"`
+	Password  string `json:"password,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+	// SHA256 of the cleartext or, for OTP vectors, the expected code
+	Expected string `json:"expected"`
+}
+
+func goldenCleartext() []byte {
+	return []byte(strings.Repeat("INTERLOCK golden cleartext 0123456789\n", 1000))
+}
+
+// goldenCipher returns a fresh cipher instance, HSM ciphers are bound to the
+// mock HSM.
+func goldenCipher(name string) (cipher cipherInterface, err error) {
+	for _, c := range splitSigCiphers(new(mockHSM)) {
+		if c.GetInfo().Name == name {
+			return c.New(), nil
+		}
+	}
+
+	c, err := conf.GetAvailableCipher(name)
+
+	if err != nil {
+		return
+	}
+
+	return c.New(), nil
+}
+
+func goldenKey(path string, cipher cipherInterface) key {
+	name := filepath.Base(path)
+	ext := filepath.Ext(name)
+
+	return key{
+		Identifier: strings.TrimSuffix(name, ext),
+		KeyFormat:  strings.TrimPrefix(ext, "."),
+		Cipher:     cipher.GetInfo().Name,
+		Private:    strings.Contains(path, "/private/"),
+		Path:       path,
+	}
+}
+
+func sha256Hex(buf []byte) string {
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:])
+}
+
+func (v *goldenVector) check(dir string) (err error) {
+	cipher, err := goldenCipher(v.Cipher)
+
+	if err != nil {
+		return
+	}
+
+	if v.Key != "" {
+		if err = cipher.SetKey(goldenKey(v.Key, cipher)); err != nil {
+			return
+		}
+	}
+
+	if v.Password != "" {
+		if err = cipher.SetPassword(v.Password); err != nil {
+			return
+		}
+	}
+
+	if v.SigKey != "" {
+		if err = cipher.SetKey(goldenKey(v.SigKey, cipher)); err != nil {
+			return
+		}
+	}
+
+	if v.Op == "otp" {
+		code, _, err := cipher.GenOTP(v.Timestamp)
+
+		if err == nil && code != v.Expected {
+			err = fmt.Errorf("code mismatch: %s", code)
+		}
+
+		return err
+	}
+
+	input, err := os.Open(filepath.Join(dir, v.File))
+
+	if err != nil {
+		return
+	}
+	defer input.Close()
+
+	output, err := ioutil.TempFile("", "golden_test_output-")
+
+	if err != nil {
+		return
+	}
+	defer os.Remove(output.Name())
+	defer output.Close()
+
+	switch v.Op {
+	case "decrypt":
+		err = cipher.Decrypt(input, output, v.SigKey != "")
+	case "verify", "sign":
+		// signing key shares must still combine to the stored public key
+		var sig *os.File
+
+		if sig, err = os.Open(filepath.Join(dir, v.Sig)); err != nil {
+			return
+		}
+		defer sig.Close()
+
+		if err = cipher.Verify(input, sig); err != nil {
+			return
+		}
+
+		_, err = input.Seek(0, 0)
+
+		if err == nil {
+			_, err = output.ReadFrom(input)
+		}
+	case "import":
+		var tmp string
+
+		if tmp, err = ioutil.TempDir("", "golden_test_import-"); err != nil {
+			return
+		}
+		defer os.RemoveAll(tmp)
+
+		if err = importBundle(cipher, input, tmp, v.SigKey != ""); err != nil {
+			return
+		}
+
+		var buf []byte
+
+		if buf, err = ioutil.ReadFile(filepath.Join(tmp, "bundle", "golden.txt")); err != nil {
+			return
+		}
+
+		_, err = output.Write(buf)
+	default:
+		err = fmt.Errorf("invalid operation %s", v.Op)
+	}
+
+	if err != nil {
+		return
+	}
+
+	buf, err := ioutil.ReadFile(output.Name())
+
+	if err != nil {
+		return
+	}
+
+	if sum := sha256Hex(buf); sum != v.Expected {
+		return fmt.Errorf("cleartext mismatch: %s", sum)
+	}
+
+	return
+}
+
+func TestGolden(t *testing.T) {
+	if *goldenRelease != "" {
+		if err := generateGolden(filepath.Join(goldenDir, *goldenRelease)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	releases, err := ioutil.ReadDir(goldenDir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mountPoint := conf.MountPoint
+	defer func() { conf.MountPoint = mountPoint }()
+
+	for _, release := range releases {
+		dir, err := filepath.Abs(filepath.Join(goldenDir, release.Name()))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		buf, err := ioutil.ReadFile(filepath.Join(dir, "vectors.json"))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var vectors []goldenVector
+
+		if err = json.Unmarshal(buf, &vectors); err != nil {
+			t.Fatal(err)
+		}
+
+		conf.MountPoint = dir
+
+		for _, v := range vectors {
+			if err = v.check(dir); err != nil {
+				t.Errorf("release %s, %s: %v", release.Name(), v.Name, err)
+			}
+		}
+	}
+}
+
+// generateGolden produces vectors for all ciphers with the current release.
+func generateGolden(dir string) (err error) {
+	if _, err = os.Stat(dir); err == nil {
+		return fmt.Errorf("%s already exists", dir)
+	}
+
+	dir, err = filepath.Abs(dir)
+
+	if err != nil {
+		return
+	}
+
+	mountPoint, keyPath := conf.MountPoint, conf.KeyPath
+	defer func() { conf.MountPoint, conf.KeyPath = mountPoint, keyPath }()
+
+	conf.MountPoint = dir
+	conf.KeyPath = "keys"
+	cleartext := goldenCleartext()
+	expected := sha256Hex(cleartext)
+
+	if err = os.MkdirAll(filepath.Join(dir, "bundle"), 0700); err != nil {
+		return
+	}
+
+	if err = ioutil.WriteFile(filepath.Join(dir, "bundle", "golden.txt"), cleartext, 0600); err != nil {
+		return
+	}
+
+	defer os.RemoveAll(filepath.Join(dir, "bundle"))
+
+	var vectors []goldenVector
+
+	writeKey := func(cipher cipherInterface, private bool, data string) (path string, err error) {
+		subdir := "public"
+
+		if private {
+			subdir = "private"
+		}
+
+		ext := cipher.GetInfo().Extension
+		path = filepath.Join("keys", ext, subdir, "golden."+cipher.GetInfo().KeyFormat)
+
+		if err = os.MkdirAll(filepath.Join(dir, filepath.Dir(path)), 0700); err != nil {
+			return
+		}
+
+		err = ioutil.WriteFile(filepath.Join(dir, path), []byte(data), 0600)
+
+		return
+	}
+
+	produce := func(name string, fn func(input *os.File, output *os.File) error) (err error) {
+		input, err := ioutil.TempFile("", "golden_test_input-")
+
+		if err != nil {
+			return
+		}
+		defer os.Remove(input.Name())
+		defer input.Close()
+
+		if _, err = input.Write(cleartext); err != nil {
+			return
+		}
+
+		if _, err = input.Seek(0, 0); err != nil {
+			return
+		}
+
+		output, err := os.Create(filepath.Join(dir, name))
+
+		if err != nil {
+			return
+		}
+		defer output.Close()
+
+		return fn(input, output)
+	}
+
+	// symmetric
+
+	aes, _ := goldenCipher("AES-256-OFB")
+	aes.SetPassword(goldenPassword)
+
+	err = produce("aes.txt.aes256ofb", func(input *os.File, output *os.File) error {
+		return aes.Encrypt(input, output, false)
+	})
+
+	if err != nil {
+		return
+	}
+
+	vectors = append(vectors, goldenVector{Name: "AES-256-OFB decryption", Cipher: "AES-256-OFB", Op: "decrypt", File: "aes.txt.aes256ofb", Password: goldenPassword, Expected: expected})
+
+	output, err := os.Create(filepath.Join(dir, "aes.bundle"))
+
+	if err != nil {
+		return
+	}
+
+	err = exportBundle(aes, filepath.Join(dir, "bundle"), output, false)
+	output.Close()
+
+	if err != nil {
+		return
+	}
+
+	vectors = append(vectors, goldenVector{Name: "AES-256-OFB bundle import", Cipher: "AES-256-OFB", Op: "import", File: "aes.bundle", Password: goldenPassword, Expected: expected})
+
+	// asymmetric
+
+	pgp, _ := goldenCipher("OpenPGP")
+	pub, sec, err := pgp.GenKey("golden", "testonly@example.com")
+
+	if err != nil {
+		return
+	}
+
+	pubKey, err := writeKey(pgp, false, pub)
+
+	if err != nil {
+		return
+	}
+
+	secKey, err := writeKey(pgp, true, sec)
+
+	if err != nil {
+		return
+	}
+
+	pgp.SetKey(goldenKey(pubKey, pgp))
+	pgp.SetKey(goldenKey(secKey, pgp))
+
+	err = produce("pgp.txt.pgp", func(input *os.File, output *os.File) error {
+		return pgp.Encrypt(input, output, true)
+	})
+
+	if err != nil {
+		return
+	}
+
+	vectors = append(vectors, goldenVector{Name: "OpenPGP decryption and verification", Cipher: "OpenPGP", Op: "decrypt", File: "pgp.txt.pgp", Key: secKey, SigKey: pubKey, Expected: expected})
+
+	err = produce("pgp.txt.pgp-signature", func(input *os.File, output *os.File) error {
+		return pgp.Sign(input, output)
+	})
+
+	if err != nil {
+		return
+	}
+
+	if err = ioutil.WriteFile(filepath.Join(dir, "pgp.txt"), cleartext, 0600); err != nil {
+		return
+	}
+
+	vectors = append(vectors, goldenVector{Name: "OpenPGP signature verification", Cipher: "OpenPGP", Op: "verify", File: "pgp.txt", Sig: "pgp.txt.pgp-signature", Key: pubKey, Expected: expected})
+
+	output, err = os.Create(filepath.Join(dir, "pgp.bundle"))
+
+	if err != nil {
+		return
+	}
+
+	err = exportBundle(pgp, filepath.Join(dir, "bundle"), output, true)
+	output.Close()
+
+	if err != nil {
+		return
+	}
+
+	vectors = append(vectors, goldenVector{Name: "OpenPGP bundle import", Cipher: "OpenPGP", Op: "import", File: "pgp.bundle", Key: secKey, SigKey: pubKey, Expected: expected})
+
+	// split-key signing, bound to the mock HSM
+
+	for _, c := range splitSigCiphers(new(mockHSM)) {
+		name := c.GetInfo().Name
+		s := c.New()
+		s.SetPassword(goldenPassword)
+
+		pub, sec, err := s.GenKey("golden", "")
+
+		if err != nil {
+			return err
+		}
+
+		pubKey, err := writeKey(s, false, pub)
+
+		if err != nil {
+			return err
+		}
+
+		secKey, err := writeKey(s, true, sec)
+
+		if err != nil {
+			return err
+		}
+
+		s = c.New()
+		s.SetKey(goldenKey(secKey, s))
+
+		if err = s.SetPassword(goldenPassword); err != nil {
+			return err
+		}
+
+		sig := "pgp.txt." + s.GetInfo().Extension + "-signature"
+
+		err = produce(sig, func(input *os.File, output *os.File) error {
+			return s.Sign(input, output)
+		})
+
+		if err != nil {
+			return err
+		}
+
+		vectors = append(vectors, goldenVector{Name: name + " signature verification", Cipher: name, Op: "verify", File: "pgp.txt", Sig: sig, Key: pubKey, Expected: expected})
+		vectors = append(vectors, goldenVector{Name: name + " key share derivation", Cipher: name, Op: "sign", File: "pgp.txt", Sig: sig, Key: secKey, Password: goldenPassword, Expected: expected})
+	}
+
+	// OTP
+
+	totp, _ := goldenCipher("TOTP")
+	seed := base32.StdEncoding.EncodeToString([]byte("INTERLOCK golden TOTP"))
+	totpKey, err := writeKey(totp, true, seed)
+
+	if err != nil {
+		return
+	}
+
+	totp.SetKey(goldenKey(totpKey, totp))
+	code, _, err := totp.GenOTP(goldenTimestamp)
+
+	if err != nil {
+		return
+	}
+
+	vectors = append(vectors, goldenVector{Name: "TOTP code", Cipher: "TOTP", Op: "otp", Key: totpKey, Timestamp: goldenTimestamp, Expected: code})
+
+	buf, err := json.MarshalIndent(vectors, "", "\t")
+
+	if err != nil {
+		return
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, "vectors.json"), append(buf, '\n'), 0600)
+}
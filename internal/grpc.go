@@ -0,0 +1,382 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"log/syslog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// gRPC management API, an optional HTTP/2 listener authenticated with mutual
+// TLS exposing administrative operations to fleet management tooling. The
+// service is described in interlock.proto, typed clients can be generated
+// from it with any gRPC toolchain.
+//
+// Methods are served through the same handlers of the JSON API, with the
+// privileges of an administrator session, and require no session cookie as
+// the client certificate authenticates each call.
+
+const grpcService = "/interlock.v1.Interlock/"
+const grpcMaxMessage = 4 << 20
+
+// gRPC status codes
+const (
+	grpcOK                 = 0
+	grpcUnknown            = 2
+	grpcInvalidArgument    = 3
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+)
+
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string {
+	return e.msg
+}
+
+type grpcMethod func(r *http.Request, req protoMessage) (res *protoWriter, err error)
+
+var grpcMethods = map[string]grpcMethod{
+	"Status":      grpcStatus,
+	"GetConfig":   grpcGetConfig,
+	"ListKeys":    grpcListKeys,
+	"GenerateKey": grpcGenerateKey,
+	"Unlock":      grpcUnlock,
+	"Lock":        grpcLock,
+}
+
+func grpcTLSConfig() (c *tls.Config, err error) {
+	cert, err := tls.LoadX509KeyPair(conf.GRPCCert, conf.GRPCKey)
+
+	if err != nil {
+		return
+	}
+
+	ca, err := ioutil.ReadFile(conf.GRPCCA)
+
+	if err != nil {
+		return
+	}
+
+	pool := x509.NewCertPool()
+
+	if ok := pool.AppendCertsFromPEM(ca); !ok {
+		return nil, errors.New("could not parse gRPC certificate authority")
+	}
+
+	c = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2"},
+	}
+
+	return
+}
+
+func startGRPC() (err error) {
+	if conf.GRPCListen == "" {
+		return
+	}
+
+	TLSConfig, err := grpcTLSConfig()
+
+	if err != nil {
+		return
+	}
+
+	srv := &http.Server{
+		Addr:      conf.GRPCListen,
+		Handler:   recoverHandler(grpcHandler),
+		TLSConfig: TLSConfig,
+	}
+
+	log.Printf("starting gRPC server on %s", conf.GRPCListen)
+
+	go func() {
+		if err := srv.ListenAndServeTLS("", ""); err != nil {
+			log.Printf("gRPC server error: %v", err)
+		}
+	}()
+
+	return
+}
+
+// grpcEscape percent-encodes status messages as required by the gRPC HTTP/2
+// protocol.
+func grpcEscape(msg string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c >= 0x20 && c <= 0x7e && c != '%' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+func grpcHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "unsupported media type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+
+	res, err := grpcServe(r)
+
+	if err == nil {
+		w.WriteHeader(http.StatusOK)
+
+		frame := make([]byte, 5, 5+len(res))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(res)))
+		w.Write(append(frame, res...))
+
+		w.Header().Set("Grpc-Status", fmt.Sprintf("%d", grpcOK))
+		return
+	}
+
+	code := grpcUnknown
+
+	if e, ok := err.(*grpcError); ok {
+		code = e.code
+	}
+
+	if conf.Debug {
+		log.Printf("gRPC %s from %s failed: %v", r.URL.Path, r.RemoteAddr, err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Grpc-Status", fmt.Sprintf("%d", code))
+	w.Header().Set("Grpc-Message", grpcEscape(err.Error()))
+}
+
+func grpcServe(r *http.Request) (res []byte, err error) {
+	method, ok := grpcMethods[strings.TrimPrefix(r.URL.Path, grpcService)]
+
+	if !ok || !strings.HasPrefix(r.URL.Path, grpcService) {
+		return nil, &grpcError{grpcUnimplemented, "unknown method " + r.URL.Path}
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, grpcMaxMessage+5))
+
+	if err != nil {
+		return
+	}
+
+	if len(body) < 5 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+		return nil, &grpcError{grpcInvalidArgument, "invalid message framing"}
+	}
+
+	if body[0] != 0 {
+		return nil, &grpcError{grpcUnimplemented, "compressed messages are not supported"}
+	}
+
+	req, err := parseProto(body[5:])
+
+	if err != nil {
+		return nil, &grpcError{grpcInvalidArgument, err.Error()}
+	}
+
+	status.Log(syslog.LOG_INFO, "gRPC %s from %s", strings.TrimPrefix(r.URL.Path, grpcService), grpcPeer(r))
+
+	w, err := method(r, req)
+
+	if err != nil {
+		return
+	}
+
+	return w.Bytes(), nil
+}
+
+// grpcPeer identifies the client by its certificate subject.
+func grpcPeer(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return fmt.Sprintf("%q (%s)", r.TLS.PeerCertificates[0].Subject.CommonName, r.RemoteAddr)
+	}
+
+	return r.RemoteAddr
+}
+
+// grpcCall invokes a JSON API handler, returning its response object.
+func grpcCall(uri string, handler func(*http.Request) jsonObject, req jsonObject) (res interface{}, err error) {
+	if !session.Active() {
+		return nil, &grpcError{grpcFailedPrecondition, "volume locked"}
+	}
+
+	if err = writeAllowed(uri); err != nil {
+		return nil, &grpcError{grpcFailedPrecondition, err.Error()}
+	}
+
+	r, err := http.NewRequest("POST", uri, bytes.NewReader([]byte(req.String())))
+
+	if err != nil {
+		return
+	}
+
+	r.RequestURI = uri
+
+	if err = validateSchema(r); err != nil {
+		return nil, &grpcError{grpcInvalidArgument, err.Error()}
+	}
+
+	response := handler(r)
+
+	switch response["status"] {
+	case "OK":
+		return response["response"], nil
+	case "INVALID_SESSION":
+		err = &grpcError{grpcFailedPrecondition, grpcResponseError(response)}
+	default:
+		err = &grpcError{grpcUnknown, grpcResponseError(response)}
+	}
+
+	return
+}
+
+func grpcResponseError(res jsonObject) string {
+	switch msg := res["response"].(type) {
+	case []string:
+		return strings.Join(msg, ", ")
+	case string:
+		return msg
+	default:
+		return "request failed"
+	}
+}
+
+func grpcStatus(r *http.Request, req protoMessage) (res *protoWriter, err error) {
+	res = &protoWriter{}
+
+	build := Build
+
+	if conf.HSM != "off" {
+		build += " " + conf.HSM
+	}
+
+	res.String(1, Revision)
+	res.String(2, build)
+	res.Bool(3, session.Active())
+
+	session.Lock()
+	res.String(4, session.Volume)
+	session.Unlock()
+
+	res.Bool(5, readOnly.Enabled())
+	res.Int64(6, time.Now().Unix())
+
+	for _, n := range status.Notifications() {
+		res.String(7, n.Message)
+	}
+
+	return
+}
+
+func grpcGetConfig(r *http.Request, req protoMessage) (res *protoWriter, err error) {
+	c, err := json.MarshalIndent(&conf, "", "\t")
+
+	if err != nil {
+		return
+	}
+
+	res = &protoWriter{}
+	res.String(1, string(c))
+
+	return
+}
+
+func grpcListKeys(r *http.Request, req protoMessage) (res *protoWriter, err error) {
+	response, err := grpcCall("/api/crypto/keys", keys, jsonObject{
+		"public":  req.Bool(1),
+		"private": req.Bool(2),
+		"cipher":  req.String(3),
+		"filter":  req.String(4),
+	})
+
+	if err != nil {
+		return
+	}
+
+	res = &protoWriter{}
+
+	for _, k := range response.([]key) {
+		m := &protoWriter{}
+		m.String(1, k.Identifier)
+		m.String(2, k.KeyFormat)
+		m.String(3, k.Cipher)
+		m.Bool(4, k.Private)
+		m.String(5, k.Path)
+		m.Int64(6, k.Revoked)
+
+		res.Message(1, m)
+	}
+
+	return
+}
+
+func grpcGenerateKey(r *http.Request, req protoMessage) (res *protoWriter, err error) {
+	_, err = grpcCall("/api/crypto/gen_key", genKey, jsonObject{
+		"identifier": req.String(1),
+		"key_format": req.String(2),
+		"cipher":     req.String(3),
+		"email":      req.String(4),
+		"password":   req.String(5),
+	})
+
+	return &protoWriter{}, err
+}
+
+func grpcUnlock(r *http.Request, req protoMessage) (res *protoWriter, err error) {
+	volume := req.String(1)
+
+	if session.Active() {
+		return nil, &grpcError{grpcFailedPrecondition, "existing session"}
+	}
+
+	if err = authenticate(r.Context(), volume, req.String(2), false); err != nil {
+		loginFailed(volume, grpcPeer(r), tlsFingerprint(r))
+		return nil, &grpcError{grpcFailedPrecondition, err.Error()}
+	}
+
+	if _, _, err = startSession(volume, grpcPeer(r)); err != nil {
+		return
+	}
+
+	return &protoWriter{}, nil
+}
+
+func grpcLock(r *http.Request, req protoMessage) (res *protoWriter, err error) {
+	if !session.Active() {
+		return nil, &grpcError{grpcFailedPrecondition, "no active session"}
+	}
+
+	if err = closeSession(); err != nil {
+		return
+	}
+
+	return &protoWriter{}, nil
+}
@@ -0,0 +1,157 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func grpcInvoke(t *testing.T, srv *httptest.Server, method string, req *protoWriter) (res protoMessage, code string) {
+	frame := make([]byte, 5)
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(req.Bytes())))
+
+	r, err := http.NewRequest("POST", srv.URL+grpcService+method, bytes.NewReader(append(frame, req.Bytes()...)))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.Header.Set("Content-Type", "application/grpc")
+
+	resp, err := srv.Client().Do(r)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("unexpected protocol %s", resp.Proto)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code = resp.Trailer.Get("Grpc-Status"); code != "0" {
+		return
+	}
+
+	if len(body) < 5 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+		t.Fatalf("%s: invalid response framing", method)
+	}
+
+	if res, err = parseProto(body[5:]); err != nil {
+		t.Fatal(err)
+	}
+
+	return
+}
+
+func TestGRPC(t *testing.T) {
+	newTestServer(t)
+
+	srv := httptest.NewUnstartedServer(recoverHandler(grpcHandler))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	res, code := grpcInvoke(t, srv, "Status", &protoWriter{})
+
+	if code != "0" || res.String(1) != Revision || res.Bool(3) {
+		t.Errorf("unexpected status: %s %v", code, res)
+	}
+
+	if _, code = grpcInvoke(t, srv, "ListKeys", &protoWriter{}); code != "9" {
+		t.Errorf("key listing allowed on locked volume: %s", code)
+	}
+
+	unlock := &protoWriter{}
+	unlock.String(1, testVolume)
+	unlock.String(2, "invalid")
+
+	if _, code = grpcInvoke(t, srv, "Unlock", unlock); code != "9" {
+		t.Errorf("invalid password accepted: %s", code)
+	}
+
+	unlock = &protoWriter{}
+	unlock.String(1, testVolume)
+	unlock.String(2, testPassword)
+
+	if _, code = grpcInvoke(t, srv, "Unlock", unlock); code != "0" {
+		t.Fatalf("unlock failed: %s", code)
+	}
+
+	defer closeSession()
+
+	if res, _ = grpcInvoke(t, srv, "Status", &protoWriter{}); !res.Bool(3) || res.String(4) != testVolume {
+		t.Errorf("unexpected status: %v", res)
+	}
+
+	list := &protoWriter{}
+	list.Bool(1, true)
+	list.Bool(2, true)
+
+	if _, code = grpcInvoke(t, srv, "ListKeys", list); code != "0" {
+		t.Errorf("key listing failed: %s", code)
+	}
+
+	if res, code = grpcInvoke(t, srv, "GetConfig", &protoWriter{}); code != "0" || !bytes.Contains([]byte(res.String(1)), []byte(`"volume_group"`)) {
+		t.Errorf("unexpected configuration: %s %v", code, res)
+	}
+
+	if _, code = grpcInvoke(t, srv, "Invalid", &protoWriter{}); code != "12" {
+		t.Errorf("unexpected status for unknown method: %s", code)
+	}
+
+	if _, code = grpcInvoke(t, srv, "Lock", &protoWriter{}); code != "0" || session.Active() {
+		t.Errorf("lock failed: %s", code)
+	}
+}
+
+func TestProtobuf(t *testing.T) {
+	k := &protoWriter{}
+	k.String(1, "test")
+	k.Bool(4, true)
+	k.Int64(6, 1234567890)
+
+	w := &protoWriter{}
+	w.Message(1, k)
+	w.Message(1, &protoWriter{})
+
+	m, err := parseProto(w.Bytes())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m[1]) != 2 {
+		t.Fatalf("unexpected repeated field: %v", m)
+	}
+
+	key, err := parseProto(m[1][0].data)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, _ := key.last(6); key.String(1) != "test" || !key.Bool(4) || v.varint != 1234567890 {
+		t.Errorf("unexpected message: %v", key)
+	}
+
+	if _, err = parseProto([]byte{0x0a, 0x05, 'a'}); err == nil {
+		t.Error("truncated message accepted")
+	}
+}
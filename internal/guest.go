@@ -0,0 +1,494 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/syslog"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Guest sessions, an authenticated user can issue time-limited credentials
+// restricted to a directory and a set of file operations, allowing a file
+// exchange without sharing the volume password. Guest sessions depend on the
+// session which created them and are invalidated on its logout.
+
+const guestUserSize = 6
+const guestMaxDuration = 24 * 60 * 60
+
+// guest operations mapped to the allowed API methods
+var guestOps = map[string]string{
+	"list":     "/api/file/list",
+	"download": "/api/file/download",
+	"upload":   "/api/file/upload",
+	"mkdir":    "/api/file/mkdir",
+	"delete":   "/api/file/delete",
+}
+
+type guest struct {
+	Username string   `json:"username"`
+	Path     string   `json:"path"`
+	Ops      []string `json:"ops"`
+	Role     string   `json:"role"`
+	Expiry   int64    `json:"expiry"`
+	Active   bool     `json:"active"`
+
+	password  string
+	sessionID string
+	xsrfToken string
+	remote    string
+}
+
+type guestManager struct {
+	sync.Mutex
+	guests map[string]*guest
+}
+
+var guests = guestManager{
+	guests: make(map[string]*guest),
+}
+
+func (g *guest) allowed(uri string) bool {
+	// previews are permitted along with downloads
+	if uri == "/api/file/preview" {
+		uri = "/api/file/download"
+	}
+
+	for _, op := range g.Ops {
+		if guestOps[op] == uri {
+			return true
+		}
+	}
+
+	return false
+}
+
+// contains returns true if the argument volume path, both as given and with
+// symbolic links resolved, is within the guest directory, root is true if
+// either is the guest directory itself.
+func (g *guest) contains(p string) (contained bool, root bool) {
+	resolved, err := resolvePath(p)
+
+	if err != nil {
+		return
+	}
+
+	for _, c := range []string{path.Clean("/" + p), resolved} {
+		if c == g.Path {
+			root = true
+		} else if g.Path != "/" && !strings.HasPrefix(c, g.Path+"/") {
+			return false, root
+		}
+	}
+
+	return true, root
+}
+
+func (m *guestManager) Create(dir string, ops []string, role string, duration time.Duration) (g *guest, err error) {
+	for _, op := range ops {
+		if _, ok := guestOps[op]; !ok {
+			return nil, fmt.Errorf("invalid guest operation %s", op)
+		}
+	}
+
+	if dir, err = resolvePath(dir); err != nil {
+		return
+	}
+
+	g = &guest{
+		Path:   dir,
+		Ops:    ops,
+		Role:   role,
+		Expiry: time.Now().Add(duration).Unix(),
+	}
+
+	if g.Username, err = randomString(guestUserSize); err != nil {
+		return
+	}
+
+	if g.password, err = randomString(cookieSize / 4); err != nil {
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.guests[g.Username] = g
+
+	status.Log(syslog.LOG_NOTICE, "created guest %s for %s (%s), expiring on %s", g.Username, g.Path, strings.Join(ops, ", "), time.Unix(g.Expiry, 0).Format(time.RFC3339))
+
+	return
+}
+
+// sessions returns the number of active sessions opened from the argument
+// client address, other than the one of the argument user, it must be called
+// with the manager locked.
+func (m *guestManager) sessions(remote string, username string) (n int) {
+	now := time.Now().Unix()
+
+	for _, g := range m.guests {
+		if g.Username != username && g.sessionID != "" && g.remote == remote && now <= g.Expiry {
+			n++
+		}
+	}
+
+	return
+}
+
+// admit verifies that the client address is allowed to open a further
+// session, it must be called with the manager locked.
+func (m *guestManager) admit(remote string, username string) (err error) {
+	if conf.ClientSessions > 0 && m.sessions(remote, username) >= conf.ClientSessions {
+		status.Log(syslog.LOG_WARNING, "refused session for %s from %s: %v", username, remote, errTooManySessions)
+		return errTooManySessions
+	}
+
+	return
+}
+
+func (m *guestManager) Login(username string, password string, remote string) (g *guest, err error) {
+	m.Lock()
+	defer m.Unlock()
+
+	g, ok := m.guests[username]
+
+	if !ok || !secretEqual(g.password, password) {
+		return nil, errors.New("invalid guest credentials")
+	}
+
+	if time.Now().Unix() > g.Expiry {
+		delete(m.guests, username)
+		return nil, errors.New("expired guest credentials")
+	}
+
+	if err = m.admit(remote, username); err != nil {
+		return nil, err
+	}
+
+	if g.sessionID, err = randomString(cookieSize); err != nil {
+		return
+	}
+
+	if g.xsrfToken, err = randomString(cookieSize); err != nil {
+		return
+	}
+
+	g.Active = true
+	g.remote = remote
+
+	status.Log(syslog.LOG_NOTICE, "guest %s logged in", username)
+
+	return
+}
+
+// Open starts a session for an externally authenticated user (e.g. PIV),
+// permitted all guest operations on the whole volume subject to ACLs.
+func (m *guestManager) Open(username string, role string, duration time.Duration, remote string) (g *guest, err error) {
+	var ops []string
+
+	for op := range guestOps {
+		ops = append(ops, op)
+	}
+
+	sort.Strings(ops)
+
+	g = &guest{
+		Username: username,
+		Path:     "/",
+		Ops:      ops,
+		Role:     role,
+		Expiry:   time.Now().Add(duration).Unix(),
+		Active:   true,
+		remote:   remote,
+	}
+
+	if g.sessionID, err = randomString(cookieSize); err != nil {
+		return
+	}
+
+	if g.xsrfToken, err = randomString(cookieSize); err != nil {
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	if err = m.admit(remote, username); err != nil {
+		return nil, err
+	}
+
+	m.guests[username] = g
+
+	status.Log(syslog.LOG_NOTICE, "%s logged in with role %s", username, role)
+
+	return
+}
+
+// Validate returns the guest matching the request session cookie and XSRF
+// token.
+func (m *guestManager) Validate(r *http.Request, checkXSRF bool) *guest {
+	cookie, err := r.Cookie(conf.CookieName)
+
+	if err != nil {
+		return nil
+	}
+
+	XSRFToken := r.Header.Get(XSRFHeader)
+
+	m.Lock()
+	defer m.Unlock()
+
+	for username, g := range m.guests {
+		if g.sessionID == "" || !secretEqual(g.sessionID, cookie.Value) {
+			continue
+		}
+
+		if time.Now().Unix() > g.Expiry {
+			status.Log(syslog.LOG_NOTICE, "guest %s expired", username)
+			delete(m.guests, username)
+			return nil
+		}
+
+		if checkXSRF && !secretEqual(g.xsrfToken, XSRFToken) {
+			return nil
+		}
+
+		return g
+	}
+
+	return nil
+}
+
+func (m *guestManager) Revoke(username string) (err error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.guests[username]; !ok {
+		return errors.New("invalid guest")
+	}
+
+	delete(m.guests, username)
+	status.Log(syslog.LOG_NOTICE, "revoked guest %s", username)
+
+	return
+}
+
+func (m *guestManager) List() (list []guest) {
+	m.Lock()
+	defer m.Unlock()
+
+	list = []guest{}
+
+	for username, g := range m.guests {
+		if time.Now().Unix() > g.Expiry {
+			delete(m.guests, username)
+			continue
+		}
+
+		list = append(list, *g)
+	}
+
+	return
+}
+
+func (m *guestManager) Reset() {
+	m.Lock()
+	defer m.Unlock()
+
+	m.guests = make(map[string]*guest)
+}
+
+func guestCreate(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	duration, err := req["duration"].(json.Number).Int64()
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	dir := req["path"].(string)
+	osPath, err := absolutePath(dir)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if fi, e := volumeJail().Stat(osPath); e != nil || !fi.IsDir() {
+		return errorResponse(errors.New("guest path must be an existing directory"), "")
+	}
+
+	var ops []string
+
+	for _, op := range req["ops"].([]interface{}) {
+		s, ok := op.(string)
+
+		if !ok {
+			return errorResponse(errors.New("invalid guest operation"), "")
+		}
+
+		ops = append(ops, s)
+	}
+
+	role, ok := req["role"].(string)
+
+	if !ok || role == "" {
+		role = "guest"
+	}
+
+	g, err := guests.Create(dir, ops, role, time.Duration(duration)*time.Second)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	res = jsonObject{
+		"status": "OK",
+		"response": map[string]interface{}{
+			"username": g.Username,
+			"password": g.password,
+			"expiry":   g.Expiry,
+		},
+	}
+
+	return
+}
+
+func guestList() (res jsonObject) {
+	return jsonObject{
+		"status":   "OK",
+		"response": guests.List(),
+	}
+}
+
+func guestRevoke(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if err = guests.Revoke(req["username"].(string)); err != nil {
+		return errorResponse(err, "")
+	}
+
+	return jsonObject{
+		"status":   "OK",
+		"response": nil,
+	}
+}
+
+func guestLogin(w http.ResponseWriter, r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if err = acknowledgeBanner(req, r.RemoteAddr); err != nil {
+		return errorResponse(err, "")
+	}
+
+	if !session.Active() {
+		return errorResponse(errors.New("volume not available"), "INVALID_SESSION")
+	}
+
+	g, err := guests.Login(req["username"].(string), req["password"].(string), clientAddress(r))
+
+	if err != nil {
+		return errorResponse(err, "INVALID_SESSION")
+	}
+
+	http.SetCookie(w, sessionCookie(g.sessionID, int(g.Expiry-time.Now().Unix())))
+
+	res = jsonObject{
+		"status": "OK",
+		"response": map[string]interface{}{
+			"path":      g.Path,
+			"ops":       g.Ops,
+			"expiry":    g.Expiry,
+			"XSRFToken": g.xsrfToken},
+	}
+
+	return
+}
+
+// checkGuestRequest verifies that the request is permitted to the guest,
+// restoring the consumed request body.
+func checkGuestRequest(w http.ResponseWriter, r *http.Request, g *guest) (err error) {
+	if !g.allowed(r.RequestURI) {
+		return errors.New("operation not permitted to guest")
+	}
+
+	paths, err := requestPaths(w, r)
+
+	if err != nil {
+		return
+	}
+
+	for attr, list := range paths {
+		// keys are used from the key storage
+		if attr == "key" || attr == "sig_key" || attr == "recipient" {
+			continue
+		}
+
+		for _, p := range list {
+			contained, root := g.contains(p)
+
+			if !contained {
+				return errors.New("path not permitted to guest")
+			}
+
+			// the guest directory itself cannot be replaced or removed
+			if root && writeRequests[r.RequestURI] {
+				return errors.New("operation on guest directory not permitted")
+			}
+		}
+	}
+
+	return
+}
+
+func handleGuestRequest(w http.ResponseWriter, r *http.Request, g *guest) {
+	if r.RequestURI == "/api/auth/logout" {
+		_ = guests.Revoke(g.Username)
+		http.SetCookie(w, sessionCookie("delete", -1))
+		sendResponse(w, jsonObject{"status": "OK", "response": nil})
+		return
+	}
+
+	if err := checkGuestRequest(w, r, g); err != nil {
+		status.Log(syslog.LOG_WARNING, "guest %s: %s %s", g.Username, r.RequestURI, err)
+		denyRequest(w, r, err)
+		return
+	}
+
+	who := principal{User: g.Username, Role: g.Role}
+
+	if err := acls.Check(w, r, who); err != nil {
+		status.Log(syslog.LOG_WARNING, "guest %s: %s %s", g.Username, r.RequestURI, err)
+		denyRequest(w, r, err)
+		return
+	}
+
+	if tripHoneytokens(w, r, who) {
+		return
+	}
+
+	handleRequest(w, r)
+}
@@ -0,0 +1,245 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/syslog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Detached LUKS headers, with `header_mode` set the volume headers are not
+// stored on the logical volumes, which are then indistinguishable from random
+// data without them. Headers are either read from `header_path` (e.g. the
+// mount point of a USB token) as <volume>.header, or uploaded on
+// /api/auth/header before login and held in memory until the volume is
+// unlocked.
+//
+// Uploaded headers are only written, for the duration of each cryptsetup
+// invocation, to headerTmp which must be memory backed.
+
+const (
+	headerToken = "token"
+	headerAPI   = "api"
+)
+
+const headerExt = ".header"
+const headerMaxSize = 32 * 1024 * 1024
+const headerExpiry = 10 * time.Minute
+
+var headerTmp = "/dev/shm"
+
+// LUKS1 and LUKS2 binary header magic
+var luksMagic = []byte{'L', 'U', 'K', 'S', 0xba, 0xbe}
+
+type uploadedHeader struct {
+	sync.Mutex
+	volume string
+	data   []byte
+	epoch  time.Time
+}
+
+var detachedHeader uploadedHeader
+
+func validHeaderVolume(volume string) error {
+	if volume == "" || strings.ContainsAny(volume, "/\\") || strings.Contains(volume, traversalPattern) {
+		return errors.New("invalid volume name")
+	}
+
+	return nil
+}
+
+// Set holds an uploaded header until the volume is unlocked or the header
+// expires.
+func (h *uploadedHeader) Set(volume string, data []byte) (err error) {
+	if err = validHeaderVolume(volume); err != nil {
+		return
+	}
+
+	if !bytes.HasPrefix(data, luksMagic) {
+		return errors.New("invalid LUKS header")
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	h.volume = volume
+	h.data = data
+	h.epoch = time.Now()
+
+	return
+}
+
+func (h *uploadedHeader) Get(volume string) []byte {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.volume != volume || time.Since(h.epoch) > headerExpiry {
+		return nil
+	}
+
+	return h.data
+}
+
+func (h *uploadedHeader) Clear() {
+	h.Lock()
+	defer h.Unlock()
+
+	h.volume = ""
+	h.data = nil
+}
+
+// Status reports the detached header mode and availability.
+func (h *uploadedHeader) Status() map[string]interface{} {
+	s := map[string]interface{}{
+		"mode":    conf.HeaderMode,
+		"volumes": []string{},
+	}
+
+	switch conf.HeaderMode {
+	case headerToken:
+		files, _ := filepath.Glob(filepath.Join(conf.HeaderPath, "*"+headerExt))
+		volumes := []string{}
+
+		for _, f := range files {
+			volumes = append(volumes, strings.TrimSuffix(filepath.Base(f), headerExt))
+		}
+
+		s["volumes"] = volumes
+	case headerAPI:
+		h.Lock()
+
+		if h.volume != "" && time.Since(h.epoch) <= headerExpiry {
+			s["volumes"] = []string{h.volume}
+		}
+
+		h.Unlock()
+	}
+
+	return s
+}
+
+// luksHeader returns the detached header path of a volume, or an empty string
+// if headers are stored on the volumes, the cleanup function must be invoked
+// once the header is no longer needed.
+func luksHeader(volume string) (path string, cleanup func(), err error) {
+	cleanup = func() {}
+
+	switch conf.HeaderMode {
+	case "":
+		return
+	case headerToken:
+		if err = validHeaderVolume(volume); err != nil {
+			return
+		}
+
+		path = filepath.Join(conf.HeaderPath, volume+headerExt)
+
+		if _, err = os.Stat(path); err != nil {
+			return "", cleanup, fmt.Errorf("header token unavailable for %s", volume)
+		}
+
+		return
+	case headerAPI:
+		data := detachedHeader.Get(volume)
+
+		if data == nil {
+			return "", cleanup, fmt.Errorf("no header uploaded for %s", volume)
+		}
+
+		f, err := ioutil.TempFile(headerTmp, ".interlock-header-")
+
+		if err != nil {
+			return "", cleanup, err
+		}
+		defer f.Close()
+
+		cleanup = func() { os.Remove(f.Name()) }
+
+		if _, err = f.Write(data); err != nil {
+			cleanup()
+			return "", func() {}, err
+		}
+
+		return f.Name(), cleanup, nil
+	default:
+		return "", cleanup, fmt.Errorf("invalid header_mode %s", conf.HeaderMode)
+	}
+}
+
+// luksDevice returns the cryptsetup arguments selecting a volume, including
+// its detached header when configured.
+func luksDevice(volume string) (args []string, cleanup func(), err error) {
+	if strings.Contains(volume, traversalPattern) {
+		return nil, func() {}, errors.New("path traversal detected")
+	}
+
+	header, cleanup, err := luksHeader(volume)
+
+	if err != nil {
+		return
+	}
+
+	if header != "" {
+		args = append(args, "--header", header)
+	}
+
+	args = append(args, volumeDevice(volume))
+
+	return
+}
+
+// luksMetadata returns the LUKS2 JSON metadata of a volume.
+func luksMetadata(volume string) (metadata string, err error) {
+	if err = tools.Check("luks_metadata"); err != nil {
+		return
+	}
+
+	device, cleanup, err := luksDevice(volume)
+
+	if err != nil {
+		return
+	}
+	defer cleanup()
+
+	return execCommand("/sbin/cryptsetup", append([]string{"luksDump", "--dump-json-metadata"}, device...), "")
+}
+
+// headerUpload receives the detached header of a volume ahead of login.
+func headerUpload(w http.ResponseWriter, r *http.Request) (res jsonObject) {
+	if conf.HeaderMode != headerAPI || r.Method != http.MethodPost {
+		return notFound()
+	}
+
+	volume := r.Header.Get("X-Volume")
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, headerMaxSize))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if err = detachedHeader.Set(volume, data); err != nil {
+		return errorResponse(err, "")
+	}
+
+	status.Log(syslog.LOG_NOTICE, "received LUKS header for %s from %s", volume, r.RemoteAddr)
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": nil,
+	}
+
+	return
+}
@@ -0,0 +1,90 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDetachedHeader(t *testing.T) {
+	c := newTestServer(t)
+	defer conf.SetDefaults()
+
+	header := append(append([]byte{}, luksMagic...), make([]byte, 4096)...)
+
+	// headers stored on the volumes
+	if device, _, err := luksDevice(testVolume); err != nil || !reflect.DeepEqual(device, []string{"/dev/lvmvolume/" + testVolume}) {
+		t.Errorf("unexpected device arguments %v (%v)", device, err)
+	}
+
+	// token
+	conf.HeaderMode = headerToken
+	conf.HeaderPath = t.TempDir()
+
+	if _, _, err := luksDevice(testVolume); err == nil {
+		t.Error("missing token header accepted")
+	}
+
+	path := filepath.Join(conf.HeaderPath, testVolume+headerExt)
+	ioutil.WriteFile(path, header, 0600)
+
+	if device, _, err := luksDevice(testVolume); err != nil || !reflect.DeepEqual(device, []string{"--header", path, "/dev/lvmvolume/" + testVolume}) {
+		t.Errorf("unexpected device arguments %v (%v)", device, err)
+	}
+
+	if s := detachedHeader.Status(); !reflect.DeepEqual(s["volumes"], []string{testVolume}) {
+		t.Errorf("unexpected status %v", s)
+	}
+
+	if _, _, err := luksDevice("../" + testVolume); err == nil {
+		t.Error("path traversal accepted")
+	}
+
+	// upload
+	conf.HeaderMode = headerAPI
+	headerTmp = t.TempDir()
+	defer func() { headerTmp = "/dev/shm" }()
+
+	var res jsonObject
+
+	for _, body := range [][]byte{[]byte("invalid header"), header} {
+		r := c.request("POST", "/api/auth/header", map[string]string{"X-Volume": testVolume}, body)
+		json.NewDecoder(r.Body).Decode(&res)
+		r.Body.Close()
+	}
+
+	if res["status"] != "OK" {
+		t.Fatalf("header upload failed: %v", res)
+	}
+
+	device, cleanup, err := luksDevice(testVolume)
+
+	if err != nil || len(device) != 3 {
+		t.Fatalf("unexpected device arguments %v (%v)", device, err)
+	}
+
+	if buf, _ := ioutil.ReadFile(device[1]); !reflect.DeepEqual(buf, header) {
+		t.Error("uploaded header mismatch")
+	}
+
+	cleanup()
+
+	if _, err = os.Stat(device[1]); !os.IsNotExist(err) {
+		t.Error("temporary header not removed")
+	}
+
+	detachedHeader.Clear()
+
+	if _, _, err = luksDevice(testVolume); err == nil {
+		t.Error("cleared header accepted")
+	}
+}
@@ -0,0 +1,163 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/syslog"
+	"strconv"
+	"strings"
+)
+
+// Deniable hidden volumes, a LUKS2 volume with a detached header
+// (`hidden_header`) whose data segment is located in the free space at the
+// end of an outer volume logical volume, the outer LUKS data area already
+// being indistinguishable from random data. The hidden volume is selected
+// when the login passphrase unlocks its header, otherwise the outer volume is
+// unlocked.
+//
+// The outer file system must end before the hidden data segment, when it does
+// not (or this cannot be determined) the outer volume is forced read-only to
+// avoid clobbering the hidden one.
+
+const dumpe2fs = "/sbin/dumpe2fs"
+
+// luksSegmentOffset returns the data segment offset, in bytes, from LUKS2
+// JSON metadata.
+func luksSegmentOffset(metadata []byte) (offset int64, err error) {
+	var luks2 struct {
+		Segments map[string]struct {
+			Offset string `json:"offset"`
+		} `json:"segments"`
+	}
+
+	if err = json.Unmarshal(metadata, &luks2); err != nil {
+		return
+	}
+
+	s, ok := luks2.Segments["0"]
+
+	if !ok {
+		return 0, errors.New("missing LUKS2 data segment")
+	}
+
+	return strconv.ParseInt(s.Offset, 10, 64)
+}
+
+// mappingOffset returns the data offset, in bytes, of an active mapping from
+// `cryptsetup status` output.
+func mappingOffset(output string) (offset int64, err error) {
+	for _, line := range strings.Split(output, "\n") {
+		f := strings.Fields(line)
+
+		if len(f) == 3 && f[0] == "offset:" && f[2] == "sectors" {
+			sectors, err := strconv.ParseInt(f[1], 10, 64)
+			return sectors * 512, err
+		}
+	}
+
+	return 0, errors.New("missing mapping offset")
+}
+
+// extSize returns the ext2/3/4 file system size, in bytes, from `dumpe2fs -h`
+// output.
+func extSize(output string) (size int64, err error) {
+	var count, blockSize int64
+
+	for _, line := range strings.Split(output, "\n") {
+		kv := strings.SplitN(line, ":", 2)
+
+		if len(kv) != 2 {
+			continue
+		}
+
+		switch kv[0] {
+		case "Block count":
+			count, err = strconv.ParseInt(strings.TrimSpace(kv[1]), 10, 64)
+		case "Block size":
+			blockSize, err = strconv.ParseInt(strings.TrimSpace(kv[1]), 10, 64)
+		}
+
+		if err != nil {
+			return
+		}
+	}
+
+	if count == 0 || blockSize == 0 {
+		return 0, errors.New("missing file system size")
+	}
+
+	return count * blockSize, nil
+}
+
+// hiddenOverlap returns an error if the file system on the unlocked mapping
+// might overlap the hidden volume data segment.
+func hiddenOverlap() (err error) {
+	metadata, err := execCommand("/sbin/cryptsetup", []string{"luksDump", "--dump-json-metadata", conf.HiddenHeader}, "")
+
+	if err != nil {
+		return
+	}
+
+	hidden, err := luksSegmentOffset([]byte(metadata))
+
+	if err != nil {
+		return
+	}
+
+	output, err := execCommand("/sbin/cryptsetup", []string{"status", volumeMapping()}, "")
+
+	if err != nil {
+		return
+	}
+
+	offset, err := mappingOffset(output)
+
+	if err != nil {
+		return
+	}
+
+	if offset == hidden {
+		// the hidden volume itself is mapped
+		return
+	}
+
+	output, err = execCommand(dumpe2fs, []string{"-h", "/dev/mapper/" + volumeMapping()}, "")
+
+	if err != nil {
+		return
+	}
+
+	size, err := extSize(output)
+
+	if err != nil {
+		return
+	}
+
+	if offset+size > hidden {
+		return fmt.Errorf("file system ends at %d, beyond reserved area at %d", offset+size, hidden)
+	}
+
+	return
+}
+
+// protectHidden forces read-only mode on the mounted volume when it might
+// overlap a configured hidden volume.
+func protectHidden() (err error) {
+	if conf.HiddenHeader == "" {
+		return
+	}
+
+	if e := hiddenOverlap(); e != nil {
+		status.Log(syslog.LOG_ERR, "volume write protected: %v", e)
+		return readOnly.Force()
+	}
+
+	return
+}
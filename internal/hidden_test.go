@@ -0,0 +1,81 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"testing"
+)
+
+// `cryptsetup status` output for a detached header mapping
+const cryptsetupStatus = `/dev/mapper/interlockfs is active.
+  type:    LUKS2
+  cipher:  aes-xts-plain64
+  keysize: 512 bits
+  key location: keyring
+  device:  /dev/mapper/lvmvolume-encryptedfs
+  sector size:  512
+  offset:  1048576 sectors
+  size:    1048576 sectors
+  mode:    read/write
+`
+
+const dumpe2fsHeader = `dumpe2fs 1.46.2 (28-Feb-2021)
+Filesystem volume name:   <none>
+Filesystem magic number:  0xEF53
+Block count:              131072
+Reserved block count:     6553
+Block size:               4096
+`
+
+func TestHiddenLayout(t *testing.T) {
+	offset, err := luksSegmentOffset([]byte(`{"segments":{"0":{"type":"crypt","offset":"536870912","size":"dynamic"}}}`))
+
+	if err != nil || offset != 536870912 {
+		t.Errorf("unexpected segment offset %d (%v)", offset, err)
+	}
+
+	if _, err = luksSegmentOffset([]byte(`{"segments":{}}`)); err == nil {
+		t.Error("missing segment accepted")
+	}
+
+	offset, err = mappingOffset(cryptsetupStatus)
+
+	if err != nil || offset != 536870912 {
+		t.Errorf("unexpected mapping offset %d (%v)", offset, err)
+	}
+
+	size, err := extSize(dumpe2fsHeader)
+
+	if err != nil || size != 536870912 {
+		t.Errorf("unexpected file system size %d (%v)", size, err)
+	}
+
+	if _, err = extSize("Block size: 4096\n"); err == nil {
+		t.Error("missing block count accepted")
+	}
+}
+
+func TestReadOnlyForce(t *testing.T) {
+	c := newTestServer(t)
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	if err := readOnly.Force(); err != nil {
+		t.Fatal(err)
+	}
+
+	if res := c.call("config/readonly", jsonObject{"readonly": false}); res["status"] == "OK" || !readOnly.Enabled() {
+		t.Errorf("forced read-only mode disabled: %v", res)
+	}
+
+	readOnly.Reset()
+
+	if readOnly.Enabled() {
+		t.Error("read-only mode not reset")
+	}
+}
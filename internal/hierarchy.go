@@ -0,0 +1,297 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Key hierarchy report, documents for the current configuration which keys
+// exist, where they are stored, what protects them and what each can
+// decrypt. Keys stored on the encrypted volume name the volume key as their
+// parent, the report is derived from the configuration and key path contents
+// and never discloses key material.
+//
+// Protections are expressed as "hsm" (device specific secret key),
+// "passphrase" (user supplied secret, never stored), "fido2" and "tang"
+// (LUKS2 tokens), "escrow" (threshold of recovery contacts), "public" (no
+// secret is stored on the device) and "plaintext".
+
+const (
+	keyProtectionHSM        = "hsm"
+	keyProtectionPassphrase = "passphrase"
+	keyProtectionFIDO2      = "fido2"
+	keyProtectionTang       = "tang"
+	keyProtectionEscrow     = "escrow"
+	keyProtectionPublic     = "public"
+	keyProtectionPlaintext  = "plaintext"
+)
+
+const volumeKeyName = "volume key"
+
+type keyNode struct {
+	Name        string   `json:"name"`
+	Storage     string   `json:"storage"`
+	Parent      string   `json:"parent,omitempty"`
+	ProtectedBy []string `json:"protected_by"`
+	Decrypts    string   `json:"decrypts"`
+	Count       int      `json:"count,omitempty"`
+	Encrypted   int      `json:"encrypted,omitempty"`
+}
+
+// volumeKeyNode describes the LUKS volume key of the argument volume.
+func volumeKeyNode(volume string) (k keyNode) {
+	k = keyNode{
+		Name:        volumeKeyName,
+		Storage:     "LUKS header of " + volumeDevice(volume),
+		ProtectedBy: []string{keyProtectionPassphrase},
+		Decrypts:    "encrypted volume " + volume + " (all files, key path and volume stores)",
+	}
+
+	switch conf.HeaderMode {
+	case headerToken:
+		k.Storage = "detached LUKS header " + filepath.Join(conf.HeaderPath, volume+headerExt)
+	case headerAPI:
+		k.Storage = "detached LUKS header uploaded on /api/auth/header, held in memory until unlock"
+	}
+
+	if conf.authHSM != nil {
+		k.ProtectedBy = append([]string{keyProtectionHSM}, k.ProtectedBy...)
+	}
+
+	// FIDO2 keyslots are only detected on unlock, their use is reported
+	// whenever an authenticator is configured
+	if conf.FIDO2Device != "" {
+		k.ProtectedBy = append(k.ProtectedBy, keyProtectionFIDO2)
+	}
+
+	if conf.TangVolume == volume {
+		k.ProtectedBy = append(k.ProtectedBy, keyProtectionTang)
+	}
+
+	if len(conf.EscrowContacts) > 0 {
+		k.ProtectedBy = append(k.ProtectedBy, keyProtectionEscrow)
+	}
+
+	return
+}
+
+// systemKeyNodes describes the keys held outside the encrypted volume.
+func systemKeyNodes(volume string) (nodes []keyNode) {
+	if conf.HSM != "off" {
+		storage := strings.Split(conf.HSM, ":")[0] + " device secret key, not exportable"
+
+		if strings.HasPrefix(conf.HSM, "caam-keyblob:") {
+			storage += ", derived key blobs in ~/.luks_kb"
+		}
+
+		nodes = append(nodes, keyNode{
+			Name:        "HSM key",
+			Storage:     storage,
+			ProtectedBy: []string{keyProtectionHSM},
+			Decrypts:    "HSM options " + strings.Split(conf.HSM, ":")[1] + " derived keys",
+		})
+	}
+
+	if conf.HiddenHeader != "" {
+		k := keyNode{
+			Name:        "hidden volume key",
+			Storage:     "detached LUKS header " + conf.HiddenHeader,
+			ProtectedBy: []string{keyProtectionPassphrase},
+			Decrypts:    "hidden volume in the free space of " + volumeDevice(volume),
+		}
+
+		if conf.authHSM != nil {
+			k.ProtectedBy = append([]string{keyProtectionHSM}, k.ProtectedBy...)
+		}
+
+		nodes = append(nodes, k)
+	}
+
+	if len(conf.EscrowContacts) > 0 {
+		nodes = append(nodes, keyNode{
+			Name:        "escrow shares",
+			Storage:     filepath.Join(conf.EscrowPath, volume+".json"),
+			ProtectedBy: []string{keyProtectionPublic},
+			Decrypts:    fmt.Sprintf("volume key escrow passphrase, %d of %d contacts OpenPGP keys required", conf.EscrowThreshold, len(conf.EscrowContacts)),
+		})
+	}
+
+	if conf.TLS != "off" {
+		k := keyNode{
+			Name:        "TLS key",
+			Storage:     conf.TLSKey,
+			ProtectedBy: []string{keyProtectionPlaintext},
+			Decrypts:    "HTTPS sessions on " + conf.BindAddress,
+		}
+
+		if conf.tlsHSM != nil {
+			k.ProtectedBy = []string{keyProtectionHSM}
+		}
+
+		nodes = append(nodes, k)
+	}
+
+	if conf.GRPCListen != "" {
+		nodes = append(nodes, keyNode{
+			Name:        "gRPC TLS key",
+			Storage:     conf.GRPCKey,
+			ProtectedBy: []string{keyProtectionPlaintext},
+			Decrypts:    "gRPC sessions on " + conf.GRPCListen,
+		})
+	}
+
+	if conf.ReplicaListen != "" || conf.ReplicaPeer != "" {
+		nodes = append(nodes, keyNode{
+			Name:        "replica TLS key",
+			Storage:     conf.ReplicaKey,
+			ProtectedBy: []string{keyProtectionPlaintext},
+			Decrypts:    "replication sessions",
+		})
+	}
+
+	if conf.DepositKey != "" {
+		nodes = append(nodes, keyNode{
+			Name:        "deposit key",
+			Storage:     conf.DepositKey,
+			ProtectedBy: []string{keyProtectionPublic},
+			Decrypts:    "none, deposits in " + conf.DepositSpool + " are encrypted to it and require the matching private key",
+		})
+	}
+
+	if conf.authHSM != nil {
+		nodes = append(nodes, keyNode{
+			Name:        "measurements sealing key",
+			Storage:     "derived from the HSM key",
+			ProtectedBy: []string{keyProtectionHSM},
+			Decrypts:    "none, authenticates system partition measurements",
+		})
+	}
+
+	return
+}
+
+// cipherKeyNodes describes the keys of the enabled ciphers.
+func cipherKeyNodes() (nodes []keyNode, err error) {
+	var names []string
+
+	for name := range conf.enabledCiphers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		cipher := conf.enabledCiphers[name]
+		info := cipher.GetInfo()
+
+		k := keyNode{
+			Name:    info.Name + " keys",
+			Storage: filepath.Join("/", conf.KeyPath, info.Extension, "private"),
+			Parent:  volumeKeyName,
+		}
+
+		switch {
+		case info.KeyFormat == "password":
+			k.Storage = "not stored, derived for each file from the request password"
+			k.Parent = ""
+			k.ProtectedBy = []string{keyProtectionPassphrase}
+		case conf.hsmCiphers[name]:
+			k.Storage = "not stored, combined from an HSM derived share and the request password"
+			k.Parent = ""
+			k.ProtectedBy = []string{keyProtectionPassphrase}
+		}
+
+		if conf.hsmCiphers[name] {
+			k.ProtectedBy = append([]string{keyProtectionHSM}, k.ProtectedBy...)
+		}
+
+		switch {
+		case info.Dec:
+			k.Decrypts = "files encrypted with " + info.Name
+		case info.Sig:
+			k.Decrypts = "none, signing only"
+		case info.OTP:
+			k.Decrypts = "none, one-time password generation"
+		default:
+			k.Decrypts = "none"
+		}
+
+		if k.Parent != "" {
+			if err = storedKeys(cipher, &k); err != nil {
+				return
+			}
+		}
+
+		nodes = append(nodes, k)
+	}
+
+	return
+}
+
+// storedKeys counts the secret keys stored in the key path and their
+// protection, keys are only protected by their parent unless encrypted.
+func storedKeys(cipher cipherInterface, k *keyNode) (err error) {
+	keys, err := getKeys(cipher, true, "")
+
+	if err != nil {
+		return
+	}
+
+	k.Count = len(keys)
+
+	if c, ok := cipher.New().(cipherKeyEncryption); ok {
+		for _, sk := range keys {
+			encrypted, err := c.KeyEncrypted(sk)
+
+			if err != nil {
+				return err
+			}
+
+			if encrypted {
+				k.Encrypted++
+			}
+		}
+	}
+
+	if k.Encrypted > 0 {
+		k.ProtectedBy = append(k.ProtectedBy, keyProtectionPassphrase)
+	}
+
+	if k.Encrypted < k.Count || k.Count == 0 {
+		k.ProtectedBy = append(k.ProtectedBy, keyProtectionPlaintext)
+	}
+
+	return
+}
+
+func keyHierarchy() (res jsonObject) {
+	volume := session.Volume
+
+	nodes := []keyNode{volumeKeyNode(volume)}
+	nodes = append(nodes, systemKeyNodes(volume)...)
+
+	cipherNodes, err := cipherKeyNodes()
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	nodes = append(nodes, cipherNodes...)
+
+	return jsonObject{
+		"status": "OK",
+		"response": jsonObject{
+			"volume": volume,
+			"hsm":    conf.HSM,
+			"keys":   nodes,
+		},
+	}
+}
@@ -0,0 +1,229 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"log/syslog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Status history, notifications and error level log entries are persisted on
+// the encrypted volume to survive restarts. Entries generated while the
+// volume is locked are kept in memory and stored at the next unlock.
+//
+// New entries are stored in batches, at most every historySaveDelay and when
+// the volume is locked, never while writes are disabled by read-only mode or
+// power failure (entries are then only retained in memory until writes are
+// allowed again).
+
+const historyFile = ".interlock-history.json"
+
+const historySaveDelay = 5 * time.Second
+
+const (
+	historyNotification = "notification"
+	historyLog          = "log"
+)
+
+type historyEntry struct {
+	statusEntry
+	Type string `json:"type"`
+}
+
+type historyStore struct {
+	sync.Mutex
+	entries []historyEntry
+	pending []historyEntry
+	dirty   bool
+	timer   *time.Timer
+	// serializes writes to the history file
+	saving sync.Mutex
+}
+
+var history historyStore
+
+func historyPath() string {
+	return filepath.Join(conf.MountPoint, historyFile)
+}
+
+func historyTrim(entries []historyEntry) []historyEntry {
+	if conf.HistorySize >= 0 && len(entries) > conf.HistorySize {
+		return entries[len(entries)-conf.HistorySize:]
+	}
+
+	return entries
+}
+
+func historyWritable() bool {
+	return !readOnly.Enabled() && !power.Failing()
+}
+
+// Open loads the history stored on the encrypted volume, merging entries
+// recorded while it was locked.
+func (h *historyStore) Open() (err error) {
+	h.saving.Lock()
+	defer h.saving.Unlock()
+
+	h.Lock()
+	defer h.Unlock()
+
+	h.entries = []historyEntry{}
+	buf, err := volumeJail().ReadFile(historyPath())
+
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+
+	if err == nil {
+		if err = json.Unmarshal(buf, &h.entries); err != nil {
+			return
+		}
+	}
+
+	h.entries = historyTrim(append(h.entries, h.pending...))
+	h.pending = nil
+
+	if !historyWritable() {
+		return
+	}
+
+	return saveHistory(h.entries)
+}
+
+func saveHistory(entries []historyEntry) (err error) {
+	buf, err := json.Marshal(entries)
+
+	if err != nil {
+		return
+	}
+
+	return volumeJail().WriteFile(historyPath(), buf, 0600)
+}
+
+// record adds an entry to the history, it must not invoke status (or any
+// method which might log) as it is called with the status buffer locked.
+func (h *historyStore) record(e statusEntry, t string) {
+	h.Lock()
+	defer h.Unlock()
+
+	entry := historyEntry{statusEntry: e, Type: t}
+
+	if h.entries == nil {
+		h.pending = historyTrim(append(h.pending, entry))
+		return
+	}
+
+	h.entries = historyTrim(append(h.entries, entry))
+
+	if !h.dirty {
+		h.dirty = true
+		h.timer = time.AfterFunc(historySaveDelay, h.Flush)
+	}
+}
+
+// Flush stores entries recorded since the last save, when writes are
+// allowed.
+func (h *historyStore) Flush() {
+	h.saving.Lock()
+	defer h.saving.Unlock()
+
+	h.Lock()
+
+	if !h.dirty || h.entries == nil || !historyWritable() {
+		h.dirty = false
+		h.Unlock()
+		return
+	}
+
+	entries := make([]historyEntry, len(h.entries))
+	copy(entries, h.entries)
+	h.dirty = false
+
+	h.Unlock()
+
+	if err := saveHistory(entries); err != nil {
+		log.Printf("could not save status history: %v", err)
+	}
+}
+
+// Entries returns the stored entries matching the argument maximum severity
+// level and time range (0 for no bound).
+func (h *historyStore) Entries(code syslog.Priority, start int64, end int64) (entries []historyEntry) {
+	h.Lock()
+	defer h.Unlock()
+
+	entries = []historyEntry{}
+
+	for _, e := range h.entries {
+		if e.Code > code || (start != 0 && e.Epoch < start) || (end != 0 && e.Epoch > end) {
+			continue
+		}
+
+		entries = append(entries, e)
+	}
+
+	return
+}
+
+// Reset stores outstanding entries and clears the history, it must be
+// invoked before the encrypted volume is unmounted.
+func (h *historyStore) Reset() {
+	h.Lock()
+
+	if h.timer != nil {
+		h.timer.Stop()
+	}
+
+	h.Unlock()
+	h.Flush()
+
+	h.Lock()
+	defer h.Unlock()
+
+	h.entries = nil
+}
+
+func historyRequest(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	code := syslog.LOG_DEBUG
+	bounds := []int64{0, 0}
+
+	if n, ok := req["severity"].(json.Number); ok {
+		severity, err := n.Int64()
+
+		if err != nil {
+			return errorResponse(errors.New("invalid severity"), "")
+		}
+
+		code = syslog.Priority(severity)
+	}
+
+	for i, key := range []string{"start", "end"} {
+		if n, ok := req[key].(json.Number); ok {
+			if bounds[i], err = n.Int64(); err != nil {
+				return errorResponse(errors.New("invalid time range"), "")
+			}
+		}
+	}
+
+	return jsonObject{
+		"status":   "OK",
+		"response": history.Entries(code, bounds[0], bounds[1]),
+	}
+}
@@ -0,0 +1,105 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"errors"
+	"io/ioutil"
+	"log/syslog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func historyMessages(res jsonObject) (messages []string) {
+	for _, e := range res["response"].([]interface{}) {
+		entry := e.(map[string]interface{})
+		messages = append(messages, entry["type"].(string)+": "+entry["msg"].(string))
+	}
+
+	return
+}
+
+func TestHistory(t *testing.T) {
+	c := newTestServer(t)
+	history.Reset()
+
+	// entries generated while the volume is locked are stored at unlock
+	status.Error(errors.New("history test error"))
+
+	c.login()
+
+	n := status.Notify(syslog.LOG_WARNING, "history test notification")
+	status.Remove(n)
+	status.Log(syslog.LOG_INFO, "history test information")
+
+	res := c.mustCall("status/history", jsonObject{"severity": int(syslog.LOG_WARNING)})
+	messages := historyMessages(res)
+
+	if len(messages) < 2 || messages[len(messages)-2] != "log: history test error" || messages[len(messages)-1] != "notification: history test notification" {
+		t.Errorf("unexpected history: %v", messages)
+	}
+
+	res = c.mustCall("status/history", jsonObject{"severity": int(syslog.LOG_ERR)})
+
+	for _, m := range historyMessages(res) {
+		if m == "notification: history test notification" {
+			t.Errorf("severity filter not applied: %v", res)
+		}
+	}
+
+	res = c.mustCall("status/history", jsonObject{"start": time.Now().Unix() + 60})
+
+	if len(res["response"].([]interface{})) != 0 {
+		t.Errorf("time range filter not applied: %v", res)
+	}
+
+	if res = c.call("status/history", jsonObject{"severity": 8}); res["status"] != "INVALID" {
+		t.Errorf("invalid severity accepted: %v", res)
+	}
+
+	// history survives restarts
+	c.mustCall("auth/logout", nil)
+
+	if entries := history.Entries(syslog.LOG_DEBUG, 0, 0); len(entries) != 0 {
+		t.Errorf("history available after logout: %v", entries)
+	}
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	res = c.mustCall("status/history", jsonObject{"severity": int(syslog.LOG_WARNING)})
+	messages = historyMessages(res)
+
+	if len(messages) < 2 || messages[0] != "log: history test error" {
+		t.Errorf("history not persisted: %v", messages)
+	}
+
+	// entries are not stored while in read-only mode
+	c.mustCall("config/readonly", jsonObject{"readonly": true})
+	status.Error(errors.New("history test read-only"))
+	history.Flush()
+
+	if buf, err := ioutil.ReadFile(historyPath()); err != nil || strings.Contains(string(buf), "history test read-only") {
+		t.Errorf("history stored in read-only mode (%v)", err)
+	}
+
+	c.mustCall("config/readonly", jsonObject{"readonly": false})
+
+	conf.HistorySize = 1
+	status.Error(errors.New("history test trimming"))
+
+	if messages = historyMessages(c.mustCall("status/history", jsonObject{})); len(messages) != 1 || messages[0] != "log: history test trimming" {
+		t.Errorf("history not trimmed: %v", messages)
+	}
+
+	history.Flush()
+
+	if buf, err := ioutil.ReadFile(historyPath()); err != nil || !strings.Contains(string(buf), "history test trimming") {
+		t.Errorf("history not stored (%v)", err)
+	}
+}
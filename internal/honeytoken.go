@@ -0,0 +1,477 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/syslog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Honeytokens, decoy files planted on the encrypted volume whose content is
+// read by any API method (download, preview, copy, move, compression,
+// encryption, signing, conversion, synchronization, clipboard paste) raises a
+// "honeytoken" event (delivered to webhooks and push notifications) and an
+// application log alert, giving early warning that a session or device has
+// been compromised. When the `honeytoken_lock` option is enabled the session
+// is also closed and the volume locked.
+//
+// Honeytokens are identified by device and inode number, rather than path, so
+// that symbolic and hard links are detected, directory level operations trip
+// any honeytoken they include. The registry follows moves and deletions
+// performed through the API.
+//
+// Honeytokens are stored on the encrypted volume and are indistinguishable
+// from regular files in listings, decoys created by the API are filled with
+// random data.
+
+const (
+	honeytokenFile = ".interlock-honeytokens.json"
+	honeytokenSize = 4096
+)
+
+// API methods which trip honeytokens on their path attributes, directories
+// trip any honeytoken within them, clipboard pastes are checked against the
+// clipboard entries
+var honeytokenRequests = map[string][]string{
+	"/api/file/download":   {"path"},
+	"/api/file/preview":    {"path"},
+	"/api/file/move":       {"src"},
+	"/api/file/copy":       {"src"},
+	"/api/file/extract":    {"src"},
+	"/api/file/compress":   {"src"},
+	"/api/file/encrypt":    {"src"},
+	"/api/file/decrypt":    {"src"},
+	"/api/file/rewrap":     {"src"},
+	"/api/file/migrate":    {"path"},
+	"/api/file/sign":       {"src"},
+	"/api/file/verify":     {"src", "sig"},
+	"/api/file/sync":       {"path"},
+	"/api/file/export":     {"src"},
+	"/api/file/import":     {"src"},
+	"/api/file/pdf":        {"src"},
+	"/api/file/sanitize":   {"src"},
+	"/api/clipboard/paste": {},
+}
+
+var errHoneytokenFound = errors.New("honeytoken found")
+
+type honeytoken struct {
+	Path    string `json:"path"`
+	Dev     uint64 `json:"dev"`
+	Ino     uint64 `json:"ino"`
+	Created int64  `json:"created"`
+}
+
+type honeytokenStore struct {
+	sync.Mutex
+	// path -> honeytoken
+	entries map[string]honeytoken
+}
+
+var honeytokens honeytokenStore
+
+func honeytokenPath() string {
+	return filepath.Join(conf.MountPoint, honeytokenFile)
+}
+
+// load reads the honeytoken store from the encrypted volume when not cached.
+func (h *honeytokenStore) load() (err error) {
+	if h.entries != nil {
+		return
+	}
+
+	h.entries = make(map[string]honeytoken)
+	buf, err := volumeJail().ReadFile(honeytokenPath())
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return
+	}
+
+	return json.Unmarshal(buf, &h.entries)
+}
+
+func (h *honeytokenStore) save() (err error) {
+	buf, err := json.MarshalIndent(h.entries, "", "\t")
+
+	if err != nil {
+		return
+	}
+
+	tmp := honeytokenPath() + ".tmp"
+
+	if err = volumeJail().WriteFile(tmp, buf, 0600); err != nil {
+		return
+	}
+
+	return volumeJail().Rename(tmp, honeytokenPath())
+}
+
+// Add marks a file as honeytoken, creating a decoy with random content if
+// it does not exist.
+func (h *honeytokenStore) Add(p string) (err error) {
+	p = path.Clean("/" + p)
+
+	if p == "/" || p == "/"+honeytokenFile || p == "/"+aclFile {
+		return errors.New("invalid honeytoken path")
+	}
+
+	osPath, err := absolutePath(p)
+
+	if err != nil {
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	if err = h.load(); err != nil {
+		return
+	}
+
+	if _, ok := h.entries[p]; ok {
+		return errors.New("path is already a honeytoken")
+	}
+
+	if fi, err := volumeJail().Stat(osPath); err == nil && fi.IsDir() {
+		return errors.New("honeytokens must be files")
+	} else if os.IsNotExist(err) {
+		decoy := make([]byte, honeytokenSize)
+
+		if _, err = rand.Read(decoy); err != nil {
+			return err
+		}
+
+		if err = volumeJail().WriteFile(osPath, decoy, 0600); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	fi, err := volumeJail().Stat(osPath)
+
+	if err != nil {
+		return
+	}
+
+	dev, ino, ok := fileIdentity(fi)
+
+	if !ok {
+		return errors.New("cannot identify honeytoken file")
+	}
+
+	for _, t := range h.entries {
+		if t.Dev == dev && t.Ino == ino {
+			return fmt.Errorf("file is already a honeytoken as %s", t.Path)
+		}
+	}
+
+	h.entries[p] = honeytoken{
+		Path:    p,
+		Dev:     dev,
+		Ino:     ino,
+		Created: time.Now().Unix(),
+	}
+
+	if err = h.save(); err != nil {
+		return
+	}
+
+	status.Log(syslog.LOG_NOTICE, "honeytoken planted at %s", p)
+
+	return
+}
+
+// Remove unmarks a honeytoken, the file itself is retained.
+func (h *honeytokenStore) Remove(p string) (err error) {
+	p = path.Clean("/" + p)
+
+	h.Lock()
+	defer h.Unlock()
+
+	if err = h.load(); err != nil {
+		return
+	}
+
+	if _, ok := h.entries[p]; !ok {
+		return errors.New("path is not a honeytoken")
+	}
+
+	delete(h.entries, p)
+
+	if err = h.save(); err != nil {
+		return
+	}
+
+	status.Log(syslog.LOG_NOTICE, "honeytoken removed from %s", p)
+
+	return
+}
+
+// Moved updates the honeytokens within a moved path.
+func (h *honeytokenStore) Moved(src string, dst string) (err error) {
+	return h.update(relativePath(src), func(p string) string {
+		return path.Join(relativePath(dst), strings.TrimPrefix(p, relativePath(src)))
+	})
+}
+
+// Deleted drops the honeytokens within a deleted path.
+func (h *honeytokenStore) Deleted(osPath string) (err error) {
+	return h.update(relativePath(osPath), func(string) string {
+		return ""
+	})
+}
+
+// update renames, or drops on empty names, the honeytokens within a path.
+func (h *honeytokenStore) update(prefix string, rename func(string) string) (err error) {
+	h.Lock()
+	defer h.Unlock()
+
+	if err = h.load(); err != nil {
+		return
+	}
+
+	entries := make(map[string]honeytoken)
+	changed := false
+
+	for p, t := range h.entries {
+		if p == prefix || strings.HasPrefix(p, strings.TrimSuffix(prefix, "/")+"/") {
+			changed = true
+
+			if t.Path = rename(p); t.Path == "" {
+				status.Log(syslog.LOG_NOTICE, "honeytoken at %s deleted", p)
+				continue
+			}
+		}
+
+		entries[t.Path] = t
+	}
+
+	if !changed {
+		return
+	}
+
+	h.entries = entries
+
+	return h.save()
+}
+
+func (h *honeytokenStore) List() (list []honeytoken, err error) {
+	h.Lock()
+	defer h.Unlock()
+
+	if err = h.load(); err != nil {
+		return
+	}
+
+	list = []honeytoken{}
+
+	for _, t := range h.entries {
+		list = append(list, t)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Path < list[j].Path
+	})
+
+	return
+}
+
+func (h *honeytokenStore) Reset() {
+	h.Lock()
+	defer h.Unlock()
+
+	h.entries = nil
+}
+
+// Check returns the first honeytoken accessed by the request, if any.
+func (h *honeytokenStore) Check(w http.ResponseWriter, r *http.Request) (p string, err error) {
+	var osPaths []string
+
+	attrs, ok := honeytokenRequests[r.RequestURI]
+
+	if !ok {
+		return
+	}
+
+	if r.RequestURI == "/api/clipboard/paste" {
+		_, osPaths = clip.Get()
+	} else {
+		paths, err := requestPaths(w, r)
+
+		if err != nil {
+			return "", err
+		}
+
+		for _, attr := range attrs {
+			for _, p := range paths[attr] {
+				// invalid paths are refused by the request itself
+				if osPath, err := absolutePath(p); err == nil {
+					osPaths = append(osPaths, osPath)
+				}
+			}
+		}
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	if err = h.load(); err != nil || len(h.entries) == 0 {
+		return
+	}
+
+	for _, osPath := range osPaths {
+		if p = h.find(osPath); p != "" {
+			return
+		}
+	}
+
+	return
+}
+
+// find returns the honeytoken matching a file or, for directories, any file
+// within it.
+func (h *honeytokenStore) find(osPath string) (p string) {
+	j := volumeJail()
+
+	match := func(fi os.FileInfo) string {
+		dev, ino, ok := fileIdentity(fi)
+
+		if !ok {
+			return ""
+		}
+
+		for _, t := range h.entries {
+			if t.Dev == dev && t.Ino == ino {
+				return t.Path
+			}
+		}
+
+		return ""
+	}
+
+	fi, err := j.Stat(osPath)
+
+	if err != nil {
+		return
+	}
+
+	if !fi.IsDir() {
+		return match(fi)
+	}
+
+	// walk the directory itself rather than a symbolic link to it
+	if osPath, err = j.Resolve(osPath); err != nil {
+		return
+	}
+
+	j.Walk(osPath, func(_ string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if p = match(fi); p != "" {
+			return errHoneytokenFound
+		}
+
+		return nil
+	})
+
+	return
+}
+
+// tripHoneytokens raises an alert when the request accesses a honeytoken,
+// returning true if the session has been closed as a consequence.
+func tripHoneytokens(w http.ResponseWriter, r *http.Request, who principal) (closed bool) {
+	p, err := honeytokens.Check(w, r)
+
+	if err != nil || p == "" {
+		return
+	}
+
+	status.Log(syslog.LOG_ALERT, "honeytoken %s accessed by %s (%s) from %s", p, who.User, r.RequestURI, r.RemoteAddr)
+
+	emitEvent(eventHoneytoken, map[string]interface{}{
+		"path":   p,
+		"action": path.Base(r.RequestURI),
+		"user":   who.User,
+		"remote": r.RemoteAddr,
+		"tls":    tlsFingerprint(r),
+	})
+
+	if !conf.HoneytokenLock {
+		return
+	}
+
+	http.SetCookie(w, sessionCookie("delete", -1))
+	reportError("honeytoken lock", closeSession())
+	sendResponse(w, jsonObject{"status": "INVALID_SESSION", "response": nil})
+
+	return true
+}
+
+func honeytokenList() (res jsonObject) {
+	list, err := honeytokens.List()
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	return jsonObject{
+		"status":   "OK",
+		"response": list,
+	}
+}
+
+func honeytokenAdd(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if err = honeytokens.Add(req["path"].(string)); err != nil {
+		return errorResponse(err, "")
+	}
+
+	return jsonObject{
+		"status":   "OK",
+		"response": nil,
+	}
+}
+
+func honeytokenRemove(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if err = honeytokens.Remove(req["path"].(string)); err != nil {
+		return errorResponse(err, "")
+	}
+
+	return jsonObject{
+		"status":   "OK",
+		"response": nil,
+	}
+}
@@ -0,0 +1,247 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Message catalogs map English API messages, optionally containing format
+// verbs (e.g. "path %s exists"), to their translation. Translations reference
+// the values matched by the verbs with %s, or %[n]s to change their order.
+//
+//go:embed i18n/*.json
+var catalogFiles embed.FS
+
+var catalogs = make(map[string]*catalog)
+
+var formatVerb = regexp.MustCompile(`%[sdvq]`)
+
+type catalogMessage struct {
+	pattern     *regexp.Regexp
+	translation string
+}
+
+type catalog struct {
+	exact    map[string]string
+	patterns []catalogMessage
+}
+
+func newCatalog(data []byte) (c *catalog, err error) {
+	var messages map[string]string
+
+	if err = json.Unmarshal(data, &messages); err != nil {
+		return
+	}
+
+	c = &catalog{
+		exact: make(map[string]string),
+	}
+
+	for msg, translation := range messages {
+		if !formatVerb.MatchString(msg) {
+			c.exact[msg] = translation
+			continue
+		}
+
+		parts := formatVerb.Split(msg, -1)
+
+		for i := range parts {
+			parts[i] = regexp.QuoteMeta(parts[i])
+		}
+
+		pattern, err := regexp.Compile("^" + strings.Join(parts, "(.*?)") + "$")
+
+		if err != nil {
+			return nil, err
+		}
+
+		c.patterns = append(c.patterns, catalogMessage{pattern, translation})
+	}
+
+	// prefer most specific patterns
+	sort.Slice(c.patterns, func(i, j int) bool {
+		return len(c.patterns[i].pattern.String()) > len(c.patterns[j].pattern.String())
+	})
+
+	return
+}
+
+func (c *catalog) Translate(msg string) string {
+	if translation, ok := c.exact[msg]; ok {
+		return translation
+	}
+
+	for _, m := range c.patterns {
+		match := m.pattern.FindStringSubmatch(msg)
+
+		if match == nil {
+			continue
+		}
+
+		args := make([]interface{}, len(match)-1)
+
+		for i, arg := range match[1:] {
+			args[i] = arg
+		}
+
+		return fmt.Sprintf(m.translation, args...)
+	}
+
+	return msg
+}
+
+func loadCatalogs(fsys fs.FS) (err error) {
+	files, err := fs.Glob(fsys, "*.json")
+
+	if err != nil {
+		return
+	}
+
+	for _, f := range files {
+		data, err := fs.ReadFile(fsys, f)
+
+		if err != nil {
+			return err
+		}
+
+		c, err := newCatalog(data)
+
+		if err != nil {
+			return fmt.Errorf("invalid message catalog %s, %v", f, err)
+		}
+
+		catalogs[strings.TrimSuffix(path.Base(f), ".json")] = c
+	}
+
+	return
+}
+
+func initCatalogs() (err error) {
+	embedded, err := fs.Sub(catalogFiles, "i18n")
+
+	if err != nil {
+		return
+	}
+
+	if err = loadCatalogs(embedded); err != nil {
+		return
+	}
+
+	if conf.LocalePath != "" {
+		if err = loadCatalogs(os.DirFS(conf.LocalePath)); err != nil {
+			return
+		}
+	}
+
+	log.Printf("loaded %d message catalogs", len(catalogs))
+
+	return
+}
+
+// requestCatalog returns the catalog best matching the request
+// Accept-Language header, nil for English or unsupported languages.
+func requestCatalog(r *http.Request) *catalog {
+	type language struct {
+		tag string
+		q   float64
+	}
+
+	var languages []language
+
+	for _, entry := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		params := strings.Split(strings.TrimSpace(entry), ";")
+		l := language{tag: strings.ToLower(params[0]), q: 1}
+
+		for _, p := range params[1:] {
+			if q := strings.TrimPrefix(strings.TrimSpace(p), "q="); q != p {
+				l.q, _ = strconv.ParseFloat(q, 64)
+			}
+		}
+
+		if l.tag != "" && l.q > 0 {
+			languages = append(languages, l)
+		}
+	}
+
+	sort.SliceStable(languages, func(i, j int) bool {
+		return languages[i].q > languages[j].q
+	})
+
+	for _, l := range languages {
+		primary := strings.SplitN(l.tag, "-", 2)[0]
+
+		if primary == "en" {
+			return nil
+		}
+
+		if c, ok := catalogs[l.tag]; ok {
+			return c
+		}
+
+		if c, ok := catalogs[primary]; ok {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// localize translates error responses and status messages according to the
+// request preferred language.
+func localize(res jsonObject, r *http.Request) jsonObject {
+	c := requestCatalog(r)
+
+	if c == nil || res == nil {
+		return res
+	}
+
+	translateEntries := func(entries []statusEntry) []statusEntry {
+		translated := make([]statusEntry, len(entries))
+
+		for i, e := range entries {
+			e.Message = c.Translate(e.Message)
+			translated[i] = e
+		}
+
+		return translated
+	}
+
+	switch response := res["response"].(type) {
+	case []string:
+		if res["status"] == "OK" {
+			break
+		}
+
+		translated := make([]string, len(response))
+
+		for i, msg := range response {
+			translated[i] = c.Translate(msg)
+		}
+
+		res["response"] = translated
+	case map[string]interface{}:
+		for _, k := range []string{"log", "notification"} {
+			if entries, ok := response[k].([]statusEntry); ok {
+				response[k] = translateEntries(entries)
+			}
+		}
+	}
+
+	return res
+}
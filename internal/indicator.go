@@ -0,0 +1,170 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Hardware status indicator, a sysfs LED (or GPIO value file) is driven with
+// a pattern reflecting the current state. Patterns are sequences of "1" (on)
+// and "0" (off) steps, each lasting indicatorStep.
+
+const indicatorStep = 100 * time.Millisecond
+
+// error state duration after an error is logged
+const indicatorErrorTime = 5 * time.Second
+
+// indicator states, in increasing priority
+const (
+	indicatorLocked   = "locked"
+	indicatorUnlocked = "unlocked"
+	indicatorTransfer = "transfer"
+	indicatorPIN      = "pin"
+	indicatorError    = "error"
+	indicatorTamper   = "tamper"
+)
+
+var defaultLEDPatterns = map[string]string{
+	indicatorLocked:   "1000000000",
+	indicatorUnlocked: "1",
+	indicatorTransfer: "10",
+	indicatorPIN:      "1100",
+	indicatorError:    "1111100000",
+	indicatorTamper:   "1010100000",
+}
+
+type indicatorStatus struct {
+	sync.Mutex
+	tamper bool
+	path   string
+	on     string
+	value  string
+}
+
+var indicator indicatorStatus
+
+func (i *indicatorStatus) SetTamper(tamper bool) {
+	i.Lock()
+	defer i.Unlock()
+
+	i.tamper = tamper
+}
+
+func (i *indicatorStatus) State() string {
+	i.Lock()
+	tamper := i.tamper
+	i.Unlock()
+
+	switch {
+	case tamper:
+		return indicatorTamper
+	case time.Since(status.LastError()) < indicatorErrorTime:
+		return indicatorError
+	case keypadState.Waiting():
+		return indicatorPIN
+	case len(status.Notifications()) > 0:
+		return indicatorTransfer
+	case session.Active():
+		return indicatorUnlocked
+	default:
+		return indicatorLocked
+	}
+}
+
+func ledPattern(state string) string {
+	if p, ok := conf.LEDPatterns[state]; ok && p != "" {
+		return p
+	}
+
+	return defaultLEDPatterns[state]
+}
+
+// open resolves the value file and "on" value for the configured LED, sysfs
+// LED directories are driven through their brightness at maximum level.
+func (i *indicatorStatus) open() (err error) {
+	i.path = conf.LED
+	i.on = "1"
+
+	stat, err := os.Stat(conf.LED)
+
+	if err != nil {
+		return
+	}
+
+	if stat.IsDir() {
+		i.path = filepath.Join(conf.LED, "brightness")
+
+		if max, err := readSysfs(filepath.Join(conf.LED, "max_brightness")); err == nil {
+			i.on = max
+		}
+
+		// disable any kernel trigger overriding brightness
+		_ = ioutil.WriteFile(filepath.Join(conf.LED, "trigger"), []byte("none"), 0600)
+	}
+
+	return
+}
+
+func (i *indicatorStatus) set(on bool) (err error) {
+	value := "0"
+
+	if on {
+		value = i.on
+	}
+
+	if value == i.value {
+		return
+	}
+
+	i.value = value
+
+	return ioutil.WriteFile(i.path, []byte(value), 0600)
+}
+
+func startIndicator() (err error) {
+	if conf.LED == "" {
+		return
+	}
+
+	if err = indicator.open(); err != nil {
+		return
+	}
+
+	go func() {
+		defer recoverJob("status indicator")
+
+		var step int
+		var previous string
+
+		for {
+			state := indicator.State()
+			pattern := ledPattern(state)
+
+			if state != previous {
+				step = 0
+				previous = state
+			}
+
+			if pattern != "" {
+				if err := indicator.set(pattern[step%len(pattern)] == '1'); err != nil {
+					status.Error(err)
+					return
+				}
+			}
+
+			step++
+			time.Sleep(indicatorStep)
+		}
+	}()
+
+	return
+}
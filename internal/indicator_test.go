@@ -0,0 +1,54 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestIndicator(t *testing.T) {
+	conf.SetDefaults()
+
+	// the last written value is cached across runs
+	indicator = indicatorStatus{}
+
+	conf.LED = t.TempDir()
+	t.Cleanup(func() {
+		conf.LED = ""
+		indicator = indicatorStatus{}
+	})
+
+	ioutil.WriteFile(filepath.Join(conf.LED, "max_brightness"), []byte("255\n"), 0600)
+
+	if err := indicator.open(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := indicator.set(true); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, _ := readSysfs(filepath.Join(conf.LED, "brightness")); b != "255" {
+		t.Errorf("unexpected brightness: %s", b)
+	}
+
+	status.Error(errors.New("indicator test"))
+
+	if state := indicator.State(); state != indicatorError {
+		t.Errorf("unexpected state: %s", state)
+	}
+
+	indicator.SetTamper(true)
+	defer indicator.SetTamper(false)
+
+	if state := indicator.State(); state != indicatorTamper || ledPattern(state) != "1010100000" {
+		t.Errorf("unexpected state: %s", state)
+	}
+}
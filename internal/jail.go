@@ -0,0 +1,289 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+const traversalPattern = "../"
+
+// jail confines paths within its root directory, all file API paths are
+// resolved through the encrypted volume jail (see absolutePath) while archive
+// entries are resolved through a jail rooted at the extraction directory.
+type jail struct {
+	root string
+}
+
+func volumeJail() *jail {
+	return &jail{root: filepath.Clean(conf.MountPoint)}
+}
+
+// Contains reports whether p lexically lies within the jail.
+func (j *jail) Contains(p string) bool {
+	p = filepath.Clean(p)
+
+	return p == j.root || strings.HasPrefix(p, strings.TrimSuffix(j.root, "/")+"/")
+}
+
+// Path canonicalizes a path relative to the jail root, rejecting invalid
+// characters, traversal elements and paths resolving outside of the jail
+// through symbolic links.
+func (j *jail) Path(subPath string) (osPath string, err error) {
+	if strings.ContainsRune(subPath, 0) {
+		return "", errors.New("invalid path")
+	}
+
+	for _, element := range strings.Split(subPath, "/") {
+		if element == ".." {
+			return "", errors.New("path traversal detected")
+		}
+	}
+
+	osPath = filepath.Join(j.root, filepath.Clean("/"+subPath))
+
+	if !j.Contains(osPath) {
+		return "", errors.New("path traversal detected")
+	}
+
+	err = j.checkSymlinks(osPath)
+
+	return
+}
+
+// Rel returns the jail relative path of p, or its base name if p lies outside
+// of the jail.
+func (j *jail) Rel(p string) string {
+	if !strings.HasPrefix(p, j.root) {
+		return path.Base(p)
+	}
+
+	return p[len(j.root):]
+}
+
+// Resolve returns osPath with the symbolic links of its existing components
+// resolved, refusing paths resolving outside of the jail.
+func (j *jail) Resolve(osPath string) (resolved string, err error) {
+	osPath = filepath.Clean(osPath)
+	root, err := filepath.EvalSymlinks(j.root)
+
+	if err != nil {
+		// nothing to resolve within a jail yet to be created
+		if os.IsNotExist(err) {
+			return osPath, nil
+		}
+
+		return
+	}
+
+	existing := osPath
+
+	for {
+		if _, err = os.Lstat(existing); err == nil {
+			break
+		}
+
+		if existing == j.root {
+			return osPath, nil
+		}
+
+		existing = filepath.Dir(existing)
+	}
+
+	if resolved, err = filepath.EvalSymlinks(existing); err != nil {
+		return "", fmt.Errorf("cannot resolve %s, %v", j.Rel(existing), err)
+	}
+
+	if !(&jail{root: root}).Contains(resolved) {
+		return "", errors.New("symbolic link resolves outside of the jail")
+	}
+
+	return filepath.Join(j.root, strings.TrimPrefix(resolved, root), strings.TrimPrefix(osPath, existing)), nil
+}
+
+// checkSymlinks resolves the existing components of osPath, refusing paths
+// resolving outside of the jail and, with the reject policy, paths traversing
+// symbolic links.
+func (j *jail) checkSymlinks(osPath string) (err error) {
+	resolved, err := j.Resolve(osPath)
+
+	if err != nil {
+		return
+	}
+
+	if conf.Symlinks == symlinkPreserve || conf.Symlinks == symlinkDereference {
+		return
+	}
+
+	if resolved != filepath.Clean(osPath) {
+		return errors.New("symbolic links are not allowed")
+	}
+
+	return
+}
+
+// MkdirAll creates the osPath directory along with any missing parent.
+func (j *jail) MkdirAll(osPath string, perm os.FileMode) (err error) {
+	osPath = filepath.Clean(osPath)
+
+	if info, err := j.Stat(osPath); err == nil {
+		if !info.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: osPath, Err: syscall.ENOTDIR}
+		}
+
+		return nil
+	}
+
+	if osPath != j.root {
+		if err = j.MkdirAll(filepath.Dir(osPath), perm); err != nil {
+			return
+		}
+	}
+
+	if err = j.Mkdir(osPath, perm); os.IsExist(err) {
+		if info, e := j.Stat(osPath); e == nil && info.IsDir() {
+			return nil
+		}
+	}
+
+	return
+}
+
+// RemoveAll removes osPath and, if a directory, any children it contains
+// without following symbolic links.
+func (j *jail) RemoveAll(osPath string) (err error) {
+	if filepath.Clean(osPath) == j.root {
+		return errors.New("operation on the jail root not allowed")
+	}
+
+	info, err := j.Lstat(osPath)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return
+	}
+
+	if info.IsDir() {
+		entries, err := j.ReadDir(osPath)
+
+		if err != nil {
+			return err
+		}
+
+		for _, e := range entries {
+			if err = j.RemoveAll(filepath.Join(osPath, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return j.Remove(osPath)
+}
+
+// ReadDir returns the osPath directory entries sorted by name.
+func (j *jail) ReadDir(osPath string) (entries []os.DirEntry, err error) {
+	dir, err := j.OpenFile(osPath, os.O_RDONLY|syscall.O_DIRECTORY, 0)
+
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+
+	entries, err = dir.ReadDir(-1)
+	sort.Slice(entries, func(i, k int) bool { return entries[i].Name() < entries[k].Name() })
+
+	return
+}
+
+// ReadFile returns the content of osPath.
+func (j *jail) ReadFile(osPath string) ([]byte, error) {
+	f, err := j.Open(osPath)
+
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ioutil.ReadAll(f)
+}
+
+// WriteFile writes data to osPath, creating it if necessary.
+func (j *jail) WriteFile(osPath string, data []byte, perm os.FileMode) (err error) {
+	f, err := j.OpenFile(osPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+
+	if err != nil {
+		return
+	}
+
+	_, err = f.Write(data)
+
+	if e := f.Close(); err == nil {
+		err = e
+	}
+
+	return
+}
+
+// Walk walks the tree rooted at osPath like filepath.Walk, without following
+// symbolic links and resolving every entry beneath the jail root.
+func (j *jail) Walk(osPath string, fn filepath.WalkFunc) (err error) {
+	info, err := j.Lstat(osPath)
+
+	if err != nil {
+		err = fn(osPath, nil, err)
+	} else {
+		err = j.walk(osPath, info, fn)
+	}
+
+	if err == filepath.SkipDir {
+		return nil
+	}
+
+	return
+}
+
+func (j *jail) walk(osPath string, info os.FileInfo, fn filepath.WalkFunc) (err error) {
+	if !info.IsDir() {
+		return fn(osPath, info, nil)
+	}
+
+	entries, err := j.ReadDir(osPath)
+
+	if e := fn(osPath, info, err); err != nil || e != nil {
+		return e
+	}
+
+	for _, entry := range entries {
+		p := filepath.Join(osPath, entry.Name())
+		info, err := j.Lstat(p)
+
+		if err != nil {
+			if err = fn(p, info, err); err != nil && err != filepath.SkipDir {
+				return err
+			}
+
+			continue
+		}
+
+		if err = j.walk(p, info, fn); err != nil && (!info.IsDir() || err != filepath.SkipDir) {
+			return err
+		}
+	}
+
+	return nil
+}
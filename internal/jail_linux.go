@@ -0,0 +1,321 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// +build linux
+
+package interlock
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Jailed file access, files are opened relative to a descriptor of the jail
+// root with openat2(2) RESOLVE_BENEATH, the kernel refuses any resolution
+// escaping the root (traversal elements, absolute or escaping symbolic links,
+// magic links) at open time, making the lexical checks of Path immune to
+// races with concurrent renames or link creation. With the reject symbolic
+// link policy any link found during resolution is refused.
+//
+// Every other file system operation within the jail is performed with *at
+// system calls relative to a descriptor of the parent directory, itself
+// opened beneath the jail root, so that no path element is ever resolved
+// outside of it.
+//
+// On kernels lacking openat2 (< 5.6) the checks of Path are applied before
+// opening, without the symbolic link guarantees.
+
+// rel returns the path of osPath relative to the jail root.
+func (j *jail) rel(osPath string) (rel string, err error) {
+	osPath = filepath.Clean(osPath)
+
+	if !j.Contains(osPath) {
+		return "", errors.New("path traversal detected")
+	}
+
+	if rel = strings.TrimPrefix(strings.TrimPrefix(osPath, j.root), "/"); rel == "" {
+		rel = "."
+	}
+
+	return
+}
+
+// OpenFile opens osPath, which must lie within the jail, resolving it
+// beneath the jail root.
+func (j *jail) OpenFile(osPath string, flag int, perm os.FileMode) (f *os.File, err error) {
+	rel, err := j.rel(osPath)
+
+	if err != nil {
+		return
+	}
+
+	root, err := unix.Open(j.root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: osPath, Err: err}
+	}
+	defer unix.Close(root)
+
+	how := &unix.OpenHow{
+		Flags:   uint64(flag | unix.O_CLOEXEC),
+		Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_MAGICLINKS,
+	}
+
+	if flag&os.O_CREATE != 0 {
+		how.Mode = uint64(perm.Perm())
+	}
+
+	if conf.Symlinks != symlinkPreserve && conf.Symlinks != symlinkDereference {
+		how.Resolve |= unix.RESOLVE_NO_SYMLINKS
+	}
+
+	fd, err := unix.Openat2(root, rel, how)
+
+	switch err {
+	case nil:
+		return os.NewFile(uintptr(fd), osPath), nil
+	case unix.ENOSYS:
+		if err = j.checkSymlinks(osPath); err != nil {
+			return
+		}
+
+		return os.OpenFile(osPath, flag, perm)
+	case unix.EXDEV:
+		return nil, errors.New("path traversal detected")
+	case unix.ELOOP:
+		if how.Resolve&unix.RESOLVE_NO_SYMLINKS != 0 {
+			return nil, errors.New("symbolic links are not allowed")
+		}
+	}
+
+	return nil, &os.PathError{Op: "open", Path: osPath, Err: err}
+}
+
+// Open opens osPath, which must lie within the jail, for reading.
+func (j *jail) Open(osPath string) (*os.File, error) {
+	return j.OpenFile(osPath, os.O_RDONLY, 0)
+}
+
+// CreateTemp creates a new temporary file in dir, which must lie within the
+// jail, with a name beginning with prefix.
+func (j *jail) CreateTemp(dir string, prefix string) (f *os.File, err error) {
+	for i := 0; i < 100; i++ {
+		var suffix string
+
+		if suffix, err = randomString(6); err != nil {
+			return
+		}
+
+		f, err = j.OpenFile(filepath.Join(dir, prefix+suffix), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+
+		if !os.IsExist(err) {
+			return
+		}
+	}
+
+	return
+}
+
+// MkdirTemp creates a new temporary directory in dir, which must lie within
+// the jail, with a name beginning with prefix.
+func (j *jail) MkdirTemp(dir string, prefix string) (name string, err error) {
+	for i := 0; i < 100; i++ {
+		var suffix string
+
+		if suffix, err = randomString(6); err != nil {
+			return
+		}
+
+		name = filepath.Join(dir, prefix+suffix)
+
+		if err = j.Mkdir(name, 0700); !os.IsExist(err) {
+			return
+		}
+	}
+
+	return
+}
+
+// parent opens the directory containing osPath beneath the jail root, for use
+// with the *at system calls on the final path element, which (unlike
+// intermediate ones) is never followed when a symbolic link. The jail root
+// itself has no parent within the jail.
+func (j *jail) parent(osPath string) (dir *os.File, name string, err error) {
+	osPath = filepath.Clean(osPath)
+
+	if osPath == j.root {
+		return nil, "", errors.New("operation on the jail root not allowed")
+	}
+
+	if dir, err = j.OpenFile(filepath.Dir(osPath), unix.O_PATH|unix.O_DIRECTORY, 0); err != nil {
+		return
+	}
+
+	return dir, filepath.Base(osPath), nil
+}
+
+// Stat returns the information of osPath, following a final symbolic link
+// only as permitted by the symbolic link policy.
+func (j *jail) Stat(osPath string) (info os.FileInfo, err error) {
+	f, err := j.OpenFile(osPath, unix.O_PATH, 0)
+
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	return f.Stat()
+}
+
+// Lstat returns the information of osPath, describing a final symbolic link
+// rather than its target.
+func (j *jail) Lstat(osPath string) (info os.FileInfo, err error) {
+	f, err := j.OpenFile(osPath, unix.O_PATH|unix.O_NOFOLLOW, 0)
+
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	return f.Stat()
+}
+
+// Mkdir creates the osPath directory.
+func (j *jail) Mkdir(osPath string, perm os.FileMode) (err error) {
+	dir, name, err := j.parent(osPath)
+
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+
+	if err = unix.Mkdirat(int(dir.Fd()), name, uint32(perm.Perm())); err != nil {
+		return &os.PathError{Op: "mkdir", Path: osPath, Err: err}
+	}
+
+	return
+}
+
+// Remove removes the osPath file or empty directory, a final symbolic link
+// is removed rather than its target.
+func (j *jail) Remove(osPath string) (err error) {
+	dir, name, err := j.parent(osPath)
+
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+
+	if err = unix.Unlinkat(int(dir.Fd()), name, 0); err == unix.EISDIR {
+		err = unix.Unlinkat(int(dir.Fd()), name, unix.AT_REMOVEDIR)
+	}
+
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: osPath, Err: err}
+	}
+
+	return
+}
+
+// Rename moves oldPath to newPath.
+func (j *jail) Rename(oldPath string, newPath string) (err error) {
+	return j.linkat("rename", oldPath, newPath, func(oldDir int, oldName string, newDir int, newName string) error {
+		return unix.Renameat(oldDir, oldName, newDir, newName)
+	})
+}
+
+// Link creates newPath as a hard link to oldPath, a final symbolic link in
+// oldPath is linked rather than its target.
+func (j *jail) Link(oldPath string, newPath string) (err error) {
+	return j.linkat("link", oldPath, newPath, func(oldDir int, oldName string, newDir int, newName string) error {
+		return unix.Linkat(oldDir, oldName, newDir, newName, 0)
+	})
+}
+
+func (j *jail) linkat(op string, oldPath string, newPath string, fn func(int, string, int, string) error) (err error) {
+	oldDir, oldName, err := j.parent(oldPath)
+
+	if err != nil {
+		return
+	}
+	defer oldDir.Close()
+
+	newDir, newName, err := j.parent(newPath)
+
+	if err != nil {
+		return
+	}
+	defer newDir.Close()
+
+	if err = fn(int(oldDir.Fd()), oldName, int(newDir.Fd()), newName); err != nil {
+		return &os.LinkError{Op: op, Old: oldPath, New: newPath, Err: err}
+	}
+
+	return
+}
+
+// Symlink creates newPath as a symbolic link to target, the target is stored
+// verbatim and must be validated by the caller.
+func (j *jail) Symlink(target string, newPath string) (err error) {
+	dir, name, err := j.parent(newPath)
+
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+
+	if err = unix.Symlinkat(target, int(dir.Fd()), name); err != nil {
+		return &os.LinkError{Op: "symlink", Old: target, New: newPath, Err: err}
+	}
+
+	return
+}
+
+// Readlink returns the target of the osPath symbolic link.
+func (j *jail) Readlink(osPath string) (target string, err error) {
+	dir, name, err := j.parent(osPath)
+
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+
+	buf := make([]byte, maxLinkTarget)
+	n, err := unix.Readlinkat(int(dir.Fd()), name, buf)
+
+	if err != nil {
+		return "", &os.PathError{Op: "readlink", Path: osPath, Err: err}
+	}
+
+	return string(buf[:n]), nil
+}
+
+// Chtimes changes the access and modification times of osPath, a final
+// symbolic link is changed rather than its target.
+func (j *jail) Chtimes(osPath string, atime time.Time, mtime time.Time) (err error) {
+	dir, name, err := j.parent(osPath)
+
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+
+	ts := []unix.Timespec{
+		unix.NsecToTimespec(atime.UnixNano()),
+		unix.NsecToTimespec(mtime.UnixNano()),
+	}
+
+	if err = unix.UtimesNanoAt(int(dir.Fd()), name, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return &os.PathError{Op: "chtimes", Path: osPath, Err: err}
+	}
+
+	return
+}
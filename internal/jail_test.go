@@ -0,0 +1,200 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJail(t *testing.T) {
+	root, _ := os.MkdirTemp("", "jail_test-")
+	defer os.RemoveAll(root)
+
+	j := &jail{root: root}
+
+	valid := map[string]string{
+		"":             root,
+		"/":            root,
+		"/a/b.txt":     filepath.Join(root, "a/b.txt"),
+		"a//b/./c":     filepath.Join(root, "a/b/c"),
+		"/a/..b/c..":   filepath.Join(root, "a/..b/c.."),
+		"/trailing/":   filepath.Join(root, "trailing"),
+		"/unicode/ü.x": filepath.Join(root, "unicode/ü.x"),
+	}
+
+	for p, expected := range valid {
+		osPath, err := j.Path(p)
+
+		if err != nil || osPath != expected {
+			t.Errorf("%q: unexpected resolution %q (%v)", p, osPath, err)
+		}
+	}
+
+	invalid := []string{
+		"..",
+		"/..",
+		"/a/../../b",
+		"a/..",
+		"/a\x00b",
+	}
+
+	for _, p := range invalid {
+		if osPath, err := j.Path(p); err == nil {
+			t.Errorf("%q: invalid path accepted (%q)", p, osPath)
+		}
+	}
+
+	os.Symlink("/", filepath.Join(root, "escape"))
+
+	if _, err := j.Path("/escape/etc"); err == nil {
+		t.Error("symbolic link escaping the jail accepted")
+	}
+}
+
+func TestJailOpen(t *testing.T) {
+	conf.SetDefaults()
+	defer conf.SetDefaults()
+
+	root := t.TempDir()
+	j := &jail{root: root}
+
+	os.Mkdir(filepath.Join(root, "a"), 0700)
+	os.WriteFile(filepath.Join(root, "a/b.txt"), []byte("jailed"), 0600)
+	os.Symlink("/etc", filepath.Join(root, "escape"))
+	os.Symlink("a", filepath.Join(root, "inner"))
+
+	f, err := j.Open(filepath.Join(root, "a/b.txt"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.Close()
+
+	for _, p := range []string{"/etc/passwd", filepath.Join(root, "escape/passwd"), filepath.Join(root, "inner/b.txt")} {
+		if f, err := j.Open(p); err == nil {
+			f.Close()
+			t.Errorf("%s: opened outside of the jail or through a symbolic link", p)
+		}
+	}
+
+	conf.Symlinks = symlinkPreserve
+
+	if f, err := j.Open(filepath.Join(root, "inner/b.txt")); err != nil {
+		t.Errorf("link within the jail refused (%v)", err)
+	} else {
+		f.Close()
+	}
+
+	if f, err := j.Open(filepath.Join(root, "escape/passwd")); err == nil {
+		f.Close()
+		t.Error("link escaping the jail followed")
+	}
+
+	tmp, err := j.CreateTemp(filepath.Join(root, "a"), partialPrefix)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmp.Close()
+
+	if !strings.HasPrefix(tmp.Name(), filepath.Join(root, "a", partialPrefix)) {
+		t.Errorf("unexpected temporary file %s", tmp.Name())
+	}
+}
+
+func TestJailOperations(t *testing.T) {
+	defer conf.SetDefaults()
+
+	for _, policy := range []string{symlinkReject, symlinkPreserve} {
+		conf.Symlinks = policy
+
+		root := t.TempDir()
+		outside := t.TempDir()
+		j := &jail{root: root}
+
+		os.Mkdir(filepath.Join(root, "a"), 0700)
+		os.WriteFile(filepath.Join(root, "a/b.txt"), []byte("jailed"), 0600)
+		os.WriteFile(filepath.Join(outside, "f"), []byte("outside"), 0600)
+		os.Symlink("f", filepath.Join(outside, "l"))
+		os.Symlink(outside, filepath.Join(root, "escape"))
+
+		past := time.Unix(0, 0)
+		os.Chtimes(outside, past, past)
+
+		in := func(p string) string { return filepath.Join(root, p) }
+
+		ops := map[string]func() error{
+			"stat":           func() error { _, err := j.Stat(in("escape/f")); return err },
+			"lstat":          func() error { _, err := j.Lstat(in("escape/f")); return err },
+			"mkdir":          func() error { return j.Mkdir(in("escape/d"), 0700) },
+			"mkdirall":       func() error { return j.MkdirAll(in("escape/d/e"), 0700) },
+			"remove":         func() error { return j.Remove(in("escape/f")) },
+			"removeall":      func() error { return j.RemoveAll(in("escape/f")) },
+			"rename from":    func() error { return j.Rename(in("escape/f"), in("a/f")) },
+			"rename to":      func() error { return j.Rename(in("a/b.txt"), in("escape/b.txt")) },
+			"link from":      func() error { return j.Link(in("escape/f"), in("a/f")) },
+			"link to":        func() error { return j.Link(in("a/b.txt"), in("escape/b.txt")) },
+			"symlink":        func() error { return j.Symlink("f", in("escape/s")) },
+			"readlink":       func() error { _, err := j.Readlink(in("escape/l")); return err },
+			"chtimes":        func() error { return j.Chtimes(in("escape/f"), time.Now(), time.Now()) },
+			"readdir":        func() error { _, err := j.ReadDir(in("escape")); return err },
+			"readfile":       func() error { _, err := j.ReadFile(in("escape/f")); return err },
+			"writefile":      func() error { return j.WriteFile(in("escape/f"), []byte("x"), 0600) },
+			"createtemp":     func() error { _, err := j.CreateTemp(in("escape"), partialPrefix); return err },
+			"mkdirtemp":      func() error { _, err := j.MkdirTemp(in("escape"), partialPrefix); return err },
+			"remove root":    func() error { return j.Remove(root) },
+			"rename root":    func() error { return j.Rename(root, in("a/root")) },
+			"removeall root": func() error { return j.RemoveAll(root) },
+		}
+
+		for name, op := range ops {
+			if err := op(); err == nil {
+				t.Errorf("%s, %s: operation escaping the jail allowed", policy, name)
+			}
+		}
+
+		// a final symbolic link is operated on rather than followed
+		if err := j.Chtimes(in("escape"), time.Now(), time.Now()); err != nil {
+			t.Errorf("%s: %v", policy, err)
+		}
+
+		var walked []string
+
+		err := j.Walk(root, func(p string, info os.FileInfo, err error) error {
+			walked = append(walked, j.Rel(p))
+			return err
+		})
+
+		if err != nil || strings.Join(walked, ",") != ",/a,/a/b.txt,/escape" {
+			t.Errorf("%s: unexpected walk %v (%v)", policy, walked, err)
+		}
+
+		if err = j.RemoveAll(in("escape")); err != nil {
+			t.Errorf("%s: %v", policy, err)
+		}
+
+		entries, _ := os.ReadDir(outside)
+
+		if len(entries) != 2 {
+			t.Errorf("%s: outside directory modified (%d entries)", policy, len(entries))
+		}
+
+		if buf, err := os.ReadFile(filepath.Join(outside, "f")); err != nil || string(buf) != "outside" {
+			t.Errorf("%s: outside file modified", policy)
+		}
+
+		if info, err := os.Stat(outside); err != nil || !info.ModTime().Equal(past) {
+			t.Errorf("%s: outside directory times modified", policy)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/syslog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Operation journal, mutating file operations record the partial artifacts
+// they create (upload targets and temporary files, cipher outputs, archives,
+// copies) in a journal synchronized to the encrypted volume before starting
+// and remove their entry on completion.
+//
+// Entries found at login belong to operations interrupted by a power loss or
+// crash, they are reported until each is either rolled back, removing its
+// artifacts, or resumed, which is possible for operations not requiring
+// credentials (copy and archive extraction).
+
+const journalFile = ".interlock-journal.json"
+
+type journalEntry struct {
+	ID        string   `json:"id"`
+	Op        string   `json:"op"`
+	Src       string   `json:"src,omitempty"`
+	Dst       string   `json:"dst"`
+	Artifacts []string `json:"artifacts"`
+	Started   int64    `json:"started"`
+}
+
+// operations which can be executed again from their source
+var journalResumable = map[string]int{
+	"copy":    _copy,
+	"extract": _extract,
+}
+
+type operationJournal struct {
+	sync.Mutex
+	active       map[string]*journalEntry
+	interrupted  map[string]*journalEntry
+	notification int
+}
+
+var journal operationJournal
+
+func journalPath() string {
+	return filepath.Join(conf.MountPoint, journalFile)
+}
+
+// save writes the journal, synchronizing it before replacing the previous
+// one, it must be called with the journal locked.
+func (j *operationJournal) save() (err error) {
+	entries := []*journalEntry{}
+
+	for _, e := range j.interrupted {
+		entries = append(entries, e)
+	}
+
+	for _, e := range j.active {
+		entries = append(entries, e)
+	}
+
+	buf, err := json.Marshal(entries)
+
+	if err != nil {
+		return
+	}
+
+	tmp := journalPath() + ".tmp"
+	f, err := volumeJail().OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+
+	if err != nil {
+		return
+	}
+
+	if _, err = f.Write(buf); err == nil {
+		err = f.Sync()
+	}
+
+	f.Close()
+
+	if err != nil {
+		return
+	}
+
+	return volumeJail().Rename(tmp, journalPath())
+}
+
+// Begin records an operation before it creates the argument artifacts, the
+// returned identifier must be passed to End once the operation terminates.
+func (j *operationJournal) Begin(op string, src string, dst string, artifacts ...string) (id string) {
+	id, err := randomString(8)
+
+	if err != nil {
+		return
+	}
+
+	e := &journalEntry{
+		ID:      id,
+		Op:      op,
+		Dst:     relativePath(dst),
+		Started: time.Now().Unix(),
+	}
+
+	if src != "" {
+		e.Src = relativePath(src)
+	}
+
+	for _, a := range artifacts {
+		e.Artifacts = append(e.Artifacts, relativePath(a))
+	}
+
+	j.Lock()
+	defer j.Unlock()
+
+	if j.active == nil {
+		j.active = make(map[string]*journalEntry)
+	}
+
+	j.active[id] = e
+	reportError("operation journal", j.save())
+
+	return
+}
+
+func (j *operationJournal) End(id string) {
+	j.Lock()
+	defer j.Unlock()
+
+	// operations terminating after logout are not recorded
+	if _, ok := j.active[id]; !ok {
+		return
+	}
+
+	delete(j.active, id)
+	reportError("operation journal", j.save())
+}
+
+// Recover loads the journal of the unlocked volume, reporting interrupted
+// operations.
+func (j *operationJournal) Recover() {
+	j.Lock()
+	defer j.Unlock()
+
+	j.active = make(map[string]*journalEntry)
+	j.interrupted = make(map[string]*journalEntry)
+
+	buf, err := volumeJail().ReadFile(journalPath())
+
+	if err != nil {
+		return
+	}
+
+	var entries []*journalEntry
+
+	if err = json.Unmarshal(buf, &entries); err != nil {
+		status.Log(syslog.LOG_ERR, "invalid operation journal: %v", err)
+		return
+	}
+
+	for _, e := range entries {
+		j.interrupted[e.ID] = e
+		status.Log(syslog.LOG_WARNING, "interrupted %s of %s detected", e.Op, e.Dst)
+	}
+
+	j.notify()
+}
+
+// notify updates the interrupted operations notification, it must be called
+// with the journal locked.
+func (j *operationJournal) notify() {
+	if j.notification != 0 {
+		status.Remove(j.notification)
+		j.notification = 0
+	}
+
+	if len(j.interrupted) > 0 {
+		j.notification = status.Notify(syslog.LOG_WARNING, "%d interrupted operation(s), resume or roll back", len(j.interrupted))
+	}
+}
+
+func (j *operationJournal) List() (entries []map[string]interface{}) {
+	j.Lock()
+	defer j.Unlock()
+
+	entries = []map[string]interface{}{}
+
+	for _, e := range j.interrupted {
+		_, resumable := journalResumable[e.Op]
+
+		entries = append(entries, map[string]interface{}{
+			"id":        e.ID,
+			"op":        e.Op,
+			"src":       e.Src,
+			"dst":       e.Dst,
+			"artifacts": e.Artifacts,
+			"started":   e.Started,
+			"resumable": resumable,
+		})
+	}
+
+	return
+}
+
+// Resolve rolls back an interrupted operation, removing its artifacts, and
+// optionally executes it again.
+func (j *operationJournal) Resolve(owner string, id string, resume bool) (err error) {
+	e, err := j.rollback(id, resume)
+
+	if err != nil || !resume {
+		return
+	}
+
+	src, err := absolutePath(e.Src)
+
+	if err != nil {
+		return
+	}
+
+	dst, err := absolutePath(e.Dst)
+
+	if err != nil {
+		return
+	}
+
+	status.Log(syslog.LOG_NOTICE, "resuming interrupted %s of %s", e.Op, e.Dst)
+
+	// the operation is journaled again as it executes
+	return fileOp(owner, src, dst, journalResumable[e.Op])
+}
+
+func (j *operationJournal) rollback(id string, resume bool) (e *journalEntry, err error) {
+	j.Lock()
+	defer j.Unlock()
+
+	e, ok := j.interrupted[id]
+
+	if !ok {
+		return nil, errors.New("invalid operation identifier")
+	}
+
+	if _, resumable := journalResumable[e.Op]; resume && !resumable {
+		return nil, fmt.Errorf("%s operations cannot be resumed", e.Op)
+	}
+
+	for _, a := range e.Artifacts {
+		var osPath string
+
+		if osPath, err = absolutePath(a); err != nil {
+			return
+		}
+
+		if err = volumeJail().RemoveAll(osPath); err != nil {
+			return
+		}
+	}
+
+	delete(j.interrupted, id)
+
+	if err = j.save(); err != nil {
+		return
+	}
+
+	j.notify()
+	status.Log(syslog.LOG_NOTICE, "rolled back interrupted %s of %s", e.Op, e.Dst)
+
+	return
+}
+
+func (j *operationJournal) Reset() {
+	j.Lock()
+	defer j.Unlock()
+
+	j.active = nil
+	j.interrupted = nil
+
+	if j.notification != 0 {
+		status.Remove(j.notification)
+		j.notification = 0
+	}
+}
+
+func journalList() (res jsonObject) {
+	return jsonObject{
+		"status":   "OK",
+		"response": journal.List(),
+	}
+}
+
+func journalResolve(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = journal.Resolve(jobOwner(r), req["id"].(string), req["action"].(string) == "resume")
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": nil,
+	}
+
+	return
+}
@@ -0,0 +1,81 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournalRecovery(t *testing.T) {
+	c := newTestServer(t)
+
+	c.login()
+	c.call("file/mkdir", jsonObject{"path": []string{"/src"}})
+	c.upload("/src/a.txt", testCleartext)
+	c.call("auth/logout", nil)
+
+	// operations interrupted before the previous logout
+	entries := []*journalEntry{
+		{ID: "copy", Op: "copy", Src: "/src", Dst: "/dst", Artifacts: []string{"/dst"}},
+		{ID: "upload", Op: "upload", Dst: "/b.txt", Artifacts: []string{"/.upload-partial"}},
+	}
+
+	os.MkdirAll(filepath.Join(conf.MountPoint, "dst"), 0700)
+	ioutil.WriteFile(filepath.Join(conf.MountPoint, "dst", "partial"), []byte("partial"), 0600)
+	ioutil.WriteFile(filepath.Join(conf.MountPoint, ".upload-partial"), []byte("partial"), 0600)
+
+	buf, _ := json.Marshal(entries)
+
+	if err := ioutil.WriteFile(filepath.Join(conf.MountPoint, journalFile), buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	res := c.mustCall("journal/list", nil)
+
+	if list := res["response"].([]interface{}); len(list) != 2 {
+		t.Fatalf("unexpected interrupted operations %v", list)
+	}
+
+	if res := c.call("journal/resolve", jsonObject{"id": "upload", "action": "resume"}); res["status"] != "KO" {
+		t.Error("resume of upload accepted")
+	}
+
+	c.mustCall("journal/resolve", jsonObject{"id": "upload", "action": "rollback"})
+
+	if _, err := os.Stat(filepath.Join(conf.MountPoint, ".upload-partial")); !os.IsNotExist(err) {
+		t.Error("upload artifact not removed")
+	}
+
+	c.mustCall("journal/resolve", jsonObject{"id": "copy", "action": "resume"})
+	c.wait("/dst/a.txt")
+
+	if _, err := os.Stat(filepath.Join(conf.MountPoint, "dst", "partial")); !os.IsNotExist(err) {
+		t.Error("copy artifact not removed")
+	}
+
+	if data := c.download("/dst/a.txt"); data != testCleartext {
+		t.Errorf("resumed copy mismatch: %s", data)
+	}
+
+	if list := c.mustCall("journal/list", nil)["response"].([]interface{}); len(list) != 0 {
+		t.Errorf("operations not resolved %v", list)
+	}
+
+	// completed operations are removed from the journal
+	buf, _ = ioutil.ReadFile(filepath.Join(conf.MountPoint, journalFile))
+
+	if err := json.Unmarshal(buf, &entries); err != nil || len(entries) != 0 {
+		t.Errorf("unexpected journal %s", buf)
+	}
+}
@@ -8,8 +8,6 @@ package interlock
 
 import (
 	"encoding/json"
-	"errors"
-	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -49,7 +47,7 @@ func (j jsonObject) String() (s string) {
 	b, err := json.Marshal(j)
 
 	if err != nil {
-		log.Print(err)
+		reportError("JSON encoding", err)
 		return
 	}
 
@@ -57,43 +55,3 @@ func (j jsonObject) String() (s string) {
 
 	return
 }
-
-func validateRequest(req jsonObject, reqAttrs []string) error {
-	for i := 0; i < len(reqAttrs); i++ {
-		var ok bool
-
-		args := strings.Split(reqAttrs[i], ":")
-
-		if len(args) != 2 {
-			return errors.New("unknown validation argument")
-		}
-
-		key := args[0]
-		kind := args[1]
-
-		if _, ok = req[key]; !ok {
-			return fmt.Errorf("missing attribute %s", key)
-		}
-
-		switch kind {
-		case "s":
-			_, ok = req[key].(string)
-		case "b":
-			_, ok = req[key].(bool)
-		case "n":
-			_, ok = req[key].(json.Number)
-		case "a":
-			_, ok = req[key].([]interface{})
-		case "i":
-			_, ok = req[key].(interface{})
-		default:
-			return errors.New("unknown validation kind")
-		}
-
-		if !ok {
-			return fmt.Errorf("invalid attribute %s (%s)", key, kind)
-		}
-	}
-
-	return nil
-}
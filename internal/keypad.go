@@ -0,0 +1,208 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/syslog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Hardware keypad PIN entry, the volume passphrase is entered on a PIN pad
+// attached to the device rather than in the browser. A keypad login request
+// blocks until the PIN is confirmed (Enter) or cancelled (Esc) on the keypad,
+// while the status indicator signals that PIN entry is expected.
+//
+// Keypads are abstracted by keypadInterface, the evdev implementation
+// supports USB HID keypads as well as I2C/GPIO matrix keypads exposed through
+// the Linux input subsystem (e.g. matrix-keypad, adp5588-keys drivers).
+
+const keypadTimeout = 60 * time.Second
+const keypadMaxPIN = 64
+
+type keypadInterface interface {
+	// ReadPIN blocks until a PIN is entered and confirmed.
+	ReadPIN(timeout time.Duration) (pin string, err error)
+}
+
+var keypad keypadInterface
+
+type keypadStatus struct {
+	sync.Mutex
+	pending bool
+}
+
+var keypadState keypadStatus
+
+// Start marks a PIN entry as pending, only one can be in progress.
+func (k *keypadStatus) Start() bool {
+	k.Lock()
+	defer k.Unlock()
+
+	if k.pending {
+		return false
+	}
+
+	k.pending = true
+
+	return true
+}
+
+func (k *keypadStatus) Done() {
+	k.Lock()
+	defer k.Unlock()
+
+	k.pending = false
+}
+
+func (k *keypadStatus) Waiting() bool {
+	k.Lock()
+	defer k.Unlock()
+
+	return k.pending
+}
+
+// Linux input event codes
+const (
+	evKey        = 0x01
+	keyEsc       = 1
+	keyBackspace = 14
+	keyEnter     = 28
+	keyKPEnter   = 96
+)
+
+var evdevDigits = map[uint16]byte{
+	// top row
+	2: '1', 3: '2', 4: '3', 5: '4', 6: '5', 7: '6', 8: '7', 9: '8', 10: '9', 11: '0',
+	// numeric keypad
+	71: '7', 72: '8', 73: '9', 75: '4', 76: '5', 77: '6', 79: '1', 80: '2', 81: '3', 82: '0',
+}
+
+// struct input_event, timeval members are longs
+var evdevEventSize = 2*strconv.IntSize/8 + 8
+
+type evdevKeypad struct {
+	path string
+}
+
+func (k *evdevKeypad) ReadPIN(timeout time.Duration) (pin string, err error) {
+	f, err := os.Open(k.path)
+
+	if err != nil {
+		return
+	}
+
+	timer := time.AfterFunc(timeout, func() { f.Close() })
+	defer timer.Stop()
+
+	pin, err = readPIN(f)
+
+	if !timer.Stop() {
+		return "", errors.New("PIN entry timeout")
+	}
+
+	f.Close()
+
+	return
+}
+
+// readPIN decodes input events until Enter is pressed.
+func readPIN(r io.Reader) (pin string, err error) {
+	var digits []byte
+
+	ev := make([]byte, evdevEventSize)
+
+	for {
+		if _, err = io.ReadFull(r, ev); err != nil {
+			return
+		}
+
+		typ := binary.LittleEndian.Uint16(ev[evdevEventSize-8:])
+		code := binary.LittleEndian.Uint16(ev[evdevEventSize-6:])
+		value := int32(binary.LittleEndian.Uint32(ev[evdevEventSize-4:]))
+
+		// key presses only
+		if typ != evKey || value != 1 {
+			continue
+		}
+
+		switch code {
+		case keyEnter, keyKPEnter:
+			if len(digits) == 0 {
+				continue
+			}
+
+			return string(digits), nil
+		case keyEsc:
+			return "", errors.New("PIN entry cancelled")
+		case keyBackspace:
+			if len(digits) > 0 {
+				digits = digits[:len(digits)-1]
+			}
+		default:
+			if d, ok := evdevDigits[code]; ok && len(digits) < keypadMaxPIN {
+				digits = append(digits, d)
+			}
+		}
+	}
+}
+
+func startKeypad() (err error) {
+	if conf.Keypad == "" {
+		return
+	}
+
+	if _, err = os.Stat(conf.Keypad); err != nil {
+		return
+	}
+
+	keypad = &evdevKeypad{path: conf.Keypad}
+
+	return
+}
+
+func keypadLogin(w http.ResponseWriter, r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if err = acknowledgeBanner(req, r.RemoteAddr); err != nil {
+		return errorResponse(err, "")
+	}
+
+	if keypad == nil {
+		return errorResponse(errors.New("keypad not available"), "")
+	}
+
+	if session.Active() {
+		return errorResponse(errors.New("existing session"), "INVALID_SESSION")
+	}
+
+	if !keypadState.Start() {
+		return errorResponse(errors.New("PIN entry already in progress"), "")
+	}
+
+	n := status.Notify(syslog.LOG_NOTICE, "enter PIN on keypad")
+	pin, err := keypad.ReadPIN(keypadTimeout)
+
+	status.Remove(n)
+	keypadState.Done()
+
+	if err != nil {
+		return errorResponse(err, "INVALID_SESSION")
+	}
+
+	return openSession(w, r, req["volume"].(string), pin, req["dispose"].(bool))
+}
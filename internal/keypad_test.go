@@ -0,0 +1,82 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func keypadEvents(codes ...uint16) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+
+	for _, code := range codes {
+		// press, release and synchronization events
+		for _, ev := range [][3]uint32{{evKey, uint32(code), 1}, {evKey, uint32(code), 0}, {0, 0, 0}} {
+			e := make([]byte, evdevEventSize)
+			binary.LittleEndian.PutUint16(e[evdevEventSize-8:], uint16(ev[0]))
+			binary.LittleEndian.PutUint16(e[evdevEventSize-6:], uint16(ev[1]))
+			binary.LittleEndian.PutUint32(e[evdevEventSize-4:], ev[2])
+			buf.Write(e)
+		}
+	}
+
+	return buf
+}
+
+type mockKeypad struct {
+	pin string
+}
+
+func (k *mockKeypad) ReadPIN(timeout time.Duration) (string, error) {
+	return k.pin, nil
+}
+
+func TestKeypad(t *testing.T) {
+	// 1, 2, backspace, KP2, 3, KP9, 0, enter
+	pin, err := readPIN(keypadEvents(2, 3, keyBackspace, 80, 4, 73, 11, keyKPEnter))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pin != "12390" {
+		t.Errorf("unexpected PIN %s", pin)
+	}
+
+	if _, err = readPIN(keypadEvents(2, 3, keyEsc)); err == nil {
+		t.Error("cancelled PIN entry accepted")
+	}
+
+	if _, err = readPIN(keypadEvents(2, 3)); err == nil {
+		t.Error("incomplete PIN entry accepted")
+	}
+
+	c := newTestServer(t)
+	conf.SetVolume(newMockVolume(testVolume, "12390"))
+
+	if res := c.call("auth/keypad", jsonObject{"volume": testVolume, "dispose": false}); res["status"] != "KO" {
+		t.Errorf("keypad login without keypad: %v", res)
+	}
+
+	keypad = &mockKeypad{pin: "0000"}
+	defer func() { keypad = nil }()
+
+	if res := c.call("auth/keypad", jsonObject{"volume": testVolume, "dispose": false}); res["status"] != "INVALID_SESSION" {
+		t.Errorf("invalid PIN accepted: %v", res)
+	}
+
+	keypad = &mockKeypad{pin: pin}
+
+	res := c.mustCall("auth/keypad", jsonObject{"volume": testVolume, "dispose": false})
+	c.XSRFToken = res["response"].(map[string]interface{})["XSRFToken"].(string)
+	defer c.call("auth/logout", nil)
+
+	c.mustCall("file/list", jsonObject{"path": "/", "sha256": false})
+}
@@ -0,0 +1,181 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Key usage log, every use of a stored key is recorded on the encrypted volume
+// to allow auditing of what a key has encrypted, decrypted, signed or
+// verified. Records are kept outside the key path as every file within it is
+// parsed as a key.
+
+const keyUsageDir = ".interlock-keyusage"
+const keyUsageInfoSize = 50
+
+const (
+	keyUsageEncrypt = "encrypt"
+	keyUsageDecrypt = "decrypt"
+	keyUsageSign    = "sign"
+	keyUsageVerify  = "verify"
+	keyUsageOTP     = "otp"
+)
+
+type keyUsage struct {
+	Epoch   int64  `json:"epoch"`
+	Op      string `json:"op"`
+	File    string `json:"file"`
+	Session string `json:"session"`
+}
+
+var keyUsageMutex sync.Mutex
+
+func keyUsagePath(k key) string {
+	sum := sha256.Sum256([]byte(filepath.Clean("/" + k.Path)))
+	return filepath.Join(conf.MountPoint, keyUsageDir, hex.EncodeToString(sum[:])+".log")
+}
+
+// sessionTag returns a short, non reversible, identifier of the current
+// session.
+func sessionTag() string {
+	if session.SessionID == "" {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(session.SessionID))
+
+	return hex.EncodeToString(sum[:4])
+}
+
+// recordKeyUsage appends a usage record for the argument key and volume file
+// path, errors are reported without failing the operation.
+func recordKeyUsage(k key, op string, file string) {
+	if readOnly.Enabled() {
+		return
+	}
+
+	reportError("key usage log", appendKeyUsage(k, keyUsage{
+		Epoch:   time.Now().Unix(),
+		Op:      op,
+		File:    file,
+		Session: sessionTag(),
+	}))
+}
+
+func appendKeyUsage(k key, u keyUsage) (err error) {
+	buf, err := json.Marshal(u)
+
+	if err != nil {
+		return
+	}
+
+	keyUsageMutex.Lock()
+	defer keyUsageMutex.Unlock()
+
+	path := keyUsagePath(k)
+
+	if err = volumeJail().MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return
+	}
+
+	if stat, err := volumeJail().Stat(path); err == nil && logRotationNeeded(stat.Size()+int64(len(buf))+1) {
+		if err = rotateFile(path); err != nil {
+			return err
+		}
+	}
+
+	f, err := volumeJail().OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "%s\n", buf)
+
+	return
+}
+
+// keyUsageLog returns all retained usage records of the argument key, oldest
+// first.
+func keyUsageLog(k key) (log []keyUsage, err error) {
+	keyUsageMutex.Lock()
+	defer keyUsageMutex.Unlock()
+
+	path := keyUsagePath(k)
+
+	for _, p := range append(rotatedPaths(path), path) {
+		if log, err = readKeyUsage(p, log); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func readKeyUsage(path string, log []keyUsage) ([]keyUsage, error) {
+	f, err := openRotated(path)
+
+	if os.IsNotExist(err) {
+		return log, nil
+	}
+
+	if err != nil {
+		return log, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		var u keyUsage
+
+		if err = json.Unmarshal(scanner.Bytes(), &u); err != nil {
+			return log, err
+		}
+
+		log = append(log, u)
+	}
+
+	return log, scanner.Err()
+}
+
+// keyUsageInfo formats the most recent usage records for key information.
+func keyUsageInfo(k key) (info string, err error) {
+	log, err := keyUsageLog(k)
+
+	if err != nil {
+		return
+	}
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "Usage (%d records)\n", len(log))
+
+	start := 0
+
+	if len(log) > keyUsageInfoSize {
+		start = len(log) - keyUsageInfoSize
+	}
+
+	for i := len(log) - 1; i >= start; i-- {
+		u := log[i]
+		fmt.Fprintf(&b, "\t%s %s %s session:%s\n", time.Unix(u.Epoch, 0).UTC().Format(time.RFC3339), u.Op, u.File, u.Session)
+	}
+
+	return b.String(), nil
+}
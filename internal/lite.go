@@ -0,0 +1,450 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+)
+
+// Lite interface, a server rendered HTML interface under /lite which does not
+// require JavaScript, meant for screen readers, text browsers and legacy
+// devices. It covers login, browsing, upload, download, directory creation,
+// deletion and logout.
+//
+// Form posts are translated to API requests dispatched to the regular API
+// handler, so that session, XSRF, ACL and one-time token validation are
+// unchanged. Forms carry the session XSRF token as a hidden field, posts
+// without it are rejected by the API handler.
+
+const liteMaxForm = 64 << 10
+
+const liteCSP = "default-src 'none'; style-src 'unsafe-inline'; img-src 'self'; form-action 'self'; frame-ancestors 'none';"
+
+var liteTemplate = template.Must(template.New("lite").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{if .Error}}<p role="alert"><strong>Error: {{.Error}}</strong></p>{{end}}
+{{if not .Authenticated}}
+<form method="post" action="/lite">
+<input type="hidden" name="action" value="login">
+{{if .Banner}}<pre>{{.Banner}}</pre>
+<p><input type="checkbox" id="banner" name="banner" value="true"> <label for="banner">I have read and accept the above notice</label></p>{{end}}
+<p><label for="volume">Volume</label> <input type="text" id="volume" name="volume" autocomplete="off"></p>
+<p><label for="password">Password</label> <input type="password" id="password" name="password"></p>
+<p><button type="submit">Login</button></p>
+</form>
+{{else}}
+<h2>Directory {{.Path}}</h2>
+{{if ne .Path "/"}}<p><a href="/lite?path={{.Parent}}">Parent directory</a></p>{{end}}
+<table>
+<caption>{{len .Entries}} entries, {{.Free}} free of {{.Total}}</caption>
+<tr><th scope="col">Name</th><th scope="col">Size</th><th scope="col">Modified</th><th scope="col">Actions</th></tr>
+{{range .Entries}}<tr>
+<td>{{if .Dir}}<a href="/lite?path={{.Path}}">{{.Name}}/</a>{{else}}{{.Name}}{{end}}</td>
+<td>{{if not .Dir}}{{.Size}}{{end}}</td>
+<td>{{.Modified}}</td>
+<td>{{if not .Dir}}<form method="post" action="/lite"><input type="hidden" name="xsrf" value="{{$.XSRF}}"><input type="hidden" name="action" value="download"><input type="hidden" name="path" value="{{.Path}}"><button type="submit">Download {{.Name}}</button></form>{{end}}
+<form method="post" action="/lite"><input type="hidden" name="xsrf" value="{{$.XSRF}}"><input type="hidden" name="action" value="delete"><input type="hidden" name="path" value="{{.Path}}"><button type="submit">Delete {{.Name}}</button></form></td>
+</tr>
+{{end}}</table>
+<h2>Upload file</h2>
+<form method="post" action="/lite" enctype="multipart/form-data">
+<input type="hidden" name="xsrf" value="{{.XSRF}}">
+<input type="hidden" name="action" value="upload">
+<input type="hidden" name="path" value="{{.Path}}">
+<p><label for="file">File</label> <input type="file" id="file" name="file"></p>
+<p><button type="submit">Upload</button></p>
+</form>
+<h2>New directory</h2>
+<form method="post" action="/lite">
+<input type="hidden" name="xsrf" value="{{.XSRF}}">
+<input type="hidden" name="action" value="mkdir">
+<input type="hidden" name="path" value="{{.Path}}">
+<p><label for="name">Name</label> <input type="text" id="name" name="name"></p>
+<p><button type="submit">Create</button></p>
+</form>
+<form method="post" action="/lite">
+<input type="hidden" name="xsrf" value="{{.XSRF}}">
+<input type="hidden" name="action" value="logout">
+<p><button type="submit">Logout</button></p>
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+type liteEntry struct {
+	Name     string
+	Path     string
+	Dir      bool
+	Size     int64
+	Modified string
+}
+
+type litePage struct {
+	Title         string
+	Banner        string
+	Error         string
+	Authenticated bool
+	XSRF          string
+	Path          string
+	Parent        string
+	Total         uint64
+	Free          uint64
+	Entries       []liteEntry
+}
+
+// liteRecorder collects the response of an API request.
+type liteRecorder struct {
+	header http.Header
+	body   bytes.Buffer
+	code   int
+}
+
+func (rec *liteRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *liteRecorder) Write(b []byte) (int, error) {
+	if rec.code == 0 {
+		rec.code = http.StatusOK
+	}
+
+	return rec.body.Write(b)
+}
+
+func (rec *liteRecorder) WriteHeader(code int) {
+	if rec.code == 0 {
+		rec.code = code
+	}
+}
+
+// liteCall dispatches an API request on behalf of a lite interface request,
+// the result is returned as error when not successful.
+func liteCall(r *http.Request, method string, body io.Reader, header map[string]string) (res jsonObject, rec *liteRecorder, err error) {
+	req, err := http.NewRequest(http.MethodPost, "/api/"+method, body)
+
+	if err != nil {
+		return
+	}
+
+	req = req.WithContext(r.Context())
+	req.RequestURI = "/api/" + method
+	req.RemoteAddr = r.RemoteAddr
+	req.Host = r.Host
+	req.TLS = r.TLS
+
+	for _, k := range []string{"Cookie", "User-Agent", "Accept-Language"} {
+		if v, ok := r.Header[k]; ok {
+			req.Header[k] = v
+		}
+	}
+
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+
+	rec = &liteRecorder{header: make(http.Header)}
+	apiHandler(rec, req)
+
+	if rec.code == 0 {
+		rec.code = http.StatusOK
+	}
+
+	if rec.code != http.StatusOK {
+		return nil, rec, errors.New(http.StatusText(rec.code) + ": " + string(bytes.TrimSpace(rec.body.Bytes())))
+	}
+
+	if method == "file/upload" {
+		return
+	}
+
+	d := json.NewDecoder(bytes.NewReader(rec.body.Bytes()))
+	d.UseNumber()
+
+	if err = d.Decode(&res); err != nil {
+		return
+	}
+
+	if res["status"] != "OK" {
+		err = fmt.Errorf("%v", res["response"])
+	}
+
+	return
+}
+
+// liteJSON dispatches an API request with a JSON body, authenticated with
+// the argument XSRF token.
+func liteJSON(r *http.Request, method string, req jsonObject, xsrf string) (res jsonObject, rec *liteRecorder, err error) {
+	header := map[string]string{XSRFHeader: xsrf}
+
+	if oneTimeRequests["/api/"+method] {
+		nonce, _, err := liteCall(r, "auth/nonce", bytes.NewBufferString(jsonObject{"method": method}.String()), header)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		header[XSRFNonceHeader], _ = nonce["response"].(string)
+	}
+
+	return liteCall(r, method, bytes.NewBufferString(req.String()), header)
+}
+
+// liteCookies forwards the session cookie set, or deleted, by an API request
+// extending it to the lite interface path.
+func liteCookies(w http.ResponseWriter, rec *liteRecorder) {
+	res := &http.Response{Header: rec.header}
+
+	for _, c := range res.Cookies() {
+		http.SetCookie(w, c)
+
+		if c.Path == "/api" {
+			lite := *c
+			lite.Path = "/lite"
+			http.SetCookie(w, &lite)
+		}
+	}
+}
+
+func liteHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	w.Header().Set("Content-Security-Policy", liteCSP)
+	w.Header().Set("Cache-Control", "no-cache, no-store, max-age=0, must-revalidate")
+	w.Header().Set("X-Frame-Options", "DENY")
+
+	switch r.Method {
+	case http.MethodGet:
+		liteRender(w, r, r.URL.Query().Get("path"), nil)
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// form posts are only accepted from the lite interface itself
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, e := url.Parse(origin); e != nil || u.Host != r.Host {
+			http.Error(w, "invalid origin", http.StatusForbidden)
+			return
+		}
+	}
+
+	if t, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); t == "multipart/form-data" {
+		liteUpload(w, r)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, liteMaxForm)
+
+	if err = r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p := r.PostForm.Get("path")
+	xsrf := r.PostForm.Get("xsrf")
+	dir := path.Dir(p)
+
+	switch r.PostForm.Get("action") {
+	case "login":
+		var rec *liteRecorder
+
+		req := jsonObject{
+			"volume":   r.PostForm.Get("volume"),
+			"password": r.PostForm.Get("password"),
+			"dispose":  false,
+			"banner":   r.PostForm.Get("banner") == "true",
+		}
+
+		if _, rec, err = liteCall(r, "auth/login", bytes.NewBufferString(req.String()), nil); err == nil {
+			liteCookies(w, rec)
+		}
+
+		dir = "/"
+	case "logout":
+		var rec *liteRecorder
+
+		if _, rec, err = liteJSON(r, "auth/logout", jsonObject{}, xsrf); err == nil {
+			liteCookies(w, rec)
+		}
+	case "mkdir":
+		dir = p
+		_, _, err = liteJSON(r, "file/mkdir", jsonObject{"path": []string{path.Join(p, r.PostForm.Get("name"))}}, xsrf)
+	case "delete":
+		_, _, err = liteJSON(r, "file/delete", jsonObject{"path": []string{p}}, xsrf)
+	case "download":
+		var res jsonObject
+
+		if res, _, err = liteJSON(r, "file/download", jsonObject{"path": p}, xsrf); err == nil {
+			id, _ := res["response"].(string)
+			http.Redirect(w, r, "/api/file/download?id="+url.QueryEscape(id), http.StatusSeeOther)
+			return
+		}
+	default:
+		err = errors.New("invalid action")
+	}
+
+	if err != nil {
+		liteRender(w, r, dir, err)
+		return
+	}
+
+	http.Redirect(w, r, "/lite?path="+url.QueryEscape(dir), http.StatusSeeOther)
+}
+
+// liteUpload streams a multipart upload to the API, the file part must follow
+// the other form fields (as sent by browsers in document order).
+func liteUpload(w http.ResponseWriter, r *http.Request) {
+	var xsrf string
+	var dir string
+
+	mr, err := r.MultipartReader()
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for {
+		part, err := mr.NextPart()
+
+		if err != nil {
+			liteRender(w, r, dir, errors.New("missing file"))
+			return
+		}
+
+		if part.FormName() != "file" {
+			v, _ := ioutil.ReadAll(io.LimitReader(part, liteMaxForm))
+
+			switch part.FormName() {
+			case "xsrf":
+				xsrf = string(v)
+			case "path":
+				dir = string(v)
+			}
+
+			continue
+		}
+
+		if part.FileName() == "" {
+			liteRender(w, r, dir, errors.New("missing file"))
+			return
+		}
+
+		header := map[string]string{
+			XSRFHeader:         xsrf,
+			"X-Uploadfilename": url.QueryEscape(path.Join(dir, path.Base(part.FileName()))),
+		}
+
+		if _, _, err = liteCall(r, "file/upload", part, header); err != nil {
+			liteRender(w, r, dir, err)
+			return
+		}
+
+		http.Redirect(w, r, "/lite?path="+url.QueryEscape(dir), http.StatusSeeOther)
+		return
+	}
+}
+
+// liteRender renders the login page or, with a valid session, the listing of
+// the argument directory.
+func liteRender(w http.ResponseWriter, r *http.Request, dir string, e error) {
+	ui := uiStatus()["response"].(map[string]interface{})
+
+	page := &litePage{
+		Title:  ui["title"].(string),
+		Banner: conf.Banner,
+	}
+
+	if e != nil {
+		page.Error = e.Error()
+	}
+
+	if validSessionID, _, _ := session.Validate(r); validSessionID {
+		session.Lock()
+		page.XSRF = session.XSRFToken
+		session.Unlock()
+
+		page.Authenticated = true
+
+		if err := page.list(r, dir); err != nil && page.Error == "" {
+			page.Error = err.Error()
+		}
+
+		// listing might have renewed the token, forms need the current one
+		session.Lock()
+		page.XSRF = session.XSRFToken
+		session.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	if err := liteTemplate.Execute(w, page); err != nil {
+		reportError("lite interface rendering", err)
+	}
+}
+
+func (page *litePage) list(r *http.Request, dir string) (err error) {
+	var list struct {
+		Response struct {
+			Total  uint64  `json:"total_space"`
+			Free   uint64  `json:"free_space"`
+			Inodes []inode `json:"inodes"`
+		} `json:"response"`
+	}
+
+	if dir == "" || dir == "." {
+		dir = "/"
+	}
+
+	page.Path = path.Clean("/" + dir)
+	page.Parent = path.Dir(page.Path)
+
+	_, rec, err := liteJSON(r, "file/list", jsonObject{"path": page.Path, "sha256": false, "sort": "natural"}, page.XSRF)
+
+	if err != nil {
+		return
+	}
+
+	if err = json.Unmarshal(rec.body.Bytes(), &list); err != nil {
+		return
+	}
+
+	page.Total = list.Response.Total
+	page.Free = list.Response.Free
+
+	for _, i := range list.Response.Inodes {
+		page.Entries = append(page.Entries, liteEntry{
+			Name:     i.Name,
+			Path:     path.Join(page.Path, i.Name),
+			Dir:      i.Dir,
+			Size:     i.Size,
+			Modified: time.Unix(i.Mtime, 0).Format("2006-01-02 15:04"),
+		})
+	}
+
+	return
+}
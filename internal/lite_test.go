@@ -0,0 +1,146 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var liteXSRFPattern = regexp.MustCompile(`name="xsrf" value="([^"]+)"`)
+
+func (c *apiClient) lite(form url.Values) string {
+	header := map[string]string{"Content-Type": "application/x-www-form-urlencoded"}
+	res := c.request("POST", "/lite", header, []byte(form.Encode()))
+	defer res.Body.Close()
+
+	body, _ := ioutil.ReadAll(res.Body)
+
+	return string(body)
+}
+
+func (c *apiClient) liteGet(p string) (page string, xsrf string) {
+	res := c.request("GET", "/lite?path="+url.QueryEscape(p), nil, nil)
+	defer res.Body.Close()
+
+	body, _ := ioutil.ReadAll(res.Body)
+	page = string(body)
+
+	if m := liteXSRFPattern.FindStringSubmatch(page); m != nil {
+		xsrf = m[1]
+	}
+
+	return
+}
+
+func TestLite(t *testing.T) {
+	c := newTestServer(t)
+
+	if page, _ := c.liteGet("/"); !strings.Contains(page, `name="password"`) {
+		t.Fatalf("login form not rendered:\n%s", page)
+	}
+
+	page := c.lite(url.Values{"action": {"login"}, "volume": {testVolume}, "password": {"invalid"}})
+
+	if !strings.Contains(page, "Error:") || session.Active() {
+		t.Fatalf("invalid login accepted:\n%s", page)
+	}
+
+	c.lite(url.Values{"action": {"login"}, "volume": {testVolume}, "password": {testPassword}})
+	defer c.call("auth/logout", nil)
+
+	page, xsrf := c.liteGet("/")
+
+	if xsrf == "" || !strings.Contains(page, "Directory /") || strings.Contains(page, "Error:") {
+		t.Fatalf("listing not rendered:\n%s", page)
+	}
+
+	// the token renewed while listing must be rendered
+	maxAge := conf.XSRFMaxAge
+	conf.XSRFMaxAge = 60
+	defer func() { conf.XSRFMaxAge = maxAge }()
+
+	session.Lock()
+	session.xsrfIssued = time.Now().Add(-45 * time.Second)
+	session.Unlock()
+
+	if _, renewed := c.liteGet("/"); renewed == xsrf || renewed != session.XSRFToken {
+		t.Errorf("stale XSRF token rendered")
+	} else {
+		xsrf = renewed
+	}
+
+	if page = c.lite(url.Values{"action": {"mkdir"}, "path": {"/"}, "name": {"docs"}}); !strings.Contains(page, "Error:") {
+		t.Error("request without XSRF token accepted")
+	}
+
+	c.lite(url.Values{"action": {"mkdir"}, "path": {"/"}, "name": {"docs"}, "xsrf": {xsrf}})
+
+	if fi, err := os.Stat(filepath.Join(conf.MountPoint, "docs")); err != nil || !fi.IsDir() {
+		t.Fatalf("directory not created (%v)", err)
+	}
+
+	var body bytes.Buffer
+
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("xsrf", xsrf)
+	mw.WriteField("action", "upload")
+	mw.WriteField("path", "/docs")
+	fw, _ := mw.CreateFormFile("file", "notes.txt")
+	fw.Write([]byte("lite upload"))
+	mw.Close()
+
+	res := c.request("POST", "/lite", map[string]string{"Content-Type": mw.FormDataContentType()}, body.Bytes())
+	res.Body.Close()
+
+	if data, err := ioutil.ReadFile(filepath.Join(conf.MountPoint, "docs", "notes.txt")); err != nil || string(data) != "lite upload" {
+		t.Fatalf("file not uploaded (%v)", err)
+	}
+
+	page, xsrf = c.liteGet("/docs")
+
+	if !strings.Contains(page, "notes.txt") {
+		t.Fatalf("uploaded file not listed:\n%s", page)
+	}
+
+	if data := c.lite(url.Values{"action": {"download"}, "path": {"/docs/notes.txt"}, "xsrf": {xsrf}}); data != "lite upload" {
+		t.Errorf("unexpected download %q", data)
+	}
+
+	_, xsrf = c.liteGet("/docs")
+	c.lite(url.Values{"action": {"delete"}, "path": {"/docs/notes.txt"}, "xsrf": {xsrf}})
+
+	if _, err := os.Stat(filepath.Join(conf.MountPoint, "docs", "notes.txt")); !os.IsNotExist(err) {
+		t.Errorf("file not deleted (%v)", err)
+	}
+
+	res = c.request("POST", "/lite", map[string]string{
+		"Content-Type": "application/x-www-form-urlencoded",
+		"Origin":       "https://attacker.example",
+	}, []byte(url.Values{"action": {"logout"}, "xsrf": {xsrf}}.Encode()))
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusForbidden || !session.Active() {
+		t.Errorf("cross-origin post accepted (%d)", res.StatusCode)
+	}
+
+	_, xsrf = c.liteGet("/")
+	c.lite(url.Values{"action": {"logout"}, "xsrf": {xsrf}})
+
+	if session.Active() {
+		t.Error("session not closed")
+	}
+}
@@ -0,0 +1,210 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/syslog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultLockTimeout = 300
+const maxLockTimeout = 86400
+
+// Advisory lock manager, writes on a locked path (or on a directory holding
+// locked paths) are refused unless the lock token is presented with the
+// X-Locktoken request header.
+
+type fileLock struct {
+	Owner  string `json:"owner"`
+	Expiry int64  `json:"expiry"`
+	token  string
+}
+
+type lockManager struct {
+	sync.Mutex
+	locks map[string]*fileLock
+}
+
+var locks = lockManager{
+	locks: make(map[string]*fileLock),
+}
+
+func (l *lockManager) expire() {
+	now := time.Now().Unix()
+
+	for p, lock := range l.locks {
+		if lock.Expiry <= now {
+			delete(l.locks, p)
+		}
+	}
+}
+
+func (l *lockManager) Acquire(osPath string, owner string, timeout int64, token string) (newToken string, err error) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.expire()
+
+	if lock, ok := l.locks[osPath]; ok && !secretEqual(lock.token, token) {
+		return "", fmt.Errorf("path %s is locked by %s", relativePath(osPath), lock.Owner)
+	}
+
+	// a valid token refreshes the existing lock
+	if token == "" {
+		token, err = randomString(16)
+
+		if err != nil {
+			return
+		}
+	}
+
+	l.locks[osPath] = &fileLock{
+		Owner:  owner,
+		Expiry: time.Now().Unix() + timeout,
+		token:  token,
+	}
+
+	return token, nil
+}
+
+func (l *lockManager) Release(osPath string, token string) error {
+	l.Lock()
+	defer l.Unlock()
+
+	lock, ok := l.locks[osPath]
+
+	if !ok {
+		return fmt.Errorf("path %s is not locked", relativePath(osPath))
+	}
+
+	if !secretEqual(lock.token, token) {
+		return errors.New("invalid lock token")
+	}
+
+	delete(l.locks, osPath)
+
+	return nil
+}
+
+func (l *lockManager) Holder(osPath string) *fileLock {
+	l.Lock()
+	defer l.Unlock()
+
+	l.expire()
+
+	return l.locks[osPath]
+}
+
+// Check returns an error if osPath, or any path within it, is locked with a
+// token different than the passed one.
+func (l *lockManager) Check(osPath string, token string) error {
+	l.Lock()
+	defer l.Unlock()
+
+	l.expire()
+
+	for p, lock := range l.locks {
+		if p != osPath && !strings.HasPrefix(p, osPath+"/") {
+			continue
+		}
+
+		if !secretEqual(lock.token, token) {
+			return fmt.Errorf("path %s is locked by %s", relativePath(p), lock.Owner)
+		}
+	}
+
+	return nil
+}
+
+func (l *lockManager) Reset() {
+	l.Lock()
+	defer l.Unlock()
+
+	l.locks = make(map[string]*fileLock)
+}
+
+func lockToken(r *http.Request) string {
+	return r.Header.Get("X-Locktoken")
+}
+
+func fileLockRequest(r *http.Request) (res jsonObject) {
+	var token string
+	var timeout int64 = defaultLockTimeout
+
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	osPath, err := absolutePath(req["path"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if n, ok := req["timeout"].(json.Number); ok {
+		timeout, err = n.Int64()
+
+		if err != nil {
+			return errorResponse(errors.New("invalid lock timeout"), "")
+		}
+	}
+
+	token, err = locks.Acquire(osPath, req["owner"].(string), timeout, lockToken(r))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	status.Log(syslog.LOG_INFO, "%s locked %s", req["owner"].(string), relativePath(osPath))
+
+	res = jsonObject{
+		"status": "OK",
+		"response": map[string]interface{}{
+			"token":  token,
+			"expiry": time.Now().Unix() + timeout,
+		},
+	}
+
+	return
+}
+
+func fileUnlockRequest(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	osPath, err := absolutePath(req["path"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = locks.Release(osPath, req["token"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	status.Log(syslog.LOG_INFO, "unlocked %s", relativePath(osPath))
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": nil,
+	}
+
+	return
+}
@@ -16,13 +16,29 @@ import (
 func EnableSyslog() {
 	if conf.logFile != nil {
 		conf.logFile.Close()
+		conf.logFile = nil
+	}
+
+	if conf.Container {
+		log.SetFlags(log.Ldate | log.Ltime)
+		log.SetOutput(os.Stdout)
+		return
 	}
 
 	log.Println("switching to syslog")
-	logwriter, err := syslog.New(syslog.LOG_INFO, "interlock")
+	tag := "interlock"
+
+	if conf.tenant != "" {
+		tag += "-" + conf.tenant
+	}
+
+	logwriter, err := syslog.New(syslog.LOG_INFO, tag)
 
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("syslog unavailable (%v), logging to standard output", err)
+		log.SetFlags(log.Ldate | log.Ltime)
+		log.SetOutput(os.Stdout)
+		return
 	}
 
 	log.SetFlags(0)
@@ -36,10 +52,11 @@ func EnableFileLog() {
 
 	logPath := filepath.Join(conf.MountPoint, ".interlock.log")
 	log.Printf("switching to log file %s", logPath)
-	logwriter, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	logwriter, err := openRotating(logPath)
 
 	if err != nil {
 		status.Log(syslog.LOG_ERR, "could not switch to log file %s: %v", logPath, err)
+		return
 	}
 
 	conf.logFile = logwriter
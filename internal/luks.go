@@ -0,0 +1,605 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/xts"
+)
+
+// LUKS1 and LUKS2 header parsing and keyslot decryption, allowing volumes to
+// be unlocked without cryptsetup (see dmcrypt_linux.go).
+//
+// Supported are PBKDF2 and Argon2 keyslots, encrypted with AES in XTS or CBC
+// (plain, plain64 or ESSIV) modes, on volumes without integrity protection or
+// pending re-encryption. Other volumes are reported as unsupported and left
+// to cryptsetup.
+
+const (
+	luksSectorSize     = 512
+	luks1HeaderSize    = 592
+	luks1KeyslotSize   = 48
+	luks1Keyslots      = 8
+	luks1KeyslotActive = 0x00ac71f3
+	luks2HeaderSize    = 4096
+)
+
+// LUKS2 secondary header offsets
+var luks2HeaderOffsets = []int64{0, 0x4000, 0x8000, 0x10000, 0x20000, 0x40000, 0x80000, 0x100000, 0x200000, 0x400000}
+
+// LUKS2 secondary header magic
+var luks2SecondaryMagic = []byte{'S', 'K', 'U', 'L', 0xba, 0xbe}
+
+var errLUKSUnsupported = errors.New("unsupported LUKS volume")
+var errLUKSPassphrase = errors.New("no key available with this passphrase")
+
+type luksKDF struct {
+	Type       string `json:"type"`
+	Hash       string `json:"hash"`
+	Iterations int    `json:"iterations"`
+	Time       uint32 `json:"time"`
+	Memory     uint32 `json:"memory"`
+	CPUs       uint8  `json:"cpus"`
+	Salt       []byte `json:"salt"`
+}
+
+type luksKeyslot struct {
+	KDF luksKDF
+	// keyslot area encryption
+	Encryption string
+	KeySize    int
+	Offset     int64
+	// anti-forensic splitter
+	Stripes int
+	AFHash  string
+}
+
+type luksDigest struct {
+	Hash       string
+	Iterations int
+	Salt       []byte
+	Digest     []byte
+}
+
+type luksSegment struct {
+	Encryption string
+	Offset     int64
+	// zero for the remainder of the device
+	Size       int64
+	IVTweak    uint64
+	SectorSize int
+}
+
+type luksFormat struct {
+	Version  int
+	UUID     string
+	KeySize  int
+	Keyslots []luksKeyslot
+	Digest   luksDigest
+	Segment  luksSegment
+}
+
+type luks2Metadata struct {
+	Keyslots map[string]struct {
+		Type     string `json:"type"`
+		KeySize  int    `json:"key_size"`
+		Priority *int   `json:"priority"`
+		AF       struct {
+			Type    string `json:"type"`
+			Stripes int    `json:"stripes"`
+			Hash    string `json:"hash"`
+		} `json:"af"`
+		Area struct {
+			Type       string `json:"type"`
+			Offset     string `json:"offset"`
+			Encryption string `json:"encryption"`
+			KeySize    int    `json:"key_size"`
+		} `json:"area"`
+		KDF luksKDF `json:"kdf"`
+	} `json:"keyslots"`
+	Segments map[string]struct {
+		Type       string          `json:"type"`
+		Offset     string          `json:"offset"`
+		Size       string          `json:"size"`
+		IVTweak    string          `json:"iv_tweak"`
+		Encryption string          `json:"encryption"`
+		SectorSize int             `json:"sector_size"`
+		Integrity  json.RawMessage `json:"integrity"`
+	} `json:"segments"`
+	Digests map[string]struct {
+		Type       string   `json:"type"`
+		Keyslots   []string `json:"keyslots"`
+		Segments   []string `json:"segments"`
+		Hash       string   `json:"hash"`
+		Iterations int      `json:"iterations"`
+		Salt       []byte   `json:"salt"`
+		Digest     []byte   `json:"digest"`
+	} `json:"digests"`
+	Config struct {
+		Requirements struct {
+			Mandatory []string `json:"mandatory"`
+		} `json:"requirements"`
+	} `json:"config"`
+}
+
+func luksHash(name string) (h func() hash.Hash, err error) {
+	switch strings.ToLower(name) {
+	case "sha1":
+		h = sha1.New
+	case "sha256":
+		h = sha256.New
+	case "sha512":
+		h = sha512.New
+	default:
+		err = errLUKSUnsupported
+	}
+
+	return
+}
+
+func luksString(b []byte) string {
+	return string(bytes.TrimRight(b, "\x00"))
+}
+
+// readLUKS parses the LUKS header of a device or detached header file.
+func readLUKS(r io.ReaderAt) (l *luksFormat, err error) {
+	buf := make([]byte, luks1HeaderSize)
+
+	if _, err = r.ReadAt(buf, 0); err != nil {
+		return nil, fmt.Errorf("could not read LUKS header, %v", err)
+	}
+
+	if !bytes.HasPrefix(buf, luksMagic) {
+		return nil, errors.New("LUKS header not found")
+	}
+
+	switch binary.BigEndian.Uint16(buf[6:8]) {
+	case 1:
+		return parseLUKS1(buf)
+	case 2:
+		return readLUKS2(r)
+	}
+
+	return nil, errLUKSUnsupported
+}
+
+func parseLUKS1(buf []byte) (l *luksFormat, err error) {
+	spec := luksString(buf[8:40]) + "-" + luksString(buf[40:72])
+	hashSpec := luksString(buf[72:104])
+
+	l = &luksFormat{
+		Version: 1,
+		UUID:    luksString(buf[168:208]),
+		KeySize: int(binary.BigEndian.Uint32(buf[108:112])),
+		Digest: luksDigest{
+			Hash:       hashSpec,
+			Iterations: int(binary.BigEndian.Uint32(buf[164:168])),
+			Salt:       buf[132:164],
+			Digest:     buf[112:132],
+		},
+		Segment: luksSegment{
+			Encryption: spec,
+			Offset:     int64(binary.BigEndian.Uint32(buf[104:108])) * luksSectorSize,
+			SectorSize: luksSectorSize,
+		},
+	}
+
+	for i := 0; i < luks1Keyslots; i++ {
+		ks := buf[208+i*luks1KeyslotSize : 208+(i+1)*luks1KeyslotSize]
+
+		if binary.BigEndian.Uint32(ks[0:4]) != luks1KeyslotActive {
+			continue
+		}
+
+		l.Keyslots = append(l.Keyslots, luksKeyslot{
+			KDF: luksKDF{
+				Type:       "pbkdf2",
+				Hash:       hashSpec,
+				Iterations: int(binary.BigEndian.Uint32(ks[4:8])),
+				Salt:       ks[8:40],
+			},
+			Encryption: spec,
+			KeySize:    l.KeySize,
+			Offset:     int64(binary.BigEndian.Uint32(ks[40:44])) * luksSectorSize,
+			Stripes:    int(binary.BigEndian.Uint32(ks[44:48])),
+			AFHash:     hashSpec,
+		})
+	}
+
+	return
+}
+
+// readLUKS2JSON returns the UUID and JSON metadata of the most recent valid
+// LUKS2 header copy.
+func readLUKS2JSON(r io.ReaderAt) (uuid string, metadata []byte, err error) {
+	var seqid uint64
+
+	hdr := make([]byte, luks2HeaderSize)
+
+	for _, offset := range luks2HeaderOffsets {
+		if _, err := r.ReadAt(hdr, offset); err != nil || !(bytes.HasPrefix(hdr, luksMagic) || bytes.HasPrefix(hdr, luks2SecondaryMagic)) {
+			continue
+		}
+
+		size := binary.BigEndian.Uint64(hdr[8:16])
+
+		if size <= luks2HeaderSize || size > 4*1024*1024 || luksString(hdr[72:104]) != "sha256" {
+			continue
+		}
+
+		area := make([]byte, size)
+
+		if _, err := r.ReadAt(area, offset); err != nil {
+			continue
+		}
+
+		csum := make([]byte, 64)
+		copy(csum, area[448:512])
+
+		for i := 448; i < 512; i++ {
+			area[i] = 0
+		}
+
+		sum := sha256.Sum256(area)
+
+		if !bytes.Equal(sum[:], csum[:sha256.Size]) {
+			continue
+		}
+
+		if s := binary.BigEndian.Uint64(hdr[16:24]); metadata == nil || s > seqid {
+			uuid = luksString(hdr[168:208])
+			metadata = bytes.TrimRight(area[luks2HeaderSize:], "\x00")
+			seqid = s
+		}
+	}
+
+	if metadata == nil {
+		return "", nil, errors.New("no valid LUKS2 header found")
+	}
+
+	return
+}
+
+func readLUKS2(r io.ReaderAt) (l *luksFormat, err error) {
+	var m luks2Metadata
+
+	uuid, metadata, err := readLUKS2JSON(r)
+
+	if err != nil {
+		return
+	}
+
+	if err = json.Unmarshal(metadata, &m); err != nil {
+		return nil, fmt.Errorf("invalid LUKS2 metadata, %v", err)
+	}
+
+	if len(m.Config.Requirements.Mandatory) > 0 || len(m.Segments) != 1 {
+		return nil, errLUKSUnsupported
+	}
+
+	s, ok := m.Segments["0"]
+
+	if !ok || s.Type != "crypt" || len(s.Integrity) > 0 {
+		return nil, errLUKSUnsupported
+	}
+
+	l = &luksFormat{
+		Version: 2,
+		UUID:    uuid,
+		Segment: luksSegment{
+			Encryption: s.Encryption,
+			SectorSize: s.SectorSize,
+		},
+	}
+
+	if l.Segment.Offset, err = strconv.ParseInt(s.Offset, 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid LUKS2 segment offset, %v", err)
+	}
+
+	if l.Segment.IVTweak, err = strconv.ParseUint(s.IVTweak, 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid LUKS2 segment IV tweak, %v", err)
+	}
+
+	if s.Size != "dynamic" {
+		if l.Segment.Size, err = strconv.ParseInt(s.Size, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid LUKS2 segment size, %v", err)
+		}
+	}
+
+	var ids []string
+
+	for _, d := range m.Digests {
+		if d.Type != "pbkdf2" || len(d.Segments) != 1 || d.Segments[0] != "0" {
+			continue
+		}
+
+		l.Digest = luksDigest{
+			Hash:       d.Hash,
+			Iterations: d.Iterations,
+			Salt:       d.Salt,
+			Digest:     d.Digest,
+		}
+
+		ids = d.Keyslots
+	}
+
+	if l.Digest.Digest == nil {
+		return nil, errLUKSUnsupported
+	}
+
+	// high priority keyslots are tried first, ignored ones never
+	sort.SliceStable(ids, func(i, j int) bool {
+		pi, pj := m.Keyslots[ids[i]].Priority, m.Keyslots[ids[j]].Priority
+		return pi != nil && *pi == 2 && (pj == nil || *pj != 2)
+	})
+
+	for _, id := range ids {
+		ks, ok := m.Keyslots[id]
+
+		if !ok || ks.Type != "luks2" || ks.AF.Type != "luks1" || ks.Area.Type != "raw" || (ks.Priority != nil && *ks.Priority == 0) {
+			continue
+		}
+
+		offset, err := strconv.ParseInt(ks.Area.Offset, 10, 64)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid LUKS2 keyslot offset, %v", err)
+		}
+
+		l.KeySize = ks.KeySize
+		l.Keyslots = append(l.Keyslots, luksKeyslot{
+			KDF:        ks.KDF,
+			Encryption: ks.Area.Encryption,
+			KeySize:    ks.Area.KeySize,
+			Offset:     offset,
+			Stripes:    ks.AF.Stripes,
+			AFHash:     ks.AF.Hash,
+		})
+	}
+
+	return
+}
+
+func (k *luksKDF) key(password []byte, size int) (key []byte, err error) {
+	switch k.Type {
+	case "pbkdf2":
+		h, err := luksHash(k.Hash)
+
+		if err != nil {
+			return nil, err
+		}
+
+		key = pbkdf2.Key(password, k.Salt, k.Iterations, size, h)
+	case "argon2i":
+		key = argon2.Key(password, k.Salt, k.Time, k.Memory, k.CPUs, uint32(size))
+	case "argon2id":
+		key = argon2.IDKey(password, k.Salt, k.Time, k.Memory, k.CPUs, uint32(size))
+	default:
+		err = errLUKSUnsupported
+	}
+
+	return
+}
+
+// deriveContext performs the key derivation, returning early when ctx is
+// done.
+func (k *luksKDF) deriveContext(ctx context.Context, password []byte, size int) (key []byte, err error) {
+	type result struct {
+		key []byte
+		err error
+	}
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	done := make(chan result, 1)
+
+	go func() {
+		key, err := k.key(password, size)
+		done <- result{key, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.key, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// luksDecrypt decrypts keyslot material in place, sectors are numbered from
+// the start of the keyslot area.
+func luksDecrypt(spec string, key []byte, data []byte) (err error) {
+	s := strings.SplitN(spec, "-", 3)
+
+	if len(s) != 3 || s[0] != "aes" || len(data)%luksSectorSize != 0 {
+		return errLUKSUnsupported
+	}
+
+	switch {
+	case s[1] == "xts" && s[2] == "plain64":
+		c, err := xts.NewCipher(aes.NewCipher, key)
+
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < len(data)/luksSectorSize; i++ {
+			sector := data[i*luksSectorSize : (i+1)*luksSectorSize]
+			c.Decrypt(sector, sector, uint64(i))
+		}
+	case s[1] == "cbc":
+		var essiv cipher.Block
+
+		block, err := aes.NewCipher(key)
+
+		if err != nil {
+			return err
+		}
+
+		switch s[2] {
+		case "plain", "plain64":
+		case "essiv:sha256":
+			salt := sha256.Sum256(key)
+			essiv, _ = aes.NewCipher(salt[:])
+		default:
+			return errLUKSUnsupported
+		}
+
+		for i := 0; i < len(data)/luksSectorSize; i++ {
+			iv := make([]byte, aes.BlockSize)
+			binary.LittleEndian.PutUint64(iv, uint64(i))
+
+			if essiv != nil {
+				essiv.Encrypt(iv, iv)
+			}
+
+			sector := data[i*luksSectorSize : (i+1)*luksSectorSize]
+			cipher.NewCBCDecrypter(block, iv).CryptBlocks(sector, sector)
+		}
+	default:
+		return errLUKSUnsupported
+	}
+
+	return
+}
+
+// afDiffuse implements the LUKS anti-forensic splitter diffusion function.
+func afDiffuse(d []byte, h func() hash.Hash) {
+	var iv [4]byte
+
+	digest := h()
+	size := digest.Size()
+
+	for i := 0; i*size < len(d); i++ {
+		end := (i + 1) * size
+
+		if end > len(d) {
+			end = len(d)
+		}
+
+		binary.BigEndian.PutUint32(iv[:], uint32(i))
+
+		digest.Reset()
+		digest.Write(iv[:])
+		digest.Write(d[i*size : end])
+
+		copy(d[i*size:end], digest.Sum(nil))
+	}
+}
+
+// afMerge recovers a key from its anti-forensic split material.
+func afMerge(material []byte, size int, stripes int, h func() hash.Hash) []byte {
+	d := make([]byte, size)
+
+	for i := 0; i < stripes-1; i++ {
+		xorBlock(d, material[i*size:(i+1)*size])
+		afDiffuse(d, h)
+	}
+
+	xorBlock(d, material[(stripes-1)*size:stripes*size])
+
+	return d
+}
+
+// verify checks a candidate volume key against the header digest.
+func (l *luksFormat) verify(key []byte) (err error) {
+	h, err := luksHash(l.Digest.Hash)
+
+	if err != nil {
+		return
+	}
+
+	digest := pbkdf2.Key(key, l.Digest.Salt, l.Digest.Iterations, len(l.Digest.Digest), h)
+
+	if !secretEqualBytes(digest, l.Digest.Digest) {
+		return errLUKSPassphrase
+	}
+
+	return
+}
+
+func (l *luksFormat) unlockKeyslot(ctx context.Context, r io.ReaderAt, ks *luksKeyslot, password []byte) (key []byte, err error) {
+	h, err := luksHash(ks.AFHash)
+
+	if err != nil {
+		return
+	}
+
+	if l.KeySize <= 0 || ks.Stripes <= 0 || l.KeySize*ks.Stripes > 64*1024*1024 {
+		return nil, errLUKSUnsupported
+	}
+
+	size := l.KeySize * ks.Stripes
+	material := make([]byte, (size+luksSectorSize-1)/luksSectorSize*luksSectorSize)
+
+	if _, err = r.ReadAt(material, ks.Offset); err != nil {
+		return nil, fmt.Errorf("could not read keyslot material, %v", err)
+	}
+
+	derived, err := ks.KDF.deriveContext(ctx, password, ks.KeySize)
+
+	if err != nil {
+		return
+	}
+
+	if err = luksDecrypt(ks.Encryption, derived, material); err != nil {
+		return
+	}
+
+	key = afMerge(material, l.KeySize, ks.Stripes, h)
+
+	if err = l.verify(key); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// Unlock returns the volume key unlocked by the argument passphrase, the
+// header is read from r.
+func (l *luksFormat) Unlock(ctx context.Context, r io.ReaderAt, password []byte) (key []byte, err error) {
+	unsupported := false
+
+	for i := range l.Keyslots {
+		key, err = l.unlockKeyslot(ctx, r, &l.Keyslots[i], password)
+
+		switch {
+		case err == nil:
+			return
+		case err == errLUKSUnsupported:
+			unsupported = true
+		case err != errLUKSPassphrase:
+			return
+		}
+	}
+
+	if unsupported || len(l.Keyslots) == 0 {
+		return nil, errLUKSUnsupported
+	}
+
+	return nil, errLUKSPassphrase
+}
@@ -0,0 +1,301 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/xts"
+)
+
+const testLUKSStripes = 4
+
+// Headers created by cryptsetup 2.x, with the volume key set to bytes 0..n-1
+// (--volume-key-file), the UUIDs checked below (--uuid), passphrase "secret",
+// truncated after the last keyslot area and compressed:
+//
+//	luks1.img: luksFormat --type luks1 --cipher aes-cbc-essiv:sha256
+//	           --key-size 128 --pbkdf-force-iterations 1000 --key-slot 1
+//	luks2.img: luksFormat --type luks2 --cipher aes-xts-plain64
+//	           --key-size 256 --pbkdf argon2id --pbkdf-force-iterations 4
+//	           --pbkdf-memory 32 --pbkdf-parallel 1 --sector-size 4096
+const testLUKSDir = "testdata/luks"
+
+// afSplit is the inverse of afMerge.
+func afSplit(key []byte, stripes int, h func() hash.Hash) (material []byte) {
+	d := make([]byte, len(key))
+	material = make([]byte, len(key)*stripes)
+	rand.Read(material[:len(key)*(stripes-1)])
+
+	for i := 0; i < stripes-1; i++ {
+		xorBlock(d, material[i*len(key):(i+1)*len(key)])
+		afDiffuse(d, h)
+	}
+
+	xorBlock(d, key)
+	copy(material[(stripes-1)*len(key):], d)
+
+	return
+}
+
+func encryptKeyslot(t *testing.T, key []byte, material []byte) []byte {
+	c, err := xts.NewCipher(aes.NewCipher, key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, (len(material)+luksSectorSize-1)/luksSectorSize*luksSectorSize)
+	copy(data, material)
+
+	for i := 0; i < len(data)/luksSectorSize; i++ {
+		sector := data[i*luksSectorSize : (i+1)*luksSectorSize]
+		c.Encrypt(sector, sector, uint64(i))
+	}
+
+	return data
+}
+
+func testLUKS1(t *testing.T, password string, volumeKey []byte) []byte {
+	img := make([]byte, 16*luksSectorSize)
+	salt := make([]byte, 32)
+	rand.Read(salt)
+
+	copy(img, luksMagic)
+	binary.BigEndian.PutUint16(img[6:], 1)
+	copy(img[8:], "aes")
+	copy(img[40:], "xts-plain64")
+	copy(img[72:], "sha256")
+	binary.BigEndian.PutUint32(img[104:], 16)
+	binary.BigEndian.PutUint32(img[108:], uint32(len(volumeKey)))
+	copy(img[112:], pbkdf2.Key(volumeKey, salt, 1000, 20, sha256.New))
+	copy(img[132:], salt)
+	binary.BigEndian.PutUint32(img[164:], 1000)
+	copy(img[168:], "6a4a5e43-6e0c-4d6c-9d0e-3c1b2a0d4f21")
+
+	// keyslot 1, keyslot 0 is left disabled
+	ks := img[208+luks1KeyslotSize : 208+2*luks1KeyslotSize]
+	binary.BigEndian.PutUint32(ks[0:], luks1KeyslotActive)
+	binary.BigEndian.PutUint32(ks[4:], 1000)
+	copy(ks[8:40], salt)
+	binary.BigEndian.PutUint32(ks[40:], 8)
+	binary.BigEndian.PutUint32(ks[44:], testLUKSStripes)
+
+	derived := pbkdf2.Key([]byte(password), salt, 1000, len(volumeKey), sha256.New)
+	copy(img[8*luksSectorSize:], encryptKeyslot(t, derived, afSplit(volumeKey, testLUKSStripes, sha256.New)))
+
+	return img
+}
+
+func testLUKS2(t *testing.T, password string, volumeKey []byte) []byte {
+	const hdrSize = 0x4000
+
+	img := make([]byte, 0x20000)
+	salt := make([]byte, 32)
+	rand.Read(salt)
+
+	derived := argon2.IDKey([]byte(password), salt, 1, 32, 1, uint32(len(volumeKey)))
+	copy(img[0x8000:], encryptKeyslot(t, derived, afSplit(volumeKey, testLUKSStripes, sha256.New)))
+
+	metadata, _ := json.Marshal(map[string]interface{}{
+		"keyslots": map[string]interface{}{
+			"0": map[string]interface{}{
+				"type":     "luks2",
+				"key_size": len(volumeKey),
+				"af":       map[string]interface{}{"type": "luks1", "stripes": testLUKSStripes, "hash": "sha256"},
+				"area":     map[string]interface{}{"type": "raw", "offset": "32768", "size": "4096", "encryption": "aes-xts-plain64", "key_size": len(volumeKey)},
+				"kdf":      map[string]interface{}{"type": "argon2id", "time": 1, "memory": 32, "cpus": 1, "salt": salt},
+			},
+		},
+		"segments": map[string]interface{}{
+			"0": map[string]interface{}{"type": "crypt", "offset": "65536", "size": "dynamic", "iv_tweak": "0", "encryption": "aes-xts-plain64", "sector_size": 4096},
+		},
+		"digests": map[string]interface{}{
+			"0": map[string]interface{}{
+				"type":       "pbkdf2",
+				"keyslots":   []string{"0"},
+				"segments":   []string{"0"},
+				"hash":       "sha256",
+				"iterations": 1000,
+				"salt":       salt,
+				"digest":     pbkdf2.Key(volumeKey, salt, 1000, 32, sha256.New),
+			},
+		},
+		"config": map[string]interface{}{"json_size": "12288", "keyslots_size": "4096"},
+	})
+
+	for i, magic := range [][]byte{luksMagic, luks2SecondaryMagic} {
+		hdr := img[i*hdrSize : (i+1)*hdrSize]
+
+		copy(hdr, magic)
+		binary.BigEndian.PutUint16(hdr[6:], 2)
+		binary.BigEndian.PutUint64(hdr[8:], hdrSize)
+		binary.BigEndian.PutUint64(hdr[16:], uint64(i+1))
+		copy(hdr[72:], "sha256")
+		copy(hdr[168:], "0e9c2f4b-8a51-4c1e-b2c7-5d1f0a6e3b78")
+		binary.BigEndian.PutUint64(hdr[256:], uint64(i*hdrSize))
+		copy(hdr[luks2HeaderSize:], metadata)
+
+		sum := sha256.Sum256(hdr)
+		copy(hdr[448:], sum[:])
+	}
+
+	return img
+}
+
+func TestLUKSUnlock(t *testing.T) {
+	ctx := context.Background()
+	volumeKey := make([]byte, 64)
+	rand.Read(volumeKey)
+
+	for _, img := range [][]byte{testLUKS1(t, "secret", volumeKey), testLUKS2(t, "secret", volumeKey)} {
+		r := bytes.NewReader(img)
+		l, err := readLUKS(r)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = l.Unlock(ctx, r, []byte("invalid")); err != errLUKSPassphrase {
+			t.Errorf("LUKS%d, invalid passphrase not rejected (%v)", l.Version, err)
+		}
+
+		key, err := l.Unlock(ctx, r, []byte("secret"))
+
+		if err != nil || !bytes.Equal(key, volumeKey) {
+			t.Fatalf("LUKS%d, unlock failed (%v)", l.Version, err)
+		}
+
+		sectors, params, err := l.Segment.table("/dev/loop0", int64(len(img))+0x100000, key)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if l.Version == 2 {
+			if sectors != (uint64(len(img))+0x100000-65536)/512 || !strings.HasSuffix(string(params), " 0 /dev/loop0 128 1 sector_size:4096") {
+				t.Errorf("unexpected LUKS2 table %d %s", sectors, params)
+			}
+		}
+
+		if !strings.HasPrefix(string(params), "aes-xts-plain64 ") {
+			t.Errorf("unexpected table %s", params)
+		}
+
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		if _, err = l.Unlock(cancelled, r, []byte("secret")); err != context.Canceled {
+			t.Errorf("LUKS%d, unlock not cancelled (%v)", l.Version, err)
+		}
+	}
+
+	// corrupted primary LUKS2 header, the secondary one must be used
+	img := testLUKS2(t, "secret", volumeKey)
+	img[luks2HeaderSize] ^= 0xff
+
+	if l, err := readLUKS(bytes.NewReader(img)); err != nil || len(l.Keyslots) != 1 {
+		t.Errorf("secondary LUKS2 header not used (%v)", err)
+	}
+}
+
+func TestLUKSFixtures(t *testing.T) {
+	ctx := context.Background()
+
+	for _, f := range []struct {
+		name    string
+		version int
+		keySize int
+		uuid    string
+		params  string
+	}{
+		{"luks1.img.gz", 1, 16, "4f6e1b0a-3d2c-4b8e-9a7f-1c2d3e4f5a6b", "aes-cbc-essiv:sha256 "},
+		{"luks2.img.gz", 2, 32, "9b1c7d2e-5f4a-4c3b-8e6d-0a1b2c3d4e5f", "aes-xts-plain64 "},
+	} {
+		file, err := os.Open(filepath.Join(testLUKSDir, f.name))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		z, err := gzip.NewReader(file)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		img, err := ioutil.ReadAll(z)
+		file.Close()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := bytes.NewReader(img)
+		l, err := readLUKS(r)
+
+		if err != nil {
+			t.Fatalf("%s: %v", f.name, err)
+		}
+
+		if l.Version != f.version || l.UUID != f.uuid || l.KeySize != f.keySize {
+			t.Errorf("%s, unexpected header %d %s %d", f.name, l.Version, l.UUID, l.KeySize)
+		}
+
+		if _, err = l.Unlock(ctx, r, []byte("invalid")); err != errLUKSPassphrase {
+			t.Errorf("%s, invalid passphrase not rejected (%v)", f.name, err)
+		}
+
+		key, err := l.Unlock(ctx, r, []byte("secret"))
+
+		if err != nil {
+			t.Fatalf("%s, unlock failed (%v)", f.name, err)
+		}
+
+		for i := range key {
+			if key[i] != byte(i) {
+				t.Fatalf("%s, unexpected volume key %x", f.name, key)
+			}
+		}
+
+		sectors, params, err := l.Segment.table("/dev/loop0", 64*1024*1024, key)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.HasPrefix(string(params), f.params) {
+			t.Errorf("%s, unexpected table %s", f.name, params)
+		}
+
+		switch f.version {
+		case 1:
+			if sectors != (64*1024*1024-1024*1024)/512 || !strings.HasSuffix(string(params), " 0 /dev/loop0 2048") {
+				t.Errorf("%s, unexpected table %d %s", f.name, sectors, params)
+			}
+		case 2:
+			if sectors != (64*1024*1024-16*1024*1024)/512 || !strings.HasSuffix(string(params), " 0 /dev/loop0 32768 1 sector_size:4096") {
+				t.Errorf("%s, unexpected table %d %s", f.name, sectors, params)
+			}
+		}
+	}
+}
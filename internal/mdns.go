@@ -0,0 +1,406 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Multicast DNS (RFC 6762) service advertisement, the device is announced
+// as a DNS-SD (RFC 6763) "_interlock._tcp" service instance so that clients
+// on the same LAN or USB network can find it without knowing its address.
+//
+// The TXT record carries the SHA-256 fingerprint of the HTTPS certificate,
+// allowing clients to pin the discovered instance.
+
+const (
+	mdnsService  = "_interlock._tcp.local."
+	mdnsServices = "_services._dns-sd._udp.local."
+	mdnsTTL      = 120
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// DNS resource record types
+const (
+	dnsA    = 1
+	dnsPTR  = 12
+	dnsTXT  = 16
+	dnsAAAA = 28
+	dnsSRV  = 33
+	dnsANY  = 255
+)
+
+type mdnsRecord struct {
+	name   string
+	rrtype uint16
+	data   []byte
+}
+
+type mdnsResponder struct {
+	records []mdnsRecord
+}
+
+func dnsName(name string) (buf []byte) {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+
+		buf = append(buf, byte(len(label)))
+		buf = append(buf, label...)
+	}
+
+	return append(buf, 0)
+}
+
+// parseDNSName decodes a, possibly compressed, domain name starting at off,
+// returning the offset following it.
+func parseDNSName(msg []byte, off int) (name string, next int, err error) {
+	var labels []string
+
+	next = -1
+
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errors.New("invalid DNS name")
+		}
+
+		l := int(msg[off])
+
+		switch {
+		case l == 0:
+			if next < 0 {
+				next = off + 1
+			}
+
+			return strings.Join(labels, ".") + ".", next, nil
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 10 {
+				return "", 0, errors.New("invalid DNS name pointer")
+			}
+
+			if next < 0 {
+				next = off + 2
+			}
+
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		case off+1+l > len(msg):
+			return "", 0, errors.New("invalid DNS label")
+		default:
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+// mdnsLabel sanitizes the configured instance name into a single DNS label.
+func mdnsLabel(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '.' || r < 0x20 {
+			return '-'
+		}
+		return r
+	}, name)
+
+	if len(name) > 63 {
+		name = name[:63]
+	}
+
+	return name
+}
+
+func newMDNSResponder(name string, host string, port int, addrs []net.IP, fingerprint string) *mdnsResponder {
+	instance := mdnsLabel(name) + "." + mdnsService
+	host = mdnsLabel(host) + ".local."
+
+	srv := make([]byte, 6)
+	binary.BigEndian.PutUint16(srv[4:], uint16(port))
+	srv = append(srv, dnsName(host)...)
+
+	var txt []byte
+
+	for _, s := range []string{"name=" + name, "version=" + Revision, "fingerprint=" + fingerprint} {
+		if strings.HasSuffix(s, "=") {
+			continue
+		}
+
+		txt = append(txt, byte(len(s)))
+		txt = append(txt, s...)
+	}
+
+	m := &mdnsResponder{
+		records: []mdnsRecord{
+			{mdnsServices, dnsPTR, dnsName(mdnsService)},
+			{mdnsService, dnsPTR, dnsName(instance)},
+			{instance, dnsSRV, srv},
+			{instance, dnsTXT, txt},
+		},
+	}
+
+	for _, ip := range addrs {
+		if ip4 := ip.To4(); ip4 != nil {
+			m.records = append(m.records, mdnsRecord{host, dnsA, ip4})
+		} else {
+			m.records = append(m.records, mdnsRecord{host, dnsAAAA, ip.To16()})
+		}
+	}
+
+	return m
+}
+
+func (m *mdnsResponder) message(id uint16, questions []byte, qdcount int, answers []mdnsRecord, additional []mdnsRecord) []byte {
+	msg := make([]byte, 12)
+
+	binary.BigEndian.PutUint16(msg[0:], id)
+	// response, authoritative answer
+	binary.BigEndian.PutUint16(msg[2:], 0x8400)
+	binary.BigEndian.PutUint16(msg[4:], uint16(qdcount))
+	binary.BigEndian.PutUint16(msg[6:], uint16(len(answers)))
+	binary.BigEndian.PutUint16(msg[10:], uint16(len(additional)))
+
+	msg = append(msg, questions...)
+
+	for _, r := range append(answers, additional...) {
+		rr := make([]byte, 10)
+		binary.BigEndian.PutUint16(rr[0:], r.rrtype)
+		// class IN, with cache-flush bit for unique records
+		if r.rrtype == dnsPTR {
+			binary.BigEndian.PutUint16(rr[2:], 0x0001)
+		} else {
+			binary.BigEndian.PutUint16(rr[2:], 0x8001)
+		}
+		binary.BigEndian.PutUint32(rr[4:], mdnsTTL)
+		binary.BigEndian.PutUint16(rr[8:], uint16(len(r.data)))
+
+		msg = append(msg, dnsName(r.name)...)
+		msg = append(msg, rr...)
+		msg = append(msg, r.data...)
+	}
+
+	return msg
+}
+
+// Announcement returns an unsolicited response with all service records.
+func (m *mdnsResponder) Announcement() []byte {
+	return m.message(0, nil, 0, m.records, nil)
+}
+
+// Answer returns the response to a query, nil if no record matches, and
+// whether it should be sent as unicast to the querier.
+func (m *mdnsResponder) Answer(query []byte, legacy bool) (res []byte, unicast bool, err error) {
+	var answers []mdnsRecord
+	var additional []mdnsRecord
+
+	if len(query) < 12 {
+		return nil, false, errors.New("invalid DNS message")
+	}
+
+	// ignore responses
+	if query[2]&0x80 != 0 {
+		return
+	}
+
+	qdcount := int(binary.BigEndian.Uint16(query[4:]))
+	off := 12
+	matched := make(map[int]bool)
+
+	for i := 0; i < qdcount; i++ {
+		var name string
+
+		if name, off, err = parseDNSName(query, off); err != nil {
+			return
+		}
+
+		if off+4 > len(query) {
+			return nil, false, errors.New("invalid DNS question")
+		}
+
+		qtype := binary.BigEndian.Uint16(query[off:])
+		unicast = unicast || query[off+2]&0x80 != 0
+		off += 4
+
+		for j, r := range m.records {
+			if !matched[j] && strings.EqualFold(r.name, name) && (qtype == r.rrtype || qtype == dnsANY) {
+				matched[j] = true
+				answers = append(answers, r)
+			}
+		}
+	}
+
+	if len(answers) == 0 {
+		return nil, false, nil
+	}
+
+	// service instance records accompany any answer (RFC 6763, section 12)
+	for j, r := range m.records {
+		if !matched[j] && r.name != mdnsServices {
+			additional = append(additional, r)
+		}
+	}
+
+	if legacy {
+		// legacy unicast queries (RFC 6762, section 6.7) require the
+		// query identifier and questions to be echoed
+		return m.message(binary.BigEndian.Uint16(query), query[12:off], qdcount, answers, additional), true, nil
+	}
+
+	return m.message(0, nil, 0, answers, additional), unicast, nil
+}
+
+// mdnsAddresses returns the addresses advertised for the bind address, and
+// the interface hosting it if any.
+func mdnsAddresses(bind string) (ifi *net.Interface, addrs []net.IP, err error) {
+	host, _, err := net.SplitHostPort(bind)
+
+	if err != nil {
+		return
+	}
+
+	// strip IPv6 zone identifier
+	if ip := net.ParseIP(strings.Split(host, "%")[0]); ip != nil && !ip.IsUnspecified() {
+		interfaces, _ := net.Interfaces()
+
+		for i := range interfaces {
+			a, _ := interfaces[i].Addrs()
+
+			for _, addr := range a {
+				if n, ok := addr.(*net.IPNet); ok && n.IP.Equal(ip) {
+					ifi = &interfaces[i]
+				}
+			}
+		}
+
+		return ifi, []net.IP{ip}, nil
+	}
+
+	a, err := net.InterfaceAddrs()
+
+	if err != nil {
+		return
+	}
+
+	for _, addr := range a {
+		if n, ok := addr.(*net.IPNet); ok && !n.IP.IsLoopback() && !n.IP.IsLinkLocalUnicast() {
+			addrs = append(addrs, n.IP)
+		}
+	}
+
+	return
+}
+
+func startMDNS(srv *http.Server) (err error) {
+	if conf.MDNS == "" {
+		return
+	}
+
+	bind := conf.bindAddresses()
+
+	if len(bind) == 0 {
+		return errors.New("missing bind address")
+	}
+
+	// the first bind address is advertised
+	_, p, err := net.SplitHostPort(bind[0])
+
+	if err != nil {
+		return
+	}
+
+	port, err := strconv.Atoi(p)
+
+	if err != nil {
+		return
+	}
+
+	ifi, addrs, err := mdnsAddresses(bind[0])
+
+	if err != nil {
+		return
+	}
+
+	host, err := os.Hostname()
+
+	if err != nil {
+		return
+	}
+
+	fingerprint := ""
+
+	if srv.TLSConfig != nil && len(srv.TLSConfig.Certificates) > 0 {
+		sum := sha256.Sum256(srv.TLSConfig.Certificates[0].Certificate[0])
+		fingerprint = "sha256:" + hex.EncodeToString(sum[:])
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", ifi, mdnsGroup)
+
+	if err != nil {
+		return
+	}
+
+	m := newMDNSResponder(conf.MDNS, host, port, addrs, fingerprint)
+
+	log.Printf("advertising %s.%s via mDNS", mdnsLabel(conf.MDNS), mdnsService)
+
+	go func() {
+		defer recoverJob("announcing mDNS service")
+
+		// RFC 6762, section 8.3
+		for i := 0; i < 2; i++ {
+			conn.WriteToUDP(m.Announcement(), mdnsGroup)
+			time.Sleep(1 * time.Second)
+		}
+	}()
+
+	go func() {
+		defer recoverJob("answering mDNS queries")
+
+		buf := make([]byte, 9000)
+
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+
+			if err != nil {
+				log.Printf("mDNS responder error: %v", err)
+				return
+			}
+
+			legacy := from.Port != mdnsGroup.Port
+			res, unicast, err := m.Answer(buf[:n], legacy)
+
+			if err != nil {
+				if conf.Debug {
+					log.Printf("invalid mDNS query from %s: %v", from, err)
+				}
+				continue
+			}
+
+			if res == nil {
+				continue
+			}
+
+			if unicast {
+				conn.WriteToUDP(res, from)
+			} else {
+				conn.WriteToUDP(res, mdnsGroup)
+			}
+		}
+	}()
+
+	return
+}
@@ -0,0 +1,92 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func mdnsQuery(id uint16, name string, qtype uint16, class uint16) []byte {
+	q := make([]byte, 12)
+	binary.BigEndian.PutUint16(q[0:], id)
+	binary.BigEndian.PutUint16(q[4:], 1)
+
+	q = append(q, dnsName(name)...)
+	q = binary.BigEndian.AppendUint16(q, qtype)
+	q = binary.BigEndian.AppendUint16(q, class)
+
+	return q
+}
+
+func TestMDNS(t *testing.T) {
+	m := newMDNSResponder("armory.1", "usbarmory", 443, []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("fe80::1")}, "sha256:0123")
+
+	res, unicast, err := m.Answer(mdnsQuery(0, "_interlock._tcp.local", dnsPTR, 1), false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if unicast {
+		t.Error("unexpected unicast response")
+	}
+
+	if an, ar := binary.BigEndian.Uint16(res[6:]), binary.BigEndian.Uint16(res[10:]); an != 1 || ar != 4 {
+		t.Errorf("unexpected record counts: %d %d", an, ar)
+	}
+
+	name, off, err := parseDNSName(res, 12)
+
+	if err != nil || name != "_interlock._tcp.local." {
+		t.Fatalf("unexpected answer: %q %v", name, err)
+	}
+
+	if instance, _, err := parseDNSName(res, off+10); err != nil || instance != "armory-1._interlock._tcp.local." {
+		t.Errorf("unexpected instance: %q %v", instance, err)
+	}
+
+	for _, s := range []string{"fingerprint=sha256:0123", "name=armory.1", "\x09usbarmory\x05local\x00"} {
+		if !bytes.Contains(res, []byte(s)) {
+			t.Errorf("missing %q in response", s)
+		}
+	}
+
+	if !bytes.Contains(res, []byte{10, 0, 0, 1}) {
+		t.Error("missing address record")
+	}
+
+	// legacy unicast query, with the host address question name
+	// compressed against the previous one
+	q := mdnsQuery(0xbeef, "_interlock._tcp.local", dnsPTR, 1)
+	q = append(q, 9)
+	q = append(q, "usbarmory"...)
+	q = append(q, 0xc0, 28, 0, dnsA, 0, 1)
+	binary.BigEndian.PutUint16(q[4:], 2)
+
+	if res, unicast, err = m.Answer(q, true); err != nil || !unicast {
+		t.Fatalf("unexpected legacy response: %v %v", unicast, err)
+	}
+
+	if id := binary.BigEndian.Uint16(res); id != 0xbeef || !bytes.Equal(res[12:len(q)], q[12:]) {
+		t.Errorf("query not echoed: %x", res)
+	}
+
+	if an := binary.BigEndian.Uint16(res[6:]); an != 2 {
+		t.Errorf("unexpected answer count: %d", an)
+	}
+
+	if res, _, _ = m.Answer(mdnsQuery(0, "printer._tcp.local", dnsANY, 1), false); res != nil {
+		t.Error("unexpected response to unrelated query")
+	}
+
+	if _, _, err = m.Answer(append(mdnsQuery(0, "a", dnsA, 1)[:12], 0xc0, 12), false); err == nil {
+		t.Error("pointer loop accepted")
+	}
+}
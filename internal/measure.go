@@ -0,0 +1,352 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"log/syslog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Tamper evidence, the interlock binary, configuration file and static assets
+// are measured at startup and compared with the record sealed on the previous
+// run, changes to the unencrypted system partition are reported at login until
+// accepted by an authenticated user.
+
+// hash algorithm for binary and configuration measurements, records sealed
+// by earlier releases (without algorithm) use SHA-256
+const measurementHash = "blake3"
+
+// fixed IV for HSM sealing, the diversifier is the measurements digest
+var measurementsIV = []byte{0x49, 0x4e, 0x54, 0x45, 0x52, 0x4c, 0x4f, 0x43, 0x4b, 0x2d, 0x4d, 0x45, 0x41, 0x53, 0x55, 0x52}
+
+type measurementRecord struct {
+	Epoch  int64             `json:"epoch"`
+	Hash   string            `json:"hash,omitempty"`
+	Binary string            `json:"binary"`
+	Config string            `json:"config"`
+	Static map[string]string `json:"static"`
+	Sealed bool              `json:"sealed"`
+	Seal   string            `json:"seal"`
+}
+
+type measurementStatus struct {
+	sync.Mutex
+	current      *measurementRecord
+	changes      []string
+	notification int
+}
+
+var measurements measurementStatus
+
+func measurementHasher(algorithm string) (newHash func() hash.Hash, err error) {
+	switch algorithm {
+	case "":
+		return sha256.New, nil
+	case measurementHash:
+		return newBLAKE3, nil
+	default:
+		return nil, fmt.Errorf("unsupported measurement hash %s", algorithm)
+	}
+}
+
+func measure(algorithm string) (m *measurementRecord, err error) {
+	m = &measurementRecord{
+		Epoch:  time.Now().Unix(),
+		Hash:   algorithm,
+		Static: make(map[string]string),
+	}
+
+	newHash, err := measurementHasher(algorithm)
+
+	if err != nil {
+		return
+	}
+
+	exe, err := os.Executable()
+
+	if err != nil {
+		return
+	}
+
+	if m.Binary, err = fileHash(exe, newHash); err != nil {
+		return
+	}
+
+	if conf.configPath != "" {
+		if m.Config, err = fileHash(conf.configPath, newHash); err != nil {
+			return
+		}
+	}
+
+	root, err := staticRoot()
+
+	if err != nil {
+		return
+	}
+
+	m.Static, err = generateManifest(root)
+
+	return
+}
+
+func (m *measurementRecord) digest() []byte {
+	h := sha256.New()
+
+	if m.Hash != "" {
+		fmt.Fprintf(h, "hash:%s\n", m.Hash)
+	}
+
+	fmt.Fprintf(h, "binary:%s\nconfig:%s\n", m.Binary, m.Config)
+
+	var paths []string
+
+	for p := range m.Static {
+		paths = append(paths, p)
+	}
+
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		fmt.Fprintf(h, "static:%s:%s\n", p, m.Static[p])
+	}
+
+	return h.Sum(nil)
+}
+
+// seal computes the record seal, keyed with the HSM when available.
+func (m *measurementRecord) seal() (seal string, sealed bool, err error) {
+	d := m.digest()
+
+	if conf.authHSM == nil {
+		return hex.EncodeToString(d), false, nil
+	}
+
+	k, err := conf.authHSM.DeriveKey(d, measurementsIV)
+
+	if err != nil {
+		return
+	}
+
+	return hex.EncodeToString(k), true, nil
+}
+
+func (m *measurementRecord) verify() bool {
+	seal, sealed, err := m.seal()
+
+	if err != nil || sealed != m.Sealed {
+		return false
+	}
+
+	return secretEqual(seal, m.Seal)
+}
+
+// compare returns the differences between the previous and current records.
+func (m *measurementRecord) compare(prev *measurementRecord) (changes []string) {
+	if !prev.verify() {
+		changes = append(changes, "invalid measurements seal")
+	}
+
+	if prev.Binary != m.Binary {
+		changes = append(changes, "interlock binary changed")
+	}
+
+	if prev.Config != m.Config {
+		changes = append(changes, "configuration file changed")
+	}
+
+	for p, sum := range m.Static {
+		if s, ok := prev.Static[p]; !ok {
+			changes = append(changes, "static asset added: "+p)
+		} else if s != sum {
+			changes = append(changes, "static asset changed: "+p)
+		}
+	}
+
+	for p := range prev.Static {
+		if _, ok := m.Static[p]; !ok {
+			changes = append(changes, "static asset removed: "+p)
+		}
+	}
+
+	sort.Strings(changes)
+
+	return
+}
+
+func loadMeasurements() (m *measurementRecord, err error) {
+	buf, err := ioutil.ReadFile(conf.Measurements)
+
+	if err != nil {
+		return
+	}
+
+	m = &measurementRecord{}
+	err = json.Unmarshal(buf, m)
+
+	return
+}
+
+func saveMeasurements(m *measurementRecord) (err error) {
+	if m.Seal, m.Sealed, err = m.seal(); err != nil {
+		return
+	}
+
+	buf, err := json.MarshalIndent(m, "", "\t")
+
+	if err != nil {
+		return
+	}
+
+	tmp := conf.Measurements + ".tmp"
+
+	if err = ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		return
+	}
+
+	return os.Rename(tmp, conf.Measurements)
+}
+
+func startMeasurements() (err error) {
+	if conf.Measurements == "" {
+		return
+	}
+
+	return measurements.check()
+}
+
+// check measures the running system against the previous sealed record, the
+// first record is sealed on first use.
+func (s *measurementStatus) check() (err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	m, err := measure(measurementHash)
+
+	if err != nil {
+		return
+	}
+
+	s.current = m
+	s.changes = nil
+
+	prev, err := loadMeasurements()
+
+	if os.IsNotExist(err) {
+		status.Log(syslog.LOG_NOTICE, "sealing initial measurements")
+		return saveMeasurements(m)
+	}
+
+	if err != nil {
+		s.changes = []string{"invalid measurements record: " + err.Error()}
+	} else if prev.Hash != m.Hash {
+		// compare with the previous algorithm, upgrading unchanged records
+		legacy, e := measure(prev.Hash)
+
+		if e != nil {
+			s.changes = []string{"invalid measurements record: " + e.Error()}
+		} else if s.changes = legacy.compare(prev); len(s.changes) == 0 {
+			status.Log(syslog.LOG_NOTICE, "upgrading measurements to %s", m.Hash)
+			return saveMeasurements(m)
+		}
+	} else {
+		s.changes = m.compare(prev)
+	}
+
+	err = nil
+
+	if len(s.changes) == 0 {
+		return
+	}
+
+	for _, c := range s.changes {
+		status.Log(syslog.LOG_ALERT, "tamper evidence: %s", c)
+	}
+
+	s.notification = status.Notify(syslog.LOG_ALERT, "system partition modified since last run (%d changes), review and accept measurements", len(s.changes))
+	indicator.SetTamper(true)
+
+	emitEvent(eventTamper, map[string]interface{}{
+		"changes": s.changes,
+	})
+
+	return
+}
+
+// Accept seals the current measurements, clearing reported changes.
+func (s *measurementStatus) Accept() (err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.current == nil {
+		return
+	}
+
+	if err = saveMeasurements(s.current); err != nil {
+		return
+	}
+
+	if len(s.changes) > 0 {
+		status.Log(syslog.LOG_NOTICE, "accepted %d measurement changes", len(s.changes))
+		status.Remove(s.notification)
+	}
+
+	s.changes = nil
+	indicator.SetTamper(false)
+
+	return
+}
+
+func (s *measurementStatus) Changes() []string {
+	s.Lock()
+	defer s.Unlock()
+
+	return append([]string{}, s.changes...)
+}
+
+func measurementsReport() (res jsonObject) {
+	measurements.Lock()
+	defer measurements.Unlock()
+
+	if measurements.current == nil {
+		return errorResponse(errors.New("measurements disabled"), "")
+	}
+
+	res = jsonObject{
+		"status": "OK",
+		"response": map[string]interface{}{
+			"epoch":   measurements.current.Epoch,
+			"binary":  measurements.current.Binary,
+			"config":  measurements.current.Config,
+			"static":  len(measurements.current.Static),
+			"sealed":  conf.authHSM != nil,
+			"changes": append([]string{}, measurements.changes...),
+		},
+	}
+
+	return
+}
+
+func acceptMeasurements() (res jsonObject) {
+	if err := measurements.Accept(); err != nil {
+		return errorResponse(err, "")
+	}
+
+	return jsonObject{
+		"status":   "OK",
+		"response": nil,
+	}
+}
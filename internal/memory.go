@@ -0,0 +1,136 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"errors"
+	"log/syslog"
+	"net/http"
+	"sync"
+)
+
+// Memory budget, the estimated memory use of API requests and file/crypto
+// jobs is accounted against `memory_budget` (MiB). Requests exceeding it are
+// rejected with the BUSY status, so that clients can retry, while queued jobs
+// wait for memory to be released, rather than exhausting system memory and
+// having the daemon killed in the middle of a write.
+
+const (
+	// baseline use of any request (buffers, JSON decoding)
+	requestMemory = 256 * 1024
+	// streaming uploads (copy buffers, compressed storage chunks)
+	uploadMemory = 4 * compressChunkSize
+	// file and crypto jobs (cipher, archive and compression buffers)
+	jobMemory = 8 * 1024 * 1024
+)
+
+var errBusy = errors.New("memory budget exhausted, retry later")
+
+// estimated memory use of requests buffering their body, or streaming it,
+// other requests are estimated from their length
+var requestMemoryUse = map[string]int64{
+	"/api/file/upload":    uploadMemory,
+	"/api/deposit/upload": uploadMemory,
+	"/api/file/camera":    cameraMaxChunk,
+	"/api/auth/header":    headerMaxSize,
+}
+
+type memoryBudget struct {
+	sync.Mutex
+	used     int64
+	peak     int64
+	rejected int
+}
+
+var memory memoryBudget
+
+func (m *memoryBudget) limit() int64 {
+	return int64(conf.MemoryBudget) * 1024 * 1024
+}
+
+// reserve accounts memory use, it must be called with the budget locked.
+func (m *memoryBudget) reserve(n int64) bool {
+	if limit := m.limit(); limit > 0 && m.used+n > limit && m.used > 0 {
+		return false
+	}
+
+	m.used += n
+
+	if m.used > m.peak {
+		m.peak = m.used
+	}
+
+	return true
+}
+
+// Reserve accounts memory use, an error is returned when the budget is
+// exhausted. A single reservation exceeding the budget is only allowed when
+// no other memory is in use.
+func (m *memoryBudget) Reserve(n int64) (err error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if !m.reserve(n) {
+		m.rejected++
+		return errBusy
+	}
+
+	return
+}
+
+// TryReserve accounts memory use without rejection accounting, for queued
+// work.
+func (m *memoryBudget) TryReserve(n int64) bool {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.reserve(n)
+}
+
+func (m *memoryBudget) Release(n int64) {
+	m.Lock()
+	m.used -= n
+	m.Unlock()
+
+	// wake up jobs waiting for memory
+	jobs.wake()
+}
+
+func (m *memoryBudget) Status() map[string]interface{} {
+	m.Lock()
+	defer m.Unlock()
+
+	return map[string]interface{}{
+		"budget":   m.limit(),
+		"used":     m.used,
+		"peak":     m.peak,
+		"rejected": m.rejected,
+	}
+}
+
+// requestMemoryEstimate returns the estimated memory use of a request.
+func requestMemoryEstimate(r *http.Request) int64 {
+	if n, ok := requestMemoryUse[r.URL.Path]; ok {
+		return requestMemory + n
+	}
+
+	// JSON bodies are buffered for validation and parsing
+	if r.ContentLength > 0 {
+		return requestMemory + 2*r.ContentLength
+	}
+
+	return requestMemory
+}
+
+// busyResponse rejects a request due to resource limits, clients are expected
+// to retry.
+func busyResponse(w http.ResponseWriter, r *http.Request, code int, err error) {
+	status.Log(syslog.LOG_WARNING, "rejected %s from %s: %v", r.URL.Path, r.RemoteAddr, err)
+
+	w.Header().Set("Retry-After", "1")
+	writeResponse(w, code, jsonObject{"status": "BUSY", "response": []string{err.Error()}})
+}
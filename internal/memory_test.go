@@ -0,0 +1,66 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	c := newTestServer(t)
+	defer conf.SetDefaults()
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	conf.MemoryBudget = 16
+
+	// exhaust the budget
+	held := int64(conf.MemoryBudget)*1024*1024 - requestMemory/2
+
+	if err := memory.Reserve(held); err != nil {
+		t.Fatal(err)
+	}
+
+	r := c.request("POST", "/api/file/list", nil, []byte(`{"path": "/", "sha256": false}`))
+
+	var res jsonObject
+	json.NewDecoder(r.Body).Decode(&res)
+	r.Body.Close()
+
+	if r.StatusCode != http.StatusServiceUnavailable || res["status"] != "BUSY" || r.Header.Get("Retry-After") == "" {
+		t.Errorf("request not rejected: %d %v", r.StatusCode, res)
+	}
+
+	// jobs are queued until memory is released
+	done := make(chan bool)
+
+	jobs.Go("test", "test", func() { close(done) })
+
+	select {
+	case <-done:
+		t.Error("job exceeded memory budget")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	memory.Release(held)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("queued job not resumed")
+	}
+
+	c.mustCall("file/list", jsonObject{"path": "/", "sha256": false})
+
+	if s := memory.Status(); s["rejected"].(int) == 0 || s["peak"].(int64) < held {
+		t.Errorf("unexpected status %v", s)
+	}
+}
@@ -0,0 +1,208 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// +build linux
+
+package interlock
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const paxXattr = "SCHILY.xattr."
+
+type inodeMetadata struct {
+	Mode   uint32            `json:"mode"`
+	UID    uint32            `json:"uid"`
+	GID    uint32            `json:"gid"`
+	Atime  int64             `json:"atime"`
+	Mtime  int64             `json:"mtime"`
+	Xattrs map[string][]byte `json:"xattrs"`
+}
+
+// fileIdentity returns the device and inode numbers of a file.
+func fileIdentity(info os.FileInfo) (dev uint64, ino uint64, ok bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+
+	if !ok {
+		return
+	}
+
+	return uint64(stat.Dev), uint64(stat.Ino), true
+}
+
+func getXattrs(fd int) (xattrs map[string][]byte, err error) {
+	xattrs = make(map[string][]byte)
+
+	size, err := unix.Flistxattr(fd, nil)
+
+	if err != nil || size == 0 {
+		if err == unix.ENOTSUP {
+			err = nil
+		}
+
+		return
+	}
+
+	buf := make([]byte, size)
+	size, err = unix.Flistxattr(fd, buf)
+
+	if err != nil {
+		return
+	}
+
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+
+		var n int
+
+		n, err = unix.Fgetxattr(fd, string(name), nil)
+
+		if err != nil {
+			return
+		}
+
+		value := make([]byte, n)
+		n, err = unix.Fgetxattr(fd, string(name), value)
+
+		if err != nil {
+			return
+		}
+
+		xattrs[string(name)] = value[:n]
+	}
+
+	return
+}
+
+func getMetadata(osPath string) (m *inodeMetadata, err error) {
+	var stat unix.Stat_t
+
+	// non-blocking to avoid stalling on FIFOs
+	f, err := volumeJail().OpenFile(osPath, os.O_RDONLY|unix.O_NONBLOCK, 0)
+
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	if err = unix.Fstat(int(f.Fd()), &stat); err != nil {
+		return
+	}
+
+	m = &inodeMetadata{
+		Mode:  stat.Mode & 07777,
+		UID:   stat.Uid,
+		GID:   stat.Gid,
+		Atime: stat.Atim.Sec,
+		Mtime: stat.Mtim.Sec,
+	}
+
+	m.Xattrs, err = getXattrs(int(f.Fd()))
+
+	return
+}
+
+// setMetadata applies mode, extended attributes and timestamps to an open
+// file, ownership is only restored when running with root privileges.
+func setMetadata(f *os.File, m *inodeMetadata) (err error) {
+	if err = f.Chmod(os.FileMode(m.Mode & 0777)); err != nil {
+		return
+	}
+
+	if os.Geteuid() == 0 {
+		if err = f.Chown(int(m.UID), int(m.GID)); err != nil {
+			return
+		}
+	}
+
+	for name, value := range m.Xattrs {
+		if err = unix.Fsetxattr(int(f.Fd()), name, value, 0); err != nil {
+			return
+		}
+	}
+
+	tv := []unix.Timeval{
+		unix.NsecToTimeval(time.Unix(m.Atime, 0).UnixNano()),
+		unix.NsecToTimeval(time.Unix(m.Mtime, 0).UnixNano()),
+	}
+
+	return unix.Futimes(int(f.Fd()), tv)
+}
+
+// tarMetadata adds extended attributes of an open file to a tar header as PAX
+// records.
+func tarMetadata(f *os.File, header *tar.Header) (err error) {
+	xattrs, err := getXattrs(int(f.Fd()))
+
+	if err != nil || len(xattrs) == 0 {
+		return
+	}
+
+	if header.PAXRecords == nil {
+		header.PAXRecords = make(map[string]string)
+	}
+
+	for name, value := range xattrs {
+		header.PAXRecords[paxXattr+name] = string(value)
+	}
+
+	header.Format = tar.FormatPAX
+
+	return
+}
+
+func tarHeaderMetadata(header *tar.Header) (m *inodeMetadata) {
+	m = &inodeMetadata{
+		Mode:   uint32(header.Mode),
+		UID:    uint32(header.Uid),
+		GID:    uint32(header.Gid),
+		Atime:  header.ModTime.Unix(),
+		Mtime:  header.ModTime.Unix(),
+		Xattrs: make(map[string][]byte),
+	}
+
+	for k, v := range header.PAXRecords {
+		if strings.HasPrefix(k, paxXattr) {
+			m.Xattrs[strings.TrimPrefix(k, paxXattr)] = []byte(v)
+		}
+	}
+
+	return
+}
+
+// cloneFile replaces the content of dst with copy-on-write references to the
+// src extents, failing on file systems without reflink support (e.g. ext4).
+func cloneFile(src string, dst string) (err error) {
+	s, err := volumeJail().Open(src)
+
+	if err != nil {
+		return
+	}
+	defer s.Close()
+
+	d, err := volumeJail().OpenFile(dst, os.O_WRONLY, 0)
+
+	if err != nil {
+		return
+	}
+	defer d.Close()
+
+	if err = unix.IoctlFileClone(int(d.Fd()), int(s.Fd())); err != nil {
+		return
+	}
+
+	return d.Sync()
+}
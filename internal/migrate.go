@@ -0,0 +1,395 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"errors"
+	"fmt"
+	"log/syslog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cipher migration, files encrypted with the deprecated `migrate_ciphers` are
+// re-encrypted with the requested password based cipher by a background job
+// which only runs after `migrate_idle` seconds without API requests. Each
+// file is decrypted through a pipe into the new cipher, so that plaintext is
+// never written, and replaces the original only once fully re-encrypted.
+
+const (
+	migrationIdle      = "idle"
+	migrationRunning   = "running"
+	migrationPaused    = "paused"
+	migrationStopped   = "stopped"
+	migrationCompleted = "completed"
+)
+
+var migrationPoll = time.Second
+
+type migrationJob struct {
+	sync.Mutex
+	state    string
+	total    int
+	done     int
+	failed   int
+	current  string
+	activity time.Time
+	pipe     *os.File
+	finished chan bool
+}
+
+var migration = migrationJob{state: migrationIdle}
+
+// Touch records API activity, deferring migration to idle time.
+func (m *migrationJob) Touch() {
+	m.Lock()
+	defer m.Unlock()
+
+	m.activity = time.Now()
+}
+
+func (m *migrationJob) Status() map[string]interface{} {
+	m.Lock()
+	defer m.Unlock()
+
+	s := map[string]interface{}{
+		"state":   m.state,
+		"total":   m.total,
+		"done":    m.done,
+		"failed":  m.failed,
+		"current": "",
+	}
+
+	if m.current != "" {
+		s["current"] = relativePath(m.current)
+	}
+
+	return s
+}
+
+func (m *migrationJob) setState(state string) (err error) {
+	m.Lock()
+	defer m.Unlock()
+
+	switch {
+	case state == migrationPaused && m.state != migrationRunning:
+		err = errors.New("migration not running")
+	case state == migrationRunning && m.state != migrationPaused:
+		err = errors.New("migration not paused")
+	default:
+		m.state = state
+	}
+
+	return
+}
+
+// wait blocks while the job is paused or the API is active, it returns false
+// if the job has been stopped.
+func (m *migrationJob) wait() bool {
+	for {
+		m.Lock()
+		state := m.state
+		busy := time.Since(m.activity) < time.Duration(conf.MigrateIdle)*time.Second
+		m.Unlock()
+
+		switch {
+		case state == migrationStopped:
+			return false
+		case state == migrationRunning && !busy:
+			return true
+		}
+
+		time.Sleep(migrationPoll)
+	}
+}
+
+// Stop interrupts the job, aborting the current file, and waits for its
+// termination.
+func (m *migrationJob) Stop() {
+	m.Lock()
+
+	if m.state != migrationRunning && m.state != migrationPaused {
+		m.Unlock()
+		return
+	}
+
+	m.state = migrationStopped
+
+	if m.pipe != nil {
+		m.pipe.Close()
+	}
+
+	finished := m.finished
+	m.Unlock()
+
+	<-finished
+}
+
+// migrationSources returns the deprecated ciphers indexed by file extension.
+func migrationSources() (sources map[string]cipherInterface) {
+	sources = make(map[string]cipherInterface)
+
+	for _, name := range conf.MigrateCiphers {
+		if cipher, err := conf.GetCipher(name); err == nil {
+			sources["."+cipher.GetInfo().Extension] = cipher
+		}
+	}
+
+	return
+}
+
+func (m *migrationJob) Start(root string, target cipherInterface, password string) (err error) {
+	if target.GetInfo().KeyFormat != "password" || !target.GetInfo().Enc {
+		return errors.New("migration requires a password based cipher")
+	}
+
+	if err = target.SetPassword(password); err != nil {
+		return
+	}
+
+	sources := migrationSources()
+
+	if len(sources) == 0 {
+		return errors.New("no deprecated cipher enabled")
+	}
+
+	var files []string
+
+	err = volumeJail().Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.Mode().IsRegular() && sources[filepath.Ext(path)] != nil {
+			files = append(files, path)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	if m.state == migrationRunning || m.state == migrationPaused {
+		return errors.New("migration already in progress")
+	}
+
+	m.state = migrationRunning
+	m.total = len(files)
+	m.done = 0
+	m.failed = 0
+	m.finished = make(chan bool)
+
+	go m.run(files, sources, target, password)
+
+	return
+}
+
+func (m *migrationJob) run(files []string, sources map[string]cipherInterface, target cipherInterface, password string) {
+	defer recoverJob("migrating ciphers")
+
+	defer func() {
+		m.Lock()
+		defer m.Unlock()
+
+		if m.state == migrationRunning {
+			m.state = migrationCompleted
+		}
+
+		m.current = ""
+		close(m.finished)
+	}()
+
+	for _, src := range files {
+		if !m.wait() {
+			return
+		}
+
+		m.Lock()
+		m.current = src
+		m.Unlock()
+
+		err := m.migrate(src, sources[filepath.Ext(src)], target, password)
+
+		m.Lock()
+
+		if err != nil {
+			m.failed++
+		} else {
+			m.done++
+		}
+
+		stopped := m.state == migrationStopped
+		m.Unlock()
+
+		if err != nil && !stopped {
+			status.Error(fmt.Errorf("migration of %s failed: %v", relativePath(src), err))
+		}
+	}
+
+	m.Lock()
+	done, failed := m.done, m.failed
+	m.Unlock()
+
+	status.Log(syslog.LOG_NOTICE, "cipher migration completed (%d migrated, %d failed)", done, failed)
+}
+
+// migrate re-encrypts src, the deprecated cipher extension is replaced with
+// the target one.
+func (m *migrationJob) migrate(src string, source cipherInterface, target cipherInterface, password string) (err error) {
+	n := status.Notify(syslog.LOG_INFO, "migrating %s", relativePath(src))
+	defer status.Remove(n)
+
+	dst := strings.TrimSuffix(src, filepath.Ext(src)) + "." + target.GetInfo().Extension
+
+	if _, err = volumeJail().Stat(dst); err == nil {
+		return errors.New("destination already exists")
+	}
+
+	stat, err := volumeJail().Stat(src)
+
+	if err != nil {
+		return
+	}
+
+	decryptor := source.New()
+
+	if err = decryptor.SetPassword(password); err != nil {
+		return
+	}
+
+	encryptor := target.New()
+
+	if err = encryptor.SetPassword(password); err != nil {
+		return
+	}
+
+	input, err := volumeJail().Open(src)
+
+	if err != nil {
+		return
+	}
+	defer input.Close()
+
+	output, err := createAtomic("migrate", src, dst, true)
+
+	if err != nil {
+		return
+	}
+
+	pr, pw, err := os.Pipe()
+
+	if err != nil {
+		output.Abort()
+		return
+	}
+	defer pr.Close()
+
+	m.Lock()
+	m.pipe = pr
+	m.Unlock()
+
+	defer func() {
+		m.Lock()
+		m.pipe = nil
+		m.Unlock()
+	}()
+
+	decrypted := make(chan error, 1)
+
+	go func() {
+		err := decryptor.Decrypt(input, pw, false)
+		pw.Close()
+		decrypted <- err
+	}()
+
+	err = encryptor.Encrypt(pr, output.File, false)
+
+	// unblock the decryption on encryption failure
+	pr.Close()
+
+	if e := <-decrypted; e != nil && err == nil {
+		err = e
+	}
+
+	if err != nil {
+		output.Abort()
+		return
+	}
+
+	if err = output.Commit(); err != nil {
+		return
+	}
+
+	volumeJail().Chtimes(dst, stat.ModTime(), stat.ModTime())
+
+	return volumeJail().Remove(src)
+}
+
+func fileMigrate(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	var target cipherInterface
+
+	switch req["action"].(string) {
+	case "start":
+		err = requireAttributes(req, "cipher", "password")
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+
+		root := "/"
+
+		if p, ok := req["path"].(string); ok {
+			root = p
+		}
+
+		root, err = absolutePath(root)
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+
+		target, err = conf.GetCipher(req["cipher"].(string))
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+
+		err = migration.Start(root, target, req["password"].(string))
+	case "pause":
+		err = migration.setState(migrationPaused)
+	case "resume":
+		err = migration.setState(migrationRunning)
+	case "stop":
+		migration.Stop()
+	}
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": migration.Status(),
+	}
+
+	return
+}
@@ -0,0 +1,96 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMigration(t *testing.T) {
+	c := newTestServer(t)
+	defer conf.SetDefaults()
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	migrationPoll = 10 * time.Millisecond
+	defer func() { migrationPoll = time.Second }()
+
+	conf.MigrateIdle = 0
+
+	c.call("file/mkdir", jsonObject{"path": []string{"/legacy"}})
+
+	for _, src := range []string{"/legacy/a.txt", "/legacy/b.txt"} {
+		c.upload(src, testCleartext)
+		c.mustCall("file/encrypt", jsonObject{"src": src, "cipher": "AES-256-OFB", "wipe_src": true, "sign": false, "password": testPassword, "key": "", "sig_key": ""})
+		c.wait(src + ".aes256ofb")
+	}
+
+	if res := c.call("file/migrate", jsonObject{"action": "start", "path": "/legacy", "cipher": "OpenPGP", "password": testPassword}); res["status"] != "KO" {
+		t.Error("migration to key based cipher accepted")
+	}
+
+	if res := c.call("file/migrate", jsonObject{"action": "resume"}); res["status"] != "KO" {
+		t.Error("resume of idle migration accepted")
+	}
+
+	c.mustCall("file/migrate", jsonObject{"action": "start", "path": "/legacy", "cipher": "AES-256-MOCK", "password": testPassword})
+
+	for _, src := range []string{"/legacy/a.txt", "/legacy/b.txt"} {
+		c.wait(src + ".aes256mock")
+	}
+
+	res := c.mustCall("file/migrate", jsonObject{"action": "status"})
+
+	for i := 0; i < 100 && res["response"].(map[string]interface{})["state"] != migrationCompleted; i++ {
+		time.Sleep(10 * time.Millisecond)
+		res = c.mustCall("file/migrate", jsonObject{"action": "status"})
+	}
+
+	if s := res["response"].(map[string]interface{}); s["state"] != migrationCompleted || s["done"] != float64(2) || s["failed"] != float64(0) {
+		t.Fatalf("unexpected migration status %v", s)
+	}
+
+	if _, err := os.Stat(filepath.Join(conf.MountPoint, "/legacy/a.txt.aes256ofb")); !os.IsNotExist(err) {
+		t.Error("migrated file not removed")
+	}
+
+	c.mustCall("file/decrypt", jsonObject{"src": "/legacy/a.txt.aes256mock", "cipher": "AES-256-MOCK", "verify": false, "password": testPassword, "key": "", "sig_key": ""})
+	c.wait("/legacy/a.txt")
+
+	if data := c.download("/legacy/a.txt"); data != testCleartext {
+		t.Fatalf("migrated data mismatch: %s", data)
+	}
+
+	// migration deferred during API activity, pausing and stopping
+	conf.MigrateIdle = 3600
+
+	c.upload("/legacy/c.txt", testCleartext)
+	c.mustCall("file/encrypt", jsonObject{"src": "/legacy/c.txt", "cipher": "AES-256-OFB", "wipe_src": true, "sign": false, "password": testPassword, "key": "", "sig_key": ""})
+	c.wait("/legacy/c.txt.aes256ofb")
+
+	c.mustCall("file/migrate", jsonObject{"action": "start", "path": "/legacy", "cipher": "AES-256-MOCK", "password": testPassword})
+	c.mustCall("file/migrate", jsonObject{"action": "pause"})
+
+	if res = c.call("file/migrate", jsonObject{"action": "start", "path": "/legacy", "cipher": "AES-256-MOCK", "password": testPassword}); res["status"] != "KO" {
+		t.Error("concurrent migration accepted")
+	}
+
+	c.mustCall("file/migrate", jsonObject{"action": "resume"})
+	res = c.mustCall("file/migrate", jsonObject{"action": "stop"})
+
+	if s := res["response"].(map[string]interface{}); s["state"] != migrationStopped || s["done"] != float64(0) {
+		t.Errorf("unexpected migration status %v", s)
+	}
+
+	if _, err := os.Stat(filepath.Join(conf.MountPoint, "/legacy/c.txt.aes256ofb")); err != nil {
+		t.Error("migration not deferred")
+	}
+}
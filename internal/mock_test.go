@@ -0,0 +1,193 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+)
+
+// In-memory volume backend, the mount point is expected to be an existing
+// (temporary) directory.
+type mockVolume struct {
+	mu        sync.Mutex
+	passwords map[string][]string
+	unlocked  string
+	mounted   bool
+	readOnly  bool
+
+	volumeInterface
+}
+
+func newMockVolume(volume string, password string) *mockVolume {
+	return &mockVolume{
+		passwords: map[string][]string{volume: {password}},
+	}
+}
+
+func (v *mockVolume) slot(volume string, password string) int {
+	for i, p := range v.passwords[volume] {
+		if hmac.Equal([]byte(p), []byte(password)) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (v *mockVolume) Unlock(ctx context.Context, volume string, password string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.unlocked != "" {
+		return errors.New("volume already unlocked")
+	}
+
+	if v.slot(volume, password) < 0 {
+		return errors.New("no key available with this passphrase")
+	}
+
+	v.unlocked = volume
+
+	return nil
+}
+
+func (v *mockVolume) Mount(ctx context.Context) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.unlocked == "" {
+		return errors.New("volume locked")
+	}
+
+	v.mounted = true
+
+	return nil
+}
+
+func (v *mockVolume) Umount(ctx context.Context) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.mounted = false
+
+	return nil
+}
+
+func (v *mockVolume) Remount(ctx context.Context, readOnly bool) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if !v.mounted {
+		return errors.New("volume not mounted")
+	}
+
+	v.readOnly = readOnly
+
+	return nil
+}
+
+func (v *mockVolume) Lock(ctx context.Context) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.mounted {
+		return errors.New("volume in use")
+	}
+
+	v.unlocked = ""
+
+	return nil
+}
+
+func (v *mockVolume) KeyOp(ctx context.Context, volume string, password string, newPassword string, mode int) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	i := v.slot(volume, password)
+
+	if i < 0 {
+		return errors.New("no key available with this passphrase")
+	}
+
+	switch mode {
+	case _change:
+		v.passwords[volume][i] = newPassword
+	case _add:
+		v.passwords[volume] = append(v.passwords[volume], newPassword)
+	case _remove:
+		v.passwords[volume] = append(v.passwords[volume][:i], v.passwords[volume][i+1:]...)
+	default:
+		return errors.New("unsupported operation")
+	}
+
+	return nil
+}
+
+// HSM emulation, the device specific secret key is fixed.
+type mockHSM struct {
+	HSMInterface
+}
+
+var mockHSMKey = []byte("INTERLOCK mock HSM device key")
+
+func (h *mockHSM) New() HSMInterface {
+	return new(mockHSM)
+}
+
+func (h *mockHSM) Cipher() cipherInterface {
+	return new(aes256Mock).Init()
+}
+
+func (h *mockHSM) DeriveKey(diversifier []byte, iv []byte) (derivedKey []byte, err error) {
+	mac := hmac.New(sha256.New, mockHSMKey)
+	mac.Write(iv)
+	mac.Write(diversifier)
+
+	return mac.Sum(nil)[0:derivedKeySize], nil
+}
+
+// AES-256-OFB cipher with password filtered through the mock HSM.
+type aes256Mock struct {
+	aes256OFB
+}
+
+func (a *aes256Mock) Init() cipherInterface {
+	a.aes256OFB.Init()
+
+	a.info.Name = "AES-256-MOCK"
+	a.info.Description = "AES OFB w/ 256 bit key derived using PBKDF2 and mock HSM"
+	a.info.Extension = "aes256mock"
+
+	return a
+}
+
+func (a *aes256Mock) New() cipherInterface {
+	return new(aes256Mock).Init()
+}
+
+func (a *aes256Mock) GetInfo() cipherInfo {
+	return a.info
+}
+
+func (a *aes256Mock) SetPassword(password string) (err error) {
+	if len(password) < 8 {
+		return errors.New("password < 8 characters")
+	}
+
+	key, err := new(mockHSM).DeriveKey([]byte(password), nil)
+
+	if err != nil {
+		return
+	}
+
+	return a.aes256OFB.SetPassword(hex.EncodeToString(key))
+}
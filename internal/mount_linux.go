@@ -0,0 +1,168 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// +build linux
+
+package interlock
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Volume mounting, the encrypted volume is mounted with the `mount_options`
+// flags (by default nodev, nosuid and noexec). When executed as root (the
+// privileged helper or container mode) mount and umount are performed with
+// the mount(2) and umount2(2) system calls rather than by executing
+// /bin/mount and /bin/umount, the mount(8) invocation being retained for
+// sudo.
+
+// supported mount options and their mount(2) flags
+var mountFlags = map[string]uintptr{
+	"nodev":      unix.MS_NODEV,
+	"nosuid":     unix.MS_NOSUID,
+	"noexec":     unix.MS_NOEXEC,
+	"noatime":    unix.MS_NOATIME,
+	"nodiratime": unix.MS_NODIRATIME,
+	"relatime":   unix.MS_RELATIME,
+	"sync":       unix.MS_SYNCHRONOUS,
+	"ro":         unix.MS_RDONLY,
+	"rw":         0,
+	"remount":    unix.MS_REMOUNT,
+}
+
+// ext2/3/4 superblock magic offset
+const extMagicOffset = 1024 + 56
+
+// validateMount verifies the mount options configuration.
+func validateMount() (err error) {
+	for _, opt := range conf.MountOptions {
+		if _, ok := mountFlags[opt]; !ok || opt == "remount" || opt == "ro" || opt == "rw" {
+			return fmt.Errorf("invalid mount_options entry %s", opt)
+		}
+	}
+
+	return
+}
+
+// mountArgs returns the mount(8) arguments for the argument options,
+// followed by the configured ones.
+func mountArgs(options []string, args ...string) []string {
+	options = append(options, conf.MountOptions...)
+
+	if len(options) == 0 {
+		return args
+	}
+
+	return append([]string{"-o", strings.Join(options, ",")}, args...)
+}
+
+// mountCommand performs mount(8) and umount(8) invocations with system
+// calls, handled is false when the command must be executed.
+func mountCommand(cmd string, args []string) (handled bool, err error) {
+	var flags uintptr
+
+	if cmd == "/bin/umount" {
+		if len(args) != 1 {
+			return
+		}
+
+		if err = unix.Unmount(args[0], 0); err != nil {
+			err = fmt.Errorf("umount %s failed, %v", args[0], err)
+		}
+
+		return true, err
+	}
+
+	if len(args) > 2 && args[0] == "-o" {
+		for _, opt := range strings.Split(args[1], ",") {
+			f, ok := mountFlags[opt]
+
+			if !ok {
+				return
+			}
+
+			flags |= f
+		}
+
+		args = args[2:]
+	}
+
+	switch {
+	case len(args) == 1 && flags&unix.MS_REMOUNT != 0:
+		err = unix.Mount("", args[0], "", flags, "")
+	case len(args) == 2 && flags&unix.MS_REMOUNT == 0:
+		err = mountDevice(args[0], args[1], flags)
+	default:
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("mount %s failed, %v", strings.Join(args, " on "), err)
+	}
+
+	return true, err
+}
+
+// mountDevice mounts a block device, detecting its file system like
+// mount(8): ext2/3/4 is identified by its superblock, other file systems
+// registered with the kernel are tried in turn.
+func mountDevice(source string, target string, flags uintptr) (err error) {
+	types, err := filesystemTypes(source)
+
+	if err != nil {
+		return
+	}
+
+	for _, fstype := range types {
+		if err = unix.Mount(source, target, fstype, flags, ""); err != unix.EINVAL {
+			return
+		}
+	}
+
+	if err == nil {
+		err = unix.EINVAL
+	}
+
+	return fmt.Errorf("unknown file system (%v)", err)
+}
+
+func filesystemTypes(source string) (types []string, err error) {
+	magic := make([]byte, 2)
+
+	f, err := os.Open(source)
+
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	if _, err = f.ReadAt(magic, extMagicOffset); err == nil && binary.LittleEndian.Uint16(magic) == 0xef53 {
+		return []string{"ext4"}, nil
+	}
+
+	fs, err := os.Open("/proc/filesystems")
+
+	if err != nil {
+		return
+	}
+	defer fs.Close()
+
+	scanner := bufio.NewScanner(fs)
+
+	for scanner.Scan() {
+		if f := strings.Fields(scanner.Text()); len(f) == 1 {
+			types = append(types, f[0])
+		}
+	}
+
+	return types, scanner.Err()
+}
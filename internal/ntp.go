@@ -0,0 +1,496 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/syslog"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NTP time synchronization, the configured servers are periodically queried
+// (SNTP, RFC 4330) and the device clock is stepped when it is off by more than
+// a second. Servers prefixed with "nts://" are authenticated with Network Time
+// Security (RFC 8915), a key establishment is performed for each query.
+//
+// The clock drift between synchronizations is reported in the running
+// status.
+
+const (
+	ntpPort       = "123"
+	ntsPort       = "4460"
+	ntpTimeout    = 10 * time.Second
+	ntpEpoch      = 2208988800
+	ntpStep       = time.Second
+	ntsALPN       = "ntske/1"
+	ntsAEAD       = 15 // AEAD_AES_SIV_CMAC_256
+	ntsLabel      = "EXPORTER-network-time-security"
+	ntsScheme     = "nts://"
+	ntsNonceSize  = 16
+	ntsUniqueSize = 32
+)
+
+// NTS-KE record types
+const (
+	ntsEndOfMessage = 0
+	ntsNextProtocol = 1
+	ntsError        = 2
+	ntsWarning      = 3
+	ntsAEADAlgo     = 4
+	ntsNewCookie    = 5
+	ntsServer       = 6
+	ntsPortNeg      = 7
+)
+
+// NTS extension field types
+const (
+	ntsUniqueID      = 0x0104
+	ntsCookie        = 0x0204
+	ntsAuthenticator = 0x0404
+)
+
+// ntsRoots overrides the system certificate pool for NTS-KE server
+// verification.
+var ntsRoots *x509.CertPool
+
+type ntpStatus struct {
+	sync.Mutex
+	server string
+	offset time.Duration
+	delay  time.Duration
+	drift  float64
+	synced time.Time
+	err    string
+}
+
+var ntp ntpStatus
+
+func (n *ntpStatus) Status() map[string]interface{} {
+	n.Lock()
+	defer n.Unlock()
+
+	if len(conf.NTPServers) == 0 {
+		return nil
+	}
+
+	synced := int64(0)
+
+	if !n.synced.IsZero() {
+		synced = n.synced.Unix()
+	}
+
+	return map[string]interface{}{
+		"server":    n.server,
+		"offset":    n.offset.Seconds(),
+		"delay":     n.delay.Seconds(),
+		"drift_ppm": n.drift,
+		"synced":    synced,
+		"error":     n.err,
+	}
+}
+
+// Synced returns true if the clock has been synchronized within the last
+// two intervals.
+func (n *ntpStatus) Synced() bool {
+	n.Lock()
+	defer n.Unlock()
+
+	return !n.synced.IsZero() && time.Since(n.synced) < 2*time.Duration(conf.NTPInterval)*time.Second
+}
+
+func startNTP() (err error) {
+	if len(conf.NTPServers) == 0 {
+		return
+	}
+
+	if conf.NTPInterval <= 0 {
+		return errors.New("invalid NTP interval")
+	}
+
+	go func() {
+		defer recoverJob("synchronizing time")
+
+		for {
+			ntp.sync()
+			time.Sleep(time.Duration(conf.NTPInterval) * time.Second)
+		}
+	}()
+
+	return
+}
+
+func (n *ntpStatus) sync() {
+	var offset time.Duration
+	var delay time.Duration
+	var err error
+
+	server := ""
+
+	for _, server = range conf.NTPServers {
+		if offset, delay, err = ntpQuery(server); err == nil {
+			break
+		}
+
+		if conf.Debug {
+			status.Log(syslog.LOG_DEBUG, "NTP query to %s failed: %v", server, err)
+		}
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	if err != nil {
+		if n.err == "" {
+			status.Log(syslog.LOG_WARNING, "NTP synchronization failed: %v", err)
+		}
+
+		n.err = err.Error()
+		return
+	}
+
+	now := time.Now()
+
+	if !n.synced.IsZero() {
+		// offset accumulated since the previous synchronization
+		n.drift = offset.Seconds() / now.Sub(n.synced).Seconds() * 1e6
+	}
+
+	n.server = server
+	n.offset = offset
+	n.delay = delay
+	n.synced = now
+	n.err = ""
+
+	if offset > -ntpStep && offset < ntpStep {
+		return
+	}
+
+	if err = setTime(now.Add(offset).Unix()); err != nil {
+		status.Error(err)
+		return
+	}
+
+	status.Log(syslog.LOG_NOTICE, "adjusted device time by %v (NTP server %s)", offset.Round(time.Millisecond), server)
+}
+
+func ntpToTime(t uint64) time.Time {
+	return time.Unix(int64(t>>32)-ntpEpoch, int64((t&0xffffffff)*1e9>>32))
+}
+
+// ntpQuery returns the clock offset against an NTP server, and the round-trip
+// delay.
+func ntpQuery(server string) (offset time.Duration, delay time.Duration, err error) {
+	var ke *ntsKeys
+
+	addr := server
+
+	if strings.HasPrefix(server, ntsScheme) {
+		if ke, err = ntsKeyExchange(strings.TrimPrefix(server, ntsScheme)); err != nil {
+			return
+		}
+
+		addr = ke.server
+	} else if _, _, e := net.SplitHostPort(addr); e != nil {
+		addr = net.JoinHostPort(addr, ntpPort)
+	}
+
+	req := make([]byte, 48)
+	// LI: 0, VN: 4, Mode: 3 (client)
+	req[0] = 0x23
+
+	// random transmit timestamp, the actual one is kept locally (RFC 9109)
+	if _, err = io.ReadFull(rand.Reader, req[40:48]); err != nil {
+		return
+	}
+
+	if ke != nil {
+		if req, err = ke.request(req); err != nil {
+			return
+		}
+	}
+
+	conn, err := net.DialTimeout("udp", addr, ntpTimeout)
+
+	if err != nil {
+		return
+	}
+
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(ntpTimeout))
+
+	t1 := time.Now()
+
+	if _, err = conn.Write(req); err != nil {
+		return
+	}
+
+	res := make([]byte, 2048)
+	n, err := conn.Read(res)
+	t4 := time.Now()
+
+	if err != nil {
+		return
+	}
+
+	res = res[:n]
+
+	if len(res) < 48 {
+		return 0, 0, errors.New("invalid NTP response")
+	}
+
+	if res[0]&0x07 != 4 || !bytes.Equal(res[24:32], req[40:48]) {
+		return 0, 0, errors.New("unexpected NTP response")
+	}
+
+	if res[1] == 0 {
+		return 0, 0, fmt.Errorf("NTP server kiss code %q", res[12:16])
+	}
+
+	if ke != nil {
+		if _, err = ke.response(res); err != nil {
+			return
+		}
+	}
+
+	t2 := ntpToTime(binary.BigEndian.Uint64(res[32:40]))
+	t3 := ntpToTime(binary.BigEndian.Uint64(res[40:48]))
+
+	offset = (t2.Sub(t1) + t3.Sub(t4)) / 2
+	delay = t4.Sub(t1) - t3.Sub(t2)
+
+	if math.Abs(offset.Hours()) > 100*365*24 {
+		return 0, 0, errors.New("implausible NTP time")
+	}
+
+	return
+}
+
+type ntsKeys struct {
+	server  string
+	cookies [][]byte
+	c2s     *aesSIV
+	s2c     *aesSIV
+	uid     []byte
+}
+
+func ntsRecord(critical bool, t uint16, body []byte) []byte {
+	if critical {
+		t |= 0x8000
+	}
+
+	r := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint16(r[0:], t)
+	binary.BigEndian.PutUint16(r[2:], uint16(len(body)))
+
+	return append(r, body...)
+}
+
+// ntsKeyExchange performs the NTS Key Establishment protocol, returning the
+// NTP server, cookies and keys for the following query.
+func ntsKeyExchange(server string) (ke *ntsKeys, err error) {
+	host, port, err := net.SplitHostPort(server)
+
+	if err != nil {
+		host = server
+		port = ntsPort
+	}
+
+	dialer := &net.Dialer{Timeout: ntpTimeout}
+
+	conn, err := tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(host, port), &tls.Config{
+		ServerName: host,
+		RootCAs:    ntsRoots,
+		MinVersion: tls.VersionTLS13,
+		NextProtos: []string{ntsALPN},
+	})
+
+	if err != nil {
+		return
+	}
+
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(ntpTimeout))
+
+	if conn.ConnectionState().NegotiatedProtocol != ntsALPN {
+		return nil, errors.New("NTS-KE protocol not negotiated")
+	}
+
+	var req []byte
+	req = append(req, ntsRecord(true, ntsNextProtocol, []byte{0, 0})...)
+	req = append(req, ntsRecord(false, ntsAEADAlgo, []byte{0, ntsAEAD})...)
+	req = append(req, ntsRecord(true, ntsEndOfMessage, nil)...)
+
+	if _, err = conn.Write(req); err != nil {
+		return
+	}
+
+	ke = &ntsKeys{}
+	addrHost := host
+	addrPort := ntpPort
+
+	for done := false; !done; {
+		hdr := make([]byte, 4)
+
+		if _, err = io.ReadFull(conn, hdr); err != nil {
+			return nil, fmt.Errorf("NTS-KE error: %v", err)
+		}
+
+		t := binary.BigEndian.Uint16(hdr) & 0x7fff
+		body := make([]byte, binary.BigEndian.Uint16(hdr[2:]))
+
+		if _, err = io.ReadFull(conn, body); err != nil {
+			return nil, fmt.Errorf("NTS-KE error: %v", err)
+		}
+
+		switch t {
+		case ntsEndOfMessage:
+			done = true
+		case ntsNextProtocol:
+			if !bytes.Equal(body, []byte{0, 0}) {
+				return nil, errors.New("NTS-KE NTPv4 protocol not supported")
+			}
+		case ntsAEADAlgo:
+			if !bytes.Equal(body, []byte{0, ntsAEAD}) {
+				return nil, errors.New("NTS-KE AEAD algorithm not supported")
+			}
+		case ntsError:
+			return nil, fmt.Errorf("NTS-KE error record %x", body)
+		case ntsNewCookie:
+			ke.cookies = append(ke.cookies, body)
+		case ntsServer:
+			addrHost = string(body)
+		case ntsPortNeg:
+			if len(body) == 2 {
+				addrPort = strconv.Itoa(int(binary.BigEndian.Uint16(body)))
+			}
+		default:
+			if hdr[0]&0x80 != 0 {
+				return nil, fmt.Errorf("NTS-KE critical record %d not supported", t)
+			}
+		}
+	}
+
+	if len(ke.cookies) == 0 {
+		return nil, errors.New("NTS-KE returned no cookies")
+	}
+
+	ke.server = net.JoinHostPort(addrHost, addrPort)
+	state := conn.ConnectionState()
+
+	for i, k := range []**aesSIV{&ke.c2s, &ke.s2c} {
+		key, err := state.ExportKeyingMaterial(ntsLabel, []byte{0, 0, 0, ntsAEAD, byte(i)}, 32)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if *k, err = newAESSIV(key); err != nil {
+			return nil, err
+		}
+	}
+
+	return
+}
+
+func ntpExtension(t uint16, body []byte) []byte {
+	size := (4 + len(body) + 3) &^ 3
+
+	e := make([]byte, size)
+	binary.BigEndian.PutUint16(e[0:], t)
+	binary.BigEndian.PutUint16(e[2:], uint16(size))
+	copy(e[4:], body)
+
+	return e
+}
+
+// request appends the NTS extension fields to an NTP request.
+func (ke *ntsKeys) request(req []byte) (packet []byte, err error) {
+	ke.uid = make([]byte, ntsUniqueSize)
+	nonce := make([]byte, ntsNonceSize)
+
+	if _, err = io.ReadFull(rand.Reader, ke.uid); err != nil {
+		return
+	}
+
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return
+	}
+
+	packet = append(req, ntpExtension(ntsUniqueID, ke.uid)...)
+	packet = append(packet, ntpExtension(ntsCookie, ke.cookies[0])...)
+
+	tag := ke.c2s.Seal(nonce, nil, packet)
+
+	auth := make([]byte, 4)
+	binary.BigEndian.PutUint16(auth[0:], uint16(len(nonce)))
+	binary.BigEndian.PutUint16(auth[2:], uint16(len(tag)))
+	auth = append(auth, nonce...)
+	auth = append(auth, tag...)
+
+	return append(packet, ntpExtension(ntsAuthenticator, auth)...), nil
+}
+
+// response authenticates an NTS response, returning its decrypted extension
+// fields.
+func (ke *ntsKeys) response(res []byte) (plaintext []byte, err error) {
+	uid := false
+
+	for off := 48; off+4 <= len(res); {
+		t := binary.BigEndian.Uint16(res[off:])
+		size := int(binary.BigEndian.Uint16(res[off+2:]))
+
+		if size < 4 || size%4 != 0 || off+size > len(res) {
+			return nil, errors.New("invalid NTP extension field")
+		}
+
+		body := res[off+4 : off+size]
+
+		switch t {
+		case ntsUniqueID:
+			uid = bytes.Equal(body, ke.uid)
+		case ntsAuthenticator:
+			if !uid {
+				return nil, errors.New("NTS unique identifier mismatch")
+			}
+
+			if len(body) < 4 {
+				return nil, errors.New("invalid NTS authenticator")
+			}
+
+			nonceSize := int(binary.BigEndian.Uint16(body[0:]))
+			tagSize := int(binary.BigEndian.Uint16(body[2:]))
+			padded := (nonceSize + 3) &^ 3
+
+			if 4+padded+tagSize > len(body) {
+				return nil, errors.New("invalid NTS authenticator")
+			}
+
+			nonce := body[4 : 4+nonceSize]
+			ciphertext := body[4+padded : 4+padded+tagSize]
+
+			return ke.s2c.Open(nonce, ciphertext, res[:off])
+		}
+
+		off += size
+	}
+
+	return nil, errors.New("unauthenticated NTP response")
+}
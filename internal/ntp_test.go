@@ -0,0 +1,301 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func ntpTime(t time.Time) uint64 {
+	return uint64(t.Unix()+ntpEpoch)<<32 | uint64(t.Nanosecond())<<32/1e9
+}
+
+// newFakeNTP starts an NTP server with a clock ahead of the local one by the
+// given offset, the optional handler appends extension fields to responses.
+func newFakeNTP(t *testing.T, offset time.Duration, handler func(req []byte, res []byte) []byte) *net.UDPAddr {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 2048)
+
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+
+			if err != nil {
+				return
+			}
+
+			req := buf[:n]
+			res := make([]byte, 48)
+			// LI: 0, VN: 4, Mode: 4 (server)
+			res[0] = 0x24
+			res[1] = 1
+			copy(res[24:32], req[40:48])
+			binary.BigEndian.PutUint64(res[32:40], ntpTime(time.Now().Add(offset)))
+			binary.BigEndian.PutUint64(res[40:48], ntpTime(time.Now().Add(offset)))
+
+			if handler != nil {
+				res = handler(req, res)
+			}
+
+			conn.WriteToUDP(res, from)
+		}
+	}()
+
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// fakeNTS implements the server side of NTS key establishment and NTP
+// request authentication.
+type fakeNTS struct {
+	sync.Mutex
+
+	keys   map[string][]*aesSIV
+	tamper bool
+}
+
+func (f *fakeNTS) keyExchange(conn *tls.Conn, ntpAddr *net.UDPAddr) {
+	defer conn.Close()
+
+	for {
+		hdr := make([]byte, 4)
+
+		if _, err := io.ReadFull(conn, hdr); err != nil {
+			return
+		}
+
+		if _, err := io.ReadFull(conn, make([]byte, binary.BigEndian.Uint16(hdr[2:]))); err != nil {
+			return
+		}
+
+		if binary.BigEndian.Uint16(hdr)&0x7fff == ntsEndOfMessage {
+			break
+		}
+	}
+
+	state := conn.ConnectionState()
+	keys := []*aesSIV{}
+
+	for i := 0; i < 2; i++ {
+		key, _ := state.ExportKeyingMaterial(ntsLabel, []byte{0, 0, 0, ntsAEAD, byte(i)}, 32)
+		s, _ := newAESSIV(key)
+		keys = append(keys, s)
+	}
+
+	cookie := make([]byte, 64)
+	rand.Read(cookie)
+
+	f.Lock()
+	f.keys[string(cookie)] = keys
+	f.Unlock()
+
+	port := make([]byte, 2)
+	binary.BigEndian.PutUint16(port, uint16(ntpAddr.Port))
+
+	var res []byte
+	res = append(res, ntsRecord(true, ntsNextProtocol, []byte{0, 0})...)
+	res = append(res, ntsRecord(true, ntsAEADAlgo, []byte{0, ntsAEAD})...)
+	res = append(res, ntsRecord(false, ntsNewCookie, cookie)...)
+	res = append(res, ntsRecord(true, ntsServer, []byte("127.0.0.1"))...)
+	res = append(res, ntsRecord(true, ntsPortNeg, port)...)
+	res = append(res, ntsRecord(true, ntsEndOfMessage, nil)...)
+
+	conn.Write(res)
+}
+
+func (f *fakeNTS) handle(req []byte, res []byte) []byte {
+	var uid, cookie []byte
+
+	for off := 48; off+4 <= len(req); {
+		size := int(binary.BigEndian.Uint16(req[off+2:]))
+		body := req[off+4 : off+size]
+
+		switch binary.BigEndian.Uint16(req[off:]) {
+		case ntsUniqueID:
+			uid = body
+		case ntsCookie:
+			cookie = body
+		case ntsAuthenticator:
+			f.Lock()
+			keys, ok := f.keys[string(cookie)]
+			tamper := f.tamper
+			f.Unlock()
+
+			nonceSize := int(binary.BigEndian.Uint16(body[0:]))
+			tagSize := int(binary.BigEndian.Uint16(body[2:]))
+
+			if !ok {
+				return res
+			}
+
+			if _, err := keys[0].Open(body[4:4+nonceSize], body[4+nonceSize:4+nonceSize+tagSize], req[:off]); err != nil {
+				return res
+			}
+
+			res = append(res, ntpExtension(ntsUniqueID, uid)...)
+
+			nonce := make([]byte, ntsNonceSize)
+			rand.Read(nonce)
+
+			ciphertext := keys[1].Seal(nonce, ntpExtension(ntsCookie, cookie), res)
+
+			if tamper {
+				ciphertext[0] ^= 1
+			}
+
+			auth := make([]byte, 4)
+			binary.BigEndian.PutUint16(auth[0:], uint16(len(nonce)))
+			binary.BigEndian.PutUint16(auth[2:], uint16(len(ciphertext)))
+			auth = append(auth, nonce...)
+			auth = append(auth, ciphertext...)
+
+			return append(res, ntpExtension(ntsAuthenticator, auth)...)
+		}
+
+		off += size
+	}
+
+	return res
+}
+
+func newFakeNTS(t *testing.T, offset time.Duration) (f *fakeNTS, addr string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "NTS test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	cert, _ := x509.ParseCertificate(der)
+
+	ntsRoots = x509.NewCertPool()
+	ntsRoots.AddCert(cert)
+
+	f = &fakeNTS{keys: make(map[string][]*aesSIV)}
+	ntpAddr := newFakeNTP(t, offset, f.handle)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		MinVersion:   tls.VersionTLS13,
+		NextProtos:   []string{ntsALPN},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go f.keyExchange(conn.(*tls.Conn), ntpAddr)
+		}
+	}()
+
+	return f, l.Addr().String()
+}
+
+func TestNTPQuery(t *testing.T) {
+	addr := newFakeNTP(t, time.Hour, nil)
+	offset, delay, err := ntpQuery(addr.String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if offset < time.Hour-time.Second || offset > time.Hour+time.Second || delay < 0 {
+		t.Errorf("unexpected offset %v, delay %v", offset, delay)
+	}
+
+	// responses not matching the request are discarded
+	addr = newFakeNTP(t, 0, func(req []byte, res []byte) []byte {
+		res[24] ^= 1
+		return res
+	})
+
+	if _, _, err = ntpQuery(addr.String()); err == nil {
+		t.Error("unexpected NTP response accepted")
+	}
+}
+
+func TestNTSQuery(t *testing.T) {
+	defer func() { ntsRoots = nil }()
+
+	f, addr := newFakeNTS(t, -time.Hour)
+	offset, _, err := ntpQuery(ntsScheme + addr)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if offset > -time.Hour+time.Second || offset < -time.Hour-time.Second {
+		t.Errorf("unexpected offset %v", offset)
+	}
+
+	f.Lock()
+	f.tamper = true
+	f.Unlock()
+
+	if _, _, err = ntpQuery(ntsScheme + addr); err == nil || err.Error() != "AES-SIV authentication failed" {
+		t.Errorf("tampered NTS response accepted: %v", err)
+	}
+
+	// NTS servers are not trusted without certificate verification
+	ntsRoots = x509.NewCertPool()
+
+	if _, _, err = ntpQuery(ntsScheme + addr); err == nil {
+		t.Error("untrusted NTS-KE server accepted")
+	}
+}
+
+func TestNTPSync(t *testing.T) {
+	defer func() { conf.NTPServers = nil; ntp = ntpStatus{} }()
+
+	conf.NTPInterval = 3600
+	addr := newFakeNTP(t, 100*time.Millisecond, nil)
+	conf.NTPServers = []string{"nts://127.0.0.1:1", addr.String()}
+
+	if ntp.Synced() {
+		t.Fatal("unexpected synchronization state")
+	}
+
+	ntp.sync()
+
+	s := ntp.Status()
+
+	if !ntp.Synced() || s["server"] != addr.String() || s["error"] != "" || s["offset"].(float64) < 0.05 {
+		t.Errorf("unexpected NTP status: %v", s)
+	}
+}
@@ -10,6 +10,7 @@ package interlock
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -54,7 +55,7 @@ func Op(op string) (err error) {
 			return
 		}
 
-		err = unlock(arg, string(key))
+		err = unlock(context.Background(), arg, string(key))
 	case "lock":
 		err = lock()
 	case "derive":
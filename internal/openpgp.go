@@ -7,13 +7,18 @@
 package interlock
 
 import (
+	"bufio"
 	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/openpgp"
@@ -21,14 +26,26 @@ import (
 	"golang.org/x/crypto/openpgp/packet"
 )
 
+const armorHeader = "-----BEGIN PGP MESSAGE-----"
+
 type openPGP struct {
-	info   cipherInfo
-	pubKey *openpgp.Entity
-	secKey *openpgp.Entity
+	info    cipherInfo
+	options openPGPOptions
+	pubKey  *openpgp.Entity
+	secKey  *openpgp.Entity
 
 	cipherInterface
 }
 
+// openPGPOptions are the OpenPGP "cipher_options", the key size applies to
+// generated RSA keys, compression (zlib level 1-9, 0 disables) and armor to
+// encrypted files.
+type openPGPOptions struct {
+	KeySize     int  `json:"key_size"`
+	Armor       bool `json:"armor"`
+	Compression int  `json:"compression"`
+}
+
 func init() {
 	conf.SetAvailableCipher(new(openPGP).Init())
 }
@@ -50,7 +67,40 @@ func (o *openPGP) Init() cipherInterface {
 }
 
 func (o *openPGP) New() cipherInterface {
-	return new(openPGP).Init()
+	return (&openPGP{options: o.options}).Init()
+}
+
+func (o *openPGP) Configure(options json.RawMessage) (err error) {
+	opts := openPGPOptions{}
+
+	if err = parseCipherOptions(options, &opts); err != nil {
+		return
+	}
+
+	if opts.KeySize != 0 && (opts.KeySize < 2048 || opts.KeySize > 8192) {
+		return fmt.Errorf("invalid key size %d", opts.KeySize)
+	}
+
+	if opts.Compression < 0 || opts.Compression > 9 {
+		return fmt.Errorf("invalid compression level %d", opts.Compression)
+	}
+
+	o.options = opts
+
+	return
+}
+
+func (o *openPGP) config() (config *packet.Config) {
+	config = &packet.Config{
+		RSABits: o.options.KeySize,
+	}
+
+	if o.options.Compression > 0 {
+		config.DefaultCompressionAlgo = packet.CompressionZLIB
+		config.CompressionConfig = &packet.CompressionConfig{Level: o.options.Compression}
+	}
+
+	return
 }
 
 func (o *openPGP) Activate(activate bool) (err error) {
@@ -68,7 +118,7 @@ func (o *openPGP) GenKey(identifier string, email string) (pubKey string, secKey
 		"Version": fmt.Sprintf("INTERLOCK %s OpenPGP generated key", Revision),
 	}
 
-	entity, err := openpgp.NewEntity(identifier, "", email, nil)
+	entity, err := openpgp.NewEntity(identifier, "", email, o.config())
 
 	if err != nil {
 		return
@@ -110,6 +160,74 @@ func (o *openPGP) GenKey(identifier string, email string) (pubKey string, secKey
 	return
 }
 
+// GenRevocation generates a key revocation certificate for the armored secret
+// key, the certificate is armored as a public key block for import in other
+// OpenPGP implementations.
+func (o *openPGP) GenRevocation(secKey string) (rev string, err error) {
+	entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(secKey))
+
+	if err != nil {
+		return
+	}
+
+	if len(entities) != 1 || entities[0].PrivateKey == nil {
+		err = errors.New("invalid secret key")
+		return
+	}
+
+	entity := entities[0]
+
+	// the revocation hash covers the primary key packet body (RFC 4880,
+	// section 5.2.4), which is not directly serializable
+	prefix := bytes.NewBuffer(nil)
+	entity.PrimaryKey.SerializeSignaturePrefix(prefix)
+
+	body := bytes.NewBuffer(nil)
+
+	if err = entity.PrimaryKey.Serialize(body); err != nil {
+		return
+	}
+
+	length := int(prefix.Bytes()[1])<<8 | int(prefix.Bytes()[2])
+
+	h := sha256.New()
+	h.Write(prefix.Bytes())
+	h.Write(body.Bytes()[body.Len()-length:])
+
+	sig := &packet.Signature{
+		SigType:      packet.SigTypeKeyRevocation,
+		PubKeyAlgo:   entity.PrimaryKey.PubKeyAlgo,
+		Hash:         crypto.SHA256,
+		CreationTime: time.Now(),
+		IssuerKeyId:  &entity.PrimaryKey.KeyId,
+	}
+
+	if err = sig.Sign(h, entity.PrivateKey, nil); err != nil {
+		return
+	}
+
+	buf := bytes.NewBuffer(nil)
+	header := map[string]string{
+		"Version": fmt.Sprintf("INTERLOCK %s OpenPGP revocation certificate", Revision),
+		"Comment": fmt.Sprintf("revocation of key %X", entity.PrimaryKey.Fingerprint),
+	}
+
+	encoder, err := armor.Encode(buf, openpgp.PublicKeyType, header)
+
+	if err != nil {
+		return
+	}
+
+	if err = sig.Serialize(encoder); err != nil {
+		return
+	}
+
+	encoder.Close()
+	rev = buf.String()
+
+	return
+}
+
 func (o *openPGP) GetKeyInfo(k key) (info string, err error) {
 	err = o.SetKey(k)
 
@@ -173,9 +291,36 @@ func readEntityWithoutExpiredSubkeys(packets *packet.Reader) (entity *openpgp.En
 	return
 }
 
+// readPublicKey parses an armored OpenPGP public key file.
+func readPublicKey(path string) (entity *openpgp.Entity, err error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	return decodePublicKey(f)
+}
+
+// decodePublicKey parses an armored OpenPGP public key.
+func decodePublicKey(r io.Reader) (entity *openpgp.Entity, err error) {
+	block, err := armor.Decode(r)
+
+	if err != nil {
+		return
+	}
+
+	if block.Type != openpgp.PublicKeyType {
+		return nil, fmt.Errorf("key type error: %s", block.Type)
+	}
+
+	return readEntityWithoutExpiredSubkeys(packet.NewReader(block.Body))
+}
+
 func (o *openPGP) SetKey(k key) (err error) {
 	keyPath := filepath.Join(conf.MountPoint, k.Path)
-	keyFile, err := os.Open(keyPath)
+	keyFile, err := volumeJail().Open(keyPath)
 
 	if err != nil {
 		return
@@ -215,17 +360,44 @@ func (o *openPGP) SetKey(k key) (err error) {
 	return
 }
 
+// KeyEncrypted reports whether a stored secret key is password protected,
+// generated keys are stored without password.
+func (o *openPGP) KeyEncrypted(k key) (encrypted bool, err error) {
+	if err = o.SetKey(k); err != nil {
+		return
+	}
+
+	if o.secKey == nil || o.secKey.PrivateKey == nil {
+		return
+	}
+
+	return o.secKey.PrivateKey.Encrypted, nil
+}
+
 func (o *openPGP) Encrypt(input *os.File, output *os.File, _ bool) (err error) {
+	var w io.Writer = output
+
 	hints := &openpgp.FileHints{
 		IsBinary: true,
 		FileName: input.Name(),
 		ModTime:  time.Now(),
 	}
 
+	if o.options.Armor {
+		encoder, err := armor.Encode(output, "PGP MESSAGE", nil)
+
+		if err != nil {
+			return err
+		}
+		defer encoder.Close()
+
+		w = encoder
+	}
+
 	// signing is automatically detected if SetKey(secKey) is performed on
 	// the *openPGP instance
 
-	pgpOut, err := openpgp.Encrypt(output, []*openpgp.Entity{o.pubKey}, o.secKey, hints, nil)
+	pgpOut, err := openpgp.Encrypt(w, []*openpgp.Entity{o.pubKey}, o.secKey, hints, o.config())
 
 	if err != nil {
 		return
@@ -245,7 +417,21 @@ func (o *openPGP) Decrypt(input *os.File, output *os.File, verify bool) (err err
 		keyRing = append(keyRing, o.secKey)
 	}
 
-	messageDetails, err := openpgp.ReadMessage(input, keyRing, nil, nil)
+	// armored messages are detected regardless of the armor option
+	reader := bufio.NewReader(input)
+	var r io.Reader = reader
+
+	if header, _ := reader.Peek(len(armorHeader)); string(header) == armorHeader {
+		block, err := armor.Decode(reader)
+
+		if err != nil {
+			return err
+		}
+
+		r = block.Body
+	}
+
+	messageDetails, err := openpgp.ReadMessage(r, keyRing, nil, nil)
 
 	if err != nil {
 		return
@@ -264,6 +450,145 @@ func (o *openPGP) Decrypt(input *os.File, output *os.File, verify bool) (err err
 	return
 }
 
+// recordingReader keeps a copy of the data read from the underlying reader.
+type recordingReader struct {
+	r   io.Reader
+	buf bytes.Buffer
+}
+
+func (rr *recordingReader) Read(p []byte) (n int, err error) {
+	n, err = rr.r.Read(p)
+	rr.buf.Write(p[:n])
+
+	return
+}
+
+// encryptionKey selects the public key, of an entity, used for encryption
+// (see openpgp.Entity.encryptionKey).
+func encryptionKey(entity *openpgp.Entity) (pub *packet.PublicKey, err error) {
+	var maxTime time.Time
+	now := time.Now()
+
+	for _, subkey := range entity.Subkeys {
+		if subkey.Sig.FlagsValid &&
+			(subkey.Sig.FlagEncryptCommunications || subkey.Sig.FlagEncryptStorage) &&
+			subkey.PublicKey.PubKeyAlgo.CanEncrypt() &&
+			!subkey.Sig.KeyExpired(now) &&
+			(maxTime.IsZero() || subkey.Sig.CreationTime.After(maxTime)) {
+			pub = subkey.PublicKey
+			maxTime = subkey.Sig.CreationTime
+		}
+	}
+
+	if pub == nil && entity.PrimaryKey.PubKeyAlgo.CanEncrypt() {
+		pub = entity.PrimaryKey
+	}
+
+	if pub == nil {
+		err = errors.New("no encryption key available")
+	}
+
+	return
+}
+
+// Rewrap replaces the public key encrypted session keys of a message with
+// one for the public key, the session key is decrypted with the secret key
+// and the encrypted data packet is copied unchanged.
+func (o *openPGP) Rewrap(input *os.File, output *os.File) (err error) {
+	var w io.Writer = output
+	var sessionKey *packet.EncryptedKey
+
+	if o.secKey == nil || o.pubKey == nil {
+		return errors.New("rewrap requires secret and public keys")
+	}
+
+	pub, err := encryptionKey(o.pubKey)
+
+	if err != nil {
+		return
+	}
+
+	reader := bufio.NewReader(input)
+	rr := &recordingReader{r: reader}
+
+	if header, _ := reader.Peek(len(armorHeader)); string(header) == armorHeader {
+		block, err := armor.Decode(reader)
+
+		if err != nil {
+			return err
+		}
+
+		rr.r = block.Body
+	}
+
+	keyRing := openpgp.EntityList{o.secKey}
+
+	for {
+		// packets are parsed from the recording reader so that the
+		// header of the encrypted data packet can be copied verbatim
+		rr.buf.Reset()
+		p, err := packet.Read(rr)
+
+		if err != nil {
+			return err
+		}
+
+		switch pkt := p.(type) {
+		case *packet.EncryptedKey:
+			if sessionKey != nil {
+				continue
+			}
+
+			for _, k := range keyRing.KeysById(pkt.KeyId) {
+				if k.PrivateKey == nil || k.PrivateKey.Encrypted {
+					continue
+				}
+
+				if pkt.Decrypt(k.PrivateKey, nil) == nil {
+					sessionKey = pkt
+					break
+				}
+			}
+
+			continue
+		case *packet.SymmetricKeyEncrypted:
+			continue
+		case *packet.SymmetricallyEncrypted:
+		default:
+			return errors.New("invalid encrypted message")
+		}
+
+		break
+	}
+
+	if sessionKey == nil {
+		return errors.New("session key not decryptable with secret key")
+	}
+
+	if o.options.Armor {
+		encoder, err := armor.Encode(output, "PGP MESSAGE", nil)
+
+		if err != nil {
+			return err
+		}
+		defer encoder.Close()
+
+		w = encoder
+	}
+
+	if err = packet.SerializeEncryptedKey(w, pub, sessionKey.CipherFunc, sessionKey.Key, nil); err != nil {
+		return
+	}
+
+	if _, err = w.Write(rr.buf.Bytes()); err != nil {
+		return
+	}
+
+	_, err = io.Copy(w, rr.r)
+
+	return
+}
+
 func (o *openPGP) Sign(input *os.File, output *os.File) error {
 	return openpgp.ArmoredDetachSign(output, o.secKey, input, nil)
 }
@@ -8,6 +8,7 @@ package interlock
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -105,6 +106,40 @@ func TestOpenPGP(t *testing.T) {
 		t.Error("cleartext and ciphertext differ")
 	}
 
+	if err = o.Configure(json.RawMessage(`{"armor": true, "compression": 9}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	input.Seek(0, 0)
+	ciphertext.Truncate(0)
+	ciphertext.Seek(0, 0)
+
+	if err = o.Encrypt(input, ciphertext, true); err != nil {
+		t.Fatal(err)
+	}
+
+	ciphertext.Seek(0, 0)
+	decrypted.Truncate(0)
+	decrypted.Seek(0, 0)
+
+	if armored, _ := ioutil.ReadFile(ciphertext.Name()); !bytes.HasPrefix(armored, []byte(armorHeader)) {
+		t.Errorf("armor not applied: %q", armored)
+	}
+
+	if err = o.Decrypt(ciphertext, decrypted, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if compare, _ = ioutil.ReadFile(decrypted.Name()); !bytes.Equal([]byte(cleartext), compare) {
+		t.Error("cleartext and armored ciphertext differ")
+	}
+
+	if err = o.Configure(json.RawMessage(`{"key_size": 1024}`)); err == nil {
+		t.Error("invalid key size accepted")
+	}
+
+	o.Configure(nil)
+
 	input.Seek(0, 0)
 	err = o.Sign(input, signature)
 
@@ -140,3 +175,50 @@ func TestOpenPGP(t *testing.T) {
 	signature.Close()
 	os.Remove(signature.Name())
 }
+
+func TestOpenPGPRewrap(t *testing.T) {
+	c := newTestServer(t)
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	for _, id := range []string{"sender", "recipient"} {
+		c.mustCall("crypto/gen_key", jsonObject{"identifier": id, "key_format": "armor", "cipher": "OpenPGP", "email": "testonly@example.com"})
+		c.wait("/keys/pgp/private/" + id + ".armor")
+	}
+
+	c.upload("/shared.txt", testCleartext)
+
+	c.mustCall("file/encrypt", jsonObject{"src": "/shared.txt", "cipher": "OpenPGP", "wipe_src": true, "sign": false, "password": "", "key": "/keys/pgp/public/sender.armor", "sig_key": ""})
+	c.wait("/shared.txt.pgp")
+
+	c.mustCall("file/mkdir", jsonObject{"path": []string{"/handoff"}})
+	c.mustCall("file/rewrap", jsonObject{"src": "/shared.txt.pgp", "dst": "/handoff/shared.txt.pgp", "cipher": "OpenPGP", "password": "", "key": "/keys/pgp/private/sender.armor", "recipient": "/keys/pgp/public/recipient.armor"})
+	c.wait("/handoff/shared.txt.pgp")
+
+	src, _ := ioutil.ReadFile(path.Join(conf.MountPoint, "shared.txt.pgp"))
+	dst, _ := ioutil.ReadFile(path.Join(conf.MountPoint, "handoff/shared.txt.pgp"))
+
+	// the encrypted data is unchanged
+	if len(src) < 64 || !bytes.HasSuffix(dst, src[len(src)-64:]) {
+		t.Error("encrypted data modified by rewrap")
+	}
+
+	// the sender key no longer decrypts the message
+	c.mustCall("file/decrypt", jsonObject{"src": "/handoff/shared.txt.pgp", "cipher": "OpenPGP", "verify": false, "password": "", "key": "/keys/pgp/private/sender.armor", "sig_key": ""})
+	c.wait("/handoff/shared.txt.pgp")
+
+	// failed decryptions leave an empty output
+	if buf, _ := ioutil.ReadFile(path.Join(conf.MountPoint, "handoff/shared.txt")); len(buf) != 0 {
+		t.Fatal("rewrapped message decrypted with sender key")
+	}
+
+	os.Remove(path.Join(conf.MountPoint, "handoff/shared.txt"))
+
+	c.mustCall("file/decrypt", jsonObject{"src": "/handoff/shared.txt.pgp", "cipher": "OpenPGP", "verify": false, "password": "", "key": "/keys/pgp/private/recipient.armor", "sig_key": ""})
+	c.wait("/handoff/shared.txt")
+
+	if data := c.download("/handoff/shared.txt"); data != testCleartext {
+		t.Errorf("rewrapped data mismatch: %s", data)
+	}
+}
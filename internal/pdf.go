@@ -0,0 +1,181 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/syslog"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// Redaction-safe PDF export, documents are converted to PDF, flattened by
+// rasterizing every page (discarding text layers, annotations, form fields
+// and any content hidden below redaction boxes) and finally encrypted with
+// AES-256 for distribution to PDF-only recipients.
+//
+// The conversion is delegated to external tools, LibreOffice for non-PDF
+// documents, Ghostscript for rasterization and qpdf for encryption.
+
+const (
+	pdfOffice      = "/usr/bin/soffice"
+	pdfGhostscript = "/usr/bin/gs"
+	pdfQPDF        = "/usr/bin/qpdf"
+)
+
+type pdfInterface interface {
+	// Convert converts a document to PDF in dir, returning its path.
+	Convert(src string, dir string) (pdf string, err error)
+	// Flatten rasterizes all pages at the specified resolution (DPI).
+	Flatten(src string, dst string, resolution int) error
+	// Encrypt applies AES-256 encryption with the user password.
+	Encrypt(src string, dst string, password string) error
+	// Sanitize removes the document information and XMP metadata.
+	Sanitize(src string, dst string) error
+}
+
+var pdfTool pdfInterface = &externalPDF{}
+
+type externalPDF struct{}
+
+func (p *externalPDF) Convert(src string, dir string) (pdf string, err error) {
+	args := []string{"--headless", "--norestore", "--convert-to", "pdf", "--outdir", dir, src}
+	_, err = execCommand(pdfOffice, args, "")
+
+	if err != nil {
+		return
+	}
+
+	pdf = filepath.Join(dir, strings.TrimSuffix(filepath.Base(src), filepath.Ext(src))+".pdf")
+
+	return
+}
+
+func (p *externalPDF) Flatten(src string, dst string, resolution int) (err error) {
+	args := []string{"-q", "-dSAFER", "-dBATCH", "-dNOPAUSE", "-sDEVICE=pdfimage24", fmt.Sprintf("-r%d", resolution), "-o", dst, src}
+	_, err = execCommand(pdfGhostscript, args, "")
+
+	return
+}
+
+func (p *externalPDF) Encrypt(src string, dst string, password string) (err error) {
+	owner := make([]byte, 16)
+
+	if _, err = rand.Read(owner); err != nil {
+		return
+	}
+
+	// arguments are passed on stdin to keep the password off the command line
+	args := []string{"--encrypt", password, hex.EncodeToString(owner), "256", "--", src, dst}
+	_, err = execCommand(pdfQPDF, []string{"@-"}, strings.Join(args, "\n")+"\n")
+
+	return
+}
+
+func (p *externalPDF) Sanitize(src string, dst string) (err error) {
+	args := []string{"--remove-info", "--remove-metadata", src, dst}
+	_, err = execCommand(pdfQPDF, args, "")
+
+	return
+}
+
+// exportPDF converts, flattens and encrypts src to dst, intermediate files
+// are kept next to the destination so that they never leave the encrypted
+// volume.
+func exportPDF(src string, dst string, password string) (err error) {
+	if strings.Contains(password, "\n") {
+		return errors.New("invalid password")
+	}
+
+	if err = tools.Check("pdf"); err != nil {
+		return
+	}
+
+	tmp, err := volumeJail().MkdirTemp(filepath.Dir(dst), ".interlock-pdf-")
+
+	if err != nil {
+		return
+	}
+	defer volumeJail().RemoveAll(tmp)
+
+	pdf := src
+
+	if strings.ToLower(filepath.Ext(src)) != ".pdf" {
+		pdf, err = pdfTool.Convert(src, tmp)
+
+		if err != nil {
+			return
+		}
+	}
+
+	flattened := filepath.Join(tmp, "flattened.pdf")
+
+	if err = pdfTool.Flatten(pdf, flattened, conf.PDFResolution); err != nil {
+		return
+	}
+
+	return pdfTool.Encrypt(flattened, dst, password)
+}
+
+func filePDF(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	src, err := absolutePath(req["src"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	dst, err := absolutePath(req["dst"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	password := req["password"].(string)
+
+	if len(password) < 8 {
+		return errorResponse(errors.New("password < 8 characters"), "")
+	}
+
+	if filepath.Ext(dst) != ".pdf" {
+		return errorResponse(errors.New("destination must have .pdf extension"), "")
+	}
+
+	if _, err = volumeJail().Stat(dst); err == nil {
+		return errorResponse(errors.New("destination already exists"), "")
+	}
+
+	jobs.Go(jobOwner(r), "exporting PDF", func() {
+		n := status.Notify(syslog.LOG_INFO, "exporting %s to PDF", relativePath(src))
+		defer status.Remove(n)
+
+		err = exportPDF(src, dst, password)
+
+		if err != nil {
+			status.Error(err)
+			return
+		}
+
+		status.Log(syslog.LOG_NOTICE, "completed PDF export of %s to %s", relativePath(src), relativePath(dst))
+	})
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": nil,
+	}
+
+	return
+}
@@ -0,0 +1,87 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type mockPDF struct {
+	calls []string
+}
+
+func (p *mockPDF) Convert(src string, dir string) (pdf string, err error) {
+	p.calls = append(p.calls, "convert")
+	pdf = filepath.Join(dir, "converted.pdf")
+	err = ioutil.WriteFile(pdf, []byte("converted"), 0600)
+
+	return
+}
+
+func (p *mockPDF) Flatten(src string, dst string, resolution int) (err error) {
+	p.calls = append(p.calls, "flatten")
+	return ioutil.WriteFile(dst, []byte("flattened"), 0600)
+}
+
+func (p *mockPDF) Encrypt(src string, dst string, password string) (err error) {
+	p.calls = append(p.calls, "encrypt")
+	return ioutil.WriteFile(dst, []byte("encrypted:"+password), 0600)
+}
+
+func (p *mockPDF) Sanitize(src string, dst string) (err error) {
+	p.calls = append(p.calls, "sanitize")
+	return ioutil.WriteFile(dst, []byte("sanitized"), 0600)
+}
+
+func TestExportPDF(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "pdf_test-")
+	defer os.RemoveAll(dir)
+
+	conf.MountPoint = dir
+	defer conf.SetDefaults()
+
+	mock := &mockPDF{}
+	pdfTool = mock
+	defer func() { pdfTool = &externalPDF{} }()
+
+	for _, src := range []string{"document.odt", "document.pdf"} {
+		mock.calls = nil
+		dst := filepath.Join(dir, "export-"+src+".pdf")
+
+		if err := exportPDF(filepath.Join(dir, src), dst, "interlocktest"); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := 3
+
+		if filepath.Ext(src) == ".pdf" {
+			expected = 2
+		}
+
+		if len(mock.calls) != expected || mock.calls[len(mock.calls)-1] != "encrypt" {
+			t.Errorf("%s: unexpected pipeline %v", src, mock.calls)
+		}
+
+		if out, _ := ioutil.ReadFile(dst); string(out) != "encrypted:interlocktest" {
+			t.Errorf("%s: unexpected output %q", src, out)
+		}
+	}
+
+	// intermediate files must be removed
+	entries, _ := ioutil.ReadDir(dir)
+
+	if len(entries) != 2 {
+		t.Errorf("unexpected intermediate files (%d entries)", len(entries))
+	}
+
+	if err := exportPDF(filepath.Join(dir, "document.pdf"), filepath.Join(dir, "x.pdf"), "inter\nlock"); err == nil {
+		t.Error("invalid password accepted")
+	}
+}
@@ -0,0 +1,260 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/syslog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Smartcard (PIV) login, holders of a certificate issued by the configured
+// certificate authority open a session on the unlocked volume either by
+// signing a server nonce with their PIV key or by presenting the certificate
+// for TLS client authentication. Certificates are mapped to roles, by subject
+// common name or SHA256 fingerprint ("sha256:<hex>"), and PIV sessions are
+// restricted by the ACLs of their user (common name) and role.
+
+const pivNonceSize = 32
+const pivNonceValidity = 60 * time.Second
+
+type pivChallengeStore struct {
+	sync.Mutex
+	nonces map[string]time.Time
+}
+
+var pivChallenges = pivChallengeStore{
+	nonces: make(map[string]time.Time),
+}
+
+func (c *pivChallengeStore) New() (nonce string, err error) {
+	if nonce, err = randomString(pivNonceSize); err != nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+
+	for n, expiry := range c.nonces {
+		if now.After(expiry) {
+			delete(c.nonces, n)
+		}
+	}
+
+	c.nonces[nonce] = now.Add(pivNonceValidity)
+
+	return
+}
+
+// Consume invalidates a nonce, returning whether it was valid.
+func (c *pivChallengeStore) Consume(nonce string) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	expiry, ok := c.nonces[nonce]
+	delete(c.nonces, nonce)
+
+	return ok && time.Now().Before(expiry)
+}
+
+func pivRoots() (pool *x509.CertPool, err error) {
+	if conf.PIVCA == "" {
+		return nil, errors.New("PIV login not configured")
+	}
+
+	ca, err := ioutil.ReadFile(conf.PIVCA)
+
+	if err != nil {
+		return
+	}
+
+	pool = x509.NewCertPool()
+
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("could not parse PIV certificate authority")
+	}
+
+	return
+}
+
+// pivRole verifies the certificate chain and returns its mapped role.
+func pivRole(cert *x509.Certificate, intermediates []*x509.Certificate) (role string, err error) {
+	roots, err := pivRoots()
+
+	if err != nil {
+		return
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+
+	for _, c := range intermediates {
+		opts.Intermediates.AddCert(c)
+	}
+
+	if _, err = cert.Verify(opts); err != nil {
+		return
+	}
+
+	fingerprint := sha256.Sum256(cert.Raw)
+	role, ok := conf.PIVRoles["sha256:"+hex.EncodeToString(fingerprint[:])]
+
+	if !ok {
+		role, ok = conf.PIVRoles[cert.Subject.CommonName]
+	}
+
+	if !ok || role == "" {
+		return "", fmt.Errorf("no role mapped to certificate %q", cert.Subject.CommonName)
+	}
+
+	return
+}
+
+// pivVerify checks a nonce signature, PIV keys sign the SHA256 digest of the
+// nonce with ECDSA (ASN.1) or RSA PKCS#1 v1.5.
+func pivVerify(cert *x509.Certificate, nonce string, signature []byte) (err error) {
+	digest := sha256.Sum256([]byte(nonce))
+
+	switch pub := cert.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest[:], signature) {
+			err = errors.New("invalid signature")
+		}
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature)
+	default:
+		err = errors.New("unsupported certificate key")
+	}
+
+	return
+}
+
+func pivChallenge() (res jsonObject) {
+	if conf.PIVCA == "" {
+		return errorResponse(errors.New("PIV login not configured"), "")
+	}
+
+	nonce, err := pivChallenges.New()
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	res = jsonObject{
+		"status": "OK",
+		"response": map[string]interface{}{
+			"nonce": nonce,
+		},
+	}
+
+	return
+}
+
+func pivLogin(w http.ResponseWriter, r *http.Request) (res jsonObject) {
+	var cert *x509.Certificate
+	var intermediates []*x509.Certificate
+
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if err = acknowledgeBanner(req, r.RemoteAddr); err != nil {
+		return errorResponse(err, "")
+	}
+
+	if !session.Active() {
+		return errorResponse(errors.New("volume not available"), "INVALID_SESSION")
+	}
+
+	if certificate, ok := req["certificate"].(string); ok && certificate != "" {
+		// nonce signature
+		err = requireAttributes(req, "nonce", "signature")
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+
+		block, _ := pem.Decode([]byte(certificate))
+
+		if block == nil {
+			return errorResponse(errors.New("invalid certificate"), "")
+		}
+
+		if cert, err = x509.ParseCertificate(block.Bytes); err != nil {
+			return errorResponse(err, "")
+		}
+
+		nonce := req["nonce"].(string)
+
+		if !pivChallenges.Consume(nonce) {
+			return errorResponse(errors.New("invalid or expired nonce"), "INVALID_SESSION")
+		}
+
+		signature, err := base64.StdEncoding.DecodeString(req["signature"].(string))
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+
+		if err = pivVerify(cert, nonce, signature); err != nil {
+			status.Log(syslog.LOG_WARNING, "PIV login failed for %q: %v", cert.Subject.CommonName, err)
+			return errorResponse(err, "INVALID_SESSION")
+		}
+	} else if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		// TLS client authentication
+		cert = r.TLS.PeerCertificates[0]
+		intermediates = r.TLS.PeerCertificates[1:]
+	} else {
+		return errorResponse(errors.New("missing PIV certificate"), "INVALID_SESSION")
+	}
+
+	role, err := pivRole(cert, intermediates)
+
+	if err != nil {
+		status.Log(syslog.LOG_WARNING, "PIV login failed for %q: %v", cert.Subject.CommonName, err)
+		return errorResponse(err, "INVALID_SESSION")
+	}
+
+	g, err := guests.Open(cert.Subject.CommonName, role, cookieAge*time.Second, clientAddress(r))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	http.SetCookie(w, sessionCookie(g.sessionID, cookieAge))
+
+	res = jsonObject{
+		"status": "OK",
+		"response": map[string]interface{}{
+			"user":      g.Username,
+			"role":      g.Role,
+			"ops":       g.Ops,
+			"expiry":    g.Expiry,
+			"XSRFToken": g.xsrfToken},
+	}
+
+	return
+}
@@ -0,0 +1,210 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+)
+
+// Bounded worker pool for file and crypto operations, long running bulk jobs
+// (encryption, archives, exports) are queued and executed by `workers`
+// goroutines while interactive requests (file listing and downloads) take
+// precedence over them. One worker is reserved to interactive requests, so
+// that bulk jobs never starve browsing.
+//
+// Jobs are queued per owner (session or guest) and dequeued round-robin
+// across owners, a session submitting many jobs does not delay the others.
+
+const (
+	jobInteractive = iota
+	jobBulk
+)
+
+type poolJob struct {
+	name string
+	fn   func()
+	done chan bool
+}
+
+type jobQueue struct {
+	owners  []string
+	pending map[string][]*poolJob
+}
+
+func (q *jobQueue) push(owner string, job *poolJob) {
+	if q.pending == nil {
+		q.pending = make(map[string][]*poolJob)
+	}
+
+	if len(q.pending[owner]) == 0 {
+		q.owners = append(q.owners, owner)
+	}
+
+	q.pending[owner] = append(q.pending[owner], job)
+}
+
+// pop dequeues the next job of the least recently served owner.
+func (q *jobQueue) pop() (job *poolJob) {
+	if len(q.owners) == 0 {
+		return
+	}
+
+	owner := q.owners[0]
+	q.owners = q.owners[1:]
+
+	job = q.pending[owner][0]
+	q.pending[owner] = q.pending[owner][1:]
+
+	if len(q.pending[owner]) > 0 {
+		q.owners = append(q.owners, owner)
+	} else {
+		delete(q.pending, owner)
+	}
+
+	return
+}
+
+func (q *jobQueue) len() (n int) {
+	for _, jobs := range q.pending {
+		n += len(jobs)
+	}
+
+	return
+}
+
+type workerPool struct {
+	sync.Mutex
+	cond    *sync.Cond
+	once    sync.Once
+	workers int
+	running [2]int
+	queues  [2]jobQueue
+}
+
+var jobs workerPool
+
+func (p *workerPool) start() {
+	p.once.Do(func() {
+		p.cond = sync.NewCond(&p.Mutex)
+		p.workers = conf.Workers
+
+		if p.workers < 2 {
+			p.workers = 2
+		}
+
+		for i := 0; i < p.workers; i++ {
+			go p.worker()
+		}
+	})
+}
+
+// next blocks until a job can be executed, it must be called with the pool
+// locked.
+func (p *workerPool) next() (job *poolJob, priority int) {
+	for {
+		if job = p.queues[jobInteractive].pop(); job != nil {
+			return job, jobInteractive
+		}
+
+		// bulk jobs wait for a worker and their memory budget
+		if p.running[jobBulk] < p.workers-1 && p.queues[jobBulk].len() > 0 && memory.TryReserve(jobMemory) {
+			return p.queues[jobBulk].pop(), jobBulk
+		}
+
+		p.cond.Wait()
+	}
+}
+
+func (p *workerPool) worker() {
+	for {
+		p.Lock()
+		job, priority := p.next()
+		p.running[priority]++
+		p.Unlock()
+
+		p.run(job)
+
+		if priority == jobBulk {
+			memory.Release(jobMemory)
+		}
+
+		p.Lock()
+		p.running[priority]--
+		p.cond.Broadcast()
+		p.Unlock()
+	}
+}
+
+func (p *workerPool) run(job *poolJob) {
+	defer close(job.done)
+	defer recoverJob(job.name)
+
+	job.fn()
+}
+
+// wake signals workers waiting for resources.
+func (p *workerPool) wake() {
+	p.start()
+
+	p.Lock()
+	p.cond.Broadcast()
+	p.Unlock()
+}
+
+func (p *workerPool) submit(owner string, priority int, name string, fn func()) (done chan bool) {
+	p.start()
+
+	job := &poolJob{
+		name: name,
+		fn:   fn,
+		done: make(chan bool),
+	}
+
+	p.Lock()
+	p.queues[priority].push(owner, job)
+	p.cond.Broadcast()
+	p.Unlock()
+
+	return job.done
+}
+
+// Go queues a bulk job, the name describes the job in error reports.
+func (p *workerPool) Go(owner string, name string, fn func()) {
+	p.submit(owner, jobBulk, name, fn)
+}
+
+// Do executes an interactive job and waits for its completion.
+func (p *workerPool) Do(owner string, name string, fn func()) {
+	<-p.submit(owner, jobInteractive, name, fn)
+}
+
+func (p *workerPool) Status() map[string]interface{} {
+	p.start()
+
+	p.Lock()
+	defer p.Unlock()
+
+	return map[string]interface{}{
+		"workers": p.workers,
+		"running": p.running[jobInteractive] + p.running[jobBulk],
+		"queued":  p.queues[jobInteractive].len() + p.queues[jobBulk].len(),
+	}
+}
+
+// jobOwner identifies the session, or guest, submitting a job without
+// retaining its credentials.
+func jobOwner(r *http.Request) string {
+	if cookie, err := r.Cookie(conf.CookieName); err == nil {
+		sum := sha256.Sum256([]byte(cookie.Value))
+		return hex.EncodeToString(sum[0:8])
+	}
+
+	return clientAddress(r)
+}
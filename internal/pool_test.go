@@ -0,0 +1,84 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkerPool(t *testing.T) {
+	conf.SetDefaults()
+
+	p := &workerPool{}
+
+	var mutex sync.Mutex
+	var order []string
+
+	started := make(chan string, 10)
+	release := make(chan bool)
+
+	bulk := func(name string) func() {
+		return func() {
+			mutex.Lock()
+			order = append(order, name)
+			mutex.Unlock()
+
+			started <- name
+			<-release
+		}
+	}
+
+	// a session queueing several bulk jobs ahead of another one
+	p.Go("a", "test", bulk("a1"))
+
+	if name := <-started; name != "a1" {
+		t.Fatalf("unexpected job %s", name)
+	}
+
+	p.Go("a", "test", bulk("a2"))
+	p.Go("a", "test", bulk("a3"))
+	p.Go("b", "test", bulk("b1"))
+
+	// one worker is reserved to interactive jobs
+	select {
+	case name := <-started:
+		t.Fatalf("bulk job %s exceeded the reserved worker", name)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	done := make(chan bool)
+
+	go func() {
+		p.Do("b", "test", func() {})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("interactive job starved by bulk jobs")
+	}
+
+	if s := p.Status(); s["queued"] != 3 || s["running"] != 1 {
+		t.Errorf("unexpected status %v", s)
+	}
+
+	for i := 0; i < 3; i++ {
+		release <- true
+		<-started
+	}
+
+	release <- true
+
+	// owners are served round-robin
+	if !reflect.DeepEqual(order, []string{"a1", "a2", "b1", "a3"}) {
+		t.Errorf("unfair job order %v", order)
+	}
+}
@@ -0,0 +1,157 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"errors"
+	"io/ioutil"
+	"log/syslog"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Power monitoring, a sysfs power supply (battery or UPS) and/or a GPIO power
+// failure signal are polled to warn about low power and to cleanly shutdown,
+// blocking new writes and unmounting the encrypted volume, before power loss.
+
+type powerStatus struct {
+	sync.Mutex
+	capacity     int
+	supply       string
+	gpio         bool
+	warning      bool
+	failing      bool
+	notification int
+}
+
+var power = powerStatus{capacity: -1}
+
+var errPowerFailure = errors.New("power failure, write operations are disabled")
+
+func startPowerMonitor() {
+	if conf.PowerSupply == "" && conf.PowerGPIO == "" {
+		return
+	}
+
+	go func() {
+		defer recoverJob("power monitor")
+
+		for {
+			if power.check() {
+				powerShutdown()
+				return
+			}
+
+			time.Sleep(time.Duration(conf.PowerInterval) * time.Second)
+		}
+	}()
+}
+
+func readSysfs(path string) (string, error) {
+	buf, err := ioutil.ReadFile(path)
+	return strings.TrimSpace(string(buf)), err
+}
+
+// check polls the configured sources, returns true when shutdown is required.
+func (p *powerStatus) check() (shutdown bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	discharging := false
+
+	if conf.PowerSupply != "" {
+		if s, err := readSysfs(filepath.Join(conf.PowerSupply, "status")); err == nil {
+			p.supply = s
+			discharging = s == "Discharging"
+		}
+
+		if c, err := readSysfs(filepath.Join(conf.PowerSupply, "capacity")); err == nil {
+			p.capacity, _ = strconv.Atoi(c)
+		} else {
+			status.Error(err)
+		}
+	}
+
+	if conf.PowerGPIO != "" {
+		if v, err := readSysfs(conf.PowerGPIO); err == nil {
+			p.gpio = (v == "1") != conf.PowerGPIOActiveLow
+		} else {
+			status.Error(err)
+		}
+	}
+
+	warning := p.gpio || (discharging && p.capacity >= 0 && p.capacity <= conf.PowerWarning)
+	shutdown = discharging && p.capacity >= 0 && p.capacity <= conf.PowerShutdown
+
+	if p.gpio && conf.PowerGPIOShutdown {
+		shutdown = true
+	}
+
+	if warning && !p.warning {
+		p.notification = status.Notify(syslog.LOG_WARNING, "low power (capacity: %d%%, status: %s), connect power source", p.capacity, p.supply)
+	}
+
+	if !warning && p.warning {
+		status.Remove(p.notification)
+		status.Log(syslog.LOG_NOTICE, "power restored")
+	}
+
+	p.warning = warning
+	p.failing = shutdown
+
+	return
+}
+
+func (p *powerStatus) Status() map[string]interface{} {
+	p.Lock()
+	defer p.Unlock()
+
+	return map[string]interface{}{
+		"capacity": p.capacity,
+		"status":   p.supply,
+		"gpio":     p.gpio,
+		"warning":  p.warning,
+		"failing":  p.failing,
+	}
+}
+
+func (p *powerStatus) Failing() bool {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.failing
+}
+
+// powerShutdown closes the session, flushes and unmounts the encrypted volume
+// and powers off the device.
+func powerShutdown() {
+	status.Log(syslog.LOG_CRIT, "power loss imminent, shutting down")
+
+	systemd.Notify("STOPPING=1", "STATUS=power loss, shutting down")
+	session.Clear()
+
+	if !conf.Debug {
+		EnableSyslog()
+	}
+
+	conf.ActivateCiphers(false)
+	syscall.Sync()
+
+	if err := umount(); err != nil {
+		status.Error(err)
+	}
+
+	if err := lock(); err != nil {
+		status.Error(err)
+	}
+
+	poweroff()
+}
@@ -0,0 +1,348 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/syslog"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	// decoding of GIF thumbnails
+	_ "image/gif"
+)
+
+// Signed preview URLs, images can be embedded in the static UI (e.g. <img>
+// tags) through short-lived URLs signed with a per-session key, requests
+// carry the session cookie but no XSRF token, which therefore never appears
+// in query strings. Signatures are bound to the requesting session, the path,
+// the optional thumbnail size and the expiration time (`preview_ttl`).
+//
+// Only raster image types are served, inline and sandboxed, thumbnails are
+// scaled down to fit the requested size.
+
+const (
+	previewMinSize   = 16
+	previewMaxSize   = 1024
+	previewMaxPixels = 16 * 1024 * 1024
+)
+
+// previewTypes lists the content types served inline, SVG is excluded as it
+// can carry scripts.
+var previewTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+	"image/bmp":  true,
+}
+
+type previewSigner struct {
+	sync.Mutex
+	key []byte
+}
+
+var previews previewSigner
+
+func (p *previewSigner) mac(owner string, osPath string, size int, expires int64) (sig []byte, err error) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.key == nil {
+		p.key = make([]byte, 32)
+
+		if _, err = rand.Read(p.key); err != nil {
+			p.key = nil
+			return
+		}
+	}
+
+	h := hmac.New(sha256.New, p.key)
+	fmt.Fprintf(h, "%s\x00%s\x00%d\x00%d", owner, relativePath(osPath), size, expires)
+
+	return h.Sum(nil), nil
+}
+
+// Sign returns a preview URL for the argument path, valid for the requesting
+// session only.
+func (p *previewSigner) Sign(r *http.Request, osPath string, size int) (u string, expires int64, err error) {
+	expires = time.Now().Add(time.Duration(conf.PreviewTTL) * time.Second).Unix()
+	sig, err := p.mac(jobOwner(r), osPath, size, expires)
+
+	if err != nil {
+		return
+	}
+
+	q := url.Values{}
+	q.Set("path", relativePath(osPath))
+	q.Set("expires", strconv.FormatInt(expires, 10))
+	q.Set("sig", base64.RawURLEncoding.EncodeToString(sig))
+
+	if size > 0 {
+		q.Set("size", strconv.Itoa(size))
+	}
+
+	return "/api/file/preview?" + q.Encode(), expires, nil
+}
+
+// Verify validates a preview URL query, returning the previewed path and
+// thumbnail size.
+func (p *previewSigner) Verify(r *http.Request, q url.Values) (osPath string, size int, err error) {
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+
+	if err != nil {
+		return "", 0, errors.New("invalid preview expiration")
+	}
+
+	if s := q.Get("size"); s != "" {
+		if size, err = strconv.Atoi(s); err != nil {
+			return "", 0, errors.New("invalid preview size")
+		}
+	}
+
+	if time.Now().Unix() > expires {
+		return "", 0, errors.New("preview URL expired")
+	}
+
+	if osPath, err = absolutePath(q.Get("path")); err != nil {
+		return
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(q.Get("sig"))
+
+	if err != nil {
+		return "", 0, errors.New("invalid preview signature")
+	}
+
+	expected, err := p.mac(jobOwner(r), osPath, size, expires)
+
+	if err != nil {
+		return
+	}
+
+	if !secretEqualBytes(sig, expected) {
+		return "", 0, errors.New("invalid preview signature")
+	}
+
+	return
+}
+
+// Reset invalidates all preview URLs.
+func (p *previewSigner) Reset() {
+	p.Lock()
+	defer p.Unlock()
+
+	p.key = nil
+}
+
+func previewType(osPath string) (contentType string, err error) {
+	contentType = mime.TypeByExtension(strings.ToLower(filepath.Ext(osPath)))
+
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = contentType[:i]
+	}
+
+	if !previewTypes[contentType] {
+		return "", fmt.Errorf("preview not supported for %s", filepath.Base(osPath))
+	}
+
+	return
+}
+
+func filePreview(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	osPath, err := absolutePath(req["path"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if _, err = previewType(osPath); err != nil {
+		return errorResponse(err, "")
+	}
+
+	size := 0
+
+	if n, ok := req["size"].(json.Number); ok {
+		s, _ := n.Int64()
+		size = int(s)
+	}
+
+	u, expires, err := previews.Sign(r, osPath, size)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	res = jsonObject{
+		"status": "OK",
+		"response": map[string]interface{}{
+			"url":    u,
+			"expiry": expires,
+		},
+	}
+
+	return
+}
+
+func filePreviewByURL(w http.ResponseWriter, r *http.Request, q url.Values) {
+	var err error
+
+	defer func() {
+		if err != nil {
+			status.Log(syslog.LOG_WARNING, "rejected preview from %s: %v", r.RemoteAddr, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}()
+
+	osPath, size, err := previews.Verify(r, q)
+
+	if err != nil {
+		return
+	}
+
+	contentType, err := previewType(osPath)
+
+	if err != nil {
+		return
+	}
+
+	input, err := openStored(osPath)
+
+	if err != nil {
+		return
+	}
+	defer input.Close()
+
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", "inline")
+	w.Header().Set("Cache-Control", "private, no-store")
+
+	if size == 0 {
+		w.Header().Set("Content-Type", contentType)
+		_, err = sendStored(w, input)
+		return
+	}
+
+	var buf bytes.Buffer
+
+	if contentType, err = thumbnail(&buf, input, size); err != nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+
+	_, err = buf.WriteTo(w)
+}
+
+// thumbnail scales down an image to fit within size x size pixels, averaging
+// the source pixels covered by each destination one.
+func thumbnail(w io.Writer, input io.Reader, size int) (contentType string, err error) {
+	if size < previewMinSize || size > previewMaxSize {
+		return "", fmt.Errorf("thumbnail size must be between %d and %d", previewMinSize, previewMaxSize)
+	}
+
+	var header bytes.Buffer
+
+	config, format, err := image.DecodeConfig(io.TeeReader(input, &header))
+
+	if err != nil {
+		return
+	}
+
+	if config.Width*config.Height > previewMaxPixels {
+		return "", errors.New("image too large for thumbnail")
+	}
+
+	src, _, err := image.Decode(io.MultiReader(&header, input))
+
+	if err != nil {
+		return
+	}
+
+	b := src.Bounds()
+	dw, dh := b.Dx(), b.Dy()
+
+	if dw > size || dh > size {
+		if dw >= dh {
+			dw, dh = size, dh*size/dw
+		} else {
+			dw, dh = dw*size/dh, size
+		}
+	}
+
+	if dw == 0 {
+		dw = 1
+	}
+
+	if dh == 0 {
+		dh = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < dh; y++ {
+		y0 := b.Min.Y + y*b.Dy()/dh
+		y1 := b.Min.Y + (y+1)*b.Dy()/dh
+
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+
+		for x := 0; x < dw; x++ {
+			x0 := b.Min.X + x*b.Dx()/dw
+			x1 := b.Min.X + (x+1)*b.Dx()/dw
+
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, bl, a, n uint64
+
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+
+			dst.SetRGBA(x, y, color.RGBA{uint8((r / n) >> 8), uint8((g / n) >> 8), uint8((bl / n) >> 8), uint8((a / n) >> 8)})
+		}
+	}
+
+	if format == "jpeg" {
+		return "image/jpeg", jpeg.Encode(w, dst, &jpeg.Options{Quality: 85})
+	}
+
+	return "image/png", png.Encode(w, dst)
+}
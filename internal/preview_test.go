@@ -0,0 +1,120 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/cookiejar"
+	"strings"
+	"testing"
+)
+
+// fetch retrieves a signed URL without XSRF token, as done by <img> tags.
+func (c *apiClient) fetch(u string) (r *http.Response) {
+	XSRFToken := c.XSRFToken
+	c.XSRFToken = ""
+
+	r = c.request("GET", u, nil, nil)
+
+	c.XSRFToken = XSRFToken
+
+	return
+}
+
+func TestPreview(t *testing.T) {
+	c := newTestServer(t)
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	img := image.NewRGBA(image.Rect(0, 0, 64, 32))
+
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 32; y++ {
+			img.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 8), 0, 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+
+	c.upload("/image.png", buf.String())
+	c.upload("/page.html", "<script>alert(1)</script>")
+
+	if res := c.call("file/preview", jsonObject{"path": "/page.html"}); res["status"] != "KO" {
+		t.Error("preview of non-image accepted")
+	}
+
+	res := c.mustCall("file/preview", jsonObject{"path": "/image.png", "size": 16})
+	u := res["response"].(map[string]interface{})["url"].(string)
+
+	if strings.Contains(u, c.XSRFToken) {
+		t.Fatal("XSRF token exposed in preview URL")
+	}
+
+	r := c.fetch(u)
+	thumb, err := png.Decode(r.Body)
+	r.Body.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Header.Get("Content-Type") != "image/png" || r.Header.Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("unexpected headers %v", r.Header)
+	}
+
+	if b := thumb.Bounds(); b.Dx() != 16 || b.Dy() != 8 {
+		t.Errorf("unexpected thumbnail size %v", b)
+	}
+
+	// tampered URLs
+	for _, tampered := range []string{
+		strings.Replace(u, "size=16", "size=32", 1),
+		strings.Replace(u, "image.png", "page.html", 1),
+	} {
+		if r := c.fetch(tampered); r.StatusCode == http.StatusOK {
+			t.Errorf("tampered preview URL accepted: %s", tampered)
+		}
+	}
+
+	// expired URLs
+	conf.PreviewTTL = -1
+	expired := c.mustCall("file/preview", jsonObject{"path": "/image.png"})["response"].(map[string]interface{})["url"].(string)
+	conf.PreviewTTL = 300
+
+	if r := c.fetch(expired); r.StatusCode == http.StatusOK {
+		t.Error("expired preview URL accepted")
+	}
+
+	// other sessions
+	res = c.mustCall("guest/create", jsonObject{"path": "/", "ops": []string{"download"}, "duration": 60})
+	credentials := res["response"].(map[string]interface{})
+
+	jar, _ := cookiejar.New(nil)
+	g := &apiClient{t: t, srv: c.srv, client: &http.Client{Jar: jar}}
+
+	res = g.mustCall("auth/guest", jsonObject{"username": credentials["username"], "password": credentials["password"]})
+	g.XSRFToken = res["response"].(map[string]interface{})["XSRFToken"].(string)
+
+	if r := g.fetch(u); r.StatusCode == http.StatusOK {
+		t.Error("preview URL accepted from a different session")
+	}
+
+	u = g.mustCall("file/preview", jsonObject{"path": "/image.png"})["response"].(map[string]interface{})["url"].(string)
+	r = g.fetch(u)
+
+	if data, err := png.Decode(r.Body); err != nil || data.Bounds().Dx() != 64 {
+		t.Errorf("guest preview failed: %v", err)
+	}
+
+	r.Body.Close()
+}
@@ -0,0 +1,372 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// +build linux
+
+package interlock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Privilege separation, with `privsep_socket` set the commands requiring
+// administrative privileges are not executed with sudo but submitted to a
+// privileged helper (`interlock -p`), running as root, over a Unix socket
+// restricted to `privsep_user`.
+//
+// The helper only executes the operations required by INTERLOCK (LUKS,
+// mount, date, poweroff and USB networking) and validates their arguments
+// against its own copy of the configuration, so that a compromise of the
+// request handling code cannot run arbitrary commands as root. Requests are
+// interrupted when the front-end closes the connection.
+
+const privsepMaxRequest = 1 << 20
+
+var epochPattern = regexp.MustCompile(`^@-?[0-9]+$`)
+
+type privsepRequest struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+	Input   string   `json:"input"`
+}
+
+type privsepResponse struct {
+	Output string `json:"output"`
+	Error  string `json:"error"`
+}
+
+type privsepHelper struct {
+	uid        int
+	user       string
+	mountPoint string
+}
+
+// peerUID returns the user ID of the process on the other end of a Unix
+// socket connection.
+func peerUID(conn *net.UnixConn) (uid int, err error) {
+	var cred *syscall.Ucred
+
+	raw, err := conn.SyscallConn()
+
+	if err != nil {
+		return
+	}
+
+	ctrlErr := raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+
+	if ctrlErr != nil {
+		return -1, ctrlErr
+	}
+
+	if err != nil {
+		return -1, err
+	}
+
+	return int(cred.Uid), nil
+}
+
+// privsepCall submits a command to the privileged helper.
+func privsepCall(ctx context.Context, cmd string, args []string, input string) (output string, err error) {
+	var d net.Dialer
+	var res privsepResponse
+
+	name := filepath.Base(cmd)
+	c, err := d.DialContext(ctx, "unix", conf.PrivsepSocket)
+
+	if err != nil {
+		return "", fmt.Errorf("privileged helper unavailable, %v", err)
+	}
+
+	conn := c.(*net.UnixConn)
+	defer conn.Close()
+
+	// passphrases are only disclosed to a helper running as root
+	if uid, err := peerUID(conn); err != nil || uid != 0 {
+		return "", errors.New("privileged helper not running as root")
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if err = json.NewEncoder(conn).Encode(&privsepRequest{Command: cmd, Args: args, Input: input}); err == nil {
+		err = json.NewDecoder(conn).Decode(&res)
+	}
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", contextError(name, ctx)
+		}
+
+		return "", fmt.Errorf("privileged helper error, %v", err)
+	}
+
+	if res.Error != "" {
+		err = errors.New(res.Error)
+	}
+
+	return res.Output, err
+}
+
+// ServePrivileged runs the privileged helper, it does not return unless an
+// error occurs.
+func ServePrivileged() (err error) {
+	if os.Geteuid() != 0 {
+		return errors.New("the privileged helper requires administrative privileges")
+	}
+
+	if conf.PrivsepSocket == "" || conf.PrivsepUser == "" {
+		return errors.New("privsep_socket and privsep_user must be configured")
+	}
+
+	u, err := user.Lookup(conf.PrivsepUser)
+
+	if err != nil {
+		return
+	}
+
+	uid, err := strconv.Atoi(u.Uid)
+
+	if err != nil {
+		return
+	}
+
+	if uid == 0 {
+		return errors.New("privsep_user must not be an administrative user")
+	}
+
+	p := &privsepHelper{
+		uid:        uid,
+		user:       u.Username,
+		mountPoint: tenantMountPoint(u.HomeDir),
+	}
+
+	os.Remove(conf.PrivsepSocket)
+
+	// the socket is created without permissions for others
+	umask := syscall.Umask(0177)
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: conf.PrivsepSocket, Net: "unix"})
+	syscall.Umask(umask)
+
+	if err != nil {
+		return
+	}
+	defer l.Close()
+
+	if err = os.Chown(conf.PrivsepSocket, uid, -1); err != nil {
+		return
+	}
+
+	log.Printf("privileged helper listening on %s for user %s", conf.PrivsepSocket, p.user)
+
+	for {
+		conn, err := l.AcceptUnix()
+
+		if err != nil {
+			return err
+		}
+
+		go p.handle(conn)
+	}
+}
+
+func (p *privsepHelper) handle(conn *net.UnixConn) {
+	var req privsepRequest
+	var res privsepResponse
+
+	defer conn.Close()
+
+	if uid, err := peerUID(conn); err != nil || uid != p.uid {
+		log.Printf("privileged helper: rejected connection from uid %d (%v)", uid, err)
+		return
+	}
+
+	if err := json.NewDecoder(io.LimitReader(conn, privsepMaxRequest)).Decode(&req); err != nil {
+		log.Printf("privileged helper: invalid request, %v", err)
+		return
+	}
+
+	if !p.allowed(req.Command, req.Args) {
+		log.Printf("privileged helper: rejected %s %v", req.Command, req.Args)
+		res.Error = fmt.Sprintf("command %s not allowed", req.Command)
+		json.NewEncoder(conn).Encode(&res)
+		return
+	}
+
+	ctx, cancel := withTimeout(context.Background(), conf.CommandTimeout)
+	defer cancel()
+
+	// the front-end closes the connection on cancellation, no further
+	// data is expected
+	go func() {
+		conn.Read(make([]byte, 1))
+		cancel()
+	}()
+
+	log.Printf("privileged helper: executing %s %v", req.Command, req.Args)
+
+	handled, err := nativeCommand(ctx, req.Command, req.Args, req.Input)
+
+	if !handled {
+		res.Output, err = runCommand(ctx, filepath.Base(req.Command), exec.Command(req.Command, req.Args...), req.Input, false)
+	}
+
+	if err != nil {
+		res.Error = err.Error()
+	}
+
+	json.NewEncoder(conn).Encode(&res)
+}
+
+func argsEqual(args []string, expected ...string) bool {
+	if len(args) != len(expected) {
+		return false
+	}
+
+	for i := range args {
+		if args[i] != expected[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// allowed validates a command against the invocations performed by
+// INTERLOCK.
+func (p *privsepHelper) allowed(cmd string, args []string) bool {
+	if policy, ok := commandAllowlist[cmd]; !ok || !policy.root {
+		return false
+	}
+
+	switch cmd {
+	case "/bin/date":
+		return len(args) == 2 && args[0] == "-s" && epochPattern.MatchString(args[1])
+	case "/sbin/hwclock":
+		return argsEqual(args, "--hctosys", "--utc", "-f", rtcDevice) ||
+			argsEqual(args, "--systohc", "--utc", "-f", rtcDevice)
+	case "/sbin/poweroff":
+		return len(args) == 0
+	case "/bin/mount":
+		return argsEqual(args, mountArgs(nil, "/dev/mapper/"+volumeMapping(), p.mountPoint)...) ||
+			argsEqual(args, mountArgs([]string{"remount", "ro"}, p.mountPoint)...) ||
+			argsEqual(args, mountArgs([]string{"remount", "rw"}, p.mountPoint)...)
+	case "/bin/umount":
+		return argsEqual(args, p.mountPoint)
+	case "/bin/chown":
+		return argsEqual(args, p.user, p.mountPoint)
+	case "/sbin/cryptsetup":
+		return p.luksAllowed(args)
+	case dumpe2fs:
+		return argsEqual(args, "-h", "/dev/mapper/"+volumeMapping())
+	case "/sbin/modprobe":
+		return argsEqual(args, "g_ether")
+	case "/sbin/ip":
+		return conf.USBNetwork != "" &&
+			(argsEqual(args, "addr", "replace", conf.USBAddress, "dev", conf.USBNetwork) ||
+				argsEqual(args, "link", "set", conf.USBNetwork, "up"))
+	}
+
+	return false
+}
+
+func (p *privsepHelper) luksAllowed(args []string) bool {
+	quiet := len(args) > 0 && args[0] == "-q"
+
+	if quiet {
+		args = args[1:]
+	}
+
+	if len(args) < 2 {
+		return false
+	}
+
+	action, args := args[0], args[1:]
+	last := len(args) - 1
+
+	switch {
+	case action == "luksKillSlot":
+		_, err := strconv.Atoi(args[last])
+		return quiet && err == nil && p.device(args[:last])
+	case quiet:
+		return false
+	case action == "luksOpen":
+		return args[last] == volumeMapping() && p.device(args[:last])
+	case action == "open":
+		return args[0] == "--test-passphrase" && p.device(args[1:])
+	case action == "luksClose":
+		return argsEqual(args, "/dev/mapper/"+volumeMapping())
+	case action == "luksChangeKey", action == "luksAddKey", action == "luksRemoveKey":
+		return p.device(args)
+	case action == "luksDump":
+		return args[0] == "--dump-json-metadata" &&
+			(p.device(args[1:]) || (conf.HiddenHeader != "" && argsEqual(args[1:], conf.HiddenHeader)))
+	case action == "status":
+		return argsEqual(args, volumeMapping())
+	}
+
+	return false
+}
+
+// device validates the volume selection arguments returned by luksDevice.
+func (p *privsepHelper) device(args []string) bool {
+	if len(args) == 3 {
+		if args[0] != "--header" || !p.header(args[1]) {
+			return false
+		}
+
+		args = args[2:]
+	}
+
+	if len(args) != 1 {
+		return false
+	}
+
+	volume := strings.TrimSuffix(filepath.Base(args[0]), volumeImageExt)
+
+	return args[0] == volumeDevice(volume) && validHeaderVolume(volume) == nil
+}
+
+// header validates detached header paths.
+func (p *privsepHelper) header(path string) bool {
+	if path != filepath.Clean(path) || !filepath.IsAbs(path) {
+		return false
+	}
+
+	switch {
+	case conf.HiddenHeader != "" && path == conf.HiddenHeader:
+		return true
+	case conf.HeaderMode == headerToken:
+		return filepath.Dir(path) == filepath.Clean(conf.HeaderPath) && strings.HasSuffix(path, headerExt)
+	case conf.HeaderMode == headerAPI:
+		return filepath.Dir(path) == headerTmp && strings.HasPrefix(filepath.Base(path), ".interlock-header-")
+	}
+
+	return false
+}
@@ -0,0 +1,111 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// +build linux
+
+package interlock
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPrivsepAllowed(t *testing.T) {
+	conf.SetDefaults()
+	defer conf.SetDefaults()
+
+	conf.HiddenHeader = "/home/interlock/.hidden"
+
+	p := &privsepHelper{
+		uid:        1000,
+		user:       "interlock",
+		mountPoint: "/home/interlock/.interlock-mnt",
+	}
+
+	allowed := [][]string{
+		{"/bin/date", "-s", "@1620000000"},
+		{"/sbin/poweroff"},
+		{"/bin/mount", "-o", "nodev,nosuid,noexec", "/dev/mapper/interlockfs", "/home/interlock/.interlock-mnt"},
+		{"/bin/mount", "-o", "remount,ro,nodev,nosuid,noexec", "/home/interlock/.interlock-mnt"},
+		{"/bin/umount", "/home/interlock/.interlock-mnt"},
+		{"/bin/chown", "interlock", "/home/interlock/.interlock-mnt"},
+		{"/sbin/cryptsetup", "luksOpen", "/dev/lvmvolume/test", "interlockfs"},
+		{"/sbin/cryptsetup", "luksOpen", "--header", "/home/interlock/.hidden", "/dev/lvmvolume/test", "interlockfs"},
+		{"/sbin/cryptsetup", "open", "--test-passphrase", "/dev/lvmvolume/test"},
+		{"/sbin/cryptsetup", "luksClose", "/dev/mapper/interlockfs"},
+		{"/sbin/cryptsetup", "luksAddKey", "/dev/lvmvolume/test"},
+		{"/sbin/cryptsetup", "luksDump", "--dump-json-metadata", "/home/interlock/.hidden"},
+		{"/sbin/cryptsetup", "-q", "luksKillSlot", "/dev/lvmvolume/test", "1"},
+		{"/sbin/cryptsetup", "status", "interlockfs"},
+		{"/sbin/dumpe2fs", "-h", "/dev/mapper/interlockfs"},
+	}
+
+	rejected := [][]string{
+		{"/bin/cp", "/etc/shadow", "/tmp"},
+		{"/bin/sh", "-c", "id"},
+		{"/bin/date", "-s", "now; id"},
+		{"/sbin/poweroff", "--force"},
+		{"/bin/mount", "-o", "nodev,nosuid,noexec", "/dev/sda1", "/home/interlock/.interlock-mnt"},
+		{"/bin/mount", "/dev/mapper/interlockfs", "/home/interlock/.interlock-mnt"},
+		{"/bin/mount", "-o", "remount,exec", "/home/interlock/.interlock-mnt"},
+		{"/bin/umount", "/"},
+		{"/bin/chown", "interlock", "/etc/shadow"},
+		{"/sbin/cryptsetup", "luksOpen", "/dev/sda1", "interlockfs"},
+		{"/sbin/cryptsetup", "luksOpen", "/dev/lvmvolume/../../sda1", "interlockfs"},
+		{"/sbin/cryptsetup", "luksOpen", "/dev/lvmvolume/test", "other"},
+		{"/sbin/cryptsetup", "luksOpen", "--header", "/etc/shadow", "/dev/lvmvolume/test", "interlockfs"},
+		{"/sbin/cryptsetup", "luksKillSlot", "/dev/lvmvolume/test", "1"},
+		{"/sbin/cryptsetup", "-q", "luksFormat", "/dev/lvmvolume/test"},
+		{"/sbin/cryptsetup", "luksClose", "/dev/mapper/other"},
+		{"/sbin/cryptsetup", "erase", "/dev/lvmvolume/test"},
+		{"/sbin/ip", "link", "set", "eth0", "down"},
+	}
+
+	for _, c := range allowed {
+		if !p.allowed(c[0], c[1:]) {
+			t.Errorf("command rejected: %v", c)
+		}
+	}
+
+	for _, c := range rejected {
+		if p.allowed(c[0], c[1:]) {
+			t.Errorf("command allowed: %v", c)
+		}
+	}
+
+	conf.HeaderMode = headerAPI
+
+	if !p.allowed("/sbin/cryptsetup", []string{"luksAddKey", "--header", filepath.Join(headerTmp, ".interlock-header-123"), "/dev/lvmvolume/test"}) {
+		t.Error("uploaded header rejected")
+	}
+
+	if p.allowed("/sbin/cryptsetup", []string{"luksAddKey", "--header", filepath.Join(headerTmp, "other"), "/dev/lvmvolume/test"}) {
+		t.Error("arbitrary header accepted")
+	}
+
+	conf.VolumePath = "/var/lib/interlock"
+
+	if !p.allowed("/sbin/cryptsetup", []string{"luksOpen", "/var/lib/interlock/test.img", "interlockfs"}) {
+		t.Error("volume image rejected")
+	}
+
+	if p.allowed("/sbin/cryptsetup", []string{"luksOpen", "/var/lib/interlock/test", "interlockfs"}) {
+		t.Error("arbitrary file accepted")
+	}
+}
+
+func TestPrivsepUnavailable(t *testing.T) {
+	conf.SetDefaults()
+	defer conf.SetDefaults()
+
+	conf.PrivsepSocket = filepath.Join(t.TempDir(), "privsep.sock")
+
+	if _, err := execCommandContext(context.Background(), "/sbin/poweroff", nil, ""); err == nil || !strings.Contains(err.Error(), "privileged helper unavailable") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
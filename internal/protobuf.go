@@ -0,0 +1,154 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Minimal Protocol Buffers (proto3) wire format support for the gRPC
+// management API, limited to the scalar types used in interlock.proto.
+
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+type protoWriter struct {
+	buf []byte
+}
+
+func (w *protoWriter) tag(field int, wireType int) {
+	w.buf = binary.AppendUvarint(w.buf, uint64(field)<<3|uint64(wireType))
+}
+
+// String encodes a string field, empty strings are omitted as per proto3
+// default values.
+func (w *protoWriter) String(field int, s string) {
+	if s == "" {
+		return
+	}
+
+	w.tag(field, protoBytes)
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *protoWriter) Bool(field int, v bool) {
+	if !v {
+		return
+	}
+
+	w.tag(field, protoVarint)
+	w.buf = append(w.buf, 1)
+}
+
+func (w *protoWriter) Int64(field int, v int64) {
+	if v == 0 {
+		return
+	}
+
+	w.tag(field, protoVarint)
+	w.buf = binary.AppendUvarint(w.buf, uint64(v))
+}
+
+// Message encodes an embedded message, always present so that it can be
+// used for repeated fields.
+func (w *protoWriter) Message(field int, m *protoWriter) {
+	w.tag(field, protoBytes)
+	w.buf = binary.AppendUvarint(w.buf, uint64(len(m.buf)))
+	w.buf = append(w.buf, m.buf...)
+}
+
+func (w *protoWriter) Bytes() []byte {
+	return w.buf
+}
+
+// protoMessage holds decoded fields by number, the last occurrence of
+// non-repeated fields prevails.
+type protoMessage map[int][]protoValue
+
+type protoValue struct {
+	varint uint64
+	data   []byte
+}
+
+func parseProto(buf []byte) (m protoMessage, err error) {
+	m = make(protoMessage)
+
+	for len(buf) > 0 {
+		var v protoValue
+
+		key, n := binary.Uvarint(buf)
+
+		if n <= 0 {
+			return nil, errors.New("invalid protobuf tag")
+		}
+
+		buf = buf[n:]
+		field := int(key >> 3)
+
+		switch key & 7 {
+		case protoVarint:
+			if v.varint, n = binary.Uvarint(buf); n <= 0 {
+				return nil, errors.New("invalid protobuf varint")
+			}
+		case protoFixed64:
+			if n = 8; len(buf) < n {
+				return nil, errors.New("invalid protobuf fixed64")
+			}
+
+			v.varint = binary.LittleEndian.Uint64(buf)
+		case protoBytes:
+			size, l := binary.Uvarint(buf)
+
+			if l <= 0 || size > uint64(len(buf)-l) {
+				return nil, errors.New("invalid protobuf length")
+			}
+
+			v.data = buf[l : l+int(size)]
+			n = l + int(size)
+		case protoFixed32:
+			if n = 4; len(buf) < n {
+				return nil, errors.New("invalid protobuf fixed32")
+			}
+
+			v.varint = uint64(binary.LittleEndian.Uint32(buf))
+		default:
+			return nil, fmt.Errorf("unsupported protobuf wire type %d", key&7)
+		}
+
+		buf = buf[n:]
+		m[field] = append(m[field], v)
+	}
+
+	return
+}
+
+func (m protoMessage) last(field int) (v protoValue, ok bool) {
+	values := m[field]
+
+	if len(values) == 0 {
+		return
+	}
+
+	return values[len(values)-1], true
+}
+
+func (m protoMessage) String(field int) string {
+	v, _ := m.last(field)
+	return string(v.data)
+}
+
+func (m protoMessage) Bool(field int) bool {
+	v, _ := m.last(field)
+	return v.varint != 0
+}
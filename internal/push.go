@@ -0,0 +1,187 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Push notifications, security relevant events are sent to an ntfy or Gotify
+// server for delivery to mobile devices.
+
+const (
+	pushNtfy   = "ntfy"
+	pushGotify = "gotify"
+)
+
+var pushTitles = map[string]string{
+	eventLogin:        "login",
+	eventLoginFailed:  "failed login",
+	eventUpload:       "upload completed",
+	eventWipe:         "dead man's switch triggered",
+	eventLowDisk:      "low disk space",
+	eventTamper:       "system partition modified",
+	eventAccessDenied: "login attempt outside access window",
+	eventHoneytoken:   "honeytoken accessed",
+}
+
+// notification priorities, on the 1 (min) - 5 (max) ntfy scale
+var pushPriorities = map[string]int{
+	eventLoginFailed:  4,
+	eventWipe:         5,
+	eventLowDisk:      4,
+	eventTamper:       5,
+	eventAccessDenied: 4,
+	eventHoneytoken:   5,
+}
+
+func init() {
+	eventSinks = append(eventSinks, sendPush)
+}
+
+func checkPush() (err error) {
+	switch conf.PushService {
+	case "":
+		return
+	case pushNtfy, pushGotify:
+	default:
+		return fmt.Errorf("invalid push_service %s", conf.PushService)
+	}
+
+	u, err := url.Parse(conf.PushURL)
+
+	if err != nil {
+		return
+	}
+
+	if u.Scheme != "https" {
+		return fmt.Errorf("push_url %s is not HTTPS", conf.PushURL)
+	}
+
+	if conf.PushService == pushGotify && conf.PushToken == "" {
+		return fmt.Errorf("missing push_token for %s", pushGotify)
+	}
+
+	return
+}
+
+func pushSubscribed(name string) bool {
+	for _, e := range conf.PushEvents {
+		if e == name || e == "*" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pushMessage returns the event summary and its details in human readable
+// form.
+func pushMessage(e event) (title string, message string, priority int) {
+	title = "INTERLOCK: " + pushTitles[e.Name]
+	priority = pushPriorities[e.Name]
+
+	if priority == 0 {
+		priority = 3
+	}
+
+	var lines []string
+
+	for k, v := range e.Details {
+		lines = append(lines, fmt.Sprintf("%s: %v", k, v))
+	}
+
+	sort.Strings(lines)
+	message = strings.Join(lines, "\n")
+
+	if message == "" {
+		message = pushTitles[e.Name]
+	}
+
+	return
+}
+
+func pushRequest(e event) (req *http.Request, err error) {
+	title, message, priority := pushMessage(e)
+
+	switch conf.PushService {
+	case pushNtfy:
+		req, err = http.NewRequest("POST", conf.PushURL, strings.NewReader(message))
+
+		if err != nil {
+			return
+		}
+
+		req.Header.Set("Title", title)
+		req.Header.Set("Priority", fmt.Sprintf("%d", priority))
+		req.Header.Set("Tags", "lock,"+e.Name)
+
+		if conf.PushToken != "" {
+			req.Header.Set("Authorization", "Bearer "+conf.PushToken)
+		}
+	case pushGotify:
+		var body []byte
+
+		// Gotify priorities range from 0 to 10
+		body, err = json.Marshal(map[string]interface{}{
+			"title":    title,
+			"message":  message,
+			"priority": priority * 2,
+		})
+
+		if err != nil {
+			return
+		}
+
+		req, err = http.NewRequest("POST", strings.TrimSuffix(conf.PushURL, "/")+"/message", bytes.NewReader(body))
+
+		if err != nil {
+			return
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Gotify-Key", conf.PushToken)
+	}
+
+	return
+}
+
+func sendPush(e event) {
+	if conf.PushService == "" || !pushSubscribed(e.Name) {
+		return
+	}
+
+	go func() {
+		defer recoverJob("push notification")
+
+		req, err := pushRequest(e)
+
+		if err != nil {
+			status.Error(err)
+			return
+		}
+
+		res, err := eventClient.Do(req)
+
+		if err != nil {
+			status.Error(fmt.Errorf("push notification: %v", err))
+			return
+		}
+
+		res.Body.Close()
+
+		if res.StatusCode < 200 || res.StatusCode >= 300 {
+			status.Error(fmt.Errorf("push notification: unexpected status %s", res.Status))
+		}
+	}()
+}
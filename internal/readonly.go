@@ -0,0 +1,129 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"errors"
+	"log/syslog"
+	"net/http"
+	"sync"
+)
+
+// Read-only mode, the encrypted volume is remounted read-only and all
+// mutating API methods are disabled (e.g. when presenting the archive to an
+// untrusted viewer or during forensic review).
+
+type readOnlyMode struct {
+	sync.Mutex
+	enabled bool
+	// set when read-only mode cannot be disabled for the current mount
+	forced bool
+}
+
+var readOnly readOnlyMode
+
+var errReadOnly = errors.New("read-only mode, write operations are disabled")
+
+func (m *readOnlyMode) Enabled() bool {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.enabled
+}
+
+// Set remounts the volume, the mode is left unchanged on failure.
+func (m *readOnlyMode) Set(enabled bool) (err error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.enabled == enabled {
+		return
+	}
+
+	if !enabled && m.forced {
+		return errors.New("read-only mode enforced for this volume")
+	}
+
+	// the log file on the encrypted partition prevents read-only remounts
+	fileLog := conf.logFile != nil && !conf.Debug
+
+	if enabled && fileLog {
+		EnableSyslog()
+	}
+
+	err = remount(enabled)
+
+	if err != nil {
+		if enabled && fileLog {
+			EnableFileLog()
+		}
+
+		return
+	}
+
+	m.enabled = enabled
+
+	if !enabled && !conf.Debug {
+		EnableFileLog()
+	}
+
+	if enabled {
+		status.Log(syslog.LOG_NOTICE, "read-only mode enabled")
+	} else {
+		status.Log(syslog.LOG_NOTICE, "read-only mode disabled")
+	}
+
+	return
+}
+
+// Force enables read-only mode until the volume is unmounted.
+func (m *readOnlyMode) Force() (err error) {
+	if err = m.Set(true); err != nil {
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.forced = true
+
+	return
+}
+
+// Reset clears the mode without remounting, invoked on volume unmount.
+func (m *readOnlyMode) Reset() {
+	m.Lock()
+	defer m.Unlock()
+
+	m.enabled = false
+	m.forced = false
+}
+
+func readOnlyRequest(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if enabled, ok := req["readonly"].(bool); ok {
+		err = readOnly.Set(enabled)
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+	}
+
+	res = jsonObject{
+		"status": "OK",
+		"response": map[string]interface{}{
+			"readonly": readOnly.Enabled(),
+		},
+	}
+
+	return
+}
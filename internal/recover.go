@@ -0,0 +1,68 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"fmt"
+	"log"
+	"log/syslog"
+	"net/http"
+	"runtime/debug"
+)
+
+// recoverHandler isolates panics occurring within a request handler, the
+// fault is logged and reported to the client with a request identifier
+// (to allow correlation with logs) instead of terminating the server, and
+// therefore dropping the mounted volume for everyone.
+func recoverHandler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			p := recover()
+
+			if p == nil {
+				return
+			}
+
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+
+			id, err := randomString(8)
+			reportError("request identifier", err)
+
+			status.Log(syslog.LOG_ERR, "internal error (request %s) on %s: %v", id, r.URL.Path, p)
+
+			if conf.Debug {
+				log.Printf("%s", debug.Stack())
+			}
+
+			writeResponse(w, http.StatusInternalServerError, jsonObject{
+				"status":     "KO",
+				"response":   []string{fmt.Sprintf("internal error (request %s)", id)},
+				"request_id": id,
+			})
+		}()
+
+		h(w, r)
+	}
+}
+
+// recoverJob isolates panics occurring within background operations, it
+// must be deferred at the beginning of the goroutine.
+func recoverJob(job string) {
+	p := recover()
+
+	if p == nil {
+		return
+	}
+
+	status.Log(syslog.LOG_ERR, "internal error while %s: %v", job, p)
+
+	if conf.Debug {
+		log.Printf("%s", debug.Stack())
+	}
+}
@@ -0,0 +1,403 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"log/syslog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Device-to-device replication, selected directories are mirrored from this
+// instance to a peer INTERLOCK instance over mutually authenticated TLS. The
+// peer accepts replicated files only while its encrypted volume is unlocked.
+
+type replicaEntry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Mtime  int64  `json:"mtime"`
+	SHA256 string `json:"sha256"`
+}
+
+func replicaTLSConfig() (c *tls.Config, err error) {
+	cert, err := tls.LoadX509KeyPair(conf.ReplicaCert, conf.ReplicaKey)
+
+	if err != nil {
+		return
+	}
+
+	ca, err := ioutil.ReadFile(conf.ReplicaCA)
+
+	if err != nil {
+		return
+	}
+
+	pool := x509.NewCertPool()
+
+	if ok := pool.AppendCertsFromPEM(ca); !ok {
+		return nil, errors.New("could not parse replication certificate authority")
+	}
+
+	c = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	return
+}
+
+func replicaHandler() http.Handler {
+	replicaMux := http.NewServeMux()
+	replicaMux.HandleFunc("/replica/manifest", recoverHandler(replicaManifestHandler))
+	replicaMux.HandleFunc("/replica/file", recoverHandler(replicaFileHandler))
+
+	return replicaMux
+}
+
+func startReplication() (err error) {
+	if conf.ReplicaListen == "" && conf.ReplicaPeer == "" {
+		return
+	}
+
+	TLSConfig, err := replicaTLSConfig()
+
+	if err != nil {
+		return
+	}
+
+	if conf.ReplicaListen != "" {
+		srv := &http.Server{
+			Addr:      conf.ReplicaListen,
+			Handler:   replicaHandler(),
+			TLSConfig: TLSConfig,
+		}
+
+		log.Printf("starting replication server on %s", conf.ReplicaListen)
+
+		go func() {
+			if err := srv.ListenAndServeTLS("", ""); err != nil {
+				log.Printf("replication server error: %v", err)
+			}
+		}()
+	}
+
+	if conf.ReplicaPeer != "" && conf.ReplicaInterval > 0 {
+		client := &http.Client{
+			Transport: &http.Transport{TLSClientConfig: TLSConfig},
+			Timeout:   10 * time.Minute,
+		}
+
+		go func() {
+			for {
+				time.Sleep(time.Duration(conf.ReplicaInterval) * time.Second)
+
+				if session.Active() {
+					replicate(client)
+				}
+			}
+		}()
+	}
+
+	return
+}
+
+// replicaPath resolves a replicated path, only configured directories are
+// allowed.
+func replicaPath(p string) (osPath string, err error) {
+	osPath, err = absolutePath(p)
+
+	if err != nil {
+		return
+	}
+
+	if inKeyPath, _ := detectKeyPath(osPath); inKeyPath {
+		return "", errors.New("replication of key storage is not allowed")
+	}
+
+	for _, dir := range conf.ReplicaPaths {
+		d := filepath.Join(conf.MountPoint, dir)
+
+		if (&jail{root: d}).Contains(osPath) {
+			return
+		}
+	}
+
+	return "", fmt.Errorf("path %s is not replicated", p)
+}
+
+func replicaManifest(dir string) (entries []replicaEntry, err error) {
+	entries = []replicaEntry{}
+
+	err = volumeJail().Walk(dir, func(p string, info os.FileInfo, e error) error {
+		if e != nil {
+			if os.IsNotExist(e) {
+				return nil
+			}
+
+			return e
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		hash, err := fileHash(p, sha256.New)
+
+		if err != nil {
+			return err
+		}
+
+		entries = append(entries, replicaEntry{
+			Path:   relativePath(p),
+			Size:   info.Size(),
+			Mtime:  info.ModTime().Unix(),
+			SHA256: hash,
+		})
+
+		return nil
+	})
+
+	return
+}
+
+func replicaManifestHandler(w http.ResponseWriter, r *http.Request) {
+	if !session.Active() {
+		http.Error(w, "volume locked", http.StatusServiceUnavailable)
+		return
+	}
+
+	dir, err := replicaPath(r.URL.Query().Get("path"))
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	entries, err := replicaManifest(dir)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+func replicaFileHandler(w http.ResponseWriter, r *http.Request) {
+	if !session.Active() {
+		http.Error(w, "volume locked", http.StatusServiceUnavailable)
+		return
+	}
+
+	if r.Method != http.MethodPut {
+		http.Error(w, "invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	osPath, err := replicaPath(query.Get("path"))
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	mtime, err := strconv.ParseInt(query.Get("mtime"), 10, 64)
+
+	if err != nil {
+		http.Error(w, "invalid mtime", http.StatusBadRequest)
+		return
+	}
+
+	err = storeReplica(osPath, time.Unix(mtime, 0), query.Get("backup") == "true", r.Body)
+
+	if err != nil {
+		status.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	status.Log(syslog.LOG_INFO, "replicated %s from %s", relativePath(osPath), r.RemoteAddr)
+}
+
+func storeReplica(osPath string, mtime time.Time, backup bool, input io.Reader) (err error) {
+	if err = volumeJail().MkdirAll(path.Dir(osPath), 0700); err != nil {
+		return
+	}
+
+	output, err := volumeJail().CreateTemp(path.Dir(osPath), ".replica-")
+
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		output.Close()
+
+		if err != nil {
+			volumeJail().Remove(output.Name())
+		}
+	}()
+
+	if _, err = io.Copy(output, input); err != nil {
+		return
+	}
+
+	if backup {
+		conflict := fmt.Sprintf("%s.conflict-%d", osPath, time.Now().Unix())
+
+		if err = volumeJail().Rename(osPath, conflict); err != nil && !os.IsNotExist(err) {
+			return
+		}
+
+		status.Log(syslog.LOG_WARNING, "replication conflict, %s preserved as %s", relativePath(osPath), relativePath(conflict))
+	}
+
+	if err = volumeJail().Rename(output.Name(), osPath); err != nil {
+		return
+	}
+
+	return volumeJail().Chtimes(osPath, mtime, mtime)
+}
+
+func replicate(client *http.Client) {
+	n := status.Notify(syslog.LOG_INFO, "replicating to %s", conf.ReplicaPeer)
+	defer status.Remove(n)
+
+	for _, dir := range conf.ReplicaPaths {
+		err := replicateDir(client, dir)
+
+		if err != nil {
+			status.Log(syslog.LOG_ERR, "replication of %s failed: %v", dir, err)
+		}
+	}
+}
+
+func replicateDir(client *http.Client, dir string) (err error) {
+	var remote []replicaEntry
+
+	osPath, err := replicaPath(dir)
+
+	if err != nil {
+		return
+	}
+
+	local, err := replicaManifest(osPath)
+
+	if err != nil {
+		return
+	}
+
+	res, err := client.Get("https://" + conf.ReplicaPeer + "/replica/manifest?path=" + url.QueryEscape(dir))
+
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer error: %s", res.Status)
+	}
+
+	if err = json.NewDecoder(res.Body).Decode(&remote); err != nil {
+		return
+	}
+
+	peer := make(map[string]replicaEntry)
+
+	for _, e := range remote {
+		peer[e.Path] = e
+	}
+
+	for _, e := range local {
+		backup := false
+
+		if p, ok := peer[e.Path]; ok {
+			if p.SHA256 == e.SHA256 {
+				continue
+			}
+
+			// the peer copy has been modified after the local one
+			if p.Mtime > e.Mtime {
+				switch conf.ReplicaConflict {
+				case "skip":
+					status.Log(syslog.LOG_WARNING, "replication conflict, skipping %s", e.Path)
+					continue
+				case "keep":
+					backup = true
+				}
+			}
+		}
+
+		if err = replicateFile(client, e, backup); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func replicateFile(client *http.Client, e replicaEntry, backup bool) (err error) {
+	osPath, err := absolutePath(e.Path)
+
+	if err != nil {
+		return
+	}
+
+	input, err := volumeJail().Open(osPath)
+
+	if err != nil {
+		return
+	}
+	defer input.Close()
+
+	query := url.Values{}
+	query.Set("path", e.Path)
+	query.Set("mtime", strconv.FormatInt(e.Mtime, 10))
+	query.Set("backup", strconv.FormatBool(backup))
+
+	req, err := http.NewRequest(http.MethodPut, "https://"+conf.ReplicaPeer+"/replica/file?"+query.Encode(), input)
+
+	if err != nil {
+		return
+	}
+
+	res, err := client.Do(req)
+
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("peer error on %s: %s", e.Path, strings.TrimSpace(string(msg)))
+	}
+
+	status.Log(syslog.LOG_INFO, "replicated %s to %s", e.Path, conf.ReplicaPeer)
+
+	return
+}
@@ -0,0 +1,258 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/syslog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Key revocation, ciphers supporting revocation certificates produce one on
+// key generation. Certificates are kept on the encrypted volume, outside the
+// key path, until downloaded once for safekeeping or publishing.
+//
+// Keys can be marked revoked locally, revoked key pairs can no longer be used
+// for encryption or signing, decryption and verification of existing files
+// remain possible.
+
+const revocationDir = ".interlock-revocation"
+const revokedFile = ".interlock-revoked.json"
+
+// revocationInterface is implemented by ciphers supporting revocation
+// certificates.
+type revocationInterface interface {
+	GenRevocation(secKey string) (rev string, err error)
+}
+
+type revocationStore struct {
+	sync.Mutex
+	// <cipher extension>/<identifier> -> revocation epoch
+	entries map[string]int64
+}
+
+var revocations revocationStore
+
+func revocationPath(k key) string {
+	sum := sha256.Sum256([]byte(filepath.Clean("/" + k.Path)))
+	return filepath.Join(conf.MountPoint, revocationDir, hex.EncodeToString(sum[:])+".rev")
+}
+
+func revokedPath() string {
+	return filepath.Join(conf.MountPoint, revokedFile)
+}
+
+// keyPairID identifies both public and private keys of a key pair.
+func keyPairID(ext string, identifier string) string {
+	return ext + "/" + identifier
+}
+
+// storeRevocation generates and stores the revocation certificate for a
+// secret key, if supported by its cipher.
+func storeRevocation(cipher cipherInterface, secKey key, sec string) (err error) {
+	rc, ok := cipher.(revocationInterface)
+
+	if !ok {
+		return
+	}
+
+	rev, err := rc.GenRevocation(sec)
+
+	if err != nil {
+		return
+	}
+
+	path := revocationPath(secKey)
+
+	if err = volumeJail().MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return
+	}
+
+	if err = volumeJail().WriteFile(path, []byte(rev), 0600); err != nil {
+		return
+	}
+
+	status.Log(syslog.LOG_NOTICE, "stored %s revocation certificate for key %s", cipher.GetInfo().Name, secKey.Identifier)
+
+	return
+}
+
+// load reads the revoked keys from the encrypted volume when not cached.
+func (s *revocationStore) load() (err error) {
+	if s.entries != nil {
+		return
+	}
+
+	s.entries = make(map[string]int64)
+	buf, err := volumeJail().ReadFile(revokedPath())
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return
+	}
+
+	return json.Unmarshal(buf, &s.entries)
+}
+
+func (s *revocationStore) save() (err error) {
+	buf, err := json.MarshalIndent(s.entries, "", "\t")
+
+	if err != nil {
+		return
+	}
+
+	tmp := revokedPath() + ".tmp"
+
+	if err = volumeJail().WriteFile(tmp, buf, 0600); err != nil {
+		return
+	}
+
+	return volumeJail().Rename(tmp, revokedPath())
+}
+
+// Revoked returns the revocation time of a key pair, zero if not revoked.
+func (s *revocationStore) Revoked(id string) (epoch int64) {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.load(); err != nil {
+		reportError("revoked keys", err)
+		return
+	}
+
+	return s.entries[id]
+}
+
+func (s *revocationStore) Revoke(id string) (err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if err = s.load(); err != nil {
+		return
+	}
+
+	if _, ok := s.entries[id]; ok {
+		return errors.New("key already revoked")
+	}
+
+	s.entries[id] = time.Now().Unix()
+
+	if err = s.save(); err != nil {
+		delete(s.entries, id)
+		return
+	}
+
+	status.Log(syslog.LOG_NOTICE, "revoked key %s", id)
+
+	return
+}
+
+func (s *revocationStore) Reset() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.entries = nil
+}
+
+// checkRevoked returns an error if the operation would produce new data with
+// a revoked key.
+func checkRevoked(k key, op string) (err error) {
+	if k.Revoked != 0 && (op == keyUsageEncrypt || op == keyUsageSign) {
+		return fmt.Errorf("key %s is revoked", k.Identifier)
+	}
+
+	return
+}
+
+func keyRevocation(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	path, err := absolutePath(req["path"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	k, _, err := getKey(path)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	revPath := revocationPath(k)
+	rev, err := volumeJail().ReadFile(revPath)
+
+	if os.IsNotExist(err) {
+		return errorResponse(errors.New("revocation certificate not available"), "")
+	}
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	// the certificate can only be retrieved once
+	if err = volumeJail().Remove(revPath); err != nil {
+		return errorResponse(err, "")
+	}
+
+	status.Log(syslog.LOG_NOTICE, "revocation certificate for key %s retrieved", k.Identifier)
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": string(rev),
+	}
+
+	return
+}
+
+func revokeKey(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	path, err := absolutePath(req["path"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	k, cipher, err := getKey(path)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = revocations.Revoke(keyPairID(cipher.GetInfo().Extension, k.Identifier))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": nil,
+	}
+
+	return
+}
@@ -0,0 +1,197 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Log rotation, the log file and key usage logs are rotated when exceeding
+// `log_max_size`, rotated files are compressed (path.1.gz being the most
+// recent) and only the `log_keep` most recent ones are retained.
+//
+// Rotation is confined, through a jail, to the directory of the log file.
+
+type rotatingFile struct {
+	sync.Mutex
+	path string
+	file *os.File
+	size int64
+}
+
+func openRotating(path string) (f *rotatingFile, err error) {
+	f = &rotatingFile{path: path}
+	err = f.open()
+
+	return
+}
+
+// logJail returns a jail rooted at the directory of a log file.
+func logJail(path string) *jail {
+	return &jail{root: filepath.Dir(filepath.Clean(path))}
+}
+
+func (f *rotatingFile) open() (err error) {
+	f.file, err = logJail(f.path).OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+
+	if err != nil {
+		return
+	}
+
+	stat, err := f.file.Stat()
+
+	if err != nil {
+		f.file.Close()
+		return
+	}
+
+	f.size = stat.Size()
+
+	return
+}
+
+func (f *rotatingFile) Write(p []byte) (n int, err error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.size > 0 && logRotationNeeded(f.size+int64(len(p))) {
+		f.file.Close()
+
+		// writing is resumed on the current file on failure, rather
+		// than losing entries
+		rotateErr := rotateFile(f.path)
+
+		if err = f.open(); err != nil {
+			return
+		}
+
+		if rotateErr != nil {
+			fmt.Fprintf(f.file, "log rotation error: %v\n", rotateErr)
+		}
+	}
+
+	n, err = f.file.Write(p)
+	f.size += int64(n)
+
+	return
+}
+
+func (f *rotatingFile) Close() error {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.file.Close()
+}
+
+func logRotationNeeded(size int64) bool {
+	return conf.LogMaxSize > 0 && size > int64(conf.LogMaxSize)*1024
+}
+
+func rotatedPath(path string, n int) string {
+	return fmt.Sprintf("%s.%d.gz", path, n)
+}
+
+// rotatedPaths returns the existing rotated files of the argument path,
+// oldest first.
+func rotatedPaths(path string) (paths []string) {
+	j := logJail(path)
+
+	for n := conf.LogKeep; n >= 1; n-- {
+		if _, err := j.Stat(rotatedPath(path, n)); err == nil {
+			paths = append(paths, rotatedPath(path, n))
+		}
+	}
+
+	return
+}
+
+// rotateFile compresses the argument file to its first rotated path, shifting
+// previous ones and removing those exceeding `log_keep`.
+func rotateFile(path string) (err error) {
+	j := logJail(path)
+
+	if conf.LogKeep <= 0 {
+		return j.Remove(path)
+	}
+
+	j.Remove(rotatedPath(path, conf.LogKeep))
+
+	for n := conf.LogKeep - 1; n >= 1; n-- {
+		if err = j.Rename(rotatedPath(path, n), rotatedPath(path, n+1)); err != nil && !os.IsNotExist(err) {
+			return
+		}
+	}
+
+	src, err := j.Open(path)
+
+	if err != nil {
+		return
+	}
+	defer src.Close()
+
+	tmp := rotatedPath(path, 1) + ".tmp"
+	dst, err := j.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+
+	if err != nil {
+		return
+	}
+
+	w := gzip.NewWriter(dst)
+
+	if _, err = io.Copy(w, src); err == nil {
+		err = w.Close()
+	}
+
+	if e := dst.Close(); err == nil {
+		err = e
+	}
+
+	if err != nil {
+		j.Remove(tmp)
+		return
+	}
+
+	if err = j.Rename(tmp, rotatedPath(path, 1)); err != nil {
+		return
+	}
+
+	return j.Remove(path)
+}
+
+// openRotated returns a reader for a rotated file, or a plain one.
+func openRotated(path string) (r io.ReadCloser, err error) {
+	f, err := logJail(path).Open(path)
+
+	if err != nil || !strings.HasSuffix(path, ".gz") {
+		return f, err
+	}
+
+	gz, err := gzip.NewReader(f)
+
+	if err != nil {
+		f.Close()
+		return
+	}
+
+	return &gzipFile{gz, f}, nil
+}
+
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (g *gzipFile) Close() error {
+	g.Reader.Close()
+	return g.file.Close()
+}
@@ -0,0 +1,89 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	defer conf.SetDefaults()
+
+	conf.LogMaxSize = 1
+	conf.LogKeep = 2
+
+	path := filepath.Join(t.TempDir(), "test.log")
+	f, err := openRotating(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	line := strings.Repeat("x", 99) + "\n"
+
+	for i := 0; i < 50; i++ {
+		if _, err = f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f.Close()
+
+	if paths := rotatedPaths(path); len(paths) != 2 || paths[0] != path+".2.gz" || paths[1] != path+".1.gz" {
+		t.Fatalf("unexpected rotated files: %v", paths)
+	}
+
+	if _, err = os.Stat(path + ".3.gz"); !os.IsNotExist(err) {
+		t.Error("rotated files exceed log_keep")
+	}
+
+	r, err := openRotated(path + ".1.gz")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if buf, err := ioutil.ReadAll(r); err != nil || string(buf) != strings.Repeat(line, 10) {
+		t.Errorf("unexpected rotated content: %d bytes, %v", len(buf), err)
+	}
+
+	if stat, _ := os.Stat(path); stat.Size() > 1024 {
+		t.Errorf("log file exceeds log_max_size: %d", stat.Size())
+	}
+}
+
+func TestKeyUsageRotation(t *testing.T) {
+	defer conf.SetDefaults()
+
+	conf.MountPoint = t.TempDir()
+	conf.LogMaxSize = 1
+	conf.LogKeep = 5
+
+	k := key{Path: "pgp/public/test"}
+
+	for i := 0; i < 40; i++ {
+		if err := appendKeyUsage(k, keyUsage{Epoch: int64(i), Op: keyUsageSign, File: fmt.Sprintf("/file%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(rotatedPaths(keyUsagePath(k))) == 0 {
+		t.Fatal("key usage log not rotated")
+	}
+
+	log, err := keyUsageLog(k)
+
+	if err != nil || len(log) != 40 || log[0].File != "/file0" || log[39].File != "/file39" {
+		t.Errorf("unexpected key usage log: %v %v", log, err)
+	}
+}
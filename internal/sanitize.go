@@ -0,0 +1,427 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Metadata stripping, files are rewritten without EXIF/XMP/IPTC data (JPEG),
+// textual and time chunks (PNG), document properties (Office Open XML) and
+// document information (PDF). The list of removed fields is returned so that
+// the user can review what was discarded.
+
+type sanitizer func(src io.Reader, dst io.Writer) (removed []string, err error)
+
+var sanitizers = map[string]sanitizer{
+	".jpg":  sanitizeJPEG,
+	".jpeg": sanitizeJPEG,
+	".png":  sanitizePNG,
+	".docx": sanitizeOOXML,
+	".xlsx": sanitizeOOXML,
+	".pptx": sanitizeOOXML,
+}
+
+// JPEG markers
+const (
+	jpegSOI  = 0xd8
+	jpegSOS  = 0xda
+	jpegAPP0 = 0xe0
+	jpegAPP2 = 0xe2
+	jpegAPPE = 0xee
+	jpegAPPF = 0xef
+	jpegCOM  = 0xfe
+)
+
+func sanitizeJPEG(src io.Reader, dst io.Writer) (removed []string, err error) {
+	r := bufio.NewReader(src)
+	marker := make([]byte, 2)
+
+	if _, err = io.ReadFull(r, marker); err != nil {
+		return
+	}
+
+	if marker[0] != 0xff || marker[1] != jpegSOI {
+		return nil, errors.New("invalid JPEG file")
+	}
+
+	if _, err = dst.Write(marker); err != nil {
+		return
+	}
+
+	for {
+		if _, err = io.ReadFull(r, marker); err != nil {
+			return
+		}
+
+		if marker[0] != 0xff {
+			return nil, errors.New("invalid JPEG marker")
+		}
+
+		if marker[1] == jpegSOS {
+			// entropy coded data follows, copied verbatim
+			if _, err = dst.Write(marker); err != nil {
+				return
+			}
+
+			_, err = io.Copy(dst, r)
+
+			return
+		}
+
+		length := make([]byte, 2)
+
+		if _, err = io.ReadFull(r, length); err != nil {
+			return
+		}
+
+		size := int(binary.BigEndian.Uint16(length))
+
+		if size < 2 {
+			return nil, errors.New("invalid JPEG segment length")
+		}
+
+		payload := make([]byte, size-2)
+
+		if _, err = io.ReadFull(r, payload); err != nil {
+			return
+		}
+
+		if jpegMetadata(marker[1], payload) {
+			removed = append(removed, jpegSegmentName(marker[1], payload))
+			continue
+		}
+
+		for _, b := range [][]byte{marker, length, payload} {
+			if _, err = dst.Write(b); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// jpegMetadata returns whether a segment carries metadata, JFIF, ICC profiles
+// and Adobe color transform are required for correct rendering.
+func jpegMetadata(marker byte, payload []byte) bool {
+	switch {
+	case marker == jpegCOM:
+		return true
+	case marker == jpegAPP0, marker == jpegAPPE:
+		return false
+	case marker == jpegAPP2:
+		return !bytes.HasPrefix(payload, []byte("ICC_PROFILE"))
+	default:
+		return marker > jpegAPP0 && marker <= jpegAPPF
+	}
+}
+
+func jpegSegmentName(marker byte, payload []byte) string {
+	switch {
+	case marker == jpegCOM:
+		return "JPEG comment"
+	case bytes.HasPrefix(payload, []byte("Exif\x00")):
+		return "EXIF"
+	case bytes.HasPrefix(payload, []byte("http://ns.adobe.com/xap/1.0/")):
+		return "XMP"
+	case bytes.HasPrefix(payload, []byte("Photoshop 3.0")):
+		return "IPTC"
+	default:
+		return fmt.Sprintf("JPEG APP%d segment", marker-jpegAPP0)
+	}
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+var pngMetadataChunks = map[string]bool{
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"eXIf": true,
+	"tIME": true,
+}
+
+func sanitizePNG(src io.Reader, dst io.Writer) (removed []string, err error) {
+	r := bufio.NewReader(src)
+	signature := make([]byte, len(pngSignature))
+
+	if _, err = io.ReadFull(r, signature); err != nil {
+		return
+	}
+
+	if !bytes.Equal(signature, pngSignature) {
+		return nil, errors.New("invalid PNG file")
+	}
+
+	if _, err = dst.Write(signature); err != nil {
+		return
+	}
+
+	header := make([]byte, 8)
+
+	for {
+		if _, err = io.ReadFull(r, header); err != nil {
+			return
+		}
+
+		size := binary.BigEndian.Uint32(header[0:4])
+		name := string(header[4:8])
+
+		if size > 1<<31-1 {
+			return nil, errors.New("invalid PNG chunk length")
+		}
+
+		// chunk data and CRC
+		data := make([]byte, size+4)
+
+		if _, err = io.ReadFull(r, data); err != nil {
+			return
+		}
+
+		if pngMetadataChunks[name] {
+			removed = append(removed, pngChunkName(name, data[:size]))
+			continue
+		}
+
+		if _, err = dst.Write(header); err != nil {
+			return
+		}
+
+		if _, err = dst.Write(data); err != nil {
+			return
+		}
+
+		if name == "IEND" {
+			return
+		}
+	}
+}
+
+func pngChunkName(name string, data []byte) string {
+	switch name {
+	case "tEXt", "zTXt", "iTXt":
+		// chunk data starts with the null terminated keyword
+		if i := bytes.IndexByte(data, 0); i > 0 {
+			return fmt.Sprintf("PNG %s: %s", name, data[:i])
+		}
+	case "eXIf":
+		return "EXIF"
+	}
+
+	return "PNG " + name
+}
+
+// Office Open XML document properties are replaced with empty ones, as
+// removing them leaves dangling package relationships.
+var ooxmlProperties = map[string]string{
+	"docProps/core.xml": `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n" +
+		`<cp:coreProperties xmlns:cp="http://schemas.openxmlformats.org/package/2006/metadata/core-properties" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:dcterms="http://purl.org/dc/terms/" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance"/>`,
+	"docProps/app.xml": `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n" +
+		`<Properties xmlns="http://schemas.openxmlformats.org/officeDocument/2006/extended-properties"/>`,
+	"docProps/custom.xml": `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n" +
+		`<Properties xmlns="http://schemas.openxmlformats.org/officeDocument/2006/custom-properties"/>`,
+}
+
+// zip entries are timestamped with the MS-DOS epoch
+var ooxmlTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func sanitizeOOXML(src io.Reader, dst io.Writer) (removed []string, err error) {
+	buf, err := ioutil.ReadAll(src)
+
+	if err != nil {
+		return
+	}
+
+	reader, err := zip.NewReader(bytes.NewReader(buf), int64(len(buf)))
+
+	if err != nil {
+		return
+	}
+
+	writer := zip.NewWriter(dst)
+
+	for _, f := range reader.File {
+		var data []byte
+
+		input, err := f.Open()
+
+		if err != nil {
+			return nil, err
+		}
+
+		data, err = ioutil.ReadAll(input)
+		input.Close()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if empty, ok := ooxmlProperties[f.Name]; ok {
+			for _, field := range xmlFields(data) {
+				removed = append(removed, f.Name+": "+field)
+			}
+
+			data = []byte(empty)
+		}
+
+		header := &zip.FileHeader{
+			Name:     f.Name,
+			Method:   f.Method,
+			Modified: ooxmlTime,
+		}
+
+		w, err := writer.CreateHeader(header)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err = w.Write(data); err != nil {
+			return nil, err
+		}
+	}
+
+	err = writer.Close()
+
+	return
+}
+
+// xmlFields returns the names of the elements with non-empty content.
+func xmlFields(data []byte) (fields []string) {
+	var name string
+
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+
+	for {
+		t, err := decoder.Token()
+
+		if err != nil {
+			return
+		}
+
+		switch e := t.(type) {
+		case xml.StartElement:
+			name = e.Name.Local
+		case xml.EndElement:
+			name = ""
+		case xml.CharData:
+			if name != "" && len(bytes.TrimSpace(e)) > 0 {
+				fields = append(fields, name)
+			}
+		}
+	}
+}
+
+func sanitizePDF(src string, dst string) (removed []string, err error) {
+	if err = pdfTool.Sanitize(src, dst); err != nil {
+		return
+	}
+
+	removed = []string{"PDF document information", "XMP metadata"}
+
+	return
+}
+
+// sanitizeFile strips metadata from the file at osPath, replacing it.
+func sanitizeFile(osPath string) (removed []string, err error) {
+	ext := strings.ToLower(filepath.Ext(osPath))
+	s, ok := sanitizers[ext]
+
+	if !ok && ext != ".pdf" {
+		return nil, fmt.Errorf("unsupported file type %s", ext)
+	}
+
+	info, err := volumeJail().Stat(osPath)
+
+	if err != nil {
+		return
+	}
+
+	output, err := volumeJail().CreateTemp(filepath.Dir(osPath), ".interlock-sanitize-")
+
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		output.Close()
+
+		if err != nil {
+			volumeJail().Remove(output.Name())
+		}
+	}()
+
+	if ext == ".pdf" {
+		removed, err = sanitizePDF(osPath, output.Name())
+	} else {
+		var input *os.File
+
+		if input, err = volumeJail().Open(osPath); err != nil {
+			return
+		}
+
+		removed, err = s(input, output)
+		input.Close()
+	}
+
+	if err != nil {
+		return
+	}
+
+	if err = output.Chmod(info.Mode().Perm()); err != nil {
+		return
+	}
+
+	err = volumeJail().Rename(output.Name(), osPath)
+
+	return
+}
+
+func fileSanitize(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	src, err := absolutePath(req["src"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	removed, err := sanitizeFile(src)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if removed == nil {
+		removed = []string{}
+	}
+
+	res = jsonObject{
+		"status": "OK",
+		"response": map[string]interface{}{
+			"removed": removed,
+		},
+	}
+
+	return
+}
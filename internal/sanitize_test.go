@@ -0,0 +1,131 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func jpegSegment(marker byte, payload string) []byte {
+	s := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(s[2:], uint16(len(payload)+2))
+
+	return append(s, payload...)
+}
+
+func pngChunk(name string, data string) []byte {
+	c := make([]byte, 4)
+	binary.BigEndian.PutUint32(c, uint32(len(data)))
+	c = append(c, name+data...)
+
+	return append(c, binary.BigEndian.AppendUint32(nil, crc32.ChecksumIEEE([]byte(name+data)))...)
+}
+
+func TestSanitizeJPEG(t *testing.T) {
+	buf := new(bytes.Buffer)
+	jpeg.Encode(buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil)
+
+	img := append([]byte{}, buf.Bytes()[:2]...)
+	img = append(img, jpegSegment(0xe1, "Exif\x00\x00GPS")...)
+	img = append(img, jpegSegment(0xfe, "secret comment")...)
+	img = append(img, buf.Bytes()[2:]...)
+
+	out := new(bytes.Buffer)
+	removed, err := sanitizeJPEG(bytes.NewReader(img), out)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(removed, []string{"EXIF", "JPEG comment"}) {
+		t.Errorf("unexpected removed fields: %v", removed)
+	}
+
+	if !bytes.Equal(out.Bytes(), buf.Bytes()) {
+		t.Error("unexpected sanitized image")
+	}
+
+	if _, err = jpeg.Decode(out); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSanitizePNG(t *testing.T) {
+	buf := new(bytes.Buffer)
+	png.Encode(buf, image.NewGray(image.Rect(0, 0, 8, 8)))
+
+	img := append([]byte{}, buf.Bytes()[:len(pngSignature)]...)
+	img = append(img, pngChunk("tEXt", "Author\x00INTERLOCK")...)
+	img = append(img, buf.Bytes()[len(pngSignature):]...)
+
+	out := new(bytes.Buffer)
+	removed, err := sanitizePNG(bytes.NewReader(img), out)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(removed, []string{"PNG tEXt: Author"}) {
+		t.Errorf("unexpected removed fields: %v", removed)
+	}
+
+	if _, err = png.Decode(out); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSanitizeOOXML(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := zip.NewWriter(buf)
+
+	f, _ := w.Create("docProps/core.xml")
+	f.Write([]byte(`<cp:coreProperties xmlns:cp="http://schemas.openxmlformats.org/package/2006/metadata/core-properties" xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:creator>Alice</dc:creator><dc:title></dc:title></cp:coreProperties>`))
+
+	f, _ = w.Create("word/document.xml")
+	f.Write([]byte("<document/>"))
+
+	w.Close()
+
+	out := new(bytes.Buffer)
+	removed, err := sanitizeOOXML(bytes.NewReader(buf.Bytes()), out)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(removed, []string{"docProps/core.xml: creator"}) {
+		t.Errorf("unexpected removed fields: %v", removed)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(out.Bytes()), int64(out.Len()))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range r.File {
+		input, _ := f.Open()
+		data, _ := ioutil.ReadAll(input)
+
+		if bytes.Contains(data, []byte("Alice")) {
+			t.Errorf("%s: metadata not removed", f.Name)
+		}
+
+		if f.Name == "word/document.xml" && string(data) != "<document/>" {
+			t.Errorf("%s: unexpected content %q", f.Name, data)
+		}
+	}
+}
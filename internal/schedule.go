@@ -0,0 +1,190 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"errors"
+	"fmt"
+	"log/syslog"
+	"strings"
+	"time"
+)
+
+// Access windows, the volume can only be unlocked within the configured
+// schedule (device local time). Sessions are closed, and the volume locked,
+// when the window ends. Attempts outside the window are logged and reported
+// with the access_denied event.
+//
+// Windows are expressed as "[days ]HH:MM-HH:MM", days being a comma separated
+// list of days or day ranges (e.g. "Mon-Fri 08:00-20:00", "Sat,Sun
+// 10:00-14:00"), a window ending before its start spans midnight.
+
+const accessCheckInterval = time.Minute
+
+var errAccessWindow = errors.New("access not permitted at this time")
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+type accessWindow struct {
+	days  [7]bool
+	start int
+	end   int
+}
+
+func parseClock(s string) (minutes int, err error) {
+	t, err := time.Parse("15:04", s)
+
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %s", s)
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func parseWeekday(s string) (d time.Weekday, err error) {
+	d, ok := weekdays[strings.ToLower(s)]
+
+	if !ok {
+		err = fmt.Errorf("invalid day %s", s)
+	}
+
+	return
+}
+
+func parseAccessWindow(s string) (w accessWindow, err error) {
+	fields := strings.Fields(s)
+
+	switch len(fields) {
+	case 1:
+		for i := range w.days {
+			w.days[i] = true
+		}
+	case 2:
+		for _, r := range strings.Split(fields[0], ",") {
+			bounds := strings.SplitN(r, "-", 2)
+			first, err := parseWeekday(bounds[0])
+
+			if err != nil {
+				return w, err
+			}
+
+			last := first
+
+			if len(bounds) == 2 {
+				if last, err = parseWeekday(bounds[1]); err != nil {
+					return w, err
+				}
+			}
+
+			for d := first; ; d = (d + 1) % 7 {
+				w.days[d] = true
+
+				if d == last {
+					break
+				}
+			}
+		}
+	default:
+		return w, fmt.Errorf("invalid access window %q", s)
+	}
+
+	clock := strings.SplitN(fields[len(fields)-1], "-", 2)
+
+	if len(clock) != 2 {
+		return w, fmt.Errorf("invalid access window %q", s)
+	}
+
+	if w.start, err = parseClock(clock[0]); err != nil {
+		return
+	}
+
+	w.end, err = parseClock(clock[1])
+
+	return
+}
+
+// contains returns whether t falls within the window, days refer to the
+// local day at time t.
+func (w accessWindow) contains(t time.Time) bool {
+	if !w.days[t.Weekday()] {
+		return false
+	}
+
+	m := t.Hour()*60 + t.Minute()
+
+	if w.start <= w.end {
+		return m >= w.start && m < w.end
+	}
+
+	return m >= w.start || m < w.end
+}
+
+func accessAllowed(t time.Time) bool {
+	if len(conf.AccessWindows) == 0 {
+		return true
+	}
+
+	for _, s := range conf.AccessWindows {
+		if w, err := parseAccessWindow(s); err == nil && w.contains(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkAccessWindow verifies that a login is permitted at the current time.
+func checkAccessWindow(volume string) (err error) {
+	if accessAllowed(time.Now()) {
+		return
+	}
+
+	status.Log(syslog.LOG_WARNING, "login attempt on %s outside access window", volume)
+
+	emitEvent(eventAccessDenied, map[string]interface{}{
+		"volume": volume,
+	})
+
+	return errAccessWindow
+}
+
+func startAccessWindows() (err error) {
+	if len(conf.AccessWindows) == 0 {
+		return
+	}
+
+	for _, s := range conf.AccessWindows {
+		if _, err = parseAccessWindow(s); err != nil {
+			return
+		}
+	}
+
+	go func() {
+		defer recoverJob("access windows")
+
+		for {
+			time.Sleep(accessCheckInterval)
+
+			if !session.Active() || accessAllowed(time.Now()) {
+				continue
+			}
+
+			status.Log(syslog.LOG_NOTICE, "access window closed, locking volume")
+			reportError("access window", closeSession())
+		}
+	}()
+
+	return
+}
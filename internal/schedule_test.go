@@ -0,0 +1,75 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAccessWindow(t *testing.T) {
+	// Monday
+	day := time.Date(2021, 5, 10, 0, 0, 0, 0, time.Local)
+
+	at := func(d int, hm string) time.Time {
+		c, _ := parseClock(hm)
+		return day.AddDate(0, 0, d).Add(time.Duration(c) * time.Minute)
+	}
+
+	tests := []struct {
+		window  string
+		t       time.Time
+		allowed bool
+	}{
+		{"08:00-20:00", at(0, "08:00"), true},
+		{"08:00-20:00", at(0, "20:00"), false},
+		{"08:00-20:00", at(6, "07:59"), false},
+		{"Mon-Fri 08:00-20:00", at(4, "12:00"), true},
+		{"Mon-Fri 08:00-20:00", at(5, "12:00"), false},
+		{"Sat,Sun 10:00-14:00", at(6, "13:59"), true},
+		{"Fri-Mon 10:00-14:00", at(0, "10:00"), true},
+		{"Fri-Mon 10:00-14:00", at(2, "10:00"), false},
+		{"22:00-06:00", at(0, "23:30"), true},
+		{"22:00-06:00", at(0, "05:59"), true},
+		{"22:00-06:00", at(0, "12:00"), false},
+	}
+
+	for _, test := range tests {
+		w, err := parseAccessWindow(test.window)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if w.contains(test.t) != test.allowed {
+			t.Errorf("%s at %v: expected %v", test.window, test.t, test.allowed)
+		}
+	}
+
+	for _, invalid := range []string{"", "8-20", "Mon-Xyz 08:00-20:00", "Mon 08:00", "Mon Tue 08:00-20:00"} {
+		if _, err := parseAccessWindow(invalid); err == nil {
+			t.Errorf("invalid window %q accepted", invalid)
+		}
+	}
+
+	c := newTestServer(t)
+
+	now := time.Now()
+	conf.AccessWindows = []string{now.Add(time.Hour).Format("15:04") + "-" + now.Add(2*time.Hour).Format("15:04")}
+	defer func() { conf.AccessWindows = nil }()
+
+	res := c.call("auth/login", jsonObject{"volume": testVolume, "password": testPassword, "dispose": false})
+
+	if res["status"] != "INVALID_SESSION" {
+		t.Errorf("login outside access window: %v", res)
+	}
+
+	conf.AccessWindows = append(conf.AccessWindows, now.Add(-time.Hour).Format("15:04")+"-"+now.Add(time.Hour).Format("15:04"))
+
+	c.login()
+	c.call("auth/logout", nil)
+}
@@ -0,0 +1,457 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Request schemas, JSON API request attributes are declared per method and
+// validated before reaching handlers, which can therefore rely on the
+// presence and type of required attributes (and on the type of optional
+// ones, when present). Invalid requests are answered with HTTP 400 and the
+// INVALID status.
+
+const (
+	fieldString = "s"
+	fieldBool   = "b"
+	fieldNumber = "n"
+	fieldArray  = "a"
+	fieldAny    = "i"
+)
+
+type field struct {
+	// attribute type
+	Kind string
+	// array elements type
+	Items string
+	// the attribute can be omitted
+	Optional bool
+	// inclusive integer range for numbers
+	Range []int64
+	// allowed values for strings
+	Enum []string
+}
+
+type schema map[string]field
+
+var (
+	requiredString = field{Kind: fieldString}
+	requiredBool   = field{Kind: fieldBool}
+	requiredNumber = field{Kind: fieldNumber}
+	optionalString = field{Kind: fieldString, Optional: true}
+	optionalBool   = field{Kind: fieldBool, Optional: true}
+	stringArray    = field{Kind: fieldArray, Items: fieldString}
+)
+
+var schemas = map[string]schema{
+	"/api/auth/login": {
+		"volume":   requiredString,
+		"password": requiredString,
+		"dispose":  requiredBool,
+		"fido2":    optionalBool,
+		"banner":   optionalBool,
+	},
+	"/api/auth/guest": {
+		"username": requiredString,
+		"password": requiredString,
+	},
+	"/api/auth/piv": {
+		"certificate": optionalString,
+		"nonce":       optionalString,
+		"signature":   optionalString,
+		"banner":      optionalBool,
+	},
+	"/api/auth/keypad": {
+		"volume":  requiredString,
+		"dispose": requiredBool,
+		"banner":  optionalBool,
+	},
+	"/api/auth/nonce": {
+		"method": requiredString,
+	},
+	"/api/luks/change": {
+		"volume":      requiredString,
+		"password":    requiredString,
+		"newpassword": requiredString,
+	},
+	"/api/luks/add": {
+		"volume":      requiredString,
+		"password":    requiredString,
+		"newpassword": requiredString,
+	},
+	"/api/escrow/provision": {
+		"volume":   requiredString,
+		"password": requiredString,
+	},
+	"/api/escrow/recover": {
+		"volume":    requiredString,
+		"share":     requiredString,
+		"signature": requiredString,
+		"banner":    optionalBool,
+	},
+	"/api/luks/remove": {
+		"volume":   requiredString,
+		"password": requiredString,
+	},
+	"/api/config/time": {
+		"epoch": requiredNumber,
+	},
+	"/api/config/readonly": {
+		"readonly": optionalBool,
+	},
+	"/api/config/network/join": {
+		"ssid":     requiredString,
+		"password": optionalString,
+	},
+	"/api/config/network/forget": {
+		"ssid": requiredString,
+	},
+	"/api/acl/set": {
+		"path":      requiredString,
+		"principal": requiredString,
+		"perms":     requiredString,
+	},
+	"/api/honeytoken/add": {
+		"path": requiredString,
+	},
+	"/api/honeytoken/remove": {
+		"path": requiredString,
+	},
+	"/api/guest/create": {
+		"path":     requiredString,
+		"ops":      stringArray,
+		"duration": {Kind: fieldNumber, Range: []int64{1, guestMaxDuration}},
+		"role":     optionalString,
+	},
+	"/api/guest/revoke": {
+		"username": requiredString,
+	},
+	"/api/file/list": {
+		"path":     requiredString,
+		"sha256":   requiredBool,
+		"metadata": optionalBool,
+		"sort":     {Kind: fieldString, Optional: true, Enum: []string{"none", "name", "natural"}},
+	},
+	"/api/file/download": {
+		"path": requiredString,
+	},
+	"/api/file/preview": {
+		"path": requiredString,
+		"size": {Kind: fieldNumber, Optional: true, Range: []int64{previewMinSize, previewMaxSize}},
+	},
+	"/api/file/downloads": {
+		"action": {Kind: fieldString, Enum: []string{"list", "revoke"}},
+		"id":     optionalString,
+	},
+	"/api/file/delete": {
+		"path": stringArray,
+	},
+	"/api/file/mkdir": {
+		"path": stringArray,
+	},
+	"/api/file/move": {
+		"src": stringArray,
+		"dst": requiredString,
+	},
+	"/api/file/copy": {
+		"src": stringArray,
+		"dst": requiredString,
+	},
+	"/api/file/extract": {
+		"src": stringArray,
+		"dst": requiredString,
+	},
+	"/api/file/new": {
+		"path":     requiredString,
+		"contents": requiredString,
+	},
+	"/api/file/compress": {
+		"src":      stringArray,
+		"dst":      requiredString,
+		"password": optionalString,
+	},
+	"/api/file/encrypt": {
+		"src":      requiredString,
+		"cipher":   requiredString,
+		"wipe_src": requiredBool,
+		"sign":     requiredBool,
+		"password": requiredString,
+		"key":      requiredString,
+		"sig_key":  requiredString,
+	},
+	"/api/file/decrypt": {
+		"src":      requiredString,
+		"cipher":   requiredString,
+		"verify":   requiredBool,
+		"password": requiredString,
+		"key":      requiredString,
+		"sig_key":  requiredString,
+	},
+	"/api/file/rewrap": {
+		"src":       requiredString,
+		"dst":       requiredString,
+		"cipher":    requiredString,
+		"password":  requiredString,
+		"key":       requiredString,
+		"recipient": requiredString,
+	},
+	"/api/file/migrate": {
+		"action":   {Kind: fieldString, Enum: []string{"start", "pause", "resume", "stop", "status"}},
+		"path":     optionalString,
+		"cipher":   optionalString,
+		"password": optionalString,
+	},
+	"/api/file/sign": {
+		"src":      requiredString,
+		"cipher":   requiredString,
+		"password": requiredString,
+		"key":      requiredString,
+	},
+	"/api/file/verify": {
+		"src":    requiredString,
+		"sig":    requiredString,
+		"key":    requiredString,
+		"cipher": requiredString,
+	},
+	"/api/file/lock": {
+		"path":    requiredString,
+		"owner":   requiredString,
+		"timeout": {Kind: fieldNumber, Optional: true, Range: []int64{1, maxLockTimeout}},
+	},
+	"/api/file/unlock": {
+		"path":  requiredString,
+		"token": requiredString,
+	},
+	"/api/file/sync": {
+		"path":       requiredString,
+		"op":         {Kind: fieldString, Enum: []string{"signature", "patch"}},
+		"block_size": {Kind: fieldNumber, Optional: true, Range: []int64{1, maxSyncBlockSize}},
+		"delta":      {Kind: fieldArray, Optional: true},
+		"sha256":     optionalString,
+	},
+	"/api/file/export": {
+		"src":      requiredString,
+		"dst":      requiredString,
+		"cipher":   requiredString,
+		"password": requiredString,
+		"key":      requiredString,
+		"sig_key":  requiredString,
+	},
+	"/api/file/import": {
+		"src":      requiredString,
+		"dst":      requiredString,
+		"cipher":   requiredString,
+		"password": requiredString,
+		"key":      requiredString,
+		"sig_key":  requiredString,
+	},
+	"/api/file/pdf": {
+		"src":      requiredString,
+		"dst":      requiredString,
+		"password": requiredString,
+	},
+	"/api/file/sanitize": {
+		"src": requiredString,
+	},
+	"/api/clipboard/cut": {
+		"path": stringArray,
+	},
+	"/api/clipboard/copy": {
+		"path": stringArray,
+	},
+	"/api/clipboard/paste": {
+		"dst": requiredString,
+	},
+	"/api/crypto/keys": {
+		"public":  requiredBool,
+		"private": requiredBool,
+		"filter":  optionalString,
+		"cipher":  optionalString,
+	},
+	"/api/crypto/gen_key": {
+		"identifier": requiredString,
+		"key_format": requiredString,
+		"cipher":     requiredString,
+		"email":      requiredString,
+		"password":   optionalString,
+	},
+	"/api/crypto/upload_key": {
+		"key":  {Kind: fieldAny},
+		"data": requiredString,
+	},
+	"/api/crypto/key_info": {
+		"path": requiredString,
+	},
+	"/api/crypto/revocation": {
+		"path": requiredString,
+	},
+	"/api/crypto/revoke_key": {
+		"path": requiredString,
+	},
+	"/api/transcript/export": {
+		"id":       optionalString,
+		"dst":      requiredString,
+		"key":      requiredString,
+		"password": requiredString,
+		"pdf":      optionalBool,
+	},
+	"/api/journal/resolve": {
+		"id":     requiredString,
+		"action": {Kind: fieldString, Enum: []string{"rollback", "resume"}},
+	},
+	"/api/status/history": {
+		"severity": {Kind: fieldNumber, Optional: true, Range: []int64{0, 7}},
+		"start":    {Kind: fieldNumber, Optional: true, Range: []int64{0, 1<<63 - 1}},
+		"end":      {Kind: fieldNumber, Optional: true, Range: []int64{0, 1<<63 - 1}},
+	},
+}
+
+func validKind(v interface{}, kind string) (ok bool) {
+	switch kind {
+	case fieldString:
+		_, ok = v.(string)
+	case fieldBool:
+		_, ok = v.(bool)
+	case fieldNumber:
+		_, ok = v.(json.Number)
+	case fieldArray:
+		_, ok = v.([]interface{})
+	case fieldAny:
+		ok = v != nil
+	}
+
+	return
+}
+
+func (f field) validate(name string, v interface{}) error {
+	if !validKind(v, f.Kind) {
+		return fmt.Errorf("invalid attribute %s (%s)", name, f.Kind)
+	}
+
+	if f.Items != "" {
+		for _, item := range v.([]interface{}) {
+			if !validKind(item, f.Items) {
+				return fmt.Errorf("invalid attribute %s elements (%s)", name, f.Items)
+			}
+		}
+	}
+
+	if len(f.Range) == 2 {
+		n, err := v.(json.Number).Int64()
+
+		if err != nil || n < f.Range[0] || n > f.Range[1] {
+			return fmt.Errorf("attribute %s out of range (%d-%d)", name, f.Range[0], f.Range[1])
+		}
+	}
+
+	if len(f.Enum) > 0 {
+		for _, e := range f.Enum {
+			if v.(string) == e {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("invalid attribute %s value (%s)", name, strings.Join(f.Enum, ", "))
+	}
+
+	return nil
+}
+
+// Validate verifies the request against the schema, attributes are checked in
+// alphabetical order for consistent errors.
+func (s schema) Validate(req jsonObject) error {
+	names := make([]string, 0, len(s))
+
+	for name := range s {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := s[name]
+		v, ok := req[name]
+
+		if !ok {
+			if f.Optional {
+				continue
+			}
+
+			return fmt.Errorf("missing attribute %s", name)
+		}
+
+		if err := f.validate(name, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// requireAttributes verifies the presence of conditionally required
+// attributes, their type is validated by the method schema.
+func requireAttributes(req jsonObject, names ...string) error {
+	for _, name := range names {
+		if _, ok := req[name]; !ok {
+			return fmt.Errorf("missing attribute %s", name)
+		}
+	}
+
+	return nil
+}
+
+// methods also served as GET requests with query parameters
+var queryRequests = map[string]bool{
+	"/api/file/download": true,
+	"/api/file/preview":  true,
+}
+
+// validateSchema applies the method schema, if any, to the request body which
+// is preserved for the handler. Requests are validated regardless of their
+// HTTP method, as handlers do not distinguish them.
+func validateSchema(r *http.Request) (err error) {
+	s, ok := schemas[r.URL.Path]
+
+	if !ok {
+		return
+	}
+
+	// signed download and preview URLs carry no JSON body
+	if r.Method == http.MethodGet && r.URL.RawQuery != "" && queryRequests[r.URL.Path] {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+
+	if err != nil {
+		return
+	}
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	var req jsonObject
+
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+
+	if err = d.Decode(&req); err != nil {
+		return fmt.Errorf("invalid request: %v", err)
+	}
+
+	return s.Validate(req)
+}
+
+func invalidRequest(w http.ResponseWriter, r *http.Request, err error) {
+	writeResponse(w, http.StatusBadRequest, localize(jsonObject{"status": "INVALID", "response": []string{err.Error()}}, r))
+}
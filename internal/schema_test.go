@@ -0,0 +1,80 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSchema(t *testing.T) {
+	s := schema{
+		"path":    requiredString,
+		"src":     stringArray,
+		"timeout": {Kind: fieldNumber, Optional: true, Range: []int64{1, 10}},
+		"op":      {Kind: fieldString, Optional: true, Enum: []string{"a", "b"}},
+	}
+
+	vectors := map[string]string{
+		`{"path": "/", "src": ["/a"]}`:                 "",
+		`{"path": "/", "src": [], "timeout": 10}`:      "",
+		`{"src": ["/a"]}`:                              "missing attribute path",
+		`{"path": 1, "src": ["/a"]}`:                   "invalid attribute path (s)",
+		`{"path": "/", "src": ["/a", 1]}`:              "invalid attribute src elements (s)",
+		`{"path": "/", "src": [], "timeout": 11}`:      "attribute timeout out of range (1-10)",
+		`{"path": "/", "src": [], "timeout": 1.5}`:     "attribute timeout out of range (1-10)",
+		`{"path": "/", "src": [], "op": "c"}`:          "invalid attribute op value (a, b)",
+		`{"path": "/", "src": [], "timeout": "1"}`:     "invalid attribute timeout (n)",
+		`{"path": "/", "src": [], "unknown": "value"}`: "",
+	}
+
+	for body, expected := range vectors {
+		var req jsonObject
+
+		d := json.NewDecoder(strings.NewReader(body))
+		d.UseNumber()
+		d.Decode(&req)
+
+		err := s.Validate(req)
+
+		if (expected == "" && err != nil) || (expected != "" && (err == nil || err.Error() != expected)) {
+			t.Errorf("%s: unexpected validation result %v", body, err)
+		}
+	}
+}
+
+func TestSchemaMiddleware(t *testing.T) {
+	c := newTestServer(t)
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	r := c.request("POST", "/api/file/list", nil, []byte(`{"path": "/", "sha256": "yes"}`))
+	defer r.Body.Close()
+
+	var res jsonObject
+
+	if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+
+	if r.StatusCode != http.StatusBadRequest || res["status"] != "INVALID" || res["response"].([]interface{})[0] != "invalid attribute sha256 (b)" {
+		t.Errorf("unexpected response to invalid request: %d %v", r.StatusCode, res)
+	}
+
+	if r := c.request("POST", "/api/file/mkdir", nil, []byte(`{"path": ["/a", {}]}`)); r.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid array element accepted: %d", r.StatusCode)
+	}
+
+	if r := c.request("GET", "/api/file/mkdir", nil, []byte(`{}`)); r.StatusCode != http.StatusBadRequest {
+		t.Errorf("GET request not validated: %d", r.StatusCode)
+	}
+
+	c.mustCall("file/list", jsonObject{"path": "/", "sha256": false})
+}
@@ -0,0 +1,193 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"fmt"
+	"log/syslog"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sysfs mount point, overridden for testing
+var sysfsRoot = "/sys"
+
+type sensor struct {
+	Name     string  `json:"name"`
+	Temp     float64 `json:"temp"`
+	Critical float64 `json:"critical"`
+}
+
+type sensorsReport struct {
+	Thermal   []sensor `json:"thermal"`
+	Storage   []sensor `json:"storage"`
+	Throttled bool     `json:"throttled"`
+	Warnings  []string `json:"warnings"`
+}
+
+var sensorsWarning struct {
+	sync.Mutex
+	notification int
+	active       bool
+}
+
+// readMillidegrees reads a sysfs temperature in millidegrees Celsius.
+func readMillidegrees(path string) (temp float64, err error) {
+	s, err := readSysfs(path)
+
+	if err != nil {
+		return
+	}
+
+	t, err := strconv.ParseInt(s, 10, 64)
+
+	return float64(t) / 1000, err
+}
+
+func thermalZones() (sensors []sensor) {
+	zones, _ := filepath.Glob(filepath.Join(sysfsRoot, "class/thermal/thermal_zone*"))
+
+	for _, zone := range zones {
+		temp, err := readMillidegrees(filepath.Join(zone, "temp"))
+
+		if err != nil {
+			continue
+		}
+
+		name, _ := readSysfs(filepath.Join(zone, "type"))
+		s := sensor{Name: name, Temp: temp, Critical: float64(conf.SensorsLimit)}
+
+		trips, _ := filepath.Glob(filepath.Join(zone, "trip_point_*_type"))
+
+		for _, trip := range trips {
+			if t, _ := readSysfs(trip); t != "critical" {
+				continue
+			}
+
+			path := trip[:len(trip)-len("type")] + "temp"
+
+			if critical, err := readMillidegrees(path); err == nil && critical > 0 {
+				s.Critical = critical
+			}
+		}
+
+		sensors = append(sensors, s)
+	}
+
+	return
+}
+
+// storageSensors returns temperatures of hwmon devices exposed by storage
+// drivers (SATA drivetemp, NVMe).
+func storageSensors() (sensors []sensor) {
+	devices, _ := filepath.Glob(filepath.Join(sysfsRoot, "class/hwmon/hwmon*"))
+
+	for _, dev := range devices {
+		name, _ := readSysfs(filepath.Join(dev, "name"))
+
+		if name != "drivetemp" && name != "nvme" {
+			continue
+		}
+
+		temp, err := readMillidegrees(filepath.Join(dev, "temp1_input"))
+
+		if err != nil {
+			continue
+		}
+
+		s := sensor{Name: name, Temp: temp, Critical: float64(conf.SensorsLimit)}
+
+		if critical, err := readMillidegrees(filepath.Join(dev, "temp1_crit")); err == nil && critical > 0 {
+			s.Critical = critical
+		}
+
+		sensors = append(sensors, s)
+	}
+
+	return
+}
+
+// throttled reports whether any CPU frequency cooling device is active.
+func throttled() bool {
+	devices, _ := filepath.Glob(filepath.Join(sysfsRoot, "class/thermal/cooling_device*"))
+
+	for _, dev := range devices {
+		if t, _ := readSysfs(filepath.Join(dev, "type")); t == "Processor" || strings.Contains(t, "cpufreq") {
+			if state, _ := readSysfs(filepath.Join(dev, "cur_state")); state != "" && state != "0" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func readSensors() (report sensorsReport) {
+	report = sensorsReport{
+		Thermal:   thermalZones(),
+		Storage:   storageSensors(),
+		Throttled: throttled(),
+		Warnings:  []string{},
+	}
+
+	for _, s := range append(append([]sensor{}, report.Thermal...), report.Storage...) {
+		if s.Temp >= s.Critical-float64(conf.SensorsMargin) {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("%s temperature (%.1f C) close to thermal limit (%.1f C)", s.Name, s.Temp, s.Critical))
+		}
+	}
+
+	if report.Throttled {
+		report.Warnings = append(report.Warnings, "CPU throttling active")
+	}
+
+	return
+}
+
+func checkSensors() {
+	report := readSensors()
+
+	sensorsWarning.Lock()
+	defer sensorsWarning.Unlock()
+
+	if len(report.Warnings) > 0 && !sensorsWarning.active {
+		sensorsWarning.notification = status.Notify(syslog.LOG_WARNING, "%s, consider pausing cryptographic operations", report.Warnings[0])
+		sensorsWarning.active = true
+	}
+
+	if len(report.Warnings) == 0 && sensorsWarning.active {
+		status.Remove(sensorsWarning.notification)
+		status.Log(syslog.LOG_NOTICE, "temperature back within limits")
+		sensorsWarning.active = false
+	}
+}
+
+func startSensorsMonitor() {
+	if conf.SensorsInterval <= 0 {
+		return
+	}
+
+	go func() {
+		defer recoverJob("sensors monitor")
+
+		for {
+			checkSensors()
+			time.Sleep(time.Duration(conf.SensorsInterval) * time.Second)
+		}
+	}()
+}
+
+func sensorsStatus() (res jsonObject) {
+	res = jsonObject{
+		"status":   "OK",
+		"response": readSensors(),
+	}
+
+	return
+}
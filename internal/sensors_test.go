@@ -0,0 +1,53 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSensors(t *testing.T) {
+	conf.SetDefaults()
+
+	sysfsRoot = t.TempDir()
+	defer func() { sysfsRoot = "/sys" }()
+
+	files := map[string]string{
+		"class/thermal/thermal_zone0/type":              "cpu-thermal",
+		"class/thermal/thermal_zone0/temp":              "91000",
+		"class/thermal/thermal_zone0/trip_point_0_type": "passive",
+		"class/thermal/thermal_zone0/trip_point_0_temp": "85000",
+		"class/thermal/thermal_zone0/trip_point_1_type": "critical",
+		"class/thermal/thermal_zone0/trip_point_1_temp": "100000",
+		"class/thermal/cooling_device0/type":            "thermal-cpufreq-0",
+		"class/thermal/cooling_device0/cur_state":       "1",
+		"class/hwmon/hwmon0/name":                       "drivetemp",
+		"class/hwmon/hwmon0/temp1_input":                "40000",
+	}
+
+	for p, v := range files {
+		os.MkdirAll(filepath.Join(sysfsRoot, filepath.Dir(p)), 0700)
+		ioutil.WriteFile(filepath.Join(sysfsRoot, p), []byte(v+"\n"), 0600)
+	}
+
+	report := readSensors()
+
+	if len(report.Thermal) != 1 || report.Thermal[0].Temp != 91 || report.Thermal[0].Critical != 100 {
+		t.Errorf("unexpected thermal zones: %+v", report.Thermal)
+	}
+
+	if len(report.Storage) != 1 || report.Storage[0].Temp != 40 || report.Storage[0].Critical != 85 {
+		t.Errorf("unexpected storage sensors: %+v", report.Storage)
+	}
+
+	if !report.Throttled || len(report.Warnings) != 2 {
+		t.Errorf("unexpected warnings: %+v", report)
+	}
+}
@@ -7,29 +7,140 @@
 package interlock
 
 import (
-	"crypto/subtle"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"sync"
 	"time"
 )
 
+// session binding levels, a session is invalidated when the client address
+// (or its subnet) or TLS connection parameters change
+const (
+	bindingOff    = "off"
+	bindingSubnet = "subnet"
+	bindingIP     = "ip"
+	bindingStrict = "strict"
+)
+
+// XSRF one-time tokens validity and grace period for previous tokens
+// replaced on expiration
+const (
+	xsrfNonceTTL  = 60 * time.Second
+	xsrfMaxNonces = 16
+	xsrfGrace     = 30 * time.Second
+)
+
+// XSRFNonceHeader carries the one-time token required by destructive
+// requests, in addition to the session XSRF token.
+const XSRFNonceHeader = "X-XSRFNonce"
+
+// oneTimeRequests lists the API methods requiring a one-time XSRF token.
+var oneTimeRequests = map[string]bool{
+	"/api/auth/poweroff": true,
+	"/api/luks/remove":   true,
+	"/api/file/delete":   true,
+}
+
+var errSessionMoved = errors.New("session used from a different client")
+
+type xsrfNonce struct {
+	uri    string
+	expiry time.Time
+}
+
 type sessionData struct {
 	sync.Mutex
 	Volume    string
 	SessionID string // only a single session can be active at any time
 	XSRFToken string
 	createdAt *time.Time
+
+	xsrfIssued   time.Time
+	xsrfPrevious string
+	xsrfExpiry   time.Time
+	nonces       map[string]xsrfNonce
+
+	remote      string
+	fingerprint string
 }
 
 var session sessionData
 
+// clientAddress returns the request address, masked according to the binding
+// level.
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+
+	if ip == nil || conf.SessionBinding != bindingSubnet {
+		return host
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
+
+// tlsFingerprint identifies the TLS connection parameters negotiated by the
+// client, including its certificate if any.
+func tlsFingerprint(r *http.Request) string {
+	if r.TLS == nil {
+		return ""
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%x:%x:%s:%s", r.TLS.Version, r.TLS.CipherSuite, r.TLS.NegotiatedProtocol, r.TLS.ServerName)
+
+	for _, cert := range r.TLS.PeerCertificates {
+		h.Write(cert.Raw)
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Bind records the client identity for the configured session binding.
+func (s *sessionData) Bind(r *http.Request) {
+	session.Lock()
+	defer session.Unlock()
+
+	session.remote = clientAddress(r)
+	session.fingerprint = tlsFingerprint(r)
+}
+
+// bound verifies the request against the session binding, sessions opened
+// without a request (console unlock) are not bound.
+func (s *sessionData) bound(r *http.Request) bool {
+	if session.remote == "" && session.fingerprint == "" {
+		return true
+	}
+
+	switch conf.SessionBinding {
+	case bindingSubnet, bindingIP:
+		return session.remote == clientAddress(r)
+	case bindingStrict:
+		return session.remote == clientAddress(r) && session.fingerprint == tlsFingerprint(r)
+	default:
+		return true
+	}
+}
+
 func (s *sessionData) Validate(r *http.Request) (validSessionID bool, validXSRFToken bool, err error) {
 	validSessionID = false
 	validXSRFToken = false
 
-	sessionID, err := r.Cookie(sessionCookie)
+	sessionID, err := r.Cookie(conf.CookieName)
 
 	if err != nil {
 		return
@@ -40,18 +151,30 @@ func (s *sessionData) Validate(r *http.Request) (validSessionID bool, validXSRFT
 	session.Lock()
 	defer session.Unlock()
 
-	if subtle.ConstantTimeCompare([]byte(session.SessionID), []byte(sessionID.Value)) == 1 {
+	if secretEqual(session.SessionID, sessionID.Value) {
 		validSessionID = true
 	} else {
 		err = errors.New("invalid session")
 	}
 
-	if subtle.ConstantTimeCompare([]byte(session.XSRFToken), []byte(XSRFToken)) == 1 {
+	if validSessionID && !session.bound(r) {
+		return false, false, errSessionMoved
+	}
+
+	if secretEqual(session.XSRFToken, XSRFToken) {
+		validXSRFToken = true
+	} else if session.xsrfPrevious != "" && time.Now().Before(session.xsrfExpiry) &&
+		secretEqual(session.xsrfPrevious, XSRFToken) {
 		validXSRFToken = true
 	} else {
 		err = errors.New("missing XSRFToken")
 	}
 
+	if validXSRFToken && conf.XSRFMaxAge > 0 && time.Since(session.xsrfIssued) > time.Duration(conf.XSRFMaxAge)*time.Second {
+		validXSRFToken = false
+		err = errors.New("expired XSRFToken")
+	}
+
 	return
 }
 
@@ -70,6 +193,115 @@ func (s *sessionData) Set(volume string, sessionID string, XSRFToken string) {
 	session.SessionID = sessionID
 	session.XSRFToken = XSRFToken
 	session.createdAt = &now
+	session.xsrfIssued = now
+	session.xsrfPrevious = ""
+	session.nonces = nil
+}
+
+// RotateXSRFToken replaces the session XSRF token, the previous one is
+// immediately invalidated.
+func (s *sessionData) RotateXSRFToken() (XSRFToken string, err error) {
+	return session.replaceXSRFToken(false)
+}
+
+// RenewXSRFToken replaces the session XSRF token when past half its maximum
+// age, the previous one remains valid for a short grace period to allow
+// requests already in flight. An empty token is returned when no renewal is
+// needed.
+func (s *sessionData) RenewXSRFToken() (XSRFToken string, err error) {
+	session.Lock()
+	renew := conf.XSRFMaxAge > 0 && time.Since(session.xsrfIssued) > time.Duration(conf.XSRFMaxAge)*time.Second/2
+	session.Unlock()
+
+	if !renew {
+		return
+	}
+
+	return session.replaceXSRFToken(true)
+}
+
+func (s *sessionData) replaceXSRFToken(grace bool) (XSRFToken string, err error) {
+	XSRFToken, err = randomString(cookieSize)
+
+	if err != nil {
+		return
+	}
+
+	session.Lock()
+	defer session.Unlock()
+
+	if grace {
+		session.xsrfPrevious = session.XSRFToken
+		session.xsrfExpiry = time.Now().Add(xsrfGrace)
+	} else {
+		session.xsrfPrevious = ""
+	}
+
+	session.XSRFToken = XSRFToken
+	session.xsrfIssued = time.Now()
+
+	return
+}
+
+// Nonce issues a one-time XSRF token valid for a single request to the
+// argument API method.
+func (s *sessionData) Nonce(uri string) (nonce string, err error) {
+	if !oneTimeRequests[uri] {
+		return "", fmt.Errorf("method %s does not require a one-time token", uri)
+	}
+
+	nonce, err = randomString(cookieSize)
+
+	if err != nil {
+		return
+	}
+
+	session.Lock()
+	defer session.Unlock()
+
+	if session.nonces == nil {
+		session.nonces = make(map[string]xsrfNonce)
+	}
+
+	now := time.Now()
+
+	for n, v := range session.nonces {
+		if now.After(v.expiry) {
+			delete(session.nonces, n)
+		}
+	}
+
+	if len(session.nonces) >= xsrfMaxNonces {
+		return "", errors.New("too many pending one-time tokens")
+	}
+
+	session.nonces[nonce] = xsrfNonce{uri: uri, expiry: now.Add(xsrfNonceTTL)}
+
+	return
+}
+
+// ConsumeNonce verifies, and invalidates, the one-time XSRF token of a
+// request to the argument API method.
+func (s *sessionData) ConsumeNonce(uri string, nonce string) bool {
+	session.Lock()
+	defer session.Unlock()
+
+	v, ok := session.nonces[nonce]
+
+	if !ok || nonce == "" {
+		return false
+	}
+
+	delete(session.nonces, nonce)
+
+	return v.uri == uri && time.Now().Before(v.expiry)
+}
+
+func (s *sessionData) Active() bool {
+	session.Lock()
+	defer session.Unlock()
+
+	return session.SessionID != ""
 }
 
 func (s *sessionData) Clear() {
@@ -79,4 +311,8 @@ func (s *sessionData) Clear() {
 	session.Volume = ""
 	session.SessionID = ""
 	session.XSRFToken = ""
+	session.xsrfPrevious = ""
+	session.nonces = nil
+	session.remote = ""
+	session.fingerprint = ""
 }
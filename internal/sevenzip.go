@@ -0,0 +1,551 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"log/syslog"
+	"os"
+	"path"
+	"strings"
+	"unicode/utf16"
+)
+
+// 7z archive creation, file contents are stored (Copy method) in a single
+// solid stream which is encrypted with the 7zAES coder (AES-256-CBC, key
+// derived from the password with 2^19 rounds of SHA256) when a password is
+// specified. File names are not encrypted.
+
+var sevenZipSignature = []byte{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c, 0, 4}
+
+const sevenZipSignatureSize = 32
+const sevenZipCyclesPower = 19
+
+// coder identifiers
+var (
+	sevenZipCopy = []byte{0x00}
+	sevenZipAES  = []byte{0x06, 0xf1, 0x07, 0x01}
+)
+
+// property identifiers
+const (
+	sevenZipEnd             = 0x00
+	sevenZipHeader          = 0x01
+	sevenZipMainStreamsInfo = 0x04
+	sevenZipFilesInfo       = 0x05
+	sevenZipPackInfo        = 0x06
+	sevenZipUnpackInfo      = 0x07
+	sevenZipSubStreamsInfo  = 0x08
+	sevenZipSize            = 0x09
+	sevenZipCRC             = 0x0a
+	sevenZipFolder          = 0x0b
+	sevenZipCodersUnpack    = 0x0c
+	sevenZipNumUnpackStream = 0x0d
+	sevenZipEmptyStream     = 0x0e
+	sevenZipEmptyFile       = 0x0f
+	sevenZipName            = 0x11
+	sevenZipMTime           = 0x14
+	sevenZipAttributes      = 0x15
+)
+
+// Windows attributes, the high 16 bits carry the unix mode
+const (
+	sevenZipAttrDirectory = 0x10
+	sevenZipAttrUnix      = 0x8000
+)
+
+type sevenZipEntry struct {
+	name    string
+	osPath  string
+	target  string
+	info    os.FileInfo
+	size    uint64
+	crc     uint32
+	symlink bool
+}
+
+func (e *sevenZipEntry) empty() bool {
+	return e.info.IsDir() || e.size == 0
+}
+
+type sevenZipBuffer struct {
+	bytes.Buffer
+}
+
+// WriteNumber encodes 7z variable length integers.
+func (b *sevenZipBuffer) WriteNumber(value uint64) {
+	var first byte
+	var i int
+
+	mask := byte(0x80)
+
+	for i = 0; i < 8; i++ {
+		if value < uint64(1)<<(7*(uint(i)+1)) {
+			first |= byte(value >> (8 * uint(i)))
+			break
+		}
+
+		first |= mask
+		mask >>= 1
+	}
+
+	b.WriteByte(first)
+
+	for ; i > 0; i-- {
+		b.WriteByte(byte(value))
+		value >>= 8
+	}
+}
+
+func (b *sevenZipBuffer) WriteUint32(value uint32) {
+	binary.Write(b, binary.LittleEndian, value)
+}
+
+func (b *sevenZipBuffer) WriteUint64(value uint64) {
+	binary.Write(b, binary.LittleEndian, value)
+}
+
+func (b *sevenZipBuffer) WriteBits(bits []bool) {
+	var v byte
+
+	for i, bit := range bits {
+		if bit {
+			v |= 0x80 >> uint(i%8)
+		}
+
+		if i%8 == 7 {
+			b.WriteByte(v)
+			v = 0
+		}
+	}
+
+	if len(bits)%8 != 0 {
+		b.WriteByte(v)
+	}
+}
+
+// WriteProperty writes a file property, prefixed with its size.
+func (b *sevenZipBuffer) WriteProperty(id byte, data []byte) {
+	b.WriteByte(id)
+	b.WriteNumber(uint64(len(data)))
+	b.Write(data)
+}
+
+// sevenZipKey derives the 7zAES key from the password (UTF-16LE).
+func sevenZipKey(password string, salt []byte, cyclesPower uint) []byte {
+	var pw []byte
+
+	for _, c := range utf16.Encode([]rune(password)) {
+		pw = append(pw, byte(c), byte(c>>8))
+	}
+
+	h := sha256.New()
+	counter := make([]byte, 8)
+
+	for i := uint64(0); i < uint64(1)<<cyclesPower; i++ {
+		binary.LittleEndian.PutUint64(counter, i)
+		h.Write(salt)
+		h.Write(pw)
+		h.Write(counter)
+	}
+
+	return h.Sum(nil)
+}
+
+// sevenZipCBC encrypts the packed stream, the last block is zero padded.
+type sevenZipCBC struct {
+	mode cipher.BlockMode
+	w    io.Writer
+	buf  []byte
+}
+
+func (c *sevenZipCBC) Write(p []byte) (n int, err error) {
+	c.buf = append(c.buf, p...)
+	blocks := len(c.buf) - len(c.buf)%aes.BlockSize
+
+	if blocks > 0 {
+		c.mode.CryptBlocks(c.buf[:blocks], c.buf[:blocks])
+
+		if _, err = c.w.Write(c.buf[:blocks]); err != nil {
+			return
+		}
+
+		c.buf = append(c.buf[:0], c.buf[blocks:]...)
+	}
+
+	return len(p), nil
+}
+
+func (c *sevenZipCBC) Close() (err error) {
+	if len(c.buf) == 0 {
+		return
+	}
+
+	c.buf = append(c.buf, make([]byte, aes.BlockSize-len(c.buf))...)
+	c.mode.CryptBlocks(c.buf, c.buf)
+	_, err = c.w.Write(c.buf)
+
+	return
+}
+
+type countingWriter struct {
+	w     io.Writer
+	count uint64
+}
+
+func (c *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = c.w.Write(p)
+	c.count += uint64(n)
+	return
+}
+
+func sevenZipEntries(src []string) (entries []*sevenZipEntry, err error) {
+	walkFn := func(osPath string, info os.FileInfo, e error) (err error) {
+		if e != nil {
+			return e
+		}
+
+		entry := &sevenZipEntry{
+			name:   strings.TrimPrefix(relativePath(osPath), "/"),
+			osPath: osPath,
+			info:   info,
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			var linked os.FileInfo
+
+			entry.target, linked, err = archiveLink(osPath)
+
+			if err != nil {
+				return
+			}
+
+			if linked != nil {
+				entry.info = linked
+			} else {
+				entry.symlink = true
+			}
+		}
+
+		switch {
+		case entry.symlink:
+			entry.size = uint64(len(entry.target))
+		case entry.info.Mode().IsRegular():
+			entry.size = uint64(entry.info.Size())
+		case !entry.info.IsDir():
+			return
+		}
+
+		entries = append(entries, entry)
+
+		return
+	}
+
+	for _, s := range src {
+		if err = volumeJail().Walk(s, walkFn); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// sevenZipWriter writes a 7z archive of the source paths, dst must be
+// seekable as the signature header is written last.
+func sevenZipWriter(src []string, dst io.WriteSeeker, password string) (written int64, err error) {
+	entries, err := sevenZipEntries(src)
+
+	if err != nil {
+		return
+	}
+
+	if _, err = dst.Write(make([]byte, sevenZipSignatureSize)); err != nil {
+		return
+	}
+
+	packed := &countingWriter{w: dst}
+	var stream io.Writer = packed
+	var cbc *sevenZipCBC
+	var coder []byte
+	var props []byte
+
+	if password != "" {
+		iv := make([]byte, aes.BlockSize)
+
+		if _, err = io.ReadFull(rand.Reader, iv); err != nil {
+			return
+		}
+
+		block, err := aes.NewCipher(sevenZipKey(password, nil, sevenZipCyclesPower))
+
+		if err != nil {
+			return 0, err
+		}
+
+		cbc = &sevenZipCBC{mode: cipher.NewCBCEncrypter(block, iv), w: packed}
+		stream = cbc
+		coder = sevenZipAES
+		// no salt, 16 bytes iv
+		props = append([]byte{sevenZipCyclesPower | 0x40, aes.BlockSize - 1}, iv...)
+	} else {
+		coder = sevenZipCopy
+	}
+
+	for _, entry := range entries {
+		if entry.empty() {
+			continue
+		}
+
+		n := status.Notify(syslog.LOG_NOTICE, "adding %s to archive", path.Base(entry.osPath))
+		crc := crc32.NewIEEE()
+
+		if entry.symlink {
+			_, err = io.WriteString(io.MultiWriter(stream, crc), entry.target)
+		} else {
+			err = copyFile(entry.osPath, io.MultiWriter(stream, crc), entry.size)
+		}
+
+		status.Remove(n)
+
+		if err != nil {
+			return
+		}
+
+		entry.crc = crc.Sum32()
+		written += int64(entry.size)
+	}
+
+	if cbc != nil {
+		if err = cbc.Close(); err != nil {
+			return
+		}
+	}
+
+	header := sevenZipHeaderData(entries, packed.count, uint64(written), coder, props)
+
+	if _, err = dst.Write(header); err != nil {
+		return
+	}
+
+	start := &sevenZipBuffer{}
+	start.WriteUint64(packed.count)
+	start.WriteUint64(uint64(len(header)))
+	start.WriteUint32(crc32.ChecksumIEEE(header))
+
+	signature := &sevenZipBuffer{}
+	signature.Write(sevenZipSignature)
+	signature.WriteUint32(crc32.ChecksumIEEE(start.Bytes()))
+	signature.Write(start.Bytes())
+
+	if _, err = dst.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+
+	_, err = dst.Write(signature.Bytes())
+
+	return
+}
+
+// copyFile copies exactly size bytes, detecting files modified while being
+// archived.
+func copyFile(osPath string, w io.Writer, size uint64) (err error) {
+	input, err := volumeJail().Open(osPath)
+
+	if err != nil {
+		return
+	}
+	defer input.Close()
+
+	n, err := io.Copy(w, io.LimitReader(input, int64(size)))
+
+	if err == nil && uint64(n) != size {
+		err = errors.New("file modified during archive creation: " + relativePath(osPath))
+	}
+
+	return
+}
+
+func sevenZipHeaderData(entries []*sevenZipEntry, packSize uint64, unpackSize uint64, coder []byte, props []byte) []byte {
+	b := &sevenZipBuffer{}
+	b.WriteByte(sevenZipHeader)
+
+	var streams []*sevenZipEntry
+
+	for _, entry := range entries {
+		if !entry.empty() {
+			streams = append(streams, entry)
+		}
+	}
+
+	if len(streams) > 0 {
+		b.WriteByte(sevenZipMainStreamsInfo)
+
+		b.WriteByte(sevenZipPackInfo)
+		b.WriteNumber(0)
+		b.WriteNumber(1)
+		b.WriteByte(sevenZipSize)
+		b.WriteNumber(packSize)
+		b.WriteByte(sevenZipEnd)
+
+		b.WriteByte(sevenZipUnpackInfo)
+		b.WriteByte(sevenZipFolder)
+		b.WriteNumber(1)
+		b.WriteByte(0)
+		// single simple coder
+		b.WriteNumber(1)
+
+		if len(props) > 0 {
+			b.WriteByte(byte(len(coder)) | 0x20)
+			b.Write(coder)
+			b.WriteNumber(uint64(len(props)))
+			b.Write(props)
+		} else {
+			b.WriteByte(byte(len(coder)))
+			b.Write(coder)
+		}
+
+		b.WriteByte(sevenZipCodersUnpack)
+		b.WriteNumber(unpackSize)
+		b.WriteByte(sevenZipEnd)
+
+		b.WriteByte(sevenZipSubStreamsInfo)
+		b.WriteByte(sevenZipNumUnpackStream)
+		b.WriteNumber(uint64(len(streams)))
+
+		if len(streams) > 1 {
+			b.WriteByte(sevenZipSize)
+
+			for _, entry := range streams[:len(streams)-1] {
+				b.WriteNumber(entry.size)
+			}
+		}
+
+		b.WriteByte(sevenZipCRC)
+		b.WriteByte(1)
+
+		for _, entry := range streams {
+			b.WriteUint32(entry.crc)
+		}
+
+		b.WriteByte(sevenZipEnd)
+		b.WriteByte(sevenZipEnd)
+	}
+
+	b.WriteByte(sevenZipFilesInfo)
+	b.WriteNumber(uint64(len(entries)))
+
+	if len(streams) != len(entries) {
+		var emptyStream []bool
+		var emptyFile []bool
+
+		for _, entry := range entries {
+			emptyStream = append(emptyStream, entry.empty())
+
+			if entry.empty() {
+				emptyFile = append(emptyFile, !entry.info.IsDir())
+			}
+		}
+
+		bits := &sevenZipBuffer{}
+		bits.WriteBits(emptyStream)
+		b.WriteProperty(sevenZipEmptyStream, bits.Bytes())
+
+		bits.Reset()
+		bits.WriteBits(emptyFile)
+		b.WriteProperty(sevenZipEmptyFile, bits.Bytes())
+	}
+
+	names := &sevenZipBuffer{}
+	names.WriteByte(0)
+
+	for _, entry := range entries {
+		for _, c := range utf16.Encode([]rune(entry.name)) {
+			names.WriteByte(byte(c))
+			names.WriteByte(byte(c >> 8))
+		}
+
+		names.Write([]byte{0, 0})
+	}
+
+	b.WriteProperty(sevenZipName, names.Bytes())
+
+	times := &sevenZipBuffer{}
+	times.Write([]byte{1, 0})
+
+	for _, entry := range entries {
+		// Windows FILETIME, 100ns intervals since 1601-01-01
+		times.WriteUint64(uint64(entry.info.ModTime().UnixNano()/100) + 116444736000000000)
+	}
+
+	b.WriteProperty(sevenZipMTime, times.Bytes())
+
+	attributes := &sevenZipBuffer{}
+	attributes.Write([]byte{1, 0})
+
+	for _, entry := range entries {
+		mode := uint32(entry.info.Mode().Perm())
+		attr := uint32(sevenZipAttrUnix)
+
+		switch {
+		case entry.symlink:
+			mode |= 0120000
+		case entry.info.IsDir():
+			mode |= 0040000
+			attr |= sevenZipAttrDirectory
+		default:
+			mode |= 0100000
+		}
+
+		attributes.WriteUint32(attr | mode<<16)
+	}
+
+	b.WriteProperty(sevenZipAttributes, attributes.Bytes())
+
+	b.WriteByte(sevenZipEnd)
+	b.WriteByte(sevenZipEnd)
+
+	return b.Bytes()
+}
+
+func sevenZipPath(owner string, src []string, dst string, password string) (err error) {
+	output, err := createAtomic("compress", "", dst, true)
+
+	if err != nil {
+		return
+	}
+
+	jobs.Go(owner, "compressing archive", func() {
+
+		n := status.Notify(syslog.LOG_NOTICE, "compressing %s", path.Base(dst))
+		defer status.Remove(n)
+
+		_, err = sevenZipWriter(src, output.File, password)
+
+		if err == nil {
+			err = output.Commit()
+		} else {
+			output.Abort()
+		}
+
+		if err != nil {
+			status.Error(err)
+			return
+		}
+
+		status.Log(syslog.LOG_NOTICE, "completed compression to %s", relativePath(dst))
+	})
+
+	return
+}
@@ -0,0 +1,115 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"crypto/rand"
+	"errors"
+)
+
+// Shamir's Secret Sharing over GF(2^8), each secret byte is the constant term
+// of a random polynomial of degree threshold-1 evaluated, for each share, at
+// its x coordinate (1-255). Shares are encoded as their x coordinate followed
+// by the evaluation of all polynomials.
+
+// gfMul multiplies in GF(2^8) with the AES reduction polynomial
+// (x^8 + x^4 + x^3 + x + 1), in constant time.
+func gfMul(a byte, b byte) (p byte) {
+	for i := 0; i < 8; i++ {
+		p ^= -(b & 1) & a
+		a = (a << 1) ^ (-(a >> 7) & 0x1b)
+		b >>= 1
+	}
+
+	return
+}
+
+// gfInv returns the multiplicative inverse as a^254.
+func gfInv(a byte) (r byte) {
+	r = 1
+
+	for i := 0; i < 254; i++ {
+		r = gfMul(r, a)
+	}
+
+	return
+}
+
+// shamirSplit splits the secret in n shares, any threshold of which allow its
+// recovery.
+func shamirSplit(secret []byte, n int, threshold int) (shares [][]byte, err error) {
+	if threshold < 1 || n < threshold || n > 255 {
+		return nil, errors.New("invalid secret sharing parameters")
+	}
+
+	coefficients := make([]byte, len(secret)*(threshold-1))
+
+	if _, err = rand.Read(coefficients); err != nil {
+		return
+	}
+
+	for x := 1; x <= n; x++ {
+		share := make([]byte, len(secret)+1)
+		share[0] = byte(x)
+
+		for i, s := range secret {
+			// Horner's method
+			var y byte
+
+			for j := threshold - 2; j >= 0; j-- {
+				y = gfMul(y^coefficients[i*(threshold-1)+j], byte(x))
+			}
+
+			share[i+1] = y ^ s
+		}
+
+		shares = append(shares, share)
+	}
+
+	return
+}
+
+// shamirCombine recovers the secret from the argument shares with Lagrange
+// interpolation at x = 0.
+func shamirCombine(shares [][]byte) (secret []byte, err error) {
+	if len(shares) == 0 {
+		return nil, errors.New("no shares")
+	}
+
+	size := len(shares[0])
+
+	for i, s := range shares {
+		if len(s) != size || size < 2 || s[0] == 0 {
+			return nil, errors.New("invalid share")
+		}
+
+		for _, p := range shares[:i] {
+			if p[0] == s[0] {
+				return nil, errors.New("duplicate share")
+			}
+		}
+	}
+
+	secret = make([]byte, size-1)
+
+	for i, si := range shares {
+		// Lagrange basis polynomial at 0
+		l := byte(1)
+
+		for j, sj := range shares {
+			if i != j {
+				l = gfMul(l, gfMul(sj[0], gfInv(si[0]^sj[0])))
+			}
+		}
+
+		for k := range secret {
+			secret[k] ^= gfMul(si[k+1], l)
+		}
+	}
+
+	return
+}
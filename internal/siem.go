@@ -0,0 +1,319 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"log/syslog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SIEM export, audit log entries are streamed in CEF or JSON Lines format
+// over TCP or TLS. Entries are spooled to the encrypted volume (or kept in
+// memory while it is locked) when the collector is unreachable, and delivered
+// on reconnection.
+//
+// Delivery errors are reported on the standard logger only, as audit entries
+// would be re-exported.
+
+const (
+	siemJSON = "json"
+	siemCEF  = "cef"
+)
+
+const siemSpool = ".interlock-siem.spool"
+const siemQueueSize = 1000
+const siemMemorySize = 1000
+
+var siemRetry = 30 * time.Second
+
+type siemExporter struct {
+	sync.Mutex
+	queue     chan statusEntry
+	conn      net.Conn
+	lastDial  time.Time
+	memory    []string
+	dropped   int
+	tlsConfig *tls.Config
+}
+
+var siem siemExporter
+
+func startSIEM() (err error) {
+	if conf.SIEMAddress == "" {
+		return
+	}
+
+	switch conf.SIEMFormat {
+	case siemJSON, siemCEF:
+	default:
+		return fmt.Errorf("invalid siem_format %s", conf.SIEMFormat)
+	}
+
+	if conf.SIEMTLS {
+		siem.tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+
+		if conf.SIEMCA != "" {
+			ca, err := ioutil.ReadFile(conf.SIEMCA)
+
+			if err != nil {
+				return err
+			}
+
+			pool := x509.NewCertPool()
+
+			if ok := pool.AppendCertsFromPEM(ca); !ok {
+				return errors.New("could not parse SIEM certificate authority")
+			}
+
+			siem.tlsConfig.RootCAs = pool
+		}
+	}
+
+	siem.queue = make(chan statusEntry, siemQueueSize)
+
+	go func() {
+		defer recoverJob("SIEM export")
+
+		ticker := time.NewTicker(siemRetry)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case e := <-siem.queue:
+				siem.deliver(siem.format(e))
+			case <-ticker.C:
+				siem.flush()
+			}
+		}
+	}()
+
+	return
+}
+
+// Export queues an audit log entry, it never blocks.
+func (s *siemExporter) Export(e statusEntry) {
+	if s.queue == nil {
+		return
+	}
+
+	select {
+	case s.queue <- e:
+	default:
+		s.Lock()
+		s.dropped++
+		s.Unlock()
+	}
+}
+
+var cefSeverity = map[syslog.Priority]int{
+	syslog.LOG_EMERG:   10,
+	syslog.LOG_ALERT:   9,
+	syslog.LOG_CRIT:    8,
+	syslog.LOG_ERR:     7,
+	syslog.LOG_WARNING: 5,
+	syslog.LOG_NOTICE:  3,
+	syslog.LOG_INFO:    2,
+	syslog.LOG_DEBUG:   1,
+}
+
+var cefHeaderEscape = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ")
+var cefExtensionEscape = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+
+func (s *siemExporter) format(e statusEntry) string {
+	host, _ := os.Hostname()
+
+	if conf.SIEMFormat == siemCEF {
+		return fmt.Sprintf("CEF:0|F-Secure|INTERLOCK|%s|%d|%s|%d|rt=%d dhost=%s msg=%s",
+			cefHeaderEscape.Replace(Revision),
+			e.Code,
+			cefHeaderEscape.Replace(firstLine(e.Message)),
+			cefSeverity[e.Code],
+			e.Epoch*1000,
+			cefExtensionEscape.Replace(host),
+			cefExtensionEscape.Replace(e.Message))
+	}
+
+	buf, _ := json.Marshal(map[string]interface{}{
+		"epoch": e.Epoch,
+		"code":  e.Code,
+		"host":  host,
+		"msg":   e.Message,
+	})
+
+	return string(buf)
+}
+
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i]
+	}
+
+	return s
+}
+
+func (s *siemExporter) dial() (err error) {
+	if time.Since(s.lastDial) < siemRetry {
+		return errors.New("SIEM collector unreachable")
+	}
+
+	s.lastDial = time.Now()
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+
+	if s.tlsConfig != nil {
+		s.conn, err = tls.DialWithDialer(dialer, "tcp", conf.SIEMAddress, s.tlsConfig)
+	} else {
+		s.conn, err = dialer.Dial("tcp", conf.SIEMAddress)
+	}
+
+	return
+}
+
+func (s *siemExporter) write(lines []string) (err error) {
+	if s.conn == nil {
+		if err = s.dial(); err != nil {
+			return
+		}
+	}
+
+	_ = s.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+
+	for _, line := range lines {
+		if _, err = fmt.Fprintln(s.conn, line); err != nil {
+			s.conn.Close()
+			s.conn = nil
+			return
+		}
+	}
+
+	return
+}
+
+func (s *siemExporter) deliver(line string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.pending() {
+		s.flushLocked()
+	}
+
+	if !s.pending() {
+		if err := s.write([]string{line}); err == nil {
+			return
+		}
+	}
+
+	s.spool(line)
+}
+
+func spoolPath() string {
+	return filepath.Join(conf.MountPoint, siemSpool)
+}
+
+// pending returns true if undelivered entries are spooled.
+func (s *siemExporter) pending() bool {
+	if len(s.memory) > 0 {
+		return true
+	}
+
+	if !session.Active() {
+		return false
+	}
+
+	_, err := volumeJail().Stat(spoolPath())
+
+	return err == nil
+}
+
+// spool stores an undelivered entry on the encrypted volume, when available,
+// or in memory.
+func (s *siemExporter) spool(line string) {
+	if session.Active() && !readOnly.Enabled() {
+		f, err := volumeJail().OpenFile(spoolPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+
+		if err == nil {
+			defer f.Close()
+
+			if _, err = fmt.Fprintln(f, line); err == nil {
+				return
+			}
+		}
+
+		log.Printf("SIEM spool error: %v", err)
+	}
+
+	if len(s.memory) >= siemMemorySize {
+		s.memory = s.memory[1:]
+		s.dropped++
+	}
+
+	s.memory = append(s.memory, line)
+}
+
+func (s *siemExporter) flush() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.pending() {
+		s.flushLocked()
+	}
+}
+
+// flushLocked delivers in memory and spooled entries, in order.
+func (s *siemExporter) flushLocked() {
+	if len(s.memory) > 0 {
+		if err := s.write(s.memory); err != nil {
+			return
+		}
+
+		s.memory = nil
+	}
+
+	if !session.Active() {
+		return
+	}
+
+	f, err := volumeJail().Open(spoolPath())
+
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	if err = s.write(lines); err != nil {
+		log.Printf("SIEM delivery error: %v", err)
+		return
+	}
+
+	if err = volumeJail().Remove(spoolPath()); err != nil {
+		log.Printf("SIEM spool error: %v", err)
+	}
+
+	if s.dropped > 0 {
+		log.Printf("SIEM export dropped %d entries", s.dropped)
+		s.dropped = 0
+	}
+}
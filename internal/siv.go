@@ -0,0 +1,154 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+)
+
+// AEAD_AES_SIV_CMAC_256 (RFC 5297), as required by Network Time Security.
+
+type aesSIV struct {
+	mac cipher.Block
+	ctr cipher.Block
+}
+
+func newAESSIV(key []byte) (s *aesSIV, err error) {
+	if len(key) != 32 {
+		return nil, errors.New("invalid AES-SIV key size")
+	}
+
+	s = &aesSIV{}
+
+	if s.mac, err = aes.NewCipher(key[:16]); err != nil {
+		return
+	}
+
+	s.ctr, err = aes.NewCipher(key[16:])
+
+	return
+}
+
+// dbl performs doubling in GF(2^128).
+func dbl(b []byte) []byte {
+	d := make([]byte, aes.BlockSize)
+
+	for i := 0; i < aes.BlockSize-1; i++ {
+		d[i] = b[i]<<1 | b[i+1]>>7
+	}
+
+	d[aes.BlockSize-1] = b[aes.BlockSize-1] << 1
+
+	if b[0]&0x80 != 0 {
+		d[aes.BlockSize-1] ^= 0x87
+	}
+
+	return d
+}
+
+func xorBlock(dst []byte, src []byte) {
+	for i := range src {
+		dst[i] ^= src[i]
+	}
+}
+
+// cmac computes AES-CMAC (RFC 4493).
+func cmac(b cipher.Block, msg []byte) []byte {
+	k := make([]byte, aes.BlockSize)
+	b.Encrypt(k, k)
+	k = dbl(k)
+
+	last := make([]byte, aes.BlockSize)
+	n := (len(msg) + aes.BlockSize - 1) / aes.BlockSize
+
+	if n == 0 {
+		n = 1
+	}
+
+	if tail := msg[(n-1)*aes.BlockSize:]; len(tail) == aes.BlockSize {
+		copy(last, tail)
+	} else {
+		copy(last, tail)
+		last[len(tail)] = 0x80
+		k = dbl(k)
+	}
+
+	xorBlock(last, k)
+
+	x := make([]byte, aes.BlockSize)
+
+	for i := 0; i < n-1; i++ {
+		xorBlock(x, msg[i*aes.BlockSize:(i+1)*aes.BlockSize])
+		b.Encrypt(x, x)
+	}
+
+	xorBlock(x, last)
+	b.Encrypt(x, x)
+
+	return x
+}
+
+func (s *aesSIV) s2v(components ...[]byte) []byte {
+	d := cmac(s.mac, make([]byte, aes.BlockSize))
+
+	for _, c := range components[:len(components)-1] {
+		d = dbl(d)
+		xorBlock(d, cmac(s.mac, c))
+	}
+
+	last := components[len(components)-1]
+
+	if len(last) >= aes.BlockSize {
+		t := append([]byte{}, last...)
+		xorBlock(t[len(t)-aes.BlockSize:], d)
+
+		return cmac(s.mac, t)
+	}
+
+	t := make([]byte, aes.BlockSize)
+	copy(t, last)
+	t[len(last)] = 0x80
+
+	xorBlock(t, dbl(d))
+
+	return cmac(s.mac, t)
+}
+
+func (s *aesSIV) crypt(v []byte, in []byte) (out []byte) {
+	q := append([]byte{}, v...)
+	q[8] &= 0x7f
+	q[12] &= 0x7f
+
+	out = make([]byte, len(in))
+	cipher.NewCTR(s.ctr, q).XORKeyStream(out, in)
+
+	return
+}
+
+// Seal returns the synthetic IV followed by the ciphertext, the nonce is
+// processed as the last associated data component (RFC 5297, section 3).
+func (s *aesSIV) Seal(nonce []byte, plaintext []byte, ad ...[]byte) []byte {
+	v := s.s2v(append(append(ad, nonce), plaintext)...)
+	return append(v, s.crypt(v, plaintext)...)
+}
+
+func (s *aesSIV) Open(nonce []byte, ciphertext []byte, ad ...[]byte) (plaintext []byte, err error) {
+	if len(ciphertext) < aes.BlockSize {
+		return nil, errors.New("invalid AES-SIV ciphertext")
+	}
+
+	v := ciphertext[:aes.BlockSize]
+	plaintext = s.crypt(v, ciphertext[aes.BlockSize:])
+
+	if !secretEqualBytes(v, s.s2v(append(append(ad, nonce), plaintext)...)) {
+		return nil, errors.New("AES-SIV authentication failed")
+	}
+
+	return
+}
@@ -0,0 +1,83 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"testing"
+)
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return b
+}
+
+func TestCMAC(t *testing.T) {
+	// RFC 4493, section 4
+	b, _ := aes.NewCipher(unhex("2b7e151628aed2a6abf7158809cf4f3c"))
+
+	vectors := map[string]string{
+		"":                                 "bb1d6929e95937287fa37d129b756746",
+		"6bc1bee22e409f96e93d7e117393172a": "070a16b46b4d4144f79bdd9dd04a287c",
+		"6bc1bee22e409f96e93d7e117393172aae2d8a571e03ac9c9eb76fac45af8e5130c81c46a35ce411": "dfa66747de9ae63030ca32611497c827",
+	}
+
+	for msg, mac := range vectors {
+		if res := cmac(b, unhex(msg)); !bytes.Equal(res, unhex(mac)) {
+			t.Errorf("CMAC(%s): %x", msg, res)
+		}
+	}
+}
+
+func TestAESSIV(t *testing.T) {
+	// RFC 5297, appendix A.1 (deterministic authenticated encryption)
+	s, err := newAESSIV(unhex("fffefdfcfbfaf9f8f7f6f5f4f3f2f1f0f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ad := unhex("101112131415161718191a1b1c1d1e1f2021222324252627")
+	plaintext := unhex("112233445566778899aabbccddee")
+
+	v := s.s2v(ad, plaintext)
+
+	if res := append(v, s.crypt(v, plaintext)...); !bytes.Equal(res, unhex("85632d07c6e8f37f950acd320a2ecc9340c02b9690c4dc04daef7f6afe5c")) {
+		t.Errorf("unexpected A.1 output: %x", res)
+	}
+
+	// RFC 5297, appendix A.2 (nonce-based authenticated encryption)
+	s, _ = newAESSIV(unhex("7f7e7d7c7b7a79787776757473727170404142434445464748494a4b4c4d4e4f"))
+
+	ad1 := unhex("00112233445566778899aabbccddeeffdeaddadadeaddadaffeeddccbbaa99887766554433221100")
+	ad2 := unhex("102030405060708090a0")
+	nonce := unhex("09f911029d74e35bd84156c5635688c0")
+	plaintext = unhex("7468697320697320736f6d6520706c61696e7465787420746f20656e6372797074207573696e67205349562d414553")
+
+	ciphertext := s.Seal(nonce, plaintext, ad1, ad2)
+
+	if !bytes.Equal(ciphertext, unhex("7bdb6e3b432667eb06f4d14bff2fbd0fcb900f2fddbe404326601965c889bf17dba77ceb094fa663b7a3f748ba8af829ea64ad544a272e9c485b62a3fd5c0d")) {
+		t.Errorf("unexpected A.2 output: %x", ciphertext)
+	}
+
+	if res, err := s.Open(nonce, ciphertext, ad1, ad2); err != nil || !bytes.Equal(res, plaintext) {
+		t.Errorf("unexpected A.2 decryption: %x %v", res, err)
+	}
+
+	ciphertext[20] ^= 1
+
+	if _, err := s.Open(nonce, ciphertext, ad1, ad2); err == nil {
+		t.Error("tampered ciphertext accepted")
+	}
+}
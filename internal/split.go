@@ -0,0 +1,419 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// Split-key (2-of-2) signing, the signing key is the combination of a device
+// share, derived through the HSM from a random per-key diversifier, and a user
+// share derived from the password supplied with each request. Neither the
+// private key nor the user share is ever stored, signing requires both device
+// possession and knowledge of the password.
+//
+// Signatures are computed on the SHA256 digest of the signed file.
+//
+// This is not threshold signing: the HSM only derives symmetric keys, the
+// shares are therefore combined into the complete private key in memory for
+// each operation and zeroed right after it. An attacker able to read process
+// memory while signing can obtain the private key.
+
+const (
+	splitEd25519 = "Ed25519"
+	splitP256    = "ECDSA-P256"
+)
+
+const splitPublicKey = "PUBLIC KEY"
+const splitKeyShare = "INTERLOCK SPLIT KEY SHARE"
+const splitDiversifierSize = 32
+
+// fixed IV for HSM share derivation, the diversifier is stored with the key
+var splitIV = []byte{0x49, 0x4e, 0x54, 0x45, 0x52, 0x4c, 0x4f, 0x43, 0x4b, 0x2d, 0x53, 0x50, 0x4c, 0x49, 0x54, 0x00}
+
+type splitSig struct {
+	info        cipherInfo
+	hsm         HSMInterface
+	algorithm   string
+	password    string
+	diversifier []byte
+	pubKey      interface{}
+
+	cipherInterface
+}
+
+// splitSigCiphers returns the split-key signing ciphers bound to the
+// argument HSM.
+func splitSigCiphers(hsm HSMInterface) []cipherInterface {
+	return []cipherInterface{
+		(&splitSig{hsm: hsm, algorithm: splitEd25519}).Init(),
+		(&splitSig{hsm: hsm, algorithm: splitP256}).Init(),
+	}
+}
+
+func (s *splitSig) Init() cipherInterface {
+	s.info = cipherInfo{
+		Name:        s.algorithm + "-SPLIT",
+		Description: fmt.Sprintf("%s 2-of-2 split-key signing (HSM and password shares)", s.algorithm),
+		KeyFormat:   "pem",
+		Enc:         false,
+		Dec:         false,
+		Sig:         true,
+		OTP:         false,
+		Msg:         false,
+		Extension:   "split-" + map[string]string{splitEd25519: "ed25519", splitP256: "p256"}[s.algorithm],
+	}
+
+	return s
+}
+
+func (s *splitSig) New() cipherInterface {
+	return (&splitSig{hsm: s.hsm, algorithm: s.algorithm}).Init()
+}
+
+func (s *splitSig) Activate(activate bool) (err error) {
+	// no activation required
+	return
+}
+
+func (s *splitSig) GetInfo() cipherInfo {
+	return s.info
+}
+
+// privateKey combines the HSM and password shares.
+func (s *splitSig) privateKey() (priv interface{}, err error) {
+	if s.password == "" {
+		return nil, errors.New("split-key signing requires the password share")
+	}
+
+	deviceKey, err := s.hsm.DeriveKey(s.diversifier, splitIV)
+
+	if err != nil {
+		return
+	}
+
+	defer zero(deviceKey)
+
+	deviceShare := sha256.Sum256(deviceKey)
+	defer zero(deviceShare[:])
+
+	_, userShare, err := deriveKeyPBKDF2(s.diversifier, s.password, derivedKeySize)
+
+	if err != nil {
+		return
+	}
+	defer zero(userShare)
+
+	seed := make([]byte, derivedKeySize)
+	defer zero(seed)
+
+	for i := range seed {
+		seed[i] = deviceShare[i] ^ userShare[i]
+	}
+
+	switch s.algorithm {
+	case splitEd25519:
+		return ed25519.NewKeyFromSeed(seed), nil
+	case splitP256:
+		// reduce a 384-bit expansion of the seed to a valid scalar
+		curve := elliptic.P256()
+		expanded := sha512.Sum384(seed)
+		defer zero(expanded[:])
+
+		n := new(big.Int).Sub(curve.Params().N, big.NewInt(1))
+		d := new(big.Int).SetBytes(expanded[:])
+		d.Mod(d, n)
+		d.Add(d, big.NewInt(1))
+
+		scalar := d.Bytes()
+		defer zero(scalar)
+
+		k := &ecdsa.PrivateKey{D: d}
+		k.PublicKey.Curve = curve
+		k.PublicKey.X, k.PublicKey.Y = curve.ScalarBaseMult(scalar)
+
+		return k, nil
+	}
+
+	return nil, errors.New("invalid split-key algorithm")
+}
+
+// zeroPrivateKey overwrites a combined private key.
+func zeroPrivateKey(priv interface{}) {
+	switch k := priv.(type) {
+	case ed25519.PrivateKey:
+		zero(k)
+	case *ecdsa.PrivateKey:
+		words := k.D.Bits()
+
+		for i := range words {
+			words[i] = 0
+		}
+
+		k.D.SetInt64(0)
+	}
+}
+
+func publicKey(priv interface{}) interface{} {
+	switch k := priv.(type) {
+	case ed25519.PrivateKey:
+		return k.Public()
+	case *ecdsa.PrivateKey:
+		return &k.PublicKey
+	}
+
+	return nil
+}
+
+func (s *splitSig) GenKey(identifier string, email string) (pubKey string, secKey string, err error) {
+	s.diversifier = make([]byte, splitDiversifierSize)
+
+	if _, err = io.ReadFull(rand.Reader, s.diversifier); err != nil {
+		return
+	}
+
+	priv, err := s.privateKey()
+
+	if err != nil {
+		return
+	}
+	defer zeroPrivateKey(priv)
+
+	der, err := x509.MarshalPKIXPublicKey(publicKey(priv))
+
+	if err != nil {
+		return
+	}
+
+	pubKey = string(pem.EncodeToMemory(&pem.Block{
+		Type:  splitPublicKey,
+		Bytes: der,
+	}))
+
+	secKey = string(pem.EncodeToMemory(&pem.Block{
+		Type: splitKeyShare,
+		Headers: map[string]string{
+			"Algorithm":   s.algorithm,
+			"Diversifier": hex.EncodeToString(s.diversifier),
+		},
+		Bytes: der,
+	}))
+
+	return
+}
+
+func (s *splitSig) GetKeyInfo(k key) (info string, err error) {
+	err = s.SetKey(k)
+
+	if err != nil {
+		return
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(s.pubKey)
+
+	if err != nil {
+		return
+	}
+
+	fingerprint := sha256.Sum256(der)
+	info = fmt.Sprintf("Identifier: %s, Format: %s, Cipher: %s\n", k.Identifier, k.KeyFormat, k.Cipher)
+	info += fmt.Sprintf("Algorithm: %s\nFingerprint: %X\n", s.algorithm, fingerprint)
+
+	if k.Private {
+		info += "Shares: HSM device share, password share\n"
+	}
+
+	return
+}
+
+// SetPassword sets the password share, it is verified immediately when a
+// key share is already set.
+func (s *splitSig) SetPassword(password string) (err error) {
+	s.password = password
+
+	if s.diversifier != nil {
+		_, err = s.signingKey()
+	}
+
+	return
+}
+
+func (s *splitSig) SetKey(k key) (err error) {
+	buf, err := volumeJail().ReadFile(filepath.Join(conf.MountPoint, k.Path))
+
+	if err != nil {
+		return
+	}
+
+	block, _ := pem.Decode(buf)
+
+	if block == nil {
+		return errors.New("invalid split-key PEM")
+	}
+
+	switch block.Type {
+	case splitPublicKey:
+	case splitKeyShare:
+		if block.Headers["Algorithm"] != s.algorithm {
+			return errors.New("split-key algorithm mismatch")
+		}
+
+		if s.diversifier, err = hex.DecodeString(block.Headers["Diversifier"]); err != nil {
+			return
+		}
+	default:
+		return fmt.Errorf("invalid split-key PEM type %s", block.Type)
+	}
+
+	s.pubKey, err = x509.ParsePKIXPublicKey(block.Bytes)
+
+	return
+}
+
+func (s *splitSig) Encrypt(input *os.File, output *os.File, sign bool) error {
+	return errors.New("cipher does not support encryption")
+}
+
+func (s *splitSig) Decrypt(input *os.File, output *os.File, verify bool) error {
+	return errors.New("cipher does not support decryption")
+}
+
+func digestFile(input *os.File) (digest []byte, err error) {
+	h := sha256.New()
+
+	if _, err = io.Copy(h, input); err != nil {
+		return
+	}
+
+	return h.Sum(nil), nil
+}
+
+// signingKey combines the key shares, verifying the result against the
+// stored public key as an invalid password yields a different key.
+func (s *splitSig) signingKey() (priv interface{}, err error) {
+	if s.diversifier == nil {
+		return nil, errors.New("signing requires the split-key share")
+	}
+
+	priv, err = s.privateKey()
+
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			zeroPrivateKey(priv)
+			priv = nil
+		}
+	}()
+
+	pub, err := x509.MarshalPKIXPublicKey(publicKey(priv))
+
+	if err != nil {
+		return
+	}
+
+	expected, err := x509.MarshalPKIXPublicKey(s.pubKey)
+
+	if err != nil {
+		return
+	}
+
+	if !secretEqualBytes(pub, expected) {
+		return nil, errors.New("invalid split-key password share")
+	}
+
+	return
+}
+
+func (s *splitSig) Sign(input *os.File, output *os.File) (err error) {
+	priv, err := s.signingKey()
+
+	if err != nil {
+		return
+	}
+	defer zeroPrivateKey(priv)
+
+	digest, err := digestFile(input)
+
+	if err != nil {
+		return
+	}
+
+	var sig []byte
+
+	switch k := priv.(type) {
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, digest)
+	case *ecdsa.PrivateKey:
+		if sig, err = ecdsa.SignASN1(rand.Reader, k, digest); err != nil {
+			return
+		}
+	}
+
+	_, err = output.Write(sig)
+
+	return
+}
+
+func (s *splitSig) Verify(input *os.File, signature *os.File) (err error) {
+	sig, err := ioutil.ReadAll(signature)
+
+	if err != nil {
+		return
+	}
+
+	digest, err := digestFile(input)
+
+	if err != nil {
+		return
+	}
+
+	valid := false
+
+	switch k := s.pubKey.(type) {
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(k, digest, sig)
+	case *ecdsa.PublicKey:
+		valid = ecdsa.VerifyASN1(k, digest, sig)
+	default:
+		return errors.New("signature verification requires a split-key")
+	}
+
+	if !valid {
+		return errors.New("invalid signature")
+	}
+
+	return
+}
+
+func (s *splitSig) GenOTP(timestamp int64) (otp string, exp int64, err error) {
+	err = errors.New("cipher does not support OTP generation")
+	return
+}
+
+func (s *splitSig) HandleRequest(r *http.Request) (res jsonObject) {
+	res = notFound()
+	return
+}
@@ -0,0 +1,115 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSplitSig(t *testing.T) {
+	conf.MountPoint = "/tmp"
+	password := "interlocktest"
+	cleartext := "01234567890ABCDEFGHILMNOPQRSTUVZ!@#"
+
+	for _, cipher := range splitSigCiphers(new(mockHSM)) {
+		s := cipher.New()
+		name := s.GetInfo().Name
+
+		if err := s.SetPassword(password); err != nil {
+			t.Fatal(err)
+		}
+
+		testPubKey, testSecKey, err := s.GenKey("split_test_key", "")
+
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		pubKeyFile, _ := ioutil.TempFile("", "split_test_pubkey-")
+		pubKeyFile.Write([]byte(testPubKey))
+		defer os.Remove(pubKeyFile.Name())
+
+		secKeyFile, _ := ioutil.TempFile("", "split_test_seckey-")
+		secKeyFile.Write([]byte(testSecKey))
+		defer os.Remove(secKeyFile.Name())
+
+		input, _ := ioutil.TempFile("", "split_test_input-")
+		input.Write([]byte(cleartext))
+		defer os.Remove(input.Name())
+
+		signature, _ := ioutil.TempFile("", "split_test_signature-")
+		defer os.Remove(signature.Name())
+
+		pubKey := key{Identifier: "split test key", KeyFormat: "pem", Cipher: name, Private: false, Path: path.Base(pubKeyFile.Name())}
+		secKey := key{Identifier: "split test key", KeyFormat: "pem", Cipher: name, Private: true, Path: path.Base(secKeyFile.Name())}
+
+		signer := s.New()
+
+		if err = signer.SetKey(secKey); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if err = signer.SetPassword("invalid"); err == nil {
+			t.Fatalf("%s: invalid password share accepted", name)
+		}
+
+		if err = signer.SetPassword(password); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		input.Seek(0, 0)
+
+		if err = signer.Sign(input, signature); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		verifier := s.New()
+
+		if err = verifier.SetKey(pubKey); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		input.Seek(0, 0)
+		signature.Seek(0, 0)
+
+		if err = verifier.Verify(input, signature); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		input.Seek(0, 0)
+		input.Write([]byte("tampered"))
+		input.Seek(0, 0)
+		signature.Seek(0, 0)
+
+		if err = verifier.Verify(input, signature); err == nil {
+			t.Fatalf("%s: tampered file verified", name)
+		}
+
+		// the device share is required
+		other := &splitSig{hsm: &otherHSM{}, algorithm: s.(*splitSig).algorithm}
+		other.Init()
+
+		if err = other.SetKey(secKey); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if err = other.SetPassword(password); err == nil {
+			t.Fatalf("%s: key share accepted on different device", name)
+		}
+	}
+}
+
+type otherHSM struct {
+	mockHSM
+}
+
+func (h *otherHSM) DeriveKey(diversifier []byte, iv []byte) ([]byte, error) {
+	return h.mockHSM.DeriveKey(append([]byte("other device"), diversifier...), iv)
+}
@@ -0,0 +1,134 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const manifestPath = "manifest.json"
+
+var assetPattern = regexp.MustCompile(`<(script|link)\b[^>]*?\b(src|href)="/?([^"#?]+)"`)
+
+// Subresource Integrity (SRI) manifest, maps each static asset path to its
+// SHA-384 integrity metadata.
+type assetManifest map[string]string
+
+func generateManifest(root fs.FS) (m assetManifest, err error) {
+	m = make(assetManifest)
+
+	err = fs.WalkDir(root, ".", func(p string, d fs.DirEntry, e error) (err error) {
+		if e != nil {
+			return e
+		}
+
+		if hiddenPath(p) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+
+			return
+		}
+
+		if d.IsDir() {
+			return
+		}
+
+		buf, err := fs.ReadFile(root, p)
+
+		if err != nil {
+			return
+		}
+
+		sum := sha512.Sum384(buf)
+		m[p] = "sha384-" + base64.StdEncoding.EncodeToString(sum[:])
+
+		return
+	})
+
+	return
+}
+
+// inject adds integrity attributes to script and stylesheet elements
+// referencing assets present in the manifest.
+func (m assetManifest) inject(html []byte) []byte {
+	return assetPattern.ReplaceAllFunc(html, func(tag []byte) []byte {
+		if bytes.Contains(tag, []byte("integrity=")) {
+			return tag
+		}
+
+		s := assetPattern.FindSubmatch(tag)
+
+		if string(s[1]) == "link" && !bytes.Contains(tag, []byte(`rel="stylesheet"`)) {
+			return tag
+		}
+
+		integrity, ok := m[string(s[3])]
+
+		if !ok {
+			return tag
+		}
+
+		return []byte(string(tag) + ` integrity="` + integrity + `"`)
+	})
+}
+
+func integrityHandler(root fs.FS, h http.Handler) (http.Handler, error) {
+	manifest, err := generateManifest(root)
+
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("generated integrity manifest for %d static assets", len(manifest))
+
+	index, err := json.Marshal(manifest)
+
+	if err != nil {
+		return nil, err
+	}
+
+	started := time.Now()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+
+		if p == "" || p == "." {
+			p = "index.html"
+		}
+
+		switch {
+		case hiddenPath(p):
+			staticError(w, root, http.StatusNotFound)
+		case p == manifestPath:
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			http.ServeContent(w, r, manifestPath, started, bytes.NewReader(index))
+		case path.Ext(p) == ".html":
+			buf, err := fs.ReadFile(root, p)
+
+			if err != nil {
+				staticError(w, root, http.StatusNotFound)
+				return
+			}
+
+			w.Header().Set("Content-Type", contentType(p))
+			http.ServeContent(w, r, p, started, bytes.NewReader(manifest.inject(buf)))
+		default:
+			h.ServeHTTP(w, r)
+		}
+	}), nil
+}
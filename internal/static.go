@@ -0,0 +1,154 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// Static asset handler, unlike http.FileServer it never generates directory
+// listings nor serve hidden files (e.g. .git, .htpasswd within StaticPath).
+// Error responses use the 404.html and 50x.html pages of the static root when
+// present, text assets are always served with an explicit UTF-8 charset.
+
+const (
+	notFoundPage = "404.html"
+	errorPage    = "50x.html"
+)
+
+const defaultErrorPage = `<!DOCTYPE html>
+<html>
+  <head><meta charset="utf-8"><title>INTERLOCK</title></head>
+  <body><p>%s</p></body>
+</html>
+`
+
+// hiddenPath returns whether any element of a slash separated path is a
+// dotfile.
+func hiddenPath(p string) bool {
+	for _, e := range strings.Split(p, "/") {
+		if strings.HasPrefix(e, ".") && e != "." {
+			return true
+		}
+	}
+
+	return false
+}
+
+// contentType returns the MIME type for a file name, text types include
+// their charset.
+func contentType(name string) string {
+	t := mime.TypeByExtension(path.Ext(name))
+
+	if t == "" {
+		return "application/octet-stream"
+	}
+
+	if strings.HasPrefix(t, "text/") && !strings.Contains(t, "charset") {
+		t += "; charset=utf-8"
+	}
+
+	return t
+}
+
+func staticError(w http.ResponseWriter, root fs.FS, code int) {
+	page := notFoundPage
+
+	if code >= http.StatusInternalServerError {
+		page = errorPage
+	}
+
+	buf, err := fs.ReadFile(root, page)
+
+	if err != nil {
+		buf = []byte(fmt.Sprintf(defaultErrorPage, http.StatusText(code)))
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	w.Write(buf)
+}
+
+func staticHandler(root fs.FS) http.Handler {
+	started := time.Now()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+
+		if p == "" {
+			p = "."
+		}
+
+		if hiddenPath(p) {
+			staticError(w, root, http.StatusNotFound)
+			return
+		}
+
+		info, err := fs.Stat(root, p)
+
+		if err == nil && info.IsDir() {
+			// directories are only served through their index
+			p = path.Join(p, "index.html")
+			info, err = fs.Stat(root, p)
+		}
+
+		if errors.Is(err, fs.ErrNotExist) || err == nil && !info.Mode().IsRegular() {
+			staticError(w, root, http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			staticError(w, root, http.StatusInternalServerError)
+			return
+		}
+
+		f, err := root.Open(p)
+
+		if err != nil {
+			staticError(w, root, http.StatusInternalServerError)
+			return
+		}
+
+		defer f.Close()
+
+		content, ok := f.(io.ReadSeeker)
+
+		if !ok {
+			buf, err := ioutil.ReadAll(f)
+
+			if err != nil {
+				staticError(w, root, http.StatusInternalServerError)
+				return
+			}
+
+			content = bytes.NewReader(buf)
+		}
+
+		modTime := info.ModTime()
+
+		if modTime.IsZero() {
+			// embedded assets carry no modification time
+			modTime = started
+		}
+
+		w.Header().Set("Content-Type", contentType(p))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+
+		http.ServeContent(w, r, p, modTime, content)
+	})
+}
@@ -29,6 +29,7 @@ Interlock.Backend = new function() {
                'file':       { 'list':     'file/list',
                                'upload':   'file/upload',
                                'download': 'file/download',
+                               'preview':  'file/preview',
                                'delete':   'file/delete',
                                'move':     'file/move',
                                'copy':     'file/copy',
@@ -47,10 +48,15 @@ Interlock.Backend = new function() {
                                'uploadKey':   'crypto/upload_key',
                                'keyInfo':     'crypto/key_info' },
 
-               'config':     { 'time': 'config/time' },
+               'config':     { 'time':          'config/time',
+                               'networkScan':   'config/network/scan',
+                               'networkJoin':   'config/network/join',
+                               'networkForget': 'config/network/forget' },
 
                'status':     { 'version': 'status/version',
-                               'running': 'status/running' },
+                               'running': 'status/running',
+                               'banner':  'status/banner',
+                               'ui':      'status/ui' },
 
                'Signal': { 'send':     'Signal/send',
                            'history':  'Signal/history',
@@ -58,6 +64,9 @@ Interlock.Backend = new function() {
              };
 
   this.API.prefix = '/api/';
+
+  /* destructive methods requiring a one-time XSRF token */
+  this.oneTimeMethods = ['auth/poweroff', 'luks/remove', 'file/delete'];
 };
 
 /**
@@ -87,6 +96,61 @@ Interlock.Backend.APIRequest = function(APIMethod, HttpMethod, payload, doneCall
   var failCallbackClass  = failCallback ? failCallback.split('.')[0] : null;
   var failCallbackMethod = failCallback ? failCallback.split('.')[1] : null;
 
+  if (Interlock.Backend.oneTimeMethods.indexOf(APIMethod) === -1) {
+    Interlock.Backend.send(APIMethod, HttpMethod, payload, null,
+      doneCallbackClass, doneCallbackMethod, failCallbackClass, failCallbackMethod, callbackView);
+
+    return;
+  }
+
+  /* destructive methods: request a one-time XSRF token first */
+  $.ajax(
+  {
+    type: 'POST',
+    url: Interlock.Backend.API.prefix + 'auth/nonce',
+    data: JSON.stringify({'method': APIMethod}),
+    processData: false,
+    contenType: 'application/json; charset=UTF-8',
+    beforeSend: function(request) {
+      request.setRequestHeader('X-XSRFToken', sessionStorage.XSRFToken);
+    }
+  })
+  .done(function(msg, textStatus, xhr) {
+    var XSRFToken = xhr.getResponseHeader('X-XSRFToken');
+
+    if (XSRFToken) {
+      sessionStorage.XSRFToken = XSRFToken;
+    }
+
+    if (Interlock.Backend.isValidResponse(msg) === true && msg.status === 'OK') {
+      Interlock.Backend.send(APIMethod, HttpMethod, payload, msg.response,
+        doneCallbackClass, doneCallbackMethod, failCallbackClass, failCallbackMethod, callbackView);
+    } else {
+      Interlock.Session.createEvent({'kind': msg.status === 'INVALID_SESSION' ? 'INVALID_SESSION' : 'critical',
+        'msg': '[Interlock.Backend.APIRequest] failed to obtain one-time XSRF token'});
+    }
+  })
+  .fail(function() {
+    Interlock.Session.createEvent({'kind': 'critical',
+      'msg': '[Interlock.Backend.APIRequest] failed to obtain one-time XSRF token'});
+  });
+};
+
+/**
+ * @function
+ * @private
+ *
+ * @description
+ * Performs an API request, see Interlock.Backend.APIRequest.
+ *
+ * @param {string} APIMethod backend API method
+ * @param {string} HttpMethod request HTTP method ('POST'|'GET')
+ * @param {string} payload JSON string containing the request payload
+ * @param {string} nonce one-time XSRF token, null if not required
+ * @returns {}
+ */
+Interlock.Backend.send = function(APIMethod, HttpMethod, payload, nonce,
+  doneCallbackClass, doneCallbackMethod, failCallbackClass, failCallbackMethod, callbackView) {
   var jqxhr = $.ajax(
   {
     type: HttpMethod,
@@ -99,9 +163,21 @@ Interlock.Backend.APIRequest = function(APIMethod, HttpMethod, payload, doneCall
       if (Interlock.Session) {
         request.setRequestHeader('X-XSRFToken', sessionStorage.XSRFToken);
       }
+
+      if (nonce) {
+        request.setRequestHeader('X-XSRFNonce', nonce);
+      }
     }
   })
-  .done(function(msg) {
+  .done(function(msg, textStatus, xhr) {
+    /* XSRF token rotation: privilege-sensitive operations, and tokens
+       approaching their maximum age, return a new token */
+    var XSRFToken = xhr.getResponseHeader('X-XSRFToken');
+
+    if (XSRFToken) {
+      sessionStorage.XSRFToken = XSRFToken;
+    }
+
     if (Interlock.Backend.isValidResponse(msg) === true) {
       if (doneCallbackClass && doneCallbackMethod) {
         if (callbackView) {
@@ -115,9 +191,16 @@ Interlock.Backend.APIRequest = function(APIMethod, HttpMethod, payload, doneCall
         'msg': '[Interlock.Backend.APIRequest] invalid backend response'});
     }
   })
-  .fail(function() {
-    Interlock.Session.createEvent({'kind': 'critical',
-      'msg': '[Interlock.Backend.APIRequest] request failed, invalid backend response'});
+  .fail(function(xhr) {
+    /* schema validation errors are returned with HTTP status 400 */
+    if (xhr.status === 400 && xhr.responseJSON &&
+        Interlock.Backend.isValidResponse(xhr.responseJSON) === true) {
+      Interlock.Session.createEvent({'kind': 'critical',
+        'msg': '[Interlock.Backend.APIRequest] invalid request: ' + xhr.responseJSON.response});
+    } else {
+      Interlock.Session.createEvent({'kind': 'critical',
+        'msg': '[Interlock.Backend.APIRequest] request failed, invalid backend response'});
+    }
 
     if (failCallbackClass && failCallbackMethod) {
       if (callbackView) {
@@ -138,7 +221,7 @@ Interlock.Backend.APIRequest = function(APIMethod, HttpMethod, payload, doneCall
  * @description
  * Basic validation of the backend response format. The response
  * must always contain both the 'status' and the 'response' key.
- * 'status' must be OK|KO|INVALID|INVALID_SESSION.
+ * 'status' must be OK|KO|INVALID|INVALID_SESSION|SESSION_MOVED.
  *
  * @param {Object} backendData
  * @returns {boolean} validationResult
@@ -149,7 +232,8 @@ Interlock.Backend.isValidResponse = function(backendData) {
   valid = valid && (backendData.status === 'OK' ||
                     backendData.status === 'KO' ||
                     backendData.status === 'INVALID' ||
-                    backendData.status === 'INVALID_SESSION');
+                    backendData.status === 'INVALID_SESSION' ||
+                    backendData.status === 'SESSION_MOVED');
 
   valid = valid && (backendData.response !== undefined);
 
@@ -65,3 +65,140 @@ Interlock.Config.setTimeCallback = function(backendData) {
       'msg': '[Interlock.Config.setTime] ' + e});
   }
 };
+
+/**
+ * @function
+ * @public
+ *
+ * @description
+ * Scan for available Wi-Fi networks
+ *
+ * @param {}
+ * @returns {}
+ */
+Interlock.Config.networkScan = function() {
+  try {
+    Interlock.Session.createEvent({'kind': 'info',
+      'msg': '[Interlock.Config.networkScan] scanning for Wi-Fi networks'});
+
+    Interlock.Backend.APIRequest(Interlock.Backend.API.config.networkScan, 'POST',
+      null, 'Config.networkScanCallback');
+  } catch (e) {
+    Interlock.Session.createEvent({'kind': 'critical',
+      'msg': '[Interlock.Config.networkScan] ' + e});
+  }
+};
+
+/**
+ * @function
+ * @public
+ *
+ * @description
+ * Callback function, presents the scanned Wi-Fi networks allowing to join
+ * or forget them
+ *
+ * @param {Object} backendData
+ * @returns {}
+ */
+Interlock.Config.networkScanCallback = function(backendData) {
+  try {
+    if (backendData.status !== 'OK') {
+      Interlock.Session.createEvent({'kind': backendData.status,
+        'msg': '[Interlock.Config.networkScanCallback] ' + backendData.response});
+      return;
+    }
+
+    var $selectNetwork = $(document.createElement('select')).attr('id', 'ssid')
+                                                            .attr('name', 'ssid');
+
+    $.each(backendData.response, function(index, network) {
+      $selectNetwork.append($(document.createElement('option')).attr('value', network.ssid)
+                                                               .text(network.ssid + ' (' + network.signal + ' dBm' +
+                                                                     (network.saved ? ', saved' : '') + ')'));
+    });
+
+    var buttons = { 'Join': function() { Interlock.Config.networkJoin({ssid: $('#ssid').val(), password: $('#password').val()}) },
+                    'Forget': function() { Interlock.Config.networkForget({ssid: $('#ssid').val()}) } };
+
+    var elements = [$(document.createElement('p')).text('Select the Wi-Fi network, the password is not required for open networks.'),
+                    $selectNetwork,
+                    $(document.createElement('input')).attr('id', 'password')
+                                                      .attr('name', 'password')
+                                                      .attr('value', '')
+                                                      .attr('type', 'password')
+                                                      .attr('placeholder', 'password')
+                                                      .addClass('text ui-widget-content ui-corner-all')];
+
+    Interlock.UI.modalFormConfigure({ elements: elements, buttons: buttons,
+      submitButton: 'Join', title: 'Wi-Fi networks' });
+    Interlock.UI.modalFormDialog('open');
+  } catch (e) {
+    Interlock.Session.createEvent({'kind': 'critical',
+      'msg': '[Interlock.Config.networkScanCallback] ' + e});
+  }
+};
+
+/**
+ * @function
+ * @public
+ *
+ * @description
+ * Join a Wi-Fi network, its credentials are saved on the encrypted volume
+ *
+ * @param {Object} args: ssid, password
+ * @returns {}
+ */
+Interlock.Config.networkJoin = function(args) {
+  try {
+    Interlock.Backend.APIRequest(Interlock.Backend.API.config.networkJoin, 'POST',
+      JSON.stringify({ssid: args.ssid, password: args.password}), 'Config.networkCallback');
+  } catch (e) {
+    Interlock.Session.createEvent({'kind': 'critical',
+      'msg': '[Interlock.Config.networkJoin] ' + e});
+  }
+};
+
+/**
+ * @function
+ * @public
+ *
+ * @description
+ * Forget a saved Wi-Fi network
+ *
+ * @param {Object} args: ssid
+ * @returns {}
+ */
+Interlock.Config.networkForget = function(args) {
+  try {
+    Interlock.Backend.APIRequest(Interlock.Backend.API.config.networkForget, 'POST',
+      JSON.stringify({ssid: args.ssid}), 'Config.networkCallback');
+  } catch (e) {
+    Interlock.Session.createEvent({'kind': 'critical',
+      'msg': '[Interlock.Config.networkForget] ' + e});
+  }
+};
+
+/**
+ * @function
+ * @public
+ *
+ * @description
+ * Callback function, reports errors in relationship with Wi-Fi network
+ * join and forget operations
+ *
+ * @param {Object} backendData
+ * @returns {}
+ */
+Interlock.Config.networkCallback = function(backendData) {
+  try {
+    if (backendData.status === 'OK') {
+      Interlock.UI.modalFormDialog('close');
+    } else {
+      Interlock.Session.createEvent({'kind': backendData.status,
+        'msg': '[Interlock.Config.networkCallback] ' + backendData.response});
+    }
+  } catch (e) {
+    Interlock.Session.createEvent({'kind': 'critical',
+      'msg': '[Interlock.Config.networkCallback] ' + e});
+  }
+};
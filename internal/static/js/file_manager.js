@@ -32,6 +32,10 @@ Interlock.FileManager = new function() {
   this.MAX_VIEW_SIZE = 1 * 1024 * 1024;
   /* supported archive file extensions */
   this.ARCHIVE_EXTENSIONS = ['zip','ZIP'];
+  /* image file extensions displayed by file view action */
+  this.IMAGE_EXTENSIONS = ['jpg','jpeg','png','gif','webp','bmp'];
+  /* max image preview dimension (pixels) */
+  this.PREVIEW_SIZE = 1024;
 
   /* FileManager mainView initialization: register drag and drop and
      file/directory upload button event handlers */
@@ -1186,7 +1190,13 @@ Interlock.FileManager = new function() {
             Interlock.UI.modalFormDialog('open');
           }));
 
-          if (inode.size <= Interlock.FileManager.MAX_VIEW_SIZE) {
+          if ($.inArray(($selectedInode.id.split('.').pop() || '').toLowerCase(),
+              Interlock.FileManager.IMAGE_EXTENSIONS) >= 0) {
+            menuEntries.push($(document.createElement('li')).text('View')
+                                                            .click(function() {
+                                                              Interlock.FileManager.filePreview(path);
+                                                            }));
+          } else if (inode.size <= Interlock.FileManager.MAX_VIEW_SIZE) {
             menuEntries.push($(document.createElement('li')).text('View')
                                                             .click(function() {
                                                               Interlock.FileManager.fileDownloadView(path);
@@ -1656,6 +1666,62 @@ Interlock.FileManager.fileDownloadView = function(path) {
   }
 };
 
+/**
+ * @function
+ * @public
+ *
+ * @description
+ * Callback function, display an image inside a dialog using its signed
+ * preview URL
+ *
+ * @param {Object} backendData
+ * @returns {}
+ */
+Interlock.FileManager.filePreviewCallback = function(backendData) {
+  try {
+    if (backendData.status === 'OK') {
+      /* the signed URL carries no XSRF token, urls format:
+       * /api/file/preview?path=...&expires=...&sig=...&size=... */
+      var buttons = {'Close': function() { Interlock.UI.modalFormDialog('close'); } };
+      var elements = [$(document.createElement('p')).append($(document.createElement('img')).attr('src', backendData.response.url)
+                                                                                            .attr('alt', 'preview')
+                                                                                            .css({'max-width': '100%', 'max-height': '100%'}))];
+
+      Interlock.UI.modalFormConfigure({elements: elements, buttons: buttons,
+                                       noCancelButton: true, submitButton: 'Close',
+                                       title: 'Image Preview', height: 600, width: 800});
+
+      Interlock.UI.modalFormDialog('open');
+    } else {
+      Interlock.Session.createEvent({'kind': backendData.status,
+        'msg': '[Interlock.FileManager.filePreviewCallback] ' + backendData.response});
+    }
+  } catch (e) {
+    Interlock.Session.createEvent({'kind': 'critical',
+      'msg': '[Interlock.FileManager.filePreviewCallback] ' + e});
+  }
+};
+
+/**
+ * @function
+ * @public
+ *
+ * @description
+ * Display an image inside a dialog
+ *
+ * @param {Object} path of the image
+ * @returns {}
+ */
+Interlock.FileManager.filePreview = function(path) {
+  try {
+    Interlock.Backend.APIRequest(Interlock.Backend.API.file.preview, 'POST',
+      JSON.stringify({path: path, size: Interlock.FileManager.PREVIEW_SIZE}), 'FileManager.filePreviewCallback');
+  } catch (e) {
+    Interlock.Session.createEvent({'kind': 'critical',
+      'msg': '[Interlock.FileManager.filePreview] ' + e});
+  }
+};
+
 /**
  * @function
  * @public
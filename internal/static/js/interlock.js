@@ -141,6 +141,7 @@ if (sessionStorageSupported() && fileAPISupported()) {
         $('body').html(data);
         document.title = 'INTERLOCK';
 
+        Interlock.Session.getUI();
         Interlock.Session.getVersion();
         Interlock.Session.statusPoller();
       });
@@ -141,6 +141,7 @@ Interlock.Session.createEvent = function(data) {
 
   switch (data.kind) {
     case 'INVALID_SESSION':
+    case 'SESSION_MOVED':
       /* do not dispatch any notification,
          clean-up the session token and redirects to login */
       eventObj.severity = 'error';
@@ -220,10 +221,29 @@ Interlock.Session.loginCallback = function(backendData) {
       sessionStorage.XSRFToken = backendData.response.XSRFToken;
       sessionStorage.volume = backendData.response.volume;
 
+      /* report changes to the unencrypted system partition */
+      if (backendData.response.tamper && backendData.response.tamper.length > 0) {
+        alert('WARNING: INTERLOCK system files changed since last run:\n\n' +
+              backendData.response.tamper.join('\n') + '\n\n' +
+              'Verify the device integrity before proceeding.');
+      }
+
+      /* report failed login attempts since the previous login */
+      if (backendData.response.failed_logins && backendData.response.failed_logins.length > 0) {
+        var attempts = $.map(backendData.response.failed_logins, function(a) {
+          return new Date(a.epoch * 1000).toString() + ' - ' + a.remote + ' (' + a.volume + ')';
+        });
+
+        alert('WARNING: ' + attempts.length + ' failed login attempt(s) since last login:\n\n' +
+              attempts.join('\n') + '\n\n' +
+              'Change your password if these attempts were not yours.');
+      }
+
       $.get("/templates/file_manager.html", function(data) {
         $('body').html(data);
         document.title = 'INTERLOCK';
 
+        Interlock.Session.getUI();
         Interlock.Session.getVersion();
         Interlock.Session.statusPoller();
       });
@@ -254,12 +274,13 @@ Interlock.Session.loginCallback = function(backendData) {
  * @param {String} volume
  * @param {String} password
  * @param {String} dispose password after login
+ * @param {Boolean} banner login banner acknowledgment
  * @returns {}
  */
-Interlock.Session.login = function(volume, pwd, dispose) {
+Interlock.Session.login = function(volume, pwd, dispose, banner) {
   try {
     Interlock.Backend.APIRequest(Interlock.Backend.API.auth.login, 'POST',
-      JSON.stringify({ volume: volume, password: pwd, dispose: dispose }),
+      JSON.stringify({ volume: volume, password: pwd, dispose: dispose, banner: banner }),
       'Session.loginCallback');
   } catch (e) {
     Interlock.Session.createEvent({'kind': 'critical', 'msg': '[Interlock.Session.login] ' + e});
@@ -414,6 +435,7 @@ Interlock.Session.refreshCallback = function(backendData) {
         $('body').html(data);
         document.title = 'INTERLOCK';
 
+        Interlock.Session.getUI();
         Interlock.Session.getVersion();
         Interlock.Session.statusPoller();
       });
@@ -455,6 +477,138 @@ Interlock.Session.refresh = function() {
   }
 };
 
+/**
+ * @function
+ * @public
+ *
+ * @description
+ * Callback function, displays the login banner requiring acknowledgment
+ *
+ * @param {Object} backendData
+ * @returns {}
+ */
+Interlock.Session.getBannerCallback = function(backendData) {
+  try {
+    if (backendData.status === 'OK' && backendData.response.banner) {
+      $('#banner_text').text(backendData.response.banner);
+      $('#banner').show();
+    }
+  } catch (e) {
+    Interlock.Session.createEvent({'kind': 'critical',
+      'msg': '[Interlock.Session.getBannerCallback] ' + e});
+  }
+};
+
+/**
+ * @function
+ * @public
+ *
+ * @description
+ * Interlock getBanner, retrieves the login banner from the backend
+ *
+ */
+Interlock.Session.getBanner = function() {
+  try {
+    Interlock.Backend.APIRequest(Interlock.Backend.API.status.banner, 'GET',
+        null, 'Session.getBannerCallback');
+  } catch (e) {
+    Interlock.Session.createEvent({'kind': 'critical',
+      'msg': '[Interlock.Session.getBanner] ' + e});
+  }
+};
+
+/**
+ * @function
+ * @public
+ *
+ * @description
+ * Applies the deployment branding (title, logo and features) to the
+ * current template
+ *
+ * @returns {}
+ */
+Interlock.Session.applyUI = function() {
+  try {
+    var features = {
+      'keys':     ['#import_key', '#generate_key'],
+      'password': ['#add_password', '#remove_password', '#change_password'],
+      'poweroff': ['#poweroff'],
+      'signal':   ['#signal_registration'],
+      'upload':   ['#file_select_li', '#directory_select_li'],
+      'wifi':     ['#wifi']
+    };
+
+    if (!sessionStorage.InterlockUI) {
+      return;
+    }
+
+    var ui = JSON.parse(sessionStorage.InterlockUI);
+    var $version = $('#interlock_version').contents().first();
+
+    document.title = document.title.replace('INTERLOCK', ui.title);
+
+    if ($version.length) {
+      $version[0].nodeValue = ui.title + ' ';
+    }
+
+    if (ui.logo) {
+      $('#ui_logo').attr('src', ui.logo).show();
+    }
+
+    $.each(features, function(feature, elements) {
+      if ($.inArray(feature, ui.features) < 0) {
+        $.each(elements, function(index, element) {
+          $(element).remove();
+        });
+      }
+    });
+  } catch (e) {
+    Interlock.Session.createEvent({'kind': 'critical',
+      'msg': '[Interlock.Session.applyUI] ' + e});
+  }
+};
+
+/**
+ * @function
+ * @public
+ *
+ * @description
+ * Callback function, stores the deployment branding in the sessionStorage
+ * and applies it
+ *
+ * @param {Object} backendData
+ * @returns {}
+ */
+Interlock.Session.getUICallback = function(backendData) {
+  try {
+    if (backendData.status === 'OK') {
+      sessionStorage.InterlockUI = JSON.stringify(backendData.response);
+      Interlock.Session.applyUI();
+    }
+  } catch (e) {
+    Interlock.Session.createEvent({'kind': 'critical',
+      'msg': '[Interlock.Session.getUICallback] ' + e});
+  }
+};
+
+/**
+ * @function
+ * @public
+ *
+ * @description
+ * Interlock getUI, retrieves the deployment branding from the backend
+ *
+ */
+Interlock.Session.getUI = function() {
+  try {
+    Interlock.Backend.APIRequest(Interlock.Backend.API.status.ui, 'GET',
+        null, 'Session.getUICallback');
+  } catch (e) {
+    Interlock.Session.createEvent({'kind': 'critical',
+      'msg': '[Interlock.Session.getUI] ' + e});
+  }
+};
+
 /**
  * @function
  * @public
@@ -0,0 +1,73 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestStaticHandler(t *testing.T) {
+	root := fstest.MapFS{
+		"index.html":       {Data: []byte("<html>index</html>")},
+		"404.html":         {Data: []byte("<html>custom not found</html>")},
+		"js/app.js":        {Data: []byte("var x;")},
+		"styles/app.css":   {Data: []byte("body {}")},
+		"docs/index.html":  {Data: []byte("<html>docs</html>")},
+		"images/logo.png":  {Data: []byte("png")},
+		".htpasswd":        {Data: []byte("secret")},
+		".git/config":      {Data: []byte("secret")},
+		"js/.app.js.swp":   {Data: []byte("secret")},
+		"images/.DS_Store": {Data: []byte("secret")},
+	}
+
+	h := staticHandler(root)
+
+	get := func(p string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/"+p, nil))
+		return w
+	}
+
+	for p, contentType := range map[string]string{
+		"js/app.js":       "text/javascript; charset=utf-8",
+		"styles/app.css":  "text/css; charset=utf-8",
+		"index.html":      "text/html; charset=utf-8",
+		"images/logo.png": "image/png",
+	} {
+		w := get(p)
+
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != contentType {
+			t.Errorf("%s: unexpected response %d %q", p, w.Code, w.Header().Get("Content-Type"))
+		}
+
+		if w.Header().Get("X-Content-Type-Options") != "nosniff" {
+			t.Errorf("%s: missing nosniff header", p)
+		}
+	}
+
+	if w := get("docs/"); w.Code != http.StatusOK || w.Body.String() != "<html>docs</html>" {
+		t.Errorf("directory index not served: %d %s", w.Code, w.Body.String())
+	}
+
+	for _, p := range []string{"js/", "images", ".htpasswd", ".git/config", ".git/", "js/.app.js.swp", "images/.DS_Store", "missing.js"} {
+		w := get(p)
+
+		if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "custom not found") {
+			t.Errorf("%s: unexpected response %d %s", p, w.Code, w.Body.String())
+		}
+	}
+
+	delete(root, "404.html")
+
+	if w := get("js/"); w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "Not Found") {
+		t.Errorf("default error page not served: %d %s", w.Code, w.Body.String())
+	}
+}
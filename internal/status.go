@@ -47,8 +47,16 @@ func (s *statusBuffer) Log(code syslog.Priority, format string, a ...interface{}
 
 	log.Printf(format, a...)
 
+	e := statusEntry{Epoch: time.Now().Unix(), Code: code, Message: fmt.Sprintf(format, a...)}
+
 	s.LogBuf = s.LogBuf.Prev()
-	s.LogBuf.Value = statusEntry{Epoch: time.Now().Unix(), Code: code, Message: fmt.Sprintf(format, a...)}
+	s.LogBuf.Value = e
+
+	if code <= syslog.LOG_ERR {
+		history.record(e, historyLog)
+	}
+
+	siem.Export(e)
 }
 
 func (s *statusBuffer) Error(err error) {
@@ -57,8 +65,13 @@ func (s *statusBuffer) Error(err error) {
 
 	log.Print(err.Error())
 
+	e := statusEntry{Epoch: time.Now().Unix(), Code: syslog.LOG_ERR, Message: err.Error()}
+
 	s.LogBuf = s.LogBuf.Prev()
-	s.LogBuf.Value = statusEntry{Epoch: time.Now().Unix(), Code: syslog.LOG_ERR, Message: err.Error()}
+	s.LogBuf.Value = e
+
+	history.record(e, historyLog)
+	siem.Export(e)
 }
 
 func (s *statusBuffer) Notify(code syslog.Priority, format string, a ...interface{}) int {
@@ -67,6 +80,7 @@ func (s *statusBuffer) Notify(code syslog.Priority, format string, a ...interfac
 
 	s.n++
 	s.Notification[s.n] = statusEntry{Epoch: time.Now().Unix(), Code: code, Message: fmt.Sprintf(format, a...)}
+	history.record(s.Notification[s.n], historyNotification)
 
 	return s.n
 }
@@ -78,7 +92,61 @@ func (s *statusBuffer) Remove(n int) {
 	delete(s.Notification, n)
 }
 
+// Logs returns a copy of the log buffer entries, most recent first.
+func (s *statusBuffer) Logs() (entries []statusEntry) {
+	s.Lock()
+	defer s.Unlock()
+
+	entries = []statusEntry{}
+
+	s.LogBuf.Do(func(v interface{}) {
+		if v != nil {
+			entries = append(entries, v.(statusEntry))
+		}
+	})
+
+	return
+}
+
+// LastError returns the time of the most recent error level log entry.
+func (s *statusBuffer) LastError() (t time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.LogBuf.Do(func(v interface{}) {
+		if e, ok := v.(statusEntry); ok && e.Code <= syslog.LOG_ERR && e.Epoch > t.Unix() {
+			t = time.Unix(e.Epoch, 0)
+		}
+	})
+
+	return
+}
+
+// Stale returns the identifiers of notifications older than the argument
+// duration.
+func (s *statusBuffer) Stale(age time.Duration) (stale []int) {
+	s.Lock()
+	defer s.Unlock()
+
+	if age <= 0 {
+		return
+	}
+
+	limit := time.Now().Add(-age).Unix()
+
+	for n, entry := range s.Notification {
+		if entry.Epoch < limit {
+			stale = append(stale, n)
+		}
+	}
+
+	return
+}
+
 func (s *statusBuffer) Notifications() (notifications []statusEntry) {
+	s.Lock()
+	defer s.Unlock()
+
 	var keys []int
 
 	for k := range s.Notification {
@@ -107,6 +175,7 @@ func versionStatus() (res jsonObject) {
 			"revision": Revision,
 			"build":    build,
 			"key_path": conf.KeyPath,
+			"tools":    tools.Status(),
 		},
 	}
 
@@ -9,6 +9,7 @@
 package interlock
 
 import (
+	"os"
 	"syscall"
 )
 
@@ -25,17 +26,21 @@ func fsStatus(path string) (total uint64, free uint64, err error) {
 	return
 }
 
+func openFiles() (n int, err error) {
+	fds, err := os.ReadDir("/proc/self/fd")
+
+	if err != nil {
+		return
+	}
+
+	return len(fds), nil
+}
+
 func runningStatus() (res jsonObject) {
 	sys := &syscall.Sysinfo_t{}
 	_ = syscall.Sysinfo(sys)
 
-	log := []statusEntry{}
-
-	status.LogBuf.Do(func(v interface{}) {
-		if v != nil {
-			log = append(log, v.(statusEntry))
-		}
-	})
+	log := status.Logs()
 
 	res = jsonObject{
 		"status": "OK",
@@ -47,6 +52,16 @@ func runningStatus() (res jsonObject) {
 			"freeram":      sys.Freeram,
 			"log":          log,
 			"notification": status.Notifications(),
+			"watchdog":     watchdog.Status(),
+			"dedup_saved":  dedup.Saved(),
+			"power":        power.Status(),
+			"deadman":      deadman.Status(),
+			"errors":       faults.Status(),
+			"ntp":          ntp.Status(),
+			"luks_header":  detachedHeader.Status(),
+			"jobs":         jobs.Status(),
+			"memory":       memory.Status(),
+			"requests":     throttle.Status(),
 		},
 	}
 
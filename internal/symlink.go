@@ -0,0 +1,105 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"path/filepath"
+)
+
+// Symbolic link policies, links resolving outside of the encrypted volume
+// are refused regardless of the policy.
+const (
+	symlinkReject      = "reject"
+	symlinkPreserve    = "preserve"
+	symlinkDereference = "dereference"
+)
+
+const maxLinkTarget = 4096
+
+// archiveLink applies the symbolic link policy to links being archived,
+// returning the link target (preserve) or the information of the linked file
+// (dereference).
+func archiveLink(osPath string) (target string, info os.FileInfo, err error) {
+	switch conf.Symlinks {
+	case symlinkPreserve:
+		target, err = volumeJail().Readlink(osPath)
+	case symlinkDereference:
+		info, err = volumeJail().Stat(osPath)
+
+		if err == nil && !info.Mode().IsRegular() {
+			err = fmt.Errorf("cannot dereference %s, not a regular file", relativePath(osPath))
+		}
+	default:
+		err = fmt.Errorf("symbolic link %s not allowed", relativePath(osPath))
+	}
+
+	return
+}
+
+// extractLink applies the symbolic link policy to links being extracted,
+// preserved links must be relative and resolve within the encrypted volume.
+func extractLink(dstPath string, target string) (err error) {
+	switch conf.Symlinks {
+	case symlinkPreserve:
+		if filepath.IsAbs(target) || !volumeJail().Contains(filepath.Join(filepath.Dir(dstPath), target)) {
+			return fmt.Errorf("symbolic link %s resolves outside of the encrypted volume", relativePath(dstPath))
+		}
+
+		if err = volumeJail().MkdirAll(filepath.Dir(dstPath), 0700); err != nil {
+			return
+		}
+
+		return volumeJail().Symlink(target, dstPath)
+	case symlinkDereference:
+		// the link target content is not available within the archive
+		status.Log(syslog.LOG_WARNING, "skipping symbolic link %s", relativePath(dstPath))
+	default:
+		err = fmt.Errorf("symbolic link %s not allowed", relativePath(dstPath))
+	}
+
+	return
+}
+
+// extractHardlink applies the link policy to hard links being extracted,
+// dereferenced links are extracted as copies of the linked file.
+func extractHardlink(dst string, dstPath string, target string) (err error) {
+	j := &jail{root: dst}
+	src, err := j.Path(target)
+
+	if err != nil {
+		return
+	}
+
+	switch conf.Symlinks {
+	case symlinkPreserve:
+		return j.Link(src, dstPath)
+	case symlinkDereference:
+		input, err := j.Open(src)
+
+		if err != nil {
+			return err
+		}
+		defer input.Close()
+
+		output, err := j.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_TRUNC, 0600)
+
+		if err != nil {
+			return err
+		}
+		defer output.Close()
+
+		_, err = io.Copy(output, input)
+
+		return err
+	default:
+		return fmt.Errorf("hard link %s not allowed", relativePath(dstPath))
+	}
+}
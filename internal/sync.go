@@ -0,0 +1,264 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/http"
+	"os"
+	"path"
+)
+
+// rsync-style delta synchronization, the client retrieves the block
+// signatures of an existing file and submits a delta composed of references
+// to existing blocks and literal data.
+
+const syncBlockSize = 4096
+const maxSyncBlockSize = 1 << 20
+
+type blockSignature struct {
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"`
+}
+
+// rsync rolling checksum
+func weakChecksum(buf []byte) uint32 {
+	var a, b uint32
+
+	l := uint32(len(buf))
+
+	for i, c := range buf {
+		a += uint32(c)
+		b += (l - uint32(i)) * uint32(c)
+	}
+
+	return (a & 0xffff) | (b&0xffff)<<16
+}
+
+func strongChecksum(buf []byte) string {
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:])
+}
+
+func fileSync(r *http.Request) (res jsonObject) {
+	var blockSize int64 = syncBlockSize
+
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	osPath, err := absolutePath(req["path"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if n, ok := req["block_size"].(json.Number); ok {
+		blockSize, err = n.Int64()
+
+		if err != nil {
+			return errorResponse(errors.New("invalid block size"), "")
+		}
+	}
+
+	switch req["op"].(string) {
+	case "signature":
+		var signatures []blockSignature
+
+		signatures, err = syncSignatures(osPath, blockSize)
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+
+		res = jsonObject{
+			"status": "OK",
+			"response": map[string]interface{}{
+				"block_size": blockSize,
+				"blocks":     signatures,
+			},
+		}
+	case "patch":
+		err = requireAttributes(req, "delta", "sha256")
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+
+		err = locks.Check(osPath, lockToken(r))
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+
+		err = syncPatch(osPath, blockSize, req["delta"].([]interface{}), req["sha256"].(string))
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+
+		res = jsonObject{
+			"status":   "OK",
+			"response": nil,
+		}
+	default:
+		return errorResponse(errors.New("unsupported operation"), "")
+	}
+
+	return
+}
+
+func syncSignatures(osPath string, blockSize int64) (signatures []blockSignature, err error) {
+	signatures = []blockSignature{}
+
+	input, err := volumeJail().Open(osPath)
+
+	if os.IsNotExist(err) {
+		// new file, the delta must include all data as literal
+		return signatures, nil
+	}
+
+	if err != nil {
+		return
+	}
+	defer input.Close()
+
+	buf := make([]byte, blockSize)
+
+	for {
+		n, e := io.ReadFull(input, buf)
+
+		if n > 0 {
+			signatures = append(signatures, blockSignature{
+				Weak:   weakChecksum(buf[0:n]),
+				Strong: strongChecksum(buf[0:n]),
+			})
+		}
+
+		if e == io.EOF || e == io.ErrUnexpectedEOF {
+			break
+		}
+
+		if e != nil {
+			return nil, e
+		}
+	}
+
+	return
+}
+
+func syncPatch(osPath string, blockSize int64, delta []interface{}, sha256sum string) (err error) {
+	var written int64
+	var reused int64
+
+	if inKeyPath, _ := detectKeyPath(osPath); inKeyPath {
+		return errors.New("synchronizing files within key storage is not allowed")
+	}
+
+	input, err := volumeJail().Open(osPath)
+
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+
+	if input != nil {
+		defer input.Close()
+	}
+
+	output, err := volumeJail().CreateTemp(path.Dir(osPath), ".sync-")
+
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		output.Close()
+
+		if err != nil {
+			volumeJail().Remove(output.Name())
+		}
+	}()
+
+	h := sha256.New()
+	w := io.MultiWriter(output, h)
+	buf := make([]byte, blockSize)
+
+	for _, d := range delta {
+		var n int
+
+		op, ok := d.(map[string]interface{})
+
+		if !ok {
+			return errors.New("invalid delta entry")
+		}
+
+		if b, ok := op["block"].(json.Number); ok {
+			var i int64
+
+			if i, err = b.Int64(); err != nil || i < 0 || input == nil {
+				return errors.New("invalid block reference")
+			}
+
+			n, err = input.ReadAt(buf, i*blockSize)
+
+			if err == io.EOF && n > 0 {
+				err = nil
+			}
+
+			if err != nil {
+				return fmt.Errorf("invalid block reference %d", i)
+			}
+
+			reused += int64(n)
+		} else if data, ok := op["data"].(string); ok {
+			var literal []byte
+
+			if literal, err = base64.StdEncoding.DecodeString(data); err != nil {
+				return
+			}
+
+			n = copy(buf, literal)
+
+			if n < len(literal) {
+				return errors.New("literal data exceeds block size")
+			}
+		} else {
+			return errors.New("invalid delta entry")
+		}
+
+		if _, err = w.Write(buf[0:n]); err != nil {
+			return
+		}
+
+		written += int64(n)
+	}
+
+	if hex.EncodeToString(h.Sum(nil)) != sha256sum {
+		return errors.New("checksum mismatch, synchronization aborted")
+	}
+
+	if err = output.Chmod(0600); err != nil {
+		return
+	}
+
+	if err = volumeJail().Rename(output.Name(), osPath); err != nil {
+		return
+	}
+
+	status.Log(syslog.LOG_INFO, "synchronized %s (%v bytes, %v reused)", relativePath(osPath), written, reused)
+
+	return
+}
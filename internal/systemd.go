@@ -0,0 +1,195 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// systemd service manager integration (sd_notify protocol), when started as a
+// `Type=notify` unit (NOTIFY_SOCKET set) readiness is signalled once all
+// listeners are bound and the unit status string reports the volume and
+// session state.
+//
+// With `WatchdogSec=` set keep-alive pings are sent at half the watchdog
+// interval, each ping first takes the session and guest locks so that a
+// deadlocked server stops pinging and is restarted by the service manager.
+//
+// The notification socket is connected before confinement is applied, as it
+// might not be reachable afterwards.
+
+const systemdStatusInterval = 30 * time.Second
+
+type systemdNotifier struct {
+	sync.Mutex
+	conn   *net.UnixConn
+	status string
+}
+
+var systemd systemdNotifier
+
+// Connect opens the service manager notification socket, if any.
+func (n *systemdNotifier) Connect() (err error) {
+	name := os.Getenv("NOTIFY_SOCKET")
+
+	if name == "" {
+		return
+	}
+
+	// abstract namespace sockets
+	if strings.HasPrefix(name, "@") {
+		name = "\x00" + name[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+
+	if err != nil {
+		return fmt.Errorf("systemd notification socket, %v", err)
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	n.conn = conn
+	n.status = ""
+
+	return
+}
+
+// Notify sends state assignments (e.g. "READY=1") to the service manager, it
+// is a no-op when not supervised by systemd.
+func (n *systemdNotifier) Notify(state ...string) (err error) {
+	n.Lock()
+	defer n.Unlock()
+
+	if n.conn == nil {
+		return
+	}
+
+	_, err = n.conn.Write([]byte(strings.Join(state, "\n")))
+
+	return
+}
+
+// Status reports the current state in the unit status string, if changed.
+func (n *systemdNotifier) Status() (err error) {
+	s := systemdStatus()
+
+	n.Lock()
+	changed := s != n.status
+	n.status = s
+	n.Unlock()
+
+	if !changed {
+		return
+	}
+
+	return n.Notify("STATUS=" + s)
+}
+
+// Close releases the notification socket.
+func (n *systemdNotifier) Close() {
+	n.Lock()
+	defer n.Unlock()
+
+	if n.conn != nil {
+		n.conn.Close()
+		n.conn = nil
+	}
+
+	n.status = ""
+}
+
+// systemdWatchdog returns the keep-alive interval requested by the service
+// manager, if any.
+func systemdWatchdog() (interval time.Duration) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+
+	if err != nil || usec <= 0 {
+		return
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// systemdStatus returns a description of the volume and session state.
+func systemdStatus() string {
+	var active int
+
+	session.Lock()
+	volume := session.Volume
+	session.Unlock()
+
+	guests.Lock()
+	now := time.Now().Unix()
+
+	for _, g := range guests.guests {
+		if g.sessionID != "" && now <= g.Expiry {
+			active++
+		}
+	}
+	guests.Unlock()
+
+	if volume == "" {
+		return "volume locked"
+	}
+
+	return fmt.Sprintf("volume %s unlocked, %d guest session(s)", volume, active)
+}
+
+// notifyReady signals readiness to the service manager and starts status
+// updates and, if requested, watchdog keep-alive pings.
+func notifyReady() (err error) {
+	systemd.Lock()
+	supervised := systemd.conn != nil
+	systemd.Unlock()
+
+	if !supervised {
+		return
+	}
+
+	if err = systemd.Notify("READY=1"); err != nil {
+		return
+	}
+
+	if err = systemd.Status(); err != nil {
+		return
+	}
+
+	interval := systemdWatchdog()
+	keepalive := interval > 0
+
+	if !keepalive {
+		interval = systemdStatusInterval
+	}
+
+	go func() {
+		for {
+			time.Sleep(interval)
+
+			// status collection verifies that the session locks
+			// can be acquired
+			systemd.Status()
+
+			if keepalive {
+				systemd.Notify("WATCHDOG=1")
+			}
+		}
+	}()
+
+	return
+}
@@ -0,0 +1,88 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSystemdNotify(t *testing.T) {
+	session.Clear()
+
+	path := filepath.Join(t.TempDir(), "notify")
+	l, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	os.Setenv("NOTIFY_SOCKET", path)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	if err = systemd.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer systemd.Close()
+
+	read := func() string {
+		buf := make([]byte, 1024)
+		l.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := l.Read(buf)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return string(buf[:n])
+	}
+
+	if err = notifyReady(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := read(); s != "READY=1" {
+		t.Errorf("unexpected readiness notification %q", s)
+	}
+
+	if s := read(); s != "STATUS=volume locked" {
+		t.Errorf("unexpected status %q", s)
+	}
+
+	session.Set("test", "id", "token")
+	defer session.Clear()
+
+	if err = systemd.Status(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := read(); s != "STATUS=volume test unlocked, 0 guest session(s)" {
+		t.Errorf("unexpected status %q", s)
+	}
+}
+
+func TestSystemdWatchdog(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+
+	os.Setenv("WATCHDOG_USEC", "30000000")
+
+	if interval := systemdWatchdog(); interval != 15*time.Second {
+		t.Errorf("unexpected interval %v", interval)
+	}
+
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+
+	if interval := systemdWatchdog(); interval != 0 {
+		t.Errorf("watchdog enabled for another process (%v)", interval)
+	}
+}
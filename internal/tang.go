@@ -0,0 +1,224 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/syslog"
+	"strings"
+	"time"
+)
+
+// Network-Bound Disk Encryption (NBDE), the `tang_volume` is unlocked at
+// startup when one of the tang servers it is bound to is reachable. Bindings
+// are the LUKS2 "clevis" tokens created with `clevis luks bind -d <device>
+// tang '{"url": ...}'`, their JWE is decrypted with clevis, which performs
+// the key recovery exchange with the tang server, to obtain the keyslot
+// passphrase. The volume is left locked, for passphrase login, when no server
+// is reachable within `tang_timeout`.
+
+const clevisTokenType = "clevis"
+const clevis = "/usr/bin/clevis"
+
+// interval between unlock attempts
+const tangRetry = 10 * time.Second
+
+type clevisBinding struct {
+	Keyslots []string
+	URL      string
+	// JWE compact serialization
+	JWE string
+}
+
+type clevisJWE struct {
+	Protected    string `json:"protected"`
+	EncryptedKey string `json:"encrypted_key"`
+	IV           string `json:"iv"`
+	Ciphertext   string `json:"ciphertext"`
+	Tag          string `json:"tag"`
+}
+
+// tangURL returns the tang server of a JWE protected header, or an empty
+// string for other clevis pins.
+func tangURL(protected string) (url string, err error) {
+	var header struct {
+		Clevis struct {
+			Pin  string `json:"pin"`
+			Tang struct {
+				URL string `json:"url"`
+			} `json:"tang"`
+		} `json:"clevis"`
+	}
+
+	buf, err := base64.RawURLEncoding.DecodeString(protected)
+
+	if err != nil {
+		return
+	}
+
+	if err = json.Unmarshal(buf, &header); err != nil {
+		return
+	}
+
+	if header.Clevis.Pin != "tang" {
+		return
+	}
+
+	return header.Clevis.Tang.URL, nil
+}
+
+func tangAllowed(url string) bool {
+	if len(conf.TangServers) == 0 {
+		return true
+	}
+
+	for _, s := range conf.TangServers {
+		if strings.TrimSuffix(s, "/") == strings.TrimSuffix(url, "/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clevisBindings parses LUKS2 JSON metadata for clevis tang tokens, bindings
+// to servers not listed in `tang_servers`, if set, are ignored.
+func clevisBindings(metadata []byte) (bindings []clevisBinding, err error) {
+	var luks2 struct {
+		Tokens map[string]json.RawMessage `json:"tokens"`
+	}
+
+	if err = json.Unmarshal(metadata, &luks2); err != nil {
+		return
+	}
+
+	for _, t := range luks2.Tokens {
+		var token struct {
+			Type     string    `json:"type"`
+			Keyslots []string  `json:"keyslots"`
+			JWE      clevisJWE `json:"jwe"`
+		}
+
+		if err = json.Unmarshal(t, &token); err != nil {
+			return
+		}
+
+		if token.Type != clevisTokenType {
+			continue
+		}
+
+		url, err := tangURL(token.JWE.Protected)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if url == "" || !tangAllowed(url) {
+			continue
+		}
+
+		jwe := token.JWE
+
+		bindings = append(bindings, clevisBinding{
+			Keyslots: token.Keyslots,
+			URL:      url,
+			JWE:      strings.Join([]string{jwe.Protected, jwe.EncryptedKey, jwe.IV, jwe.Ciphertext, jwe.Tag}, "."),
+		})
+	}
+
+	if len(bindings) == 0 {
+		err = errors.New("no tang binding found")
+	}
+
+	return
+}
+
+// tangPassphrase recovers the keyslot passphrase of a volume from its tang
+// bindings.
+func tangPassphrase(volume string) (passphrase string, err error) {
+	metadata, err := luksMetadata(volume)
+
+	if err != nil {
+		return
+	}
+
+	bindings, err := clevisBindings([]byte(metadata))
+
+	if err != nil {
+		return
+	}
+
+	for _, b := range bindings {
+		passphrase, err = execCommand(clevis, []string{"decrypt"}, b.JWE)
+
+		if err == nil && passphrase != "" {
+			return
+		}
+
+		status.Log(syslog.LOG_NOTICE, "tang recovery failed for keyslot(s) %v on %s", b.Keyslots, b.URL)
+	}
+
+	return "", fmt.Errorf("no tang server reachable for %s", volume)
+}
+
+// startTang attempts the unattended unlock of `tang_volume` until successful,
+// `tang_timeout` expiration or a login with another method.
+func startTang() {
+	if conf.TangVolume == "" {
+		return
+	}
+
+	volume := conf.TangVolume
+	deadline := time.Now().Add(time.Duration(conf.TangTimeout) * time.Second)
+
+	go func() {
+		defer recoverJob("unlocking with tang")
+
+		for {
+			if session.Active() {
+				return
+			}
+
+			passphrase, err := tangPassphrase(volume)
+
+			if err == nil {
+				tangUnlock(volume, passphrase)
+				return
+			}
+
+			if time.Now().After(deadline) {
+				status.Log(syslog.LOG_NOTICE, "tang unlock unavailable, passphrase login required (%v)", err)
+				return
+			}
+
+			time.Sleep(tangRetry)
+		}
+	}()
+}
+
+func tangUnlock(volume string, passphrase string) {
+	if session.Active() {
+		return
+	}
+
+	if err := authenticate(context.Background(), volume, passphrase, false); err != nil {
+		loginFailed(volume, "tang", "")
+		status.Error(fmt.Errorf("tang unlock failed: %v", err))
+		return
+	}
+
+	if _, _, err := startSession(volume, "tang"); err != nil {
+		status.Error(fmt.Errorf("tang unlock failed: %v", err))
+		return
+	}
+
+	status.Log(syslog.LOG_NOTICE, "volume %s unlocked with tang", volume)
+}
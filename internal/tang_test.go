@@ -0,0 +1,74 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"testing"
+)
+
+// LUKS2 metadata excerpt after `clevis luks bind` with the tang and tpm2 pins
+const clevisMetadata = `{
+  "keyslots": {},
+  "tokens": {
+    "0": {
+      "type": "clevis",
+      "keyslots": ["1"],
+      "jwe": {
+        "ciphertext": "Y2lwaGVydGV4dA",
+        "encrypted_key": "",
+        "iv": "aXZpdml2aXZpdml2",
+        "protected": "eyJhbGciOiJFQ0RILUVTIiwiZW5jIjoiQTI1NkdDTSIsImNsZXZpcyI6eyJwaW4iOiJ0YW5nIiwidGFuZyI6eyJ1cmwiOiJodHRwOi8vdGFuZy5leGFtcGxlLmNvbSJ9fX0",
+        "tag": "dGFndGFndGFndGFndGFn"
+      }
+    },
+    "1": {
+      "type": "clevis",
+      "keyslots": ["2"],
+      "jwe": {
+        "ciphertext": "Y2lwaGVydGV4dA",
+        "encrypted_key": "",
+        "iv": "aXZpdml2aXZpdml2",
+        "protected": "eyJhbGciOiJkaXIiLCJlbmMiOiJBMjU2R0NNIiwiY2xldmlzIjp7InBpbiI6InRwbTIifX0",
+        "tag": "dGFndGFndGFndGFndGFn"
+      }
+    },
+    "2": {
+      "type": "systemd-fido2",
+      "keyslots": ["3"]
+    }
+  }
+}`
+
+func TestClevisBindings(t *testing.T) {
+	defer conf.SetDefaults()
+
+	bindings, err := clevisBindings([]byte(clevisMetadata))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(bindings) != 1 || bindings[0].URL != "http://tang.example.com" || bindings[0].Keyslots[0] != "1" {
+		t.Fatalf("unexpected bindings: %+v", bindings)
+	}
+
+	if expected := "eyJhbGciOiJFQ0RILUVTIiwiZW5jIjoiQTI1NkdDTSIsImNsZXZpcyI6eyJwaW4iOiJ0YW5nIiwidGFuZyI6eyJ1cmwiOiJodHRwOi8vdGFuZy5leGFtcGxlLmNvbSJ9fX0..aXZpdml2aXZpdml2.Y2lwaGVydGV4dA.dGFndGFndGFndGFndGFn"; bindings[0].JWE != expected {
+		t.Errorf("unexpected JWE compact serialization: %s", bindings[0].JWE)
+	}
+
+	conf.TangServers = []string{"http://tang.example.com/"}
+
+	if bindings, err = clevisBindings([]byte(clevisMetadata)); err != nil || len(bindings) != 1 {
+		t.Errorf("allowed tang server ignored: %v", err)
+	}
+
+	conf.TangServers = []string{"http://other.example.com"}
+
+	if _, err = clevisBindings([]byte(clevisMetadata)); err == nil {
+		t.Error("binding to unlisted tang server accepted")
+	}
+}
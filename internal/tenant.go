@@ -0,0 +1,176 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Multi-tenant operation, the `tenants` section maps tenant names to
+// configuration overrides applied on top of the rest of the configuration
+// file. When tenants are configured the daemon acts as a supervisor which
+// executes, and restarts on exit, one server process per tenant (`-n <name>`).
+//
+// Separate processes ensure that sessions, volumes, keys and in-memory state
+// are never shared. Each tenant uses its own device mapper name
+// (interlockfs-<name>), mount point (~/.interlock-mnt-<name>) and session
+// cookie name, while overrides must provide distinct bind addresses and
+// typically volume_group or volume_path, key_path and static_path.
+
+const tenantRestartDelay = 5 * time.Second
+
+var tenantPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// SetTenant applies the configuration overrides of the argument tenant.
+func (c *Config) SetTenant(name string) (err error) {
+	overrides, ok := c.Tenants[name]
+
+	if !ok || !tenantPattern.MatchString(name) {
+		return fmt.Errorf("invalid tenant %s", name)
+	}
+
+	// cookies are not isolated by port
+	c.CookieName += "-" + name
+
+	if err = json.Unmarshal(overrides, c); err != nil {
+		return fmt.Errorf("invalid tenant %s configuration, %v", name, err)
+	}
+
+	c.Tenants = nil
+	c.tenant = name
+
+	return
+}
+
+// volumeMapping returns the device mapper name of the unlocked volume.
+func volumeMapping() string {
+	if conf.tenant != "" {
+		return mapping + "-" + conf.tenant
+	}
+
+	return mapping
+}
+
+// tenantMountPoint returns the volume mount point within the argument home
+// directory.
+func tenantMountPoint(home string) string {
+	if conf.tenant != "" {
+		return filepath.Join(home, mountPoint+"-"+conf.tenant)
+	}
+
+	return filepath.Join(home, mountPoint)
+}
+
+// tenantNames validates the configured tenants, returning their names.
+func (c *Config) tenantNames() (names []string, err error) {
+	addrs := make(map[string]string)
+
+	for name, overrides := range c.Tenants {
+		var t struct {
+			BindAddress string `json:"bind_address"`
+		}
+
+		if !tenantPattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid tenant name %s", name)
+		}
+
+		if err = json.Unmarshal(overrides, &t); err != nil {
+			return nil, fmt.Errorf("invalid tenant %s configuration, %v", name, err)
+		}
+
+		if t.BindAddress == "" {
+			return nil, fmt.Errorf("tenant %s requires a bind_address", name)
+		}
+
+		for _, addr := range strings.Split(t.BindAddress, ",") {
+			if other, ok := addrs[addr]; ok {
+				return nil, fmt.Errorf("tenants %s and %s share bind address %s", other, name, addr)
+			}
+
+			addrs[addr] = name
+		}
+
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return
+}
+
+// ServeTenants supervises one server process for each configured tenant, it
+// does not return unless an error occurs.
+func ServeTenants(configPath string) (err error) {
+	names, err := conf.tenantNames()
+
+	if err != nil {
+		return
+	}
+
+	if len(names) == 0 {
+		return errors.New("no tenants configured")
+	}
+
+	self, err := os.Executable()
+
+	if err != nil {
+		return
+	}
+
+	if err = systemd.Connect(); err != nil {
+		return
+	}
+
+	// tenant processes do not notify systemd
+	os.Unsetenv("NOTIFY_SOCKET")
+
+	errs := make(chan error, len(names))
+
+	for _, name := range names {
+		go superviseTenant(self, configPath, name, errs)
+	}
+
+	systemd.Notify("READY=1", fmt.Sprintf("STATUS=supervising %d tenant(s)", len(names)))
+
+	return <-errs
+}
+
+func superviseTenant(self string, configPath string, name string, errs chan<- error) {
+	args := []string{"-c", configPath, "-n", name}
+
+	if conf.Debug {
+		args = append(args, "-d")
+	}
+
+	for {
+		c := exec.Command(self, args...)
+		c.Stdout = os.Stdout
+		c.Stderr = os.Stderr
+
+		log.Printf("starting tenant %s", name)
+
+		if err := c.Start(); err != nil {
+			errs <- fmt.Errorf("tenant %s, %v", name, err)
+			return
+		}
+
+		err := c.Wait()
+		log.Printf("tenant %s exited (%v), restarting in %v", name, err, tenantRestartDelay)
+
+		time.Sleep(tenantRestartDelay)
+	}
+}
@@ -0,0 +1,126 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// Request throttling, API requests are limited to `session_requests`
+// concurrent ones for each session (or client address when unauthenticated),
+// up to `session_queue` further requests wait for their turn while others are
+// rejected with the BUSY status (HTTP 429). Simultaneous guest sessions opened
+// from the same client address are limited to `client_sessions`.
+//
+// This prevents a single misbehaving client or script from monopolizing the
+// device. Requests are only accounted to a session once its cookie is
+// validated, as clients could otherwise obtain a fresh allowance by sending
+// arbitrary cookies.
+
+var errThrottled = errors.New("too many concurrent requests, retry later")
+var errTooManySessions = errors.New("too many sessions from client address")
+
+type ownerRequests struct {
+	slots   chan struct{}
+	pending int
+}
+
+type requestLimiter struct {
+	sync.Mutex
+	owners   map[string]*ownerRequests
+	rejected int
+}
+
+var throttle requestLimiter
+
+// Acquire waits for a request slot of the argument owner, an error is
+// returned when its queue is full or the client goes away while waiting.
+func (l *requestLimiter) Acquire(r *http.Request, owner string) (release func(), err error) {
+	if conf.SessionRequests <= 0 {
+		return func() {}, nil
+	}
+
+	l.Lock()
+
+	if l.owners == nil {
+		l.owners = make(map[string]*ownerRequests)
+	}
+
+	o, ok := l.owners[owner]
+
+	if !ok {
+		o = &ownerRequests{
+			slots: make(chan struct{}, conf.SessionRequests),
+		}
+
+		l.owners[owner] = o
+	}
+
+	if o.pending >= cap(o.slots)+conf.SessionQueue {
+		l.rejected++
+		l.Unlock()
+
+		return nil, errThrottled
+	}
+
+	o.pending++
+	l.Unlock()
+
+	release = func() {
+		<-o.slots
+		l.done(owner, o)
+	}
+
+	select {
+	case o.slots <- struct{}{}:
+	case <-r.Context().Done():
+		l.done(owner, o)
+		return nil, r.Context().Err()
+	}
+
+	return
+}
+
+// throttleOwner identifies the throttled client, the session (or guest) of
+// requests with a valid session cookie or the client address otherwise.
+func throttleOwner(r *http.Request) string {
+	if validSessionID, _, _ := session.Validate(r); validSessionID || guests.Validate(r, false) != nil {
+		return jobOwner(r)
+	}
+
+	return clientAddress(r)
+}
+
+func (l *requestLimiter) done(owner string, o *ownerRequests) {
+	l.Lock()
+	defer l.Unlock()
+
+	o.pending--
+
+	if o.pending == 0 {
+		delete(l.owners, owner)
+	}
+}
+
+func (l *requestLimiter) Status() map[string]interface{} {
+	l.Lock()
+	defer l.Unlock()
+
+	pending := 0
+
+	for _, o := range l.owners {
+		pending += o.pending
+	}
+
+	return map[string]interface{}{
+		"clients":  len(l.owners),
+		"pending":  pending,
+		"rejected": l.rejected,
+	}
+}
@@ -0,0 +1,153 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"context"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestThrottle(t *testing.T) {
+	conf.SetDefaults()
+	defer conf.SetDefaults()
+
+	conf.SessionRequests = 1
+	conf.SessionQueue = 1
+
+	l := &requestLimiter{}
+	r := httptest.NewRequest("POST", "/api/file/list", nil)
+
+	release, err := l.Acquire(r, "a")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// queued request
+	acquired := make(chan func())
+
+	go func() {
+		next, err := l.Acquire(r, "a")
+
+		if err != nil {
+			t.Error(err)
+		}
+
+		acquired <- next
+	}()
+
+	for l.Status()["pending"] != 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err = l.Acquire(r, "a"); err != errThrottled {
+		t.Errorf("request exceeding queue accepted (%v)", err)
+	}
+
+	// other sessions are unaffected
+	other, err := l.Acquire(r, "b")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other()
+
+	select {
+	case <-acquired:
+		t.Fatal("request exceeded concurrency limit")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	release()
+
+	select {
+	case next := <-acquired:
+		next()
+	case <-time.After(time.Second):
+		t.Fatal("queued request not resumed")
+	}
+
+	// clients going away while queued
+	release, _ = l.Acquire(r, "a")
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	if _, err = l.Acquire(r.WithContext(ctx), "a"); err == nil {
+		t.Error("canceled request acquired")
+	}
+
+	release()
+
+	if s := l.Status(); s["pending"] != 0 || s["clients"] != 0 || s["rejected"] != 1 {
+		t.Errorf("unexpected status %v", s)
+	}
+}
+
+func TestThrottleOwner(t *testing.T) {
+	c := newTestServer(t)
+
+	r := httptest.NewRequest("POST", "/api/file/list", nil)
+	r.AddCookie(&http.Cookie{Name: conf.CookieName, Value: "random"})
+
+	if owner := throttleOwner(r); owner != clientAddress(r) {
+		t.Errorf("invalid session cookie accounted to its own owner: %s", owner)
+	}
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	session.Lock()
+	sessionID := session.SessionID
+	session.Unlock()
+
+	r = httptest.NewRequest("POST", "/api/file/list", nil)
+	r.AddCookie(&http.Cookie{Name: conf.CookieName, Value: sessionID})
+
+	if owner := throttleOwner(r); owner != jobOwner(r) || owner == clientAddress(r) {
+		t.Errorf("valid session not accounted to its owner: %s", owner)
+	}
+}
+
+func TestClientSessions(t *testing.T) {
+	c := newTestServer(t)
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	conf.ClientSessions = 1
+
+	var credentials []map[string]interface{}
+
+	for i := 0; i < 2; i++ {
+		res := c.mustCall("guest/create", jsonObject{"path": "/", "ops": []string{"list"}, "duration": 60})
+		credentials = append(credentials, res["response"].(map[string]interface{}))
+	}
+
+	jar, _ := cookiejar.New(nil)
+	g := &apiClient{t: t, srv: c.srv, client: &http.Client{Jar: jar}}
+
+	g.mustCall("auth/guest", jsonObject{"username": credentials[0]["username"], "password": credentials[0]["password"]})
+
+	// logging in again replaces the guest own session
+	g.mustCall("auth/guest", jsonObject{"username": credentials[0]["username"], "password": credentials[0]["password"]})
+
+	if res := g.call("auth/guest", jsonObject{"username": credentials[1]["username"], "password": credentials[1]["password"]}); res["status"] != "INVALID_SESSION" {
+		t.Errorf("session exceeding client limit accepted: %v", res)
+	}
+
+	c.mustCall("guest/revoke", jsonObject{"username": credentials[0]["username"]})
+	g.mustCall("auth/guest", jsonObject{"username": credentials[1]["username"], "password": credentials[1]["password"]})
+}
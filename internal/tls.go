@@ -15,6 +15,8 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"log/syslog"
@@ -27,6 +29,12 @@ import (
 	"time"
 )
 
+type listenerTLS struct {
+	TLSCert     string `json:"tls_cert"`
+	TLSKey      string `json:"tls_key"`
+	TLSClientCA string `json:"tls_client_ca"`
+}
+
 func ConfigureServer() (srv *http.Server, err error) {
 	var TLSCert []byte
 	var TLSKey []byte
@@ -38,7 +46,8 @@ func ConfigureServer() (srv *http.Server, err error) {
 	switch conf.TLS {
 	case "off":
 		srv = &http.Server{
-			Addr: conf.BindAddress,
+			Addr:    conf.BindAddress,
+			Handler: mux,
 		}
 
 		return
@@ -111,7 +120,8 @@ func ConfigureServer() (srv *http.Server, err error) {
 		}
 
 		srv = &http.Server{
-			Addr: conf.BindAddress,
+			Addr:    conf.BindAddress,
+			Handler: mux,
 			TLSConfig: &tls.Config{
 				Certificates: []tls.Certificate{certificate},
 				ClientAuth:   tls.RequireAndVerifyClientCert,
@@ -120,24 +130,228 @@ func ConfigureServer() (srv *http.Server, err error) {
 		}
 	} else {
 		srv = &http.Server{
-			Addr: conf.BindAddress,
+			Addr:    conf.BindAddress,
+			Handler: mux,
 			TLSConfig: &tls.Config{
 				Certificates: []tls.Certificate{certificate},
 			},
 		}
+
+		if conf.PIVCA != "" {
+			// optional client certificates for PIV login
+			srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			srv.TLSConfig.ClientCAs, err = pivRoots()
+		}
 	}
 
 	return
 }
 
 func StartServer(srv *http.Server) (err error) {
-	if conf.TLS == "off" {
-		log.Printf("starting HTTP server on %s", conf.BindAddress)
-		return srv.ListenAndServe()
-	} else {
-		log.Printf("starting HTTPS server on %s", conf.BindAddress)
-		return srv.ListenAndServeTLS("", "")
+	startWatchdog()
+	startClock()
+	startPowerMonitor()
+	startSensorsMonitor()
+
+	if err = auditTools(); err != nil {
+		return
+	}
+
+	if err = startIndicator(); err != nil {
+		return
+	}
+
+	if err = startUSBNetwork(); err != nil {
+		return
+	}
+
+	if err = startNTP(); err != nil {
+		return
+	}
+
+	if err = checkWebhooks(); err != nil {
+		return
+	}
+
+	if err = checkPush(); err != nil {
+		return
+	}
+
+	if err = startSIEM(); err != nil {
+		return
+	}
+
+	if err = startMeasurements(); err != nil {
+		return
+	}
+
+	if err = startDeadman(); err != nil {
+		return
+	}
+
+	if err = startDebugServer(); err != nil {
+		return
+	}
+
+	if err = startReplication(); err != nil {
+		return
+	}
+
+	if err = startConsole(); err != nil {
+		return
+	}
+
+	startTang()
+
+	if err = startGRPC(); err != nil {
+		return
+	}
+
+	if err = startMDNS(srv); err != nil {
+		return
+	}
+
+	if err = startKeypad(); err != nil {
+		return
+	}
+
+	if err = startAccessWindows(); err != nil {
+		return
+	}
+
+	switch conf.SessionBinding {
+	case bindingOff, bindingSubnet, bindingIP, bindingStrict:
+	default:
+		return fmt.Errorf("invalid session binding %q", conf.SessionBinding)
+	}
+
+	return serve(srv)
+}
+
+// listenerTLSConfig returns the TLS configuration for a listening address,
+// applying its listener_tls settings if any.
+func listenerTLSConfig(base *tls.Config, addr string) (c *tls.Config, err error) {
+	c = base.Clone()
+
+	if len(c.NextProtos) == 0 {
+		c.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	l, ok := conf.ListenerTLS[addr]
+
+	if !ok {
+		return
+	}
+
+	if l.TLSCert != "" || l.TLSKey != "" {
+		var cert tls.Certificate
+
+		if cert, err = tls.LoadX509KeyPair(l.TLSCert, l.TLSKey); err != nil {
+			return
+		}
+
+		c.Certificates = []tls.Certificate{cert}
 	}
+
+	if l.TLSClientCA != "" {
+		var ca []byte
+
+		if ca, err = ioutil.ReadFile(l.TLSClientCA); err != nil {
+			return
+		}
+
+		pool := x509.NewCertPool()
+
+		if ok := pool.AppendCertsFromPEM(ca); !ok {
+			return nil, fmt.Errorf("could not parse client certificate authority for %s", addr)
+		}
+
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+		c.ClientCAs = pool
+	}
+
+	return
+}
+
+// serve starts the HTTP server on all bind addresses, returning when any of
+// the listeners fails.
+func serve(srv *http.Server) (err error) {
+	var listeners []net.Listener
+
+	addrs := conf.bindAddresses()
+
+	if len(addrs) == 0 {
+		return errors.New("missing bind address")
+	}
+
+	for addr := range conf.ListenerTLS {
+		if conf.TLS == "off" {
+			return errors.New("listener_tls requires tls")
+		}
+
+		found := false
+
+		for _, a := range addrs {
+			found = found || a == addr
+		}
+
+		if !found {
+			return fmt.Errorf("listener_tls address %s is not a bind address", addr)
+		}
+	}
+
+	defer func() {
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+		}
+	}()
+
+	for _, addr := range addrs {
+		var l net.Listener
+		var c *tls.Config
+
+		if l, err = net.Listen("tcp", addr); err != nil {
+			return
+		}
+
+		listeners = append(listeners, l)
+
+		if conf.TLS == "off" {
+			log.Printf("starting HTTP server on %s", addr)
+			continue
+		}
+
+		if c, err = listenerTLSConfig(srv.TLSConfig, addr); err != nil {
+			return
+		}
+
+		listeners[len(listeners)-1] = tls.NewListener(l, c)
+		log.Printf("starting HTTPS server on %s", addr)
+	}
+
+	if err = systemd.Connect(); err != nil {
+		return
+	}
+
+	if err = confine(); err != nil {
+		return
+	}
+
+	if err = notifyReady(); err != nil {
+		return
+	}
+
+	errs := make(chan error, len(listeners))
+
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			errs <- srv.Serve(l)
+		}(l)
+	}
+
+	return <-errs
 }
 
 func generateTLSCerts() (err error) {
@@ -155,10 +369,26 @@ func generateTLSCerts() (err error) {
 		return nil
 	}
 
-	address := net.ParseIP(strings.Split(conf.BindAddress, ":")[0])
+	var addresses []net.IP
+
+	for _, addr := range conf.bindAddresses() {
+		host, _, _ := net.SplitHostPort(addr)
+
+		// strip IPv6 zone identifier
+		if ip := net.ParseIP(strings.Split(host, "%")[0]); ip != nil {
+			addresses = append(addresses, ip)
+		}
+	}
+
+	var address net.IP
+
+	if len(addresses) > 0 {
+		address = addresses[0]
+	}
+
 	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<63-1))
 
-	status.Log(syslog.LOG_NOTICE, "generating TLS keypair IP: %s, Serial: % X", address.String(), serial)
+	status.Log(syslog.LOG_NOTICE, "generating TLS keypair IP: %v, Serial: % X", addresses, serial)
 
 	certTemplate := x509.Certificate{
 		SerialNumber: serial,
@@ -167,7 +397,7 @@ func generateTLSCerts() (err error) {
 			OrganizationalUnit: []string{"generateTLSCerts()"},
 			CommonName:         address.String(),
 		},
-		IPAddresses:        []net.IP{address},
+		IPAddresses:        addresses,
 		SignatureAlgorithm: x509.ECDSAWithSHA256,
 		PublicKeyAlgorithm: x509.ECDSA,
 		NotBefore:          time.Now(),
@@ -214,7 +444,7 @@ func encryptKeyFile(cipher cipherInterface, src string, dst string) (err error)
 		return
 	}
 
-	output, err := ioutil.TempFile("", "tls_key-hsm")
+	output, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
 
 	if err != nil {
 		input.Close()
@@ -223,17 +453,17 @@ func encryptKeyFile(cipher cipherInterface, src string, dst string) (err error)
 
 	err = cipher.Encrypt(input, output, false)
 
+	input.Close()
+	output.Close()
+
 	if err != nil {
-		input.Close()
-		output.Close()
+		os.Remove(dst)
 		return
 	}
 
-	input.Close()
-	output.Close()
-
-	_ = fileOp(src, "", _delete)
-	err = fileOp(output.Name(), dst, _move)
+	if err = os.Remove(src); err != nil {
+		return
+	}
 
 	status.Log(syslog.LOG_NOTICE, "TLS key file %s moved and encrypted to %s\n", src, dst)
 
@@ -0,0 +1,128 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func freeAddress(t *testing.T, network string, host string) string {
+	l, err := net.Listen(network, net.JoinHostPort(host, "0"))
+
+	if err != nil {
+		t.Skip(err)
+	}
+
+	defer l.Close()
+
+	return l.Addr().String()
+}
+
+func TestBindAddresses(t *testing.T) {
+	defer func(addr string) { conf.BindAddress = addr }(conf.BindAddress)
+
+	conf.BindAddress = "10.0.0.1:443, [fe80::1%usb0]:443,"
+
+	if addrs := conf.bindAddresses(); !reflect.DeepEqual(addrs, []string{"10.0.0.1:443", "[fe80::1%usb0]:443"}) {
+		t.Errorf("unexpected bind addresses: %v", addrs)
+	}
+}
+
+func TestServe(t *testing.T) {
+	newTestServer(t)
+	defer func(addr string) { conf.BindAddress = addr }(conf.BindAddress)
+
+	addrs := []string{freeAddress(t, "tcp4", "127.0.0.1"), freeAddress(t, "tcp6", "::1")}
+	conf.BindAddress = addrs[0] + "," + addrs[1]
+
+	conf.ListenerTLS = map[string]listenerTLS{"127.0.0.1:1": {}}
+	defer func() { conf.ListenerTLS = nil }()
+
+	if err := serve(&http.Server{Handler: mux}); err == nil {
+		t.Error("listener_tls accepted without tls")
+	}
+
+	conf.ListenerTLS = nil
+	go serve(&http.Server{Handler: mux})
+
+	for _, addr := range addrs {
+		var res *http.Response
+		var err error
+
+		for i := 0; i < 50; i++ {
+			if res, err = http.Get(fmt.Sprintf("http://%s/api/status/version", addr)); err == nil {
+				break
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("%s: unexpected status %d", addr, res.StatusCode)
+		}
+	}
+}
+
+func TestListenerTLS(t *testing.T) {
+	dir := t.TempDir()
+	defer conf.SetDefaults()
+	defer func(addr string) { conf.BindAddress = addr }(conf.BindAddress)
+
+	conf.BindAddress = "127.0.0.1:4430,[::1]:4430"
+	conf.TLSCert = filepath.Join(dir, "cert.pem")
+	conf.TLSKey = filepath.Join(dir, "key.pem")
+
+	if err := generateTLSCerts(); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := tls.LoadX509KeyPair(conf.TLSCert, conf.TLSKey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	conf.ListenerTLS = map[string]listenerTLS{
+		"[::1]:4430": {TLSClientCA: conf.TLSCert},
+	}
+	defer func() { conf.ListenerTLS = nil }()
+
+	c, err := listenerTLSConfig(base, "127.0.0.1:4430")
+
+	if err != nil || c.ClientAuth != tls.NoClientCert || len(c.NextProtos) == 0 {
+		t.Errorf("unexpected default listener configuration: %v", err)
+	}
+
+	if c, err = listenerTLSConfig(base, "[::1]:4430"); err != nil || c.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("unexpected listener configuration: %v", err)
+	}
+
+	if base.ClientAuth != tls.NoClientCert {
+		t.Error("base configuration modified")
+	}
+
+	conf.ListenerTLS["[::1]:4430"] = listenerTLS{TLSCert: conf.TLSKey, TLSKey: conf.TLSKey}
+
+	if _, err = listenerTLSConfig(base, "[::1]:4430"); err == nil {
+		t.Error("invalid certificate accepted")
+	}
+}
@@ -0,0 +1,254 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// External tool auditing, at startup the versions of the system commands
+// INTERLOCK depends on are detected, logged and reported by
+// /api/status/version.
+//
+// Features relying on tool versions with known defects are refused: the
+// server does not start when such a feature is explicitly configured, while
+// features invoked on demand return an error.
+//
+// Version probes are executed directly, without sudo or the privilege
+// separation helper, as they never require privileges.
+
+const toolProbeTimeout = 10 * time.Second
+
+type toolProbe struct {
+	path string
+	args []string
+}
+
+type toolDefect struct {
+	tool    string
+	feature string
+	// affected versions, an empty bound is open
+	from   string
+	before string
+	reason string
+}
+
+type toolVersion struct {
+	Path     string   `json:"path"`
+	Version  string   `json:"version"`
+	Disabled []string `json:"disabled,omitempty"`
+}
+
+type toolAudit struct {
+	sync.RWMutex
+	versions map[string]*toolVersion
+	// disabled features and their reason
+	disabled map[string]string
+}
+
+var tools = &toolAudit{}
+
+var toolProbes = map[string]toolProbe{
+	"cryptsetup": {"/sbin/cryptsetup", []string{"--version"}},
+	"lvm":        {"/sbin/lvm", []string{"version"}},
+	"date":       {"/bin/date", []string{"--version"}},
+	"gs":         {pdfGhostscript, []string{"--version"}},
+	"qpdf":       {pdfQPDF, []string{"--version"}},
+}
+
+var toolDefects = []toolDefect{
+	{
+		tool:    "cryptsetup",
+		feature: "header_upload",
+		from:    "2.2.0",
+		before:  "2.3.4",
+		reason:  "CVE-2020-14382, LUKS2 header parsing out-of-bounds write",
+	},
+	{
+		tool:    "cryptsetup",
+		feature: "luks_metadata",
+		before:  "2.4.0",
+		reason:  "luksDump --dump-json-metadata unsupported",
+	},
+	{
+		tool:    "gs",
+		feature: "pdf",
+		before:  "10.01.2",
+		reason:  "CVE-2023-36664, -dSAFER pipe device bypass",
+	},
+}
+
+// first dotted version number of the probe output, which is prefixed by
+// labels such as "LVM version:" or "date (GNU coreutils)"
+var toolVersionPattern = regexp.MustCompile(`\b(\d+(?:\.\d+)+)`)
+
+// compareVersions compares dotted numeric versions, returning -1, 0 or 1.
+func compareVersions(a string, b string) int {
+	x := strings.Split(a, ".")
+	y := strings.Split(b, ".")
+
+	for i := 0; i < len(x) || i < len(y); i++ {
+		var m, n int
+
+		if i < len(x) {
+			m, _ = strconv.Atoi(x[i])
+		}
+
+		if i < len(y) {
+			n, _ = strconv.Atoi(y[i])
+		}
+
+		switch {
+		case m < n:
+			return -1
+		case m > n:
+			return 1
+		}
+	}
+
+	return 0
+}
+
+func (d *toolDefect) affects(version string) bool {
+	if version == "" {
+		return false
+	}
+
+	if d.from != "" && compareVersions(version, d.from) < 0 {
+		return false
+	}
+
+	if d.before != "" && compareVersions(version, d.before) >= 0 {
+		return false
+	}
+
+	return true
+}
+
+// Set records the argument tool versions, evaluating known defects.
+func (a *toolAudit) Set(versions map[string]*toolVersion) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.versions = versions
+	a.disabled = make(map[string]string)
+
+	for _, d := range toolDefects {
+		v, ok := versions[d.tool]
+
+		if !ok || !d.affects(v.Version) {
+			continue
+		}
+
+		v.Disabled = append(v.Disabled, d.feature)
+		a.disabled[d.feature] = fmt.Sprintf("%s %s: %s", d.tool, v.Version, d.reason)
+	}
+}
+
+// Check returns an error if the argument feature is disabled due to a
+// defective tool version.
+func (a *toolAudit) Check(feature string) (err error) {
+	a.RLock()
+	defer a.RUnlock()
+
+	if reason, ok := a.disabled[feature]; ok {
+		return fmt.Errorf("%s disabled, %s", feature, reason)
+	}
+
+	return
+}
+
+// Status returns the recorded tool versions.
+func (a *toolAudit) Status() (versions map[string]*toolVersion) {
+	a.RLock()
+	defer a.RUnlock()
+
+	versions = make(map[string]*toolVersion)
+
+	for name, v := range a.versions {
+		versions[name] = v
+	}
+
+	return
+}
+
+func probeTool(name string, probe toolProbe) (version string, err error) {
+	if _, ok := commandAllowlist[probe.path]; !ok {
+		return "", fmt.Errorf("command %s not allowed", probe.path)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), toolProbeTimeout)
+	defer cancel()
+
+	output, err := runCommand(ctx, filepath.Base(probe.path), exec.Command(probe.path, probe.args...), "", true)
+
+	if err != nil {
+		return
+	}
+
+	m := toolVersionPattern.FindStringSubmatch(output)
+
+	if m == nil {
+		return "", fmt.Errorf("could not parse %s version", name)
+	}
+
+	return m[1], nil
+}
+
+// auditTools detects external tool versions, failing when configured
+// features depend on defective ones.
+func auditTools() (err error) {
+	versions := make(map[string]*toolVersion)
+
+	for name, probe := range toolProbes {
+		if _, err := os.Stat(probe.path); err != nil {
+			continue
+		}
+
+		version, err := probeTool(name, probe)
+
+		if err != nil {
+			log.Printf("could not detect %s version, %v", name, err)
+		} else {
+			log.Printf("detected %s %s", name, version)
+		}
+
+		versions[name] = &toolVersion{Path: probe.path, Version: version}
+	}
+
+	tools.Set(versions)
+
+	if conf.HeaderMode == headerAPI {
+		if err = tools.Check("header_upload"); err != nil {
+			return fmt.Errorf("header_mode %s refused, %v", headerAPI, err)
+		}
+	}
+
+	if conf.TangVolume != "" {
+		if err = tools.Check("luks_metadata"); err != nil {
+			return fmt.Errorf("tang_volume refused, %v", err)
+		}
+	}
+
+	for _, feature := range []string{"luks_metadata", "pdf"} {
+		if err := tools.Check(feature); err != nil {
+			log.Printf("warning: %v", err)
+		}
+	}
+
+	return
+}
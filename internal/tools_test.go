@@ -0,0 +1,81 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"os"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	for _, v := range []struct {
+		a, b string
+		res  int
+	}{
+		{"2.3.4", "2.3.4", 0},
+		{"2.3.3", "2.3.4", -1},
+		{"2.10.0", "2.9.1", 1},
+		{"10.01.2", "9.50", 1},
+		{"2.4", "2.4.0", 0},
+	} {
+		if res := compareVersions(v.a, v.b); res != v.res {
+			t.Errorf("compareVersions(%s, %s) = %d, expected %d", v.a, v.b, res, v.res)
+		}
+	}
+}
+
+func TestToolDefects(t *testing.T) {
+	defer tools.Set(nil)
+
+	tools.Set(map[string]*toolVersion{
+		"cryptsetup": {Path: "/sbin/cryptsetup", Version: "2.3.3"},
+		"gs":         {Path: pdfGhostscript, Version: "10.02.1"},
+	})
+
+	if err := tools.Check("header_upload"); err == nil {
+		t.Error("header upload allowed with defective cryptsetup")
+	}
+
+	if err := tools.Check("luks_metadata"); err == nil {
+		t.Error("LUKS2 metadata allowed without --dump-json-metadata")
+	}
+
+	if err := tools.Check("pdf"); err != nil {
+		t.Errorf("pdf refused with fixed Ghostscript, %v", err)
+	}
+
+	if s := tools.Status()["cryptsetup"]; len(s.Disabled) != 2 {
+		t.Errorf("unexpected disabled features %v", s.Disabled)
+	}
+
+	tools.Set(map[string]*toolVersion{
+		"cryptsetup": {Path: "/sbin/cryptsetup", Version: "2.6.1"},
+		"gs":         {Path: pdfGhostscript, Version: "9.56.1"},
+	})
+
+	if err := tools.Check("header_upload"); err != nil {
+		t.Errorf("header upload refused with fixed cryptsetup, %v", err)
+	}
+
+	if err := exportPDF("a.txt", "a.pdf", ""); err == nil {
+		t.Error("pdf export allowed with defective Ghostscript")
+	}
+}
+
+func TestProbeTool(t *testing.T) {
+	probe := toolProbes["date"]
+
+	if _, err := os.Stat(probe.path); err != nil {
+		t.Skip("date not available")
+	}
+
+	version, err := probeTool("date", probe)
+
+	if err != nil || compareVersions(version, "1") < 0 {
+		t.Errorf("unexpected date version %q (%v)", version, err)
+	}
+}
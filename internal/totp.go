@@ -12,9 +12,10 @@ import (
 	"crypto/sha1"
 	"encoding/base32"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"math"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -23,12 +24,20 @@ import (
 )
 
 type tOTP struct {
-	info   cipherInfo
-	secKey []byte
+	info    cipherInfo
+	options tOTPOptions
+	secKey  []byte
 
 	cipherInterface
 }
 
+// tOTPOptions are the TOTP "cipher_options", code length (6-8 digits) and time
+// step in seconds, both default to the RFC6238 values (6, 30).
+type tOTPOptions struct {
+	Digits int `json:"digits"`
+	Period int `json:"period"`
+}
+
 func init() {
 	conf.SetAvailableCipher(new(tOTP).Init())
 }
@@ -50,7 +59,27 @@ func (t *tOTP) Init() cipherInterface {
 }
 
 func (t *tOTP) New() cipherInterface {
-	return new(tOTP).Init()
+	return (&tOTP{options: t.options}).Init()
+}
+
+func (t *tOTP) Configure(options json.RawMessage) (err error) {
+	opts := tOTPOptions{}
+
+	if err = parseCipherOptions(options, &opts); err != nil {
+		return
+	}
+
+	if opts.Digits != 0 && (opts.Digits < 6 || opts.Digits > 8) {
+		return fmt.Errorf("invalid digits %d", opts.Digits)
+	}
+
+	if opts.Period < 0 {
+		return fmt.Errorf("invalid period %d", opts.Period)
+	}
+
+	t.options = opts
+
+	return
 }
 
 func (t *tOTP) Activate(activate bool) (err error) {
@@ -82,7 +111,7 @@ func (t *tOTP) GetKeyInfo(k key) (info string, err error) {
 
 func (t *tOTP) SetKey(k key) (err error) {
 	keyPath := filepath.Join(conf.MountPoint, k.Path)
-	s, err := ioutil.ReadFile(keyPath)
+	s, err := volumeJail().ReadFile(keyPath)
 
 	if err != nil {
 		return
@@ -102,7 +131,17 @@ func (t *tOTP) SetKey(k key) (err error) {
 }
 
 func (t *tOTP) GenOTP(timestamp int64) (code string, exp int64, err error) {
+	digits := 6
 	interval := int64(30)
+
+	if t.options.Digits != 0 {
+		digits = t.options.Digits
+	}
+
+	if t.options.Period != 0 {
+		interval = int64(t.options.Period)
+	}
+
 	message := timestamp / interval
 
 	buf := bytes.Buffer{}
@@ -127,9 +166,9 @@ func (t *tOTP) GenOTP(timestamp int64) (code string, exp int64, err error) {
 	}
 
 	c = c & 0x7fffffff
-	c = c % 1000000
+	c = c % int32(math.Pow10(digits))
 
-	code = fmt.Sprintf("%06d", c)
+	code = fmt.Sprintf("%0*d", digits, c)
 	exp = interval - (timestamp % interval)
 
 	return
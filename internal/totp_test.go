@@ -7,6 +7,7 @@
 package interlock
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"path"
@@ -49,6 +50,25 @@ func TestTOTP(t *testing.T) {
 		t.Errorf("invalid code (%v at %v, expires in %v)", otp, timestamp, exp)
 	}
 
+	// RFC6238 Appendix B, 8 digits, T = 59
+	ioutil.WriteFile(secKeyFile.Name(), []byte("GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"), 0600)
+
+	if err = totp.Configure(json.RawMessage(`{"digits": 8}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = totp.SetKey(secKey); err != nil {
+		t.Fatal(err)
+	}
+
+	if otp, _, _ = totp.GenOTP(59); otp != "94287082" {
+		t.Errorf("invalid 8 digits code %v", otp)
+	}
+
+	if err = totp.Configure(json.RawMessage(`{"digits": 10}`)); err == nil {
+		t.Error("invalid digits accepted")
+	}
+
 	secKeyFile.Close()
 	os.Remove(secKeyFile.Name())
 }
@@ -0,0 +1,444 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"log/syslog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Session transcripts, the API operations performed during each session are
+// recorded on the encrypted volume, as JSON lines, for chain-of-custody
+// documentation. Only the arguments listed in transcriptArgs are recorded to
+// keep passwords and other secrets out of transcripts.
+//
+// Transcripts are exported as a JSON document, and optionally a PDF
+// rendering, with detached OpenPGP signatures.
+
+const transcriptDir = ".interlock-transcripts"
+const transcriptExt = ".jsonl"
+
+var transcriptArgs = []string{"volume", "path", "src", "dst", "sig", "key", "sig_key", "cipher", "identifier", "id"}
+
+type transcriptEntry struct {
+	Epoch  int64                  `json:"epoch"`
+	Method string                 `json:"method"`
+	Remote string                 `json:"remote"`
+	Args   map[string]interface{} `json:"args,omitempty"`
+	Status string                 `json:"status,omitempty"`
+}
+
+type transcriptInfo struct {
+	ID      string `json:"id"`
+	Start   int64  `json:"start"`
+	End     int64  `json:"end"`
+	Entries int    `json:"entries"`
+}
+
+type transcriptDocument struct {
+	ID          string            `json:"id"`
+	Device      string            `json:"device"`
+	Build       string            `json:"build"`
+	Revision    string            `json:"revision"`
+	Exported    int64             `json:"exported"`
+	ClockSynced bool              `json:"clock_synced"`
+	Entries     []transcriptEntry `json:"entries"`
+}
+
+type transcriptLog struct {
+	sync.Mutex
+	id      string
+	entries []transcriptEntry
+}
+
+var transcript transcriptLog
+
+func transcriptPath(id string) string {
+	return filepath.Join(conf.MountPoint, transcriptDir, id+transcriptExt)
+}
+
+// transcriptBody returns the body of JSON API requests, which is restored
+// for consumption by the request handler.
+func transcriptBody(r *http.Request) (body []byte) {
+	if _, ok := schemas[r.URL.Path]; !ok || r.Method != http.MethodPost {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+
+	if err != nil {
+		return nil
+	}
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	return
+}
+
+// Start opens the transcript of a new session.
+func (t *transcriptLog) Start(volume string, remote string) {
+	rnd := make([]byte, 4)
+	rand.Read(rnd)
+
+	t.Lock()
+	t.id = time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(rnd)
+	t.entries = nil
+	t.Unlock()
+
+	t.add(transcriptEntry{Method: "login", Remote: remote, Args: map[string]interface{}{"volume": volume}, Status: "OK"})
+}
+
+// Record adds an API request to the current session transcript.
+func (t *transcriptLog) Record(r *http.Request, body []byte, res jsonObject) {
+	e := transcriptEntry{
+		Method: r.URL.Path,
+		Remote: r.RemoteAddr,
+	}
+
+	if len(body) > 0 {
+		var req map[string]interface{}
+
+		if json.Unmarshal(body, &req) == nil {
+			for _, k := range transcriptArgs {
+				if v, ok := req[k]; ok && v != "" {
+					if e.Args == nil {
+						e.Args = make(map[string]interface{})
+					}
+
+					e.Args[k] = v
+				}
+			}
+		}
+	}
+
+	if res != nil {
+		e.Status, _ = res["status"].(string)
+	}
+
+	t.add(e)
+}
+
+// End closes the current session transcript, it must be called before the
+// volume is unmounted.
+func (t *transcriptLog) End() {
+	t.add(transcriptEntry{Method: "logout", Status: "OK"})
+
+	t.Lock()
+	defer t.Unlock()
+
+	t.id = ""
+	t.entries = nil
+}
+
+func (t *transcriptLog) add(e transcriptEntry) {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.id == "" {
+		return
+	}
+
+	e.Epoch = time.Now().Unix()
+	t.entries = append(t.entries, e)
+
+	if readOnly.Enabled() {
+		return
+	}
+
+	if err := t.append(e); err != nil {
+		log.Printf("could not save session transcript: %v", err)
+	}
+}
+
+func (t *transcriptLog) append(e transcriptEntry) (err error) {
+	buf, err := json.Marshal(e)
+
+	if err != nil {
+		return
+	}
+
+	if err = volumeJail().MkdirAll(filepath.Join(conf.MountPoint, transcriptDir), 0700); err != nil {
+		return
+	}
+
+	f, err := volumeJail().OpenFile(transcriptPath(t.id), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(buf, '\n'))
+
+	return
+}
+
+// Entries returns the entries of the argument transcript, the current one is
+// returned for an empty identifier.
+func (t *transcriptLog) Entries(id string) (entries []transcriptEntry, err error) {
+	t.Lock()
+
+	if id == "" || id == t.id {
+		id = t.id
+		entries = append(entries, t.entries...)
+	}
+
+	t.Unlock()
+
+	if id == "" {
+		return nil, errors.New("no active transcript")
+	}
+
+	if entries != nil {
+		return
+	}
+
+	if strings.ContainsAny(id, "/\\") || strings.Contains(id, traversalPattern) {
+		return nil, errors.New("invalid transcript identifier")
+	}
+
+	f, err := volumeJail().Open(transcriptPath(id))
+
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		var e transcriptEntry
+
+		if err = json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("invalid transcript %s: %v", id, err)
+		}
+
+		entries = append(entries, e)
+	}
+
+	err = scanner.Err()
+
+	return
+}
+
+func transcriptList() (res jsonObject) {
+	files, err := volumeJail().ReadDir(filepath.Join(conf.MountPoint, transcriptDir))
+
+	if err != nil && !os.IsNotExist(err) {
+		return errorResponse(err, "")
+	}
+
+	list := []transcriptInfo{}
+
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), transcriptExt) {
+			continue
+		}
+
+		id := strings.TrimSuffix(f.Name(), transcriptExt)
+		entries, err := transcript.Entries(id)
+
+		if err != nil || len(entries) == 0 {
+			continue
+		}
+
+		list = append(list, transcriptInfo{
+			ID:      id,
+			Start:   entries[0].Epoch,
+			End:     entries[len(entries)-1].Epoch,
+			Entries: len(entries),
+		})
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": list,
+	}
+
+	return
+}
+
+// transcriptText renders a transcript for PDF conversion.
+func transcriptText(doc *transcriptDocument) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "INTERLOCK session transcript %s\n\n", doc.ID)
+	fmt.Fprintf(&b, "Device:       %s\n", doc.Device)
+	fmt.Fprintf(&b, "Build:        %s %s\n", doc.Build, doc.Revision)
+	fmt.Fprintf(&b, "Exported:     %s\n", time.Unix(doc.Exported, 0).UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "Clock synced: %v\n\n", doc.ClockSynced)
+
+	for _, e := range doc.Entries {
+		args, _ := json.Marshal(e.Args)
+		fmt.Fprintf(&b, "%s  %-28s %-20s %-4s %s\n", time.Unix(e.Epoch, 0).UTC().Format(time.RFC3339), e.Method, e.Remote, e.Status, args)
+	}
+
+	return b.String()
+}
+
+// signTranscript creates the detached signature of path with the argument
+// private key.
+func signTranscript(path string, keyPath string, password string) (err error) {
+	k, cipher, err := getKey(keyPath)
+
+	if err != nil {
+		return
+	}
+
+	if !cipher.GetInfo().Sig {
+		return errors.New("signing not supported by cipher")
+	}
+
+	if err = checkRevoked(k, keyUsageSign); err != nil {
+		return
+	}
+
+	if err = cipher.SetKey(k); err != nil {
+		return
+	}
+
+	if password != "" {
+		if err = cipher.SetPassword(password); err != nil {
+			return
+		}
+	}
+
+	input, err := volumeJail().Open(path)
+
+	if err != nil {
+		return
+	}
+	defer input.Close()
+
+	output, err := volumeJail().OpenFile(path+"."+cipher.GetInfo().Extension+"-signature", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+
+	if err != nil {
+		return
+	}
+	defer output.Close()
+
+	recordKeyUsage(k, keyUsageSign, relativePath(path))
+
+	return cipher.Sign(input, output)
+}
+
+// transcriptExport writes a signed transcript bundle to the `dst` directory.
+func transcriptExport(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	id, _ := req["id"].(string)
+	usePDF, _ := req["pdf"].(bool)
+
+	dst, err := absolutePath(req["dst"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	keyPath, err := absolutePath(req["key"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if _, err = volumeJail().Stat(dst); err == nil {
+		return errorResponse(errors.New("destination already exists"), "")
+	}
+
+	entries, err := transcript.Entries(id)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if id == "" {
+		transcript.Lock()
+		id = transcript.id
+		transcript.Unlock()
+	}
+
+	device, _ := os.Hostname()
+
+	doc := &transcriptDocument{
+		ID:          id,
+		Device:      device,
+		Build:       Build,
+		Revision:    Revision,
+		Exported:    time.Now().Unix(),
+		ClockSynced: ntp.Synced(),
+		Entries:     entries,
+	}
+
+	buf, err := json.MarshalIndent(doc, "", "\t")
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if err = volumeJail().MkdirAll(dst, 0700); err != nil {
+		return errorResponse(err, "")
+	}
+
+	files := []string{filepath.Join(dst, "transcript.json")}
+
+	if err = volumeJail().WriteFile(files[0], buf, 0600); err != nil {
+		return errorResponse(err, "")
+	}
+
+	if usePDF {
+		txt := filepath.Join(dst, "transcript.txt")
+
+		if err = volumeJail().WriteFile(txt, []byte(transcriptText(doc)), 0600); err != nil {
+			return errorResponse(err, "")
+		}
+
+		pdf, err := pdfTool.Convert(txt, dst)
+		volumeJail().Remove(txt)
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+
+		files = append(files, pdf)
+	}
+
+	for _, f := range files {
+		if err = signTranscript(f, keyPath, req["password"].(string)); err != nil {
+			return errorResponse(err, "")
+		}
+	}
+
+	status.Log(syslog.LOG_NOTICE, "exported session transcript %s to %s", id, relativePath(dst))
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": relativePath(dst),
+	}
+
+	return
+}
@@ -0,0 +1,93 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTranscript(t *testing.T) {
+	c := newTestServer(t)
+
+	mock := &mockPDF{}
+	pdfTool = mock
+	defer func() { pdfTool = &externalPDF{} }()
+
+	c.login()
+
+	c.mustCall("crypto/gen_key", jsonObject{"identifier": "custody", "key_format": "armor", "cipher": "OpenPGP", "email": "testonly@example.com"})
+	c.wait("/keys/pgp/private/custody.armor")
+
+	c.mustCall("file/mkdir", jsonObject{"path": []string{"/evidence"}})
+	c.mustCall("luks/add", jsonObject{"volume": testVolume, "password": testPassword, "newpassword": "transcriptsecret"})
+
+	res := c.mustCall("transcript/list", nil)
+
+	if list := res["response"].([]interface{}); len(list) != 1 {
+		t.Fatalf("unexpected transcript list: %v", res)
+	}
+
+	c.mustCall("transcript/export", jsonObject{"dst": "/custody", "key": "/keys/pgp/private/custody.armor", "password": "", "pdf": true})
+
+	dir := filepath.Join(conf.MountPoint, "custody")
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "transcript.json"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(string(buf), "transcriptsecret") || strings.Contains(string(buf), testPassword) {
+		t.Error("password recorded in transcript")
+	}
+
+	var doc transcriptDocument
+
+	if err = json.Unmarshal(buf, &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	var mkdir bool
+
+	for _, e := range doc.Entries {
+		if e.Method == "/api/file/mkdir" && e.Status == "OK" && len(e.Args["path"].([]interface{})) == 1 {
+			mkdir = true
+		}
+	}
+
+	if doc.Entries[0].Method != "login" || !mkdir {
+		t.Errorf("unexpected transcript entries: %+v", doc.Entries)
+	}
+
+	for _, f := range []string{"transcript.json", "converted.pdf"} {
+		res = c.mustCall("file/verify", jsonObject{"src": "/custody/" + f, "sig": "/custody/" + f + ".pgp-signature", "cipher": "OpenPGP", "key": "/keys/pgp/public/custody.armor"})
+		c.wait("/custody/" + f)
+
+		if !logged("successful verification of /custody/" + f) {
+			t.Errorf("signature verification failed for %s", f)
+		}
+	}
+
+	id := doc.ID
+	c.mustCall("auth/logout", nil)
+
+	c.login()
+	defer c.call("auth/logout", nil)
+
+	entries, err := transcript.Entries(id)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if last := entries[len(entries)-1]; last.Method != "logout" {
+		t.Errorf("transcript not closed at logout: %+v", last)
+	}
+}
@@ -0,0 +1,78 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Deployment branding, the `ui_title`, `ui_logo` and `ui_features` options are
+// served with the login banner, before authentication, to the static client
+// which applies them to its templates, allowing white-labeled appliances
+// without changes to the static assets.
+//
+// Disabled features are only hidden by the client, API access remains
+// governed by roles and ACLs.
+
+const defaultUITitle = "INTERLOCK"
+
+// client features which can be hidden
+var uiFeatures = []string{"keys", "password", "poweroff", "signal", "upload", "wifi"}
+
+// validateUI verifies the branding configuration.
+func validateUI() (err error) {
+	if conf.UILogo != "" && (path.IsAbs(conf.UILogo) || path.Clean(conf.UILogo) != conf.UILogo || strings.HasPrefix(conf.UILogo, "..")) {
+		return fmt.Errorf("invalid ui_logo %s, a path relative to the static files is required", conf.UILogo)
+	}
+
+	for _, f := range conf.UIFeatures {
+		found := false
+
+		for _, known := range uiFeatures {
+			found = found || f == known
+		}
+
+		if !found {
+			return fmt.Errorf("invalid ui_features entry %s", f)
+		}
+	}
+
+	return
+}
+
+func uiStatus() (res jsonObject) {
+	var logo string
+
+	title := conf.UITitle
+	features := conf.UIFeatures
+
+	if title == "" {
+		title = defaultUITitle
+	}
+
+	if conf.UILogo != "" {
+		logo = "/" + conf.UILogo
+	}
+
+	if features == nil {
+		features = uiFeatures
+	}
+
+	res = jsonObject{
+		"status": "OK",
+		"response": map[string]interface{}{
+			"title":    title,
+			"logo":     logo,
+			"banner":   conf.Banner,
+			"features": features,
+		},
+	}
+
+	return
+}
@@ -0,0 +1,78 @@
+#!/usr/bin/env python3
+#
+# Generates the Unicode normalization tables (unicode_tables.go) used for
+# filename NFC normalization, from the Python unicodedata module.
+#
+# usage: python3 unicode_gen.py | gofmt > unicode_tables.go
+
+import unicodedata
+
+SBase, SCount = 0xAC00, 11172
+
+decompositions = {}
+compositions = {}
+classes = []
+
+for c in range(0x110000):
+    if 0xD800 <= c <= 0xDFFF:
+        continue
+
+    ch = chr(c)
+    ccc = unicodedata.combining(ch)
+
+    if ccc:
+        if classes and classes[-1][1] == c - 1 and classes[-1][2] == ccc:
+            classes[-1][1] = c
+        else:
+            classes.append([c, c, ccc])
+
+    if SBase <= c < SBase + SCount:
+        continue
+
+    nfd = unicodedata.normalize('NFD', ch)
+
+    if nfd != ch:
+        decompositions[c] = nfd
+
+    d = unicodedata.decomposition(ch)
+
+    if d and not d.startswith('<'):
+        parts = [int(x, 16) for x in d.split()]
+
+        if len(parts) == 2 and unicodedata.normalize('NFC', ch) == ch:
+            compositions[(parts[0], parts[1])] = c
+
+def runes(s):
+    return '"' + ''.join('\\U%08x' % ord(x) if ord(x) > 0xffff else '\\u%04x' % ord(x) for x in s) + '"'
+
+print('''// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// Code generated by unicode_gen.py (Unicode %s); DO NOT EDIT.
+
+package interlock
+
+type combiningClass struct {
+	lo  rune
+	hi  rune
+	ccc uint8
+}
+''' % unicodedata.unidata_version)
+
+print('var combiningClasses = []combiningClass{')
+for lo, hi, ccc in classes:
+    print('\t{0x%04X, 0x%04X, %d},' % (lo, hi, ccc))
+print('}\n')
+
+print('var canonicalDecompositions = map[rune]string{')
+for c in sorted(decompositions):
+    print('\t0x%04X: %s,' % (c, runes(decompositions[c])))
+print('}\n')
+
+print('var canonicalCompositions = map[[2]rune]rune{')
+for (a, b) in sorted(compositions):
+    print('\t{0x%04X, 0x%04X}: 0x%04X,' % (a, b, compositions[(a, b)]))
+print('}')
@@ -0,0 +1,138 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// USB network gadget bring-up, the Ethernet gadget interface is configured
+// at startup (loading the g_ether driver if required) and the host side of
+// the link is optionally served its address over DHCP, making the device
+// reachable without external network configuration.
+
+const usbGadgetTimeout = 10 * time.Second
+
+func usbInterface() (err error) {
+	if _, err = net.InterfaceByName(conf.USBNetwork); err == nil {
+		return
+	}
+
+	log.Printf("loading USB Ethernet gadget driver")
+
+	if _, err = execCommand("/sbin/modprobe", []string{"g_ether"}, ""); err != nil {
+		return fmt.Errorf("cannot load USB Ethernet gadget driver: %v", err)
+	}
+
+	for start := time.Now(); time.Since(start) < usbGadgetTimeout; time.Sleep(100 * time.Millisecond) {
+		if _, err = net.InterfaceByName(conf.USBNetwork); err == nil {
+			return
+		}
+	}
+
+	return fmt.Errorf("USB network interface %s not found", conf.USBNetwork)
+}
+
+func startUSBNetwork() (err error) {
+	var d *dhcpServer
+
+	if conf.USBNetwork == "" {
+		return
+	}
+
+	if conf.USBDHCP {
+		if d, err = newDHCPServer(conf.USBAddress); err != nil {
+			return
+		}
+	}
+
+	if err = usbInterface(); err != nil {
+		return
+	}
+
+	log.Printf("configuring USB network interface %s (%s)", conf.USBNetwork, conf.USBAddress)
+
+	if _, err = execCommand("/sbin/ip", []string{"addr", "replace", conf.USBAddress, "dev", conf.USBNetwork}, ""); err != nil {
+		return fmt.Errorf("cannot configure %s: %v", conf.USBNetwork, err)
+	}
+
+	if _, err = execCommand("/sbin/ip", []string{"link", "set", conf.USBNetwork, "up"}, ""); err != nil {
+		return fmt.Errorf("cannot enable %s: %v", conf.USBNetwork, err)
+	}
+
+	if d == nil {
+		return
+	}
+
+	return startDHCP(d)
+}
+
+func startDHCP(d *dhcpServer) (err error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) (err error) {
+			e := c.Control(func(fd uintptr) {
+				if err = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, conf.USBNetwork); err != nil {
+					return
+				}
+
+				err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_BROADCAST, 1)
+			})
+
+			if e != nil {
+				return e
+			}
+
+			return
+		},
+	}
+
+	conn, err := lc.ListenPacket(context.Background(), "udp4", ":67")
+
+	if err != nil {
+		return fmt.Errorf("cannot start DHCP server: %v", err)
+	}
+
+	log.Printf("starting DHCP server on %s, leasing %s", conf.USBNetwork, d.lease)
+
+	go func() {
+		defer recoverJob("serving DHCP")
+
+		buf := make([]byte, 1500)
+		client := &net.UDPAddr{IP: net.IPv4bcast, Port: 68}
+
+		for {
+			n, from, err := conn.ReadFrom(buf)
+
+			if err != nil {
+				log.Printf("DHCP server error: %v", err)
+				return
+			}
+
+			res, err := d.Reply(buf[:n])
+
+			if err != nil {
+				if conf.Debug {
+					log.Printf("invalid DHCP message from %s: %v", from, err)
+				}
+				continue
+			}
+
+			if res != nil {
+				conn.WriteTo(res, client)
+			}
+		}
+	}()
+
+	return
+}
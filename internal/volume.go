@@ -6,10 +6,132 @@
 
 package interlock
 
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
 const mapping = "interlockfs"
 
+const volumeImageExt = ".img"
+
 const (
 	_change = iota
 	_add
 	_remove
 )
+
+type volumeInterface interface {
+	// unlock encrypted volume
+	Unlock(ctx context.Context, volume string, password string) error
+	// mount unlocked volume on the configured mount point
+	Mount(ctx context.Context) error
+	// unmount volume
+	Umount(ctx context.Context) error
+	// remount mounted volume read-only or read-write
+	Remount(ctx context.Context, readOnly bool) error
+	// lock encrypted volume
+	Lock(ctx context.Context) error
+	// change, add or remove volume password
+	KeyOp(ctx context.Context, volume string, password string, newPassword string, mode int) error
+}
+
+// Volume operations are bound to a context, canceled when the requesting
+// client goes away, and to the `luks_timeout` expiration. Unmounting and
+// locking are never canceled by clients as they release the volume.
+
+// Key operations (change, add or remove) test the current password against
+// the volume keyslots. To prevent their use as a fast passphrase oracle they
+// are serialized and each failure doubles the delay imposed on further
+// attempts, up to keyOpMaxDelay, until one succeeds.
+const (
+	keyOpDelay    = 2 * time.Second
+	keyOpMaxDelay = 5 * time.Minute
+)
+
+type keyOpLimiter struct {
+	sync.Mutex
+	failures int
+	next     time.Time
+}
+
+var keyOps keyOpLimiter
+
+// volumeDevice returns the logical volume, or with `volume_path` the image
+// file, holding a volume.
+func volumeDevice(volume string) string {
+	if conf.VolumePath != "" {
+		return filepath.Join(conf.VolumePath, volume+volumeImageExt)
+	}
+
+	return "/dev/" + conf.VolumeGroup + "/" + volume
+}
+
+func unlock(ctx context.Context, volume string, password string) error {
+	ctx, cancel := withTimeout(ctx, conf.LUKSTimeout)
+	defer cancel()
+
+	return conf.volume.Unlock(ctx, volume, password)
+}
+
+func mount(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, conf.LUKSTimeout)
+	defer cancel()
+
+	return conf.volume.Mount(ctx)
+}
+
+func umount() error {
+	ctx, cancel := withTimeout(context.Background(), conf.LUKSTimeout)
+	defer cancel()
+
+	readOnly.Reset()
+	return conf.volume.Umount(ctx)
+}
+
+func remount(readOnly bool) error {
+	ctx, cancel := withTimeout(context.Background(), conf.LUKSTimeout)
+	defer cancel()
+
+	return conf.volume.Remount(ctx, readOnly)
+}
+
+func lock() error {
+	ctx, cancel := withTimeout(context.Background(), conf.LUKSTimeout)
+	defer cancel()
+
+	return conf.volume.Lock(ctx)
+}
+
+func keyOp(ctx context.Context, volume string, password string, newPassword string, mode int) (err error) {
+	keyOps.Lock()
+	defer keyOps.Unlock()
+
+	if wait := time.Until(keyOps.next); wait > 0 {
+		return fmt.Errorf("key operations delayed after failed attempts, retry in %v", wait.Round(time.Second))
+	}
+
+	ctx, cancel := withTimeout(ctx, conf.LUKSTimeout)
+	defer cancel()
+
+	if err = conf.volume.KeyOp(ctx, volume, password, newPassword, mode); err != nil {
+		delay := keyOpMaxDelay
+
+		if keyOps.failures < 8 && keyOpDelay<<uint(keyOps.failures) < delay {
+			delay = keyOpDelay << uint(keyOps.failures)
+		}
+
+		keyOps.failures++
+		keyOps.next = time.Now().Add(delay)
+
+		return
+	}
+
+	keyOps.failures = 0
+	keyOps.next = time.Time{}
+
+	return
+}
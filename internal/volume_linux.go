@@ -9,6 +9,7 @@
 package interlock
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/base64"
 	"errors"
@@ -19,7 +20,17 @@ import (
 	"syscall"
 )
 
-func unlock(volume string, password string) (err error) {
+// LUKS encrypted volumes, managed with cryptsetup on logical volumes
+// belonging to the configured volume group.
+type luksVolume struct{}
+
+var _ volumeInterface = (*luksVolume)(nil)
+
+func init() {
+	conf.SetVolume(new(luksVolume))
+}
+
+func (v *luksVolume) Unlock(ctx context.Context, volume string, password string) (err error) {
 	var key string
 
 	if strings.Contains(volume, traversalPattern) {
@@ -34,13 +45,41 @@ func unlock(volume string, password string) (err error) {
 		}
 	}
 
-	args := []string{"luksOpen", "/dev/" + conf.VolumeGroup + "/" + volume, mapping}
-	cmd := "/sbin/cryptsetup"
+	device, cleanup, err := luksDevice(volume)
+
+	if err != nil {
+		return
+	}
+	defer cleanup()
 
 	status.Log(syslog.LOG_NOTICE, "unlocking encrypted volume %s", volume)
 
+	if conf.HiddenHeader != "" {
+		args := []string{"luksOpen", "--header", conf.HiddenHeader, volumeDevice(volume), volumeMapping()}
+
+		if err = v.open(ctx, args, key, password); err == nil {
+			// keep the same number of key derivations as for the
+			// outer volume
+			v.open(ctx, append([]string{"open", "--test-passphrase"}, device...), key, password)
+			detachedHeader.Clear()
+			return
+		}
+	}
+
+	err = v.open(ctx, append(append([]string{"luksOpen"}, device...), volumeMapping()), key, password)
+
+	if err == nil {
+		detachedHeader.Clear()
+	}
+
+	return
+}
+
+func (v *luksVolume) open(ctx context.Context, args []string, key string, password string) (err error) {
+	cmd := "/sbin/cryptsetup"
+
 	if conf.authHSM != nil {
-		_, err = execCommand(cmd, args, true, key+"\n")
+		_, err = execCommandContext(ctx, cmd, args, key+"\n")
 
 		if err == nil {
 			return
@@ -48,18 +87,18 @@ func unlock(volume string, password string) (err error) {
 		// fallback to original password to allow pre-HSM migration
 	}
 
-	_, err = execCommand(cmd, args, true, password+"\n")
+	_, err = execCommandContext(ctx, cmd, args, password+"\n")
 
 	return
 }
 
-func mount() (err error) {
-	args := []string{"/dev/mapper/" + mapping, conf.MountPoint}
+func (v *luksVolume) Mount(ctx context.Context) (err error) {
+	args := mountArgs(nil, "/dev/mapper/"+volumeMapping(), conf.MountPoint)
 	cmd := "/bin/mount"
 
 	status.Log(syslog.LOG_NOTICE, "mounting encrypted volume to %s", conf.MountPoint)
 
-	_, err = execCommand(cmd, args, true, "")
+	_, err = execCommandContext(ctx, cmd, args, "")
 
 	if err != nil {
 		return
@@ -76,45 +115,71 @@ func mount() (err error) {
 
 	status.Log(syslog.LOG_NOTICE, "setting mount point permissions for user %s", u.Username)
 
-	_, err = execCommand(cmd, args, true, "")
+	_, err = execCommandContext(ctx, cmd, args, "")
+
+	return
+}
+
+func (v *luksVolume) Remount(ctx context.Context, readOnly bool) (err error) {
+	mode := "rw"
+
+	if readOnly {
+		mode = "ro"
+	}
+
+	args := mountArgs([]string{"remount", mode}, conf.MountPoint)
+	cmd := "/bin/mount"
+
+	status.Log(syslog.LOG_NOTICE, "remounting encrypted volume (%s)", mode)
+
+	syscall.Sync()
+	_, err = execCommandContext(ctx, cmd, args, "")
 
 	return
 }
 
-func umount() (err error) {
+func (v *luksVolume) Umount(ctx context.Context) (err error) {
 	args := []string{conf.MountPoint}
 	cmd := "/bin/umount"
 
 	status.Log(syslog.LOG_NOTICE, "unmounting encrypted volume on %s", conf.MountPoint)
 
 	syscall.Sync()
-	_, err = execCommand(cmd, args, true, "")
+	_, err = execCommandContext(ctx, cmd, args, "")
 
 	return
 }
 
-func lock() (err error) {
-	args := []string{"luksClose", "/dev/mapper/" + mapping}
+func (v *luksVolume) Lock(ctx context.Context) (err error) {
+	args := []string{"luksClose", "/dev/mapper/" + volumeMapping()}
 	cmd := "/sbin/cryptsetup"
 
 	status.Log(syslog.LOG_NOTICE, "locking encrypted volume")
 
-	_, err = execCommand(cmd, args, true, "")
+	_, err = execCommandContext(ctx, cmd, args, "")
 
 	return
 }
 
-func keyOp(volume string, password string, newPassword string, mode int) (err error) {
+func (v *luksVolume) KeyOp(ctx context.Context, volume string, password string, newPassword string, mode int) (err error) {
 	var action string
 	var input string
 	var key string
 	var newKey string
 	var keyInputs []string
 
-	if strings.Contains(volume, traversalPattern) {
-		return errors.New("path traversal detected")
+	if conf.HeaderMode == headerAPI {
+		// changes to uploaded headers would be lost at logout
+		return errors.New("key operations unavailable with uploaded LUKS headers")
 	}
 
+	device, cleanup, err := luksDevice(volume)
+
+	if err != nil {
+		return
+	}
+	defer cleanup()
+
 	if conf.authHSM != nil {
 		key, err = deriveKey(password)
 
@@ -161,22 +226,33 @@ func keyOp(volume string, password string, newPassword string, mode int) (err er
 		return
 	}
 
-	args := []string{action, "/dev/" + conf.VolumeGroup + "/" + volume}
+	targets := [][]string{append([]string{action}, device...)}
 	cmd := "/sbin/cryptsetup"
 
+	if conf.HiddenHeader != "" {
+		// the hidden volume is selected by its passphrase
+		targets = append(targets, []string{action, "--header", conf.HiddenHeader, volumeDevice(volume)})
+	}
+
 	status.Log(syslog.LOG_NOTICE, "performing LUKS key action %s", action)
 
-	if conf.authHSM != nil {
-		for i := 0; i < len(keyInputs); i++ {
-			_, err = execCommand(cmd, args, true, keyInputs[i])
+	for _, args := range targets {
+		if conf.authHSM != nil {
+			for i := 0; i < len(keyInputs); i++ {
+				_, err = execCommandContext(ctx, cmd, args, keyInputs[i])
+
+				if err == nil {
+					return
+				}
+				// fallback to original password to allow pre-HSM migration
+			}
+		} else {
+			_, err = execCommandContext(ctx, cmd, args, input)
 
 			if err == nil {
 				return
 			}
-			// fallback to original password to allow pre-HSM migration
 		}
-	} else {
-		_, err = execCommand(cmd, args, true, input)
 	}
 
 	return
@@ -0,0 +1,117 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"log/syslog"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+type watchdogStatus struct {
+	sync.Mutex
+	Epoch      int64    `json:"epoch"`
+	Goroutines int      `json:"goroutines"`
+	Files      int      `json:"open_files"`
+	HeapAlloc  uint64   `json:"heap_alloc"`
+	StuckJobs  int      `json:"stuck_jobs"`
+	Warnings   []string `json:"warnings"`
+}
+
+var watchdog watchdogStatus
+
+func startWatchdog() {
+	if conf.WatchdogInterval <= 0 {
+		return
+	}
+
+	go func() {
+		for {
+			watchdog.check()
+			time.Sleep(time.Duration(conf.WatchdogInterval) * time.Second)
+		}
+	}()
+}
+
+func (wd *watchdogStatus) check() {
+	var m runtime.MemStats
+	var warnings []string
+
+	runtime.ReadMemStats(&m)
+
+	goroutines := runtime.NumGoroutine()
+	files, _ := openFiles()
+	stuck := status.Stale(time.Duration(conf.WatchdogJobTimeout) * time.Second)
+
+	if conf.WatchdogGoroutines > 0 && goroutines > conf.WatchdogGoroutines {
+		warnings = append(warnings, "goroutine count exceeds threshold")
+	}
+
+	if conf.WatchdogFiles > 0 && files > conf.WatchdogFiles {
+		warnings = append(warnings, "open file descriptors exceed threshold")
+	}
+
+	if conf.WatchdogMemory > 0 && m.HeapAlloc > uint64(conf.WatchdogMemory)<<20 {
+		warnings = append(warnings, "heap allocation exceeds threshold")
+
+		if conf.WatchdogRelease {
+			debug.FreeOSMemory()
+		}
+	}
+
+	if len(stuck) > 0 {
+		warnings = append(warnings, "background operation(s) exceeding timeout")
+
+		if conf.WatchdogRelease {
+			// stuck operations cannot be interrupted, only their
+			// notifications are cleared while they keep running
+			for _, n := range stuck {
+				status.Remove(n)
+			}
+		}
+	}
+
+	if len(stuck) > 0 && conf.WatchdogRelease {
+		status.Log(syslog.LOG_WARNING, "watchdog: cleared %d stuck operation notification(s), operations are still running", len(stuck))
+	}
+
+	for _, w := range warnings {
+		status.Log(syslog.LOG_WARNING, "watchdog: %s (goroutines: %d, files: %d, heap: %d, stuck jobs: %d)", w, goroutines, files, m.HeapAlloc, len(stuck))
+	}
+
+	wd.Lock()
+	defer wd.Unlock()
+
+	wd.Epoch = time.Now().Unix()
+	wd.Goroutines = goroutines
+	wd.Files = files
+	wd.HeapAlloc = m.HeapAlloc
+	wd.StuckJobs = len(stuck)
+	wd.Warnings = warnings
+}
+
+func (wd *watchdogStatus) Status() (s map[string]interface{}) {
+	wd.Lock()
+	defer wd.Unlock()
+
+	if wd.Epoch == 0 {
+		return
+	}
+
+	s = map[string]interface{}{
+		"epoch":      wd.Epoch,
+		"goroutines": wd.Goroutines,
+		"open_files": wd.Files,
+		"heap_alloc": wd.HeapAlloc,
+		"stuck_jobs": wd.StuckJobs,
+		"warnings":   wd.Warnings,
+	}
+
+	return
+}
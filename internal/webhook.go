@@ -0,0 +1,144 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Webhooks, events are delivered as HTTPS POST requests with a JSON body
+// authenticated by an HMAC-SHA256 signature of the body keyed with the webhook
+// secret.
+
+const webhookSignatureHeader = "X-Interlock-Signature"
+const webhookEventHeader = "X-Interlock-Event"
+const webhookAttempts = 3
+
+type webhook struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+}
+
+func init() {
+	eventSinks = append(eventSinks, sendWebhooks)
+}
+
+// MarshalJSON redacts the secret from the configuration dump.
+func (h webhook) MarshalJSON() ([]byte, error) {
+	type plain webhook
+
+	if h.Secret != "" {
+		h.Secret = "<redacted>"
+	}
+
+	return json.Marshal(plain(h))
+}
+
+func (h *webhook) subscribed(name string) bool {
+	for _, e := range h.Events {
+		if e == name || e == "*" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func checkWebhooks() (err error) {
+	for _, h := range conf.Webhooks {
+		u, err := url.Parse(h.URL)
+
+		if err != nil {
+			return err
+		}
+
+		if u.Scheme != "https" {
+			return fmt.Errorf("webhook %s is not HTTPS", h.URL)
+		}
+
+		if h.Secret == "" {
+			return fmt.Errorf("webhook %s has no secret", h.URL)
+		}
+	}
+
+	return
+}
+
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func sendWebhooks(e event) {
+	for _, h := range conf.Webhooks {
+		if !h.subscribed(e.Name) {
+			continue
+		}
+
+		go func(h webhook) {
+			defer recoverJob("webhook")
+
+			if err := h.deliver(e); err != nil {
+				status.Error(fmt.Errorf("webhook %s: %v", h.URL, err))
+			}
+		}(h)
+	}
+}
+
+func (h *webhook) deliver(e event) (err error) {
+	body, err := json.Marshal(e)
+
+	if err != nil {
+		return
+	}
+
+	for i := 0; i < webhookAttempts; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(1<<uint(i)) * time.Second)
+		}
+
+		var req *http.Request
+		var res *http.Response
+
+		req, err = http.NewRequest("POST", h.URL, bytes.NewReader(body))
+
+		if err != nil {
+			return
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(webhookEventHeader, e.Name)
+		req.Header.Set(webhookSignatureHeader, signWebhook(h.Secret, body))
+
+		res, err = eventClient.Do(req)
+
+		if err != nil {
+			continue
+		}
+
+		res.Body.Close()
+
+		if res.StatusCode >= 200 && res.StatusCode < 300 {
+			return nil
+		}
+
+		err = fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	return
+}
@@ -0,0 +1,442 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/syslog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Wi-Fi provisioning, wireless networks are scanned, joined and forgotten
+// through the wpa_supplicant control interface. Credentials of joined
+// networks are stored on the encrypted volume and restored to wpa_supplicant
+// at every unlock.
+//
+// Passphrases are converted to their WPA pre-shared key before being stored
+// or passed to wpa_supplicant.
+
+const wifiFile = ".interlock-wifi.json"
+const wifiScanTime = 5 * time.Second
+const wifiTimeout = 10 * time.Second
+
+var errWiFiDisabled = errors.New("Wi-Fi is not configured")
+
+type wifiNetwork struct {
+	SSID string `json:"ssid"`
+	PSK  string `json:"psk,omitempty"`
+}
+
+type wifiScanResult struct {
+	SSID      string `json:"ssid"`
+	BSSID     string `json:"bssid"`
+	Frequency int    `json:"frequency"`
+	Signal    int    `json:"signal"`
+	Flags     string `json:"flags"`
+	Saved     bool   `json:"saved"`
+}
+
+var wifi struct {
+	sync.Mutex
+	requests int
+}
+
+func wifiPath() string {
+	return filepath.Join(conf.MountPoint, wifiFile)
+}
+
+// wpaRequest sends a command to the wpa_supplicant control interface of the
+// configured wireless interface.
+func wpaRequest(cmd string) (res string, err error) {
+	wifi.Lock()
+	defer wifi.Unlock()
+
+	wifi.requests++
+
+	local := &net.UnixAddr{
+		Name: filepath.Join(os.TempDir(), fmt.Sprintf("interlock-wpa-%d-%d", os.Getpid(), wifi.requests)),
+		Net:  "unixgram",
+	}
+
+	remote := &net.UnixAddr{
+		Name: filepath.Join(conf.WiFiControl, conf.WiFi),
+		Net:  "unixgram",
+	}
+
+	conn, err := net.DialUnix("unixgram", local, remote)
+
+	if err != nil {
+		return
+	}
+
+	defer os.Remove(local.Name)
+	defer conn.Close()
+
+	if err = conn.SetDeadline(time.Now().Add(wifiTimeout)); err != nil {
+		return
+	}
+
+	if _, err = conn.Write([]byte(cmd)); err != nil {
+		return
+	}
+
+	buf := make([]byte, 16384)
+
+	for {
+		n, err := conn.Read(buf)
+
+		if err != nil {
+			return "", err
+		}
+
+		// skip unsolicited event messages
+		if res = string(buf[:n]); !strings.HasPrefix(res, "<") {
+			break
+		}
+	}
+
+	if strings.HasPrefix(res, "FAIL") || strings.HasPrefix(res, "UNKNOWN COMMAND") {
+		return "", fmt.Errorf("wpa_supplicant %s failed (%s)", strings.Fields(cmd)[0], strings.TrimSpace(res))
+	}
+
+	return strings.TrimSpace(res), nil
+}
+
+func wifiLoad() (networks map[string]wifiNetwork, err error) {
+	networks = make(map[string]wifiNetwork)
+
+	buf, err := volumeJail().ReadFile(wifiPath())
+
+	if os.IsNotExist(err) {
+		return networks, nil
+	}
+
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(buf, &networks)
+
+	return
+}
+
+func wifiSave(networks map[string]wifiNetwork) (err error) {
+	buf, err := json.Marshal(networks)
+
+	if err != nil {
+		return
+	}
+
+	return volumeJail().WriteFile(wifiPath(), buf, 0600)
+}
+
+// wifiPSK derives the WPA pre-shared key from a passphrase (IEEE 802.11i).
+func wifiPSK(ssid string, passphrase string) (psk string, err error) {
+	if passphrase == "" {
+		return
+	}
+
+	if len(passphrase) < 8 || len(passphrase) > 63 {
+		return "", errors.New("passphrase must be between 8 and 63 characters")
+	}
+
+	return hex.EncodeToString(pbkdf2.Key([]byte(passphrase), []byte(ssid), 4096, 32, sha1.New)), nil
+}
+
+// wpaNetworks returns the wpa_supplicant network identifiers by SSID.
+func wpaNetworks() (ids map[string][]string, err error) {
+	ids = make(map[string][]string)
+
+	res, err := wpaRequest("LIST_NETWORKS")
+
+	if err != nil {
+		return
+	}
+
+	// network id / ssid / bssid / flags
+	for _, line := range strings.Split(res, "\n")[1:] {
+		fields := strings.Split(line, "\t")
+
+		if len(fields) < 2 {
+			continue
+		}
+
+		ids[fields[1]] = append(ids[fields[1]], fields[0])
+	}
+
+	return
+}
+
+func wpaAddNetwork(n wifiNetwork) (err error) {
+	id, err := wpaRequest("ADD_NETWORK")
+
+	if err != nil {
+		return
+	}
+
+	if _, err = strconv.Atoi(id); err != nil {
+		return fmt.Errorf("invalid network id %q", id)
+	}
+
+	cmds := []string{"SET_NETWORK " + id + " ssid " + hex.EncodeToString([]byte(n.SSID))}
+
+	if n.PSK != "" {
+		cmds = append(cmds, "SET_NETWORK "+id+" psk "+n.PSK)
+	} else {
+		cmds = append(cmds, "SET_NETWORK "+id+" key_mgmt NONE")
+	}
+
+	cmds = append(cmds, "ENABLE_NETWORK "+id)
+
+	for _, cmd := range cmds {
+		if _, err = wpaRequest(cmd); err != nil {
+			wpaRequest("REMOVE_NETWORK " + id)
+			return
+		}
+	}
+
+	return
+}
+
+func wpaRemoveNetwork(ssid string) (err error) {
+	ids, err := wpaNetworks()
+
+	if err != nil {
+		return
+	}
+
+	for _, id := range ids[ssid] {
+		if _, err = wpaRequest("REMOVE_NETWORK " + id); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// wifiRestore configures the networks saved on the encrypted volume.
+func wifiRestore() {
+	networks, err := wifiLoad()
+
+	if err != nil {
+		reportError("Wi-Fi restore", err)
+		return
+	}
+
+	for _, n := range networks {
+		if err = wpaRemoveNetwork(n.SSID); err == nil {
+			err = wpaAddNetwork(n)
+		}
+
+		reportError("Wi-Fi restore", err)
+	}
+}
+
+// wifiScanResults parses wpa_supplicant scan results, strongest signal
+// first.
+func wifiScanResults(scan string, networks map[string]wifiNetwork) (results []wifiScanResult) {
+	results = []wifiScanResult{}
+
+	// bssid / frequency / signal level / flags / ssid
+	for _, line := range strings.Split(scan, "\n")[1:] {
+		fields := strings.SplitN(line, "\t", 5)
+
+		if len(fields) != 5 || fields[4] == "" {
+			continue
+		}
+
+		frequency, _ := strconv.Atoi(fields[1])
+		signal, _ := strconv.Atoi(fields[2])
+		_, saved := networks[fields[4]]
+
+		results = append(results, wifiScanResult{
+			BSSID:     fields[0],
+			Frequency: frequency,
+			Signal:    signal,
+			Flags:     fields[3],
+			SSID:      fields[4],
+			Saved:     saved,
+		})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Signal > results[j].Signal
+	})
+
+	return
+}
+
+func wifiScan() (res jsonObject) {
+	if conf.WiFi == "" {
+		return errorResponse(errWiFiDisabled, "")
+	}
+
+	if _, err := wpaRequest("SCAN"); err != nil && !strings.Contains(err.Error(), "FAIL-BUSY") {
+		return errorResponse(err, "")
+	}
+
+	time.Sleep(wifiScanTime)
+
+	scan, err := wpaRequest("SCAN_RESULTS")
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	networks, err := wifiLoad()
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	return jsonObject{
+		"status":   "OK",
+		"response": wifiScanResults(scan, networks),
+	}
+}
+
+func wifiList() (res jsonObject) {
+	if conf.WiFi == "" {
+		return errorResponse(errWiFiDisabled, "")
+	}
+
+	networks, err := wifiLoad()
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	ssids := []string{}
+
+	for ssid := range networks {
+		ssids = append(ssids, ssid)
+	}
+
+	sort.Strings(ssids)
+
+	state := make(map[string]string)
+
+	if res, err := wpaRequest("STATUS"); err == nil {
+		for _, line := range strings.Split(res, "\n") {
+			if kv := strings.SplitN(line, "=", 2); len(kv) == 2 {
+				state[kv[0]] = kv[1]
+			}
+		}
+	}
+
+	return jsonObject{
+		"status": "OK",
+		"response": map[string]interface{}{
+			"saved":  ssids,
+			"status": state,
+		},
+	}
+}
+
+func wifiJoin(r *http.Request) (res jsonObject) {
+	if conf.WiFi == "" {
+		return errorResponse(errWiFiDisabled, "")
+	}
+
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	ssid := req["ssid"].(string)
+	passphrase, _ := req["password"].(string)
+
+	if ssid == "" || len(ssid) > 32 {
+		return errorResponse(errors.New("invalid SSID"), "")
+	}
+
+	psk, err := wifiPSK(ssid, passphrase)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	networks, err := wifiLoad()
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	n := wifiNetwork{SSID: ssid, PSK: psk}
+
+	if err = wpaRemoveNetwork(ssid); err != nil {
+		return errorResponse(err, "")
+	}
+
+	if err = wpaAddNetwork(n); err != nil {
+		return errorResponse(err, "")
+	}
+
+	networks[ssid] = n
+
+	if err = wifiSave(networks); err != nil {
+		return errorResponse(err, "")
+	}
+
+	status.Log(syslog.LOG_NOTICE, "joined Wi-Fi network %q", ssid)
+
+	return jsonObject{
+		"status":   "OK",
+		"response": nil,
+	}
+}
+
+func wifiForget(r *http.Request) (res jsonObject) {
+	if conf.WiFi == "" {
+		return errorResponse(errWiFiDisabled, "")
+	}
+
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	ssid := req["ssid"].(string)
+	networks, err := wifiLoad()
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if err = wpaRemoveNetwork(ssid); err != nil {
+		return errorResponse(err, "")
+	}
+
+	delete(networks, ssid)
+
+	if err = wifiSave(networks); err != nil {
+		return errorResponse(err, "")
+	}
+
+	status.Log(syslog.LOG_NOTICE, "forgot Wi-Fi network %q", ssid)
+
+	return jsonObject{
+		"status":   "OK",
+		"response": nil,
+	}
+}
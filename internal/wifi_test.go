@@ -0,0 +1,200 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// mockSupplicant emulates the wpa_supplicant control interface network
+// management commands.
+type mockSupplicant struct {
+	sync.Mutex
+
+	next     int
+	networks map[string]map[string]string
+}
+
+func (m *mockSupplicant) handle(cmd string) string {
+	m.Lock()
+	defer m.Unlock()
+
+	args := strings.Fields(cmd)
+
+	switch args[0] {
+	case "ADD_NETWORK":
+		id := fmt.Sprintf("%d", m.next)
+		m.next++
+		m.networks[id] = map[string]string{}
+		return id + "\n"
+	case "SET_NETWORK":
+		if n, ok := m.networks[args[1]]; ok && len(args) == 4 {
+			n[args[2]] = args[3]
+			return "OK\n"
+		}
+	case "ENABLE_NETWORK":
+		if n, ok := m.networks[args[1]]; ok {
+			n["enabled"] = "1"
+			return "OK\n"
+		}
+	case "REMOVE_NETWORK":
+		if _, ok := m.networks[args[1]]; ok {
+			delete(m.networks, args[1])
+			return "OK\n"
+		}
+	case "LIST_NETWORKS":
+		res := "network id / ssid / bssid / flags\n"
+
+		for id, n := range m.networks {
+			ssid, _ := hexDecode(n["ssid"])
+			res += id + "\t" + ssid + "\tany\t\n"
+		}
+
+		return res
+	case "STATUS":
+		return "wpa_state=COMPLETED\nssid=test\n"
+	}
+
+	return "FAIL\n"
+}
+
+// saved returns the pre-shared keys of configured networks by SSID.
+func (m *mockSupplicant) saved() (networks map[string]string) {
+	m.Lock()
+	defer m.Unlock()
+
+	networks = make(map[string]string)
+
+	for _, n := range m.networks {
+		ssid, _ := hexDecode(n["ssid"])
+		networks[ssid] = n["psk"]
+	}
+
+	return
+}
+
+func (m *mockSupplicant) reset() {
+	m.Lock()
+	defer m.Unlock()
+
+	m.networks = make(map[string]map[string]string)
+}
+
+func hexDecode(s string) (string, error) {
+	var b []byte
+	_, err := fmt.Sscanf(s, "%x", &b)
+	return string(b), err
+}
+
+func newMockSupplicant(t *testing.T) (m *mockSupplicant) {
+	dir := t.TempDir()
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filepath.Join(dir, "wlan0"), Net: "unixgram"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	conf.WiFi = "wlan0"
+	conf.WiFiControl = dir
+
+	m = &mockSupplicant{networks: make(map[string]map[string]string)}
+
+	go func() {
+		buf := make([]byte, 4096)
+
+		for {
+			n, from, err := conn.ReadFromUnix(buf)
+
+			if err != nil {
+				return
+			}
+
+			// unsolicited events must be skipped by the client
+			conn.WriteToUnix([]byte("<3>CTRL-EVENT-SCAN-STARTED"), from)
+			conn.WriteToUnix([]byte(m.handle(string(buf[:n]))), from)
+		}
+	}()
+
+	return
+}
+
+func TestWiFi(t *testing.T) {
+	c := newTestServer(t)
+	defer func() { conf.WiFi = "" }()
+
+	if res := c.call("config/network/list", nil); res["status"] != "INVALID_SESSION" {
+		t.Errorf("unexpected unauthenticated response: %v", res)
+	}
+
+	c.login()
+	defer closeSession()
+
+	if res := c.call("config/network/list", nil); res["status"] != "KO" {
+		t.Errorf("Wi-Fi available without configuration: %v", res)
+	}
+
+	m := newMockSupplicant(t)
+
+	if res := c.call("config/network/join", jsonObject{"ssid": "test", "password": "short"}); res["status"] != "KO" {
+		t.Errorf("invalid passphrase accepted: %v", res)
+	}
+
+	c.mustCall("config/network/join", jsonObject{"ssid": "test", "password": "interlocktest"})
+	c.mustCall("config/network/join", jsonObject{"ssid": "open"})
+	c.mustCall("config/network/join", jsonObject{"ssid": "test", "password": "interlocktest"})
+
+	if networks := m.saved(); len(networks) != 2 || networks["test"] != "ece47445d02fb714cde1b1c6d95d232bc27f437e9255df3a17e3abdb3acd5ee0" {
+		t.Fatalf("unexpected networks: %v", networks)
+	}
+
+	buf, err := ioutil.ReadFile(wifiPath())
+
+	if err != nil || strings.Contains(string(buf), "interlocktest") {
+		t.Errorf("unexpected credentials storage: %s %v", buf, err)
+	}
+
+	res := c.mustCall("config/network/list", nil)
+
+	if fmt.Sprintf("%v", res["response"]) != "map[saved:[open test] status:map[ssid:test wpa_state:COMPLETED]]" {
+		t.Errorf("unexpected network list: %v", res)
+	}
+
+	// networks are restored from the encrypted volume at unlock
+	m.reset()
+	wifiRestore()
+
+	if networks := m.saved(); len(networks) != 2 {
+		t.Errorf("networks not restored: %v", networks)
+	}
+
+	c.mustCall("config/network/forget", jsonObject{"ssid": "test"})
+
+	if networks := m.saved(); len(networks) != 1 || !logged(`forgot Wi-Fi network "test"`) {
+		t.Errorf("network not forgotten: %v", networks)
+	}
+}
+
+func TestWiFiScanResults(t *testing.T) {
+	scan := "bssid / frequency / signal level / flags / ssid\n" +
+		"00:11:22:33:44:55\t2412\t-70\t[WPA2-PSK-CCMP][ESS]\ttest\n" +
+		"00:11:22:33:44:66\t5180\t-40\t[ESS]\topen network\n" +
+		"00:11:22:33:44:77\t2437\t-50\t[ESS]\t"
+
+	results := wifiScanResults(scan, map[string]wifiNetwork{"test": {SSID: "test"}})
+
+	if len(results) != 2 || results[0].SSID != "open network" || results[0].Frequency != 5180 || results[1].Saved != true || results[1].Signal != -70 {
+		t.Errorf("unexpected scan results: %+v", results)
+	}
+}
@@ -0,0 +1,2108 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+// Zstandard (RFC 8878) compression, used by the compressed storage class (see
+// compress.go) without third-party dependencies.
+//
+// The decoder supports the complete format except dictionaries. The encoder
+// produces single segment frames, matches are found with hash chains (with
+// one step lazy evaluation and repeat offsets) and encoded as Huffman
+// compressed literals and FSE compressed sequences, favouring a compact
+// implementation over the ratio of the reference encoder.
+
+const (
+	zstdMagic          = 0xfd2fb528
+	zstdSkippableMagic = 0x184d2a50
+	zstdMaxBlockSize   = 128 * 1024
+	zstdMinMatch       = 4
+	zstdHashLog        = 16
+	zstdChainDepth     = 32
+	zstdMaxHuffmanBits = 11
+)
+
+var errZstdCorrupted = errors.New("corrupted zstd data")
+
+// literals length codes baselines and extra bits
+var zstdLLBase = [36]uint32{
+	0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+	16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096,
+	8192, 16384, 32768, 65536,
+}
+
+var zstdLLBits = [36]uint8{
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12,
+	13, 14, 15, 16,
+}
+
+// match length codes baselines and extra bits
+var zstdMLBase = [53]uint32{
+	3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+	19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+	35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051,
+	4099, 8195, 16387, 32771, 65539,
+}
+
+var zstdMLBits = [53]uint8{
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11,
+	12, 13, 14, 15, 16,
+}
+
+// predefined sequence distributions
+var zstdLLDefault = []int16{
+	4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+	2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+	-1, -1, -1, -1,
+}
+
+var zstdMLDefault = []int16{
+	1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+	1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+	1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+	-1, -1, -1, -1, -1,
+}
+
+var zstdOFDefault = []int16{
+	1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+	1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+}
+
+// sequence symbol streams: distribution, maximum accuracy and symbol
+type zstdSequenceKind struct {
+	predefined    []int16
+	predefinedLog uint
+	maxLog        uint
+	maxSymbol     int
+}
+
+var (
+	zstdLL = zstdSequenceKind{zstdLLDefault, 6, 9, 35}
+	zstdOF = zstdSequenceKind{zstdOFDefault, 5, 8, 31}
+	zstdML = zstdSequenceKind{zstdMLDefault, 6, 9, 52}
+)
+
+var (
+	zstdLLTable = mustZstdFSETable(zstdLLDefault, 6)
+	zstdOFTable = mustZstdFSETable(zstdOFDefault, 5)
+	zstdMLTable = mustZstdFSETable(zstdMLDefault, 6)
+)
+
+// symbol compression modes
+const (
+	zstdModePredefined = iota
+	zstdModeRLE
+	zstdModeCompressed
+	zstdModeRepeat
+)
+
+func zstdHighBit(v uint32) uint {
+	return uint(bits.Len32(v)) - 1
+}
+
+// zstdRepeat resolves an offset value, updating the repeat offsets, a zero
+// offset is invalid.
+func zstdRepeat(rep *[3]int, value int, litLen int) (offset int) {
+	if value > 3 {
+		offset = value - 3
+		rep[2], rep[1], rep[0] = rep[1], rep[0], offset
+
+		return
+	}
+
+	i := value - 1
+
+	if litLen == 0 {
+		i++
+	}
+
+	switch i {
+	case 0:
+		return rep[0]
+	case 3:
+		offset = rep[0] - 1
+	default:
+		offset = rep[i]
+	}
+
+	if i > 1 {
+		rep[2] = rep[1]
+	}
+
+	rep[1], rep[0] = rep[0], offset
+
+	return
+}
+
+// zstdForwardReader reads little-endian bit fields, as used by FSE table
+// descriptions.
+type zstdForwardReader struct {
+	data []byte
+	pos  uint
+}
+
+func (r *zstdForwardReader) peek(n uint) (v uint32) {
+	for i := uint(0); i < n; i++ {
+		p := r.pos + i
+
+		if int(p/8) < len(r.data) && r.data[p/8]&(1<<(p%8)) != 0 {
+			v |= 1 << i
+		}
+	}
+
+	return
+}
+
+func (r *zstdForwardReader) read(n uint) (v uint32) {
+	v = r.peek(n)
+	r.pos += n
+
+	return
+}
+
+// zstdBackwardReader reads bit fields from the end of a bitstream, whose last
+// byte carries a padding marker, as used by Huffman and FSE streams.
+type zstdBackwardReader struct {
+	data []byte
+	pos  int
+}
+
+func newZstdBackwardReader(data []byte) (r *zstdBackwardReader, err error) {
+	if len(data) == 0 || data[len(data)-1] == 0 {
+		return nil, errZstdCorrupted
+	}
+
+	r = &zstdBackwardReader{
+		data: data,
+		pos:  (len(data)-1)*8 + bits.Len8(data[len(data)-1]) - 1,
+	}
+
+	return
+}
+
+// bits returns the n bits starting at pos, bits before the start of the
+// stream read as zero.
+func (r *zstdBackwardReader) bits(pos int, n uint) uint64 {
+	var w uint64
+	var shift uint
+
+	if n == 0 {
+		return 0
+	}
+
+	if pos < 0 {
+		shift = uint(-pos)
+
+		if shift >= n {
+			return 0
+		}
+
+		n -= shift
+		pos = 0
+	}
+
+	for i, j := 0, pos/8; i < 8 && j < len(r.data); i, j = i+1, j+1 {
+		w |= uint64(r.data[j]) << (8 * i)
+	}
+
+	return (w >> uint(pos%8)) & (1<<n - 1) << shift
+}
+
+func (r *zstdBackwardReader) peek(n uint) uint64 {
+	return r.bits(r.pos-int(n), n)
+}
+
+func (r *zstdBackwardReader) read(n uint) (v uint64) {
+	r.pos -= int(n)
+	return r.bits(r.pos, n)
+}
+
+// zstdBitWriter writes little-endian bit fields.
+type zstdBitWriter struct {
+	out []byte
+	acc uint64
+	n   uint
+}
+
+func (w *zstdBitWriter) add(v uint64, n uint) {
+	w.acc |= (v & (1<<n - 1)) << w.n
+	w.n += n
+
+	for w.n >= 8 {
+		w.out = append(w.out, byte(w.acc))
+		w.acc >>= 8
+		w.n -= 8
+	}
+}
+
+// flush pads the last byte with zeros.
+func (w *zstdBitWriter) flush() []byte {
+	if w.n > 0 {
+		w.out = append(w.out, byte(w.acc))
+		w.acc = 0
+		w.n = 0
+	}
+
+	return w.out
+}
+
+// close terminates a backward read bitstream with its padding marker.
+func (w *zstdBitWriter) close() []byte {
+	w.add(1, 1)
+	return w.flush()
+}
+
+type zstdFSEEntry struct {
+	symbol uint8
+	nbBits uint8
+	base   uint16
+}
+
+type zstdFSETable struct {
+	log     uint
+	entries []zstdFSEEntry
+}
+
+// zstdFSESpread distributes the symbols of a normalized distribution over
+// the table.
+func zstdFSESpread(norm []int16, log uint) (symbols []uint8, err error) {
+	size := 1 << log
+	high := size - 1
+	symbols = make([]uint8, size)
+
+	for s, n := range norm {
+		if n == -1 {
+			symbols[high] = uint8(s)
+			high--
+		}
+	}
+
+	pos := 0
+	step := size>>1 + size>>3 + 3
+
+	for s, n := range norm {
+		for i := 0; i < int(n); i++ {
+			symbols[pos] = uint8(s)
+			pos = (pos + step) & (size - 1)
+
+			for pos > high {
+				pos = (pos + step) & (size - 1)
+			}
+		}
+	}
+
+	if pos != 0 {
+		return nil, errZstdCorrupted
+	}
+
+	return
+}
+
+func mustZstdFSETable(norm []int16, log uint) *zstdFSETable {
+	t, err := newZstdFSETable(norm, log)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return t
+}
+
+func newZstdFSETable(norm []int16, log uint) (t *zstdFSETable, err error) {
+	symbols, err := zstdFSESpread(norm, log)
+
+	if err != nil {
+		return
+	}
+
+	size := 1 << log
+	next := make([]uint32, len(norm))
+
+	for s, n := range norm {
+		if n == -1 {
+			next[s] = 1
+		} else {
+			next[s] = uint32(n)
+		}
+	}
+
+	t = &zstdFSETable{
+		log:     log,
+		entries: make([]zstdFSEEntry, size),
+	}
+
+	for i, s := range symbols {
+		n := next[s]
+		next[s]++
+
+		nbBits := log - zstdHighBit(n)
+		t.entries[i] = zstdFSEEntry{
+			symbol: s,
+			nbBits: uint8(nbBits),
+			base:   uint16(n<<nbBits - uint32(size)),
+		}
+	}
+
+	return
+}
+
+func zstdRLETable(symbol uint8) *zstdFSETable {
+	return &zstdFSETable{
+		entries: []zstdFSEEntry{{symbol: symbol}},
+	}
+}
+
+// zstdReadNCount parses an FSE table description, returning the normalized
+// distribution, its accuracy and the description size.
+func zstdReadNCount(data []byte, maxLog uint, maxSymbol int) (norm []int16, log uint, size int, err error) {
+	r := &zstdForwardReader{data: data}
+	log = uint(r.read(4)) + 5
+
+	if log > maxLog {
+		return nil, 0, 0, errZstdCorrupted
+	}
+
+	remaining := 1<<log + 1
+	threshold := 1 << log
+	nbBits := log + 1
+	previous0 := false
+
+	for remaining > 1 {
+		if previous0 {
+			for {
+				repeat := r.read(2)
+
+				for i := uint32(0); i < repeat; i++ {
+					norm = append(norm, 0)
+				}
+
+				if repeat != 3 {
+					break
+				}
+			}
+		}
+
+		if len(norm) > maxSymbol {
+			return nil, 0, 0, errZstdCorrupted
+		}
+
+		max := uint32(2*threshold - 1 - remaining)
+		v := r.peek(nbBits)
+		count := int(v & uint32(threshold-1))
+
+		if uint32(count) < max {
+			r.pos += nbBits - 1
+		} else {
+			count = int(v & uint32(2*threshold-1))
+
+			if count >= threshold {
+				count -= int(max)
+			}
+
+			r.pos += nbBits
+		}
+
+		count--
+
+		if count < 0 {
+			remaining += count
+		} else {
+			remaining -= count
+		}
+
+		if remaining < 1 {
+			return nil, 0, 0, errZstdCorrupted
+		}
+
+		norm = append(norm, int16(count))
+		previous0 = count == 0
+
+		for remaining < threshold {
+			nbBits--
+			threshold >>= 1
+		}
+	}
+
+	size = int((r.pos + 7) / 8)
+
+	if remaining != 1 || size > len(data) {
+		return nil, 0, 0, errZstdCorrupted
+	}
+
+	return
+}
+
+// zstdWriteNCount returns the description of a normalized distribution.
+func zstdWriteNCount(norm []int16, log uint) []byte {
+	w := &zstdBitWriter{}
+	w.add(uint64(log-5), 4)
+
+	remaining := 1<<log + 1
+	threshold := 1 << log
+	nbBits := log + 1
+	previous0 := false
+
+	for s := 0; s < len(norm) && remaining > 1; {
+		if previous0 {
+			start := s
+
+			for s < len(norm) && norm[s] == 0 {
+				s++
+			}
+
+			if s == len(norm) {
+				break
+			}
+
+			for ; s >= start+3; start += 3 {
+				w.add(3, 2)
+			}
+
+			w.add(uint64(s-start), 2)
+		}
+
+		count := int(norm[s])
+		s++
+
+		max := 2*threshold - 1 - remaining
+
+		if count < 0 {
+			remaining += count
+		} else {
+			remaining -= count
+		}
+
+		count++
+
+		if count >= threshold {
+			count += max
+		}
+
+		if count < max {
+			w.add(uint64(count), nbBits-1)
+		} else {
+			w.add(uint64(count), nbBits)
+		}
+
+		previous0 = count == 1
+
+		for remaining < threshold {
+			nbBits--
+			threshold >>= 1
+		}
+	}
+
+	return w.flush()
+}
+
+// zstdTableLog returns the FSE accuracy for a distribution of total symbols,
+// up to maxSymbol, as chosen by the reference encoder.
+func zstdTableLog(maxLog uint, total int, maxSymbol int) uint {
+	maxBitsSrc := int(zstdHighBit(uint32(total-1))) - 2
+	minBits := int(zstdHighBit(uint32(total))) + 1
+
+	if b := int(zstdHighBit(uint32(maxSymbol))) + 2; b < minBits {
+		minBits = b
+	}
+
+	log := int(maxLog)
+
+	if maxBitsSrc < log {
+		log = maxBitsSrc
+	}
+
+	if minBits > log {
+		log = minBits
+	}
+
+	if log < 5 {
+		log = 5
+	}
+
+	if log > int(maxLog) {
+		log = int(maxLog)
+	}
+
+	return uint(log)
+}
+
+// zstdNormalize scales symbol counts to a distribution summing to the table
+// size, each present symbol retaining a non-zero probability.
+func zstdNormalize(counts []int, total int, log uint) (norm []int16) {
+	size := 1 << log
+	sum := 0
+	largest := -1
+	norm = make([]int16, len(counts))
+
+	for s, c := range counts {
+		if c == 0 {
+			continue
+		}
+
+		n := (c*size + total/2) / total
+
+		if n < 1 {
+			n = 1
+		}
+
+		norm[s] = int16(n)
+		sum += n
+
+		if largest < 0 || c > counts[largest] {
+			largest = s
+		}
+	}
+
+	for ; sum > size; sum-- {
+		max := 0
+
+		for s := range norm {
+			if norm[s] > norm[max] {
+				max = s
+			}
+		}
+
+		norm[max]--
+	}
+
+	norm[largest] += int16(size - sum)
+
+	return
+}
+
+// zstdCost estimates the encoded size in bits of symbol counts with a
+// normalized distribution.
+func zstdCost(counts []int, norm []int16, log uint) (cost float64) {
+	for s, c := range counts {
+		if c == 0 {
+			continue
+		}
+
+		if s >= len(norm) || norm[s] == 0 {
+			return math.Inf(1)
+		}
+
+		p := float64(norm[s])
+
+		if p < 0 {
+			p = 1
+		}
+
+		cost += float64(c) * (float64(log) - math.Log2(p))
+	}
+
+	return
+}
+
+type zstdFSETransform struct {
+	deltaNbBits    uint32
+	deltaFindState int
+}
+
+type zstdFSEEncoder struct {
+	log        uint
+	stateTable []uint16
+	symbolTT   []zstdFSETransform
+}
+
+func newZstdFSEEncoder(norm []int16, log uint) (e *zstdFSEEncoder) {
+	size := 1 << log
+	symbols, _ := zstdFSESpread(norm, log)
+	cumul := make([]int, len(norm)+1)
+
+	for s, n := range norm {
+		if n == -1 {
+			n = 1
+		}
+
+		cumul[s+1] = cumul[s] + int(n)
+	}
+
+	e = &zstdFSEEncoder{
+		log:        log,
+		stateTable: make([]uint16, size),
+		symbolTT:   make([]zstdFSETransform, len(norm)),
+	}
+
+	for i, s := range symbols {
+		e.stateTable[cumul[s]] = uint16(size + i)
+		cumul[s]++
+	}
+
+	total := 0
+
+	for s, n := range norm {
+		switch n {
+		case 0:
+			e.symbolTT[s].deltaNbBits = uint32(log+1)<<16 - uint32(size)
+		case -1, 1:
+			e.symbolTT[s].deltaNbBits = uint32(log)<<16 - uint32(size)
+			e.symbolTT[s].deltaFindState = total - 1
+			total++
+		default:
+			maxBitsOut := log - zstdHighBit(uint32(n)-1)
+			minStatePlus := uint32(n) << maxBitsOut
+			e.symbolTT[s].deltaNbBits = uint32(maxBitsOut)<<16 - minStatePlus
+			e.symbolTT[s].deltaFindState = total - int(n)
+			total += int(n)
+		}
+	}
+
+	return
+}
+
+// init returns the initial state encoding a symbol.
+func (e *zstdFSEEncoder) init(symbol uint8) (state uint32) {
+	tt := e.symbolTT[symbol]
+	nbBitsOut := (tt.deltaNbBits + 1<<15) >> 16
+	state = nbBitsOut<<16 - tt.deltaNbBits
+
+	return uint32(e.stateTable[int(state>>nbBitsOut)+tt.deltaFindState])
+}
+
+func (e *zstdFSEEncoder) encode(w *zstdBitWriter, state *uint32, symbol uint8) {
+	tt := e.symbolTT[symbol]
+	nbBitsOut := (*state + tt.deltaNbBits) >> 16
+	w.add(uint64(*state), uint(nbBitsOut))
+	*state = uint32(e.stateTable[int(*state>>nbBitsOut)+tt.deltaFindState])
+}
+
+func (e *zstdFSEEncoder) flush(w *zstdBitWriter, state uint32) {
+	w.add(uint64(state), e.log)
+}
+
+type zstdHuffman struct {
+	maxBits uint
+	// symbol << 8 | number of bits
+	table []uint16
+}
+
+// newZstdHuffman builds the decoding table from the weights of all symbols
+// but the last, whose weight is implied.
+func newZstdHuffman(weights []uint8) (h *zstdHuffman, err error) {
+	var sum uint32
+
+	if len(weights) > 255 {
+		return nil, errZstdCorrupted
+	}
+
+	for _, w := range weights {
+		if w > zstdMaxHuffmanBits {
+			return nil, errZstdCorrupted
+		}
+
+		if w > 0 {
+			sum += 1 << (w - 1)
+		}
+	}
+
+	if sum == 0 {
+		return nil, errZstdCorrupted
+	}
+
+	maxBits := zstdHighBit(sum) + 1
+	rest := uint32(1)<<maxBits - sum
+
+	if maxBits > zstdMaxHuffmanBits || rest&(rest-1) != 0 {
+		return nil, errZstdCorrupted
+	}
+
+	weights = append(weights, uint8(zstdHighBit(rest)+1))
+
+	h = &zstdHuffman{
+		maxBits: maxBits,
+		table:   make([]uint16, 1<<maxBits),
+	}
+
+	pos := 0
+
+	for w := uint(1); w <= maxBits; w++ {
+		for s, sw := range weights {
+			if uint(sw) != w {
+				continue
+			}
+
+			n := 1 << (w - 1)
+			entry := uint16(s)<<8 | uint16(maxBits+1-w)
+
+			for i := pos; i < pos+n; i++ {
+				h.table[i] = entry
+			}
+
+			pos += n
+		}
+	}
+
+	return
+}
+
+// zstdReadHuffman parses a Huffman tree description, returning its size.
+func zstdReadHuffman(data []byte) (h *zstdHuffman, size int, err error) {
+	var weights []uint8
+
+	if len(data) == 0 {
+		return nil, 0, errZstdCorrupted
+	}
+
+	header := int(data[0])
+
+	if header >= 128 {
+		n := header - 127
+		size = 1 + (n+1)/2
+
+		if size > len(data) {
+			return nil, 0, errZstdCorrupted
+		}
+
+		for i := 0; i < n; i++ {
+			b := data[1+i/2]
+
+			if i%2 == 0 {
+				weights = append(weights, b>>4)
+			} else {
+				weights = append(weights, b&0xf)
+			}
+		}
+	} else {
+		size = 1 + header
+
+		if size > len(data) {
+			return nil, 0, errZstdCorrupted
+		}
+
+		if weights, err = zstdReadWeights(data[1:size]); err != nil {
+			return
+		}
+	}
+
+	h, err = newZstdHuffman(weights)
+
+	return
+}
+
+// zstdReadWeights decodes FSE compressed Huffman weights, interleaved on two
+// states until the bitstream is exhausted.
+func zstdReadWeights(data []byte) (weights []uint8, err error) {
+	norm, log, n, err := zstdReadNCount(data, 6, zstdMaxHuffmanBits+1)
+
+	if err != nil {
+		return
+	}
+
+	t, err := newZstdFSETable(norm, log)
+
+	if err != nil {
+		return
+	}
+
+	r, err := newZstdBackwardReader(data[n:])
+
+	if err != nil {
+		return
+	}
+
+	states := [2]uint64{r.read(log), r.read(log)}
+
+	for i := 0; ; i = 1 - i {
+		if len(weights) > 255 {
+			return nil, errZstdCorrupted
+		}
+
+		e := t.entries[states[i]]
+		weights = append(weights, e.symbol)
+		states[i] = uint64(e.base) + r.read(uint(e.nbBits))
+
+		if r.pos < 0 {
+			weights = append(weights, t.entries[states[1-i]].symbol)
+			break
+		}
+	}
+
+	return
+}
+
+func (h *zstdHuffman) decodeStream(dst []byte, stream []byte) (err error) {
+	r, err := newZstdBackwardReader(stream)
+
+	if err != nil {
+		return
+	}
+
+	for i := range dst {
+		e := h.table[r.peek(h.maxBits)]
+		dst[i] = byte(e >> 8)
+		r.pos -= int(e & 0xff)
+	}
+
+	if r.pos != 0 {
+		return errZstdCorrupted
+	}
+
+	return
+}
+
+// zstdDecoder holds the state shared by the blocks of a frame.
+type zstdDecoder struct {
+	out     []byte
+	start   int
+	limit   int
+	rep     [3]int
+	huffman *zstdHuffman
+	tables  [3]*zstdFSETable
+}
+
+// zstdDecompress decodes the Zstandard frames in src, output larger than
+// limit is refused.
+func zstdDecompress(src []byte, limit int) (out []byte, err error) {
+	d := &zstdDecoder{
+		limit: limit,
+	}
+
+	for len(src) > 0 {
+		if len(src) < 8 {
+			return nil, errZstdCorrupted
+		}
+
+		magic := binary.LittleEndian.Uint32(src)
+
+		if magic&0xfffffff0 == zstdSkippableMagic {
+			size := int64(binary.LittleEndian.Uint32(src[4:]))
+
+			if size > int64(len(src)-8) {
+				return nil, errZstdCorrupted
+			}
+
+			src = src[8+size:]
+			continue
+		}
+
+		if magic != zstdMagic {
+			return nil, errors.New("invalid zstd magic")
+		}
+
+		if src, err = d.frame(src[4:]); err != nil {
+			return nil, err
+		}
+	}
+
+	return d.out, nil
+}
+
+func (d *zstdDecoder) frame(src []byte) (rest []byte, err error) {
+	descriptor := src[0]
+	single := descriptor&(1<<5) != 0
+	checksum := descriptor&(1<<2) != 0
+	pos := 1
+
+	if descriptor&(1<<3) != 0 {
+		return nil, errZstdCorrupted
+	}
+
+	if !single {
+		pos++
+	}
+
+	if descriptor&3 != 0 {
+		dictSize := []int{0, 1, 2, 4}[descriptor&3]
+
+		if len(src) < pos+dictSize {
+			return nil, errZstdCorrupted
+		}
+
+		for _, b := range src[pos : pos+dictSize] {
+			if b != 0 {
+				return nil, errors.New("zstd dictionaries are not supported")
+			}
+		}
+
+		pos += dictSize
+	}
+
+	contentSize := int64(-1)
+	fcsSize := []int{0, 2, 4, 8}[descriptor>>6]
+
+	if fcsSize == 0 && single {
+		fcsSize = 1
+	}
+
+	if len(src) < pos+fcsSize {
+		return nil, errZstdCorrupted
+	}
+
+	switch fcsSize {
+	case 1:
+		contentSize = int64(src[pos])
+	case 2:
+		contentSize = int64(binary.LittleEndian.Uint16(src[pos:])) + 256
+	case 4:
+		contentSize = int64(binary.LittleEndian.Uint32(src[pos:]))
+	case 8:
+		contentSize = int64(binary.LittleEndian.Uint64(src[pos:]))
+	}
+
+	pos += fcsSize
+
+	if contentSize > int64(d.limit-len(d.out)) {
+		return nil, errors.New("zstd content exceeds limit")
+	}
+
+	if contentSize > 0 && cap(d.out) < len(d.out)+int(contentSize) {
+		out := make([]byte, len(d.out), len(d.out)+int(contentSize))
+		copy(out, d.out)
+		d.out = out
+	}
+
+	d.start = len(d.out)
+	d.rep = [3]int{1, 4, 8}
+	d.huffman = nil
+	d.tables = [3]*zstdFSETable{}
+
+	for last := false; !last; {
+		if len(src) < pos+3 {
+			return nil, errZstdCorrupted
+		}
+
+		header := uint32(src[pos]) | uint32(src[pos+1])<<8 | uint32(src[pos+2])<<16
+		last = header&1 != 0
+		size := int(header >> 3)
+		pos += 3
+
+		switch header >> 1 & 3 {
+		case 0:
+			if len(src) < pos+size || size > zstdMaxBlockSize {
+				return nil, errZstdCorrupted
+			}
+
+			err = d.append(src[pos : pos+size])
+			pos += size
+		case 1:
+			if len(src) < pos+1 || size > zstdMaxBlockSize {
+				return nil, errZstdCorrupted
+			}
+
+			if err = d.grow(size); err == nil {
+				for i := 0; i < size; i++ {
+					d.out = append(d.out, src[pos])
+				}
+			}
+
+			pos++
+		case 2:
+			if len(src) < pos+size || size > zstdMaxBlockSize {
+				return nil, errZstdCorrupted
+			}
+
+			err = d.block(src[pos : pos+size])
+			pos += size
+		default:
+			err = errZstdCorrupted
+		}
+
+		if err != nil {
+			return
+		}
+	}
+
+	if contentSize >= 0 && int64(len(d.out)-d.start) != contentSize {
+		return nil, errZstdCorrupted
+	}
+
+	if checksum {
+		if len(src) < pos+4 {
+			return nil, errZstdCorrupted
+		}
+
+		if uint32(xxhash64(d.out[d.start:])) != binary.LittleEndian.Uint32(src[pos:]) {
+			return nil, errors.New("zstd checksum mismatch")
+		}
+
+		pos += 4
+	}
+
+	return src[pos:], nil
+}
+
+func (d *zstdDecoder) grow(n int) error {
+	if n > d.limit-len(d.out) {
+		return errors.New("zstd content exceeds limit")
+	}
+
+	return nil
+}
+
+func (d *zstdDecoder) append(data []byte) (err error) {
+	if err = d.grow(len(data)); err != nil {
+		return
+	}
+
+	d.out = append(d.out, data...)
+
+	return
+}
+
+func (d *zstdDecoder) block(data []byte) (err error) {
+	literals, n, err := d.literals(data)
+
+	if err != nil {
+		return
+	}
+
+	return d.sequences(data[n:], literals)
+}
+
+// literals decodes the literals section, returning its size.
+func (d *zstdDecoder) literals(data []byte) (literals []byte, size int, err error) {
+	var regenerated, compressed, headerSize int
+
+	if len(data) == 0 {
+		return nil, 0, errZstdCorrupted
+	}
+
+	kind := data[0] & 3
+	format := data[0] >> 2 & 3
+
+	if kind < 2 {
+		switch format {
+		case 0, 2:
+			headerSize = 1
+			regenerated = int(data[0] >> 3)
+		case 1:
+			headerSize = 2
+		case 3:
+			headerSize = 3
+		}
+
+		if len(data) < headerSize {
+			return nil, 0, errZstdCorrupted
+		}
+
+		if headerSize > 1 {
+			regenerated = int(data[0] >> 4)
+
+			for i := 1; i < headerSize; i++ {
+				regenerated |= int(data[i]) << (4 + 8*(i-1))
+			}
+		}
+
+		if regenerated > zstdMaxBlockSize {
+			return nil, 0, errZstdCorrupted
+		}
+
+		if kind == 0 {
+			size = headerSize + regenerated
+
+			if len(data) < size {
+				return nil, 0, errZstdCorrupted
+			}
+
+			return data[headerSize:size], size, nil
+		}
+
+		if len(data) < headerSize+1 {
+			return nil, 0, errZstdCorrupted
+		}
+
+		literals = make([]byte, regenerated)
+
+		for i := range literals {
+			literals[i] = data[headerSize]
+		}
+
+		return literals, headerSize + 1, nil
+	}
+
+	fieldSize := []uint{10, 10, 14, 18}[format]
+	headerSize = int(4+2*fieldSize+7) / 8
+
+	if len(data) < headerSize {
+		return nil, 0, errZstdCorrupted
+	}
+
+	var header uint64
+
+	for i := 0; i < headerSize; i++ {
+		header |= uint64(data[i]) << (8 * i)
+	}
+
+	regenerated = int(header >> 4 & (1<<fieldSize - 1))
+	compressed = int(header >> (4 + fieldSize) & (1<<fieldSize - 1))
+	size = headerSize + compressed
+
+	if regenerated > zstdMaxBlockSize || len(data) < size {
+		return nil, 0, errZstdCorrupted
+	}
+
+	data = data[headerSize:size]
+
+	if kind == 2 {
+		h, n, err := zstdReadHuffman(data)
+
+		if err != nil {
+			return nil, 0, err
+		}
+
+		d.huffman = h
+		data = data[n:]
+	} else if d.huffman == nil {
+		return nil, 0, errZstdCorrupted
+	}
+
+	literals = make([]byte, regenerated)
+
+	if format == 0 {
+		err = d.huffman.decodeStream(literals, data)
+		return
+	}
+
+	if len(data) < 6 {
+		return nil, 0, errZstdCorrupted
+	}
+
+	streams := make([][]byte, 4)
+	offset := 6
+
+	for i := 0; i < 3; i++ {
+		n := int(binary.LittleEndian.Uint16(data[2*i:]))
+
+		if offset+n > len(data) {
+			return nil, 0, errZstdCorrupted
+		}
+
+		streams[i] = data[offset : offset+n]
+		offset += n
+	}
+
+	streams[3] = data[offset:]
+	segment := (regenerated + 3) / 4
+
+	if regenerated < 3*segment {
+		return nil, 0, errZstdCorrupted
+	}
+
+	for i, stream := range streams {
+		end := (i + 1) * segment
+
+		if i == 3 {
+			end = regenerated
+		}
+
+		if err = d.huffman.decodeStream(literals[i*segment:end], stream); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// table parses a sequence symbol table description according to its mode,
+// returning its size.
+func (d *zstdDecoder) table(i int, mode byte, kind zstdSequenceKind, data []byte) (size int, err error) {
+	switch mode {
+	case zstdModePredefined:
+		d.tables[i] = []*zstdFSETable{zstdLLTable, zstdOFTable, zstdMLTable}[i]
+	case zstdModeRLE:
+		if len(data) < 1 || int(data[0]) > kind.maxSymbol {
+			return 0, errZstdCorrupted
+		}
+
+		d.tables[i] = zstdRLETable(data[0])
+		size = 1
+	case zstdModeCompressed:
+		var norm []int16
+		var log uint
+
+		if norm, log, size, err = zstdReadNCount(data, kind.maxLog, kind.maxSymbol); err != nil {
+			return
+		}
+
+		d.tables[i], err = newZstdFSETable(norm, log)
+	case zstdModeRepeat:
+		if d.tables[i] == nil {
+			return 0, errZstdCorrupted
+		}
+	}
+
+	return
+}
+
+// sequences decodes and executes the sequences section.
+func (d *zstdDecoder) sequences(data []byte, literals []byte) (err error) {
+	var count int
+
+	if len(data) == 0 {
+		return errZstdCorrupted
+	}
+
+	switch {
+	case data[0] < 128:
+		count = int(data[0])
+		data = data[1:]
+	case data[0] < 255:
+		if len(data) < 2 {
+			return errZstdCorrupted
+		}
+
+		count = int(data[0]-128)<<8 | int(data[1])
+		data = data[2:]
+	default:
+		if len(data) < 3 {
+			return errZstdCorrupted
+		}
+
+		count = (int(data[1]) | int(data[2])<<8) + 0x7f00
+		data = data[3:]
+	}
+
+	if count == 0 {
+		return d.append(literals)
+	}
+
+	if len(data) < 1 || data[0]&3 != 0 {
+		return errZstdCorrupted
+	}
+
+	modes := data[0]
+	data = data[1:]
+
+	for i, kind := range []zstdSequenceKind{zstdLL, zstdOF, zstdML} {
+		n, err := d.table(i, modes>>(6-2*i)&3, kind, data)
+
+		if err != nil {
+			return err
+		}
+
+		data = data[n:]
+	}
+
+	r, err := newZstdBackwardReader(data)
+
+	if err != nil {
+		return
+	}
+
+	ll, of, ml := d.tables[0], d.tables[1], d.tables[2]
+	llState := r.read(ll.log)
+	ofState := r.read(of.log)
+	mlState := r.read(ml.log)
+
+	for i := 0; i < count; i++ {
+		ofCode := of.entries[ofState].symbol
+		mlCode := ml.entries[mlState].symbol
+		llCode := ll.entries[llState].symbol
+
+		if ofCode > 31 {
+			return errZstdCorrupted
+		}
+
+		value := int(1)<<ofCode + int(r.read(uint(ofCode)))
+		matchLen := int(zstdMLBase[mlCode]) + int(r.read(uint(zstdMLBits[mlCode])))
+		litLen := int(zstdLLBase[llCode]) + int(r.read(uint(zstdLLBits[llCode])))
+
+		if i < count-1 {
+			e := ll.entries[llState]
+			llState = uint64(e.base) + r.read(uint(e.nbBits))
+			e = ml.entries[mlState]
+			mlState = uint64(e.base) + r.read(uint(e.nbBits))
+			e = of.entries[ofState]
+			ofState = uint64(e.base) + r.read(uint(e.nbBits))
+		}
+
+		if r.pos < 0 || litLen > len(literals) {
+			return errZstdCorrupted
+		}
+
+		if err = d.append(literals[:litLen]); err != nil {
+			return
+		}
+
+		literals = literals[litLen:]
+		offset := zstdRepeat(&d.rep, value, litLen)
+
+		if offset <= 0 || offset > len(d.out)-d.start {
+			return errZstdCorrupted
+		}
+
+		if err = d.grow(matchLen); err != nil {
+			return
+		}
+
+		start := len(d.out) - offset
+
+		if offset >= matchLen {
+			d.out = append(d.out, d.out[start:start+matchLen]...)
+		} else {
+			for j := 0; j < matchLen; j++ {
+				d.out = append(d.out, d.out[start+j])
+			}
+		}
+	}
+
+	if r.pos != 0 {
+		return errZstdCorrupted
+	}
+
+	return d.append(literals)
+}
+
+type zstdSequence struct {
+	litLen   uint32
+	matchLen uint32
+	offset   uint32
+}
+
+type zstdEncoder struct {
+	src   []byte
+	rep   [3]int
+	head  []int32
+	chain []int32
+	next  int
+}
+
+// zstdCompress encodes data as a single Zstandard frame.
+func zstdCompress(src []byte) (out []byte) {
+	size := uint64(len(src))
+	out = make([]byte, 4, 16+len(src)/2)
+	binary.LittleEndian.PutUint32(out, zstdMagic)
+
+	// single segment, no checksum (authenticated by the storage class)
+	switch {
+	case size < 256:
+		out = append(out, 0<<6|1<<5, byte(size))
+	case size < 65536+256:
+		out = append(out, 1<<6|1<<5, byte(size-256), byte((size-256)>>8))
+	case size <= math.MaxUint32:
+		out = append(out, 2<<6|1<<5)
+		out = append(out, make([]byte, 4)...)
+		binary.LittleEndian.PutUint32(out[len(out)-4:], uint32(size))
+	default:
+		out = append(out, 3<<6|1<<5)
+		out = append(out, make([]byte, 8)...)
+		binary.LittleEndian.PutUint64(out[len(out)-8:], size)
+	}
+
+	e := &zstdEncoder{
+		src:   src,
+		rep:   [3]int{1, 4, 8},
+		head:  make([]int32, 1<<zstdHashLog),
+		chain: make([]int32, len(src)),
+	}
+
+	for start := 0; ; start += zstdMaxBlockSize {
+		end := start + zstdMaxBlockSize
+
+		if end >= len(src) {
+			return e.block(out, start, len(src), true)
+		}
+
+		out = e.block(out, start, end, false)
+	}
+}
+
+func zstdBlockHeader(out []byte, kind uint32, size int, last bool) []byte {
+	header := kind<<1 | uint32(size)<<3
+
+	if last {
+		header |= 1
+	}
+
+	return append(out, byte(header), byte(header>>8), byte(header>>16))
+}
+
+func (e *zstdEncoder) block(out []byte, start int, end int, last bool) []byte {
+	data := e.src[start:end]
+
+	if len(data) > 1 && zstdUniform(data) {
+		out = zstdBlockHeader(out, 1, len(data), last)
+		return append(out, data[0])
+	}
+
+	rep := e.rep
+	sequences, literals := e.parse(start, end)
+
+	if len(sequences) > 0 || len(literals) > 0 {
+		compressed := zstdEncodeLiterals(nil, literals)
+		compressed = zstdEncodeSequences(compressed, sequences)
+
+		if len(compressed) < len(data) {
+			out = zstdBlockHeader(out, 2, len(compressed), last)
+			return append(out, compressed...)
+		}
+	}
+
+	// repeat offsets are not updated by raw blocks
+	e.rep = rep
+	out = zstdBlockHeader(out, 0, len(data), last)
+
+	return append(out, data...)
+}
+
+func zstdUniform(data []byte) bool {
+	for _, b := range data[1:] {
+		if b != data[0] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (e *zstdEncoder) hash(pos int) uint32 {
+	return binary.LittleEndian.Uint32(e.src[pos:]) * 2654435761 >> (32 - zstdHashLog)
+}
+
+// insert adds positions before pos to the hash chains.
+func (e *zstdEncoder) insert(pos int) {
+	for ; e.next < pos && e.next+zstdMinMatch <= len(e.src); e.next++ {
+		h := e.hash(e.next)
+		e.chain[e.next] = e.head[h]
+		e.head[h] = int32(e.next + 1)
+	}
+}
+
+func (e *zstdEncoder) matchLen(a int, b int, end int) (n int) {
+	for b+n < end && e.src[a+n] == e.src[b+n] {
+		n++
+	}
+
+	return
+}
+
+// find returns the longest match for pos ending within end, repeat offsets
+// are preferred on equal length.
+func (e *zstdEncoder) find(pos int, end int) (length int, offset int) {
+	e.insert(pos)
+
+	for _, r := range e.rep {
+		if r <= pos {
+			if n := e.matchLen(pos-r, pos, end); n > length {
+				length, offset = n, r
+			}
+		}
+	}
+
+	candidate := e.head[e.hash(pos)]
+
+	for depth := 0; candidate > 0 && depth < zstdChainDepth; depth++ {
+		c := int(candidate) - 1
+
+		if n := e.matchLen(c, pos, end); n > length {
+			length, offset = n, pos-c
+		}
+
+		candidate = e.chain[c]
+	}
+
+	if length < zstdMinMatch {
+		return 0, 0
+	}
+
+	return
+}
+
+// parse returns the sequences and literals of a block.
+func (e *zstdEncoder) parse(start int, end int) (sequences []zstdSequence, literals []byte) {
+	anchor := start
+
+	for pos := start; pos+zstdMinMatch <= end; {
+		length, offset := e.find(pos, end)
+
+		if length == 0 {
+			pos++
+			continue
+		}
+
+		if pos+1+zstdMinMatch <= end {
+			if n, o := e.find(pos+1, end); n > length+1 {
+				pos, length, offset = pos+1, n, o
+			}
+		}
+
+		for pos > anchor && pos > offset && e.src[pos-1] == e.src[pos-1-offset] {
+			pos--
+			length++
+		}
+
+		litLen := pos - anchor
+		literals = append(literals, e.src[anchor:pos]...)
+
+		sequences = append(sequences, zstdSequence{
+			litLen:   uint32(litLen),
+			matchLen: uint32(length),
+			offset:   uint32(e.offsetValue(offset, litLen)),
+		})
+
+		pos += length
+		anchor = pos
+	}
+
+	literals = append(literals, e.src[anchor:end]...)
+
+	return
+}
+
+// offsetValue returns the offset value encoding a match offset, preferring
+// repeat offsets, and updates them as the decoder does.
+func (e *zstdEncoder) offsetValue(offset int, litLen int) (value int) {
+	value = offset + 3
+
+	if litLen > 0 {
+		for i, r := range e.rep {
+			if r == offset {
+				value = i + 1
+				break
+			}
+		}
+	} else {
+		switch offset {
+		case e.rep[1]:
+			value = 1
+		case e.rep[2]:
+			value = 2
+		case e.rep[0] - 1:
+			value = 3
+		}
+	}
+
+	zstdRepeat(&e.rep, value, litLen)
+
+	return
+}
+
+// zstdLiteralsHeader encodes the literals section header for raw and RLE
+// literals.
+func zstdLiteralsHeader(out []byte, kind byte, size int) []byte {
+	switch {
+	case size < 32:
+		return append(out, kind|byte(size)<<3)
+	case size < 4096:
+		return append(out, kind|1<<2|byte(size)<<4, byte(size>>4))
+	default:
+		return append(out, kind|3<<2|byte(size)<<4, byte(size>>4), byte(size>>12))
+	}
+}
+
+func zstdEncodeLiterals(out []byte, literals []byte) []byte {
+	if len(literals) > 1 && zstdUniform(literals) {
+		out = zstdLiteralsHeader(out, 1, len(literals))
+		return append(out, literals[0])
+	}
+
+	if len(literals) >= 64 {
+		if compressed := zstdHuffmanLiterals(literals); compressed != nil && len(compressed) < len(literals) {
+			return append(out, compressed...)
+		}
+	}
+
+	out = zstdLiteralsHeader(out, 0, len(literals))
+
+	return append(out, literals...)
+}
+
+// zstdHuffmanLengths returns Huffman code lengths, limited to the maximum
+// supported, for at least two symbols with non-zero counts.
+func zstdHuffmanLengths(counts []int) (lengths []uint8) {
+	var symbols []int
+
+	for s, c := range counts {
+		if c > 0 {
+			symbols = append(symbols, s)
+		}
+	}
+
+	weights := make([]int, 2*len(symbols)-1)
+	parents := make([]int, len(weights))
+
+	for {
+		sort.SliceStable(symbols, func(i, j int) bool {
+			return counts[symbols[i]] < counts[symbols[j]]
+		})
+
+		for i, s := range symbols {
+			weights[i] = counts[s]
+		}
+
+		// two queues construction, leaves sorted by count
+		leaf, node := 0, len(symbols)
+
+		for n := len(symbols); n < len(weights); n++ {
+			for k := 0; k < 2; k++ {
+				if leaf < len(symbols) && (node >= n || weights[leaf] <= weights[node]) {
+					parents[leaf] = n
+					weights[n] += weights[leaf]
+					leaf++
+				} else {
+					parents[node] = n
+					weights[n] += weights[node]
+					node++
+				}
+			}
+		}
+
+		depths := make([]uint8, len(weights))
+		lengths = make([]uint8, len(counts))
+		max := uint8(0)
+
+		for n := len(weights) - 2; n >= 0; n-- {
+			depths[n] = depths[parents[n]] + 1
+		}
+
+		for i, s := range symbols {
+			lengths[s] = depths[i]
+
+			if depths[i] > max {
+				max = depths[i]
+			}
+		}
+
+		if max <= zstdMaxHuffmanBits {
+			return
+		}
+
+		// flatten the distribution until the lengths fit
+		for _, s := range symbols {
+			counts[s] = (counts[s] + 1) / 2
+		}
+
+		for i := range weights {
+			weights[i] = 0
+		}
+	}
+}
+
+// zstdHuffmanTree returns the description of Huffman weights, omitting the
+// last one, nil if they cannot be described.
+func zstdHuffmanTree(weights []uint8) []byte {
+	if len(weights) >= 2 {
+		counts := make([]int, zstdMaxHuffmanBits+1)
+		max := 0
+
+		for _, w := range weights {
+			counts[w]++
+
+			if counts[w] > max {
+				max = counts[w]
+			}
+		}
+
+		// reference encoder heuristics for compressible weights
+		if max > 1 && max < len(weights) {
+			maxSymbol := 0
+
+			for w, c := range counts {
+				if c > 0 {
+					maxSymbol = w
+				}
+			}
+
+			log := zstdTableLog(6, len(weights), maxSymbol)
+			norm := zstdNormalize(counts[:maxSymbol+1], len(weights), log)
+			e := newZstdFSEEncoder(norm, log)
+			w := &zstdBitWriter{}
+
+			// interleaved states, encoded in reverse
+			var states [2]uint32
+			n := len(weights)
+
+			if n%2 == 1 {
+				states[0] = e.init(weights[n-1])
+				states[1] = e.init(weights[n-2])
+				e.encode(w, &states[0], weights[n-3])
+				n -= 3
+			} else {
+				states[1] = e.init(weights[n-1])
+				states[0] = e.init(weights[n-2])
+				n -= 2
+			}
+
+			for ; n > 0; n -= 2 {
+				e.encode(w, &states[1], weights[n-1])
+				e.encode(w, &states[0], weights[n-2])
+			}
+
+			e.flush(w, states[1])
+			e.flush(w, states[0])
+
+			tree := append(zstdWriteNCount(norm, log), w.close()...)
+
+			if len(tree) < 128 && len(tree) < len(weights)/2 {
+				return append([]byte{byte(len(tree))}, tree...)
+			}
+		}
+	}
+
+	if len(weights) > 128 {
+		return nil
+	}
+
+	tree := []byte{byte(127 + len(weights))}
+
+	for i := 0; i < len(weights); i += 2 {
+		b := weights[i] << 4
+
+		if i+1 < len(weights) {
+			b |= weights[i+1]
+		}
+
+		tree = append(tree, b)
+	}
+
+	return tree
+}
+
+// zstdHuffmanLiterals returns the Huffman compressed literals section, nil
+// if the literals cannot be compressed.
+func zstdHuffmanLiterals(literals []byte) (out []byte) {
+	counts := make([]int, 256)
+	maxSymbol := 0
+
+	for _, b := range literals {
+		counts[b]++
+
+		if int(b) > maxSymbol {
+			maxSymbol = int(b)
+		}
+	}
+
+	lengths := zstdHuffmanLengths(counts[:maxSymbol+1])
+	maxBits := uint8(0)
+
+	for _, l := range lengths {
+		if l > maxBits {
+			maxBits = l
+		}
+	}
+
+	weights := make([]uint8, len(lengths))
+
+	for s, l := range lengths {
+		if l > 0 {
+			weights[s] = maxBits + 1 - l
+		}
+	}
+
+	tree := zstdHuffmanTree(weights[:maxSymbol])
+
+	if tree == nil {
+		return nil
+	}
+
+	// canonical codes, by increasing weight and symbol
+	codes := make([]uint64, len(weights))
+	pos := 0
+
+	for w := uint8(1); w <= maxBits; w++ {
+		for s, sw := range weights {
+			if sw == w {
+				codes[s] = uint64(pos >> (w - 1))
+				pos += 1 << (w - 1)
+			}
+		}
+	}
+
+	stream := func(data []byte) []byte {
+		w := &zstdBitWriter{}
+
+		for i := len(data) - 1; i >= 0; i-- {
+			w.add(codes[data[i]], uint(lengths[data[i]]))
+		}
+
+		return w.close()
+	}
+
+	var format uint64
+	var fieldSize uint
+	compressed := tree
+
+	if len(literals) < 256 {
+		compressed = append(compressed, stream(literals)...)
+		fieldSize = 10
+	} else {
+		segment := (len(literals) + 3) / 4
+		var streams [][]byte
+
+		for i := 0; i < 4; i++ {
+			end := (i + 1) * segment
+
+			if i == 3 {
+				end = len(literals)
+			}
+
+			streams = append(streams, stream(literals[i*segment:end]))
+		}
+
+		for _, s := range streams[:3] {
+			if len(s) > math.MaxUint16 {
+				return nil
+			}
+
+			compressed = append(compressed, byte(len(s)), byte(len(s)>>8))
+		}
+
+		for _, s := range streams {
+			compressed = append(compressed, s...)
+		}
+
+		switch size := len(literals); {
+		case size < 1024 && len(compressed) < 1024:
+			format, fieldSize = 1, 10
+		case size < 16384 && len(compressed) < 16384:
+			format, fieldSize = 2, 14
+		default:
+			format, fieldSize = 3, 18
+		}
+	}
+
+	if len(compressed) >= 1<<fieldSize {
+		return nil
+	}
+
+	header := 2 | format<<2 | uint64(len(literals))<<4 | uint64(len(compressed))<<(4+fieldSize)
+
+	for i := uint(0); i < (4+2*fieldSize+7)/8; i++ {
+		out = append(out, byte(header>>(8*i)))
+	}
+
+	return append(out, compressed...)
+}
+
+func zstdLLCode(litLen uint32) uint8 {
+	if litLen < 16 {
+		return uint8(litLen)
+	}
+
+	if litLen >= 64 {
+		return uint8(zstdHighBit(litLen) + 19)
+	}
+
+	code := uint8(16)
+
+	for code < 35 && zstdLLBase[code+1] <= litLen {
+		code++
+	}
+
+	return code
+}
+
+func zstdMLCode(matchLen uint32) uint8 {
+	base := matchLen - 3
+
+	if base < 32 {
+		return uint8(base)
+	}
+
+	if base >= 128 {
+		return uint8(zstdHighBit(base) + 36)
+	}
+
+	code := uint8(32)
+
+	for code < 52 && zstdMLBase[code+1] <= matchLen {
+		code++
+	}
+
+	return code
+}
+
+// zstdSymbolTable selects the cheapest encoding of a sequence symbol
+// stream, returning its mode, description and encoder.
+func zstdSymbolTable(kind zstdSequenceKind, codes []uint8) (mode byte, description []byte, e *zstdFSEEncoder) {
+	counts := make([]int, kind.maxSymbol+1)
+	maxSymbol := 0
+	distinct := 0
+
+	for _, c := range codes {
+		if counts[c] == 0 {
+			distinct++
+		}
+
+		counts[c]++
+
+		if int(c) > maxSymbol {
+			maxSymbol = int(c)
+		}
+	}
+
+	if distinct == 1 {
+		return zstdModeRLE, []byte{codes[0]}, nil
+	}
+
+	counts = counts[:maxSymbol+1]
+	log := zstdTableLog(kind.maxLog, len(codes), maxSymbol)
+	norm := zstdNormalize(counts, len(codes), log)
+	description = zstdWriteNCount(norm, log)
+
+	custom := zstdCost(counts, norm, log) + float64(8*len(description))
+	predefined := zstdCost(counts, kind.predefined, kind.predefinedLog)
+
+	if predefined <= custom {
+		return zstdModePredefined, nil, newZstdFSEEncoder(kind.predefined, kind.predefinedLog)
+	}
+
+	return zstdModeCompressed, description, newZstdFSEEncoder(norm, log)
+}
+
+func zstdEncodeSequences(out []byte, sequences []zstdSequence) []byte {
+	n := len(sequences)
+
+	switch {
+	case n < 128:
+		out = append(out, byte(n))
+	case n < 0x7f00:
+		out = append(out, byte(n>>8+128), byte(n))
+	default:
+		out = append(out, 255, byte(n-0x7f00), byte((n-0x7f00)>>8))
+	}
+
+	if n == 0 {
+		return out
+	}
+
+	llCodes := make([]uint8, n)
+	ofCodes := make([]uint8, n)
+	mlCodes := make([]uint8, n)
+
+	for i, s := range sequences {
+		llCodes[i] = zstdLLCode(s.litLen)
+		ofCodes[i] = uint8(zstdHighBit(s.offset))
+		mlCodes[i] = zstdMLCode(s.matchLen)
+	}
+
+	modes := byte(0)
+	encoders := make([]*zstdFSEEncoder, 3)
+	var descriptions []byte
+
+	for i, k := range []struct {
+		kind  zstdSequenceKind
+		codes []uint8
+	}{{zstdLL, llCodes}, {zstdOF, ofCodes}, {zstdML, mlCodes}} {
+		mode, description, e := zstdSymbolTable(k.kind, k.codes)
+		modes |= mode << (6 - 2*i)
+		descriptions = append(descriptions, description...)
+		encoders[i] = e
+	}
+
+	out = append(out, modes)
+	out = append(out, descriptions...)
+
+	// RLE streams have no state bits
+	var states [3]uint32
+	codes := [3][]uint8{llCodes, ofCodes, mlCodes}
+
+	encode := func(w *zstdBitWriter, i int, j int) {
+		if encoders[i] != nil {
+			encoders[i].encode(w, &states[i], codes[i][j])
+		}
+	}
+
+	extra := func(w *zstdBitWriter, j int) {
+		s := sequences[j]
+		w.add(uint64(s.litLen-zstdLLBase[llCodes[j]]), uint(zstdLLBits[llCodes[j]]))
+		w.add(uint64(s.matchLen-zstdMLBase[mlCodes[j]]), uint(zstdMLBits[mlCodes[j]]))
+		w.add(uint64(s.offset), uint(ofCodes[j]))
+	}
+
+	for i, e := range encoders {
+		if e != nil {
+			states[i] = e.init(codes[i][n-1])
+		}
+	}
+
+	w := &zstdBitWriter{}
+	extra(w, n-1)
+
+	for j := n - 2; j >= 0; j-- {
+		encode(w, 1, j)
+		encode(w, 2, j)
+		encode(w, 0, j)
+		extra(w, j)
+	}
+
+	for _, i := range []int{2, 1, 0} {
+		if encoders[i] != nil {
+			encoders[i].flush(w, states[i])
+		}
+	}
+
+	return append(out, w.close()...)
+}
+
+// xxhash64 returns the XXH64 digest (seed 0) used by zstd content checksums.
+func xxhash64(data []byte) (h uint64) {
+	const (
+		p1 = 11400714785074694791
+		p2 = 14029467366897019727
+		p3 = 1609587929392839161
+		p4 = 9650029242287828579
+		p5 = 2870177450012600261
+	)
+
+	round := func(acc uint64, input uint64) uint64 {
+		return bits.RotateLeft64(acc+input*p2, 31) * p1
+	}
+
+	merge := func(acc uint64, v uint64) uint64 {
+		return (acc^round(0, v))*p1 + p4
+	}
+
+	n := uint64(len(data))
+
+	if len(data) >= 32 {
+		v := [4]uint64{p1, p2, 0, 0}
+		v[0] += p2
+		v[3] -= p1
+
+		for ; len(data) >= 32; data = data[32:] {
+			for i := range v {
+				v[i] = round(v[i], binary.LittleEndian.Uint64(data[8*i:]))
+			}
+		}
+
+		h = bits.RotateLeft64(v[0], 1) + bits.RotateLeft64(v[1], 7) + bits.RotateLeft64(v[2], 12) + bits.RotateLeft64(v[3], 18)
+
+		for i := range v {
+			h = merge(h, v[i])
+		}
+	} else {
+		h = p5
+	}
+
+	h += n
+
+	for ; len(data) >= 8; data = data[8:] {
+		h ^= round(0, binary.LittleEndian.Uint64(data))
+		h = bits.RotateLeft64(h, 27)*p1 + p4
+	}
+
+	if len(data) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(data)) * p1
+		h = bits.RotateLeft64(h, 23)*p2 + p3
+		data = data[4:]
+	}
+
+	for _, b := range data {
+		h ^= uint64(b) * p5
+		h = bits.RotateLeft64(h, 11) * p1
+	}
+
+	h ^= h >> 33
+	h *= p2
+	h ^= h >> 29
+	h *= p3
+	h ^= h >> 32
+
+	return
+}
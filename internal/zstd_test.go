@@ -0,0 +1,181 @@
+// INTERLOCK | https://github.com/f-secure-foundry/interlock
+// Copyright (c) F-Secure Corporation
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// reference encoder (zstd 1.5) output, at levels 1 (without checksum) and 19
+// (with checksum), of the same 67672 bytes text
+const zstdSampleHash = "e253a4e9ae459b86e0e02ed389b124e6fd2c4cdf2027d432ca32c13e48a83681"
+
+var zstdSamples = []string{"sample-1.zst", "sample-19.zst"}
+
+func zstdInputs() (inputs [][]byte) {
+	r := rand.New(rand.NewSource(1))
+
+	random := make([]byte, 200*1024)
+	r.Read(random)
+
+	// matches, repeat offsets and literals across multiple blocks
+	var mixed []byte
+
+	for len(mixed) < 300*1024 {
+		if len(mixed) > 64 && r.Intn(2) == 0 {
+			offset := 1 + r.Intn(len(mixed)-1)
+
+			for i := 0; i < 4+r.Intn(60); i++ {
+				mixed = append(mixed, mixed[len(mixed)-offset])
+			}
+		} else {
+			for i := 0; i < 1+r.Intn(20); i++ {
+				mixed = append(mixed, byte('a'+r.Intn(26)))
+			}
+		}
+	}
+
+	inputs = append(inputs,
+		[]byte{},
+		[]byte{0x42},
+		bytes.Repeat([]byte{0xaa}, zstdMaxBlockSize+1),
+		[]byte(strings.Repeat(testCleartext, 1000)),
+		random,
+		mixed,
+		append(append([]byte{}, random[:1000]...), mixed...),
+	)
+
+	return
+}
+
+func TestZstd(t *testing.T) {
+	inputs := zstdInputs()
+
+	for i, data := range inputs {
+		compressed := zstdCompress(data)
+
+		// incompressible blocks are stored raw
+		if len(compressed) > len(data)+64 {
+			t.Errorf("input %d: output expansion (%d -> %d)", i, len(data), len(compressed))
+		}
+
+		d, err := zstdDecompress(compressed, len(data))
+
+		if err != nil {
+			t.Fatalf("input %d: %v", i, err)
+		}
+
+		if !bytes.Equal(d, data) {
+			t.Fatalf("input %d: round trip mismatch", i)
+		}
+
+		if len(data) > 0 {
+			if _, err = zstdDecompress(compressed, len(data)-1); err == nil {
+				t.Errorf("input %d: output limit not enforced", i)
+			}
+		}
+	}
+
+	if text := inputs[3]; len(zstdCompress(text)) > len(text)/50 {
+		t.Error("repetitive input not compressed")
+	}
+
+	for _, name := range zstdSamples {
+		compressed, err := ioutil.ReadFile(filepath.Join("testdata", "zstd", name))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d, err := zstdDecompress(compressed, 1<<20)
+
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		sum := sha256.Sum256(d)
+
+		if hex.EncodeToString(sum[:]) != zstdSampleHash {
+			t.Fatalf("%s: decompressed data mismatch", name)
+		}
+
+		// the trailing checksum, truncation and bit flips must be detected
+		// (or at least never panic)
+		tampered := append([]byte{}, compressed...)
+		tampered[len(tampered)-1] ^= 0x01
+
+		if name == "sample-19.zst" {
+			if _, err = zstdDecompress(tampered, 1<<20); err == nil {
+				t.Errorf("%s: checksum mismatch not detected", name)
+			}
+		}
+
+		if _, err = zstdDecompress(compressed[:len(compressed)-10], 1<<20); err == nil {
+			t.Errorf("%s: truncation not detected", name)
+		}
+
+		r := rand.New(rand.NewSource(2))
+
+		for i := 0; i < 1000; i++ {
+			corrupted := append([]byte{}, compressed...)
+			corrupted[r.Intn(len(corrupted))] ^= byte(1 << uint(r.Intn(8)))
+			zstdDecompress(corrupted, 1<<20)
+		}
+	}
+
+	// skippable frames are ignored, concatenated frames joined
+	skippable := []byte{0x50, 0x2a, 0x4d, 0x18, 0x03, 0x00, 0x00, 0x00, 1, 2, 3}
+	frames := append(append(zstdCompress([]byte("INTER")), skippable...), zstdCompress([]byte("LOCK"))...)
+
+	if d, err := zstdDecompress(frames, 16); err != nil || string(d) != "INTERLOCK" {
+		t.Errorf("multiple frames not decoded (%q, %v)", d, err)
+	}
+}
+
+// TestZstdReference checks the encoder output against the reference decoder
+// when available.
+func TestZstdReference(t *testing.T) {
+	zstd, err := exec.LookPath("zstd")
+
+	if err != nil {
+		t.Skip("zstd not available")
+	}
+
+	tmp, err := ioutil.TempFile("", "interlock_zstd_")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(tmp.Name())
+	tmp.Close()
+
+	for i, data := range zstdInputs() {
+		if err = ioutil.WriteFile(tmp.Name(), zstdCompress(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		d, err := exec.Command(zstd, "-q", "-d", "-c", tmp.Name()).Output()
+
+		if err != nil {
+			t.Fatalf("input %d: %v", i, err)
+		}
+
+		if !bytes.Equal(d, data) {
+			t.Fatalf("input %d: reference decoder mismatch", i)
+		}
+	}
+}